@@ -67,13 +67,20 @@ func runInteractive(addr string) {
 	fmt.Println("Type commands to interact with the cache server.")
 	fmt.Println("Type 'quit' to exit.")
 	fmt.Println("\nAvailable command types:")
-	fmt.Println("  Strings: SET key value [ttl], GET key, DEL key")
+	fmt.Println("  Strings: SET key value [ttl|EX s|PX ms] [NX|XX], GET key, DEL key [key ...], EXISTS key [key ...]")
+	fmt.Println("  Expiry: EXPIRE key seconds, PEXPIRE key ms, EXPIREAT key unix, TTL key, PTTL key, PERSIST key")
 	fmt.Println("  Lists: LPUSH key value, LPOP key")
 	fmt.Println("  Sets: SADD key member, SMEMBERS key")
-	fmt.Println("  Hashes: HSET key field value, HGET key field")
+	fmt.Println("  Hashes: HSET key field value [field value ...], HGET key field")
+	fmt.Println("  Sorted sets: ZADD key score member, ZRANGE key start stop [WITHSCORES], ZRANGEBYSCORE key min max, ZRANK key member, ZINCRBY key incr member, ZREM key member")
+	fmt.Println("  Geo: GEOADD key lon lat member, GEODIST key m1 m2 [m|km|ft|mi], GEOPOS key member, GEOSEARCH key FROMMEMBER m|FROMLONLAT lon lat BYRADIUS r unit|BYBOX w h unit [ASC|DESC] [COUNT n] [WITHDIST]")
+	fmt.Println("  Streams: XADD key [MAXLEN n] *|id field value, XRANGE key start end, XREAD [BLOCK ms] STREAMS key id, XGROUP CREATE key group id, XREADGROUP GROUP group consumer STREAMS key >, XACK key group id, XPENDING key group")
 	fmt.Println("  Pub/Sub: SUBSCRIBE channel, PUBLISH channel message")
 	fmt.Println("  Scripts: EVAL script numkeys key arg")
-	fmt.Println("  Info: INFO, PING")
+	fmt.Println("  Persistence: SAVE, BGSAVE, LASTSAVE, BGREWRITEAOF, BACKUP LIST, BACKUP RESTORE name")
+	fmt.Println("  Replication: ROLE, INFO replication")
+	fmt.Println("  Cluster: CLUSTER NODES, CLUSTER INFO, CLUSTER MYID, CLUSTER FORGET id, CLUSTER SLOTS, CLUSTER SHARDS, CLUSTER KEYSLOT key, CLUSTER ADDSLOTS slot ..., CLUSTER SETSLOT slot NODE|MIGRATING|IMPORTING id, CLUSTER GETKEYSINSLOT slot count, MIGRATE host port key 0 timeout")
+	fmt.Println("  Info: INFO [section], PING, ECHO message, COMMAND")
 
 	scanner := bufio.NewScanner(os.Stdin)
 	reader := bufio.NewReader(conn)
@@ -3,6 +3,7 @@ package cmd
 import (
 	"log"
 "fmt"
+	"time"
 	"github.com/spf13/cobra"
 
 	"boltcache/config"
@@ -13,14 +14,17 @@ var (
 	nodeID   string
 	nodePort int
 	replicas []string
+	master   string
+	join     []string
+	slots    string
 )
 
 var clusterCmd = &cobra.Command{
 	Use:   "cluster",
 	Short: "Start a BoltCache cluster node",
 	Run: func(cmd *cobra.Command, args []string) {
-		if nodeID == "" || nodePort == 0 {
-			log.Fatalf("Both --node and --port must be specified")
+		if nodePort == 0 {
+			log.Fatalf("--port must be specified")
 		}
 
 		cfg, err := config.LoadConfig(configFile)
@@ -29,12 +33,65 @@ var clusterCmd = &cobra.Command{
 		}
 fmt.Print(replicas)
 
-		server.RunClusterCMD(cfg, nodeID, nodePort, replicas)
+		server.RunClusterCMD(cfg, server.ClusterOptions{
+			NodeID:   nodeID,
+			Port:     nodePort,
+			Replicas: replicas,
+			Master:   master,
+			Join:     join,
+			Slots:    slots,
+		})
+	},
+}
+
+var (
+	reshardAddr     string
+	reshardFrom     string
+	reshardTo       string
+	reshardSlots    int
+	reshardPipeline int
+	reshardTimeout  time.Duration
+)
+
+var reshardCmd = &cobra.Command{
+	Use:   "reshard",
+	Short: "Move hash slots and their keys from one master to another",
+	Long: "Moves --slots hash slots, lowest first, from the master --from to the master --to " +
+		"while both keep serving traffic. Clients are redirected with ASK for keys already moved. " +
+		"--addr may be any node of the cluster.",
+	Run: func(cmd *cobra.Command, args []string) {
+		err := server.Reshard(reshardAddr, server.ReshardOptions{
+			From:     reshardFrom,
+			To:       reshardTo,
+			Slots:    reshardSlots,
+			Pipeline: reshardPipeline,
+			Timeout:  reshardTimeout,
+		}, func(slot, keys int) {
+			log.Printf("Moved slot %d with %d keys", slot, keys)
+		})
+		if err != nil {
+			log.Fatalf("Reshard failed: %v", err)
+		}
+		log.Printf("Moved %d slots from %s to %s", reshardSlots, reshardFrom, reshardTo)
 	},
 }
 
 func init() {
-	clusterCmd.Flags().StringVar(&nodeID, "node", "", "Cluster node ID")
+	clusterCmd.Flags().StringVar(&nodeID, "node", "", "Cluster node ID (default cluster.node_id)")
 	clusterCmd.Flags().IntVar(&nodePort, "port", 0, "Cluster node port")
 	clusterCmd.Flags().StringSliceVar(&replicas, "replica", nil, "Add replicas (comma separated)")
+	clusterCmd.Flags().StringVar(&master, "master", "", "Run as a replica of the master at this address")
+	clusterCmd.Flags().StringSliceVar(&join, "join", nil, "Join the cluster through these nodes (comma separated)")
+	clusterCmd.Flags().StringVar(&slots, "slots", "", "Hash slots this node serves, e.g. 0-5460")
+
+	reshardCmd.Flags().StringVar(&reshardAddr, "addr", "localhost:6380", "Address of any cluster node")
+	reshardCmd.Flags().StringVar(&reshardFrom, "from", "", "ID of the master to move slots from")
+	reshardCmd.Flags().StringVar(&reshardTo, "to", "", "ID of the master to move slots to")
+	reshardCmd.Flags().IntVar(&reshardSlots, "slots", 0, "Number of slots to move")
+	reshardCmd.Flags().IntVar(&reshardPipeline, "pipeline", 100, "Keys moved per MIGRATE")
+	reshardCmd.Flags().DurationVar(&reshardTimeout, "timeout", 5*time.Second, "Timeout of each MIGRATE")
+	reshardCmd.MarkFlagRequired("from")
+	reshardCmd.MarkFlagRequired("to")
+	reshardCmd.MarkFlagRequired("slots")
+	clusterCmd.AddCommand(reshardCmd)
 }
@@ -29,4 +29,5 @@ func init() {
 	rootCmd.AddCommand(clusterCmd)
 	rootCmd.AddCommand(clientCmd)
 	rootCmd.AddCommand(configCmd)
+	rootCmd.AddCommand(dataCmd)
 }
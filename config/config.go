@@ -48,6 +48,11 @@ type CacheConfig struct {
 	CleanupInterval   time.Duration `yaml:"cleanup_interval"`
 	EvictionPolicy    string        `yaml:"eviction_policy"`
 	EvictionThreshold float64       `yaml:"eviction_threshold"`
+
+	// Active expiration runs every ActiveExpireInterval and may spend at
+	// most ActiveExpireBudget removing expired keys per run.
+	ActiveExpireInterval time.Duration `yaml:"active_expire_interval"`
+	ActiveExpireBudget   time.Duration `yaml:"active_expire_budget"`
 }
 
 type PersistenceConfig struct {
@@ -57,6 +62,11 @@ type PersistenceConfig struct {
 	Compression bool           `yaml:"compression"`
 	BackupCount int            `yaml:"backup_count"`
 	Snapshot    SnapshotConfig `yaml:"snapshot"`
+	AOF         AOFConfig      `yaml:"aof"`
+
+	// Snapshots are compressed with CompressionAlgorithm, zstd or gzip,
+	// when Compression is set.
+	CompressionAlgorithm string `yaml:"compression_algorithm"`
 
 	// Cleanup starts only when the total number of backup files
 	// exceeds this value.
@@ -64,10 +74,31 @@ type PersistenceConfig struct {
 	CleanupWhenExceeds int `yaml:"cleanup_when_exceeds"`
 }
 
+// AOFConfig configures the append-only file. Every write is appended to
+// File and the log is replayed on startup.
+type AOFConfig struct {
+	Enabled bool   `yaml:"enabled"`
+	File    string `yaml:"file"`
+
+	// AppendFsync is always (fsync every write), everysec or no (leave
+	// flushing to the OS).
+	AppendFsync string `yaml:"appendfsync"`
+
+	// The log is rewritten in the background once it is at least
+	// RewriteMinSize and has grown by RewritePercentage percent since the
+	// last rewrite. A zero percentage disables automatic rewrites.
+	RewritePercentage int    `yaml:"auto_rewrite_percentage"`
+	RewriteMinSize    string `yaml:"auto_rewrite_min_size"`
+}
+
 type SnapshotConfig struct {
 	Enabled   bool          `yaml:"enabled"`
 	Interval  time.Duration `yaml:"interval"`
 	Directory string        `yaml:"directory"`
+
+	// Keep is the number of snapshots kept in Directory; older ones are
+	// deleted. Zero keeps all of them.
+	Keep int `yaml:"keep"`
 }
 
 type ClusterConfig struct {
@@ -75,17 +106,90 @@ type ClusterConfig struct {
 	NodeID      string            `yaml:"node_id"`
 	Replication ReplicationConfig `yaml:"replication"`
 	Discovery   DiscoveryConfig   `yaml:"discovery"`
+
+	// Announce is the address other nodes reach this node's TCP port at;
+	// it defaults to the TCP host and port.
+	Announce string `yaml:"announce"`
+
+	// Nodes exchange heartbeats every HeartbeatInterval; a node not heard
+	// from for NodeTimeout is marked failed.
+	HeartbeatInterval time.Duration `yaml:"heartbeat_interval"`
+	NodeTimeout       time.Duration `yaml:"node_timeout"`
+
+	Consensus    ConsensusConfig    `yaml:"consensus"`
+	ActiveActive ActiveActiveConfig `yaml:"active_active"`
+}
+
+// ActiveActiveConfig makes this master accept writes alongside the
+// masters at Peers, their TCP addresses. The masters exchange their writes
+// and merge them as CRDTs, so they converge whatever order writes arrive
+// in. It is off without peers.
+type ActiveActiveConfig struct {
+	Peers []string `yaml:"peers"`
+
+	// BacklogSize bounds the writes kept for peers that fall behind; a
+	// peer further behind reconnects and gets the full state again.
+	BacklogSize string `yaml:"backlog_size"`
+}
+
+// ConsensusConfig puts keyspaces under Raft consensus. Writes to keys
+// starting with one of Prefixes go through a Raft log replicated to
+// Peers, and reads of them are linearizable. It is off without prefixes.
+type ConsensusConfig struct {
+	Prefixes []string `yaml:"prefixes"`
+
+	// Peers are the TCP addresses of the Raft members, this node's
+	// cluster address included.
+	Peers []string `yaml:"peers"`
+
+	// Directory keeps the Raft term, vote, log and snapshots.
+	Directory string `yaml:"directory"`
+
+	// A follower not hearing from the leader for ElectionTimeout starts
+	// an election. The log is compacted into a snapshot every
+	// SnapshotEntries applied entries.
+	ElectionTimeout time.Duration `yaml:"election_timeout"`
+	SnapshotEntries int           `yaml:"snapshot_entries"`
 }
 
 type ReplicationConfig struct {
 	Enabled  bool     `yaml:"enabled"`
 	Mode     string   `yaml:"mode"`
 	Replicas []string `yaml:"replicas"`
+
+	// Role is master or replica. A replica copies the master at Master,
+	// the address of its TCP port, and rejects writes.
+	Role   string `yaml:"role"`
+	Master string `yaml:"master"`
+
+	// BacklogSize bounds the writes kept for replicas that reconnect;
+	// a replica further behind gets a full resync.
+	BacklogSize string `yaml:"backlog_size"`
+
+	// In sync mode a write is answered once the replicas acknowledged
+	// it, or after SyncTimeout. The number of replicas waited for is the
+	// length of Replicas, or every connected replica when it is empty.
+	SyncTimeout time.Duration `yaml:"sync_timeout"`
+
+	// Replicas compare their dataset with the master's every
+	// AntiEntropyInterval and repair the keys that differ; 0 disables it.
+	AntiEntropyInterval time.Duration `yaml:"anti_entropy_interval"`
 }
 
+// DiscoveryConfig finds the other nodes of the cluster. Method is static,
+// dns, file, consul or etcd, and Endpoints are respectively the node
+// addresses, DNS SRV names, files listing node addresses, or the HTTP
+// URLs of the Consul or etcd servers.
 type DiscoveryConfig struct {
 	Method    string   `yaml:"method"`
 	Endpoints []string `yaml:"endpoints"`
+
+	// Prefix is the key prefix nodes register under in Consul or etcd.
+	Prefix string `yaml:"prefix"`
+
+	// Nodes are looked up again every Interval; registrations in Consul
+	// or etcd expire when not renewed for three intervals.
+	Interval time.Duration `yaml:"interval"`
 }
 
 type SecurityConfig struct {
@@ -3,6 +3,8 @@ package config
 import (
 	"fmt"
 	"os"
+	"strconv"
+	"strings"
 	"time"
 
 	"gopkg.in/yaml.v3"
@@ -39,14 +41,53 @@ func LoadConfig(filename string) (*Config, error) {
 			CleanupInterval:   time.Minute,
 			EvictionPolicy:    "lru",
 			EvictionThreshold: 0.8,
+
+			ActiveExpireInterval: 100 * time.Millisecond,
+			ActiveExpireBudget:   25 * time.Millisecond,
 		},
 		Persistence: PersistenceConfig{
-			Enabled:     true,
-			File:        "./data/boltcache.json",
-			Interval:    30 * time.Second,
-			Compression: true,
-			BackupCount: 3,
-			CleanupWhenExceeds: 20,
+			Enabled:              true,
+			File:                 "./data/boltcache.json",
+			Interval:             30 * time.Second,
+			Compression:          true,
+			CompressionAlgorithm: "zstd",
+			BackupCount:          3,
+			CleanupWhenExceeds:   20,
+			AOF: AOFConfig{
+				File:              "./data/appendonly.aof",
+				AppendFsync:       "everysec",
+				RewritePercentage: 100,
+				RewriteMinSize:    "64MB",
+			},
+			Snapshot: SnapshotConfig{
+				Interval:  5 * time.Minute,
+				Directory: "./snapshots",
+				Keep:      5,
+			},
+		},
+		Cluster: ClusterConfig{
+			HeartbeatInterval: time.Second,
+			NodeTimeout:       5 * time.Second,
+			Replication: ReplicationConfig{
+				Mode:                "async",
+				Role:                "master",
+				BacklogSize:         "1MB",
+				SyncTimeout:         time.Second,
+				AntiEntropyInterval: time.Minute,
+			},
+			Discovery: DiscoveryConfig{
+				Method:   "static",
+				Prefix:   "boltcache/nodes/",
+				Interval: 10 * time.Second,
+			},
+			Consensus: ConsensusConfig{
+				Directory:       "./data/raft",
+				ElectionTimeout: time.Second,
+				SnapshotEntries: 10000,
+			},
+			ActiveActive: ActiveActiveConfig{
+				BacklogSize: "1MB",
+			},
 		},
 		Features: FeaturesConfig{
 			LuaScripting: true,
@@ -99,6 +140,115 @@ func (c *Config) Validate() error {
 		return fmt.Errorf("eviction threshold must be between 0.1 and 1.0")
 	}
 
+	// Validate memory limits
+	if _, err := ParseMemorySize(c.Cache.MaxMemory); err != nil {
+		return fmt.Errorf("invalid max_memory: %v", err)
+	}
+	if c.Cache.MaxKeys < 0 {
+		return fmt.Errorf("max_keys must not be negative")
+	}
+
+	// Validate snapshots
+	switch c.Persistence.CompressionAlgorithm {
+	case "zstd", "gzip":
+	default:
+		return fmt.Errorf("invalid compression_algorithm: %s", c.Persistence.CompressionAlgorithm)
+	}
+	if c.Persistence.Snapshot.Keep < 0 {
+		return fmt.Errorf("snapshot keep must not be negative")
+	}
+
+	// Validate the append-only file
+	if c.Persistence.AOF.Enabled {
+		switch c.Persistence.AOF.AppendFsync {
+		case "always", "everysec", "no":
+		default:
+			return fmt.Errorf("invalid appendfsync: %s", c.Persistence.AOF.AppendFsync)
+		}
+		if c.Persistence.AOF.File == "" {
+			return fmt.Errorf("aof file must be set")
+		}
+		if _, err := ParseMemorySize(c.Persistence.AOF.RewriteMinSize); err != nil {
+			return fmt.Errorf("invalid auto_rewrite_min_size: %v", err)
+		}
+	}
+
+	// Validate cluster
+	if c.Cluster.Enabled {
+		if c.Cluster.NodeID == "" || strings.ContainsAny(c.Cluster.NodeID, " \t\r\n") {
+			return fmt.Errorf("cluster node_id must be set and contain no spaces")
+		}
+		if c.Cluster.HeartbeatInterval <= 0 || c.Cluster.NodeTimeout <= c.Cluster.HeartbeatInterval {
+			return fmt.Errorf("cluster node_timeout must exceed heartbeat_interval")
+		}
+	}
+
+	// Validate discovery
+	switch d := c.Cluster.Discovery; d.Method {
+	case "", "static":
+	case "dns", "file", "consul", "etcd":
+		if len(d.Endpoints) == 0 {
+			return fmt.Errorf("discovery endpoints must be set for method %s", d.Method)
+		}
+	default:
+		return fmt.Errorf("invalid discovery method: %s", d.Method)
+	}
+
+	// Validate consensus
+	if cons := c.Cluster.Consensus; len(cons.Prefixes) > 0 {
+		if len(cons.Peers) == 0 {
+			return fmt.Errorf("consensus peers must be set")
+		}
+		for _, p := range cons.Prefixes {
+			if p == "" {
+				return fmt.Errorf("consensus prefixes must not be empty")
+			}
+		}
+	}
+
+	// Validate active-active replication
+	if aa := c.Cluster.ActiveActive; len(aa.Peers) > 0 {
+		if c.Cluster.NodeID == "" || strings.ContainsAny(c.Cluster.NodeID, " \t\r\n") {
+			return fmt.Errorf("active-active replication needs a cluster node_id without spaces")
+		}
+		if repl := c.Cluster.Replication; repl.Enabled && repl.Role == "replica" {
+			return fmt.Errorf("active-active replication runs on masters only")
+		}
+		if _, err := ParseMemorySize(aa.BacklogSize); err != nil {
+			return fmt.Errorf("invalid active_active backlog_size: %v", err)
+		}
+	}
+
+	// Validate replication
+	if repl := c.Cluster.Replication; repl.Enabled {
+		switch repl.Mode {
+		case "sync", "async":
+		default:
+			return fmt.Errorf("invalid replication mode: %s", repl.Mode)
+		}
+		switch repl.Role {
+		case "master":
+		case "replica":
+			if repl.Master == "" {
+				return fmt.Errorf("replication master must be set on replicas")
+			}
+		default:
+			return fmt.Errorf("invalid replication role: %s", repl.Role)
+		}
+		if _, err := ParseMemorySize(repl.BacklogSize); err != nil {
+			return fmt.Errorf("invalid backlog_size: %v", err)
+		}
+		if repl.AntiEntropyInterval < 0 {
+			return fmt.Errorf("anti_entropy_interval must not be negative")
+		}
+	}
+
+	// Validate active expiration
+	if c.Cache.ActiveExpireBudget > 0 && c.Cache.ActiveExpireInterval > 0 &&
+		c.Cache.ActiveExpireBudget > c.Cache.ActiveExpireInterval {
+		return fmt.Errorf("active_expire_budget must not exceed active_expire_interval")
+	}
+
 	return nil
 }
 
@@ -131,31 +281,30 @@ func (c *Config) IsFeatureEnabled(feature string) bool {
 
 // Helper function to parse memory size
 func ParseMemorySize(size string) (int64, error) {
+	size = strings.TrimSpace(strings.ToUpper(size))
 	if size == "" {
 		return 0, nil
 	}
 
 	multiplier := int64(1)
-	unit := size[len(size)-2:]
-
-	switch unit {
-	case "KB":
+	switch {
+	case strings.HasSuffix(size, "KB"):
 		multiplier = 1024
 		size = size[:len(size)-2]
-	case "MB":
+	case strings.HasSuffix(size, "MB"):
 		multiplier = 1024 * 1024
 		size = size[:len(size)-2]
-	case "GB":
+	case strings.HasSuffix(size, "GB"):
 		multiplier = 1024 * 1024 * 1024
 		size = size[:len(size)-2]
-	default:
+	case strings.HasSuffix(size, "B"):
 		// Assume bytes
-		if size[len(size)-1:] == "B" {
-			size = size[:len(size)-1]
-		}
+		size = size[:len(size)-1]
 	}
 
-	var value int64
-	fmt.Sscanf(size, "%d", &value)
+	value, err := strconv.ParseInt(strings.TrimSpace(size), 10, 64)
+	if err != nil || value < 0 {
+		return 0, fmt.Errorf("invalid memory size: %q", size)
+	}
 	return value * multiplier, nil
 }
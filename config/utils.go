@@ -38,7 +38,9 @@ cache:
   # TTL Settings
   default_ttl: "0s"  # 0 = no expiration
   max_ttl: "24h"
-  cleanup_interval: "1m"
+  cleanup_interval: "1m"        # How often expired-key totals are logged
+  active_expire_interval: "100ms"  # Incremental expiration tick
+  active_expire_budget: "25ms"     # Max time spent expiring keys per tick
   
   # Eviction policy: lru, lfu, random, ttl
   eviction_policy: "lru"
@@ -6,6 +6,7 @@ require (
 	github.com/fatih/color v1.18.0
 	github.com/gorilla/mux v1.8.1
 	github.com/gorilla/websocket v1.5.1
+	github.com/klauspost/compress v1.17.11
 	github.com/mattn/go-runewidth v0.0.19
 	github.com/panjf2000/gnet/v2 v2.9.7
 	github.com/spf13/cobra v1.8.0
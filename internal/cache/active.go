@@ -0,0 +1,592 @@
+package cache
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+import (
+	config "boltcache/config"
+	logger "boltcache/logger"
+)
+
+// In active-active mode every master accepts writes. Each write is stamped
+// with the HLC of the node and turned into operations on the CRDT state of
+// its key (see crdt.go), which the node keeps in a backlog. A master
+// connects to each of its peers and sends
+//
+//	CRDTSYNC <node-id>
+//
+// The peer answers +CRDTSYNC <its node-id>, sends the operations making up
+// its whole state and then streams the operations of its own writes.
+// Merging an operation updates the dataset with the value derived from
+// the new state. As operations commute and are idempotent, reconnecting
+// simply starts over with the whole state.
+
+var ErrActiveDisabled = errors.New("ERR active-active replication is disabled")
+
+const (
+	// tombstoneTTL is how long the state of a deleted or expired key is
+	// kept, so that operations still on their way merge with it.
+	tombstoneTTL = time.Hour
+
+	activeSweepInterval = time.Minute
+)
+
+// activeReplication is the state of a node in active-active mode.
+type activeReplication struct {
+	node  string
+	clock hlcClock
+
+	mu   sync.Mutex
+	keys map[string]*crdtKey
+
+	feed  *replicationMaster // operations of this node's writes
+	peers []*activePeer
+
+	sent      atomic.Uint64
+	merged    atomic.Uint64
+	conflicts [conflictKinds]atomic.Uint64
+}
+
+// activePeer is the link to a peer the node merges the writes of.
+type activePeer struct {
+	addr string
+
+	mu     sync.Mutex
+	node   string
+	linkUp bool
+	since  time.Time // when the link went up or down
+}
+
+// ActiveInfo is reported by INFO.
+type ActiveInfo struct {
+	Node    string
+	Clock   HLC
+	Keys    int
+	Peers   []ActivePeerInfo
+	Pulling int // peers connected to this node
+
+	OpsSent          uint64
+	OpsMerged        uint64
+	ConflictsLWW     uint64
+	ConflictsCleared uint64
+	ConflictsAddWins uint64
+}
+
+// ActivePeerInfo describes the link to a peer.
+type ActivePeerInfo struct {
+	Addr         string
+	Node         string
+	LinkUp       bool
+	LinkDuration time.Duration
+}
+
+// StartActiveReplication makes the cache a master of an active-active
+// group, as node, merging the writes of the masters at cfg.Peers. The keys
+// already loaded count as written before any other write.
+func (c *BoltCache) StartActiveReplication(node string, cfg config.ActiveActiveConfig) error {
+	size, err := config.ParseMemorySize(cfg.BacklogSize)
+	if err != nil {
+		return err
+	}
+	if size <= 0 {
+		size = defaultBacklogSize
+	}
+	a := &activeReplication{
+		node:  node,
+		clock: hlcClock{node: node},
+		keys:  make(map[string]*crdtKey),
+		feed:  newReplicationMaster(node, size, 0),
+	}
+	for _, addr := range cfg.Peers {
+		a.peers = append(a.peers, &activePeer{addr: addr, since: time.Now()})
+	}
+
+	c.Mu.Lock()
+	seed, now := HLC{Node: node}, time.Now()
+	c.Data.Range(func(key, value interface{}) bool {
+		item := value.(*CacheItem)
+		if item.expired(now) || c.Consensus != nil && c.Consensus.Covers(key.(string)) {
+			return true
+		}
+		for _, op := range valueOps(key.(string), seed, item.Value) {
+			a.key(op.key).apply(op)
+		}
+		if !item.ExpiresAt.IsZero() {
+			a.key(key.(string)).apply(&crdtOp{name: opExp, key: key.(string), ts: seed, at: item.ExpiresAt})
+		}
+		return true
+	})
+	c.active.Store(a)
+	c.Mu.Unlock()
+
+	// Evicted keys are deleted on the peers too.
+	c.Data.OnEvict(func(key string) {
+		c.propagate("DEL", key)
+	})
+
+	for _, p := range a.peers {
+		go c.pullPeer(a, p)
+	}
+	go a.sweepLoop()
+	logger.Log("Active-active replication started as %s with peers %v", node, cfg.Peers)
+	return nil
+}
+
+// ActiveEnabled reports whether StartActiveReplication was called.
+func (c *BoltCache) ActiveEnabled() bool {
+	return c.active.Load() != nil
+}
+
+// key returns the state of key, creating it. The caller holds a.mu.
+func (a *activeReplication) key(key string) *crdtKey {
+	k := a.keys[key]
+	if k == nil {
+		k = &crdtKey{}
+		a.keys[key] = k
+	}
+	return k
+}
+
+// valueOps returns the operations writing value as a whole. Sets and
+// hashes are written member by member, so that later operations on
+// members merge with them.
+func valueOps(key string, ts HLC, value interface{}) []*crdtOp {
+	ops := []*crdtOp{{name: opReg, key: key, ts: ts}}
+	switch v := value.(type) {
+	case map[string]struct{}:
+		for m := range v {
+			ops = append(ops, &crdtOp{name: opAdd, key: key, ts: ts, member: m})
+		}
+	case map[string]string:
+		for f, val := range v {
+			ops = append(ops, &crdtOp{name: opField, key: key, ts: ts, member: f, value: val})
+		}
+	default:
+		ops[0].value = value
+	}
+	return ops
+}
+
+// commit merges an operation of this node and sends it to the peers. The
+// caller holds a.mu.
+func (a *activeReplication) commit(op *crdtOp) {
+	a.key(op.key).apply(op)
+	args, err := op.args()
+	if err != nil {
+		logger.Log("Cannot replicate write to %s: %v", op.key, err)
+		return
+	}
+	a.feed.write(args)
+	a.sent.Add(1)
+}
+
+// record turns a write of this node, as reported to the write hooks, into
+// operations on the state of its key.
+func (a *activeReplication) record(c *BoltCache, args []string) {
+	if len(args) < 2 {
+		return
+	}
+	name, key := strings.ToUpper(args[0]), args[1]
+	if name == "XGROUP" && len(args) > 2 {
+		key = args[2]
+	}
+	if c.Consensus != nil && c.Consensus.Covers(key) {
+		return
+	}
+
+	// String writes, deletions and expirations are reported while the key
+	// is locked and carry everything they change. The other writes are
+	// reported once stored, so their value is read back.
+	var item *CacheItem
+	switch name {
+	case "SET", "SETVALUE", "DEL", "PEXPIREAT", "PERSIST", "INCRBY":
+	default:
+		if it, ok := c.Data.Load(key); ok && !it.expired(time.Now()) {
+			item = it
+		}
+	}
+
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	now, ts := time.Now(), a.clock.Now()
+	k := a.key(key)
+	// A passed expiration deleted the key. Record the deletion, at the
+	// deadline every node agrees on, so that a new expiration doesn't
+	// bring back what it cleared.
+	if !k.at.IsZero() && now.After(k.at) && deadline(k.at).After(k.reg) {
+		a.commit(&crdtOp{name: opReg, key: key, ts: deadline(k.at)})
+	}
+
+	switch name {
+	case "SET", "SETVALUE":
+		value, at, err := parseSetArgs(name, args[1:])
+		if err != nil {
+			logger.Log("Cannot replicate %s: %v", name, err)
+			return
+		}
+		for _, op := range valueOps(key, ts, value) {
+			a.commit(op)
+		}
+		a.commit(&crdtOp{name: opExp, key: key, ts: ts, at: at})
+	case "DEL":
+		a.commit(&crdtOp{name: opReg, key: key, ts: ts})
+	case "PEXPIREAT", "PERSIST":
+		var at time.Time
+		if name == "PEXPIREAT" && len(args) == 3 {
+			at, _ = parseUnixMilli(args[2])
+		}
+		a.commit(&crdtOp{name: opExp, key: key, ts: ts, at: at})
+	case "SADD":
+		for _, m := range args[2:] {
+			a.commit(&crdtOp{name: opAdd, key: key, ts: ts, member: m})
+		}
+	case "SREM":
+		for _, m := range args[2:] {
+			op := &crdtOp{name: opRem, key: key, member: m}
+			for t := range k.adds[m] {
+				op.tags = append(op.tags, t)
+			}
+			if len(op.tags) > 0 {
+				a.commit(op)
+			}
+		}
+	case "HSET":
+		for i := 2; i+1 < len(args); i += 2 {
+			a.commit(&crdtOp{name: opField, key: key, ts: ts, member: args[i], value: args[i+1]})
+		}
+	case "HDEL":
+		for _, f := range args[2:] {
+			a.commit(&crdtOp{name: opField, key: key, ts: ts, member: f})
+		}
+	case "INCRBY":
+		delta, err := strconv.ParseInt(args[2], 10, 64)
+		if err != nil {
+			return
+		}
+		// Counts belong to the clear they were made after.
+		epoch := k.floor(kindCounter, k.clearPoint(now))
+		count := k.counts[counterID{node: a.node, epoch: epoch}]
+		if delta >= 0 {
+			count.p += delta
+		} else {
+			count.n -= delta
+		}
+		a.commit(&crdtOp{name: opCount, key: key, ts: ts, epoch: epoch, p: count.p, n: count.n})
+	default:
+		// Lists, sorted sets and streams are registers written as a whole.
+		var value interface{}
+		if item != nil {
+			value = item.Value
+		}
+		for _, op := range valueOps(key, ts, value) {
+			a.commit(op)
+		}
+	}
+
+	// Collection writes store their value without an expiration.
+	if item != nil && !item.ExpiresAt.Equal(k.expiresAt(now)) {
+		a.commit(&crdtOp{name: opExp, key: key, ts: ts, at: item.ExpiresAt})
+	}
+}
+
+// mergeActive merges an operation from a peer and stores the value of its
+// key derived from the new state.
+func (c *BoltCache) mergeActive(a *activeReplication, args []string) error {
+	op, err := parseCRDTOp(args)
+	if err != nil {
+		return err
+	}
+	if c.Consensus != nil && c.Consensus.Covers(op.key) {
+		return nil
+	}
+	a.clock.Observe(op.ts)
+	for _, t := range op.tags {
+		a.clock.Observe(t)
+	}
+
+	c.Mu.Lock()
+	defer c.Mu.Unlock()
+	c.Data.compute(op.key, func(old *CacheItem) (*CacheItem, bool) {
+		a.mu.Lock()
+		defer a.mu.Unlock()
+		k := a.key(op.key)
+		changed, conflict := k.apply(op)
+		a.merged.Add(1)
+		if conflict != noConflict {
+			a.conflicts[conflict].Add(1)
+		}
+		if !changed {
+			return nil, false
+		}
+
+		now := time.Now()
+		if item := c.patchMember(k, op, old, now); item != nil {
+			return item, true
+		}
+		value, at := k.materialize(now)
+		if value == nil {
+			if old == nil {
+				return nil, false
+			}
+			c.runHooks([]string{"DEL", op.key})
+			return nil, true
+		}
+		item := &CacheItem{Value: value, ExpiresAt: at}
+		if c.hooked() {
+			if args := setArgs(op.key, item); args != nil {
+				c.runHooks(args)
+			}
+		}
+		return item, true
+	})
+	c.signalKey(op.key)
+	return nil
+}
+
+// patchMember applies an operation on a member of a set or a hash to the
+// stored value in place, rather than building the value again. It returns
+// nil when it can't.
+func (c *BoltCache) patchMember(k *crdtKey, op *crdtOp, old *CacheItem, now time.Time) *CacheItem {
+	// SADD and friends drop the expiration when replayed.
+	if old == nil || !old.ExpiresAt.IsZero() {
+		return nil
+	}
+	kind, ts := k.newest()
+	if ts.Compare(k.reg) < 0 {
+		return nil
+	}
+	f := k.floor(kind, k.clearPoint(now))
+
+	var args []string
+	switch v := old.Value.(type) {
+	case map[string]struct{}:
+		if kind != kindSet || op.name != opAdd && op.name != opRem {
+			return nil
+		}
+		if k.memberLive(op.member, f) {
+			v[op.member] = struct{}{}
+			args = []string{"SADD", op.key, op.member}
+		} else if len(v) > 1 {
+			delete(v, op.member)
+			args = []string{"SREM", op.key, op.member}
+		} else {
+			return nil
+		}
+	case map[string]string:
+		if kind != kindHash || op.name != opField {
+			return nil
+		}
+		if value := k.fieldValue(op.member, f); value != nil {
+			v[op.member] = value.(string)
+			args = []string{"HSET", op.key, op.member, value.(string)}
+		} else if len(v) > 1 {
+			delete(v, op.member)
+			args = []string{"HDEL", op.key, op.member}
+		} else {
+			return nil
+		}
+	default:
+		return nil
+	}
+	c.runHooks(args)
+	return old.clone()
+}
+
+// ServeActivePeer answers CRDTSYNC from the peer node on conn: it sends
+// the whole state and then streams the operations of this node's writes
+// until the connection fails. r holds what was read from conn past the
+// command.
+func (c *BoltCache) ServeActivePeer(conn net.Conn, r *bufio.Reader, node string) error {
+	defer conn.Close()
+	a := c.active.Load()
+	if a == nil {
+		return writeReplError(conn, ErrActiveDisabled)
+	}
+
+	// Collection writes wait on Mu and string writes on a.mu while the
+	// state is captured, so no operation is both in it and after offset.
+	var buf bytes.Buffer
+	fmt.Fprintf(&buf, "+CRDTSYNC %s\r\n", a.node)
+	c.Mu.RLock()
+	a.mu.Lock()
+	a.feed.mu.Lock()
+	offset := a.feed.backlog.end
+	a.feed.mu.Unlock()
+	err := a.writeState(&buf)
+	a.mu.Unlock()
+	c.Mu.RUnlock()
+	if err != nil {
+		return writeReplError(conn, err)
+	}
+	if _, err := buf.WriteTo(conn); err != nil {
+		return err
+	}
+
+	feed := a.feed
+	link := &replicaLink{addr: conn.RemoteAddr().String(), ack: offset, lastAck: time.Now()}
+	feed.mu.Lock()
+	feed.replicas[link] = struct{}{}
+	feed.mu.Unlock()
+	logger.Log("Active-active peer %s (%s) connected", node, link.addr)
+
+	go feed.readAcks(link, r)
+	err = feed.stream(conn, link, offset)
+
+	feed.mu.Lock()
+	link.closed = true
+	delete(feed.replicas, link)
+	feed.mu.Unlock()
+	logger.Log("Active-active peer %s (%s) disconnected: %v", node, link.addr, err)
+	return err
+}
+
+// writeState writes the operations making up the whole state. The caller
+// holds a.mu.
+func (a *activeReplication) writeState(w *bytes.Buffer) error {
+	var scratch []byte
+	for key, k := range a.keys {
+		for _, op := range k.ops(key) {
+			args, err := op.args()
+			if err != nil {
+				return err
+			}
+			scratch = appendCommand(scratch[:0], args)
+			w.Write(scratch)
+		}
+	}
+	return nil
+}
+
+// pullPeer keeps merging the writes of a peer.
+func (c *BoltCache) pullPeer(a *activeReplication, p *activePeer) {
+	for {
+		err := c.syncPeer(a, p)
+		p.mu.Lock()
+		if p.linkUp {
+			p.since = time.Now()
+		}
+		p.linkUp = false
+		p.mu.Unlock()
+		if err == errActiveSelf {
+			logger.Log("Active-active peer %s is this node, ignoring it", p.addr)
+			return
+		}
+		logger.Log("Active-active link to %s lost: %v", p.addr, err)
+		time.Sleep(replicaRetryDelay)
+	}
+}
+
+var errActiveSelf = errors.New("connected to itself")
+
+// syncPeer connects to a peer and merges its state and writes until the
+// connection fails.
+func (c *BoltCache) syncPeer(a *activeReplication, p *activePeer) error {
+	conn, err := net.DialTimeout("tcp", p.addr, 5*time.Second)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	if _, err := fmt.Fprintf(conn, "CRDTSYNC %s\r\n", a.node); err != nil {
+		return err
+	}
+
+	br := bufio.NewReaderSize(conn, 64*1024)
+	line, err := br.ReadString('\n')
+	if err != nil {
+		return err
+	}
+	fields := strings.Fields(line)
+	switch {
+	case len(fields) == 2 && fields[0] == "+CRDTSYNC":
+	case strings.HasPrefix(line, "-"):
+		return errors.New(strings.TrimSpace(line[1:]))
+	default:
+		return fmt.Errorf("unexpected CRDTSYNC reply %q", strings.TrimSpace(line))
+	}
+	if fields[1] == a.node {
+		return errActiveSelf
+	}
+
+	p.mu.Lock()
+	p.node, p.linkUp, p.since = fields[1], true, time.Now()
+	p.mu.Unlock()
+	logger.Log("Active-active link to %s (%s) up", p.addr, fields[1])
+
+	for {
+		args, _, err := readCommand(br)
+		if err != nil {
+			return err
+		}
+		c.TxMu.RLock()
+		err = c.mergeActive(a, args)
+		c.TxMu.RUnlock()
+		if err != nil {
+			logger.Log("Cannot merge %v from %s: %v", args, p.addr, err)
+		}
+	}
+}
+
+func (a *activeReplication) sweepLoop() {
+	ticker := time.NewTicker(activeSweepInterval)
+	defer ticker.Stop()
+	for range ticker.C {
+		a.sweep(time.Now())
+	}
+}
+
+// sweep drops the state of keys deleted or expired for tombstoneTTL.
+func (a *activeReplication) sweep(now time.Time) {
+	horizon := now.Add(-tombstoneTTL)
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	for key, k := range a.keys {
+		if k.lastChange().Wall < horizon.UnixMilli() && !k.at.After(horizon) && k.empty(now) {
+			delete(a.keys, key)
+		}
+	}
+}
+
+// ActiveInfo returns the state of active-active replication, or false
+// when it is off.
+func (c *BoltCache) ActiveInfo() (ActiveInfo, bool) {
+	a := c.active.Load()
+	if a == nil {
+		return ActiveInfo{}, false
+	}
+	info := ActiveInfo{
+		Node:             a.node,
+		Clock:            a.clock.Last(),
+		OpsSent:          a.sent.Load(),
+		OpsMerged:        a.merged.Load(),
+		ConflictsLWW:     a.conflicts[conflictLWW].Load(),
+		ConflictsCleared: a.conflicts[conflictCleared].Load(),
+		ConflictsAddWins: a.conflicts[conflictAddWins].Load(),
+	}
+	a.mu.Lock()
+	info.Keys = len(a.keys)
+	a.mu.Unlock()
+	a.feed.mu.Lock()
+	info.Pulling = len(a.feed.replicas)
+	a.feed.mu.Unlock()
+	for _, p := range a.peers {
+		p.mu.Lock()
+		info.Peers = append(info.Peers, ActivePeerInfo{
+			Addr:         p.addr,
+			Node:         p.node,
+			LinkUp:       p.linkUp,
+			LinkDuration: time.Since(p.since),
+		})
+		p.mu.Unlock()
+	}
+	return info, true
+}
@@ -0,0 +1,174 @@
+package cache
+
+import (
+	"bufio"
+	"net"
+	"reflect"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+import (
+	config "boltcache/config"
+)
+
+// activeListener accepts active-active peers the way the CRDTSYNC command
+// does. While it is partitioned it drops its links and refuses new ones.
+type activeListener struct {
+	ln          net.Listener
+	partitioned atomic.Bool
+
+	mu    sync.Mutex
+	conns []net.Conn
+}
+
+func listenActive(t *testing.T) *activeListener {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { ln.Close() })
+	return &activeListener{ln: ln}
+}
+
+func (l *activeListener) serve(c *BoltCache) {
+	go func() {
+		for {
+			conn, err := l.ln.Accept()
+			if err != nil {
+				return
+			}
+			if l.partitioned.Load() {
+				conn.Close()
+				continue
+			}
+			l.mu.Lock()
+			l.conns = append(l.conns, conn)
+			l.mu.Unlock()
+			r := bufio.NewReader(conn)
+			line, _ := r.ReadString('\n')
+			fields := strings.Fields(line)
+			if len(fields) != 2 {
+				conn.Close()
+				continue
+			}
+			go c.ServeActivePeer(conn, r, fields[1])
+		}
+	}()
+}
+
+func (l *activeListener) partition(on bool) {
+	l.partitioned.Store(on)
+	if !on {
+		return
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	for _, conn := range l.conns {
+		conn.Close()
+	}
+	l.conns = nil
+}
+
+func linksUp(c *BoltCache) bool {
+	info, _ := c.ActiveInfo()
+	for _, p := range info.Peers {
+		if !p.LinkUp {
+			return false
+		}
+	}
+	return info.Pulling == len(info.Peers)
+}
+
+func members(c *BoltCache, key string) []string {
+	m := c.SMembers(key)
+	sort.Strings(m)
+	return m
+}
+
+func TestActiveReplication(t *testing.T) {
+	la, lb := listenActive(t), listenActive(t)
+	a := &BoltCache{Data: NewShardedMap()}
+	b := &BoltCache{Data: NewShardedMap()}
+	a.Set("loaded", "from a", 0)
+	b.Set("loaded", "from b", 0)
+	b.Set("only b", "x", time.Hour)
+	for _, n := range []struct {
+		c    *BoltCache
+		node string
+		peer string
+	}{{a, "a", lb.ln.Addr().String()}, {b, "b", la.ln.Addr().String()}} {
+		err := n.c.StartActiveReplication(n.node, config.ActiveActiveConfig{Peers: []string{n.peer}, BacklogSize: "64KB"})
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	la.serve(a)
+	lb.serve(b)
+	waitFor(t, "links", func() bool { return linksUp(a) && linksUp(b) })
+
+	// The loaded keys of the node with the higher ID win.
+	waitFor(t, "initial sync", func() bool { return a.Data.Len() == 2 && b.Data.Len() == 2 })
+	sameData(t, b, a)
+	if v, _ := a.Get("loaded"); v != "from b" {
+		t.Fatalf("loaded = %v", v)
+	}
+
+	a.SAdd("set", "m", "n")
+	a.IncrBy("counter", 5)
+	waitFor(t, "writes of a", func() bool { return len(b.SMembers("set")) == 2 && b.Data.Len() == 4 })
+
+	// Writes on both sides of a partition are merged once it heals.
+	la.partition(true)
+	lb.partition(true)
+	waitFor(t, "partition", func() bool { return !linksUp(a) && !linksUp(b) })
+	b.SRem("set", "m", "n")
+	a.SAdd("set", "m")
+	a.IncrBy("counter", 3)
+	b.IncrBy("counter", -1)
+	a.HSet("hash", "f", "1")
+	b.HSet("hash", "g", "2")
+	a.Set("string", "first", 0)
+	time.Sleep(2 * time.Millisecond)
+	b.Set("string", "second", 0)
+	la.partition(false)
+	lb.partition(false)
+	waitFor(t, "links", func() bool { return linksUp(a) && linksUp(b) })
+	waitFor(t, "convergence", func() bool {
+		v, _ := a.Get("counter")
+		return v == "7" && len(a.HGetAll("hash")) == 2 && len(members(b, "set")) == 1
+	})
+
+	for _, c := range []*BoltCache{a, b} {
+		if got := members(c, "set"); !reflect.DeepEqual(got, []string{"m"}) {
+			t.Fatalf("set = %v", got)
+		}
+		if got := c.HGetAll("hash"); !reflect.DeepEqual(got, map[string]string{"f": "1", "g": "2"}) {
+			t.Fatalf("hash = %v", got)
+		}
+		if v, _ := c.Get("string"); v != "second" {
+			t.Fatalf("string = %v", v)
+		}
+	}
+	sameData(t, a, b)
+
+	ia, _ := a.ActiveInfo()
+	ib, _ := b.ActiveInfo()
+	if ia.ConflictsAddWins == 0 {
+		t.Fatalf("no add-wins conflict on a: %+v", ia)
+	}
+	if ia.ConflictsLWW+ib.ConflictsLWW == 0 {
+		t.Fatalf("no LWW conflict: %+v %+v", ia, ib)
+	}
+
+	// A deleted key stays deleted everywhere.
+	b.Delete("string")
+	waitFor(t, "delete", func() bool {
+		_, ok := a.Get("string")
+		return !ok
+	})
+}
@@ -0,0 +1,505 @@
+package cache
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"sort"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+import (
+	logger "boltcache/logger"
+)
+
+// Replicas compare their dataset with the master's through the Merkle
+// trees of merkle.go. The replica connects to the master's TCP port and
+// sends MERKLE, answered with +OK, and then requests
+//
+//	TREE <offset> <level> <node>...  hashes of the nodes at level
+//	KEYS <offset> <leaf>...          keys in the leaves with their hashes
+//	REPAIR <key>...                  resend the keys in the replication stream
+//
+// as RESP arrays. A reply is an array starting with the replication
+// offset it was taken at, or an error line. TREE and KEYS first wait for
+// the offset to reach the one sent, and the requesting side waits for the
+// offset of the reply before comparing, so each side has the writes the
+// other had. The tree is descended from the root merkleStep levels at a
+// time, only below the nodes that differ.
+//
+// Repairs go through the replication stream, after the writes already in
+// it. As they set the whole value with an absolute expiration or delete
+// the key, repairing a key that changed during the comparison rather than
+// differed is harmless.
+
+var (
+	errMerkleRequest = errors.New("ERR invalid MERKLE request")
+	errMerkleReply   = errors.New("unexpected MERKLE reply")
+	errRepairReplica = errors.New("ERR only masters repair keys")
+)
+
+const (
+	merkleStep    = 4    // levels descended per TREE request
+	merkleBatch   = 1024 // nodes, leaves or keys per request
+	merkleTimeout = 30 * time.Second
+)
+
+// Divergence is what comparing the dataset with a peer's found. Missing
+// and Extra are relative to the master: keys only the master has, and
+// keys only the replica has.
+type Divergence struct {
+	Peer    string
+	Offset  int64 // replication offset of the last comparison
+	Ranges  int   // leaves that differ
+	Missing []string
+	Extra   []string
+	Changed []string // keys with another value or expiration
+}
+
+// Keys returns the keys that differ.
+func (d *Divergence) Keys() []string {
+	keys := append(append(append([]string(nil), d.Missing...), d.Extra...), d.Changed...)
+	sort.Strings(keys)
+	return keys
+}
+
+// antiEntropyStats is reported by INFO.
+type antiEntropyStats struct {
+	runs     atomic.Uint64
+	repaired atomic.Uint64
+}
+
+// merkleTree builds the tree over the keys replication covers and
+// returns it with the replication offset it was built at.
+func (c *BoltCache) merkleTree() (*merkleTree, int64) {
+	c.Mu.RLock()
+	defer c.Mu.RUnlock()
+	offset := c.ReplicationOffset()
+	return c.Data.merkleTree(time.Now(), c.notUnderConsensus()), offset
+}
+
+// leafKeys returns the hashes of the keys in leaves and the replication
+// offset they were taken at.
+func (c *BoltCache) leafKeys(leaves []int) (map[string]uint64, int64) {
+	c.Mu.RLock()
+	defer c.Mu.RUnlock()
+	offset := c.ReplicationOffset()
+	return c.Data.leafKeys(leaves, time.Now(), c.notUnderConsensus()), offset
+}
+
+// waitOffset waits until the replication offset reaches offset.
+func (c *BoltCache) waitOffset(offset int64) error {
+	deadline := time.Now().Add(merkleTimeout)
+	for c.ReplicationOffset() < offset {
+		if time.Now().After(deadline) {
+			return fmt.Errorf("ERR replication offset %d not reached", offset)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	return nil
+}
+
+// ServeMerkle answers the anti-entropy requests of a peer on conn until
+// it disconnects. r holds what was read from conn past the MERKLE
+// command.
+func (c *BoltCache) ServeMerkle(conn net.Conn, r *bufio.Reader) error {
+	defer conn.Close()
+	if _, err := io.WriteString(conn, "+OK\r\n"); err != nil {
+		return err
+	}
+	var buf []byte
+	for {
+		args, _, err := readCommand(r)
+		if err != nil {
+			return err
+		}
+		reply, err := c.merkleRequest(args)
+		if err != nil {
+			buf = append(append(append(buf[:0], '-'), err.Error()...), '\r', '\n')
+		} else {
+			buf = appendCommand(buf[:0], reply)
+		}
+		if _, err := conn.Write(buf); err != nil {
+			return err
+		}
+	}
+}
+
+func (c *BoltCache) merkleRequest(args []string) ([]string, error) {
+	if len(args) < 2 {
+		return nil, errMerkleRequest
+	}
+	switch strings.ToUpper(args[0]) {
+	case "TREE":
+		if len(args) < 4 {
+			return nil, errMerkleRequest
+		}
+		level, err := strconv.Atoi(args[2])
+		if err != nil || level < 0 || level > merkleDepth {
+			return nil, errMerkleRequest
+		}
+		nodes, err := parseNodes(args[3:], 1<<level)
+		if err != nil {
+			return nil, err
+		}
+		if err := c.waitOffset(parseOffset(args[1])); err != nil {
+			return nil, err
+		}
+		t, offset := c.merkleTree()
+		reply := []string{strconv.FormatInt(offset, 10)}
+		for _, n := range nodes {
+			reply = append(reply, strconv.FormatUint(t[level][n], 16))
+		}
+		return reply, nil
+
+	case "KEYS":
+		leaves, err := parseNodes(args[2:], merkleLeaves)
+		if err != nil {
+			return nil, err
+		}
+		if err := c.waitOffset(parseOffset(args[1])); err != nil {
+			return nil, err
+		}
+		hashes, offset := c.leafKeys(leaves)
+		reply := []string{strconv.FormatInt(offset, 10)}
+		for key, h := range hashes {
+			reply = append(reply, key, strconv.FormatUint(h, 16))
+		}
+		return reply, nil
+
+	case "REPAIR":
+		m := c.master.Load()
+		if m == nil {
+			return nil, errRepairReplica
+		}
+		c.repair(m, args[1:])
+		return []string{strconv.FormatInt(c.ReplicationOffset(), 10)}, nil
+	}
+	return nil, errMerkleRequest
+}
+
+func parseNodes(args []string, n int) ([]int, error) {
+	nodes := make([]int, len(args))
+	for i, a := range args {
+		node, err := strconv.Atoi(a)
+		if err != nil || node < 0 || node >= n {
+			return nil, errMerkleRequest
+		}
+		nodes[i] = node
+	}
+	return nodes, nil
+}
+
+func parseOffset(s string) int64 {
+	offset, _ := strconv.ParseInt(s, 10, 64)
+	return offset
+}
+
+// repair writes keys to the replication stream with their current value,
+// or deleted when they are missing. Collection writes wait on Mu and
+// string writes on the shard lock, so each key goes after its last write.
+func (c *BoltCache) repair(m *replicationMaster, keys []string) {
+	c.Mu.RLock()
+	defer c.Mu.RUnlock()
+	include := c.notUnderConsensus()
+	now := time.Now()
+	for _, key := range keys {
+		if include != nil && !include(key) {
+			continue
+		}
+		c.Data.compute(key, func(old *CacheItem) (*CacheItem, bool) {
+			args := []string{"DEL", key}
+			if old != nil && !old.expired(now) {
+				args = setArgs(key, old)
+			}
+			if args != nil {
+				m.write(args)
+			}
+			return nil, false
+		})
+	}
+}
+
+// merkleConn is the requesting side of the anti-entropy protocol.
+type merkleConn struct {
+	conn net.Conn
+	r    *bufio.Reader
+	buf  []byte
+}
+
+func dialMerkle(addr string) (*merkleConn, error) {
+	conn, err := net.DialTimeout("tcp", addr, 5*time.Second)
+	if err != nil {
+		return nil, err
+	}
+	conn.SetDeadline(time.Now().Add(merkleTimeout))
+	mc := &merkleConn{conn: conn, r: bufio.NewReaderSize(conn, 64*1024)}
+	if _, err := io.WriteString(conn, "MERKLE\r\n"); err != nil {
+		conn.Close()
+		return nil, err
+	}
+	line, err := mc.r.ReadString('\n')
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	if line = strings.TrimSpace(line); line != "+OK" {
+		conn.Close()
+		return nil, fmt.Errorf("unexpected MERKLE reply %q", line)
+	}
+	return mc, nil
+}
+
+// do sends a request and returns the offset and the rest of the reply.
+func (mc *merkleConn) do(args []string) (int64, []string, error) {
+	mc.conn.SetDeadline(time.Now().Add(merkleTimeout + 5*time.Second))
+	mc.buf = appendCommand(mc.buf[:0], args)
+	if _, err := mc.conn.Write(mc.buf); err != nil {
+		return 0, nil, err
+	}
+	if b, err := mc.r.Peek(1); err == nil && b[0] == '-' {
+		line, err := mc.r.ReadString('\n')
+		if err != nil {
+			return 0, nil, err
+		}
+		return 0, nil, errors.New(strings.TrimSpace(line[1:]))
+	}
+	reply, _, err := readCommand(mc.r)
+	if err != nil {
+		return 0, nil, err
+	}
+	if len(reply) == 0 {
+		return 0, nil, errMerkleReply
+	}
+	offset, err := strconv.ParseInt(reply[0], 10, 64)
+	if err != nil {
+		return 0, nil, errMerkleReply
+	}
+	return offset, reply[1:], nil
+}
+
+// request sends the command with the current replication offset and
+// items, at most merkleBatch at a time, and calls fn with each batch and
+// its reply once the replication offset reached the one of the reply.
+func (c *BoltCache) request(mc *merkleConn, cmd []string, items []string, fn func(items, reply []string) error) error {
+	for len(items) > 0 {
+		batch := items[:min(len(items), merkleBatch)]
+		items = items[len(batch):]
+		args := append(append(append([]string(nil), cmd[0], strconv.FormatInt(c.ReplicationOffset(), 10)), cmd[1:]...), batch...)
+		offset, reply, err := mc.do(args)
+		if err != nil {
+			return err
+		}
+		if err := c.waitOffset(offset); err != nil {
+			return err
+		}
+		if err := fn(batch, reply); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// diffLeaves descends the trees of both sides and returns the leaves
+// that differ.
+func (c *BoltCache) diffLeaves(mc *merkleConn) ([]int, error) {
+	level, nodes := 0, []int{0}
+	for {
+		var differ []int
+		err := c.request(mc, []string{"TREE", strconv.Itoa(level)}, itoas(nodes), func(batch, hashes []string) error {
+			if len(hashes) != len(batch) {
+				return errMerkleReply
+			}
+			t, _ := c.merkleTree()
+			for i, s := range batch {
+				n, _ := strconv.Atoi(s)
+				if strconv.FormatUint(t[level][n], 16) != hashes[i] {
+					differ = append(differ, n)
+				}
+			}
+			return nil
+		})
+		if err != nil || len(differ) == 0 || level == merkleDepth {
+			return differ, err
+		}
+		next := min(level+merkleStep, merkleDepth)
+		nodes = nodes[:0]
+		for _, n := range differ {
+			for i := n << (next - level); i < (n+1)<<(next-level); i++ {
+				nodes = append(nodes, i)
+			}
+		}
+		level = next
+	}
+}
+
+// diffKeys compares the keys of leaves on both sides.
+func (c *BoltCache) diffKeys(mc *merkleConn, leaves []int) (*Divergence, error) {
+	d := &Divergence{}
+	isMaster := c.master.Load() != nil
+	err := c.request(mc, []string{"KEYS"}, itoas(leaves), func(batch, reply []string) error {
+		if len(reply)%2 != 0 {
+			return errMerkleReply
+		}
+		nums := make([]int, len(batch))
+		for i, s := range batch {
+			nums[i], _ = strconv.Atoi(s)
+		}
+		mine, offset := c.leafKeys(nums)
+		d.Offset = offset
+		for i := 0; i < len(reply); i += 2 {
+			key := reply[i]
+			h, ok := mine[key]
+			switch {
+			case !ok && isMaster:
+				d.Extra = append(d.Extra, key)
+			case !ok:
+				d.Missing = append(d.Missing, key)
+			case strconv.FormatUint(h, 16) != reply[i+1]:
+				d.Changed = append(d.Changed, key)
+			}
+			delete(mine, key)
+		}
+		for key := range mine {
+			if isMaster {
+				d.Missing = append(d.Missing, key)
+			} else {
+				d.Extra = append(d.Extra, key)
+			}
+		}
+		return nil
+	})
+	return d, err
+}
+
+func itoas(nums []int) []string {
+	s := make([]string, len(nums))
+	for i, n := range nums {
+		s[i] = strconv.Itoa(n)
+	}
+	return s
+}
+
+// CheckPeer compares the dataset with the one of the node at addr, a
+// master or replica of this node, without repairing anything. Keys that
+// differ are compared twice, so writes made meanwhile are not reported.
+func (c *BoltCache) CheckPeer(addr string) (*Divergence, error) {
+	mc, err := dialMerkle(addr)
+	if err != nil {
+		return nil, err
+	}
+	defer mc.conn.Close()
+
+	leaves, err := c.diffLeaves(mc)
+	if err != nil || len(leaves) == 0 {
+		return &Divergence{Peer: addr, Offset: c.ReplicationOffset()}, err
+	}
+	first, err := c.diffKeys(mc, leaves)
+	if err != nil {
+		return nil, err
+	}
+	again := make(map[int]bool)
+	for _, key := range first.Keys() {
+		again[leafOf(key)] = true
+	}
+	leaves = leaves[:0]
+	for leaf := range again {
+		leaves = append(leaves, leaf)
+	}
+	sort.Ints(leaves)
+	d, err := c.diffKeys(mc, leaves)
+	if err != nil {
+		return nil, err
+	}
+	d.Peer = addr
+	d.Missing = intersect(d.Missing, first.Missing)
+	d.Extra = intersect(d.Extra, first.Extra)
+	d.Changed = intersect(d.Changed, first.Changed)
+	ranges := make(map[int]bool)
+	for _, key := range d.Keys() {
+		ranges[leafOf(key)] = true
+	}
+	d.Ranges = len(ranges)
+	return d, nil
+}
+
+func intersect(a, b []string) []string {
+	in := make(map[string]bool, len(b))
+	for _, s := range b {
+		in[s] = true
+	}
+	var out []string
+	for _, s := range a {
+		if in[s] {
+			out = append(out, s)
+		}
+	}
+	sort.Strings(out)
+	return out
+}
+
+// repairFrom compares the replica with its master at addr and has the
+// master resend the keys that differ.
+func (c *BoltCache) repairFrom(addr string) (*Divergence, error) {
+	mc, err := dialMerkle(addr)
+	if err != nil {
+		return nil, err
+	}
+	defer mc.conn.Close()
+
+	leaves, err := c.diffLeaves(mc)
+	if err != nil || len(leaves) == 0 {
+		return &Divergence{Peer: addr, Offset: c.ReplicationOffset()}, err
+	}
+	d, err := c.diffKeys(mc, leaves)
+	if err != nil {
+		return nil, err
+	}
+	d.Peer, d.Ranges = addr, len(leaves)
+	keys := d.Keys()
+	for len(keys) > 0 {
+		batch := keys[:min(len(keys), merkleBatch)]
+		keys = keys[len(batch):]
+		if _, _, err := mc.do(append([]string{"REPAIR"}, batch...)); err != nil {
+			return d, err
+		}
+	}
+	return d, nil
+}
+
+// antiEntropyLoop repairs the replica from its master every interval
+// until replication stops.
+func (c *BoltCache) antiEntropyLoop(r *replicaState, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-r.stop:
+			return
+		case <-ticker.C:
+		}
+		r.mu.Lock()
+		up := r.linkUp
+		r.mu.Unlock()
+		if !up {
+			continue
+		}
+
+		d, err := c.repairFrom(r.master)
+		c.antiEntropy.runs.Add(1)
+		if err != nil {
+			logger.Log("Anti-entropy with %s failed: %v", r.master, err)
+			continue
+		}
+		if n := len(d.Keys()); n > 0 {
+			c.antiEntropy.repaired.Add(uint64(n))
+			logger.Log("Anti-entropy repaired %d keys in %d ranges from %s (%d missing, %d extra, %d changed)",
+				n, d.Ranges, r.master, len(d.Missing), len(d.Extra), len(d.Changed))
+		}
+	}
+}
@@ -0,0 +1,123 @@
+package cache
+
+import (
+	"bufio"
+	"net"
+	"reflect"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+import (
+	config "boltcache/config"
+)
+
+// serveNode accepts replicas and anti-entropy peers for c the way the
+// PSYNC and MERKLE commands do.
+func serveNode(t *testing.T, c *BoltCache) string {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { ln.Close() })
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			r := bufio.NewReader(conn)
+			line, _ := r.ReadString('\n')
+			switch args := strings.Fields(line); {
+			case len(args) == 1 && args[0] == "MERKLE":
+				go c.ServeMerkle(conn, r)
+			case len(args) == 3 && args[0] == "PSYNC":
+				offset, _ := strconv.ParseInt(args[2], 10, 64)
+				go c.ServeReplica(conn, r, args[1], offset)
+			default:
+				conn.Close()
+			}
+		}
+	}()
+	return ln.Addr().String()
+}
+
+func TestAntiEntropy(t *testing.T) {
+	master := &BoltCache{Data: NewShardedMap()}
+	if err := master.StartReplication(config.ReplicationConfig{Role: "master", BacklogSize: "64KB"}); err != nil {
+		t.Fatal(err)
+	}
+	masterAddr := serveNode(t, master)
+	replica := &BoltCache{Data: NewShardedMap()}
+	if err := replica.StartReplication(config.ReplicationConfig{Role: "replica", Master: masterAddr}); err != nil {
+		t.Fatal(err)
+	}
+	replicaAddr := serveNode(t, replica)
+
+	master.Set("string", "v", time.Hour)
+	master.SAdd("set", "a", "b")
+	master.HSet("hash", "f", "1")
+	for i := 0; i < 100; i++ {
+		master.Set("key"+strconv.Itoa(i), "v", 0)
+	}
+	waitFor(t, "sync", func() bool {
+		return replica.ReplicationInfo().LinkUp && replica.ReplicationOffset() == master.ReplicationOffset()
+	})
+	for _, c := range []*BoltCache{master, replica} {
+		addr := masterAddr
+		if c == master {
+			addr = replicaAddr
+		}
+		if d, err := c.CheckPeer(addr); err != nil || d.Ranges != 0 || len(d.Keys()) != 0 {
+			t.Fatalf("in sync: %+v, %v", d, err)
+		}
+	}
+
+	// The replica drifts without the master knowing.
+	replica.Data.Delete("string")
+	replica.Data.Store("extra", &CacheItem{Value: "x"})
+	replica.Data.Store("hash", &CacheItem{Value: map[string]string{"f": "2"}})
+
+	// Missing and extra are relative to the master on both sides.
+	want := &Divergence{Ranges: 3, Missing: []string{"string"}, Extra: []string{"extra"}, Changed: []string{"hash"}}
+	for _, c := range []*BoltCache{replica, master} {
+		addr := masterAddr
+		if c == master {
+			addr = replicaAddr
+		}
+		d, err := c.CheckPeer(addr)
+		if err != nil {
+			t.Fatal(err)
+		}
+		d.Peer, d.Offset = "", 0
+		if !reflect.DeepEqual(d, want) {
+			t.Fatalf("check of %s: %+v", addr, d)
+		}
+	}
+	if _, ok := replica.Data.Load("extra"); !ok {
+		t.Fatal("check repaired the replica")
+	}
+
+	// Repairs come through the replication stream.
+	d, err := replica.repairFrom(masterAddr)
+	if err != nil || len(d.Keys()) != 3 {
+		t.Fatalf("repair: %+v, %v", d, err)
+	}
+	waitFor(t, "repair", func() bool { return replica.ReplicationOffset() == master.ReplicationOffset() })
+	sameData(t, master, replica)
+	if d, err := replica.CheckPeer(masterAddr); err != nil || len(d.Keys()) != 0 {
+		t.Fatalf("after repair: %+v, %v", d, err)
+	}
+
+	// Only masters repair.
+	mc, err := dialMerkle(replicaAddr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer mc.conn.Close()
+	if _, _, err := mc.do([]string{"REPAIR", "string"}); err == nil || err.Error() != errRepairReplica.Error() {
+		t.Fatalf("REPAIR on a replica: %v", err)
+	}
+}
@@ -0,0 +1,479 @@
+package cache
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+import (
+	config "boltcache/config"
+	logger "boltcache/logger"
+)
+
+var (
+	ErrAOFDisabled        = errors.New("ERR append only file is disabled")
+	ErrRewriteInProgress  = errors.New("ERR Background append only file rewriting already in progress")
+	errAOFClosed          = errors.New("append only file is closed")
+	errAOFInvalidProtocol = errors.New("invalid protocol")
+)
+
+// aofMaxBuffer bounds the writes buffered between flushes with the
+// everysec and no policies.
+const aofMaxBuffer = 4 << 20
+
+// appendOnlyFile logs every write as a RESP command. With appendfsync
+// always each write is flushed and synced before the command returns;
+// otherwise writes are buffered and flushed once per second, and synced
+// as well with everysec.
+type appendOnlyFile struct {
+	mu       sync.Mutex
+	path     string
+	file     *os.File
+	fsync    string
+	buf      []byte
+	size     int64 // bytes written to file plus buf
+	baseSize int64 // size after the last rewrite
+	closed   bool
+
+	// rewriteBuf collects the writes made while a rewrite captures the
+	// dataset; they are appended to the new file. nil outside rewrites.
+	rewriteBuf []byte
+
+	rewritePercentage int
+	rewriteMinSize    int64
+
+	rewriting     atomic.Bool
+	lastRewriteOK atomic.Bool
+	stop          chan struct{}
+	done          chan struct{}
+	closeOnce     sync.Once
+}
+
+// AOFStats is reported by INFO.
+type AOFStats struct {
+	Enabled           bool
+	RewriteInProgress bool
+	LastRewriteOK     bool
+	CurrentSize       int64
+	BaseSize          int64
+}
+
+// appendCommand encodes args as a RESP array.
+func appendCommand(buf []byte, args []string) []byte {
+	buf = append(buf, '*')
+	buf = strconv.AppendInt(buf, int64(len(args)), 10)
+	buf = append(buf, '\r', '\n')
+	for _, a := range args {
+		buf = append(buf, '$')
+		buf = strconv.AppendInt(buf, int64(len(a)), 10)
+		buf = append(buf, '\r', '\n')
+		buf = append(buf, a...)
+		buf = append(buf, '\r', '\n')
+	}
+	return buf
+}
+
+// readCommand reads one RESP array of bulk strings. It returns io.EOF at a
+// clean end of input and io.ErrUnexpectedEOF for a truncated command.
+func readCommand(r *bufio.Reader) ([]string, int64, error) {
+	var read int64
+	line := func() (string, error) {
+		s, err := r.ReadString('\n')
+		read += int64(len(s))
+		if err == io.EOF {
+			if s == "" && read == 0 {
+				return "", io.EOF
+			}
+			return "", io.ErrUnexpectedEOF
+		}
+		if err != nil {
+			return "", err
+		}
+		if len(s) < 3 || s[len(s)-2] != '\r' {
+			return "", errAOFInvalidProtocol
+		}
+		return s[:len(s)-2], nil
+	}
+	header := func(prefix byte) (int, error) {
+		s, err := line()
+		if err != nil {
+			return 0, err
+		}
+		if s[0] != prefix {
+			return 0, errAOFInvalidProtocol
+		}
+		n, err := strconv.Atoi(s[1:])
+		if err != nil || n < 0 {
+			return 0, errAOFInvalidProtocol
+		}
+		return n, nil
+	}
+
+	n, err := header('*')
+	if err != nil {
+		return nil, read, err
+	}
+	args := make([]string, n)
+	for i := range args {
+		size, err := header('$')
+		if err != nil {
+			return nil, read, err
+		}
+		data := make([]byte, size+2)
+		m, err := io.ReadFull(r, data)
+		read += int64(m)
+		if err == io.EOF || err == io.ErrUnexpectedEOF {
+			return nil, read, io.ErrUnexpectedEOF
+		}
+		if err != nil {
+			return nil, read, err
+		}
+		if data[size] != '\r' || data[size+1] != '\n' {
+			return nil, read, errAOFInvalidProtocol
+		}
+		args[i] = string(data[:size])
+	}
+	return args, read, nil
+}
+
+// LoadAOF replays the append-only file at path and reports whether it
+// existed. A command cut off by a crash at the end of the file is
+// discarded and the file truncated before it.
+func (c *BoltCache) LoadAOF(path string) (bool, error) {
+	f, err := os.Open(path)
+	if os.IsNotExist(err) {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+	defer f.Close()
+
+	r := bufio.NewReaderSize(f, 64*1024)
+	var offset int64
+	commands, failed := 0, 0
+	for {
+		args, n, err := readCommand(r)
+		if err == io.EOF {
+			break
+		}
+		if err == io.ErrUnexpectedEOF {
+			logger.Log("AOF %s ends with a truncated command, truncating at offset %d", path, offset)
+			if err := os.Truncate(path, offset); err != nil {
+				return true, err
+			}
+			break
+		}
+		if err != nil {
+			return true, fmt.Errorf("AOF %s: %v at offset %d", path, err, offset)
+		}
+		offset += n
+
+		commands++
+		if err := c.Apply(args); err != nil {
+			failed++
+			logger.Log("AOF %s: cannot apply command %d: %v", path, commands, err)
+		}
+	}
+
+	logger.Log("Replayed %d commands from %s (%d failed)", commands, path, failed)
+	return true, nil
+}
+
+// StartAOF starts logging writes to the append-only file. A missing or
+// empty file is first written with the current dataset.
+func (c *BoltCache) StartAOF(cfg config.AOFConfig) error {
+	minSize, err := config.ParseMemorySize(cfg.RewriteMinSize)
+	if err != nil {
+		return err
+	}
+
+	if err := os.MkdirAll(filepath.Dir(cfg.File), 0755); err != nil {
+		return err
+	}
+	f, err := os.OpenFile(cfg.File, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
+		return err
+	}
+	info, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return err
+	}
+
+	a := &appendOnlyFile{
+		path:              cfg.File,
+		file:              f,
+		fsync:             cfg.AppendFsync,
+		size:              info.Size(),
+		baseSize:          info.Size(),
+		rewritePercentage: cfg.RewritePercentage,
+		rewriteMinSize:    minSize,
+		stop:              make(chan struct{}),
+		done:              make(chan struct{}),
+	}
+	a.lastRewriteOK.Store(true)
+	c.aof = a
+	c.AddWriteHook(a.append)
+	go c.aofLoop()
+
+	if info.Size() == 0 {
+		return c.RewriteAOF()
+	}
+	return nil
+}
+
+// append is the WriteHook of the append-only file.
+func (a *appendOnlyFile) append(args []string) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	if a.closed {
+		return
+	}
+	n := len(a.buf)
+	a.buf = appendCommand(a.buf, args)
+	a.size += int64(len(a.buf) - n)
+	if a.rewriteBuf != nil {
+		a.rewriteBuf = append(a.rewriteBuf, a.buf[n:]...)
+	}
+
+	if a.fsync == "always" || len(a.buf) >= aofMaxBuffer {
+		a.flushLocked(a.fsync == "always")
+	}
+}
+
+// flushLocked writes the buffered commands and optionally syncs the file.
+// The caller must hold a.mu.
+func (a *appendOnlyFile) flushLocked(sync bool) {
+	if len(a.buf) > 0 {
+		if _, err := a.file.Write(a.buf); err != nil {
+			logger.Log("Failed to write AOF: %v", err)
+			return
+		}
+		a.buf = a.buf[:0]
+	}
+	if sync {
+		if err := a.file.Sync(); err != nil {
+			logger.Log("Failed to fsync AOF: %v", err)
+		}
+	}
+}
+
+// aofLoop flushes the buffer every second and starts automatic rewrites.
+func (c *BoltCache) aofLoop() {
+	a := c.aof
+	defer close(a.done)
+
+	ticker := time.NewTicker(time.Second)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-a.stop:
+			return
+		case <-ticker.C:
+		}
+
+		a.mu.Lock()
+		if a.fsync != "always" {
+			a.flushLocked(a.fsync == "everysec")
+		}
+		grow := a.rewritePercentage > 0 && a.size >= a.rewriteMinSize &&
+			a.size >= a.baseSize+a.baseSize*int64(a.rewritePercentage)/100
+		a.mu.Unlock()
+
+		if grow && !a.rewriting.Load() {
+			logger.Log("Starting automatic AOF rewrite")
+			go c.RewriteAOF()
+		}
+	}
+}
+
+// BackgroundRewriteAOF starts a rewrite unless one is already running.
+func (c *BoltCache) BackgroundRewriteAOF() error {
+	if c.aof == nil {
+		return ErrAOFDisabled
+	}
+	if c.aof.rewriting.Load() {
+		return ErrRewriteInProgress
+	}
+	go c.RewriteAOF()
+	return nil
+}
+
+// RewriteAOF replaces the append-only file with the shortest log that
+// rebuilds the current dataset: one SET or SETVALUE per key.
+//
+// Collection writes wait on Mu while the dataset is captured. String
+// writes may still run; they are logged to the new file as well, which is
+// harmless since they are all logged as SET with an absolute expiry, DEL,
+// PEXPIREAT or PERSIST, which have the same effect when applied twice.
+// INCRBY is logged as the SET of its result for that reason.
+func (c *BoltCache) RewriteAOF() error {
+	a := c.aof
+	if a == nil {
+		return ErrAOFDisabled
+	}
+	if !a.rewriting.CompareAndSwap(false, true) {
+		return ErrRewriteInProgress
+	}
+	defer a.rewriting.Store(false)
+
+	err := c.rewriteAOF(a)
+	a.lastRewriteOK.Store(err == nil)
+	if err != nil {
+		logger.Log("AOF rewrite failed: %v", err)
+	}
+	return err
+}
+
+func (c *BoltCache) rewriteAOF(a *appendOnlyFile) error {
+	now := time.Now()
+	var data []byte
+
+	c.Mu.RLock()
+	a.mu.Lock()
+	a.rewriteBuf = []byte{}
+	a.mu.Unlock()
+	c.Data.Range(func(key, value interface{}) bool {
+		item := value.(*CacheItem)
+		if item.expired(now) {
+			return true
+		}
+
+		var args []string
+		if s, ok := item.Value.(string); ok {
+			args = []string{"SET", key.(string), s}
+		} else {
+			typ, payload, err := EncodeValue(item.Value)
+			if err != nil {
+				logger.Log("AOF rewrite skips %s: %v", key, err)
+				return true
+			}
+			args = []string{"SETVALUE", key.(string), typ, string(payload)}
+		}
+		if !item.ExpiresAt.IsZero() {
+			args = append(args, "PXAT", formatUnixMilli(item.ExpiresAt))
+		}
+		data = appendCommand(data, args)
+		return true
+	})
+	c.Mu.RUnlock()
+
+	abort := func(err error) error {
+		a.mu.Lock()
+		a.rewriteBuf = nil
+		a.mu.Unlock()
+		return err
+	}
+
+	tmp := a.path + ".rewrite"
+	f, err := os.OpenFile(tmp, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, 0644)
+	if err != nil {
+		return abort(err)
+	}
+	fail := func(err error) error {
+		f.Close()
+		os.Remove(tmp)
+		return abort(err)
+	}
+	if _, err := f.Write(data); err != nil {
+		return fail(err)
+	}
+	if err := f.Sync(); err != nil {
+		return fail(err)
+	}
+
+	// Writes made since the capture go after it. Holding a.mu keeps new
+	// ones out until the files are switched.
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	if a.closed {
+		f.Close()
+		os.Remove(tmp)
+		a.rewriteBuf = nil
+		return errAOFClosed
+	}
+	tail := a.rewriteBuf
+	a.rewriteBuf = nil
+	if _, err := f.Write(tail); err != nil {
+		f.Close()
+		os.Remove(tmp)
+		return err
+	}
+	if err := f.Sync(); err != nil {
+		f.Close()
+		os.Remove(tmp)
+		return err
+	}
+	if err := os.Rename(tmp, a.path); err != nil {
+		f.Close()
+		os.Remove(tmp)
+		return err
+	}
+	syncDir(filepath.Dir(a.path))
+
+	// Everything still buffered for the old file is in the new one.
+	a.file.Close()
+	a.file = f
+	a.buf = a.buf[:0]
+	a.size = int64(len(data) + len(tail))
+	a.baseSize = a.size
+	logger.Log("AOF rewritten: %d bytes", a.size)
+	return nil
+}
+
+// syncDir fsyncs a directory so a rename in it survives a crash.
+func syncDir(dir string) {
+	d, err := os.Open(dir)
+	if err != nil {
+		return
+	}
+	d.Sync()
+	d.Close()
+}
+
+// CloseAOF flushes and syncs the append-only file and stops logging.
+func (c *BoltCache) CloseAOF() {
+	a := c.aof
+	if a == nil {
+		return
+	}
+	a.closeOnce.Do(func() {
+		close(a.stop)
+		<-a.done
+
+		a.mu.Lock()
+		defer a.mu.Unlock()
+		a.flushLocked(true)
+		a.file.Close()
+		a.closed = true
+	})
+}
+
+// AOFStats returns the state of the append-only file.
+func (c *BoltCache) AOFStats() AOFStats {
+	a := c.aof
+	if a == nil {
+		return AOFStats{}
+	}
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	return AOFStats{
+		Enabled:           true,
+		RewriteInProgress: a.rewriting.Load(),
+		LastRewriteOK:     a.lastRewriteOK.Load(),
+		CurrentSize:       a.size,
+		BaseSize:          a.baseSize,
+	}
+}
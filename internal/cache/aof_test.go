@@ -0,0 +1,203 @@
+package cache
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"strconv"
+	"testing"
+	"time"
+)
+
+import (
+	config "boltcache/config"
+)
+
+func newAOFCache(t *testing.T, path string) *BoltCache {
+	c := &BoltCache{Data: NewShardedMap()}
+	if _, err := c.LoadAOF(path); err != nil {
+		t.Fatal(err)
+	}
+	err := c.StartAOF(config.AOFConfig{Enabled: true, File: path, AppendFsync: "always"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return c
+}
+
+// sameData compares the encoded values and expirations of two caches.
+// Streams are compared by entries and pending counts, since consumer
+// activity times are reset on replay.
+func sameData(t *testing.T, want, got *BoltCache) {
+	t.Helper()
+	if want.Data.Len() != got.Data.Len() {
+		t.Fatalf("got %d keys, want %d", got.Data.Len(), want.Data.Len())
+	}
+	want.Data.Range(func(k, v interface{}) bool {
+		key := k.(string)
+		w := v.(*CacheItem)
+		g, ok := got.Data.Load(key)
+		if !ok {
+			t.Fatalf("%s is missing", key)
+		}
+		if w.ExpiresAt.UnixMilli() != g.ExpiresAt.UnixMilli() {
+			t.Fatalf("%s expires at %v, want %v", key, g.ExpiresAt, w.ExpiresAt)
+		}
+		if ws, ok := w.Value.(*Stream); ok {
+			gs := g.Value.(*Stream)
+			if len(gs.entries) != len(ws.entries) || gs.lastID != ws.lastID {
+				t.Fatalf("%s: stream entries differ", key)
+			}
+			for name, wg := range ws.groups {
+				gg := gs.groups[name]
+				if gg == nil || gg.lastDelivered != wg.lastDelivered || len(gg.pending) != len(wg.pending) || len(gg.consumers) != len(wg.consumers) {
+					t.Fatalf("%s: group %s differs", key, name)
+				}
+				for id, pe := range wg.pending {
+					if p := gg.pending[id]; p == nil || p.Consumer != pe.Consumer || p.Deliveries != pe.Deliveries {
+						t.Fatalf("%s: pending entry %v differs", key, id)
+					}
+				}
+			}
+			return true
+		}
+		_, wd, _ := EncodeValue(w.Value)
+		_, gd, _ := EncodeValue(g.Value)
+		if !bytes.Equal(wd, gd) {
+			t.Fatalf("%s: got %s, want %s", key, gd, wd)
+		}
+		return true
+	})
+}
+
+func TestAOFReplay(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "appendonly.aof")
+	c := newAOFCache(t, path)
+
+	c.Set("str", "v", time.Hour)
+	c.Set("json", map[string]interface{}{"a": []interface{}{1.0, "x"}}, 0)
+	c.Set("gone", "x", 0)
+	c.Delete("gone")
+	c.SetWithOptions("str", "v2", SetOptions{KeepTTL: true})
+	c.Set("ttl", "x", 0)
+	c.Expire("ttl", time.Hour)
+	c.Set("persisted", "x", time.Hour)
+	c.Persist("persisted")
+	c.LPush("list", "a", "b")
+	c.LPush("list", "c")
+	c.LPop("list")
+	c.SAdd("set", "x", "y")
+	c.HSet("hash", "f", "v")
+	c.ZAdd("zset", ZAddOptions{}, ZMember{"a", 1}, ZMember{"b", 2})
+	c.ZIncrBy("zset", "a", 0.1)
+	c.ZAdd("zset", ZAddOptions{NX: true}, ZMember{"a", 100})
+	c.ZRem("zset", "b", "missing")
+	c.GeoAdd("geo", ZAddOptions{}, GeoMember{"p", GeoPoint{13.361389, 38.115556}})
+	for i := 0; i < 4; i++ {
+		c.XAdd("s", "*", []string{"n", "x"}, XAddOptions{})
+	}
+	c.XAdd("s", "*", []string{"n", "x"}, XAddOptions{Trim: true, MaxLen: 3})
+	c.XGroupCreate("s", "g", "0", false)
+	c.XReadGroup("s", "g", "alice", StreamID{}, true, 2, false)
+	c.XReadGroup("s", "g", "bob", StreamID{}, true, 0, false)
+	entries, _ := c.XRange("s", StreamID{}, MaxStreamID, 0, false)
+	c.XAck("s", "g", entries[0].ID)
+	c.XClaim("s", "g", "carol", 0, []StreamID{entries[1].ID}, XClaimOptions{})
+	c.CloseAOF()
+
+	replayed := &BoltCache{Data: NewShardedMap()}
+	if ok, err := replayed.LoadAOF(path); !ok || err != nil {
+		t.Fatalf("LoadAOF: %v, %v", ok, err)
+	}
+	sameData(t, c, replayed)
+}
+
+func TestAOFRewrite(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "appendonly.aof")
+	c := newAOFCache(t, path)
+	for i := 0; i < 100; i++ {
+		c.HSet("h", "counter", time.Now().String())
+		c.LPush("l", "x")
+	}
+	before, _ := os.Stat(path)
+
+	if err := c.RewriteAOF(); err != nil {
+		t.Fatal(err)
+	}
+	c.SAdd("after", "rewrite")
+	c.CloseAOF()
+
+	after, _ := os.Stat(path)
+	if after.Size() >= before.Size() {
+		t.Fatalf("rewrite did not shrink the log: %d -> %d bytes", before.Size(), after.Size())
+	}
+	replayed := &BoltCache{Data: NewShardedMap()}
+	replayed.LoadAOF(path)
+	sameData(t, c, replayed)
+}
+
+func TestAOFRewriteDuringIncr(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "appendonly.aof")
+	c := &BoltCache{Data: NewShardedMap()}
+	for i := 0; i < 50000; i++ {
+		c.Data.Store("key"+strconv.Itoa(i), &CacheItem{Value: "v"})
+	}
+	if err := c.StartAOF(config.AOFConfig{Enabled: true, File: path, AppendFsync: "no"}); err != nil {
+		t.Fatal(err)
+	}
+	c.Set("counter", "0", time.Hour)
+
+	// Increments racing a rewrite may be in both the captured dataset and
+	// the tail logged after it.
+	stop := make(chan struct{})
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for {
+			select {
+			case <-stop:
+				return
+			default:
+				c.IncrBy("counter", 1)
+			}
+		}
+	}()
+	for i := 0; i < 5; i++ {
+		if err := c.RewriteAOF(); err != nil {
+			t.Fatal(err)
+		}
+	}
+	close(stop)
+	<-done
+	c.CloseAOF()
+
+	replayed := &BoltCache{Data: NewShardedMap()}
+	if ok, err := replayed.LoadAOF(path); !ok || err != nil {
+		t.Fatalf("LoadAOF: %v, %v", ok, err)
+	}
+	sameData(t, c, replayed)
+}
+
+func TestAOFTruncatedTail(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "appendonly.aof")
+	c := newAOFCache(t, path)
+	c.Set("a", "1", 0)
+	c.Set("b", "2", 0)
+	c.CloseAOF()
+
+	good, _ := os.Stat(path)
+	f, _ := os.OpenFile(path, os.O_APPEND|os.O_WRONLY, 0644)
+	f.WriteString("*3\r\n$3\r\nSET\r\n$1\r\nc")
+	f.Close()
+
+	replayed := &BoltCache{Data: NewShardedMap()}
+	if _, err := replayed.LoadAOF(path); err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := replayed.Get("b"); !ok {
+		t.Fatalf("commands before the truncated one must be replayed")
+	}
+	if info, _ := os.Stat(path); info.Size() != good.Size() {
+		t.Fatalf("file should be truncated to %d bytes, got %d", good.Size(), info.Size())
+	}
+}
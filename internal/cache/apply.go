@@ -0,0 +1,284 @@
+package cache
+
+import (
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+var errApplySyntax = errors.New("syntax error")
+
+// Apply replays a command reported to a WriteHook. It understands exactly
+// the forms the cache reports, which are valid Redis commands except for
+// SETVALUE key type payload [PXAT ms], used for values other than strings.
+func (c *BoltCache) Apply(args []string) error {
+	if len(args) == 0 {
+		return errApplySyntax
+	}
+	if err := c.apply(strings.ToUpper(args[0]), args[1:]); err != nil {
+		return fmt.Errorf("%s: %v", args[0], err)
+	}
+	return nil
+}
+
+func (c *BoltCache) apply(name string, args []string) error {
+	switch name {
+	case "SET", "SETVALUE":
+		return c.applySet(name, args)
+	case "DEL":
+		for _, key := range args {
+			c.Delete(key)
+		}
+		return nil
+	case "PEXPIREAT":
+		if len(args) != 2 {
+			return errApplySyntax
+		}
+		at, err := parseUnixMilli(args[1])
+		if err != nil {
+			return err
+		}
+		c.ExpireAt(args[0], at)
+		return nil
+	case "PERSIST":
+		if len(args) != 1 {
+			return errApplySyntax
+		}
+		c.Persist(args[0])
+		return nil
+	case "LPUSH", "SADD":
+		if len(args) < 2 {
+			return errApplySyntax
+		}
+		if name == "LPUSH" {
+			c.LPush(args[0], args[1:]...)
+		} else {
+			c.SAdd(args[0], args[1:]...)
+		}
+		return nil
+	case "SREM", "HDEL":
+		if len(args) < 2 {
+			return errApplySyntax
+		}
+		if name == "SREM" {
+			c.SRem(args[0], args[1:]...)
+		} else {
+			c.HDel(args[0], args[1:]...)
+		}
+		return nil
+	case "INCRBY":
+		if len(args) != 2 {
+			return errApplySyntax
+		}
+		delta, err := strconv.ParseInt(args[1], 10, 64)
+		if err != nil {
+			return err
+		}
+		_, err = c.IncrBy(args[0], delta)
+		return err
+	case "LPOP":
+		if len(args) != 1 {
+			return errApplySyntax
+		}
+		c.LPop(args[0])
+		return nil
+	case "HSET":
+		if len(args) < 3 || len(args)%2 != 1 {
+			return errApplySyntax
+		}
+		for i := 1; i < len(args); i += 2 {
+			c.HSet(args[0], args[i], args[i+1])
+		}
+		return nil
+	case "ZADD":
+		if len(args) < 3 || len(args)%2 != 1 {
+			return errApplySyntax
+		}
+		members := make([]ZMember, 0, len(args)/2)
+		for i := 1; i < len(args); i += 2 {
+			score, err := strconv.ParseFloat(args[i], 64)
+			if err != nil {
+				return err
+			}
+			members = append(members, ZMember{Member: args[i+1], Score: score})
+		}
+		_, err := c.ZAdd(args[0], ZAddOptions{}, members...)
+		return err
+	case "ZREM":
+		if len(args) < 2 {
+			return errApplySyntax
+		}
+		_, err := c.ZRem(args[0], args[1:]...)
+		return err
+	case "XADD":
+		if len(args) < 4 || len(args)%2 != 0 {
+			return errApplySyntax
+		}
+		_, _, err := c.XAdd(args[0], args[1], args[2:], XAddOptions{})
+		return err
+	case "XTRIM":
+		if len(args) != 3 || !strings.EqualFold(args[1], "MAXLEN") {
+			return errApplySyntax
+		}
+		n, err := strconv.Atoi(args[2])
+		if err != nil {
+			return err
+		}
+		_, err = c.XTrim(args[0], n)
+		return err
+	case "XGROUP":
+		return c.applyXGroup(args)
+	case "XACK":
+		if len(args) < 3 {
+			return errApplySyntax
+		}
+		ids, err := parseApplyStreamIDs(args[2:])
+		if err != nil {
+			return err
+		}
+		_, err = c.XAck(args[0], args[1], ids...)
+		return err
+	case "XCLAIM":
+		return c.applyXClaim(args)
+	}
+	return fmt.Errorf("unknown command")
+}
+
+// parseExpiry parses an optional trailing PXAT ms.
+func parseExpiry(args []string) (time.Time, error) {
+	switch {
+	case len(args) == 0:
+		return time.Time{}, nil
+	case len(args) == 2 && strings.EqualFold(args[0], "PXAT"):
+		return parseUnixMilli(args[1])
+	}
+	return time.Time{}, errApplySyntax
+}
+
+func parseUnixMilli(s string) (time.Time, error) {
+	ms, err := strconv.ParseInt(s, 10, 64)
+	if err != nil {
+		return time.Time{}, err
+	}
+	return time.UnixMilli(ms), nil
+}
+
+// SET key value [PXAT ms] | SETVALUE key type payload [PXAT ms]
+func (c *BoltCache) applySet(name string, args []string) error {
+	value, at, err := parseSetArgs(name, args)
+	if err != nil {
+		return err
+	}
+	c.SetWithOptions(args[0], value, SetOptions{ExpireAt: at})
+	return nil
+}
+
+// parseSetArgs returns the value and expiration of SET or SETVALUE.
+func parseSetArgs(name string, args []string) (interface{}, time.Time, error) {
+	if len(args) < 2 {
+		return nil, time.Time{}, errApplySyntax
+	}
+
+	var value interface{} = args[1]
+	rest := args[2:]
+	if name == "SETVALUE" {
+		if len(args) < 3 {
+			return nil, time.Time{}, errApplySyntax
+		}
+		v, err := DecodeValue(args[1], []byte(args[2]))
+		if err != nil {
+			return nil, time.Time{}, err
+		}
+		value, rest = v, args[3:]
+	}
+
+	at, err := parseExpiry(rest)
+	if err != nil {
+		return nil, time.Time{}, err
+	}
+	return value, at, nil
+}
+
+func (c *BoltCache) applyXGroup(args []string) error {
+	if len(args) < 3 {
+		return errApplySyntax
+	}
+	key, group := args[1], args[2]
+
+	var err error
+	switch sub := strings.ToUpper(args[0]); {
+	case sub == "CREATE" && (len(args) == 4 || len(args) == 5):
+		err = c.XGroupCreate(key, group, args[3], len(args) == 5)
+	case sub == "SETID" && len(args) == 4:
+		err = c.XGroupSetID(key, group, args[3])
+	case sub == "DESTROY" && len(args) == 3:
+		_, err = c.XGroupDestroy(key, group)
+	case sub == "CREATECONSUMER" && len(args) == 4:
+		_, err = c.XGroupCreateConsumer(key, group, args[3])
+	case sub == "DELCONSUMER" && len(args) == 4:
+		_, err = c.XGroupDelConsumer(key, group, args[3])
+	default:
+		return errApplySyntax
+	}
+	return err
+}
+
+// XCLAIM key group consumer min-idle id [id ...] [TIME ms] [RETRYCOUNT n]
+// [FORCE] [JUSTID]
+func (c *BoltCache) applyXClaim(args []string) error {
+	if len(args) < 5 {
+		return errApplySyntax
+	}
+	minIdle, err := strconv.ParseInt(args[3], 10, 64)
+	if err != nil {
+		return err
+	}
+
+	var opts XClaimOptions
+	var ids []StreamID
+	for i := 4; i < len(args); i++ {
+		switch strings.ToUpper(args[i]) {
+		case "TIME", "RETRYCOUNT":
+			if i+1 == len(args) {
+				return errApplySyntax
+			}
+			n, err := strconv.ParseInt(args[i+1], 10, 64)
+			if err != nil {
+				return err
+			}
+			if strings.EqualFold(args[i], "TIME") {
+				opts.Time = time.UnixMilli(n)
+			} else {
+				opts.Retry, opts.RetryCount = true, int(n)
+			}
+			i++
+		case "FORCE":
+			opts.Force = true
+		case "JUSTID":
+			opts.JustID = true
+		default:
+			id, err := ParseStreamID(args[i], 0)
+			if err != nil {
+				return err
+			}
+			ids = append(ids, id)
+		}
+	}
+
+	_, err = c.XClaim(args[0], args[1], args[2], time.Duration(minIdle)*time.Millisecond, ids, opts)
+	return err
+}
+
+func parseApplyStreamIDs(args []string) ([]StreamID, error) {
+	ids := make([]StreamID, len(args))
+	for i, a := range args {
+		id, err := ParseStreamID(a, 0)
+		if err != nil {
+			return nil, err
+		}
+		ids[i] = id
+	}
+	return ids, nil
+}
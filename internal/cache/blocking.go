@@ -0,0 +1,61 @@
+package cache
+
+import (
+	"sync"
+)
+
+// keyWaiters tracks clients blocked on keys, such as XREAD BLOCK, so
+// writers can wake them.
+type keyWaiters struct {
+	mu    sync.Mutex
+	byKey map[string]map[chan struct{}]struct{}
+}
+
+// WaitKeys registers interest in writes to keys. The returned channel
+// receives a value after a write to any of them; several writes before
+// the receiver wakes up are coalesced. stop must be called to unregister.
+func (c *BoltCache) WaitKeys(keys []string) (wake <-chan struct{}, stop func()) {
+	ch := make(chan struct{}, 1)
+	w := &c.waiters
+
+	w.mu.Lock()
+	if w.byKey == nil {
+		w.byKey = make(map[string]map[chan struct{}]struct{})
+	}
+	for _, key := range keys {
+		set := w.byKey[key]
+		if set == nil {
+			set = make(map[chan struct{}]struct{})
+			w.byKey[key] = set
+		}
+		set[ch] = struct{}{}
+	}
+	w.mu.Unlock()
+
+	return ch, func() {
+		w.mu.Lock()
+		defer w.mu.Unlock()
+		for _, key := range keys {
+			if set := w.byKey[key]; set != nil {
+				delete(set, ch)
+				if len(set) == 0 {
+					delete(w.byKey, key)
+				}
+			}
+		}
+	}
+}
+
+// signalKey wakes the clients waiting on key.
+func (c *BoltCache) signalKey(key string) {
+	w := &c.waiters
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	for ch := range w.byKey[key] {
+		select {
+		case ch <- struct{}{}:
+		default:
+		}
+	}
+}
@@ -2,16 +2,24 @@ package cache
 
 import (
 	"sync"
+	"sync/atomic"
 	"time"
 )
 
 import (
 	config "boltcache/config"
+	cluster "boltcache/internal/cluster"
 )
 
 type CacheItem struct {
 	Value     interface{}
 	ExpiresAt time.Time
+
+	// Bookkeeping maintained by ShardedMap and never persisted.
+	size       int64
+	lastAccess int64
+	hits       uint32
+	version    uint64 // see ShardedMap.Version
 }
 
 type BoltCache struct {
@@ -22,6 +30,31 @@ type BoltCache struct {
 	Replicas    []string
 	LuaEngine *LuaEngine
 	Config    *config.Config
+
+	// Cluster is the membership table when the node runs in a cluster.
+	Cluster *cluster.Cluster
+
+	// Consensus is set when keyspaces are replicated through Raft.
+	Consensus *Consensus
+
+	// TxMu makes transactions atomic: commands run holding the read
+	// lock, EXEC holds the write lock while it applies its queue.
+	TxMu sync.RWMutex
+
+	waiters keyWaiters
+
+	hooks atomic.Value // []WriteHook
+	aof   *appendOnlyFile
+	saves saveState
+
+	replConfig  config.ReplicationConfig
+	backlogSize int64
+	master      atomic.Pointer[replicationMaster] // set on a replication master
+	replica     atomic.Pointer[replicaState]      // set on a replica
+	active      atomic.Pointer[activeReplication] // set in active-active mode
+	antiEntropy antiEntropyStats
+
+	expiryOnce sync.Once
 }
 
 var _API = (*BoltCache)(nil)
@@ -35,7 +68,7 @@ func NewBoltCache(persistFile ...string) *BoltCache {
 		bc.PersistFile = persistFile[0]
 	}
 
-	go bc.cleanupExpired()
+	bc.StartActiveExpiry()
 	return bc
 }
 
@@ -50,26 +83,89 @@ func (c *BoltCache) Set(key string, value interface{}, ttl time.Duration) {
 		ExpiresAt: expiresAt,
 	}
 
-	c.Data.Store(key, item)
+	c.Data.storeIf(key, item, func(*CacheItem) bool {
+		c.propagateSet(key, item)
+		return true
+	})
+}
+
+// put stores value without an expiration and without propagating the
+// write. Collection commands use it and propagate the command instead.
+func (c *BoltCache) put(key string, value interface{}) {
+	c.Data.Store(key, &CacheItem{Value: value})
 }
 
 func (c *BoltCache) Get(key string) (interface{}, bool) {
-	val, ok := c.Data.Load(key)
+	item, ok := c.Data.Load(key)
 	if !ok {
 		return nil, false
 	}
 
-	item := val.(*CacheItem)
-	if !item.ExpiresAt.IsZero() && time.Now().After(item.ExpiresAt) {
-		c.Data.Delete(key)
+	if item.expired(time.Now()) {
+		c.Data.expireItem(key, item)
 		return nil, false
 	}
 
 	return item.Value, true
 }
 
-func (c *BoltCache) Delete(key string) {
-	c.Data.Delete(key)
+// Delete removes key and reports whether it existed.
+func (c *BoltCache) Delete(key string) bool {
+	return c.delete(key, true)
+}
+
+func (c *BoltCache) delete(key string, propagate bool) bool {
+	item, ok := c.Data.Load(key)
+	if !ok {
+		return false
+	}
+	if item.expired(time.Now()) {
+		c.Data.expireItem(key, item)
+		return false
+	}
+	return c.Data.deleteIf(key, func(*CacheItem) bool {
+		if propagate {
+			c.propagate("DEL", key)
+		}
+		return true
+	})
+}
+
+// SetOptions are the conditional and expiration flags of SET.
+type SetOptions struct {
+	TTL      time.Duration // relative expiration, 0 = none
+	ExpireAt time.Time     // absolute expiration, wins over TTL
+	KeepTTL  bool          // retain the expiration of an existing key
+	NX       bool          // only set if the key does not exist
+	XX       bool          // only set if the key already exists
+}
+
+// SetWithOptions stores value according to opts and reports whether the
+// value was written. The existence check and the write are atomic.
+func (c *BoltCache) SetWithOptions(key string, value interface{}, opts SetOptions) bool {
+	return c.setWithOptions(key, value, opts, true)
+}
+
+func (c *BoltCache) setWithOptions(key string, value interface{}, opts SetOptions, propagate bool) bool {
+	expiresAt := opts.ExpireAt
+	if expiresAt.IsZero() && opts.TTL > 0 {
+		expiresAt = time.Now().Add(opts.TTL)
+	}
+
+	item := &CacheItem{Value: value, ExpiresAt: expiresAt}
+	return c.Data.storeIf(key, item, func(old *CacheItem) bool {
+		exists := old != nil && !old.expired(time.Now())
+		if (opts.NX && exists) || (opts.XX && !exists) {
+			return false
+		}
+		if opts.KeepTTL && exists {
+			item.ExpiresAt = old.ExpiresAt
+		}
+		if propagate {
+			c.propagateSet(key, item)
+		}
+		return true
+	})
 }
 
 func (c *BoltCache) AddReplica(addr string) {
@@ -78,6 +174,13 @@ func (c *BoltCache) AddReplica(addr string) {
 	c.Replicas = append(c.Replicas, addr)
 }
 
+// SetReplicas replaces the replicas added with AddReplica.
+func (c *BoltCache) SetReplicas(addrs []string) {
+	c.Mu.Lock()
+	defer c.Mu.Unlock()
+	c.Replicas = append([]string(nil), addrs...)
+}
+
 func (c *BoltCache) GetReplicas() []string {
 	c.Mu.RLock()
 	defer c.Mu.RUnlock()
@@ -1,6 +1,8 @@
-package cache 
+package cache
 
 import (
+	"container/heap"
+	"sync/atomic"
 	"time"
 )
 
@@ -8,28 +10,174 @@ import (
 	logger "boltcache/logger"
 )
 
-func (c *BoltCache) cleanupExpired() {
-	ticker := time.NewTicker(time.Minute)
+const (
+	defaultActiveExpireInterval = 100 * time.Millisecond
+	defaultActiveExpireBudget   = 25 * time.Millisecond
+
+	// expireBatchPerShard caps how many keys one shard may expire per visit,
+	// so a shard full of dead keys cannot starve the others.
+	expireBatchPerShard = 64
+
+	// budgetCheckEvery is how many shards are visited between clock reads.
+	budgetCheckEvery = 16
+)
+
+type expiryEntry struct {
+	at  int64 // unix nanoseconds
+	key string
+}
+
+// expiryHeap is a min-heap of deadlines. Entries are never removed when a
+// key is deleted or its TTL changes; stale entries are recognised and
+// dropped when they reach the top.
+type expiryHeap []expiryEntry
+
+func (h expiryHeap) Len() int            { return len(h) }
+func (h expiryHeap) Less(i, j int) bool  { return h[i].at < h[j].at }
+func (h expiryHeap) Swap(i, j int)       { h[i], h[j] = h[j], h[i] }
+func (h *expiryHeap) Push(x interface{}) { *h = append(*h, x.(expiryEntry)) }
+func (h *expiryHeap) Pop() interface{} {
+	old := *h
+	n := len(old)
+	e := old[n-1]
+	*h = old[:n-1]
+	return e
+}
+
+// trackExpiry registers a deadline for key. The caller must hold s.mu.
+func (s *Shard) trackExpiry(key string, at time.Time) {
+	heap.Push(&s.expiries, expiryEntry{at: at.UnixNano(), key: key})
+
+	// Overwritten TTLs leave stale entries behind; rebuild once they
+	// clearly outnumber the live keys.
+	if len(s.expiries) > 2*len(s.items)+1024 {
+		s.rebuildExpiries()
+	}
+}
+
+func (s *Shard) rebuildExpiries() {
+	live := s.expiries[:0]
+	for key, item := range s.items {
+		if !item.ExpiresAt.IsZero() {
+			live = append(live, expiryEntry{at: item.ExpiresAt.UnixNano(), key: key})
+		}
+	}
+	// Clear the tail so dropped keys can be collected.
+	for i := len(live); i < len(s.expiries); i++ {
+		s.expiries[i] = expiryEntry{}
+	}
+	s.expiries = live
+	heap.Init(&s.expiries)
+}
+
+// expireShard deletes up to limit keys of shard whose deadline has passed.
+func (sm *ShardedMap) expireShard(shard *Shard, now int64, limit int) int {
+	// Most visits find nothing due; don't take the write lock for those.
+	shard.mu.RLock()
+	due := len(shard.expiries) > 0 && shard.expiries[0].at <= now
+	shard.mu.RUnlock()
+	if !due {
+		return 0
+	}
+
+	shard.mu.Lock()
+	defer shard.mu.Unlock()
+
+	removed := 0
+	for removed < limit && len(shard.expiries) > 0 && shard.expiries[0].at <= now {
+		e := heap.Pop(&shard.expiries).(expiryEntry)
+		item, ok := shard.items[e.key]
+		if !ok || item.ExpiresAt.IsZero() || item.ExpiresAt.UnixNano() != e.at {
+			continue // stale entry
+		}
+		sm.removeLocked(shard, e.key, item)
+		removed++
+	}
+	if removed > 0 {
+		atomic.AddUint64(&sm.expired, uint64(removed))
+	}
+	return removed
+}
+
+// expireItem removes an item found expired on access.
+func (sm *ShardedMap) expireItem(key string, item *CacheItem) {
+	if sm.deleteItem(key, item) {
+		atomic.AddUint64(&sm.expired, 1)
+	}
+}
+
+// ExpiredKeys returns the number of keys removed because their TTL passed.
+func (sm *ShardedMap) ExpiredKeys() uint64 {
+	return atomic.LoadUint64(&sm.expired)
+}
+
+// StartActiveExpiry starts the background expiration cycle. It is safe to
+// call more than once; only the first call starts a goroutine.
+func (c *BoltCache) StartActiveExpiry() {
+	c.expiryOnce.Do(func() {
+		go c.activeExpireLoop()
+	})
+}
+
+// activeExpireLoop wakes up every active_expire_interval and walks the
+// shards round-robin, popping due deadlines from each shard's heap until
+// active_expire_budget is spent. Lazy expiration in Get covers whatever
+// a cycle does not reach.
+func (c *BoltCache) activeExpireLoop() {
+	interval := defaultActiveExpireInterval
+	budget := defaultActiveExpireBudget
+	logInterval := time.Minute
+	if c.Config != nil {
+		if c.Config.Cache.ActiveExpireInterval > 0 {
+			interval = c.Config.Cache.ActiveExpireInterval
+		}
+		if c.Config.Cache.ActiveExpireBudget > 0 {
+			budget = c.Config.Cache.ActiveExpireBudget
+		}
+		if c.Config.Cache.CleanupInterval > 0 {
+			logInterval = c.Config.Cache.CleanupInterval
+		}
+	}
+
+	ticker := time.NewTicker(interval)
 	defer ticker.Stop()
 
+	cursor := 0
+	cleaned := 0
+	lastLog := time.Now()
+
 	for range ticker.C {
-		now := time.Now()
-		expiredKeys := make([]string, 0)
+		var n int
+		n, cursor = c.Data.activeExpireCycle(cursor, budget)
+		cleaned += n
 
-		c.Data.Range(func(key, value interface{}) bool {
-			item := value.(*CacheItem)
-			if !item.ExpiresAt.IsZero() && now.After(item.ExpiresAt) {
-				expiredKeys = append(expiredKeys, key.(string))
+		if time.Since(lastLog) >= logInterval {
+			if cleaned > 0 {
+				logger.Log("Cleaned up %d expired keys", cleaned)
 			}
-			return true
-		})
-
-		for _, key := range expiredKeys {
-			c.Data.Delete(key)
+			cleaned = 0
+			lastLog = time.Now()
 		}
+	}
+}
+
+// activeExpireCycle visits shards starting at cursor until every shard has
+// been seen once or budget is exhausted. It returns the number of expired
+// keys and the cursor to resume from.
+func (sm *ShardedMap) activeExpireCycle(cursor int, budget time.Duration) (int, int) {
+	start := time.Now()
+	now := start.UnixNano()
+	removed := 0
+
+	for visited := 0; visited < ShardCount; visited++ {
+		shard := sm.shards[cursor]
+		cursor = (cursor + 1) & (ShardCount - 1)
+
+		removed += sm.expireShard(shard, now, expireBatchPerShard)
 
-		if len(expiredKeys) > 0 {
-			logger.Log("Cleaned up %d expired keys", len(expiredKeys))
+		if visited%budgetCheckEvery == budgetCheckEvery-1 && time.Since(start) >= budget {
+			break
 		}
 	}
-}
\ No newline at end of file
+	return removed, cursor
+}
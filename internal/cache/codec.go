@@ -0,0 +1,194 @@
+package cache
+
+import (
+	"encoding/json"
+	"fmt"
+	"sort"
+	"strconv"
+)
+
+// Type tags for persisted values. Each value is stored with its tag so it
+// decodes back to the exact Go type the commands expect.
+const (
+	TypeString = "string"
+	TypeBytes  = "bytes"
+	TypeList   = "list"
+	TypeSet    = "set"
+	TypeHash   = "hash"
+	TypeZSet   = "zset"
+	TypeStream = "stream"
+	// TypeJSON holds arbitrary JSON values stored through the REST API.
+	TypeJSON = "json"
+)
+
+// TypeOf returns the type tag for value.
+func TypeOf(value interface{}) string {
+	switch value.(type) {
+	case string:
+		return TypeString
+	case []byte:
+		return TypeBytes
+	case []string:
+		return TypeList
+	case map[string]struct{}:
+		return TypeSet
+	case map[string]string:
+		return TypeHash
+	case *SortedSet:
+		return TypeZSet
+	case *Stream:
+		return TypeStream
+	}
+	return TypeJSON
+}
+
+// zsetRecord is the persisted form of a sorted set member. Scores are
+// strings because JSON numbers can't hold +inf and -inf.
+type zsetRecord struct {
+	Member string `json:"member"`
+	Score  string `json:"score"`
+}
+
+// EncodeValue returns the type tag and JSON encoding of value.
+func EncodeValue(value interface{}) (string, []byte, error) {
+	typ := TypeOf(value)
+
+	var v interface{} = value
+	switch x := value.(type) {
+	case map[string]struct{}:
+		members := make([]string, 0, len(x))
+		for m := range x {
+			members = append(members, m)
+		}
+		sort.Strings(members)
+		v = members
+	case *SortedSet:
+		members := x.Range(0, -1, false)
+		records := make([]zsetRecord, len(members))
+		for i, m := range members {
+			records[i] = zsetRecord{m.Member, formatScore(m.Score)}
+		}
+		v = records
+	}
+
+	data, err := json.Marshal(v)
+	return typ, data, err
+}
+
+// DecodeValue is the inverse of EncodeValue.
+func DecodeValue(typ string, data []byte) (interface{}, error) {
+	switch typ {
+	case TypeString:
+		var s string
+		err := json.Unmarshal(data, &s)
+		return s, err
+	case TypeBytes:
+		var b []byte
+		err := json.Unmarshal(data, &b)
+		return b, err
+	case TypeList:
+		var l []string
+		if err := json.Unmarshal(data, &l); err != nil {
+			return nil, err
+		}
+		if l == nil {
+			l = []string{}
+		}
+		return l, nil
+	case TypeSet:
+		var members []string
+		if err := json.Unmarshal(data, &members); err != nil {
+			return nil, err
+		}
+		set := make(map[string]struct{}, len(members))
+		for _, m := range members {
+			set[m] = struct{}{}
+		}
+		return set, nil
+	case TypeHash:
+		h := make(map[string]string)
+		err := json.Unmarshal(data, &h)
+		return h, err
+	case TypeZSet:
+		var records []zsetRecord
+		if err := json.Unmarshal(data, &records); err != nil {
+			return nil, err
+		}
+		z := NewSortedSet()
+		for _, r := range records {
+			score, err := strconv.ParseFloat(r.Score, 64)
+			if err != nil {
+				return nil, fmt.Errorf("zset member %q: %v", r.Member, err)
+			}
+			z.set(r.Member, score)
+		}
+		return z, nil
+	case TypeStream:
+		s := NewStream()
+		err := json.Unmarshal(data, s)
+		return s, err
+	case TypeJSON:
+		var v interface{}
+		err := json.Unmarshal(data, &v)
+		return v, err
+	case "":
+		return decodeUntyped(data)
+	}
+	return nil, fmt.Errorf("unknown value type %q", typ)
+}
+
+// decodeUntyped reads values from files written before type tags were
+// added. Lists, sets and hashes came back from plain JSON as generic
+// slices and maps; they are converted back when their shape is
+// unambiguous.
+func decodeUntyped(data []byte) (interface{}, error) {
+	var v interface{}
+	if err := json.Unmarshal(data, &v); err != nil {
+		return nil, err
+	}
+
+	switch x := v.(type) {
+	case []interface{}:
+		list := make([]string, 0, len(x))
+		for _, e := range x {
+			s, ok := e.(string)
+			if !ok {
+				return v, nil
+			}
+			list = append(list, s)
+		}
+		return list, nil
+	case map[string]interface{}:
+		if len(x) == 0 {
+			return v, nil
+		}
+		if isLegacySet(x) {
+			set := make(map[string]struct{}, len(x))
+			for m := range x {
+				set[m] = struct{}{}
+			}
+			return set, nil
+		}
+		hash := make(map[string]string, len(x))
+		for f, e := range x {
+			s, ok := e.(string)
+			if !ok {
+				return v, nil
+			}
+			hash[f] = s
+		}
+		return hash, nil
+	}
+	return v, nil
+}
+
+// isLegacySet reports whether m is a JSON-encoded map[string]struct{},
+// where every value is an empty object.
+func isLegacySet(m map[string]interface{}) bool {
+	for _, e := range m {
+		if obj, ok := e.(map[string]interface{}); !ok || len(obj) != 0 {
+			return false
+		}
+	}
+	return true
+}
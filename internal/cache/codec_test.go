@@ -0,0 +1,82 @@
+package cache
+
+import (
+	"encoding/json"
+	"math"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+)
+
+import (
+	config "boltcache/config"
+)
+
+func TestPersistenceRoundTripsTypes(t *testing.T) {
+	dir := t.TempDir()
+	cfg := &config.Config{}
+	cfg.Persistence.Enabled = true
+	cfg.Persistence.File = filepath.Join(dir, "cache.json")
+
+	c := &BoltCache{Data: NewShardedMap(), Config: cfg}
+	c.Set("str", "hello", time.Hour)
+	c.Set("bytes", []byte{0, 1, 0xff}, 0)
+	c.Set("json", map[string]interface{}{"n": 1.5}, 0)
+	c.Set("empty", []string{}, 0)
+	c.LPush("list", "a", "b")
+	c.SAdd("set", "x", "y")
+	c.HSet("hash", "f", "v")
+	c.ZAdd("zset", ZAddOptions{}, ZMember{"lo", math.Inf(-1)}, ZMember{"mid", 2.5}, ZMember{"hi", math.Inf(1)})
+	c.ForcePersist()
+
+	c2 := &BoltCache{Data: NewShardedMap(), PersistFile: cfg.Persistence.File}
+	c2.LoadFromDisk()
+
+	for _, key := range []string{"str", "bytes", "json", "empty", "list", "set", "hash"} {
+		want, _ := c.Get(key)
+		got, _ := c2.Get(key)
+		if !reflect.DeepEqual(got, want) {
+			t.Errorf("%s: got %#v, want %#v", key, got, want)
+		}
+	}
+	if item, _ := c2.Data.Load("str"); item.ExpiresAt.IsZero() {
+		t.Errorf("str lost its TTL")
+	}
+	if got, _ := c2.LPop("list"); got == "" {
+		t.Errorf("LPop after reload found no list")
+	}
+	members, _ := c2.ZRange("zset", 0, -1, false)
+	if len(members) != 3 || !math.IsInf(members[0].Score, -1) || members[1].Score != 2.5 || !math.IsInf(members[2].Score, 1) {
+		t.Errorf("zset after reload: %v", members)
+	}
+}
+
+// Files written before type tags existed store plain JSON values.
+func TestLoadUntypedPersistence(t *testing.T) {
+	file := filepath.Join(t.TempDir(), "old.json")
+	old := map[string]interface{}{
+		"list": map[string]interface{}{"Value": []string{"a", "b"}},
+		"set":  map[string]interface{}{"Value": map[string]struct{}{"x": {}}},
+		"hash": map[string]interface{}{"Value": map[string]string{"f": "v"}},
+		"str":  map[string]interface{}{"Value": "s"},
+	}
+	data, _ := json.Marshal(old)
+	os.WriteFile(file, data, 0644)
+
+	c := &BoltCache{Data: NewShardedMap(), PersistFile: file}
+	c.LoadFromDisk()
+
+	want := map[string]interface{}{
+		"list": []string{"a", "b"},
+		"set":  map[string]struct{}{"x": {}},
+		"hash": map[string]string{"f": "v"},
+		"str":  "s",
+	}
+	for key, w := range want {
+		if got, _ := c.Get(key); !reflect.DeepEqual(got, w) {
+			t.Errorf("%s: got %#v, want %#v", key, got, w)
+		}
+	}
+}
@@ -0,0 +1,48 @@
+package cache
+
+import (
+	"strings"
+)
+
+import (
+	raft "boltcache/internal/raft"
+)
+
+// Consensus is the Raft group the keys under Prefixes are replicated
+// through. Every member holds all of them.
+type Consensus struct {
+	*raft.Node
+	Prefixes []string
+}
+
+// Covers reports whether key is under consensus.
+func (c *Consensus) Covers(key string) bool {
+	for _, p := range c.Prefixes {
+		if strings.HasPrefix(key, p) {
+			return true
+		}
+	}
+	return false
+}
+
+// underConsensus reports whether a write from the replication stream is to
+// a key under consensus, which a Raft member gets through the log instead.
+func (c *BoltCache) underConsensus(args []string) bool {
+	if c.Consensus == nil || len(args) < 2 {
+		return false
+	}
+	key := args[1]
+	if strings.EqualFold(args[0], "XGROUP") && len(args) > 2 {
+		key = args[2]
+	}
+	return c.Consensus.Covers(key)
+}
+
+// notUnderConsensus matches the keys a full resync replaces: all of them,
+// unless some are under consensus.
+func (c *BoltCache) notUnderConsensus() func(string) bool {
+	if c.Consensus == nil {
+		return nil
+	}
+	return func(key string) bool { return !c.Consensus.Covers(key) }
+}
@@ -0,0 +1,69 @@
+package cache
+
+import (
+	"errors"
+	"math"
+	"strconv"
+	"time"
+)
+
+var (
+	ErrNotInteger = errors.New("ERR value is not an integer or out of range")
+	ErrOverflow   = errors.New("ERR increment or decrement would overflow")
+)
+
+// IncrBy adds delta to the integer stored as a string at key, starting
+// from 0 when the key is missing, and returns the new value. The key keeps
+// its expiration.
+func (c *BoltCache) IncrBy(key string, delta int64) (int64, error) {
+	var n int64
+	var err error
+	item := &CacheItem{}
+	c.Data.storeIf(key, item, func(old *CacheItem) bool {
+		var cur int64
+		if old != nil && !old.expired(time.Now()) {
+			if cur, err = integerValue(old.Value); err != nil {
+				return false
+			}
+			item.ExpiresAt = old.ExpiresAt
+		}
+		if delta > 0 && cur > math.MaxInt64-delta || delta < 0 && cur < math.MinInt64-delta {
+			err = ErrOverflow
+			return false
+		}
+		n = cur + delta
+		item.Value = strconv.FormatInt(n, 10)
+		// The hooks get the result, since the AOF rewrite and full syncs
+		// may apply a string write twice. Active-active peers add up
+		// the increments.
+		if c.hooked() {
+			c.runHooks(setArgs(key, item))
+		}
+		if a := c.active.Load(); a != nil {
+			a.record(c, []string{"INCRBY", key, strconv.FormatInt(delta, 10)})
+		}
+		return true
+	})
+	return n, err
+}
+
+// integerValue parses a value holding a 64-bit integer.
+func integerValue(value interface{}) (int64, error) {
+	var s string
+	switch v := value.(type) {
+	case string:
+		s = v
+	case []byte:
+		s = string(v)
+	default:
+		if TypeOf(value) != TypeJSON {
+			return 0, ErrWrongType
+		}
+		return 0, ErrNotInteger
+	}
+	n, err := strconv.ParseInt(s, 10, 64)
+	if err != nil {
+		return 0, ErrNotInteger
+	}
+	return n, nil
+}
@@ -0,0 +1,605 @@
+package cache
+
+import (
+	"errors"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Active-active replication keeps, beside the dataset, the CRDT state of
+// every key, which masters exchange as operations:
+//
+//	REG key ts [type payload]     the whole value, or a deletion without it
+//	EXP key ts ms                 the expiration, 0 for none
+//	ADD key tag member            adds a set member (OR-set)
+//	REM key member tag [tag ...]  removes the adds of member it saw
+//	FIELD key ts field [value]    sets a hash field, or deletes it (LWW)
+//	COUNT key ts epoch p n        a node's increments and decrements
+//	TOUCH key ts kind             the last operation on a set, hash or counter
+//
+// Operations are idempotent and commute, so the state of a key is the
+// same on every master that applied the same operations, whatever their
+// order. The value of the key is derived from that state.
+//
+// A write of the whole value clears the key: set members, fields and
+// counts older than the register are dead. A passed expiration clears the
+// key at its deadline the same way. Set, hash and counter operations make
+// the key a set, a hash or a counter when they are newer than the
+// register, and each kind clears the state of the others older than it.
+// Counters are PN-counters added to the integer in the register: every
+// node keeps its totals per epoch, the clear point it saw when counting,
+// so that counts made before a clear drop out.
+
+type elemKind uint8
+
+const (
+	kindNone elemKind = iota
+	kindSet
+	kindHash
+	kindCounter
+	kindCount
+)
+
+const (
+	opReg   = "REG"
+	opExp   = "EXP"
+	opAdd   = "ADD"
+	opRem   = "REM"
+	opField = "FIELD"
+	opCount = "COUNT"
+	opTouch = "TOUCH"
+)
+
+var kindNames = [kindCount]string{kindSet: "set", kindHash: "hash", kindCounter: "counter"}
+
+var errCRDTOp = errors.New("invalid CRDT operation")
+
+// crdtOp is an operation on the state of a key.
+type crdtOp struct {
+	name   string
+	key    string
+	ts     HLC         // REM: unused
+	value  interface{} // REG: the value, nil for a deletion; FIELD: a string, nil for a deletion
+	at     time.Time   // EXP: zero for no expiration
+	member string      // ADD, REM: the member; FIELD: the field
+	tags   []HLC       // REM
+	epoch  HLC         // COUNT
+	p, n   int64       // COUNT
+	kind   elemKind    // TOUCH
+}
+
+// args encodes op as a command.
+func (op *crdtOp) args() ([]string, error) {
+	switch op.name {
+	case opReg:
+		args := []string{opReg, op.key, op.ts.String()}
+		if op.value == nil {
+			return args, nil
+		}
+		if s, ok := op.value.(string); ok {
+			return append(args, TypeString, s), nil
+		}
+		typ, data, err := EncodeValue(op.value)
+		if err != nil {
+			return nil, err
+		}
+		return append(args, typ, string(data)), nil
+	case opExp:
+		ms := "0"
+		if !op.at.IsZero() {
+			ms = formatUnixMilli(op.at)
+		}
+		return []string{opExp, op.key, op.ts.String(), ms}, nil
+	case opAdd:
+		return []string{opAdd, op.key, op.ts.String(), op.member}, nil
+	case opRem:
+		args := []string{opRem, op.key, op.member}
+		for _, t := range op.tags {
+			args = append(args, t.String())
+		}
+		return args, nil
+	case opField:
+		args := []string{opField, op.key, op.ts.String(), op.member}
+		if op.value != nil {
+			args = append(args, op.value.(string))
+		}
+		return args, nil
+	case opCount:
+		return []string{opCount, op.key, op.ts.String(), op.epoch.String(),
+			strconv.FormatInt(op.p, 10), strconv.FormatInt(op.n, 10)}, nil
+	case opTouch:
+		return []string{opTouch, op.key, op.ts.String(), kindNames[op.kind]}, nil
+	}
+	return nil, errCRDTOp
+}
+
+// parseCRDTOp is the inverse of crdtOp.args.
+func parseCRDTOp(args []string) (*crdtOp, error) {
+	if len(args) < 3 {
+		return nil, errCRDTOp
+	}
+	op := &crdtOp{name: strings.ToUpper(args[0]), key: args[1]}
+	var err error
+	if op.name != opRem {
+		if op.ts, err = ParseHLC(args[2]); err != nil {
+			return nil, err
+		}
+	}
+	switch n := len(args); {
+	case op.name == opReg && n == 3:
+	case op.name == opReg && n == 5:
+		op.value = args[4]
+		if args[3] != TypeString {
+			if op.value, err = DecodeValue(args[3], []byte(args[4])); err != nil {
+				return nil, err
+			}
+		}
+	case op.name == opExp && n == 4:
+		ms, err := strconv.ParseInt(args[3], 10, 64)
+		if err != nil {
+			return nil, err
+		}
+		if ms != 0 {
+			op.at = time.UnixMilli(ms)
+		}
+	case op.name == opAdd && n == 4:
+		op.member = args[3]
+	case op.name == opRem && n >= 4:
+		op.member = args[2]
+		for _, a := range args[3:] {
+			t, err := ParseHLC(a)
+			if err != nil {
+				return nil, err
+			}
+			op.tags = append(op.tags, t)
+		}
+	case op.name == opField && (n == 4 || n == 5):
+		op.member = args[3]
+		if n == 5 {
+			op.value = args[4]
+		}
+	case op.name == opCount && n == 6:
+		if op.epoch, err = ParseHLC(args[3]); err != nil {
+			return nil, err
+		}
+		p, err1 := strconv.ParseInt(args[4], 10, 64)
+		m, err2 := strconv.ParseInt(args[5], 10, 64)
+		if err1 != nil || err2 != nil || p < 0 || m < 0 {
+			return nil, errCRDTOp
+		}
+		op.p, op.n = p, m
+	case op.name == opTouch && n == 4:
+		for kind, name := range kindNames {
+			if name != "" && name == args[3] {
+				op.kind = elemKind(kind)
+			}
+		}
+		if op.kind == kindNone {
+			return nil, errCRDTOp
+		}
+	default:
+		return nil, errCRDTOp
+	}
+	return op, nil
+}
+
+// conflict is how an operation met the writes merged before it.
+type conflict uint8
+
+const (
+	noConflict      conflict = iota
+	conflictLWW              // lost to a newer write of the same register or field
+	conflictCleared          // dropped by a newer write of the whole value or another kind
+	conflictAddWins          // a removal left adds it had not seen
+	conflictKinds
+)
+
+type lwwField struct {
+	value   string
+	ts      HLC
+	deleted bool
+}
+
+type counterID struct {
+	node  string
+	epoch HLC
+}
+
+type pnCount struct {
+	p, n int64
+	ts   HLC // last count
+}
+
+// crdtKey is the CRDT state of a key.
+type crdtKey struct {
+	reg   HLC
+	value interface{} // of the register, nil when deleted
+	exp   HLC
+	at    time.Time // zero for no expiration
+
+	latest  [kindCount]HLC              // last operation of each kind
+	adds    map[string]map[HLC]struct{} // member -> tags
+	removed map[string]map[HLC]struct{} // member -> removed tags
+	fields  map[string]lwwField
+	counts  map[counterID]pnCount
+}
+
+// clearPoint returns the time before which the key was cleared, by the
+// register or a passed expiration.
+func (k *crdtKey) clearPoint(now time.Time) HLC {
+	cp := k.reg
+	if !k.at.IsZero() && now.After(k.at) {
+		if d := deadline(k.at); d.After(cp) {
+			cp = d
+		}
+	}
+	return cp
+}
+
+// deadline is the timestamp at which an expiration clears the key. It
+// precedes the writes of every node in the same millisecond.
+func deadline(at time.Time) HLC {
+	return HLC{Wall: at.UnixMilli()}
+}
+
+// floor returns the time before which elements of kind are dead.
+func (k *crdtKey) floor(kind elemKind, cp HLC) HLC {
+	f := cp
+	for other, t := range k.latest {
+		if elemKind(other) != kind && t.After(f) {
+			f = t
+		}
+	}
+	return f
+}
+
+// newest returns the kind of the last element operation and its time.
+func (k *crdtKey) newest() (elemKind, HLC) {
+	kind := kindNone
+	var ts HLC
+	for i, t := range k.latest {
+		if t.After(ts) {
+			kind, ts = elemKind(i), t
+		}
+	}
+	return kind, ts
+}
+
+// touch records an operation of kind at ts.
+func (k *crdtKey) touch(kind elemKind, ts HLC) {
+	if ts.After(k.latest[kind]) {
+		k.latest[kind] = ts
+	}
+}
+
+// cleared classifies an element operation at ts against the floor of its
+// kind.
+func (k *crdtKey) cleared(kind elemKind, ts HLC) conflict {
+	if ts.Compare(k.floor(kind, k.reg)) < 0 {
+		return conflictCleared
+	}
+	return noConflict
+}
+
+func (k *crdtKey) dropTags(before HLC) {
+	for _, m := range []map[string]map[HLC]struct{}{k.adds, k.removed} {
+		for member, tags := range m {
+			for t := range tags {
+				if t.Compare(before) < 0 {
+					delete(tags, t)
+				}
+			}
+			if len(tags) == 0 {
+				delete(m, member)
+			}
+		}
+	}
+}
+
+func (k *crdtKey) dropFields(before HLC) {
+	for f, v := range k.fields {
+		if v.ts.Compare(before) < 0 {
+			delete(k.fields, f)
+		}
+	}
+}
+
+func (k *crdtKey) dropCounts(before HLC) {
+	for id := range k.counts {
+		if id.epoch.Compare(before) < 0 {
+			delete(k.counts, id)
+		}
+	}
+}
+
+// apply merges op into the state and reports whether it changed.
+func (k *crdtKey) apply(op *crdtOp) (bool, conflict) {
+	switch op.name {
+	case opReg:
+		if c := op.ts.Compare(k.reg); c <= 0 {
+			return false, lostTo(c)
+		}
+		k.reg, k.value = op.ts, op.value
+		k.dropTags(op.ts)
+		k.dropFields(op.ts)
+		k.dropCounts(op.ts)
+		return true, noConflict
+	case opExp:
+		if c := op.ts.Compare(k.exp); c <= 0 {
+			return false, lostTo(c)
+		}
+		k.exp, k.at = op.ts, op.at
+		return true, noConflict
+	case opAdd:
+		if op.ts.Compare(k.reg) < 0 {
+			return false, conflictCleared
+		}
+		k.touch(kindSet, op.ts)
+		if _, ok := k.removed[op.member][op.ts]; ok {
+			return false, noConflict
+		}
+		if _, ok := k.adds[op.member][op.ts]; ok {
+			return false, noConflict
+		}
+		addTag(&k.adds, op.member, op.ts)
+		return true, k.cleared(kindSet, op.ts)
+	case opRem:
+		changed := false
+		for _, t := range op.tags {
+			if t.Compare(k.reg) < 0 {
+				continue
+			}
+			if _, ok := k.removed[op.member][t]; ok {
+				continue
+			}
+			// The tag is the time of an add.
+			k.touch(kindSet, t)
+			addTag(&k.removed, op.member, t)
+			delete(k.adds[op.member], t)
+			changed = true
+		}
+		if len(k.adds[op.member]) == 0 {
+			delete(k.adds, op.member)
+		} else if changed {
+			return true, conflictAddWins
+		}
+		return changed, noConflict
+	case opField:
+		if op.ts.Compare(k.reg) < 0 {
+			return false, conflictCleared
+		}
+		k.touch(kindHash, op.ts)
+		cur, ok := k.fields[op.member]
+		if ok {
+			if c := op.ts.Compare(cur.ts); c <= 0 {
+				return false, lostTo(c)
+			}
+		}
+		v, _ := op.value.(string)
+		if k.fields == nil {
+			k.fields = make(map[string]lwwField)
+		}
+		k.fields[op.member] = lwwField{value: v, ts: op.ts, deleted: op.value == nil}
+		return true, k.cleared(kindHash, op.ts)
+	case opCount:
+		// Counts cleared by the register are dropped, but their time
+		// still orders the kinds.
+		k.touch(kindCounter, op.ts)
+		if op.epoch.Compare(k.reg) < 0 {
+			return false, conflictCleared
+		}
+		id := counterID{node: op.ts.Node, epoch: op.epoch}
+		cur := k.counts[id]
+		if op.p <= cur.p && op.n <= cur.n {
+			return false, noConflict
+		}
+		cur.p, cur.n = max(cur.p, op.p), max(cur.n, op.n)
+		if op.ts.After(cur.ts) {
+			cur.ts = op.ts
+		}
+		if k.counts == nil {
+			k.counts = make(map[counterID]pnCount)
+		}
+		k.counts[id] = cur
+		return true, k.cleared(kindCounter, op.epoch)
+	case opTouch:
+		changed := op.ts.After(k.latest[op.kind])
+		k.touch(op.kind, op.ts)
+		return changed, noConflict
+	}
+	return false, noConflict
+}
+
+// lostTo classifies an operation older than the register or field it
+// writes, c being their comparison; an equal one was merged already.
+func lostTo(c int) conflict {
+	if c < 0 {
+		return conflictLWW
+	}
+	return noConflict
+}
+
+func addTag(m *map[string]map[HLC]struct{}, member string, tag HLC) {
+	if *m == nil {
+		*m = make(map[string]map[HLC]struct{})
+	}
+	tags := (*m)[member]
+	if tags == nil {
+		tags = make(map[HLC]struct{})
+		(*m)[member] = tags
+	}
+	tags[tag] = struct{}{}
+}
+
+// materialize returns the value of the key and its expiration, or nil
+// when the key doesn't exist.
+func (k *crdtKey) materialize(now time.Time) (interface{}, time.Time) {
+	cp := k.clearPoint(now)
+	var value interface{}
+	if kind, ts := k.newest(); kind != kindNone && ts.Compare(k.reg) >= 0 {
+		value = k.elements(kind, cp)
+	} else if k.reg.Compare(cp) >= 0 {
+		value = k.value
+	}
+	if value == nil {
+		return nil, time.Time{}
+	}
+	return value, k.expiresAt(now)
+}
+
+// empty reports whether the key doesn't exist, like materialize returning
+// nil but without building the value.
+func (k *crdtKey) empty(now time.Time) bool {
+	cp := k.clearPoint(now)
+	kind, ts := k.newest()
+	if kind == kindNone || ts.Compare(k.reg) < 0 {
+		return k.value == nil || k.reg.Compare(cp) < 0
+	}
+	f := k.floor(kind, cp)
+	switch kind {
+	case kindSet:
+		for m := range k.adds {
+			if k.memberLive(m, f) {
+				return false
+			}
+		}
+	case kindHash:
+		for name := range k.fields {
+			if k.fieldValue(name, f) != nil {
+				return false
+			}
+		}
+	case kindCounter:
+		return k.elements(kindCounter, cp) == nil
+	}
+	return true
+}
+
+// expiresAt returns the expiration of the key if it is still ahead.
+func (k *crdtKey) expiresAt(now time.Time) time.Time {
+	if k.at.After(now) {
+		return k.at
+	}
+	return time.Time{}
+}
+
+// elements builds the value of a key of kind, or returns nil when it is
+// empty.
+func (k *crdtKey) elements(kind elemKind, cp HLC) interface{} {
+	f := k.floor(kind, cp)
+	switch kind {
+	case kindSet:
+		set := make(map[string]struct{})
+		for m := range k.adds {
+			if k.memberLive(m, f) {
+				set[m] = struct{}{}
+			}
+		}
+		if len(set) > 0 {
+			return set
+		}
+	case kindHash:
+		hash := make(map[string]string)
+		for name, v := range k.fields {
+			if v.ts.Compare(f) >= 0 && !v.deleted {
+				hash[name] = v.value
+			}
+		}
+		if len(hash) > 0 {
+			return hash
+		}
+	case kindCounter:
+		// The register is the base of the counts, unless a newer
+		// operation of another kind or an expiration cleared it.
+		var base interface{}
+		if k.reg.Compare(f) >= 0 {
+			base = k.value
+		}
+		n, counted := int64(0), false
+		for id, c := range k.counts {
+			if id.epoch == f {
+				n += c.p - c.n
+				counted = true
+			}
+		}
+		if !counted {
+			return base
+		}
+		if b, err := integerValue(base); err == nil {
+			n += b
+		}
+		return strconv.FormatInt(n, 10)
+	}
+	return nil
+}
+
+// memberLive reports whether set member has an add at or after floor.
+func (k *crdtKey) memberLive(member string, floor HLC) bool {
+	for t := range k.adds[member] {
+		if t.Compare(floor) >= 0 {
+			return true
+		}
+	}
+	return false
+}
+
+// fieldValue returns the value of a hash field, or nil when deleted.
+func (k *crdtKey) fieldValue(field string, floor HLC) interface{} {
+	v, ok := k.fields[field]
+	if !ok || v.deleted || v.ts.Compare(floor) < 0 {
+		return nil
+	}
+	return v.value
+}
+
+// ops returns operations recreating the state.
+func (k *crdtKey) ops(key string) []*crdtOp {
+	var ops []*crdtOp
+	if !k.reg.IsZero() {
+		ops = append(ops, &crdtOp{name: opReg, key: key, ts: k.reg, value: k.value})
+	}
+	if !k.exp.IsZero() {
+		ops = append(ops, &crdtOp{name: opExp, key: key, ts: k.exp, at: k.at})
+	}
+	for m, tags := range k.adds {
+		for t := range tags {
+			ops = append(ops, &crdtOp{name: opAdd, key: key, ts: t, member: m})
+		}
+	}
+	for m, tags := range k.removed {
+		op := &crdtOp{name: opRem, key: key, member: m}
+		for t := range tags {
+			op.tags = append(op.tags, t)
+		}
+		ops = append(ops, op)
+	}
+	for f, v := range k.fields {
+		op := &crdtOp{name: opField, key: key, ts: v.ts, member: f}
+		if !v.deleted {
+			op.value = v.value
+		}
+		ops = append(ops, op)
+	}
+	for id, c := range k.counts {
+		ops = append(ops, &crdtOp{name: opCount, key: key, ts: c.ts, epoch: id.epoch, p: c.p, n: c.n})
+	}
+	// The operations above may not include the last of each kind.
+	for kind, ts := range k.latest {
+		if !ts.IsZero() && ts.Compare(k.reg) >= 0 {
+			ops = append(ops, &crdtOp{name: opTouch, key: key, ts: ts, kind: elemKind(kind)})
+		}
+	}
+	return ops
+}
+
+// lastChange returns the time of the last operation on the key.
+func (k *crdtKey) lastChange() HLC {
+	_, last := k.newest()
+	for _, t := range []HLC{k.reg, k.exp} {
+		if t.After(last) {
+			last = t
+		}
+	}
+	return last
+}
@@ -0,0 +1,127 @@
+package cache
+
+import (
+	"math/rand"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestHLC(t *testing.T) {
+	wall := time.UnixMilli(1000)
+	c := hlcClock{node: "a", now: func() time.Time { return wall }}
+	t1, t2 := c.Now(), c.Now()
+	if !t2.After(t1) || t2.Wall != 1000 || t2.Logical != 1 {
+		t.Fatalf("%v then %v", t1, t2)
+	}
+
+	// A timestamp from a node ahead moves the clock past it.
+	c.Observe(HLC{Wall: 2000, Logical: 5, Node: "b"})
+	if t3 := c.Now(); t3 != (HLC{Wall: 2000, Logical: 6, Node: "a"}) {
+		t.Fatalf("after observing got %v", t3)
+	}
+	wall = time.UnixMilli(3000)
+	if t4 := c.Now(); t4 != (HLC{Wall: 3000, Node: "a"}) {
+		t.Fatalf("after the wall clock moved got %v", t4)
+	}
+
+	ts, err := ParseHLC(HLC{Wall: 7, Logical: 2, Node: "node.1"}.String())
+	if err != nil || ts != (HLC{Wall: 7, Logical: 2, Node: "node.1"}) {
+		t.Fatalf("ParseHLC = %v, %v", ts, err)
+	}
+}
+
+func hlc(wall int64, node string) HLC { return HLC{Wall: wall, Node: node} }
+
+// TestCRDTConverge applies concurrent operations in every order, some of
+// them twice, and checks the value doesn't depend on it.
+func TestCRDTConverge(t *testing.T) {
+	now := time.UnixMilli(1_000_000)
+	tests := []struct {
+		name string
+		ops  []*crdtOp
+		want interface{}
+	}{
+		{"last SET wins", []*crdtOp{
+			{name: opReg, key: "k", ts: hlc(10, "a"), value: "x"},
+			{name: opReg, key: "k", ts: hlc(10, "b"), value: "y"},
+			{name: opReg, key: "k", ts: hlc(9, "c"), value: "z"},
+		}, "y"},
+		{"add wins over a concurrent remove", []*crdtOp{
+			{name: opAdd, key: "k", ts: hlc(10, "a"), member: "m"},
+			{name: opAdd, key: "k", ts: hlc(11, "b"), member: "m"},
+			{name: opAdd, key: "k", ts: hlc(11, "b"), member: "n"},
+			{name: opRem, key: "k", member: "m", tags: []HLC{hlc(10, "a")}},
+			{name: opRem, key: "k", member: "n", tags: []HLC{hlc(11, "b")}},
+		}, map[string]struct{}{"m": {}}},
+		{"a delete clears older members", []*crdtOp{
+			{name: opAdd, key: "k", ts: hlc(10, "a"), member: "m"},
+			{name: opReg, key: "k", ts: hlc(12, "b")},
+			{name: opAdd, key: "k", ts: hlc(13, "a"), member: "n"},
+		}, map[string]struct{}{"n": {}}},
+		{"fields are registers of their own", []*crdtOp{
+			{name: opField, key: "k", ts: hlc(10, "a"), member: "f", value: "1"},
+			{name: opField, key: "k", ts: hlc(11, "b"), member: "f", value: "2"},
+			{name: opField, key: "k", ts: hlc(10, "b"), member: "g", value: "3"},
+			{name: opField, key: "k", ts: hlc(12, "a"), member: "h", value: "4"},
+			{name: opField, key: "k", ts: hlc(13, "b"), member: "h"},
+		}, map[string]string{"f": "2", "g": "3"}},
+		{"counts add up on top of the register", []*crdtOp{
+			{name: opReg, key: "k", ts: hlc(10, "a"), value: "5"},
+			{name: opCount, key: "k", ts: hlc(11, "a"), epoch: hlc(10, "a"), p: 2},
+			{name: opCount, key: "k", ts: hlc(12, "a"), epoch: hlc(10, "a"), p: 3},
+			{name: opCount, key: "k", ts: hlc(11, "b"), epoch: hlc(10, "a"), n: 1},
+		}, "7"},
+		{"counts before a SET drop out", []*crdtOp{
+			{name: opCount, key: "k", ts: hlc(10, "a"), p: 4},
+			{name: opReg, key: "k", ts: hlc(11, "b"), value: "abc"},
+			{name: opCount, key: "k", ts: hlc(12, "a"), p: 6},
+		}, "abc"},
+		{"the newest kind wins", []*crdtOp{
+			{name: opAdd, key: "k", ts: hlc(10, "a"), member: "m"},
+			{name: opField, key: "k", ts: hlc(11, "b"), member: "f", value: "1"},
+			{name: opAdd, key: "k", ts: hlc(12, "a"), member: "n"},
+			{name: opField, key: "k", ts: hlc(9, "b"), member: "g", value: "2"},
+		}, map[string]struct{}{"n": {}}},
+		{"a passed expiration clears the key", []*crdtOp{
+			{name: opReg, key: "k", ts: hlc(10, "a")},
+			{name: opAdd, key: "k", ts: hlc(10, "a"), member: "m"},
+			{name: opExp, key: "k", ts: hlc(10, "a"), at: now.Add(-time.Second)},
+			{name: opAdd, key: "k", ts: HLC{Wall: now.UnixMilli(), Node: "b"}, member: "n"},
+		}, map[string]struct{}{"n": {}}},
+	}
+
+	rnd := rand.New(rand.NewSource(1))
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			for i := 0; i < 20; i++ {
+				ops := append(append([]*crdtOp(nil), tt.ops...), tt.ops[rnd.Intn(len(tt.ops))])
+				rnd.Shuffle(len(ops), func(i, j int) { ops[i], ops[j] = ops[j], ops[i] })
+				k := &crdtKey{}
+				for _, op := range ops {
+					k.apply(op)
+				}
+				if got, _ := k.materialize(now); !reflect.DeepEqual(got, tt.want) {
+					t.Fatalf("order %d: got %v, want %v", i, got, tt.want)
+				}
+
+				// The state sent to a new peer gives the same value.
+				copied := &crdtKey{}
+				for _, op := range k.ops("k") {
+					args, err := op.args()
+					if err != nil {
+						t.Fatal(err)
+					}
+					parsed, err := parseCRDTOp(args)
+					if err != nil {
+						t.Fatalf("parse %q: %v", args, err)
+					}
+					copied.apply(parsed)
+				}
+				if got, _ := copied.materialize(now); !reflect.DeepEqual(got, tt.want) {
+					t.Fatalf("copied state: got %v, want %v", got, tt.want)
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,70 @@
+package cache
+
+import (
+	"bytes"
+	"errors"
+	"time"
+)
+
+var (
+	ErrBusyKey     = errors.New("BUSYKEY Target key name already exists.")
+	ErrBadDumpData = errors.New("ERR DUMP payload version or checksum are wrong")
+)
+
+// Dumped is a key serialized by Dump.
+type Dumped struct {
+	Key       string
+	Payload   []byte    // type tag, ':' and the EncodeValue encoding
+	ExpiresAt time.Time // zero without a TTL
+
+	version uint64
+}
+
+// Dump serializes key for Restore. It returns nil when the key is missing.
+func (c *BoltCache) Dump(key string) (*Dumped, error) {
+	item, ok := c.Data.Load(key)
+	if !ok || item.expired(time.Now()) {
+		return nil, nil
+	}
+	typ, data, err := EncodeValue(item.Value)
+	if err != nil {
+		return nil, err
+	}
+	payload := append([]byte(typ+":"), data...)
+	return &Dumped{Key: key, Payload: payload, ExpiresAt: item.ExpiresAt, version: item.version}, nil
+}
+
+// DeleteDumped deletes the key of d unless it was written since the dump,
+// and reports whether it did.
+func (c *BoltCache) DeleteDumped(d *Dumped) bool {
+	return c.Data.deleteIf(d.Key, func(old *CacheItem) bool {
+		if old.version != d.version {
+			return false
+		}
+		c.propagate("DEL", d.Key)
+		return true
+	})
+}
+
+// Restore stores a value serialized by Dump under key. An existing key is
+// only replaced with replace set. Values already expired are dropped.
+func (c *BoltCache) Restore(key string, payload []byte, expiresAt time.Time, replace bool) error {
+	typ, data, ok := bytes.Cut(payload, []byte(":"))
+	if !ok {
+		return ErrBadDumpData
+	}
+	value, err := DecodeValue(string(typ), data)
+	if err != nil {
+		return ErrBadDumpData
+	}
+	if !expiresAt.IsZero() && !expiresAt.After(time.Now()) {
+		if replace {
+			c.Delete(key)
+		}
+		return nil
+	}
+	if !c.SetWithOptions(key, value, SetOptions{ExpireAt: expiresAt, NX: !replace}) {
+		return ErrBusyKey
+	}
+	return nil
+}
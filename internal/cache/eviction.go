@@ -0,0 +1,319 @@
+package cache
+
+import (
+	"math/rand"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+import (
+	config "boltcache/config"
+	logger "boltcache/logger"
+)
+
+const (
+	// evictionSamples is how many candidate keys are compared per eviction,
+	// the same approximation Redis uses instead of keeping a global LRU list.
+	evictionSamples = 5
+
+	// maxEvictionsPerWrite bounds the work a single write can be charged with.
+	// Remaining pressure is relieved by the following writes.
+	maxEvictionsPerWrite = 32
+
+	// itemOverhead approximates the map entry, CacheItem header and pointers.
+	itemOverhead = 64
+
+	// collectionSampleSize is the number of elements measured exactly before
+	// the size of a large list, set or hash is extrapolated.
+	collectionSampleSize = 64
+
+	// lfuDecayTime is how long an idle key takes to lose half its access
+	// count under the lfu policy, so keys hot long ago make way for keys
+	// hot now. Redis' lfu-decay-time defaults to a minute as well.
+	lfuDecayTime = time.Minute
+)
+
+type evictor struct {
+	policy      string
+	maxMemory   int64
+	maxKeys     int64
+	memoryLimit int64 // maxMemory * threshold
+	keyLimit    int64 // maxKeys * threshold
+	lfuDecay    time.Duration
+
+	mu      sync.Mutex
+	evicted uint64
+	onEvict func(key string)
+}
+
+// EvictionStats is reported by INFO.
+type EvictionStats struct {
+	Policy      string
+	MaxMemory   int64
+	MaxKeys     int64
+	UsedMemory  int64
+	Keys        int
+	EvictedKeys uint64
+}
+
+// ConfigureEviction enables memory accounting limits and the configured
+// eviction policy. Eviction starts once used memory or the key count grows
+// past EvictionThreshold of MaxMemory / MaxKeys. Zero limits disable it.
+func (sm *ShardedMap) ConfigureEviction(cfg config.CacheConfig) {
+	maxMemory, err := config.ParseMemorySize(cfg.MaxMemory)
+	if err != nil {
+		logger.Log("Invalid max_memory %q, memory limit disabled: %v", cfg.MaxMemory, err)
+		maxMemory = 0
+	}
+
+	if maxMemory <= 0 && cfg.MaxKeys <= 0 {
+		sm.evictor = nil
+		return
+	}
+
+	threshold := cfg.EvictionThreshold
+	if threshold <= 0 || threshold > 1 {
+		threshold = 1
+	}
+
+	policy := cfg.EvictionPolicy
+	if policy == "" {
+		policy = "lru"
+	}
+
+	sm.evictor = &evictor{
+		policy:      policy,
+		maxMemory:   maxMemory,
+		maxKeys:     int64(cfg.MaxKeys),
+		memoryLimit: int64(float64(maxMemory) * threshold),
+		keyLimit:    int64(float64(cfg.MaxKeys) * threshold),
+		lfuDecay:    lfuDecayTime,
+	}
+}
+
+// OnEvict registers a callback invoked with every evicted key. It runs
+// while the key's shard is locked and must not access the map.
+func (sm *ShardedMap) OnEvict(fn func(key string)) {
+	if sm.evictor != nil {
+		sm.evictor.onEvict = fn
+	}
+}
+
+// EvictionStats returns the current accounting and eviction counters.
+func (sm *ShardedMap) EvictionStats() EvictionStats {
+	stats := EvictionStats{
+		Policy:     "noeviction",
+		UsedMemory: sm.UsedMemory(),
+		Keys:       sm.Len(),
+	}
+	if e := sm.evictor; e != nil {
+		stats.Policy = e.policy
+		stats.MaxMemory = e.maxMemory
+		stats.MaxKeys = e.maxKeys
+		stats.EvictedKeys = atomic.LoadUint64(&e.evicted)
+	}
+	return stats
+}
+
+func (e *evictor) touch(item *CacheItem) {
+	switch e.policy {
+	case "lru":
+		atomic.StoreInt64(&item.lastAccess, nowNano())
+	case "lfu":
+		// Concurrent accesses may lose a count; the count is approximate
+		// anyway.
+		now := nowNano()
+		if hits := e.frequency(item, now); hits < ^uint32(0) {
+			atomic.StoreUint32(&item.hits, hits+1)
+		}
+		atomic.StoreInt64(&item.lastAccess, now)
+	}
+}
+
+// frequency returns the access count of item halved for every lfuDecay
+// it has been idle at now.
+func (e *evictor) frequency(item *CacheItem, now int64) uint32 {
+	hits := atomic.LoadUint32(&item.hits)
+	if e.lfuDecay <= 0 {
+		return hits
+	}
+	idle := (now - atomic.LoadInt64(&item.lastAccess)) / int64(e.lfuDecay)
+	if idle >= 32 {
+		return 0
+	}
+	if idle > 0 {
+		hits >>= idle
+	}
+	return hits
+}
+
+func (e *evictor) overLimit(sm *ShardedMap) bool {
+	if e.memoryLimit > 0 && atomic.LoadInt64(&sm.memory) > e.memoryLimit {
+		return true
+	}
+	if e.keyLimit > 0 && atomic.LoadInt64(&sm.keys) > e.keyLimit {
+		return true
+	}
+	return false
+}
+
+// makeRoom evicts keys until the map is back under its limits or the
+// per-write budget is spent. The key that was just written is never chosen.
+// It must be called without any shard lock held.
+func (e *evictor) makeRoom(sm *ShardedMap, written string) {
+	if !e.overLimit(sm) {
+		return
+	}
+
+	// Writers evict one at a time so they don't pile onto the same victims.
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	for i := 0; i < maxEvictionsPerWrite && e.overLimit(sm); i++ {
+		key, item, ok := e.pickVictim(sm, written)
+		if !ok {
+			return
+		}
+		evicted := sm.deleteIf(key, func(old *CacheItem) bool {
+			if old != item {
+				return false
+			}
+			if e.onEvict != nil {
+				e.onEvict(key)
+			}
+			return true
+		})
+		if evicted {
+			atomic.AddUint64(&e.evicted, 1)
+		}
+	}
+}
+
+// pickVictim samples a few keys from random shards and returns the best
+// candidate according to the policy.
+func (e *evictor) pickVictim(sm *ShardedMap, skip string) (string, *CacheItem, bool) {
+	var (
+		bestKey  string
+		bestItem *CacheItem
+		sampled  int
+	)
+
+	// Random shards first; when the map is sparse and they keep coming up
+	// empty, walk the remaining shards in order so a victim is always found.
+	start := rand.Intn(ShardCount)
+	for tries := 0; sampled < evictionSamples && tries < ShardCount; tries++ {
+		idx := start + tries
+		if tries < evictionSamples*8 {
+			idx = rand.Intn(ShardCount)
+		}
+		shard := sm.shards[idx&(ShardCount-1)]
+		shard.mu.RLock()
+		for k, item := range shard.items {
+			if k == skip {
+				continue
+			}
+			if bestItem == nil || e.better(item, bestItem) {
+				bestKey, bestItem = k, item
+			}
+			sampled++
+			break
+		}
+		shard.mu.RUnlock()
+	}
+
+	return bestKey, bestItem, bestItem != nil
+}
+
+// better reports whether a is a better eviction candidate than b.
+func (e *evictor) better(a, b *CacheItem) bool {
+	switch e.policy {
+	case "lfu":
+		now := nowNano()
+		return e.frequency(a, now) < e.frequency(b, now)
+	case "random":
+		return false
+	case "ttl":
+		// Keys closest to expiring go first. Keys without a TTL are only
+		// evicted when none of the sampled keys has one, oldest access first.
+		aVolatile, bVolatile := !a.ExpiresAt.IsZero(), !b.ExpiresAt.IsZero()
+		if aVolatile != bVolatile {
+			return aVolatile
+		}
+		if aVolatile {
+			return a.ExpiresAt.Before(b.ExpiresAt)
+		}
+	}
+	return atomic.LoadInt64(&a.lastAccess) < atomic.LoadInt64(&b.lastAccess)
+}
+
+func nowNano() int64 {
+	return time.Now().UnixNano()
+}
+
+func itemSize(key string, value interface{}) int64 {
+	return int64(len(key)) + valueSize(value) + itemOverhead
+}
+
+// memorySizer is implemented by value types that know their own footprint.
+type memorySizer interface {
+	memoryUsage() int64
+}
+
+func valueSize(value interface{}) int64 {
+	switch v := value.(type) {
+	case string:
+		return int64(len(v))
+	case []byte:
+		return int64(len(v))
+	case []string:
+		return 24 + sampledSize(len(v), func(fn func(n int64) bool) {
+			for _, s := range v {
+				if !fn(int64(len(s)) + 16) {
+					return
+				}
+			}
+		})
+	case map[string]struct{}:
+		return 48 + sampledSize(len(v), func(fn func(n int64) bool) {
+			for m := range v {
+				if !fn(int64(len(m)) + 24) {
+					return
+				}
+			}
+		})
+	case map[string]string:
+		return 48 + sampledSize(len(v), func(fn func(n int64) bool) {
+			for f, val := range v {
+				if !fn(int64(len(f)+len(val)) + 40) {
+					return
+				}
+			}
+		})
+	case memorySizer:
+		return v.memoryUsage()
+	default:
+		return 16
+	}
+}
+
+// sampledSize measures up to collectionSampleSize elements and
+// extrapolates, so rewriting a large collection stays cheap.
+func sampledSize(length int, each func(fn func(n int64) bool)) int64 {
+	if length == 0 {
+		return 0
+	}
+
+	var total int64
+	seen := 0
+	each(func(n int64) bool {
+		total += n
+		seen++
+		return seen < collectionSampleSize
+	})
+
+	if seen < length {
+		total = total / int64(seen) * int64(length)
+	}
+	return total
+}
@@ -0,0 +1,105 @@
+package cache
+
+import (
+	"fmt"
+	"testing"
+	"time"
+)
+
+import (
+	config "boltcache/config"
+)
+
+func TestEvictionMaxKeys(t *testing.T) {
+	for _, policy := range []string{"lru", "lfu", "random", "ttl"} {
+		t.Run(policy, func(t *testing.T) {
+			c := &BoltCache{Data: NewShardedMap()}
+			c.Data.ConfigureEviction(config.CacheConfig{
+				MaxKeys:           1000,
+				EvictionPolicy:    policy,
+				EvictionThreshold: 0.5,
+			})
+
+			for i := 0; i < 5000; i++ {
+				c.Set(fmt.Sprintf("key:%d", i), "value", time.Hour)
+			}
+
+			if n := c.Data.Len(); n > 500 {
+				t.Fatalf("expected at most 500 keys, got %d", n)
+			}
+			if stats := c.Data.EvictionStats(); stats.EvictedKeys == 0 {
+				t.Fatalf("expected evictions to be counted")
+			}
+		})
+	}
+}
+
+func TestEvictionMaxMemory(t *testing.T) {
+	c := &BoltCache{Data: NewShardedMap()}
+	c.Data.ConfigureEviction(config.CacheConfig{
+		MaxMemory:         "64KB",
+		EvictionPolicy:    "lru",
+		EvictionThreshold: 1.0,
+	})
+
+	value := make([]byte, 1024)
+	for i := 0; i < 1000; i++ {
+		c.Set(fmt.Sprintf("key:%d", i), value, 0)
+	}
+
+	if used := c.Data.UsedMemory(); used > 64*1024 {
+		t.Fatalf("used memory %d exceeds limit", used)
+	}
+}
+
+func TestMemoryAccountingOnDelete(t *testing.T) {
+	c := &BoltCache{Data: NewShardedMap()}
+	c.Set("a", "hello", 0)
+	c.SAdd("s", "x", "y", "z")
+	c.Delete("a")
+	c.Delete("s")
+
+	if used := c.Data.UsedMemory(); used != 0 {
+		t.Fatalf("expected 0 bytes after deletes, got %d", used)
+	}
+	if n := c.Data.Len(); n != 0 {
+		t.Fatalf("expected empty map, got %d keys", n)
+	}
+}
+
+func TestLFUDecay(t *testing.T) {
+	c := &BoltCache{Data: NewShardedMap()}
+	c.Data.ConfigureEviction(config.CacheConfig{MaxKeys: 100, EvictionPolicy: "lfu"})
+	e := c.Data.evictor
+	e.lfuDecay = 20 * time.Millisecond
+	item := func(key string) *CacheItem {
+		return c.Data.getShard(key).items[key]
+	}
+
+	c.Set("old", "v", 0)
+	for i := 0; i < 100; i++ {
+		c.Get("old")
+	}
+	c.Set("recent", "v", 0)
+	for i := 0; i < 5; i++ {
+		c.Get("recent")
+	}
+	if !e.better(item("recent"), item("old")) {
+		t.Fatal("hot key evicted before a colder one")
+	}
+
+	// Once idle, the old hot key loses to a key hot now.
+	time.Sleep(300 * time.Millisecond)
+	for i := 0; i < 5; i++ {
+		c.Get("recent")
+	}
+	if !e.better(item("old"), item("recent")) {
+		t.Fatalf("idle key with %d hits kept over a recent one with %d", item("old").hits, item("recent").hits)
+	}
+
+	// Rewrites don't bring back the decayed count.
+	c.Set("old", "v2", 0)
+	if hits := item("old").hits; hits != 0 {
+		t.Fatalf("rewritten idle key has %d hits", hits)
+	}
+}
@@ -0,0 +1,110 @@
+package cache
+
+import (
+	"sync/atomic"
+	"time"
+)
+
+// Redis-compatible TTL codes returned by TTL.
+const (
+	NoExpiry    time.Duration = -1 // key exists but has no associated expire
+	KeyNotFound time.Duration = -2 // key does not exist
+)
+
+func (item *CacheItem) expired(now time.Time) bool {
+	return !item.ExpiresAt.IsZero() && now.After(item.ExpiresAt)
+}
+
+// clone returns a copy that can be modified and swapped in under the shard
+// lock while readers keep using the original.
+func (item *CacheItem) clone() *CacheItem {
+	return &CacheItem{
+		Value:      item.Value,
+		ExpiresAt:  item.ExpiresAt,
+		size:       item.size,
+		lastAccess: atomic.LoadInt64(&item.lastAccess),
+		hits:       atomic.LoadUint32(&item.hits),
+	}
+}
+
+// update replaces the live item stored under key with a copy modified by fn.
+// It returns false when the key is missing or already expired, or when fn
+// declines the change.
+func (sm *ShardedMap) update(key string, fn func(item *CacheItem) bool) bool {
+	shard := sm.getShard(key)
+	shard.mu.Lock()
+	defer shard.mu.Unlock()
+
+	old, ok := shard.items[key]
+	if !ok || old.expired(time.Now()) {
+		return false
+	}
+
+	item := old.clone()
+	if !fn(item) {
+		return false
+	}
+	item.version = atomic.AddUint64(&sm.version, 1)
+	shard.items[key] = item
+	shard.changed(key)
+	if !item.ExpiresAt.IsZero() && !item.ExpiresAt.Equal(old.ExpiresAt) {
+		shard.trackExpiry(key, item.ExpiresAt)
+	}
+	return true
+}
+
+// TTL returns the remaining time to live of key, NoExpiry when the key
+// has no expire set, or KeyNotFound when the key does not exist.
+func (c *BoltCache) TTL(key string) time.Duration {
+	item, ok := c.Data.Load(key)
+	if !ok {
+		return KeyNotFound
+	}
+
+	now := time.Now()
+	if item.expired(now) {
+		c.Data.expireItem(key, item)
+		return KeyNotFound
+	}
+	if item.ExpiresAt.IsZero() {
+		return NoExpiry
+	}
+	return item.ExpiresAt.Sub(now)
+}
+
+// Expire sets a timeout on key. A non-positive ttl deletes the key
+// right away, as Redis does. It reports whether the key exists.
+func (c *BoltCache) Expire(key string, ttl time.Duration) bool {
+	return c.ExpireAt(key, time.Now().Add(ttl))
+}
+
+// ExpireAt sets the absolute expiration time of key. A time in the past
+// deletes the key. It reports whether the key exists.
+func (c *BoltCache) ExpireAt(key string, at time.Time) bool {
+	if !at.After(time.Now()) {
+		if _, ok := c.Get(key); !ok {
+			return false
+		}
+		c.Delete(key)
+		return true
+	}
+
+	return c.Data.update(key, func(item *CacheItem) bool {
+		item.ExpiresAt = at
+		c.propagate("PEXPIREAT", key, formatUnixMilli(at))
+		return true
+	})
+}
+
+// Persist removes the expiration from key. It reports whether a timeout
+// was removed.
+func (c *BoltCache) Persist(key string) bool {
+	return c.Data.update(key, func(item *CacheItem) bool {
+		if item.ExpiresAt.IsZero() {
+			return false
+		}
+		item.ExpiresAt = time.Time{}
+		c.propagate("PERSIST", key)
+		return true
+	})
+}
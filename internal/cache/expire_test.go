@@ -0,0 +1,75 @@
+package cache
+
+import (
+	"strconv"
+	"testing"
+	"time"
+)
+
+func TestTTLCodes(t *testing.T) {
+	c := &BoltCache{Data: NewShardedMap()}
+
+	if ttl := c.TTL("missing"); ttl != KeyNotFound {
+		t.Fatalf("expected KeyNotFound, got %v", ttl)
+	}
+
+	c.Set("k", "v", 0)
+	if ttl := c.TTL("k"); ttl != NoExpiry {
+		t.Fatalf("expected NoExpiry, got %v", ttl)
+	}
+
+	if !c.Expire("k", time.Minute) {
+		t.Fatalf("expected Expire to find the key")
+	}
+	if ttl := c.TTL("k"); ttl <= 0 || ttl > time.Minute {
+		t.Fatalf("unexpected ttl %v", ttl)
+	}
+
+	if !c.Persist("k") {
+		t.Fatalf("expected Persist to remove the timeout")
+	}
+	if c.Persist("k") {
+		t.Fatalf("expected second Persist to report no timeout")
+	}
+
+	if !c.ExpireAt("k", time.Now().Add(-time.Second)) {
+		t.Fatalf("expected ExpireAt in the past to delete the key")
+	}
+	if _, ok := c.Get("k"); ok {
+		t.Fatalf("expected key to be gone")
+	}
+	if c.Expire("k", time.Minute) {
+		t.Fatalf("expected Expire on a missing key to fail")
+	}
+}
+
+func TestActiveExpireCycle(t *testing.T) {
+	c := &BoltCache{Data: NewShardedMap()}
+	for i := 0; i < 10000; i++ {
+		c.Set("short:"+strconv.Itoa(i), "v", time.Millisecond)
+		c.Set("long:"+strconv.Itoa(i), "v", time.Hour)
+	}
+	// Overwrite some TTLs so stale heap entries exist.
+	for i := 0; i < 100; i++ {
+		c.Expire("long:"+strconv.Itoa(i), 2*time.Hour)
+	}
+	time.Sleep(5 * time.Millisecond)
+
+	cursor := 0
+	total := 0
+	for i := 0; i < 100 && total < 10000; i++ {
+		var n int
+		n, cursor = c.Data.activeExpireCycle(cursor, time.Second)
+		total += n
+	}
+
+	if total != 10000 {
+		t.Fatalf("expected 10000 expired keys, got %d", total)
+	}
+	if n := c.Data.Len(); n != 10000 {
+		t.Fatalf("expected 10000 live keys, got %d", n)
+	}
+	if got := c.Data.ExpiredKeys(); got != 10000 {
+		t.Fatalf("expected expired counter 10000, got %d", got)
+	}
+}
@@ -0,0 +1,389 @@
+package cache
+
+import (
+	"errors"
+	"fmt"
+	"math"
+	"sort"
+)
+
+// Geospatial operations. Geo sets are sorted sets scored by a 52 bit
+// interleaved geohash, encoded the same way as Redis, so every sorted set
+// command works on them too.
+
+const (
+	geoStepMax = 26 // 26 bits per coordinate, 52 in the score
+
+	GeoLatMin = -85.05112878
+	GeoLatMax = 85.05112878
+	GeoLonMin = -180.0
+	GeoLonMax = 180.0
+
+	earthRadiusMeters = 6372797.560856
+	mercatorMax       = 20037726.37
+)
+
+// ErrGeoMemberMissing is returned when a search starts from a missing member.
+var ErrGeoMemberMissing = errors.New("ERR could not decode requested zset member")
+
+// GeoPoint is a position in degrees.
+type GeoPoint struct {
+	Longitude float64 `json:"longitude"`
+	Latitude  float64 `json:"latitude"`
+}
+
+// GeoMember is a named position of a geo set.
+type GeoMember struct {
+	Member string `json:"member"`
+	GeoPoint
+}
+
+// GeoResult is a search match. Dist is in meters.
+type GeoResult struct {
+	Member string  `json:"member"`
+	Dist   float64 `json:"distance"`
+	Hash   uint64  `json:"hash"`
+	GeoPoint
+}
+
+// ValidGeoPoint reports whether p can be geohash encoded.
+func ValidGeoPoint(p GeoPoint) bool {
+	return p.Longitude >= GeoLonMin && p.Longitude <= GeoLonMax &&
+		p.Latitude >= GeoLatMin && p.Latitude <= GeoLatMax
+}
+
+func invalidPointError(p GeoPoint) error {
+	return fmt.Errorf("ERR invalid longitude,latitude pair %f,%f", p.Longitude, p.Latitude)
+}
+
+// spread moves the low 32 bits of v to the even bit positions.
+func spread(v uint64) uint64 {
+	v &= 0xFFFFFFFF
+	v = (v | v<<16) & 0x0000FFFF0000FFFF
+	v = (v | v<<8) & 0x00FF00FF00FF00FF
+	v = (v | v<<4) & 0x0F0F0F0F0F0F0F0F
+	v = (v | v<<2) & 0x3333333333333333
+	v = (v | v<<1) & 0x5555555555555555
+	return v
+}
+
+// squash is the inverse of spread.
+func squash(v uint64) uint64 {
+	v &= 0x5555555555555555
+	v = (v | v>>1) & 0x3333333333333333
+	v = (v | v>>2) & 0x0F0F0F0F0F0F0F0F
+	v = (v | v>>4) & 0x00FF00FF00FF00FF
+	v = (v | v>>8) & 0x0000FFFF0000FFFF
+	v = (v | v>>16) & 0x00000000FFFFFFFF
+	return v
+}
+
+// geohashEncode interleaves step bits of each coordinate, latitude on the
+// even bits, within the given latitude range.
+func geohashEncode(p GeoPoint, latMin, latMax float64, step uint) uint64 {
+	latOffset := (p.Latitude - latMin) / (latMax - latMin)
+	lonOffset := (p.Longitude - GeoLonMin) / (GeoLonMax - GeoLonMin)
+	cells := uint64(1) << step
+	lat := uint64(latOffset * float64(cells))
+	lon := uint64(lonOffset * float64(cells))
+	// The upper edges belong to the last cell.
+	if lat >= cells {
+		lat = cells - 1
+	}
+	if lon >= cells {
+		lon = cells - 1
+	}
+	return spread(lat) | spread(lon)<<1
+}
+
+// geohashCell returns the bounds of the cell a hash of step bits per
+// coordinate denotes.
+func geohashCell(hash uint64, step uint) (lonMin, lonMax, latMin, latMax float64) {
+	cells := float64(uint64(1) << step)
+	lat := float64(squash(hash))
+	lon := float64(squash(hash >> 1))
+
+	latScale := GeoLatMax - GeoLatMin
+	lonScale := GeoLonMax - GeoLonMin
+	latMin = GeoLatMin + lat/cells*latScale
+	latMax = GeoLatMin + (lat+1)/cells*latScale
+	lonMin = GeoLonMin + lon/cells*lonScale
+	lonMax = GeoLonMin + (lon+1)/cells*lonScale
+	return
+}
+
+// GeoEncode returns the sorted set score of p.
+func GeoEncode(p GeoPoint) float64 {
+	return float64(geohashEncode(p, GeoLatMin, GeoLatMax, geoStepMax))
+}
+
+// GeoDecode returns the position a score stands for: the center of its cell.
+func GeoDecode(score float64) GeoPoint {
+	lonMin, lonMax, latMin, latMax := geohashCell(uint64(score), geoStepMax)
+	p := GeoPoint{(lonMin + lonMax) / 2, (latMin + latMax) / 2}
+	p.Longitude = math.Max(GeoLonMin, math.Min(GeoLonMax, p.Longitude))
+	p.Latitude = math.Max(GeoLatMin, math.Min(GeoLatMax, p.Latitude))
+	return p
+}
+
+const geohashAlphabet = "0123456789bcdefghjkmnpqrstuvwxyz"
+
+// GeoHashString returns the standard 11 character geohash of a score. The
+// standard latitude range is [-90, 90], so the position is re-encoded.
+func GeoHashString(score float64) string {
+	hash := geohashEncode(GeoDecode(score), -90, 90, geoStepMax)
+	buf := make([]byte, 11)
+	for i := range buf {
+		idx := 0
+		if i < 10 {
+			idx = int(hash>>(52-uint(i+1)*5)) & 0x1f
+		}
+		buf[i] = geohashAlphabet[idx]
+	}
+	return string(buf)
+}
+
+func degRad(d float64) float64 { return d * math.Pi / 180 }
+
+func latDistance(lat1, lat2 float64) float64 {
+	return earthRadiusMeters * math.Abs(degRad(lat2)-degRad(lat1))
+}
+
+// GeoDistance is the haversine distance between a and b in meters.
+func GeoDistance(a, b GeoPoint) float64 {
+	lat1, lon1 := degRad(a.Latitude), degRad(a.Longitude)
+	lat2, lon2 := degRad(b.Latitude), degRad(b.Longitude)
+	v := math.Sin((lon2 - lon1) / 2)
+	if v == 0 {
+		return latDistance(a.Latitude, b.Latitude)
+	}
+	u := math.Sin((lat2 - lat1) / 2)
+	h := u*u + math.Cos(lat1)*math.Cos(lat2)*v*v
+	return 2 * earthRadiusMeters * math.Asin(math.Sqrt(h))
+}
+
+// GeoShape is the search area of GEOSEARCH: a circle of Radius meters,
+// or with Box set a Width by Height meters rectangle.
+type GeoShape struct {
+	Radius        float64
+	Box           bool
+	Width, Height float64
+}
+
+// contains returns the distance from center to p and whether p lies in
+// the shape around center.
+func (s GeoShape) contains(center, p GeoPoint) (float64, bool) {
+	if !s.Box {
+		d := GeoDistance(center, p)
+		return d, d <= s.Radius
+	}
+	// Latitude distance is cheaper, so it is checked first.
+	if latDistance(p.Latitude, center.Latitude) > s.Height/2 {
+		return 0, false
+	}
+	if GeoDistance(GeoPoint{p.Longitude, p.Latitude}, GeoPoint{center.Longitude, p.Latitude}) > s.Width/2 {
+		return 0, false
+	}
+	return GeoDistance(center, p), true
+}
+
+// reach is the distance from the center to the farthest point of the shape.
+func (s GeoShape) reach() float64 {
+	if s.Box {
+		return math.Hypot(s.Width/2, s.Height/2)
+	}
+	return s.Radius
+}
+
+// GeoQuery describes a GEOSEARCH. The center is Member's position when
+// Member is set, otherwise Center. Sort is 1 for nearest first, -1 for
+// farthest first and 0 for unsorted; Count 0 means no limit and Any
+// returns the first Count matches found instead of the nearest ones.
+type GeoQuery struct {
+	Member string
+	Center GeoPoint
+	Shape  GeoShape
+	Sort   int
+	Count  int
+	Any    bool
+}
+
+// searchStep picks the geohash precision whose cells are at least as
+// large as reach around center, so the cell of the center and its eight
+// neighbours cover the whole search area.
+func searchStep(center GeoPoint, reach float64) uint {
+	if reach <= 0 {
+		return geoStepMax
+	}
+
+	// Start from the estimate Redis uses and make it coarser until a
+	// cell is big enough at the latitude farthest from the equator.
+	step, r := 1, reach
+	for r < mercatorMax {
+		r *= 2
+		step++
+	}
+	step -= 2
+	if step > geoStepMax {
+		step = geoStepMax
+	}
+
+	reachDeg := reach / earthRadiusMeters * 180 / math.Pi
+	lat := math.Min(90, math.Abs(center.Latitude)+reachDeg)
+	for ; step > 0; step-- {
+		cells := float64(uint64(1) << uint(step))
+		height := degRad((GeoLatMax-GeoLatMin)/cells) * earthRadiusMeters
+		width := degRad((GeoLonMax-GeoLonMin)/cells) * earthRadiusMeters * math.Cos(degRad(lat))
+		if height >= reach && width >= reach {
+			break
+		}
+	}
+	if step < 0 {
+		step = 0
+	}
+	return uint(step)
+}
+
+// searchRanges returns the score ranges of the center's cell and its
+// neighbours at step, as [min, max) pairs.
+func searchRanges(center GeoPoint, step uint) [][2]float64 {
+	if step == 0 {
+		return [][2]float64{{0, float64(uint64(1) << (2 * geoStepMax))}}
+	}
+
+	hash := geohashEncode(center, GeoLatMin, GeoLatMax, step)
+	lonMin, lonMax, latMin, latMax := geohashCell(hash, step)
+	dLon, dLat := lonMax-lonMin, latMax-latMin
+	midLon, midLat := (lonMin+lonMax)/2, (latMin+latMax)/2
+
+	seen := make(map[uint64]bool, 9)
+	var ranges [][2]float64
+	for _, dy := range []float64{-1, 0, 1} {
+		lat := midLat + dy*dLat
+		if lat < GeoLatMin || lat > GeoLatMax {
+			continue
+		}
+		for _, dx := range []float64{-1, 0, 1} {
+			lon := midLon + dx*dLon
+			// Neighbours wrap around the antimeridian.
+			if lon < GeoLonMin {
+				lon += 360
+			} else if lon > GeoLonMax {
+				lon -= 360
+			}
+			cell := geohashEncode(GeoPoint{lon, lat}, GeoLatMin, GeoLatMax, step)
+			if seen[cell] {
+				continue
+			}
+			seen[cell] = true
+			shift := 2 * (geoStepMax - step)
+			ranges = append(ranges, [2]float64{float64(cell << shift), float64((cell + 1) << shift)})
+		}
+	}
+	return ranges
+}
+
+// GeoAdd adds or moves members and returns the number added, or changed
+// with opts.CH. Invalid positions are rejected before anything is stored.
+func (c *BoltCache) GeoAdd(key string, opts ZAddOptions, members ...GeoMember) (int, error) {
+	zmembers := make([]ZMember, len(members))
+	for i, m := range members {
+		if !ValidGeoPoint(m.GeoPoint) {
+			return 0, invalidPointError(m.GeoPoint)
+		}
+		zmembers[i] = ZMember{Member: m.Member, Score: GeoEncode(m.GeoPoint)}
+	}
+	return c.ZAdd(key, opts, zmembers...)
+}
+
+// GeoPos returns the positions of members; nil for missing ones.
+func (c *BoltCache) GeoPos(key string, members ...string) ([]*GeoPoint, error) {
+	c.Mu.RLock()
+	defer c.Mu.RUnlock()
+
+	z, err := c.loadZSet(key)
+	if err != nil {
+		return nil, err
+	}
+	out := make([]*GeoPoint, len(members))
+	if z == nil {
+		return out, nil
+	}
+	for i, m := range members {
+		if score, ok := z.Score(m); ok {
+			p := GeoDecode(score)
+			out[i] = &p
+		}
+	}
+	return out, nil
+}
+
+// GeoDist returns the distance between two members in meters; ok is false
+// when either is missing.
+func (c *BoltCache) GeoDist(key, a, b string) (float64, bool, error) {
+	pos, err := c.GeoPos(key, a, b)
+	if err != nil || pos[0] == nil || pos[1] == nil {
+		return 0, false, err
+	}
+	return GeoDistance(*pos[0], *pos[1]), true, nil
+}
+
+// GeoSearch returns the members inside the query's shape.
+func (c *BoltCache) GeoSearch(key string, q GeoQuery) ([]GeoResult, error) {
+	c.Mu.RLock()
+	defer c.Mu.RUnlock()
+
+	z, err := c.loadZSet(key)
+	if err != nil {
+		return nil, err
+	}
+	if z == nil {
+		return []GeoResult{}, nil
+	}
+
+	center := q.Center
+	if q.Member != "" {
+		score, ok := z.Score(q.Member)
+		if !ok {
+			return nil, ErrGeoMemberMissing
+		}
+		center = GeoDecode(score)
+	}
+
+	// Taking the nearest Count members needs every match first.
+	sortBy := q.Sort
+	if q.Count > 0 && !q.Any && sortBy == 0 {
+		sortBy = 1
+	}
+
+	out := []GeoResult{}
+	for _, r := range searchRanges(center, searchStep(center, q.Shape.reach())) {
+		min := ScoreBound{Value: r[0]}
+		max := ScoreBound{Value: r[1], Exclusive: true}
+		for _, m := range z.RangeByScore(min, max, false, 0, -1) {
+			p := GeoDecode(m.Score)
+			dist, ok := q.Shape.contains(center, p)
+			if !ok {
+				continue
+			}
+			out = append(out, GeoResult{Member: m.Member, Dist: dist, Hash: uint64(m.Score), GeoPoint: p})
+			if q.Any && len(out) == q.Count {
+				break
+			}
+		}
+		if q.Any && q.Count > 0 && len(out) >= q.Count {
+			break
+		}
+	}
+
+	switch sortBy {
+	case 1:
+		sort.SliceStable(out, func(i, j int) bool { return out[i].Dist < out[j].Dist })
+	case -1:
+		sort.SliceStable(out, func(i, j int) bool { return out[i].Dist > out[j].Dist })
+	}
+	if q.Count > 0 && len(out) > q.Count {
+		out = out[:q.Count]
+	}
+	return out, nil
+}
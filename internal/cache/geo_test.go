@@ -0,0 +1,104 @@
+package cache
+
+import (
+	"fmt"
+	"math"
+	"math/rand"
+	"sort"
+	"testing"
+)
+
+// Reference values from the Redis documentation.
+func TestGeoMatchesRedis(t *testing.T) {
+	c := &BoltCache{Data: NewShardedMap()}
+	c.GeoAdd("Sicily", ZAddOptions{},
+		GeoMember{"Palermo", GeoPoint{13.361389, 38.115556}},
+		GeoMember{"Catania", GeoPoint{15.087269, 37.502669}})
+
+	if score, _, _ := c.ZScore("Sicily", "Palermo"); score != 3479099956230698 {
+		t.Fatalf("Palermo score: got %.0f", score)
+	}
+	if score, _, _ := c.ZScore("Sicily", "Catania"); GeoHashString(score) != "sqdtr74hyu0" {
+		t.Fatalf("Catania geohash: got %s", GeoHashString(score))
+	}
+
+	pos, _ := c.GeoPos("Sicily", "Palermo", "missing")
+	if pos[1] != nil || math.Abs(pos[0].Longitude-13.36138933897018433) > 1e-12 || math.Abs(pos[0].Latitude-38.11555639549629859) > 1e-12 {
+		t.Fatalf("GeoPos: got %v, %v", pos[0], pos[1])
+	}
+
+	dist, ok, _ := c.GeoDist("Sicily", "Palermo", "Catania")
+	if !ok || fmt.Sprintf("%.4f", dist) != "166274.1516" {
+		t.Fatalf("GeoDist: got %.4f", dist)
+	}
+
+	if _, err := c.GeoAdd("Sicily", ZAddOptions{}, GeoMember{"bad", GeoPoint{10, 86}}); err == nil {
+		t.Fatalf("expected an invalid latitude to be rejected")
+	}
+}
+
+// TestGeoSearchMatchesScan compares searches against a full scan, which
+// catches cells missed by the neighbour ranges.
+func TestGeoSearchMatchesScan(t *testing.T) {
+	rng := rand.New(rand.NewSource(1))
+	c := &BoltCache{Data: NewShardedMap()}
+
+	var all []GeoMember
+	for i := 0; i < 2000; i++ {
+		m := GeoMember{fmt.Sprintf("m%d", i), GeoPoint{rng.Float64()*20 - 10, rng.Float64()*20 + 40}}
+		all = append(all, m)
+	}
+	// A cluster around the antimeridian and one near the latitude limit.
+	for i := 0; i < 200; i++ {
+		all = append(all, GeoMember{fmt.Sprintf("w%d", i), GeoPoint{179.5 + rng.Float64()*0.5, rng.Float64()}})
+		all = append(all, GeoMember{fmt.Sprintf("e%d", i), GeoPoint{-180 + rng.Float64()*0.5, rng.Float64()}})
+		all = append(all, GeoMember{fmt.Sprintf("n%d", i), GeoPoint{rng.Float64()*2, 84 + rng.Float64()}})
+	}
+	c.GeoAdd("g", ZAddOptions{}, all...)
+
+	queries := []GeoQuery{
+		{Center: GeoPoint{0, 50}, Shape: GeoShape{Radius: 150000}},
+		{Center: GeoPoint{3.3, 47.1}, Shape: GeoShape{Radius: 1200}},
+		{Center: GeoPoint{-5, 45}, Shape: GeoShape{Box: true, Width: 400000, Height: 100000}},
+		{Center: GeoPoint{180, 0.5}, Shape: GeoShape{Radius: 60000}},
+		{Center: GeoPoint{1, 84.9}, Shape: GeoShape{Radius: 80000}},
+		{Center: GeoPoint{0, 50}, Shape: GeoShape{Radius: 5000000}},
+	}
+	for _, q := range queries {
+		var want []string
+		for _, m := range all {
+			p := GeoDecode(GeoEncode(m.GeoPoint))
+			if _, ok := q.Shape.contains(q.Center, p); ok {
+				want = append(want, m.Member)
+			}
+		}
+
+		res, err := c.GeoSearch("g", q)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var got []string
+		for _, r := range res {
+			got = append(got, r.Member)
+		}
+		sort.Strings(want)
+		sort.Strings(got)
+		if fmt.Sprint(got) != fmt.Sprint(want) {
+			t.Fatalf("query %+v: got %d members, want %d", q, len(got), len(want))
+		}
+	}
+
+	q := GeoQuery{Center: GeoPoint{0, 50}, Shape: GeoShape{Radius: 300000}, Count: 5}
+	nearest, _ := c.GeoSearch("g", q)
+	if len(nearest) != 5 {
+		t.Fatalf("COUNT 5: got %d", len(nearest))
+	}
+	q.Count = 0
+	everything, _ := c.GeoSearch("g", q)
+	sort.Slice(everything, func(i, j int) bool { return everything[i].Dist < everything[j].Dist })
+	for i := range nearest {
+		if nearest[i].Member != everything[i].Member {
+			t.Fatalf("COUNT must return the nearest members first")
+		}
+	}
+}
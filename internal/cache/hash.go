@@ -1,7 +1,9 @@
 package cache
 
 // Hash operations
-func (c *BoltCache) HSet(key, field, value string) {
+
+// HSet sets field in the hash at key and reports whether the field is new.
+func (c *BoltCache) HSet(key, field, value string) bool {
 	c.Mu.Lock()
 	defer c.Mu.Unlock()
 
@@ -12,8 +14,46 @@ func (c *BoltCache) HSet(key, field, value string) {
 		}
 	}
 
+	_, exists := hash[field]
 	hash[field] = value
-	c.Set(key, hash, 0)
+	c.put(key, hash)
+	c.propagate("HSET", key, field, value)
+	return !exists
+}
+
+// HDel removes fields from the hash at key and returns how many were
+// there. The key is deleted when the hash becomes empty.
+func (c *BoltCache) HDel(key string, fields ...string) int {
+	c.Mu.Lock()
+	defer c.Mu.Unlock()
+
+	val, ok := c.Get(key)
+	if !ok {
+		return 0
+	}
+	hash, ok := val.(map[string]string)
+	if !ok {
+		return 0
+	}
+
+	removed := 0
+	for _, f := range fields {
+		if _, ok := hash[f]; ok {
+			delete(hash, f)
+			removed++
+		}
+	}
+	if removed == 0 {
+		return 0
+	}
+
+	if len(hash) == 0 {
+		c.delete(key, false)
+	} else {
+		c.put(key, hash)
+	}
+	c.propagate(append([]string{"HDEL", key}, fields...)...)
+	return removed
 }
 
 func (c *BoltCache) HGet(key, field string) (string, bool) {
@@ -24,4 +64,20 @@ func (c *BoltCache) HGet(key, field string) (string, bool) {
 		}
 	}
 	return "", false
-}
\ No newline at end of file
+}
+// HGetAll returns a copy of the hash at key.
+func (c *BoltCache) HGetAll(key string) map[string]string {
+	c.Mu.RLock()
+	defer c.Mu.RUnlock()
+
+	if val, ok := c.Get(key); ok {
+		if hash, ok := val.(map[string]string); ok {
+			out := make(map[string]string, len(hash))
+			for f, v := range hash {
+				out[f] = v
+			}
+			return out
+		}
+	}
+	return nil
+}
@@ -0,0 +1,107 @@
+package cache
+
+import (
+	"errors"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// HLC is a hybrid logical clock timestamp: wall clock milliseconds, a
+// counter ordering events within the same millisecond, and the node that
+// made it, which breaks ties. Timestamps of different nodes are totally
+// ordered, and an event is always stamped later than the events its node
+// had seen.
+type HLC struct {
+	Wall    int64 // Unix milliseconds
+	Logical uint32
+	Node    string
+}
+
+var errInvalidHLC = errors.New("invalid HLC timestamp")
+
+// Compare returns -1, 0 or 1 as t is before, equal to or after u.
+func (t HLC) Compare(u HLC) int {
+	switch {
+	case t.Wall != u.Wall:
+		return cmpInt64(t.Wall, u.Wall)
+	case t.Logical != u.Logical:
+		return cmpInt64(int64(t.Logical), int64(u.Logical))
+	}
+	return strings.Compare(t.Node, u.Node)
+}
+
+func cmpInt64(a, b int64) int {
+	if a < b {
+		return -1
+	}
+	return 1
+}
+
+// After reports whether t is later than u.
+func (t HLC) After(u HLC) bool { return t.Compare(u) > 0 }
+
+func (t HLC) IsZero() bool { return t == HLC{} }
+
+// String formats t as wall.logical.node, which ParseHLC reads back.
+func (t HLC) String() string {
+	return strconv.FormatInt(t.Wall, 10) + "." + strconv.FormatUint(uint64(t.Logical), 10) + "." + t.Node
+}
+
+func ParseHLC(s string) (HLC, error) {
+	parts := strings.SplitN(s, ".", 3)
+	if len(parts) != 3 {
+		return HLC{}, errInvalidHLC
+	}
+	wall, err1 := strconv.ParseInt(parts[0], 10, 64)
+	logical, err2 := strconv.ParseUint(parts[1], 10, 32)
+	if err1 != nil || err2 != nil {
+		return HLC{}, errInvalidHLC
+	}
+	return HLC{Wall: wall, Logical: uint32(logical), Node: parts[2]}, nil
+}
+
+// hlcClock hands out the timestamps of a node.
+type hlcClock struct {
+	mu   sync.Mutex
+	node string
+	last HLC
+	now  func() time.Time // for tests
+}
+
+// Now returns a timestamp later than any the clock handed out or observed.
+func (c *hlcClock) Now() HLC {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	wall := c.wall()
+	if wall > c.last.Wall {
+		c.last = HLC{Wall: wall, Node: c.node}
+	} else {
+		c.last = HLC{Wall: c.last.Wall, Logical: c.last.Logical + 1, Node: c.node}
+	}
+	return c.last
+}
+
+// Observe moves the clock past a timestamp received from another node.
+func (c *hlcClock) Observe(t HLC) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if t.Wall > c.last.Wall || t.Wall == c.last.Wall && t.Logical > c.last.Logical {
+		c.last = HLC{Wall: t.Wall, Logical: t.Logical, Node: c.node}
+	}
+}
+
+// Last returns the last timestamp handed out or observed.
+func (c *hlcClock) Last() HLC {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.last
+}
+
+func (c *hlcClock) wall() int64 {
+	if c.now != nil {
+		return c.now().UnixMilli()
+	}
+	return time.Now().UnixMilli()
+}
@@ -13,7 +13,8 @@ func (c *BoltCache) LPush(key string, values ...string) int {
 	}
 
 	list = append(values, list...)
-	c.Set(key, list, 0)
+	c.put(key, list)
+	c.propagate(append([]string{"LPUSH", key}, values...)...)
 	return len(list)
 }
 
@@ -26,10 +27,11 @@ func (c *BoltCache) LPop(key string) (string, bool) {
 			item := list[0]
 			list = list[1:]
 			if len(list) == 0 {
-				c.Delete(key)
+				c.delete(key, false)
 			} else {
-				c.Set(key, list, 0)
+				c.put(key, list)
 			}
+			c.propagate("LPOP", key)
 			return item, true
 		}
 	}
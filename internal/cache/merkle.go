@@ -0,0 +1,200 @@
+package cache
+
+import (
+	"encoding/binary"
+	"hash/fnv"
+	"io"
+	"time"
+)
+
+// Anti-entropy compares datasets through Merkle trees. Each shard has a
+// tree of merkleBuckets leaves, a leaf covering the keys whose hash falls
+// in it, and the shard roots make up the upper levels of one tree over
+// the whole dataset. A leaf adds up the hashes of the key, value and
+// expiration of its live keys, so the order of the keys doesn't matter.
+// Shards keep their leaf hashes and only hash the leaves written since
+// again.
+
+const (
+	merkleBuckets = 16 // leaves per shard
+	merkleLeaves  = ShardCount * merkleBuckets
+	merkleDepth   = 15 // level of the leaves, log2(merkleLeaves)
+)
+
+// shardMerkle holds the leaf hashes of a shard, guarded by
+// ShardedMap.merkleMu.
+type shardMerkle struct {
+	leaves [merkleBuckets]uint64
+	next   [merkleBuckets]int64 // first expiration in each leaf, Unix ms, 0 if none
+}
+
+// merkleTree holds the node hashes of each level, from the root at level
+// 0 to the leaves at merkleDepth. The children of node i are 2i and 2i+1,
+// and leaf i belongs to shard i/merkleBuckets.
+type merkleTree [merkleDepth + 1][]uint64
+
+// bucketOf returns the leaf of key within its shard.
+func bucketOf(key string) int {
+	return int(keyHash(key) / ShardCount % merkleBuckets)
+}
+
+// leafOf returns the leaf of key in the tree.
+func leafOf(key string) int {
+	h := keyHash(key)
+	return int(h%ShardCount)*merkleBuckets + int(h/ShardCount%merkleBuckets)
+}
+
+// changed marks the leaf of key to be hashed again. The caller holds s.mu
+// for writing.
+func (s *Shard) changed(key string) {
+	if s.merkle != nil {
+		s.merkleDirty |= 1 << bucketOf(key)
+	}
+}
+
+// merkleTree builds the tree over the live keys include accepts, all of
+// them when it is nil. The caller holds Mu of the cache for reading, so
+// collections don't change while they are hashed.
+func (sm *ShardedMap) merkleTree(now time.Time, include func(string) bool) *merkleTree {
+	sm.merkleMu.Lock()
+	defer sm.merkleMu.Unlock()
+
+	t := new(merkleTree)
+	leaves := make([]uint64, merkleLeaves)
+	for i, shard := range sm.shards {
+		m := sm.shardLeaves(shard, now, include)
+		copy(leaves[i*merkleBuckets:], m.leaves[:])
+	}
+	t[merkleDepth] = leaves
+	for d := merkleDepth - 1; d >= 0; d-- {
+		below := t[d+1]
+		level := make([]uint64, len(below)/2)
+		for i := range level {
+			level[i] = hashPair(below[2*i], below[2*i+1])
+		}
+		t[d] = level
+	}
+	return t
+}
+
+// shardLeaves hashes the leaves of shard written or expired since they
+// were last hashed again, and returns the leaf hashes. The caller holds
+// merkleMu.
+func (sm *ShardedMap) shardLeaves(shard *Shard, now time.Time, include func(string) bool) *shardMerkle {
+	ms := now.UnixMilli()
+	shard.mu.Lock()
+	m := shard.merkle
+	if m == nil {
+		m = &shardMerkle{}
+		shard.merkle = m
+		shard.merkleDirty = 1<<merkleBuckets - 1
+	}
+	dirty := shard.merkleDirty
+	for b, next := range m.next {
+		if next != 0 && next <= ms {
+			dirty |= 1 << b
+		}
+	}
+	shard.merkleDirty = 0
+	if dirty == 0 {
+		shard.mu.Unlock()
+		return m
+	}
+	var keys []string
+	var items []*CacheItem
+	for key, item := range shard.items {
+		if dirty&(1<<bucketOf(key)) != 0 {
+			keys = append(keys, key)
+			items = append(items, item)
+		}
+	}
+	shard.mu.Unlock()
+
+	for b := range m.leaves {
+		if dirty&(1<<b) != 0 {
+			m.leaves[b], m.next[b] = 0, 0
+		}
+	}
+	for i, key := range keys {
+		item := items[i]
+		if item.expired(now) || include != nil && !include(key) {
+			continue
+		}
+		b := bucketOf(key)
+		m.leaves[b] += entryHash(key, item)
+		if at := item.ExpiresAt.UnixMilli(); !item.ExpiresAt.IsZero() && (m.next[b] == 0 || at < m.next[b]) {
+			m.next[b] = at
+		}
+	}
+	return m
+}
+
+// leafKeys returns the hashes of the live keys include accepts in leaves.
+// The caller holds Mu of the cache for reading.
+func (sm *ShardedMap) leafKeys(leaves []int, now time.Time, include func(string) bool) map[string]uint64 {
+	wanted := make(map[int]bool, len(leaves))
+	for _, leaf := range leaves {
+		wanted[leaf] = true
+	}
+	hashes := make(map[string]uint64)
+	var keys []string
+	var items []*CacheItem
+	for i, shard := range sm.shards {
+		found := false
+		for b := 0; b < merkleBuckets && !found; b++ {
+			found = wanted[i*merkleBuckets+b]
+		}
+		if !found {
+			continue
+		}
+		keys, items = keys[:0], items[:0]
+		shard.mu.RLock()
+		for key, item := range shard.items {
+			if wanted[leafOf(key)] {
+				keys = append(keys, key)
+				items = append(items, item)
+			}
+		}
+		shard.mu.RUnlock()
+		for j, key := range keys {
+			if !items[j].expired(now) && (include == nil || include(key)) {
+				hashes[key] = entryHash(key, items[j])
+			}
+		}
+	}
+	return hashes
+}
+
+// entryHash hashes key with its value and expiration.
+func entryHash(key string, item *CacheItem) uint64 {
+	h := fnv.New64a()
+	var n [binary.MaxVarintLen64]byte
+	field := func(s string) {
+		h.Write(n[:binary.PutUvarint(n[:], uint64(len(s)))])
+		io.WriteString(h, s)
+	}
+	field(key)
+	if s, ok := item.Value.(string); ok {
+		field(TypeString)
+		field(s)
+	} else {
+		// Sets and sorted sets encode in member order and hashes in
+		// field order, so equal values hash the same.
+		typ, data, _ := EncodeValue(item.Value)
+		field(typ)
+		field(string(data))
+	}
+	if !item.ExpiresAt.IsZero() {
+		h.Write(n[:binary.PutVarint(n[:], item.ExpiresAt.UnixMilli())])
+	}
+	return h.Sum64()
+}
+
+func hashPair(a, b uint64) uint64 {
+	var buf [16]byte
+	binary.BigEndian.PutUint64(buf[:8], a)
+	binary.BigEndian.PutUint64(buf[8:], b)
+	h := fnv.New64a()
+	h.Write(buf[:])
+	return h.Sum64()
+}
@@ -0,0 +1,74 @@
+package cache
+
+import (
+	"testing"
+	"time"
+)
+
+func TestMerkleTree(t *testing.T) {
+	a := &BoltCache{Data: NewShardedMap()}
+	b := &BoltCache{Data: NewShardedMap()}
+	at := time.Now().Add(time.Hour)
+	for _, c := range []*BoltCache{a, b} {
+		c.Set("string", "v", 0)
+		c.ExpireAt("string", at)
+		c.SAdd("set", "x", "y", "z")
+		c.HSet("hash", "f", "1")
+		c.HSet("hash", "g", "2")
+	}
+	root := func(c *BoltCache) uint64 {
+		tree, _ := c.merkleTree()
+		return tree[0][0]
+	}
+	if root(a) != root(b) {
+		t.Fatal("same data, different roots")
+	}
+
+	// Only the path from the leaf of a changed key differs, and the leaf
+	// is hashed again once the key changes back.
+	b.HSet("hash", "g", "3")
+	ta, _ := a.merkleTree()
+	tb, _ := b.merkleTree()
+	leaf := leafOf("hash")
+	for d := merkleDepth; d >= 0; d-- {
+		for i := range ta[d] {
+			if differ := ta[d][i] != tb[d][i]; differ != (i == leaf>>(merkleDepth-d)) {
+				t.Fatalf("level %d node %d differs: %v", d, i, differ)
+			}
+		}
+	}
+	b.HSet("hash", "g", "2")
+	if root(a) != root(b) {
+		t.Fatal("roots differ after changing the key back")
+	}
+
+	// Expirations count, and expired keys are left out.
+	b.Expire("string", 2*time.Hour)
+	if root(a) == root(b) {
+		t.Fatal("expiration is not hashed")
+	}
+	b.ExpireAt("string", at)
+	a.Set("expiring", "v", 20*time.Millisecond)
+	if root(a) == root(b) {
+		t.Fatal("extra key is not hashed")
+	}
+	time.Sleep(30 * time.Millisecond)
+	if root(a) != root(b) {
+		t.Fatal("expired key is hashed")
+	}
+	if keys, _ := a.leafKeys([]int{leafOf("expiring"), leafOf("set")}); len(keys) != 1 || keys["set"] == 0 {
+		t.Fatalf("leaf keys %v", keys)
+	}
+
+	// Keys under consensus are not replicated and so not compared.
+	for _, c := range []*BoltCache{a, b} {
+		c.Data = NewShardedMap()
+		c.Consensus = &Consensus{Prefixes: []string{"lock:"}}
+		c.Set("k", "v", 0)
+	}
+	a.Set("lock:1", "a", 0)
+	b.Set("lock:1", "b", 0)
+	if root(a) != root(b) {
+		t.Fatal("keys under consensus are compared")
+	}
+}
@@ -1,35 +1,186 @@
 package cache
 
 import (
+	"bufio"
 	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
 	"log"
 	"os"
+	"path/filepath"
+	"time"
 )
 
 import (
 	logger "boltcache/logger"
 )
 
-// Persistence
-func (c *BoltCache) LoadFromDisk() {
-	if c.PersistFile == "" {
-		return
-	}
+// persistedItem is the on-disk form of a CacheItem. Value holds the
+// encoding of the value named by Type; see EncodeValue.
+type persistedItem struct {
+	Type      string `json:",omitempty"`
+	Value     json.RawMessage
+	ExpiresAt time.Time
+}
 
-	data, err := os.ReadFile(c.PersistFile)
+func newPersistedItem(item *CacheItem) (persistedItem, error) {
+	typ, data, err := EncodeValue(item.Value)
+	return persistedItem{Type: typ, Value: data, ExpiresAt: item.ExpiresAt}, err
+}
+
+func (p persistedItem) item() (*CacheItem, error) {
+	value, err := DecodeValue(p.Type, p.Value)
 	if err != nil {
-		return
+		return nil, err
 	}
+	return &CacheItem{Value: value, ExpiresAt: p.ExpiresAt}, nil
+}
 
+// LoadFromDisk loads the persistence file. When it is damaged, the newest
+// backup that loads cleanly is used instead, and after the backups, or when
+// the file is missing, the newest snapshot of snapshot.directory that does.
+// The error is returned only when none loads; no file at all is not an
+// error.
+func (c *BoltCache) LoadFromDisk() error {
 	var items map[string]*CacheItem
-	if err := json.Unmarshal(data, &items); err != nil {
-		logger.Log("Failed to unmarshal persistence data: %v", err)
-		return
+	var fallbacks []string
+	err := error(os.ErrNotExist)
+	if c.PersistFile != "" {
+		items, err = readPersistFile(c.PersistFile)
+		if err != nil && !os.IsNotExist(err) {
+			logger.Log("Failed to load %s: %v", c.PersistFile, err)
+			fallbacks = listBackups(c.PersistFile)
+		}
 	}
-
-	for k, v := range items {
-		c.Data.Store(k, v)
+	if err != nil {
+		fallbacks = append(fallbacks, c.snapshotFiles()...)
+		for _, path := range fallbacks {
+			var ferr error
+			if items, ferr = readPersistFile(path); ferr == nil {
+				logger.Log("Recovered data from %s", path)
+				err = nil
+				break
+			}
+			logger.Log("Skipping %s: %v", path, ferr)
+		}
+	}
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("load %s: %w", c.PersistFile, err)
 	}
 
+	for k, item := range items {
+		c.Data.Store(k, item)
+	}
 	log.Printf("Loaded %d items from disk", len(items))
+	return nil
+}
+
+// readPersistFile decodes a persistence file in either format. Nothing is
+// returned unless the whole file is intact; expired keys are left out.
+func readPersistFile(path string) (map[string]*CacheItem, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	items := make(map[string]*CacheItem)
+	now := time.Now()
+	err = scanPersistFile(f, func(key string, item *CacheItem) error {
+		if !item.expired(now) {
+			items[key] = item
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return items, nil
+}
+
+// scanPersistFile decodes a persistence file in either format, calling fn
+// with each key as it is read, so a file can be checked without holding
+// its data.
+func scanPersistFile(r io.Reader, fn func(key string, item *CacheItem) error) error {
+	// Older versions saved a JSON map; newer ones a binary snapshot.
+	br := bufio.NewReader(r)
+	if header, _ := br.Peek(len(snapshotMagic)); isSnapshot(header) {
+		return ReadSnapshot(br, fn)
+	}
+
+	dec := json.NewDecoder(br)
+	if tok, err := dec.Token(); err != nil {
+		return err
+	} else if tok != json.Delim('{') {
+		return errors.New("persistence file is not a JSON object")
+	}
+	for dec.More() {
+		tok, err := dec.Token()
+		if err != nil {
+			return err
+		}
+		key := tok.(string)
+		var p persistedItem
+		if err := dec.Decode(&p); err != nil {
+			return err
+		}
+		item, err := p.item()
+		if err != nil {
+			return fmt.Errorf("key %q: %v", key, err)
+		}
+		if err := fn(key, item); err != nil {
+			return err
+		}
+	}
+	if _, err := dec.Token(); err != nil {
+		return err
+	}
+	if _, err := dec.Token(); err != io.EOF {
+		return errors.New("unexpected data after the JSON object")
+	}
+	return nil
+}
+
+// writeFileAtomic replaces path with what write produces. The data goes to
+// a temporary file in the same directory that is synced and renamed over
+// path, so readers see either the old file or the complete new one.
+func writeFileAtomic(path string, write func(io.Writer) error) error {
+	dir := filepath.Dir(path)
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return err
+	}
+	f, err := os.CreateTemp(dir, filepath.Base(path)+".tmp-*")
+	if err != nil {
+		return err
+	}
+	tmp := f.Name()
+	fail := func(err error) error {
+		f.Close()
+		os.Remove(tmp)
+		return err
+	}
+
+	if err := write(f); err != nil {
+		return fail(err)
+	}
+	if err := f.Chmod(0644); err != nil {
+		return fail(err)
+	}
+	if err := f.Sync(); err != nil {
+		return fail(err)
+	}
+	if err := f.Close(); err != nil {
+		os.Remove(tmp)
+		return err
+	}
+	if err := os.Rename(tmp, path); err != nil {
+		os.Remove(tmp)
+		return err
+	}
+	syncDir(dir)
+	return nil
 }
@@ -0,0 +1,173 @@
+package cache
+
+import (
+	"bytes"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+import (
+	config "boltcache/config"
+)
+
+func newPersistCache(dir string) *BoltCache {
+	cfg := &config.Config{}
+	cfg.Persistence.Enabled = true
+	cfg.Persistence.BackupCount = 3
+	cfg.Persistence.File = filepath.Join(dir, "cache.json")
+	return &BoltCache{Data: NewShardedMap(), Config: cfg, PersistFile: cfg.Persistence.File}
+}
+
+func TestForcePersistIsAtomic(t *testing.T) {
+	dir := t.TempDir()
+	c := newPersistCache(dir)
+	c.Set("k", "v", 0)
+	for i := 0; i < 3; i++ {
+		if err := c.ForcePersist(); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// The first save had nothing to back up; each later one backed up the
+	// previous file under a name of its own.
+	if n := len(listBackups(c.PersistFile)); n != 2 {
+		t.Fatalf("got %d backups, want 2", n)
+	}
+	if matches, _ := filepath.Glob(filepath.Join(dir, "*.tmp-*")); len(matches) > 0 {
+		t.Fatalf("temporary files left behind: %v", matches)
+	}
+}
+
+func TestLoadFromDiskFallsBackToBackup(t *testing.T) {
+	dir := t.TempDir()
+	c := newPersistCache(dir)
+	c.Set("k", "old", 0)
+	c.ForcePersist()
+	c.Set("k", "new", 0)
+	c.ForcePersist()
+
+	// Truncate the primary as a crash during a plain write would.
+	data, _ := os.ReadFile(c.PersistFile)
+	os.WriteFile(c.PersistFile, data[:len(data)/2], 0644)
+
+	// A damaged file is not backed up over the good one.
+	if _, err := c.CreateBackup(); err == nil {
+		t.Fatal("damaged persistence file was backed up")
+	}
+
+	c2 := newPersistCache(dir)
+	if err := c2.LoadFromDisk(); err != nil {
+		t.Fatal(err)
+	}
+	if got, _ := c2.Get("k"); got != "old" {
+		t.Fatalf("got %v, want the backed up value", got)
+	}
+}
+
+func TestCreateBackup(t *testing.T) {
+	dir := t.TempDir()
+	c := newPersistCache(dir)
+	c.Set("k", "v", 0)
+	c.HSet("h", "f", "1")
+	c.ForcePersist()
+	item, _ := newPersistedItem(&CacheItem{Value: "v"})
+	legacy, _ := json.Marshal(map[string]persistedItem{"k": item})
+
+	// Snapshots and JSON files are copied as they are.
+	snapshot, _ := os.ReadFile(c.PersistFile)
+	for _, data := range [][]byte{snapshot, legacy} {
+		os.WriteFile(c.PersistFile, data, 0644)
+		backup, err := c.CreateBackup()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got, _ := os.ReadFile(backup); !bytes.Equal(got, data) {
+			t.Fatalf("backup %q, want %q", got, data)
+		}
+		os.Remove(backup)
+	}
+
+	// Damage anywhere in the file is caught, not only at its start.
+	for _, data := range [][]byte{snapshot[:len(snapshot)-1], append(legacy[:len(legacy):len(legacy)], '{')} {
+		os.WriteFile(c.PersistFile, data, 0644)
+		if _, err := c.CreateBackup(); err == nil {
+			t.Fatalf("damaged file %q backed up", data)
+		}
+	}
+	if backups := listBackups(c.PersistFile); len(backups) != 0 {
+		t.Fatalf("backups left: %v", backups)
+	}
+	if matches, _ := filepath.Glob(filepath.Join(dir, "*.tmp-*")); len(matches) > 0 {
+		t.Fatalf("temporary files left behind: %v", matches)
+	}
+}
+
+func TestLoadFromDiskFallsBackToSnapshot(t *testing.T) {
+	dir := t.TempDir()
+	c := newPersistCache(dir)
+	c.Config.Persistence.Snapshot = config.SnapshotConfig{Enabled: true, Directory: filepath.Join(dir, "snapshots")}
+	c.Set("k", "old", 0)
+	c.TakeSnapshot()
+	time.Sleep(2 * time.Millisecond)
+	c.Set("k", "new", 0)
+	newest, err := c.TakeSnapshot()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	load := func() (interface{}, error) {
+		c2 := newPersistCache(dir)
+		c2.Config.Persistence.Snapshot = c.Config.Persistence.Snapshot
+		err := c2.LoadFromDisk()
+		v, _ := c2.Get("k")
+		return v, err
+	}
+
+	// Without the file or backups, the newest snapshot is loaded.
+	if v, err := load(); err != nil || v != "new" {
+		t.Fatalf("missing file: %v, %v", v, err)
+	}
+	os.WriteFile(c.PersistFile, []byte("{"), 0644)
+	if v, err := load(); err != nil || v != "new" {
+		t.Fatalf("damaged file: %v, %v", v, err)
+	}
+
+	// A damaged snapshot is skipped for an older one.
+	data, _ := os.ReadFile(newest)
+	os.WriteFile(newest, data[:len(data)/2], 0644)
+	if v, err := load(); err != nil || v != "old" {
+		t.Fatalf("damaged snapshot: %v, %v", v, err)
+	}
+}
+
+func TestLoadFromDiskReportsErrors(t *testing.T) {
+	dir := t.TempDir()
+	c := newPersistCache(dir)
+	os.WriteFile(c.PersistFile, []byte("BOLTSN\x01\x00garbage"), 0644)
+	os.WriteFile(c.PersistFile+".backup."+time.Now().Format(backupTimeFormat), []byte("{"), 0644)
+
+	if err := c.LoadFromDisk(); err == nil {
+		t.Fatal("damaged file and backup loaded without error")
+	}
+	if c.Data.Len() != 0 {
+		t.Fatal("partial data was loaded")
+	}
+
+	// A JSON file with a key that doesn't decode is damaged as well.
+	os.WriteFile(c.PersistFile, []byte(`{"good":{"Value":"\"v\""},"bad":{"Type":"list","Value":"1"}}`), 0644)
+	if _, err := readPersistFile(c.PersistFile); err == nil || !strings.Contains(err.Error(), `key "bad"`) {
+		t.Fatalf("undecodable key: %v", err)
+	}
+	if err := c.LoadFromDisk(); err == nil || c.Data.Len() != 0 {
+		t.Fatalf("file with an undecodable key loaded: %v", err)
+	}
+
+	os.Remove(c.PersistFile)
+	if err := newPersistCache(dir).LoadFromDisk(); err != nil {
+		t.Fatalf("missing file: %v", err)
+	}
+}
@@ -0,0 +1,94 @@
+package cache
+
+import (
+	"strconv"
+	"time"
+)
+
+import (
+	logger "boltcache/logger"
+)
+
+// WriteHook observes every write applied to the cache as a command that
+// Apply replays to the same effect. Writes that depend on the current
+// time or state, like SET with a TTL, XADD * or XREADGROUP, are reported
+// by their outcome.
+//
+// Hooks run while the written key is locked, so writes to one key reach
+// them in the order they were applied. They must be quick and must not
+// call back into the cache.
+type WriteHook func(args []string)
+
+// AddWriteHook registers fn for all following writes.
+func (c *BoltCache) AddWriteHook(fn WriteHook) {
+	c.Mu.Lock()
+	defer c.Mu.Unlock()
+
+	hooks, _ := c.hooks.Load().([]WriteHook)
+	c.hooks.Store(append(hooks[:len(hooks):len(hooks)], fn))
+
+	// Evicted keys must be deleted on replay as well.
+	c.Data.OnEvict(func(key string) {
+		c.propagate("DEL", key)
+	})
+}
+
+func (c *BoltCache) propagate(args ...string) {
+	c.runHooks(args)
+	if a := c.active.Load(); a != nil {
+		a.record(c, args)
+	}
+}
+
+// runHooks reports a write to the hooks only. Writes merged from
+// active-active peers are reported this way, as the peers have them.
+func (c *BoltCache) runHooks(args []string) {
+	hooks, _ := c.hooks.Load().([]WriteHook)
+	for _, fn := range hooks {
+		fn(args)
+	}
+}
+
+func (c *BoltCache) hooked() bool {
+	hooks, _ := c.hooks.Load().([]WriteHook)
+	return len(hooks) > 0
+}
+
+func (c *BoltCache) propagating() bool {
+	return c.hooked() || c.active.Load() != nil
+}
+
+// propagateSet reports item being stored under key, with its absolute
+// expiration time.
+func (c *BoltCache) propagateSet(key string, item *CacheItem) {
+	if !c.propagating() {
+		return
+	}
+	if args := setArgs(key, item); args != nil {
+		c.propagate(args...)
+	}
+}
+
+// setArgs returns the SET or SETVALUE command storing item under key, or
+// nil when the value can't be encoded.
+func setArgs(key string, item *CacheItem) []string {
+	var args []string
+	if s, ok := item.Value.(string); ok {
+		args = []string{"SET", key, s}
+	} else {
+		typ, data, err := EncodeValue(item.Value)
+		if err != nil {
+			logger.Log("Cannot propagate write to %s: %v", key, err)
+			return nil
+		}
+		args = []string{"SETVALUE", key, typ, string(data)}
+	}
+	if !item.ExpiresAt.IsZero() {
+		args = append(args, "PXAT", formatUnixMilli(item.ExpiresAt))
+	}
+	return args
+}
+
+func formatUnixMilli(t time.Time) string {
+	return strconv.FormatInt(t.UnixMilli(), 10)
+}
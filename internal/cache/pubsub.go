@@ -1,26 +1,62 @@
 package cache
 
 import (
-	"net"
-	"sync"
 	"fmt"
+	"io"
+	"sync"
 )
 
+// Subscriber receives the messages published to the channels it is
+// subscribed to. Each protocol front-end provides its own implementation
+// so messages arrive in the connection's wire format.
+type Subscriber interface {
+	Deliver(channel, message string) error
+}
+
+// ConnSubscriber delivers messages as "MESSAGE <channel> <message>" lines,
+// the format of the text protocol and the WebSocket endpoint.
+type ConnSubscriber struct {
+	mu sync.Mutex
+	w  io.Writer
+}
+
+func NewConnSubscriber(w io.Writer) *ConnSubscriber {
+	return &ConnSubscriber{w: w}
+}
+
+func (s *ConnSubscriber) Deliver(channel, message string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	_, err := fmt.Fprintf(s.w, "MESSAGE %s %s\n", channel, message)
+	return err
+}
+
 // Pub/Sub
-func (c *BoltCache) Subscribe(channel string, conn net.Conn) {
-	conns, _ := c.Subscribers.LoadOrStore(channel, &sync.Map{})
-	conns.(*sync.Map).Store(conn, true)
+func (c *BoltCache) Subscribe(channel string, sub Subscriber) {
+	subs, _ := c.Subscribers.LoadOrStore(channel, &sync.Map{})
+	subs.(*sync.Map).Store(sub, true)
 }
 
+func (c *BoltCache) Unsubscribe(channel string, sub Subscriber) {
+	if subs, ok := c.Subscribers.Load(channel); ok {
+		subs.(*sync.Map).Delete(sub)
+	}
+}
+
+// Publish delivers message to every subscriber of channel and returns the
+// number of receivers. Subscribers that fail to receive are dropped.
 func (c *BoltCache) Publish(channel string, message string) int {
 	count := 0
-	if conns, ok := c.Subscribers.Load(channel); ok {
-		conns.(*sync.Map).Range(func(key, value interface{}) bool {
-			conn := key.(net.Conn)
-			fmt.Fprintf(conn, "MESSAGE %s %s\n", channel, message)
+	if subs, ok := c.Subscribers.Load(channel); ok {
+		subs.(*sync.Map).Range(func(key, value interface{}) bool {
+			sub := key.(Subscriber)
+			if err := sub.Deliver(channel, message); err != nil {
+				subs.(*sync.Map).Delete(sub)
+				return true
+			}
 			count++
 			return true
 		})
 	}
 	return count
-}
\ No newline at end of file
+}
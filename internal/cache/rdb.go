@@ -0,0 +1,1043 @@
+package cache
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash"
+	"hash/crc64"
+	"io"
+	"math"
+	"strconv"
+	"time"
+)
+
+import (
+	appinfo "boltcache/appinfo"
+)
+
+// Redis RDB files, as written by Redis 2.6 through 7.x.
+//
+// Strings, lists, sets, hashes and sorted sets are read in every encoding
+// Redis has used for them: plain, zipmap, ziplist, intset, quicklist and
+// listpack. Streams, modules and hash field expirations are not supported.
+// Keys of every database are loaded into the one BoltCache keyspace.
+//
+// Files are written in version 9 with plain encodings, which Redis 5.0 and
+// later load.
+
+const (
+	rdbMagic         = "REDIS"
+	rdbMaxVersion    = 12
+	rdbWriteVersion  = 9
+	rdbChecksumSince = 5
+)
+
+// Opcodes.
+const (
+	rdbOpSlotInfo     = 0xF4
+	rdbOpFunction2    = 0xF5
+	rdbOpFunctionPre  = 0xF6
+	rdbOpModuleAux    = 0xF7
+	rdbOpIdle         = 0xF8
+	rdbOpFreq         = 0xF9
+	rdbOpAux          = 0xFA
+	rdbOpResizeDB     = 0xFB
+	rdbOpExpireTimeMs = 0xFC
+	rdbOpExpireTime   = 0xFD
+	rdbOpSelectDB     = 0xFE
+	rdbOpEOF          = 0xFF
+)
+
+// Value types.
+const (
+	rdbTypeString          = 0
+	rdbTypeList            = 1
+	rdbTypeSet             = 2
+	rdbTypeZSet            = 3
+	rdbTypeHash            = 4
+	rdbTypeZSet2           = 5
+	rdbTypeHashZipmap      = 9
+	rdbTypeListZiplist     = 10
+	rdbTypeSetIntset       = 11
+	rdbTypeZSetZiplist     = 12
+	rdbTypeHashZiplist     = 13
+	rdbTypeListQuicklist   = 14
+	rdbTypeHashListpack    = 16
+	rdbTypeZSetListpack    = 17
+	rdbTypeListQuicklist2  = 18
+	rdbTypeSetListpack     = 20
+	rdbQuicklistNodePlain  = 1
+	rdbQuicklistNodePacked = 2
+)
+
+// Special string encodings.
+const (
+	rdbEncInt8  = 0
+	rdbEncInt16 = 1
+	rdbEncInt32 = 2
+	rdbEncLZF   = 3
+)
+
+var ErrRDBFormat = errors.New("not an RDB file")
+
+// rdbCRC is the CRC-64/Jones checksum Redis appends to RDB files, in the
+// reflected form hash/crc64 expects.
+var rdbCRC = crc64.MakeTable(0x95AC9329AC4BC9B5)
+
+// rdbChecksum implements hash.Hash64 for rdbCRC. Redis starts from zero
+// and doesn't invert the result, unlike hash/crc64.
+type rdbChecksum struct{ crc uint64 }
+
+func (h *rdbChecksum) Write(p []byte) (int, error) {
+	h.crc = ^crc64.Update(^h.crc, rdbCRC, p)
+	return len(p), nil
+}
+
+func (h *rdbChecksum) Sum(b []byte) []byte { return binary.LittleEndian.AppendUint64(b, h.crc) }
+func (h *rdbChecksum) Reset()              { h.crc = 0 }
+func (h *rdbChecksum) Size() int           { return 8 }
+func (h *rdbChecksum) BlockSize() int      { return 1 }
+func (h *rdbChecksum) Sum64() uint64       { return h.crc }
+
+var _ hash.Hash64 = (*rdbChecksum)(nil)
+
+// rdbReader reads an RDB file and checksums what it consumes.
+type rdbReader struct {
+	r   *bufio.Reader
+	sum rdbChecksum
+	buf [8]byte
+}
+
+func (r *rdbReader) readFull(p []byte) error {
+	if _, err := io.ReadFull(r.r, p); err != nil {
+		return truncated(err)
+	}
+	r.sum.Write(p)
+	return nil
+}
+
+func (r *rdbReader) byte() (byte, error) {
+	if err := r.readFull(r.buf[:1]); err != nil {
+		return 0, err
+	}
+	return r.buf[0], nil
+}
+
+func (r *rdbReader) uint32LE() (uint32, error) {
+	if err := r.readFull(r.buf[:4]); err != nil {
+		return 0, err
+	}
+	return binary.LittleEndian.Uint32(r.buf[:4]), nil
+}
+
+func (r *rdbReader) uint64LE() (uint64, error) {
+	if err := r.readFull(r.buf[:8]); err != nil {
+		return 0, err
+	}
+	return binary.LittleEndian.Uint64(r.buf[:8]), nil
+}
+
+// length reads a length. encoded reports a special string encoding, whose
+// code is returned in place of the length.
+func (r *rdbReader) length() (n uint64, encoded bool, err error) {
+	b, err := r.byte()
+	if err != nil {
+		return 0, false, err
+	}
+	switch b >> 6 {
+	case 0:
+		return uint64(b & 0x3f), false, nil
+	case 1:
+		b2, err := r.byte()
+		if err != nil {
+			return 0, false, err
+		}
+		return uint64(b&0x3f)<<8 | uint64(b2), false, nil
+	case 2:
+		switch b {
+		case 0x80:
+			if err := r.readFull(r.buf[:4]); err != nil {
+				return 0, false, err
+			}
+			return uint64(binary.BigEndian.Uint32(r.buf[:4])), false, nil
+		case 0x81:
+			if err := r.readFull(r.buf[:8]); err != nil {
+				return 0, false, err
+			}
+			return binary.BigEndian.Uint64(r.buf[:8]), false, nil
+		}
+		return 0, false, fmt.Errorf("invalid length encoding 0x%02x", b)
+	default:
+		return uint64(b & 0x3f), true, nil
+	}
+}
+
+// count reads a collection length.
+func (r *rdbReader) count() (int, error) {
+	n, encoded, err := r.length()
+	if err != nil {
+		return 0, err
+	}
+	if encoded || n > math.MaxInt32 {
+		return 0, errors.New("invalid collection length")
+	}
+	return int(n), nil
+}
+
+func (r *rdbReader) string() ([]byte, error) {
+	n, encoded, err := r.length()
+	if err != nil {
+		return nil, err
+	}
+	if !encoded {
+		return r.raw(n)
+	}
+
+	switch n {
+	case rdbEncInt8:
+		b, err := r.byte()
+		return strconv.AppendInt(nil, int64(int8(b)), 10), err
+	case rdbEncInt16:
+		if err := r.readFull(r.buf[:2]); err != nil {
+			return nil, err
+		}
+		return strconv.AppendInt(nil, int64(int16(binary.LittleEndian.Uint16(r.buf[:2]))), 10), nil
+	case rdbEncInt32:
+		v, err := r.uint32LE()
+		return strconv.AppendInt(nil, int64(int32(v)), 10), err
+	case rdbEncLZF:
+		clen, _, err := r.length()
+		if err != nil {
+			return nil, err
+		}
+		ulen, _, err := r.length()
+		if err != nil {
+			return nil, err
+		}
+		data, err := r.raw(clen)
+		if err != nil {
+			return nil, err
+		}
+		return lzfDecompress(data, ulen)
+	}
+	return nil, fmt.Errorf("unknown string encoding %d", n)
+}
+
+func (r *rdbReader) raw(n uint64) ([]byte, error) {
+	if n > math.MaxInt32 {
+		return nil, fmt.Errorf("invalid string length %d", n)
+	}
+	// Grow with the data actually read, so a bogus length can't allocate
+	// more than the file holds.
+	if n > 1<<20 {
+		b, err := io.ReadAll(io.LimitReader(r.r, int64(n)))
+		if err != nil {
+			return nil, err
+		}
+		if uint64(len(b)) != n {
+			return nil, io.ErrUnexpectedEOF
+		}
+		r.sum.Write(b)
+		return b, nil
+	}
+	b := make([]byte, n)
+	return b, r.readFull(b)
+}
+
+// lzfDecompress expands LZF data into a buffer of size n.
+func lzfDecompress(in []byte, n uint64) ([]byte, error) {
+	if n > math.MaxInt32 {
+		return nil, errors.New("invalid LZF length")
+	}
+	out := make([]byte, 0, min(n, 1<<20))
+	for i := 0; i < len(in); {
+		ctrl := int(in[i])
+		i++
+		if ctrl < 32 {
+			ctrl++
+			if i+ctrl > len(in) {
+				return nil, errors.New("corrupt LZF data")
+			}
+			out = append(out, in[i:i+ctrl]...)
+			i += ctrl
+			continue
+		}
+
+		length := ctrl >> 5
+		if length == 7 {
+			if i >= len(in) {
+				return nil, errors.New("corrupt LZF data")
+			}
+			length += int(in[i])
+			i++
+		}
+		if i >= len(in) {
+			return nil, errors.New("corrupt LZF data")
+		}
+		ref := len(out) - (ctrl&0x1f)<<8 - int(in[i]) - 1
+		i++
+		if ref < 0 {
+			return nil, errors.New("corrupt LZF data")
+		}
+		// The reference may overlap the bytes being written.
+		for j := 0; j < length+2; j++ {
+			out = append(out, out[ref+j])
+		}
+	}
+	if uint64(len(out)) != n {
+		return nil, errors.New("corrupt LZF data")
+	}
+	return out, nil
+}
+
+func (r *rdbReader) float() (float64, error) {
+	n, err := r.byte()
+	if err != nil {
+		return 0, err
+	}
+	switch n {
+	case 253:
+		return math.NaN(), nil
+	case 254:
+		return math.Inf(1), nil
+	case 255:
+		return math.Inf(-1), nil
+	}
+	b := make([]byte, n)
+	if err := r.readFull(b); err != nil {
+		return 0, err
+	}
+	return strconv.ParseFloat(string(b), 64)
+}
+
+func (r *rdbReader) binaryFloat() (float64, error) {
+	v, err := r.uint64LE()
+	return math.Float64frombits(v), err
+}
+
+// ReadRDB decodes an RDB file from r and calls fn for every key, expired
+// ones included.
+func ReadRDB(r io.Reader, fn func(key string, item *CacheItem) error) error {
+	rr := &rdbReader{r: bufio.NewReaderSize(r, 64*1024)}
+	header := make([]byte, 9)
+	if err := rr.readFull(header); err != nil || string(header[:5]) != rdbMagic {
+		return ErrRDBFormat
+	}
+	version, err := strconv.Atoi(string(header[5:]))
+	if err != nil || version < 1 || version > rdbMaxVersion {
+		return fmt.Errorf("unsupported RDB version %q", header[5:])
+	}
+
+	var expires time.Time
+	for {
+		op, err := rr.byte()
+		if err != nil {
+			return err
+		}
+
+		switch op {
+		case rdbOpEOF:
+			if version < rdbChecksumSince {
+				return nil
+			}
+			want := rr.sum.Sum64()
+			got, err := rr.uint64LE()
+			if err != nil {
+				return err
+			}
+			// Redis writes zero when checksums are disabled.
+			if got != 0 && got != want {
+				return errors.New("RDB checksum mismatch")
+			}
+			return nil
+		case rdbOpSelectDB:
+			if _, _, err := rr.length(); err != nil {
+				return err
+			}
+			continue
+		case rdbOpResizeDB:
+			if _, _, err := rr.length(); err != nil {
+				return err
+			}
+			if _, _, err := rr.length(); err != nil {
+				return err
+			}
+			continue
+		case rdbOpSlotInfo:
+			for i := 0; i < 3; i++ {
+				if _, _, err := rr.length(); err != nil {
+					return err
+				}
+			}
+			continue
+		case rdbOpAux:
+			if _, err := rr.string(); err != nil {
+				return err
+			}
+			if _, err := rr.string(); err != nil {
+				return err
+			}
+			continue
+		case rdbOpFunction2:
+			// Function libraries have no BoltCache equivalent.
+			if _, err := rr.string(); err != nil {
+				return err
+			}
+			continue
+		case rdbOpFunctionPre, rdbOpModuleAux:
+			return fmt.Errorf("unsupported RDB opcode 0x%02x", op)
+		case rdbOpIdle:
+			if _, _, err := rr.length(); err != nil {
+				return err
+			}
+			continue
+		case rdbOpFreq:
+			if _, err := rr.byte(); err != nil {
+				return err
+			}
+			continue
+		case rdbOpExpireTime:
+			s, err := rr.uint32LE()
+			if err != nil {
+				return err
+			}
+			expires = time.Unix(int64(s), 0)
+			continue
+		case rdbOpExpireTimeMs:
+			ms, err := rr.uint64LE()
+			if err != nil {
+				return err
+			}
+			expires = time.UnixMilli(int64(ms))
+			continue
+		}
+
+		key, err := rr.string()
+		if err != nil {
+			return err
+		}
+		value, err := rr.value(op)
+		if err != nil {
+			return fmt.Errorf("key %q: %v", key, err)
+		}
+		if err := fn(string(key), &CacheItem{Value: value, ExpiresAt: expires}); err != nil {
+			return err
+		}
+		expires = time.Time{}
+	}
+}
+
+func (r *rdbReader) value(typ byte) (interface{}, error) {
+	switch typ {
+	case rdbTypeString:
+		s, err := r.string()
+		return string(s), err
+
+	case rdbTypeList, rdbTypeSet:
+		n, err := r.count()
+		if err != nil {
+			return nil, err
+		}
+		list := make([]string, 0, min(n, 1024))
+		for i := 0; i < n; i++ {
+			s, err := r.string()
+			if err != nil {
+				return nil, err
+			}
+			list = append(list, string(s))
+		}
+		if typ == rdbTypeSet {
+			return setOf(list), nil
+		}
+		return list, nil
+
+	case rdbTypeHash:
+		n, err := r.count()
+		if err != nil {
+			return nil, err
+		}
+		h := make(map[string]string, min(n, 1024))
+		for i := 0; i < n; i++ {
+			f, err := r.string()
+			if err != nil {
+				return nil, err
+			}
+			v, err := r.string()
+			if err != nil {
+				return nil, err
+			}
+			h[string(f)] = string(v)
+		}
+		return h, nil
+
+	case rdbTypeZSet, rdbTypeZSet2:
+		n, err := r.count()
+		if err != nil {
+			return nil, err
+		}
+		z := NewSortedSet()
+		for i := 0; i < n; i++ {
+			m, err := r.string()
+			if err != nil {
+				return nil, err
+			}
+			var score float64
+			if typ == rdbTypeZSet2 {
+				score, err = r.binaryFloat()
+			} else {
+				score, err = r.float()
+			}
+			if err != nil {
+				return nil, err
+			}
+			z.set(string(m), score)
+		}
+		return z, nil
+
+	case rdbTypeHashZipmap:
+		blob, err := r.string()
+		if err != nil {
+			return nil, err
+		}
+		entries, err := zipmapEntries(blob)
+		if err != nil {
+			return nil, err
+		}
+		return hashOf(entries)
+
+	case rdbTypeSetIntset:
+		blob, err := r.string()
+		if err != nil {
+			return nil, err
+		}
+		members, err := intsetEntries(blob)
+		if err != nil {
+			return nil, err
+		}
+		return setOf(members), nil
+
+	case rdbTypeListZiplist, rdbTypeZSetZiplist, rdbTypeHashZiplist,
+		rdbTypeHashListpack, rdbTypeZSetListpack, rdbTypeSetListpack:
+		blob, err := r.string()
+		if err != nil {
+			return nil, err
+		}
+		var entries []string
+		switch typ {
+		case rdbTypeListZiplist, rdbTypeZSetZiplist, rdbTypeHashZiplist:
+			entries, err = ziplistEntries(blob)
+		default:
+			entries, err = listpackEntries(blob)
+		}
+		if err != nil {
+			return nil, err
+		}
+		switch typ {
+		case rdbTypeListZiplist:
+			return entries, nil
+		case rdbTypeSetListpack:
+			return setOf(entries), nil
+		case rdbTypeHashZiplist, rdbTypeHashListpack:
+			return hashOf(entries)
+		default:
+			return zsetOf(entries)
+		}
+
+	case rdbTypeListQuicklist, rdbTypeListQuicklist2:
+		n, err := r.count()
+		if err != nil {
+			return nil, err
+		}
+		var list []string
+		for i := 0; i < n; i++ {
+			container := uint64(rdbQuicklistNodePacked)
+			if typ == rdbTypeListQuicklist2 {
+				if container, _, err = r.length(); err != nil {
+					return nil, err
+				}
+			}
+			blob, err := r.string()
+			if err != nil {
+				return nil, err
+			}
+			var entries []string
+			switch {
+			case container == rdbQuicklistNodePlain:
+				entries = []string{string(blob)}
+			case typ == rdbTypeListQuicklist:
+				entries, err = ziplistEntries(blob)
+			default:
+				entries, err = listpackEntries(blob)
+			}
+			if err != nil {
+				return nil, err
+			}
+			list = append(list, entries...)
+		}
+		return list, nil
+	}
+	return nil, fmt.Errorf("unsupported RDB value type %d", typ)
+}
+
+func setOf(members []string) map[string]struct{} {
+	set := make(map[string]struct{}, len(members))
+	for _, m := range members {
+		set[m] = struct{}{}
+	}
+	return set
+}
+
+func hashOf(entries []string) (map[string]string, error) {
+	if len(entries)%2 != 0 {
+		return nil, errors.New("odd number of hash entries")
+	}
+	h := make(map[string]string, len(entries)/2)
+	for i := 0; i < len(entries); i += 2 {
+		h[entries[i]] = entries[i+1]
+	}
+	return h, nil
+}
+
+func zsetOf(entries []string) (*SortedSet, error) {
+	if len(entries)%2 != 0 {
+		return nil, errors.New("odd number of sorted set entries")
+	}
+	z := NewSortedSet()
+	for i := 0; i < len(entries); i += 2 {
+		score, err := strconv.ParseFloat(entries[i+1], 64)
+		if err != nil {
+			return nil, fmt.Errorf("invalid score %q", entries[i+1])
+		}
+		z.set(entries[i], score)
+	}
+	return z, nil
+}
+
+var errRDBEncoding = errors.New("corrupt encoded value")
+
+// ziplistEntries decodes a ziplist: a header, entries prefixed with the
+// previous entry's length and an encoding, and a 0xFF terminator.
+func ziplistEntries(b []byte) ([]string, error) {
+	if len(b) < 11 {
+		return nil, errRDBEncoding
+	}
+	var entries []string
+	for i := 10; ; {
+		if i >= len(b) {
+			return nil, errRDBEncoding
+		}
+		if b[i] == 0xFF {
+			return entries, nil
+		}
+		// Skip the previous entry length.
+		if b[i] == 0xFE {
+			i += 5
+		} else {
+			i++
+		}
+		if i >= len(b) {
+			return nil, errRDBEncoding
+		}
+
+		enc := b[i]
+		var n, hdr int
+		var v int64
+		isInt := true
+		switch {
+		case enc>>6 == 0:
+			n, hdr, isInt = int(enc&0x3f), 1, false
+		case enc>>6 == 1:
+			if i+2 > len(b) {
+				return nil, errRDBEncoding
+			}
+			n, hdr, isInt = int(enc&0x3f)<<8|int(b[i+1]), 2, false
+		case enc == 0x80:
+			if i+5 > len(b) {
+				return nil, errRDBEncoding
+			}
+			n, hdr, isInt = int(binary.BigEndian.Uint32(b[i+1:])), 5, false
+		case enc == 0xC0:
+			n, hdr = 2, 1
+		case enc == 0xD0:
+			n, hdr = 4, 1
+		case enc == 0xE0:
+			n, hdr = 8, 1
+		case enc == 0xF0:
+			n, hdr = 3, 1
+		case enc == 0xFE:
+			n, hdr = 1, 1
+		case enc >= 0xF1 && enc <= 0xFD:
+			n, hdr, v = 0, 1, int64(enc&0x0f)-1
+		default:
+			return nil, errRDBEncoding
+		}
+		i += hdr
+		if n < 0 || i+n > len(b) {
+			return nil, errRDBEncoding
+		}
+		data := b[i : i+n]
+		i += n
+
+		if !isInt {
+			entries = append(entries, string(data))
+			continue
+		}
+		switch n {
+		case 1:
+			v = int64(int8(data[0]))
+		case 2:
+			v = int64(int16(binary.LittleEndian.Uint16(data)))
+		case 3:
+			v = int64(int32(uint32(data[0])|uint32(data[1])<<8|uint32(data[2])<<16) << 8 >> 8)
+		case 4:
+			v = int64(int32(binary.LittleEndian.Uint32(data)))
+		case 8:
+			v = int64(binary.LittleEndian.Uint64(data))
+		}
+		entries = append(entries, strconv.FormatInt(v, 10))
+	}
+}
+
+// listpackEntries decodes a listpack: a header, entries made of an
+// encoding, data and a back length, and a 0xFF terminator.
+func listpackEntries(b []byte) ([]string, error) {
+	if len(b) < 7 {
+		return nil, errRDBEncoding
+	}
+	var entries []string
+	for i := 6; ; {
+		if i >= len(b) {
+			return nil, errRDBEncoding
+		}
+		enc := b[i]
+		if enc == 0xFF {
+			return entries, nil
+		}
+
+		var hdr, n int
+		var v int64
+		isInt := true
+		switch {
+		case enc&0x80 == 0:
+			hdr, v = 1, int64(enc)
+		case enc&0xC0 == 0x80:
+			hdr, n, isInt = 1, int(enc&0x3f), false
+		case enc&0xE0 == 0xC0:
+			if i+2 > len(b) {
+				return nil, errRDBEncoding
+			}
+			hdr = 2
+			v = int64(enc&0x1f)<<8 | int64(b[i+1])
+			if v >= 1<<12 {
+				v -= 1 << 13
+			}
+		case enc&0xF0 == 0xE0:
+			if i+2 > len(b) {
+				return nil, errRDBEncoding
+			}
+			hdr, n, isInt = 2, int(enc&0x0f)<<8|int(b[i+1]), false
+		case enc == 0xF0:
+			if i+5 > len(b) {
+				return nil, errRDBEncoding
+			}
+			hdr, n, isInt = 5, int(binary.LittleEndian.Uint32(b[i+1:])), false
+		case enc == 0xF1:
+			hdr, n = 1, 2
+		case enc == 0xF2:
+			hdr, n = 1, 3
+		case enc == 0xF3:
+			hdr, n = 1, 4
+		case enc == 0xF4:
+			hdr, n = 1, 8
+		default:
+			return nil, errRDBEncoding
+		}
+		if n < 0 || i+hdr+n > len(b) {
+			return nil, errRDBEncoding
+		}
+		data := b[i+hdr : i+hdr+n]
+
+		if !isInt {
+			entries = append(entries, string(data))
+		} else {
+			switch n {
+			case 2:
+				v = int64(int16(binary.LittleEndian.Uint16(data)))
+			case 3:
+				v = int64(int32(uint32(data[0])|uint32(data[1])<<8|uint32(data[2])<<16) << 8 >> 8)
+			case 4:
+				v = int64(int32(binary.LittleEndian.Uint32(data)))
+			case 8:
+				v = int64(binary.LittleEndian.Uint64(data))
+			}
+			entries = append(entries, strconv.FormatInt(v, 10))
+		}
+
+		// Skip the back length, which encodes hdr+n in 7-bit groups.
+		i += hdr + n + listpackBacklenSize(hdr+n)
+	}
+}
+
+func listpackBacklenSize(n int) int {
+	switch {
+	case n <= 127:
+		return 1
+	case n < 16383:
+		return 2
+	case n < 2097151:
+		return 3
+	case n < 268435455:
+		return 4
+	}
+	return 5
+}
+
+// intsetEntries decodes an intset: the integer width, a count and the
+// sorted little-endian integers.
+func intsetEntries(b []byte) ([]string, error) {
+	if len(b) < 8 {
+		return nil, errRDBEncoding
+	}
+	width := int(binary.LittleEndian.Uint32(b))
+	n := int(binary.LittleEndian.Uint32(b[4:]))
+	if (width != 2 && width != 4 && width != 8) || n < 0 || 8+n*width > len(b) {
+		return nil, errRDBEncoding
+	}
+	members := make([]string, n)
+	for i := range members {
+		p := b[8+i*width:]
+		var v int64
+		switch width {
+		case 2:
+			v = int64(int16(binary.LittleEndian.Uint16(p)))
+		case 4:
+			v = int64(int32(binary.LittleEndian.Uint32(p)))
+		case 8:
+			v = int64(binary.LittleEndian.Uint64(p))
+		}
+		members[i] = strconv.FormatInt(v, 10)
+	}
+	return members, nil
+}
+
+// zipmapEntries decodes the zipmap hashes of Redis 2.x.
+func zipmapEntries(b []byte) ([]string, error) {
+	var entries []string
+	i := 1
+	next := func() (int, bool) {
+		if i >= len(b) || b[i] == 0xFF {
+			return 0, false
+		}
+		if b[i] < 254 {
+			i++
+			return int(b[i-1]), true
+		}
+		if b[i] == 254 && i+5 <= len(b) {
+			n := int(binary.LittleEndian.Uint32(b[i+1:]))
+			i += 5
+			return n, true
+		}
+		return 0, false
+	}
+	for {
+		if i >= len(b) {
+			return nil, errRDBEncoding
+		}
+		if b[i] == 0xFF {
+			return entries, nil
+		}
+		kn, ok := next()
+		if !ok || kn < 0 || i+kn > len(b) {
+			return nil, errRDBEncoding
+		}
+		key := string(b[i : i+kn])
+		i += kn
+		vn, ok := next()
+		if !ok || i >= len(b) {
+			return nil, errRDBEncoding
+		}
+		free := int(b[i])
+		i++
+		if vn < 0 || i+vn+free > len(b) {
+			return nil, errRDBEncoding
+		}
+		entries = append(entries, key, string(b[i:i+vn]))
+		i += vn + free
+	}
+}
+
+// LoadRDB stores the keys of the RDB file read from r and returns how many
+// were loaded. Expired keys are skipped.
+func (c *BoltCache) LoadRDB(r io.Reader) (int, error) {
+	now := time.Now()
+	loaded := 0
+	err := ReadRDB(r, func(key string, item *CacheItem) error {
+		if !item.expired(now) {
+			c.Data.Store(key, item)
+			loaded++
+		}
+		return nil
+	})
+	return loaded, err
+}
+
+// SaveRDB writes the dataset to path as an RDB file; see WriteRDB. The file
+// is replaced atomically.
+func (c *BoltCache) SaveRDB(path string) (written, skipped int, err error) {
+	err = writeFileAtomic(path, func(w io.Writer) error {
+		var err error
+		written, skipped, err = c.WriteRDB(w)
+		return err
+	})
+	return written, skipped, err
+}
+
+// rdbWriter writes an RDB file and checksums what it writes.
+type rdbWriter struct {
+	w   *bufio.Writer
+	sum rdbChecksum
+	buf []byte
+	err error
+}
+
+func (w *rdbWriter) write(p []byte) {
+	if w.err != nil {
+		return
+	}
+	w.sum.Write(p)
+	_, w.err = w.w.Write(p)
+}
+
+func (w *rdbWriter) byte(b byte) { w.write([]byte{b}) }
+
+func (w *rdbWriter) length(n uint64) {
+	b := w.buf[:0]
+	switch {
+	case n < 1<<6:
+		b = append(b, byte(n))
+	case n < 1<<14:
+		b = append(b, byte(n>>8)|0x40, byte(n))
+	case n <= math.MaxUint32:
+		b = binary.BigEndian.AppendUint32(append(b, 0x80), uint32(n))
+	default:
+		b = binary.BigEndian.AppendUint64(append(b, 0x81), n)
+	}
+	w.buf = b
+	w.write(b)
+}
+
+func (w *rdbWriter) string(s string) {
+	w.length(uint64(len(s)))
+	w.write([]byte(s))
+}
+
+// WriteRDB writes the dataset to w as an RDB file and returns the number
+// of keys written. Streams have no plain RDB encoding and are skipped;
+// they are counted in skipped. Byte values are written as strings and JSON
+// values as their JSON text.
+func (c *BoltCache) WriteRDB(out io.Writer) (written, skipped int, err error) {
+	w := &rdbWriter{w: bufio.NewWriterSize(out, 64*1024)}
+	w.write([]byte(fmt.Sprintf("%s%04d", rdbMagic, rdbWriteVersion)))
+	aux := func(k, v string) {
+		w.byte(rdbOpAux)
+		w.string(k)
+		w.string(v)
+	}
+	aux("redis-ver", "7.0.0")
+	aux("redis-bits", "64")
+	aux("ctime", strconv.FormatInt(time.Now().Unix(), 10))
+	aux("boltcache-ver", appinfo.Version)
+	w.byte(rdbOpSelectDB)
+	w.length(0)
+
+	now := time.Now()
+	c.Data.rangeShards(func(keys []string, items []*CacheItem) bool {
+		// Collections change in place under Mu.
+		c.Mu.RLock()
+		defer c.Mu.RUnlock()
+		for i, item := range items {
+			if item.expired(now) {
+				continue
+			}
+			if _, ok := item.Value.(*Stream); ok {
+				skipped++
+				continue
+			}
+			if err := w.item(keys[i], item); err != nil {
+				w.err = fmt.Errorf("%s: %v", keys[i], err)
+				return false
+			}
+			written++
+		}
+		return w.err == nil
+	})
+
+	w.byte(rdbOpEOF)
+	if w.err != nil {
+		return written, skipped, w.err
+	}
+	sum := binary.LittleEndian.AppendUint64(nil, w.sum.Sum64())
+	if _, err := w.w.Write(sum); err != nil {
+		return written, skipped, err
+	}
+	return written, skipped, w.w.Flush()
+}
+
+func (w *rdbWriter) item(key string, item *CacheItem) error {
+	if !item.ExpiresAt.IsZero() {
+		w.byte(rdbOpExpireTimeMs)
+		w.write(binary.LittleEndian.AppendUint64(nil, uint64(item.ExpiresAt.UnixMilli())))
+	}
+
+	switch v := item.Value.(type) {
+	case string:
+		w.byte(rdbTypeString)
+		w.string(key)
+		w.string(v)
+	case []byte:
+		w.byte(rdbTypeString)
+		w.string(key)
+		w.string(string(v))
+	case []string:
+		w.byte(rdbTypeList)
+		w.string(key)
+		w.length(uint64(len(v)))
+		for _, s := range v {
+			w.string(s)
+		}
+	case map[string]struct{}:
+		w.byte(rdbTypeSet)
+		w.string(key)
+		w.length(uint64(len(v)))
+		for m := range v {
+			w.string(m)
+		}
+	case map[string]string:
+		w.byte(rdbTypeHash)
+		w.string(key)
+		w.length(uint64(len(v)))
+		for f, val := range v {
+			w.string(f)
+			w.string(val)
+		}
+	case *SortedSet:
+		w.byte(rdbTypeZSet2)
+		w.string(key)
+		w.length(uint64(v.Len()))
+		for x := v.list.byRank(1); x != nil; x = x.level[0].forward {
+			w.string(x.member)
+			w.write(binary.LittleEndian.AppendUint64(nil, math.Float64bits(x.score)))
+		}
+	default:
+		_, data, err := EncodeValue(v)
+		if err != nil {
+			return err
+		}
+		w.byte(rdbTypeString)
+		w.string(key)
+		w.string(string(data))
+	}
+	return w.err
+}
@@ -0,0 +1,135 @@
+package cache
+
+import (
+	"bytes"
+	"encoding/binary"
+	"math"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestRDBChecksum(t *testing.T) {
+	var h rdbChecksum
+	h.Write([]byte("123"))
+	h.Write([]byte("456789"))
+	if got := h.Sum64(); got != 0xe9c6d914c4b8d9ca {
+		t.Fatalf("crc64 = %x", got)
+	}
+}
+
+func TestRDBRoundTrip(t *testing.T) {
+	c := &BoltCache{Data: NewShardedMap()}
+	c.Set("str", "hello", time.Hour)
+	c.Set("empty", "", 0)
+	c.LPush("list", "a", "b")
+	c.SAdd("set", "x", "y")
+	c.HSet("hash", "f", "v")
+	c.ZAdd("zset", ZAddOptions{}, ZMember{"lo", math.Inf(-1)}, ZMember{"mid", 2.5})
+	c.XAdd("stream", "1-1", []string{"f", "v"}, XAddOptions{})
+
+	var buf bytes.Buffer
+	written, skipped, err := c.WriteRDB(&buf)
+	if err != nil || written != 6 || skipped != 1 {
+		t.Fatalf("WriteRDB: %d written, %d skipped, %v", written, skipped, err)
+	}
+
+	c2 := &BoltCache{Data: NewShardedMap()}
+	if _, err := c2.LoadRDB(&buf); err != nil {
+		t.Fatal(err)
+	}
+	c.Delete("stream")
+	sameData(t, c, c2)
+}
+
+// listpack frames encoded entries, each followed by its back length.
+func listpack(entries ...[]byte) []byte {
+	var body []byte
+	for _, e := range entries {
+		body = append(body, e...)
+		body = append(body, byte(len(e)))
+	}
+	b := binary.LittleEndian.AppendUint32(nil, uint32(6+len(body)+1))
+	b = binary.LittleEndian.AppendUint16(b, uint16(len(entries)))
+	return append(append(b, body...), 0xFF)
+}
+
+// rdbFile frames records the way Redis 7 writes them.
+func rdbFile(records ...[]byte) []byte {
+	b := []byte("REDIS0011")
+	b = append(b, rdbOpAux, 9)
+	b = append(b, "redis-ver"...)
+	b = append(b, 5)
+	b = append(b, "7.2.4"...)
+	b = append(b, rdbOpSelectDB, 0, rdbOpResizeDB, 6, 1)
+	for _, r := range records {
+		b = append(b, r...)
+	}
+	b = append(b, rdbOpEOF)
+	var h rdbChecksum
+	h.Write(b)
+	return binary.LittleEndian.AppendUint64(b, h.Sum64())
+}
+
+func rdbString(s string) []byte {
+	return append([]byte{byte(len(s))}, s...)
+}
+
+func rdbRecord(typ byte, key string, value []byte) []byte {
+	return append(append([]byte{typ}, rdbString(key)...), value...)
+}
+
+func TestReadRDBEncodings(t *testing.T) {
+	quicklist := listpack(
+		[]byte{0x81, 'a'},
+		[]byte{0x05},
+		[]byte{0xDF, 0x9C},       // 13-bit -100
+		[]byte{0xF1, 0xE8, 0x03}, // int16 1000
+	)
+	intset := []byte{2, 0, 0, 0, 3, 0, 0, 0, 0xFD, 0xFF, 1, 0, 2, 0}
+	ziplist := []byte{0, 0, 0, 0, 0, 0, 0, 0, 2, 0, 0, 0x01, 'f', 3, 0xF8, 0xFF}
+	zsetLP := listpack([]byte{0x81, 'm'}, []byte{0x83, '1', '.', '5'}, []byte{0x81, 'n'}, []byte{0x02})
+	lzf := []byte{0xC3, 5, 10, 0x00, 'a', 0xE0, 0x00, 0x00}
+	future := binary.LittleEndian.AppendUint64([]byte{rdbOpExpireTimeMs}, uint64(time.Now().Add(time.Hour).UnixMilli()))
+	past := binary.LittleEndian.AppendUint64([]byte{rdbOpExpireTimeMs}, 1000)
+
+	data := rdbFile(
+		rdbRecord(rdbTypeListQuicklist2, "list", append([]byte{1, rdbQuicklistNodePacked}, rdbString(string(quicklist))...)),
+		rdbRecord(rdbTypeSetIntset, "set", rdbString(string(intset))),
+		rdbRecord(rdbTypeHashZiplist, "hash", rdbString(string(ziplist))),
+		rdbRecord(rdbTypeZSetListpack, "zset", rdbString(string(zsetLP))),
+		rdbRecord(rdbTypeString, "lzf", lzf),
+		append(future, rdbRecord(rdbTypeString, "int", []byte{0xC0, 123})...),
+		append(past, rdbRecord(rdbTypeString, "gone", rdbString("x"))...),
+	)
+
+	c := &BoltCache{Data: NewShardedMap()}
+	n, err := c.LoadRDB(bytes.NewReader(data))
+	if err != nil || n != 6 {
+		t.Fatalf("loaded %d keys: %v", n, err)
+	}
+
+	want := map[string]interface{}{
+		"list": []string{"a", "5", "-100", "1000"},
+		"set":  map[string]struct{}{"-3": {}, "1": {}, "2": {}},
+		"hash": map[string]string{"f": "7"},
+		"lzf":  "aaaaaaaaaa",
+		"int":  "123",
+	}
+	for key, w := range want {
+		if got, _ := c.Get(key); !reflect.DeepEqual(got, w) {
+			t.Errorf("%s: got %#v, want %#v", key, got, w)
+		}
+	}
+	if got, _ := c.ZRange("zset", 0, -1, false); !reflect.DeepEqual(got, []ZMember{{"m", 1.5}, {"n", 2}}) {
+		t.Errorf("zset: got %v", got)
+	}
+	if item, _ := c.Data.Load("int"); item.ExpiresAt.IsZero() {
+		t.Error("int lost its expiration")
+	}
+
+	data[20] ^= 0xff
+	if _, err := (&BoltCache{Data: NewShardedMap()}).LoadRDB(bytes.NewReader(data)); err == nil {
+		t.Error("damaged file loaded without error")
+	}
+}
@@ -0,0 +1,815 @@
+package cache
+
+import (
+	"bufio"
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+import (
+	config "boltcache/config"
+	logger "boltcache/logger"
+)
+
+// Replication follows the Redis design. A replica connects to the master's
+// TCP port and sends PSYNC with the replication ID and offset it has. The
+// master answers
+//
+//	+CONTINUE <id>                               and resends its backlog from
+//	                                             the offset, or
+//	+FULLRESYNC <id> <offset>\r\n<snapshot>      and a snapshot taken at
+//	                                             offset, sent as bulk
+//	                                             strings ended by $0\r\n\r\n,
+//
+// then streams every write as a RESP command. The offset counts the bytes
+// of that stream. Replicas report what they applied with REPLCONF ACK
+// <offset>, which sync mode waits for.
+
+var (
+	ErrReplicationDisabled = errors.New("ERR replication is disabled")
+	ErrReplicaOfReplica    = errors.New("ERR replicas can't serve replicas")
+	errBacklogOverrun      = errors.New("replica fell behind the backlog")
+)
+
+const (
+	defaultBacklogSize = 1 << 20
+	replicaAckInterval = time.Second
+	replicaRetryDelay  = time.Second
+)
+
+// replBacklog is a ring buffer holding the last bytes of the replication
+// stream.
+type replBacklog struct {
+	buf   []byte
+	first int64 // offset the backlog was started at
+	end   int64 // replication offset after the last byte
+}
+
+func (b *replBacklog) write(p []byte) {
+	for len(p) > 0 {
+		n := copy(b.buf[b.end%int64(len(b.buf)):], p)
+		p = p[n:]
+		b.end += int64(n)
+	}
+}
+
+// start is the offset of the oldest byte still held.
+func (b *replBacklog) start() int64 {
+	return max(b.first, b.end-int64(len(b.buf)))
+}
+
+// read copies the stream from offset from, which must not be before start.
+func (b *replBacklog) read(from int64, p []byte) int {
+	n := 0
+	for from < b.end && n < len(p) {
+		i := from % int64(len(b.buf))
+		chunk := b.buf[i:min(int64(len(b.buf)), i+b.end-from)]
+		m := copy(p[n:], chunk)
+		n += m
+		from += int64(m)
+	}
+	return n
+}
+
+// replicationMaster feeds connected replicas from the backlog.
+type replicationMaster struct {
+	mu      sync.Mutex
+	changed *sync.Cond // new writes, acknowledgements or lost replicas
+	id      string
+	backlog replBacklog
+
+	// A promoted replica continues the history of its old master up to
+	// the offset it had, so the other replicas resync partially.
+	id2    string
+	id2End int64
+
+	scratch  []byte
+	replicas map[*replicaLink]struct{}
+
+	syncTimeouts atomic.Uint64
+}
+
+// replicaLink is a replica connected to the master.
+type replicaLink struct {
+	addr    string
+	ack     int64 // guarded by replicationMaster.mu
+	lastAck time.Time
+	closed  bool
+}
+
+// replicaState is the link of a replica to its master.
+type replicaState struct {
+	master string
+	stop   chan struct{} // closed to stop replicating
+	done   chan struct{} // closed when replicaLoop returns
+
+	mu     sync.Mutex
+	id     string
+	offset int64
+	linkUp bool
+	conn   net.Conn
+	since  time.Time // when the link went up or down
+}
+
+// ReplicationInfo is reported by INFO and ROLE.
+type ReplicationInfo struct {
+	Role         string // master or replica
+	ReplID       string
+	Offset       int64
+	BacklogStart int64
+	Replicas     []ReplicaInfo
+	SyncTimeouts uint64
+
+	// Anti-entropy runs and keys it repaired, on replicas.
+	AntiEntropyRuns     uint64
+	AntiEntropyRepaired uint64
+
+	// Replica only.
+	Master       string
+	LinkUp       bool
+	LinkDuration time.Duration
+}
+
+// ReplicaInfo describes a replica connected to the master.
+type ReplicaInfo struct {
+	Addr   string
+	Offset int64
+	Lag    time.Duration
+}
+
+func newReplicationID() string {
+	b := make([]byte, 20)
+	rand.Read(b)
+	return hex.EncodeToString(b)
+}
+
+// StartReplication enables replication with cfg: as a replica, it starts
+// copying the master; as a master, it starts keeping the backlog replicas
+// resynchronize from.
+func (c *BoltCache) StartReplication(cfg config.ReplicationConfig) error {
+	size, err := config.ParseMemorySize(cfg.BacklogSize)
+	if err != nil {
+		return err
+	}
+	if size <= 0 {
+		size = defaultBacklogSize
+	}
+	c.replConfig, c.backlogSize = cfg, size
+	for _, addr := range cfg.Replicas {
+		c.AddReplica(addr)
+	}
+	// Registered on replicas too, which failover may promote.
+	c.AddWriteHook(c.feedReplicas)
+
+	if cfg.Role == "replica" {
+		if cfg.Master == "" {
+			return errors.New("replication master is not set")
+		}
+		c.startReplica(cfg.Master, "", 0)
+		return nil
+	}
+	c.master.Store(c.newMaster(newReplicationID(), 0))
+	return nil
+}
+
+// newMaster creates the master state with an empty backlog at offset.
+func (c *BoltCache) newMaster(id string, offset int64) *replicationMaster {
+	return newReplicationMaster(id, c.backlogSize, offset)
+}
+
+func newReplicationMaster(id string, size, offset int64) *replicationMaster {
+	m := &replicationMaster{
+		id:       id,
+		backlog:  replBacklog{buf: make([]byte, size), first: offset, end: offset},
+		replicas: make(map[*replicaLink]struct{}),
+	}
+	m.changed = sync.NewCond(&m.mu)
+	return m
+}
+
+// startReplica starts copying the master at addr, resuming the history id
+// from offset when the master still has it.
+func (c *BoltCache) startReplica(addr, id string, offset int64) {
+	r := &replicaState{
+		master: addr,
+		stop:   make(chan struct{}),
+		done:   make(chan struct{}),
+		id:     id,
+		offset: offset,
+		since:  time.Now(),
+	}
+	c.replica.Store(r)
+	go c.replicaLoop(r)
+	if interval := c.replConfig.AntiEntropyInterval; interval > 0 {
+		go c.antiEntropyLoop(r, interval)
+	}
+}
+
+// stopReplica stops copying the master and returns the replication ID and
+// offset the replica got to.
+func (c *BoltCache) stopReplica(r *replicaState) (string, int64) {
+	close(r.stop)
+	r.mu.Lock()
+	if r.conn != nil {
+		r.conn.Close()
+	}
+	r.mu.Unlock()
+	<-r.done
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.id, r.offset
+}
+
+// Promote turns a replica into a master. The new master keeps the history
+// of its old master up to its offset, so the other replicas of the old
+// master continue from it with a partial resync.
+func (c *BoltCache) Promote() error {
+	if !c.ReplicationEnabled() {
+		return ErrReplicationDisabled
+	}
+	r := c.replica.Load()
+	if r == nil {
+		return nil
+	}
+	id, offset := c.stopReplica(r)
+	m := c.newMaster(newReplicationID(), offset)
+	m.id2, m.id2End = id, offset
+	c.master.Store(m)
+	c.replica.Store(nil)
+	logger.Log("Promoted to master at offset %d, replication ID %s", offset, m.id)
+	return nil
+}
+
+// Follow makes the cache a replica of the master at addr. A master
+// resumes from its own history, so only the writes the new master doesn't
+// have are resynchronized; its replicas are disconnected.
+func (c *BoltCache) Follow(addr string) error {
+	if !c.ReplicationEnabled() {
+		return ErrReplicationDisabled
+	}
+	var id string
+	var offset int64
+	if r := c.replica.Load(); r != nil {
+		if r.master == addr {
+			return nil
+		}
+		id, offset = c.stopReplica(r)
+	} else if m := c.master.Load(); m != nil {
+		m.mu.Lock()
+		id, offset = m.id, m.backlog.end
+		m.mu.Unlock()
+	}
+
+	c.startReplica(addr, id, offset)
+	if m := c.master.Swap(nil); m != nil {
+		m.mu.Lock()
+		for link := range m.replicas {
+			link.closed = true
+		}
+		m.mu.Unlock()
+		m.changed.Broadcast()
+	}
+	logger.Log("Replicating %s from offset %d", addr, offset)
+	return nil
+}
+
+// ReplicationEnabled reports whether StartReplication was called.
+func (c *BoltCache) ReplicationEnabled() bool {
+	return c.master.Load() != nil || c.replica.Load() != nil
+}
+
+// IsReplica reports whether the cache copies a master and so rejects
+// writes from clients.
+func (c *BoltCache) IsReplica() bool {
+	return c.replica.Load() != nil
+}
+
+// SyncReplication reports whether writes wait for replicas to confirm them.
+func (c *BoltCache) SyncReplication() bool {
+	return c.master.Load() != nil && c.replConfig.Mode == "sync"
+}
+
+// feedReplicas is the WriteHook adding writes to the backlog of a master.
+func (c *BoltCache) feedReplicas(args []string) {
+	m := c.master.Load()
+	if m == nil {
+		return
+	}
+	m.write(args)
+}
+
+// write adds a command to the backlog.
+func (m *replicationMaster) write(args []string) {
+	m.mu.Lock()
+	m.scratch = appendCommand(m.scratch[:0], args)
+	m.backlog.write(m.scratch)
+	m.mu.Unlock()
+	m.changed.Broadcast()
+}
+
+// ReplicationOffset returns the offset of the replication stream: on a
+// master the bytes written so far, on a replica the bytes applied.
+func (c *BoltCache) ReplicationOffset() int64 {
+	if m := c.master.Load(); m != nil {
+		m.mu.Lock()
+		defer m.mu.Unlock()
+		return m.backlog.end
+	}
+	if r := c.replica.Load(); r != nil {
+		r.mu.Lock()
+		defer r.mu.Unlock()
+		return r.offset
+	}
+	return 0
+}
+
+// WaitReplicas waits until enough replicas acknowledged offset, or until
+// the sync timeout passes, and reports whether they did. Enough is the
+// number of replicas added with AddReplica, or every connected replica
+// when none were added.
+func (c *BoltCache) WaitReplicas(offset int64) bool {
+	m := c.master.Load()
+	if m == nil {
+		return true
+	}
+	timeout := c.replConfig.SyncTimeout
+	if timeout <= 0 {
+		timeout = time.Second
+	}
+
+	configured := len(c.GetReplicas())
+	expired := false
+	timer := time.AfterFunc(timeout, func() {
+		m.mu.Lock()
+		expired = true
+		m.mu.Unlock()
+		m.changed.Broadcast()
+	})
+	defer timer.Stop()
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	for {
+		want := configured
+		if want == 0 {
+			want = len(m.replicas)
+		}
+		acked := 0
+		for r := range m.replicas {
+			if r.ack >= offset {
+				acked++
+			}
+		}
+		if acked >= want {
+			return true
+		}
+		if expired {
+			m.syncTimeouts.Add(1)
+			return false
+		}
+		m.changed.Wait()
+	}
+}
+
+// ServeReplica answers PSYNC id offset on conn and then streams writes to
+// the replica until the connection fails. r holds what was read from conn
+// past the PSYNC command.
+func (c *BoltCache) ServeReplica(conn net.Conn, r *bufio.Reader, id string, offset int64) error {
+	defer conn.Close()
+	m := c.master.Load()
+	if m == nil {
+		if c.IsReplica() {
+			return writeReplError(conn, ErrReplicaOfReplica)
+		}
+		return writeReplError(conn, ErrReplicationDisabled)
+	}
+
+	m.mu.Lock()
+	known := id == m.id || id == m.id2 && offset <= m.id2End
+	partial := known && offset >= m.backlog.start() && offset <= m.backlog.end
+	m.mu.Unlock()
+
+	if partial {
+		if _, err := fmt.Fprintf(conn, "+CONTINUE %s\r\n", m.id); err != nil {
+			return err
+		}
+	} else {
+		var err error
+		if offset, err = c.sendFullSync(conn, m); err != nil {
+			return err
+		}
+	}
+
+	link := &replicaLink{addr: conn.RemoteAddr().String(), ack: offset, lastAck: time.Now()}
+	m.mu.Lock()
+	m.replicas[link] = struct{}{}
+	m.mu.Unlock()
+	logger.Log("Replica %s connected at offset %d (partial resync: %v)", link.addr, offset, partial)
+
+	go m.readAcks(link, r)
+	err := m.stream(conn, link, offset)
+
+	m.mu.Lock()
+	link.closed = true
+	delete(m.replicas, link)
+	m.mu.Unlock()
+	m.changed.Broadcast()
+	logger.Log("Replica %s disconnected: %v", link.addr, err)
+	return err
+}
+
+func writeReplError(w io.Writer, err error) error {
+	fmt.Fprintf(w, "-%s\r\n", err.Error())
+	return err
+}
+
+// sendFullSync sends a snapshot of the dataset and returns the offset it
+// was taken at. Collection writes wait on Mu while the dataset is
+// captured, so none is both in the snapshot and after the offset. String
+// writes may be in both, which is harmless since they are all sent as SET
+// with an absolute expiry, DEL, PEXPIREAT or PERSIST, which have the same
+// effect when applied twice. The snapshot is encoded and sent after Mu is
+// released, in chunks, so it is never held in memory as a whole.
+func (c *BoltCache) sendFullSync(w io.Writer, m *replicationMaster) (int64, error) {
+	c.Mu.RLock()
+	m.mu.Lock()
+	offset := m.backlog.end
+	m.mu.Unlock()
+	sc, err := c.captureSnapshot()
+	c.Mu.RUnlock()
+	if err != nil {
+		return 0, writeReplError(w, err)
+	}
+
+	if _, err := fmt.Fprintf(w, "+FULLRESYNC %s %d\r\n", m.id, offset); err != nil {
+		return 0, err
+	}
+	cw := &chunkWriter{w: w}
+	if err := sc.write(cw, c.snapshotCompression()); err != nil {
+		return 0, err
+	}
+	if err := cw.close(); err != nil {
+		return 0, err
+	}
+	return offset, nil
+}
+
+// chunkWriter sends a snapshot as bulk strings, ended by an empty one.
+type chunkWriter struct {
+	w   io.Writer
+	buf []byte
+}
+
+func (cw *chunkWriter) Write(p []byte) (int, error) {
+	if len(p) == 0 {
+		return 0, nil
+	}
+	cw.buf = append(cw.buf[:0], '$')
+	cw.buf = strconv.AppendInt(cw.buf, int64(len(p)), 10)
+	cw.buf = append(cw.buf, "\r\n"...)
+	cw.buf = append(cw.buf, p...)
+	cw.buf = append(cw.buf, "\r\n"...)
+	if _, err := cw.w.Write(cw.buf); err != nil {
+		return 0, err
+	}
+	return len(p), nil
+}
+
+func (cw *chunkWriter) close() error {
+	_, err := io.WriteString(cw.w, "$0\r\n\r\n")
+	return err
+}
+
+// chunkReader reads the snapshot sent by a chunkWriter.
+type chunkReader struct {
+	r    *bufio.Reader
+	left int64 // bytes left in the current chunk
+	done bool
+}
+
+func (cr *chunkReader) Read(p []byte) (int, error) {
+	for cr.left == 0 {
+		if cr.done {
+			return 0, io.EOF
+		}
+		if err := cr.next(); err != nil {
+			return 0, err
+		}
+	}
+	if int64(len(p)) > cr.left {
+		p = p[:cr.left]
+	}
+	n, err := cr.r.Read(p)
+	cr.left -= int64(n)
+	if cr.left == 0 && err == nil {
+		err = cr.crlf()
+	}
+	if err == io.EOF {
+		err = io.ErrUnexpectedEOF
+	}
+	return n, err
+}
+
+// next reads the header of the next chunk.
+func (cr *chunkReader) next() error {
+	line, err := cr.r.ReadString('\n')
+	if err != nil {
+		return err
+	}
+	if len(line) < 4 || line[0] != '$' {
+		return fmt.Errorf("unexpected snapshot chunk %q", strings.TrimSpace(line))
+	}
+	n, err := strconv.ParseInt(strings.TrimSpace(line[1:]), 10, 64)
+	if err != nil || n < 0 {
+		return fmt.Errorf("invalid snapshot chunk size %q", strings.TrimSpace(line[1:]))
+	}
+	if n == 0 {
+		cr.done = true
+		return cr.crlf()
+	}
+	cr.left = n
+	return nil
+}
+
+// crlf reads the CRLF ending a chunk.
+func (cr *chunkReader) crlf() error {
+	var end [2]byte
+	if _, err := io.ReadFull(cr.r, end[:]); err != nil {
+		return err
+	}
+	if end != [2]byte{'\r', '\n'} {
+		return errors.New("snapshot chunk not terminated by CRLF")
+	}
+	return nil
+}
+
+// stream writes the replication stream from offset until the link closes,
+// a write fails or the replica falls behind the backlog.
+func (m *replicationMaster) stream(w io.Writer, link *replicaLink, offset int64) error {
+	chunk := make([]byte, 64*1024)
+	for {
+		m.mu.Lock()
+		for offset == m.backlog.end && !link.closed {
+			m.changed.Wait()
+		}
+		if link.closed {
+			m.mu.Unlock()
+			return io.EOF
+		}
+		if offset < m.backlog.start() {
+			m.mu.Unlock()
+			return errBacklogOverrun
+		}
+		n := m.backlog.read(offset, chunk)
+		m.mu.Unlock()
+
+		if _, err := w.Write(chunk[:n]); err != nil {
+			return err
+		}
+		offset += int64(n)
+	}
+}
+
+// readAcks records the REPLCONF ACK offsets sent by the replica.
+func (m *replicationMaster) readAcks(link *replicaLink, r *bufio.Reader) {
+	defer func() {
+		m.mu.Lock()
+		link.closed = true
+		m.mu.Unlock()
+		m.changed.Broadcast()
+	}()
+
+	for {
+		args, _, err := readCommand(r)
+		if err != nil {
+			return
+		}
+		if len(args) != 3 || !strings.EqualFold(args[0], "REPLCONF") || !strings.EqualFold(args[1], "ACK") {
+			continue
+		}
+		offset, err := strconv.ParseInt(args[2], 10, 64)
+		if err != nil {
+			continue
+		}
+		m.mu.Lock()
+		link.ack = max(link.ack, offset)
+		link.lastAck = time.Now()
+		m.mu.Unlock()
+		m.changed.Broadcast()
+	}
+}
+
+// ReplicationInfo returns the replication state.
+func (c *BoltCache) ReplicationInfo() ReplicationInfo {
+	if r := c.replica.Load(); r != nil {
+		r.mu.Lock()
+		defer r.mu.Unlock()
+		return ReplicationInfo{
+			Role:                "replica",
+			ReplID:              r.id,
+			Offset:              r.offset,
+			AntiEntropyRuns:     c.antiEntropy.runs.Load(),
+			AntiEntropyRepaired: c.antiEntropy.repaired.Load(),
+			Master:              r.master,
+			LinkUp:              r.linkUp,
+			LinkDuration:        time.Since(r.since),
+		}
+	}
+
+	info := ReplicationInfo{
+		Role:                "master",
+		AntiEntropyRuns:     c.antiEntropy.runs.Load(),
+		AntiEntropyRepaired: c.antiEntropy.repaired.Load(),
+	}
+	m := c.master.Load()
+	if m == nil {
+		return info
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	info.ReplID = m.id
+	info.Offset = m.backlog.end
+	info.BacklogStart = m.backlog.start()
+	info.SyncTimeouts = m.syncTimeouts.Load()
+	for link := range m.replicas {
+		info.Replicas = append(info.Replicas, ReplicaInfo{
+			Addr:   link.addr,
+			Offset: link.ack,
+			Lag:    time.Since(link.lastAck),
+		})
+	}
+	return info
+}
+
+// replicaLoop keeps the replica connected to its master until stopped.
+func (c *BoltCache) replicaLoop(r *replicaState) {
+	defer close(r.done)
+	for {
+		err := c.syncWithMaster(r)
+		r.mu.Lock()
+		if r.linkUp {
+			r.since = time.Now()
+		}
+		r.linkUp, r.conn = false, nil
+		r.mu.Unlock()
+		select {
+		case <-r.stop:
+			return
+		default:
+		}
+		logger.Log("Replication link to %s lost: %v", r.master, err)
+		select {
+		case <-r.stop:
+			return
+		case <-time.After(replicaRetryDelay):
+		}
+	}
+}
+
+// syncWithMaster resynchronizes with the master and applies its stream
+// until the connection fails.
+func (c *BoltCache) syncWithMaster(r *replicaState) error {
+	conn, err := net.DialTimeout("tcp", r.master, 5*time.Second)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	r.mu.Lock()
+	r.conn = conn
+	r.mu.Unlock()
+	select {
+	case <-r.stop:
+		return errors.New("replication stopped")
+	default:
+	}
+
+	r.mu.Lock()
+	id, offset := r.id, r.offset
+	r.mu.Unlock()
+	if id == "" {
+		id = "?"
+	}
+	if _, err := fmt.Fprintf(conn, "PSYNC %s %d\r\n", id, offset); err != nil {
+		return err
+	}
+
+	br := bufio.NewReaderSize(conn, 64*1024)
+	line, err := br.ReadString('\n')
+	if err != nil {
+		return err
+	}
+	fields := strings.Fields(line)
+	switch {
+	case len(fields) == 2 && fields[0] == "+CONTINUE":
+		// A promoted master continues under its new ID.
+		id = fields[1]
+		logger.Log("Partial resync with %s from offset %d", r.master, offset)
+	case len(fields) == 3 && fields[0] == "+FULLRESYNC":
+		id = fields[1]
+		if offset, err = strconv.ParseInt(fields[2], 10, 64); err != nil {
+			return fmt.Errorf("invalid FULLRESYNC offset %q", fields[2])
+		}
+		n, err := c.loadFullSync(br)
+		if err != nil {
+			return err
+		}
+		logger.Log("Full resync with %s: %d keys at offset %d", r.master, n, offset)
+	case strings.HasPrefix(line, "-"):
+		return errors.New(strings.TrimSpace(line[1:]))
+	default:
+		return fmt.Errorf("unexpected PSYNC reply %q", strings.TrimSpace(line))
+	}
+
+	r.mu.Lock()
+	r.id, r.offset = id, offset
+	r.linkUp, r.since = true, time.Now()
+	r.mu.Unlock()
+
+	// Acks are sent after every batch and once a second, so the master
+	// learns the offset even when no writes arrive.
+	var writeMu sync.Mutex
+	ack := func() error {
+		writeMu.Lock()
+		defer writeMu.Unlock()
+		cmd := appendCommand(nil, []string{"REPLCONF", "ACK", strconv.FormatInt(c.ReplicationOffset(), 10)})
+		_, err := conn.Write(cmd)
+		return err
+	}
+	if err := ack(); err != nil {
+		return err
+	}
+	done := make(chan struct{})
+	defer close(done)
+	go func() {
+		ticker := time.NewTicker(replicaAckInterval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-done:
+				return
+			case <-ticker.C:
+				if ack() != nil {
+					conn.Close()
+					return
+				}
+			}
+		}
+	}()
+
+	for {
+		args, n, err := readCommand(br)
+		if err != nil {
+			return err
+		}
+		if !c.underConsensus(args) {
+			c.TxMu.RLock()
+			err = c.Apply(args)
+			c.TxMu.RUnlock()
+		}
+		if err != nil {
+			logger.Log("Replica failed to apply %v", err)
+		}
+
+		r.mu.Lock()
+		r.offset += n
+		r.mu.Unlock()
+		if br.Buffered() == 0 {
+			if err := ack(); err != nil {
+				return err
+			}
+		}
+	}
+}
+
+// loadFullSync reads the snapshot of a FULLRESYNC and makes it the dataset.
+func (c *BoltCache) loadFullSync(br *bufio.Reader) (int, error) {
+	body := &chunkReader{r: br}
+	items := make(map[string]*CacheItem)
+	now := time.Now()
+	replaced := c.notUnderConsensus()
+	err := ReadSnapshot(body, func(key string, item *CacheItem) error {
+		if !item.expired(now) && (replaced == nil || replaced(key)) {
+			items[key] = item
+		}
+		return nil
+	})
+	if err != nil {
+		return 0, err
+	}
+	// Skip anything the snapshot reader didn't consume.
+	if _, err := io.Copy(io.Discard, body); err != nil {
+		return 0, err
+	}
+	c.replaceKeys(items, replaced)
+	return len(items), nil
+}
@@ -0,0 +1,248 @@
+package cache
+
+import (
+	"bufio"
+	"bytes"
+	"net"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+import (
+	config "boltcache/config"
+)
+
+func TestReplBacklog(t *testing.T) {
+	b := replBacklog{buf: make([]byte, 8)}
+	b.write([]byte("abcdef"))
+	b.write([]byte("ghijk"))
+	if b.start() != 3 || b.end != 11 {
+		t.Fatalf("start %d, end %d", b.start(), b.end)
+	}
+	p := make([]byte, 16)
+	if n := b.read(3, p); string(p[:n]) != "defghijk" {
+		t.Fatalf("read %q", p[:n])
+	}
+	if n := b.read(9, p); string(p[:n]) != "jk" {
+		t.Fatalf("read %q", p[:n])
+	}
+}
+
+// serveMaster accepts replicas for c the way the PSYNC command does and
+// reports the PSYNC arguments of each connection.
+func serveMaster(t *testing.T, c *BoltCache) (string, <-chan []string) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { ln.Close() })
+	psyncs := make(chan []string, 10)
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			r := bufio.NewReader(conn)
+			line, _ := r.ReadString('\n')
+			args := strings.Fields(line)
+			psyncs <- args
+			offset, _ := strconv.ParseInt(args[2], 10, 64)
+			go c.ServeReplica(conn, r, args[1], offset)
+		}
+	}()
+	return ln.Addr().String(), psyncs
+}
+
+func waitFor(t *testing.T, what string, cond func() bool) {
+	t.Helper()
+	for deadline := time.Now().Add(5 * time.Second); !cond(); {
+		if time.Now().After(deadline) {
+			t.Fatalf("timed out waiting for %s", what)
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+}
+
+func TestReplication(t *testing.T) {
+	master := &BoltCache{Data: NewShardedMap()}
+	err := master.StartReplication(config.ReplicationConfig{Mode: "sync", Role: "master", BacklogSize: "1KB", SyncTimeout: 2 * time.Second})
+	if err != nil {
+		t.Fatal(err)
+	}
+	master.Set("before", "sync", time.Hour)
+	master.SAdd("set", "a", "b")
+	addr, psyncs := serveMaster(t, master)
+
+	replica := &BoltCache{Data: NewShardedMap()}
+	replica.Set("stale", "x", 0)
+	if err := replica.StartReplication(config.ReplicationConfig{Role: "replica", Master: addr}); err != nil {
+		t.Fatal(err)
+	}
+	if args := <-psyncs; args[1] != "?" {
+		t.Fatalf("first sync sent %v", args)
+	}
+	waitFor(t, "full sync", func() bool { return replica.ReplicationInfo().LinkUp })
+	sameData(t, master, replica)
+
+	// Writes are streamed, and sync mode sees the acknowledgement.
+	master.Set("after", "stream", 0)
+	master.HSet("hash", "f", "v")
+	if !master.WaitReplicas(master.ReplicationOffset()) {
+		t.Fatal("write was not acknowledged")
+	}
+	waitFor(t, "stream", func() bool { return replica.ReplicationOffset() == master.ReplicationOffset() })
+	sameData(t, master, replica)
+
+	// After a brief disconnect the replica continues from the backlog.
+	r := replica.replica.Load()
+	r.mu.Lock()
+	r.conn.Close()
+	r.mu.Unlock()
+	master.Delete("before")
+	if args := <-psyncs; args[1] != master.master.Load().id || args[2] == "0" {
+		t.Fatalf("resync sent %v", args)
+	}
+	waitFor(t, "partial resync", func() bool { return replica.ReplicationOffset() == master.ReplicationOffset() })
+	sameData(t, master, replica)
+
+	// A replica further behind than the backlog gets a full resync.
+	r = replica.replica.Load()
+	r.mu.Lock()
+	r.conn.Close()
+	r.mu.Unlock()
+	master.Set("big", strings.Repeat("x", 2048), 0)
+	<-psyncs
+	waitFor(t, "full resync", func() bool { return replica.ReplicationOffset() == master.ReplicationOffset() })
+	sameData(t, master, replica)
+}
+
+func TestWaitReplicasTimesOut(t *testing.T) {
+	c := &BoltCache{Data: NewShardedMap()}
+	err := c.StartReplication(config.ReplicationConfig{Mode: "sync", Role: "master", Replicas: []string{"r1"}, SyncTimeout: 20 * time.Millisecond})
+	if err != nil {
+		t.Fatal(err)
+	}
+	c.Set("k", "v", 0)
+	if c.WaitReplicas(c.ReplicationOffset()) {
+		t.Fatal("write acknowledged without replicas")
+	}
+	if n := c.ReplicationInfo().SyncTimeouts; n != 1 {
+		t.Fatalf("%d sync timeouts", n)
+	}
+
+	// The snapshot sent on a full sync is the dataset at its offset.
+	var buf bytes.Buffer
+	offset, err := c.sendFullSync(&buf, c.master.Load())
+	if err != nil || offset != c.ReplicationOffset() {
+		t.Fatalf("offset %d, %v", offset, err)
+	}
+	header, _ := buf.ReadString('\n')
+	if !strings.HasPrefix(header, "+FULLRESYNC "+c.master.Load().id) {
+		t.Fatalf("header %q", header)
+	}
+	replica := &BoltCache{Data: NewShardedMap()}
+	if _, err := replica.loadFullSync(bufio.NewReader(&buf)); err != nil {
+		t.Fatal(err)
+	}
+	sameData(t, c, replica)
+}
+
+// lockProbe records whether c.Mu could be taken while the snapshot was
+// written to it.
+type lockProbe struct {
+	bytes.Buffer
+	c      *BoltCache
+	locked bool
+}
+
+func (p *lockProbe) Write(b []byte) (int, error) {
+	if p.c.Mu.TryLock() {
+		p.c.Mu.Unlock()
+	} else {
+		p.locked = true
+	}
+	return p.Buffer.Write(b)
+}
+
+func TestFullSyncReleasesMu(t *testing.T) {
+	c := &BoltCache{Data: NewShardedMap()}
+	if err := c.StartReplication(config.ReplicationConfig{Role: "master"}); err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 1000; i++ {
+		c.Set("s"+strconv.Itoa(i), strings.Repeat("v", 100), 0)
+		c.LPush("l"+strconv.Itoa(i), "a", "b")
+		c.HSet("h"+strconv.Itoa(i), "f", "v")
+	}
+
+	p := &lockProbe{c: c}
+	if _, err := c.sendFullSync(p, c.master.Load()); err != nil {
+		t.Fatal(err)
+	}
+	if p.locked {
+		t.Fatal("snapshot written while holding Mu")
+	}
+	p.ReadString('\n')
+	replica := &BoltCache{Data: NewShardedMap()}
+	if _, err := replica.loadFullSync(bufio.NewReader(&p.Buffer)); err != nil {
+		t.Fatal(err)
+	}
+	sameData(t, c, replica)
+	if p.Len() != 0 {
+		t.Fatalf("%d bytes left after the snapshot", p.Len())
+	}
+}
+
+func TestPromoteAndFollow(t *testing.T) {
+	master := &BoltCache{Data: NewShardedMap()}
+	if err := master.StartReplication(config.ReplicationConfig{Role: "master"}); err != nil {
+		t.Fatal(err)
+	}
+	master.Set("k", "1", 0)
+	addr, psyncs := serveMaster(t, master)
+	replicas := make([]*BoltCache, 2)
+	for i := range replicas {
+		replicas[i] = &BoltCache{Data: NewShardedMap()}
+		if err := replicas[i].StartReplication(config.ReplicationConfig{Role: "replica", Master: addr}); err != nil {
+			t.Fatal(err)
+		}
+		<-psyncs
+	}
+	waitFor(t, "sync", func() bool {
+		return replicas[0].ReplicationOffset() == master.ReplicationOffset() && replicas[1].ReplicationOffset() == master.ReplicationOffset()
+	})
+	oldID := master.ReplicationInfo().ReplID
+
+	// The sibling continues from the promoted replica's history.
+	promoted, sibling := replicas[0], replicas[1]
+	if err := promoted.Promote(); err != nil || promoted.IsReplica() {
+		t.Fatalf("promote: %v", err)
+	}
+	newAddr, newPsyncs := serveMaster(t, promoted)
+	sibling.Follow(newAddr)
+	if args := <-newPsyncs; args[1] != oldID {
+		t.Fatalf("sibling sent %v", args)
+	}
+	promoted.Set("k", "2", 0)
+	waitFor(t, "partial resync", func() bool {
+		info := sibling.ReplicationInfo()
+		return info.LinkUp && info.ReplID == promoted.ReplicationInfo().ReplID && sibling.ReplicationOffset() == promoted.ReplicationOffset()
+	})
+	sameData(t, promoted, sibling)
+
+	// Writes the old master took after the promotion are discarded when
+	// it follows the new master.
+	master.Set("lost", "x", 0)
+	master.Follow(newAddr)
+	if !master.IsReplica() {
+		t.Fatal("old master still a master")
+	}
+	<-newPsyncs
+	waitFor(t, "full resync", func() bool {
+		return master.ReplicationOffset() == promoted.ReplicationOffset() && master.ReplicationInfo().LinkUp
+	})
+	sameData(t, promoted, master)
+}
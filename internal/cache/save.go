@@ -0,0 +1,208 @@
+package cache
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+import (
+	logger "boltcache/logger"
+)
+
+var (
+	ErrNoPersistFile     = errors.New("ERR no persistence file configured")
+	ErrSaveInProgress    = errors.New("ERR Background save already in progress")
+	ErrBackupNotFound    = errors.New("ERR no such backup")
+	ErrRestoreInProgress = errors.New("ERR restore already in progress")
+)
+
+// saveState tracks SAVE, BGSAVE and the periodic saves.
+type saveState struct {
+	mu         sync.Mutex // one save at a time
+	background atomic.Bool
+	restoring  atomic.Bool
+	lastSave   atomic.Int64 // unix seconds of the last successful save
+	lastFailed atomic.Bool
+}
+
+// SaveStats describes the persistence file saves.
+type SaveStats struct {
+	InProgress bool
+	LastSave   time.Time
+	LastSaveOK bool
+}
+
+func (c *BoltCache) persistFile() string {
+	if c.Config != nil && c.Config.Persistence.File != "" {
+		return c.Config.Persistence.File
+	}
+	return c.PersistFile
+}
+
+// Save writes the dataset to the persistence file, backing up the previous
+// file first when backup_count is set. It works whether or not periodic
+// persistence is enabled.
+func (c *BoltCache) Save() error {
+	file := c.persistFile()
+	if file == "" {
+		return ErrNoPersistFile
+	}
+
+	c.saves.mu.Lock()
+	defer c.saves.mu.Unlock()
+
+	// A failed backup doesn't stop the save.
+	if c.Config != nil && c.Config.Persistence.BackupCount > 0 {
+		if _, err := c.CreateBackup(); err != nil && !os.IsNotExist(err) {
+			logger.Log("Failed to back up persistence file: %v", err)
+		}
+	}
+
+	if err := c.SaveSnapshot(file); err != nil {
+		c.saves.lastFailed.Store(true)
+		logger.Log("Failed to write persistence file: %v", err)
+		return err
+	}
+	c.saves.lastFailed.Store(false)
+	c.saves.lastSave.Store(time.Now().Unix())
+	return nil
+}
+
+// BackgroundSave starts a Save unless a background save is already running.
+func (c *BoltCache) BackgroundSave() error {
+	if c.persistFile() == "" {
+		return ErrNoPersistFile
+	}
+	if !c.saves.background.CompareAndSwap(false, true) {
+		return ErrSaveInProgress
+	}
+	go func() {
+		defer c.saves.background.Store(false)
+		start := time.Now()
+		if err := c.Save(); err == nil {
+			logger.Log("Background save done in %v", time.Since(start).Round(time.Millisecond))
+		}
+	}()
+	return nil
+}
+
+// LastSave returns the time of the last successful save, or the zero time
+// when nothing has been saved since startup.
+func (c *BoltCache) LastSave() time.Time {
+	if s := c.saves.lastSave.Load(); s != 0 {
+		return time.Unix(s, 0)
+	}
+	return time.Time{}
+}
+
+// SaveStats returns the state of the persistence file saves.
+func (c *BoltCache) SaveStats() SaveStats {
+	return SaveStats{
+		InProgress: c.saves.background.Load(),
+		LastSave:   c.LastSave(),
+		LastSaveOK: !c.saves.lastFailed.Load(),
+	}
+}
+
+// BackupInfo describes a backup of the persistence file.
+type BackupInfo struct {
+	Name    string    `json:"name"`
+	Size    int64     `json:"size"`
+	ModTime time.Time `json:"mod_time"`
+}
+
+// Backups lists the backups of the persistence file, newest first.
+func (c *BoltCache) Backups() []BackupInfo {
+	file := c.persistFile()
+	if file == "" {
+		return nil
+	}
+	backups := []BackupInfo{}
+	for _, path := range listBackups(file) {
+		info, err := os.Stat(path)
+		if err != nil {
+			continue
+		}
+		backups = append(backups, BackupInfo{Name: filepath.Base(path), Size: info.Size(), ModTime: info.ModTime()})
+	}
+	return backups
+}
+
+// RestoreBackup replaces the dataset with the contents of the named backup
+// and returns the number of keys loaded. Only backups listed by Backups can
+// be restored. The backup is verified before anything is changed, and the
+// swap is reported to write hooks, so the append-only file follows it.
+//
+// Collection writes wait while the data is swapped; string writes racing
+// with the restore may land before or after it. Callers that need the
+// restore atomic hold TxMu exclusively.
+func (c *BoltCache) RestoreBackup(name string) (int, error) {
+	file := c.persistFile()
+	if file == "" {
+		return 0, ErrNoPersistFile
+	}
+	if name == "" || strings.ContainsAny(name, `/\`) || !strings.HasPrefix(name, filepath.Base(file)+".backup.") {
+		return 0, ErrBackupNotFound
+	}
+	path := filepath.Join(filepath.Dir(file), name)
+	found := false
+	for _, b := range listBackups(file) {
+		found = found || b == path
+	}
+	if !found {
+		return 0, ErrBackupNotFound
+	}
+
+	if !c.saves.restoring.CompareAndSwap(false, true) {
+		return 0, ErrRestoreInProgress
+	}
+	defer c.saves.restoring.Store(false)
+
+	items, err := readPersistFile(path)
+	if err != nil {
+		return 0, fmt.Errorf("ERR backup %s is damaged: %v", name, err)
+	}
+
+	c.replaceDataset(items)
+	logger.Log("Restored %d keys from backup %s", len(items), name)
+	return len(items), nil
+}
+
+// replaceDataset makes items the whole dataset and reports the change to
+// write hooks.
+func (c *BoltCache) replaceDataset(items map[string]*CacheItem) {
+	c.replaceKeys(items, nil)
+}
+
+// replaceKeys is replaceDataset for the keys match accepts, all of them
+// when it is nil.
+func (c *BoltCache) replaceKeys(items map[string]*CacheItem, match func(string) bool) {
+	c.Mu.Lock()
+	defer c.Mu.Unlock()
+
+	var stale []string
+	c.Data.Range(func(key, _ interface{}) bool {
+		if match != nil && !match(key.(string)) {
+			return true
+		}
+		if _, ok := items[key.(string)]; !ok {
+			stale = append(stale, key.(string))
+		}
+		return true
+	})
+	for _, key := range stale {
+		c.delete(key, true)
+	}
+	for key, item := range items {
+		c.Data.storeIf(key, item, func(*CacheItem) bool {
+			c.propagateSet(key, item)
+			return true
+		})
+	}
+}
@@ -0,0 +1,71 @@
+package cache
+
+import (
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestSaveAndLastSave(t *testing.T) {
+	c := newPersistCache(t.TempDir())
+	c.Config.Persistence.Enabled = false
+	if !c.LastSave().IsZero() {
+		t.Fatal("LastSave set before any save")
+	}
+
+	// SAVE works without periodic persistence.
+	c.Set("k", "v", 0)
+	if err := c.Save(); err != nil {
+		t.Fatal(err)
+	}
+	if time.Since(c.LastSave()) > time.Minute {
+		t.Fatalf("LastSave = %v", c.LastSave())
+	}
+
+	if err := c.BackgroundSave(); err != nil {
+		t.Fatal(err)
+	}
+	for c.SaveStats().InProgress {
+		time.Sleep(time.Millisecond)
+	}
+	if n := len(c.Backups()); n != 1 {
+		t.Fatalf("got %d backups, want 1", n)
+	}
+}
+
+func TestRestoreBackup(t *testing.T) {
+	c := newPersistCache(t.TempDir())
+	c.Set("a", "1", 0)
+	c.LPush("l", "x")
+	c.Save()
+	c.Set("a", "2", 0)
+	c.Set("b", "new", 0)
+	c.Save()
+
+	var logged [][]string
+	c.AddWriteHook(func(args []string) { logged = append(logged, args) })
+
+	backups := c.Backups()
+	if len(backups) != 1 {
+		t.Fatalf("got %d backups, want 1", len(backups))
+	}
+	n, err := c.RestoreBackup(backups[0].Name)
+	if err != nil || n != 2 {
+		t.Fatalf("restore: %d, %v", n, err)
+	}
+	if v, _ := c.Get("a"); v != "1" {
+		t.Fatalf("a = %v", v)
+	}
+	if _, ok := c.Get("b"); ok {
+		t.Fatal("key missing from the backup survived the restore")
+	}
+	if len(logged) != 3 {
+		t.Fatalf("restore reported %d writes, want 3: %q", len(logged), logged)
+	}
+
+	for _, name := range []string{"", "cache.json", "../cache.json.backup.x", filepath.Base(c.PersistFile) + ".backup.missing"} {
+		if _, err := c.RestoreBackup(name); err != ErrBackupNotFound {
+			t.Errorf("%q: got %v", name, err)
+		}
+	}
+}
@@ -2,6 +2,8 @@ package cache
 
 
 // Set operations
+
+// SAdd adds members to the set at key and returns how many were new.
 func (c *BoltCache) SAdd(key string, members ...string) int {
 	c.Mu.Lock()
 	defer c.Mu.Unlock()
@@ -21,8 +23,44 @@ func (c *BoltCache) SAdd(key string, members ...string) int {
 		}
 	}
 
-	c.Set(key, set, 0)
-	return len(set)
+	c.put(key, set)
+	c.propagate(append([]string{"SADD", key}, members...)...)
+	return added
+}
+
+// SRem removes members from the set at key and returns how many were
+// there. The key is deleted when the set becomes empty.
+func (c *BoltCache) SRem(key string, members ...string) int {
+	c.Mu.Lock()
+	defer c.Mu.Unlock()
+
+	val, ok := c.Get(key)
+	if !ok {
+		return 0
+	}
+	set, ok := val.(map[string]struct{})
+	if !ok {
+		return 0
+	}
+
+	removed := 0
+	for _, m := range members {
+		if _, ok := set[m]; ok {
+			delete(set, m)
+			removed++
+		}
+	}
+	if removed == 0 {
+		return 0
+	}
+
+	if len(set) == 0 {
+		c.delete(key, false)
+	} else {
+		c.put(key, set)
+	}
+	c.propagate(append([]string{"SREM", key}, members...)...)
+	return removed
 }
 
 func (c *BoltCache) SMembers(key string) []string {
@@ -2,17 +2,44 @@ package cache
 
 import (
 	"sync"
+	"sync/atomic"
+	"time"
 )
 
 const ShardCount = 2048
 
 type Shard struct {
-	mu    sync.RWMutex
-	items map[string]interface{}
+	mu       sync.RWMutex
+	items    map[string]*CacheItem
+	memory   int64      // accounted bytes of the items in this shard, guarded by mu
+	expiries expiryHeap // keys with a TTL ordered by deadline, guarded by mu
+
+	// Merkle leaf hashes of the shard once a tree was built, and the
+	// leaves written since, guarded by mu; see merkle.go.
+	merkle      *shardMerkle
+	merkleDirty uint16
 }
 
 type ShardedMap struct {
 	shards []*Shard
+
+	// Totals across all shards, kept with atomics so INFO and the
+	// evictor never have to walk 2048 locks.
+	memory  int64
+	keys    int64
+	expired uint64
+
+	// version is the last version handed out to a write; every stored
+	// item gets a fresh one so WATCH can detect modifications.
+	version uint64
+
+	evictor *evictor
+
+	// slots indexes the keys by cluster hash slot once IndexSlots is
+	// called.
+	slots atomic.Pointer[slotIndex]
+
+	merkleMu sync.Mutex // serializes building Merkle trees
 }
 
 func NewShardedMap() *ShardedMap {
@@ -21,41 +48,159 @@ func NewShardedMap() *ShardedMap {
 	}
 	for i := 0; i < ShardCount; i++ {
 		sm.shards[i] = &Shard{
-			items: make(map[string]interface{}, 1024),
+			items: make(map[string]*CacheItem, 1024),
 		}
 	}
 	return sm
 }
 
 func (sm *ShardedMap) getShard(key string) *Shard {
+	return sm.shards[keyHash(key)&(ShardCount-1)]
+}
+
+// keyHash is the FNV-1a hash of key, whose low bits pick its shard.
+func keyHash(key string) uint32 {
 	var h uint32 = 2166136261
 	for i := 0; i < len(key); i++ {
 		h ^= uint32(key[i])
 		h *= 16777619
 	}
-	return sm.shards[h&(ShardCount-1)]
+	return h
 }
 
-func (sm *ShardedMap) Load(key string) (interface{}, bool) {
+func (sm *ShardedMap) Load(key string) (*CacheItem, bool) {
 	shard := sm.getShard(key)
 	shard.mu.RLock()
-	val, ok := shard.items[key]
+	item, ok := shard.items[key]
 	shard.mu.RUnlock()
-	return val, ok
+	if ok && sm.evictor != nil {
+		sm.evictor.touch(item)
+	}
+	return item, ok
+}
+
+func (sm *ShardedMap) Store(key string, item *CacheItem) {
+	sm.storeIf(key, item, nil)
 }
 
-func (sm *ShardedMap) Store(key string, value interface{}) {
+// storeIf stores item unless cond, evaluated under the shard lock with the
+// current item (nil when absent), returns false.
+func (sm *ShardedMap) storeIf(key string, item *CacheItem, cond func(old *CacheItem) bool) bool {
 	shard := sm.getShard(key)
 	shard.mu.Lock()
-	shard.items[key] = value
+	old := shard.items[key]
+	if cond != nil && !cond(old) {
+		shard.mu.Unlock()
+		return false
+	}
+	delta := sm.storeLocked(shard, key, item, old)
 	shard.mu.Unlock()
+	sm.stored(key, delta, old == nil)
+	return true
 }
 
-func (sm *ShardedMap) Delete(key string) {
+// compute replaces the item under key with the one fn returns, or deletes
+// the key when fn returns nil. fn runs under the shard lock with the
+// current item, nil when absent, and returns false to leave it.
+func (sm *ShardedMap) compute(key string, fn func(old *CacheItem) (*CacheItem, bool)) {
 	shard := sm.getShard(key)
 	shard.mu.Lock()
-	delete(shard.items, key)
+	old := shard.items[key]
+	item, ok := fn(old)
+	switch {
+	case !ok:
+		shard.mu.Unlock()
+	case item == nil:
+		if old != nil {
+			sm.removeLocked(shard, key, old)
+		}
+		shard.mu.Unlock()
+	default:
+		delta := sm.storeLocked(shard, key, item, old)
+		shard.mu.Unlock()
+		sm.stored(key, delta, old == nil)
+	}
+}
+
+// storeLocked puts item in place of old, nil when absent, and returns the
+// change of the shard's memory. The caller must hold shard.mu for writing.
+func (sm *ShardedMap) storeLocked(shard *Shard, key string, item, old *CacheItem) int64 {
+	item.size = itemSize(key, item.Value)
+	item.lastAccess = nowNano()
+	item.version = atomic.AddUint64(&sm.version, 1)
+	delta := item.size
+	if old != nil {
+		delta -= old.size
+		// Rewrites of the same key (LPUSH, HSET, ...) keep their access
+		// frequency, decayed up to now since lastAccess starts over.
+		item.hits = atomic.LoadUint32(&old.hits)
+		if sm.evictor != nil {
+			item.hits = sm.evictor.frequency(old, item.lastAccess)
+		}
+	}
+	shard.items[key] = item
+	shard.memory += delta
+	shard.changed(key)
+	if !item.ExpiresAt.IsZero() {
+		shard.trackExpiry(key, item.ExpiresAt)
+	}
+	if ix := sm.slots.Load(); ix != nil && old == nil {
+		ix.add(key)
+	}
+	return delta
+}
+
+// stored updates the totals after a store and makes room for it.
+func (sm *ShardedMap) stored(key string, delta int64, added bool) {
+	atomic.AddInt64(&sm.memory, delta)
+	if added {
+		atomic.AddInt64(&sm.keys, 1)
+	}
+
+	if sm.evictor != nil {
+		sm.evictor.makeRoom(sm, key)
+	}
+}
+
+// Delete removes key and reports whether it was present.
+func (sm *ShardedMap) Delete(key string) bool {
+	return sm.deleteItem(key, nil)
+}
+
+// deleteItem removes key. When expected is non-nil the key is only removed
+// if it still maps to that exact item, so a concurrent overwrite survives.
+func (sm *ShardedMap) deleteItem(key string, expected *CacheItem) bool {
+	return sm.deleteIf(key, func(old *CacheItem) bool {
+		return expected == nil || old == expected
+	})
+}
+
+// deleteIf removes key unless cond, evaluated under the shard lock with the
+// current item, returns false.
+func (sm *ShardedMap) deleteIf(key string, cond func(old *CacheItem) bool) bool {
+	shard := sm.getShard(key)
+	shard.mu.Lock()
+	old, exists := shard.items[key]
+	if !exists || !cond(old) {
+		shard.mu.Unlock()
+		return false
+	}
+	sm.removeLocked(shard, key, old)
 	shard.mu.Unlock()
+	return true
+}
+
+// removeLocked drops key from shard and updates the totals.
+// The caller must hold shard.mu for writing.
+func (sm *ShardedMap) removeLocked(shard *Shard, key string, old *CacheItem) {
+	delete(shard.items, key)
+	shard.changed(key)
+	if ix := sm.slots.Load(); ix != nil {
+		ix.remove(key)
+	}
+	shard.memory -= old.size
+	atomic.AddInt64(&sm.memory, -old.size)
+	atomic.AddInt64(&sm.keys, -1)
 }
 
 func (sm *ShardedMap) Range(f func(key, value interface{}) bool) {
@@ -71,12 +216,44 @@ func (sm *ShardedMap) Range(f func(key, value interface{}) bool) {
 	}
 }
 
-func (sm *ShardedMap) Len() int {
-	total := 0
+// rangeShards calls f with the keys and items of one shard at a time. The
+// shard is not locked while f runs.
+func (sm *ShardedMap) rangeShards(f func(keys []string, items []*CacheItem) bool) {
+	var keys []string
+	var items []*CacheItem
 	for _, shard := range sm.shards {
+		keys, items = keys[:0], items[:0]
 		shard.mu.RLock()
-		total += len(shard.items)
+		for k, v := range shard.items {
+			keys = append(keys, k)
+			items = append(items, v)
+		}
 		shard.mu.RUnlock()
+		if len(keys) > 0 && !f(keys, items) {
+			return
+		}
 	}
-	return total
+}
+
+// Version returns the version of the item stored under key, or 0 when the
+// key is missing or expired. Any write to the key changes its version.
+func (sm *ShardedMap) Version(key string) uint64 {
+	shard := sm.getShard(key)
+	shard.mu.RLock()
+	defer shard.mu.RUnlock()
+
+	item, ok := shard.items[key]
+	if !ok || item.expired(time.Now()) {
+		return 0
+	}
+	return item.version
+}
+
+func (sm *ShardedMap) Len() int {
+	return int(atomic.LoadInt64(&sm.keys))
+}
+
+// UsedMemory returns the estimated number of bytes held by all items.
+func (sm *ShardedMap) UsedMemory() int64 {
+	return atomic.LoadInt64(&sm.memory)
 }
@@ -0,0 +1,116 @@
+package cache
+
+import (
+	"sync"
+)
+
+import (
+	cluster "boltcache/internal/cluster"
+)
+
+// slotLocks is the number of locks striped over the slot sets.
+const slotLocks = 256
+
+// slotIndex holds the keys of every cluster hash slot, so the keys of a
+// slot being migrated can be listed without walking the whole map. It is
+// updated under the shard lock of the key, and the slot locks are always
+// taken after it.
+type slotIndex struct {
+	locks [slotLocks]sync.Mutex
+	keys  [cluster.SlotCount]map[string]struct{}
+}
+
+func (ix *slotIndex) add(key string) {
+	slot := cluster.KeySlot([]byte(key))
+	mu := &ix.locks[slot&(slotLocks-1)]
+	mu.Lock()
+	if ix.keys[slot] == nil {
+		ix.keys[slot] = make(map[string]struct{})
+	}
+	ix.keys[slot][key] = struct{}{}
+	mu.Unlock()
+}
+
+func (ix *slotIndex) remove(key string) {
+	slot := cluster.KeySlot([]byte(key))
+	mu := &ix.locks[slot&(slotLocks-1)]
+	mu.Lock()
+	delete(ix.keys[slot], key)
+	if len(ix.keys[slot]) == 0 {
+		ix.keys[slot] = nil
+	}
+	mu.Unlock()
+}
+
+// IndexSlots starts tracking the cluster hash slot of every key, including
+// those already stored. Without it KeysInSlot and CountKeysInSlot walk the
+// whole map.
+func (sm *ShardedMap) IndexSlots() {
+	ix := &slotIndex{}
+	if !sm.slots.CompareAndSwap(nil, ix) {
+		return
+	}
+	// Writes from now on maintain the index; holding the shard lock keeps
+	// those racing with the backfill consistent.
+	for _, shard := range sm.shards {
+		shard.mu.RLock()
+		for key := range shard.items {
+			ix.add(key)
+		}
+		shard.mu.RUnlock()
+	}
+}
+
+// KeysInSlot returns up to count keys of the hash slot.
+func (sm *ShardedMap) KeysInSlot(slot, count int) []string {
+	keys := []string{}
+	if count <= 0 {
+		return keys
+	}
+	if ix := sm.slots.Load(); ix != nil {
+		mu := &ix.locks[slot&(slotLocks-1)]
+		mu.Lock()
+		defer mu.Unlock()
+		for key := range ix.keys[slot] {
+			if len(keys) == count {
+				break
+			}
+			keys = append(keys, key)
+		}
+		return keys
+	}
+
+	sm.rangeShards(func(shardKeys []string, _ []*CacheItem) bool {
+		for _, key := range shardKeys {
+			if cluster.KeySlot([]byte(key)) == slot {
+				keys = append(keys, key)
+				if len(keys) == count {
+					return false
+				}
+			}
+		}
+		return true
+	})
+	return keys
+}
+
+// CountKeysInSlot returns the number of keys in the hash slot.
+func (sm *ShardedMap) CountKeysInSlot(slot int) int {
+	if ix := sm.slots.Load(); ix != nil {
+		mu := &ix.locks[slot&(slotLocks-1)]
+		mu.Lock()
+		defer mu.Unlock()
+		return len(ix.keys[slot])
+	}
+
+	n := 0
+	sm.rangeShards(func(keys []string, _ []*CacheItem) bool {
+		for _, key := range keys {
+			if cluster.KeySlot([]byte(key)) == slot {
+				n++
+			}
+		}
+		return true
+	})
+	return n
+}
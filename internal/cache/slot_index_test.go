@@ -0,0 +1,77 @@
+package cache
+
+import (
+	"sort"
+	"testing"
+	"time"
+)
+
+func TestSlotIndex(t *testing.T) {
+	c := &BoltCache{Data: NewShardedMap()}
+	// {user} hashes to slot 5474.
+	c.Set("{user}a", "1", 0)
+	c.Set("other", "x", 0)
+
+	// Without the index the keys are found by walking the map.
+	if keys := c.Data.KeysInSlot(5474, 10); len(keys) != 1 || keys[0] != "{user}a" {
+		t.Fatalf("keys %v", keys)
+	}
+
+	c.Data.IndexSlots()
+	c.Set("{user}b", "2", 0)
+	c.Set("{user}b", "3", 0)
+	c.LPush("{user}c", "x")
+	c.Set("{user}d", "4", 0)
+	c.Delete("{user}d")
+
+	keys := c.Data.KeysInSlot(5474, 10)
+	sort.Strings(keys)
+	if len(keys) != 3 || keys[0] != "{user}a" || keys[2] != "{user}c" {
+		t.Fatalf("keys %v", keys)
+	}
+	if n := c.Data.CountKeysInSlot(5474); n != 3 {
+		t.Fatalf("count %d", n)
+	}
+	if keys := c.Data.KeysInSlot(5474, 2); len(keys) != 2 {
+		t.Fatalf("limited keys %v", keys)
+	}
+	if n := c.Data.CountKeysInSlot(0); n != 0 {
+		t.Fatalf("count of an empty slot %d", n)
+	}
+}
+
+func TestDumpRestore(t *testing.T) {
+	c := &BoltCache{Data: NewShardedMap()}
+	c.HSet("h", "f", "v")
+	c.Expire("h", time.Minute)
+
+	d, err := c.Dump("h")
+	if err != nil || d == nil || d.ExpiresAt.IsZero() {
+		t.Fatalf("dump %+v, %v", d, err)
+	}
+	if err := c.Restore("h", d.Payload, d.ExpiresAt, false); err != ErrBusyKey {
+		t.Fatalf("restore over an existing key: %v", err)
+	}
+	if err := c.Restore("h2", d.Payload, d.ExpiresAt, false); err != nil {
+		t.Fatal(err)
+	}
+	if v, ok := c.Get("h2"); !ok || v.(map[string]string)["f"] != "v" || c.TTL("h2") <= 0 {
+		t.Fatalf("restored %v", v)
+	}
+	if err := c.Restore("h3", []byte("garbage"), time.Time{}, false); err != ErrBadDumpData {
+		t.Fatalf("bad payload: %v", err)
+	}
+
+	// A key written after the dump is not deleted with it.
+	c.HSet("h", "f", "w")
+	if c.DeleteDumped(d) {
+		t.Fatal("deleted a key written after the dump")
+	}
+	d, _ = c.Dump("h")
+	if !c.DeleteDumped(d) {
+		t.Fatal("dumped key not deleted")
+	}
+	if d, _ := c.Dump("h"); d != nil {
+		t.Fatalf("dump of a missing key %+v", d)
+	}
+}
@@ -0,0 +1,678 @@
+package cache
+
+import (
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash"
+	"hash/crc32"
+	"io"
+	"math"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/klauspost/compress/zstd"
+)
+
+import (
+	logger "boltcache/logger"
+)
+
+// Binary snapshot format, version 1:
+//
+//	header   "BOLTSN" version:u8 compression:u8      (never compressed)
+//	body     record* 0x00 count:uvarint checksum:u32  (optionally compressed)
+//	record   length:uvarint payload crc:u32
+//	payload  type:u8 key:bytes expires:varint value
+//
+// bytes are a uvarint length followed by the data; expires is the
+// expiration in Unix milliseconds, 0 for none. crc is the CRC-32C of the
+// payload and checksum the CRC-32C of everything in the body before it.
+// Integers are little endian.
+const (
+	snapshotMagic   = "BOLTSN"
+	snapshotVersion = 1
+)
+
+// Compression codes stored in the snapshot header.
+const (
+	snapshotRaw  byte = 0
+	snapshotGzip byte = 1
+	snapshotZstd byte = 2
+)
+
+// Value type codes of snapshot records.
+var snapshotTypes = []string{TypeString, TypeBytes, TypeList, TypeSet, TypeHash, TypeZSet, TypeStream, TypeJSON}
+
+var (
+	ErrSnapshotFormat   = errors.New("not a boltcache snapshot")
+	ErrSnapshotChecksum = errors.New("snapshot checksum mismatch")
+)
+
+var crc32c = crc32.MakeTable(crc32.Castagnoli)
+
+// isSnapshot reports whether data starts with a snapshot header.
+func isSnapshot(data []byte) bool {
+	return bytes.HasPrefix(data, []byte(snapshotMagic))
+}
+
+// snapshotCompression returns the compression code configured by
+// persistence.compression and persistence.compression_algorithm.
+func (c *BoltCache) snapshotCompression() byte {
+	if c.Config == nil || !c.Config.Persistence.Compression {
+		return snapshotRaw
+	}
+	if strings.EqualFold(c.Config.Persistence.CompressionAlgorithm, "gzip") {
+		return snapshotGzip
+	}
+	return snapshotZstd
+}
+
+// SaveSnapshot writes the dataset to path in the binary snapshot format.
+// The file is replaced atomically, so a crash leaves the old one intact.
+func (c *BoltCache) SaveSnapshot(path string) error {
+	return writeFileAtomic(path, func(w io.Writer) error {
+		return c.WriteSnapshot(w, c.snapshotCompression())
+	})
+}
+
+// WriteSnapshot streams the dataset to w. Records are encoded one shard at
+// a time, so a save needs little memory beyond the dataset itself. Every
+// key is captured consistently, but keys written during the save may be
+// captured before or after their write.
+func (c *BoltCache) WriteSnapshot(w io.Writer, compression byte) error {
+	return c.writeSnapshot(w, compression, nil)
+}
+
+// WriteSnapshotKeys writes the keys match accepts as a snapshot, with the
+// configured compression.
+func (c *BoltCache) WriteSnapshotKeys(w io.Writer, match func(key string) bool) error {
+	return c.writeSnapshot(w, c.snapshotCompression(), match)
+}
+
+// writeSnapshot is WriteSnapshot of the keys match accepts, all of them
+// when it is nil.
+func (c *BoltCache) writeSnapshot(w io.Writer, compression byte, match func(string) bool) error {
+	now := time.Now()
+	return encodeSnapshot(w, compression, func(sw *snapshotWriter) error {
+		var err error
+		c.Data.rangeShards(func(keys []string, items []*CacheItem) bool {
+			// Collections change in place under Mu.
+			c.Mu.RLock()
+			defer c.Mu.RUnlock()
+			for i, item := range items {
+				if item.expired(now) || match != nil && !match(keys[i]) {
+					continue
+				}
+				if err = sw.record(keys[i], item); err != nil {
+					break
+				}
+			}
+			return err == nil
+		})
+		return err
+	})
+}
+
+// encodeSnapshot writes the snapshot header, the records records writes
+// to sw and the trailer.
+func encodeSnapshot(w io.Writer, compression byte, records func(sw *snapshotWriter) error) error {
+	bw := bufio.NewWriterSize(w, 64*1024)
+	bw.WriteString(snapshotMagic)
+	bw.WriteByte(snapshotVersion)
+	bw.WriteByte(compression)
+
+	var body io.WriteCloser
+	switch compression {
+	case snapshotRaw:
+		body = nopCloser{bw}
+	case snapshotGzip:
+		body = gzip.NewWriter(bw)
+	case snapshotZstd:
+		zw, err := zstd.NewWriter(bw)
+		if err != nil {
+			return err
+		}
+		body = zw
+	default:
+		return fmt.Errorf("unknown snapshot compression %d", compression)
+	}
+
+	sw := &snapshotWriter{w: body, sum: crc32.New(crc32c)}
+	if err := records(sw); err != nil {
+		return err
+	}
+
+	if err := sw.finish(); err != nil {
+		return err
+	}
+	if err := body.Close(); err != nil {
+		return err
+	}
+	return bw.Flush()
+}
+
+// snapshotCapture is the dataset taken under Mu for a snapshot encoded
+// after Mu is released. String writes replace the item, so strings are
+// kept as they are; collections change in place and are encoded up front.
+type snapshotCapture struct {
+	keys     []string
+	items    []CacheItem
+	payloads [][]byte // nil for strings
+}
+
+// captureSnapshot captures the live keys. The caller holds Mu.
+func (c *BoltCache) captureSnapshot() (*snapshotCapture, error) {
+	sc := &snapshotCapture{}
+	now := time.Now()
+	var err error
+	c.Data.rangeShards(func(keys []string, items []*CacheItem) bool {
+		for i, item := range items {
+			if item.expired(now) {
+				continue
+			}
+			var captured CacheItem
+			var p []byte
+			switch item.Value.(type) {
+			case string, []byte:
+				captured = CacheItem{Value: item.Value, ExpiresAt: item.ExpiresAt}
+			default:
+				if p, err = appendSnapshotPayload(nil, keys[i], item); err != nil {
+					err = fmt.Errorf("%s: %v", keys[i], err)
+					return false
+				}
+			}
+			sc.keys = append(sc.keys, keys[i])
+			sc.items = append(sc.items, captured)
+			sc.payloads = append(sc.payloads, p)
+		}
+		return true
+	})
+	return sc, err
+}
+
+// write encodes the captured keys as a snapshot to w, releasing each
+// record once it is written.
+func (sc *snapshotCapture) write(w io.Writer, compression byte) error {
+	return encodeSnapshot(w, compression, func(sw *snapshotWriter) error {
+		for i, key := range sc.keys {
+			var err error
+			if p := sc.payloads[i]; p != nil {
+				err = sw.frame(p)
+			} else {
+				err = sw.record(key, &sc.items[i])
+			}
+			if err != nil {
+				return err
+			}
+			sc.items[i], sc.payloads[i] = CacheItem{}, nil
+		}
+		return nil
+	})
+}
+
+type nopCloser struct{ io.Writer }
+
+func (nopCloser) Close() error { return nil }
+
+// snapshotWriter frames records and keeps the body checksum.
+type snapshotWriter struct {
+	w       io.Writer
+	sum     hash.Hash32
+	count   uint64
+	payload []byte
+	buf     []byte
+}
+
+func (sw *snapshotWriter) write(p []byte) error {
+	sw.sum.Write(p)
+	_, err := sw.w.Write(p)
+	return err
+}
+
+func (sw *snapshotWriter) record(key string, item *CacheItem) error {
+	p, err := appendSnapshotPayload(sw.payload[:0], key, item)
+	if err != nil {
+		return fmt.Errorf("%s: %v", key, err)
+	}
+	sw.payload = p
+	return sw.frame(p)
+}
+
+// frame writes the record with payload p.
+func (sw *snapshotWriter) frame(p []byte) error {
+	f := binary.AppendUvarint(sw.buf[:0], uint64(len(p)))
+	f = append(f, p...)
+	f = binary.LittleEndian.AppendUint32(f, crc32.Checksum(p, crc32c))
+	sw.buf = f
+	sw.count++
+	return sw.write(f)
+}
+
+func (sw *snapshotWriter) finish() error {
+	trailer := binary.AppendUvarint([]byte{0}, sw.count)
+	if err := sw.write(trailer); err != nil {
+		return err
+	}
+	_, err := sw.w.Write(binary.LittleEndian.AppendUint32(nil, sw.sum.Sum32()))
+	return err
+}
+
+func appendBytes(b []byte, s string) []byte {
+	b = binary.AppendUvarint(b, uint64(len(s)))
+	return append(b, s...)
+}
+
+func appendSnapshotPayload(b []byte, key string, item *CacheItem) ([]byte, error) {
+	typ := TypeOf(item.Value)
+	code := 0
+	for i, t := range snapshotTypes {
+		if t == typ {
+			code = i
+		}
+	}
+	b = append(b, byte(code))
+	b = appendBytes(b, key)
+	var expires int64
+	if !item.ExpiresAt.IsZero() {
+		expires = item.ExpiresAt.UnixMilli()
+	}
+	b = binary.AppendVarint(b, expires)
+
+	switch v := item.Value.(type) {
+	case string:
+		b = append(b, v...)
+	case []byte:
+		b = append(b, v...)
+	case []string:
+		b = binary.AppendUvarint(b, uint64(len(v)))
+		for _, s := range v {
+			b = appendBytes(b, s)
+		}
+	case map[string]struct{}:
+		b = binary.AppendUvarint(b, uint64(len(v)))
+		for m := range v {
+			b = appendBytes(b, m)
+		}
+	case map[string]string:
+		b = binary.AppendUvarint(b, uint64(len(v)))
+		for f, val := range v {
+			b = appendBytes(b, f)
+			b = appendBytes(b, val)
+		}
+	case *SortedSet:
+		b = binary.AppendUvarint(b, uint64(v.Len()))
+		for x := v.list.byRank(1); x != nil; x = x.level[0].forward {
+			b = appendBytes(b, x.member)
+			b = binary.LittleEndian.AppendUint64(b, math.Float64bits(x.score))
+		}
+	default:
+		_, data, err := EncodeValue(v)
+		if err != nil {
+			return nil, err
+		}
+		b = append(b, data...)
+	}
+	return b, nil
+}
+
+// ReadSnapshot decodes a snapshot from r and calls fn for every record,
+// expired ones included. It stops at the first damaged record.
+func ReadSnapshot(r io.Reader, fn func(key string, item *CacheItem) error) error {
+	br := bufio.NewReaderSize(r, 64*1024)
+	header := make([]byte, len(snapshotMagic)+2)
+	if _, err := io.ReadFull(br, header); err != nil || !isSnapshot(header) {
+		return ErrSnapshotFormat
+	}
+	if v := header[len(snapshotMagic)]; v != snapshotVersion {
+		return fmt.Errorf("unsupported snapshot version %d", v)
+	}
+
+	var body io.Reader
+	switch compression := header[len(snapshotMagic)+1]; compression {
+	case snapshotRaw:
+		body = br
+	case snapshotGzip:
+		zr, err := gzip.NewReader(br)
+		if err != nil {
+			return err
+		}
+		defer zr.Close()
+		body = zr
+	case snapshotZstd:
+		zr, err := zstd.NewReader(br)
+		if err != nil {
+			return err
+		}
+		defer zr.Close()
+		body = zr
+	default:
+		return fmt.Errorf("unknown snapshot compression %d", compression)
+	}
+
+	sr := &summingReader{r: bufio.NewReaderSize(body, 64*1024), sum: crc32.New(crc32c)}
+	var count uint64
+	var payload []byte
+	for {
+		n, err := binary.ReadUvarint(sr)
+		if err != nil {
+			return truncated(err)
+		}
+		if n == 0 {
+			break
+		}
+		if n > math.MaxInt32 {
+			return fmt.Errorf("record %d: invalid length %d", count, n)
+		}
+
+		if size := int(n) + 4; size <= cap(payload) || size <= 1<<20 {
+			if cap(payload) < size {
+				payload = make([]byte, size)
+			}
+			payload = payload[:size]
+			if _, err := io.ReadFull(sr, payload); err != nil {
+				return truncated(err)
+			}
+		} else {
+			// Grow with the data actually read, so a bogus length can't
+			// allocate more than the file holds.
+			b, err := io.ReadAll(io.LimitReader(sr, int64(size)))
+			if err != nil {
+				return truncated(err)
+			}
+			if len(b) != size {
+				return truncated(io.ErrUnexpectedEOF)
+			}
+			payload = b
+		}
+		p := payload[:n]
+		if crc32.Checksum(p, crc32c) != binary.LittleEndian.Uint32(payload[n:]) {
+			return fmt.Errorf("record %d: %w", count, ErrSnapshotChecksum)
+		}
+
+		key, item, err := decodeSnapshotPayload(p)
+		if err != nil {
+			return fmt.Errorf("record %d: %v", count, err)
+		}
+		if err := fn(key, item); err != nil {
+			return err
+		}
+		count++
+	}
+
+	n, err := binary.ReadUvarint(sr)
+	if err != nil {
+		return truncated(err)
+	}
+	if n != count {
+		return fmt.Errorf("snapshot has %d records, trailer says %d", count, n)
+	}
+	want := sr.sum.Sum32()
+	checksum := make([]byte, 4)
+	if _, err := io.ReadFull(sr.r, checksum); err != nil {
+		return truncated(err)
+	}
+	if binary.LittleEndian.Uint32(checksum) != want {
+		return ErrSnapshotChecksum
+	}
+	return nil
+}
+
+// summingReader checksums the bytes consumed from r.
+type summingReader struct {
+	r   *bufio.Reader
+	sum hash.Hash32
+}
+
+func (s *summingReader) ReadByte() (byte, error) {
+	b, err := s.r.ReadByte()
+	if err == nil {
+		s.sum.Write([]byte{b})
+	}
+	return b, err
+}
+
+func (s *summingReader) Read(p []byte) (int, error) {
+	n, err := s.r.Read(p)
+	s.sum.Write(p[:n])
+	return n, err
+}
+
+func truncated(err error) error {
+	if err == io.EOF {
+		return io.ErrUnexpectedEOF
+	}
+	return err
+}
+
+// payloadReader decodes the fields of a record payload.
+type payloadReader struct {
+	b   []byte
+	err error
+}
+
+func (r *payloadReader) uvarint() uint64 {
+	v, n := binary.Uvarint(r.b)
+	if n <= 0 {
+		r.fail()
+		return 0
+	}
+	r.b = r.b[n:]
+	return v
+}
+
+func (r *payloadReader) varint() int64 {
+	v, n := binary.Varint(r.b)
+	if n <= 0 {
+		r.fail()
+		return 0
+	}
+	r.b = r.b[n:]
+	return v
+}
+
+func (r *payloadReader) bytes() string {
+	n := r.uvarint()
+	if r.err != nil || n > uint64(len(r.b)) {
+		r.fail()
+		return ""
+	}
+	s := string(r.b[:n])
+	r.b = r.b[n:]
+	return s
+}
+
+// count reads a collection length, which can't exceed the bytes left.
+func (r *payloadReader) count() int {
+	n := r.uvarint()
+	if n > uint64(len(r.b)) {
+		r.fail()
+		return 0
+	}
+	return int(n)
+}
+
+func (r *payloadReader) fail() {
+	if r.err == nil {
+		r.err = errors.New("malformed record")
+	}
+	r.b = nil
+}
+
+func decodeSnapshotPayload(p []byte) (string, *CacheItem, error) {
+	if len(p) == 0 || int(p[0]) >= len(snapshotTypes) {
+		return "", nil, errors.New("unknown value type")
+	}
+	typ := snapshotTypes[p[0]]
+	r := &payloadReader{b: p[1:]}
+	key := r.bytes()
+	item := &CacheItem{}
+	if ms := r.varint(); ms != 0 {
+		item.ExpiresAt = time.UnixMilli(ms)
+	}
+	if r.err != nil {
+		return "", nil, r.err
+	}
+
+	switch typ {
+	case TypeString:
+		item.Value = string(r.b)
+	case TypeBytes:
+		item.Value = append([]byte{}, r.b...)
+	case TypeList:
+		list := make([]string, r.count())
+		for i := range list {
+			list[i] = r.bytes()
+		}
+		item.Value = list
+	case TypeSet:
+		n := r.count()
+		set := make(map[string]struct{}, n)
+		for i := 0; i < n; i++ {
+			set[r.bytes()] = struct{}{}
+		}
+		item.Value = set
+	case TypeHash:
+		n := r.count()
+		hash := make(map[string]string, n)
+		for i := 0; i < n; i++ {
+			f := r.bytes()
+			hash[f] = r.bytes()
+		}
+		item.Value = hash
+	case TypeZSet:
+		n := r.count()
+		z := NewSortedSet()
+		for i := 0; i < n; i++ {
+			m := r.bytes()
+			if len(r.b) < 8 {
+				r.fail()
+				break
+			}
+			z.set(m, math.Float64frombits(binary.LittleEndian.Uint64(r.b)))
+			r.b = r.b[8:]
+		}
+		item.Value = z
+	default:
+		v, err := DecodeValue(typ, r.b)
+		if err != nil {
+			return "", nil, err
+		}
+		item.Value = v
+	}
+	if r.err != nil {
+		return "", nil, r.err
+	}
+	return key, item, nil
+}
+
+// ReplaceKeys makes the records of the snapshot read from r the keys
+// match accepts: other keys it accepts are deleted. A nil r deletes all of
+// them. It returns how many keys were loaded.
+func (c *BoltCache) ReplaceKeys(r io.Reader, match func(key string) bool) (int, error) {
+	items := make(map[string]*CacheItem)
+	if r != nil {
+		now := time.Now()
+		err := ReadSnapshot(r, func(key string, item *CacheItem) error {
+			if !item.expired(now) && match(key) {
+				items[key] = item
+			}
+			return nil
+		})
+		if err != nil {
+			return 0, err
+		}
+	}
+	c.replaceKeys(items, match)
+	return len(items), nil
+}
+
+// StartSnapshots writes a snapshot to snapshot.directory every
+// snapshot.interval and keeps the newest snapshot.keep of them.
+func (c *BoltCache) StartSnapshots() {
+	conf := c.Config.Persistence.Snapshot
+	if !conf.Enabled {
+		return
+	}
+	interval := conf.Interval
+	if interval <= 0 {
+		interval = 5 * time.Minute
+	}
+
+	go func() {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+
+		for range ticker.C {
+			c.TakeSnapshot()
+		}
+	}()
+}
+
+const snapshotPrefix = "snapshot-"
+
+// TakeSnapshot writes a timestamped snapshot to snapshot.directory and
+// returns its path.
+func (c *BoltCache) TakeSnapshot() (string, error) {
+	conf := c.Config.Persistence.Snapshot
+	dir := c.snapshotDir()
+	path := filepath.Join(dir, snapshotPrefix+time.Now().Format("20060102-150405.000")+".bcs")
+	start := time.Now()
+	if err := c.SaveSnapshot(path); err != nil {
+		logger.Log("Failed to write snapshot %s: %v", path, err)
+		return "", err
+	}
+	logger.Log("Snapshot %s written in %v", path, time.Since(start).Round(time.Millisecond))
+
+	if conf.Keep > 0 {
+		pruneSnapshots(dir, conf.Keep)
+	}
+	return path, nil
+}
+
+// pruneSnapshots removes all but the newest keep snapshots in dir.
+func pruneSnapshots(dir string, keep int) {
+	names := listSnapshots(dir)
+	for _, name := range names[min(keep, len(names)):] {
+		os.Remove(name)
+	}
+}
+
+// listSnapshots returns the snapshots in dir, newest first. The timestamp
+// in their names sorts chronologically.
+func listSnapshots(dir string) []string {
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return nil
+	}
+	var names []string
+	for _, e := range entries {
+		if strings.HasPrefix(e.Name(), snapshotPrefix) && strings.HasSuffix(e.Name(), ".bcs") {
+			names = append(names, filepath.Join(dir, e.Name()))
+		}
+	}
+	sort.Sort(sort.Reverse(sort.StringSlice(names)))
+	return names
+}
+
+// snapshotFiles returns the snapshots TakeSnapshot wrote, newest first, or
+// nil when snapshots are disabled.
+func (c *BoltCache) snapshotFiles() []string {
+	if c.Config == nil || !c.Config.Persistence.Snapshot.Enabled {
+		return nil
+	}
+	return listSnapshots(c.snapshotDir())
+}
+
+func (c *BoltCache) snapshotDir() string {
+	if dir := c.Config.Persistence.Snapshot.Directory; dir != "" {
+		return dir
+	}
+	return "./snapshots"
+}
@@ -0,0 +1,147 @@
+package cache
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"os"
+	"path/filepath"
+	"runtime"
+	"testing"
+	"time"
+)
+
+import (
+	config "boltcache/config"
+)
+
+func newSnapshotCache() *BoltCache {
+	c := &BoltCache{Data: NewShardedMap()}
+	c.Set("str", "hello", time.Hour)
+	c.Set("bytes", []byte{0, 1, 0xff}, 0)
+	c.Set("json", map[string]interface{}{"n": 1.5}, 0)
+	c.Set("empty", "", 0)
+	c.LPush("list", "a", "b")
+	c.SAdd("set", "x", "y")
+	c.HSet("hash", "f", "v")
+	c.ZAdd("zset", ZAddOptions{}, ZMember{"lo", math.Inf(-1)}, ZMember{"mid", 2.5}, ZMember{"hi", math.Inf(1)})
+	c.XAdd("stream", "1-1", []string{"f", "v"}, XAddOptions{})
+	c.XGroupCreate("stream", "g", "0", false)
+	c.XReadGroup("stream", "g", "alice", StreamID{}, true, 0, false)
+	for i := 0; i < 100; i++ {
+		c.Set(fmt.Sprintf("key:%d", i), "value", 0)
+	}
+	return c
+}
+
+func TestSnapshotRoundTrip(t *testing.T) {
+	c := newSnapshotCache()
+	for _, compression := range []byte{snapshotRaw, snapshotGzip, snapshotZstd} {
+		var buf bytes.Buffer
+		if err := c.WriteSnapshot(&buf, compression); err != nil {
+			t.Fatal(err)
+		}
+
+		c2 := &BoltCache{Data: NewShardedMap()}
+		err := ReadSnapshot(&buf, func(key string, item *CacheItem) error {
+			c2.Data.Store(key, item)
+			return nil
+		})
+		if err != nil {
+			t.Fatalf("compression %d: %v", compression, err)
+		}
+		sameData(t, c, c2)
+	}
+}
+
+func TestSnapshotCorruption(t *testing.T) {
+	var buf bytes.Buffer
+	if err := newSnapshotCache().WriteSnapshot(&buf, snapshotRaw); err != nil {
+		t.Fatal(err)
+	}
+	data := buf.Bytes()
+
+	damaged := append([]byte{}, data...)
+	damaged[len(damaged)/2] ^= 0xff
+	err := ReadSnapshot(bytes.NewReader(damaged), func(string, *CacheItem) error { return nil })
+	if err == nil {
+		t.Fatal("damaged snapshot loaded without error")
+	}
+
+	err = ReadSnapshot(bytes.NewReader(data[:len(data)-10]), func(string, *CacheItem) error { return nil })
+	if !errors.Is(err, io.ErrUnexpectedEOF) {
+		t.Fatalf("truncated snapshot: got %v", err)
+	}
+
+	last := append([]byte{}, data...)
+	last[len(last)-1] ^= 0xff
+	err = ReadSnapshot(bytes.NewReader(last), func(string, *CacheItem) error { return nil })
+	if !errors.Is(err, ErrSnapshotChecksum) {
+		t.Fatalf("bad checksum: got %v", err)
+	}
+
+	// A bogus record length allocates no more than the file holds.
+	bogus := append([]byte(snapshotMagic), snapshotVersion, snapshotRaw)
+	bogus = binary.AppendUvarint(bogus, math.MaxInt32)
+	bogus = append(bogus, "short"...)
+	var before, after runtime.MemStats
+	runtime.ReadMemStats(&before)
+	err = ReadSnapshot(bytes.NewReader(bogus), func(string, *CacheItem) error { return nil })
+	runtime.ReadMemStats(&after)
+	if !errors.Is(err, io.ErrUnexpectedEOF) {
+		t.Fatalf("bogus length: got %v", err)
+	}
+	if n := after.TotalAlloc - before.TotalAlloc; n > 16<<20 {
+		t.Fatalf("bogus length allocated %d bytes", n)
+	}
+}
+
+func TestLoadFromDiskDetectsFormat(t *testing.T) {
+	dir := t.TempDir()
+	cfg := &config.Config{}
+	cfg.Persistence.Enabled = true
+	cfg.Persistence.Compression = true
+	cfg.Persistence.CompressionAlgorithm = "zstd"
+	cfg.Persistence.File = filepath.Join(dir, "cache.json")
+
+	c := newSnapshotCache()
+	c.Config = cfg
+	c.ForcePersist()
+
+	data, err := os.ReadFile(cfg.Persistence.File)
+	if err != nil || !isSnapshot(data) {
+		t.Fatalf("persistence file is not a snapshot: %v", err)
+	}
+	c2 := &BoltCache{Data: NewShardedMap(), PersistFile: cfg.Persistence.File}
+	c2.LoadFromDisk()
+	sameData(t, c, c2)
+}
+
+func TestSnapshotRetention(t *testing.T) {
+	dir := t.TempDir()
+	cfg := &config.Config{}
+	cfg.Persistence.Snapshot = config.SnapshotConfig{Directory: dir, Keep: 2}
+
+	c := &BoltCache{Data: NewShardedMap(), Config: cfg}
+	c.Set("k", "v", 0)
+	var paths []string
+	for i := 0; i < 4; i++ {
+		path, err := c.TakeSnapshot()
+		if err != nil {
+			t.Fatal(err)
+		}
+		paths = append(paths, path)
+		time.Sleep(2 * time.Millisecond)
+	}
+
+	entries, _ := os.ReadDir(dir)
+	if len(entries) != 2 {
+		t.Fatalf("got %d snapshots, want 2", len(entries))
+	}
+	if _, err := os.Stat(paths[3]); err != nil {
+		t.Fatal("newest snapshot was removed")
+	}
+}
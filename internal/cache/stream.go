@@ -0,0 +1,885 @@
+package cache
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Stream operations
+
+var (
+	ErrInvalidStreamID  = errors.New("ERR Invalid stream ID specified as stream command argument")
+	ErrStreamIDTooSmall = errors.New("ERR The ID specified in XADD is equal or smaller than the target stream top item")
+	ErrStreamIDZero     = errors.New("ERR The ID specified in XADD must be greater than 0-0")
+	ErrBusyGroup        = errors.New("BUSYGROUP Consumer Group name already exists")
+	ErrNoStream         = errors.New("ERR The XGROUP subcommand requires the key to exist. Note that for CREATE you may want to use the MKSTREAM option to create an empty stream automatically.")
+)
+
+func noGroupError(key, group string) error {
+	return fmt.Errorf("NOGROUP No such key '%s' or consumer group '%s'", key, group)
+}
+
+// StreamID identifies a stream entry: a millisecond timestamp and a
+// sequence number for entries added in the same millisecond.
+type StreamID struct {
+	Ms  uint64
+	Seq uint64
+}
+
+// MaxStreamID is the largest possible ID, the "+" of range commands.
+var MaxStreamID = StreamID{math.MaxUint64, math.MaxUint64}
+
+// ParseStreamID parses "ms-seq", or "ms" with missingSeq as sequence.
+func ParseStreamID(s string, missingSeq uint64) (StreamID, error) {
+	msPart, seqPart, hasSeq := strings.Cut(s, "-")
+	ms, err := strconv.ParseUint(msPart, 10, 64)
+	if err != nil {
+		return StreamID{}, ErrInvalidStreamID
+	}
+	seq := missingSeq
+	if hasSeq {
+		if seq, err = strconv.ParseUint(seqPart, 10, 64); err != nil {
+			return StreamID{}, ErrInvalidStreamID
+		}
+	}
+	return StreamID{ms, seq}, nil
+}
+
+func (id StreamID) String() string {
+	return strconv.FormatUint(id.Ms, 10) + "-" + strconv.FormatUint(id.Seq, 10)
+}
+
+func (id StreamID) Less(other StreamID) bool {
+	return id.Ms < other.Ms || (id.Ms == other.Ms && id.Seq < other.Seq)
+}
+
+func (id StreamID) IsZero() bool {
+	return id == StreamID{}
+}
+
+// Next returns the smallest ID after id; ok is false for MaxStreamID.
+func (id StreamID) Next() (StreamID, bool) {
+	switch {
+	case id.Seq < math.MaxUint64:
+		return StreamID{id.Ms, id.Seq + 1}, true
+	case id.Ms < math.MaxUint64:
+		return StreamID{id.Ms + 1, 0}, true
+	}
+	return id, false
+}
+
+// Prev returns the largest ID before id; ok is false for 0-0.
+func (id StreamID) Prev() (StreamID, bool) {
+	switch {
+	case id.Seq > 0:
+		return StreamID{id.Ms, id.Seq - 1}, true
+	case id.Ms > 0:
+		return StreamID{id.Ms - 1, math.MaxUint64}, true
+	}
+	return id, false
+}
+
+func (id StreamID) MarshalText() ([]byte, error) {
+	return []byte(id.String()), nil
+}
+
+func (id *StreamID) UnmarshalText(b []byte) error {
+	parsed, err := ParseStreamID(string(b), 0)
+	*id = parsed
+	return err
+}
+
+// StreamEntry is one stream record. Fields alternates names and values
+// and is nil for a pending entry that was trimmed from the stream.
+type StreamEntry struct {
+	ID     StreamID `json:"id"`
+	Fields []string `json:"fields"`
+}
+
+// PendingEntry is an entry delivered to a consumer of a group and not
+// acknowledged yet.
+type PendingEntry struct {
+	ID          StreamID  `json:"id"`
+	Consumer    string    `json:"consumer"`
+	DeliveredAt time.Time `json:"delivered_at"`
+	Deliveries  int       `json:"deliveries"`
+}
+
+// ConsumerPending is the number of pending entries of one consumer.
+type ConsumerPending struct {
+	Consumer string
+	Count    int
+}
+
+// PendingSummary is the short form of XPENDING.
+type PendingSummary struct {
+	Count     int
+	Min, Max  StreamID
+	Consumers []ConsumerPending
+}
+
+type streamGroup struct {
+	lastDelivered StreamID
+	pending       map[StreamID]*PendingEntry
+	consumers     map[string]time.Time // name -> last seen
+}
+
+func newStreamGroup(lastDelivered StreamID) *streamGroup {
+	return &streamGroup{
+		lastDelivered: lastDelivered,
+		pending:       make(map[StreamID]*PendingEntry),
+		consumers:     make(map[string]time.Time),
+	}
+}
+
+// sortedPending returns the pending entries in ID order.
+func (g *streamGroup) sortedPending() []*PendingEntry {
+	out := make([]*PendingEntry, 0, len(g.pending))
+	for _, pe := range g.pending {
+		out = append(out, pe)
+	}
+	sort.Slice(out, func(i, j int) bool { return out[i].ID.Less(out[j].ID) })
+	return out
+}
+
+// Stream is an append-only log of entries with increasing IDs, plus the
+// consumer groups reading it. Entries are kept in a slice ordered by ID,
+// so range reads are a binary search and trimming drops a prefix.
+type Stream struct {
+	entries []StreamEntry
+	lastID  StreamID
+	added   uint64
+	groups  map[string]*streamGroup
+	bytes   int64
+}
+
+// Per-entry and per-group bookkeeping overhead used for memory accounting.
+const (
+	streamEntryOverhead = 48
+	streamGroupOverhead = 96
+	pendingOverhead     = 80
+)
+
+func NewStream() *Stream {
+	return &Stream{groups: make(map[string]*streamGroup)}
+}
+
+func (s *Stream) Len() int {
+	return len(s.entries)
+}
+
+// LastID returns the ID of the last entry ever added.
+func (s *Stream) LastID() StreamID {
+	return s.lastID
+}
+
+func entrySize(fields []string) int64 {
+	n := int64(streamEntryOverhead)
+	for _, f := range fields {
+		n += int64(len(f)) + 16
+	}
+	return n
+}
+
+func (s *Stream) memoryUsage() int64 {
+	n := 64 + s.bytes
+	for name, g := range s.groups {
+		n += streamGroupOverhead + int64(len(name)) + int64(len(g.pending))*pendingOverhead
+		for consumer := range g.consumers {
+			n += int64(len(consumer)) + 32
+		}
+	}
+	return n
+}
+
+// nextID resolves the ID argument of XADD: "*", "ms-*" or an explicit ID.
+func (s *Stream) nextID(spec string, now time.Time) (StreamID, error) {
+	if spec == "*" {
+		ms := uint64(now.UnixMilli())
+		if ms > s.lastID.Ms {
+			return StreamID{ms, 0}, nil
+		}
+		id, ok := s.lastID.Next()
+		if !ok {
+			return StreamID{}, ErrStreamIDTooSmall
+		}
+		return id, nil
+	}
+
+	if msPart, found := strings.CutSuffix(spec, "-*"); found {
+		ms, err := strconv.ParseUint(msPart, 10, 64)
+		if err != nil {
+			return StreamID{}, ErrInvalidStreamID
+		}
+		switch {
+		case ms < s.lastID.Ms:
+			return StreamID{}, ErrStreamIDTooSmall
+		case ms == s.lastID.Ms && !s.lastID.IsZero():
+			if s.lastID.Seq == math.MaxUint64 {
+				return StreamID{}, ErrStreamIDTooSmall
+			}
+			return StreamID{ms, s.lastID.Seq + 1}, nil
+		case ms == 0:
+			return StreamID{0, 1}, nil
+		}
+		return StreamID{ms, 0}, nil
+	}
+
+	id, err := ParseStreamID(spec, 0)
+	if err != nil {
+		return StreamID{}, err
+	}
+	if id.IsZero() {
+		return StreamID{}, ErrStreamIDZero
+	}
+	if !s.lastID.Less(id) {
+		return StreamID{}, ErrStreamIDTooSmall
+	}
+	return id, nil
+}
+
+func (s *Stream) add(id StreamID, fields []string) {
+	s.entries = append(s.entries, StreamEntry{ID: id, Fields: fields})
+	s.lastID = id
+	s.added++
+	s.bytes += entrySize(fields)
+}
+
+// trim drops the oldest entries so at most maxLen remain and returns how
+// many were removed.
+func (s *Stream) trim(maxLen int) int {
+	n := len(s.entries) - maxLen
+	if n <= 0 {
+		return 0
+	}
+	for i := range s.entries[:n] {
+		s.bytes -= entrySize(s.entries[i].Fields)
+		s.entries[i] = StreamEntry{}
+	}
+	// The head of the backing array is released on the next reallocation.
+	s.entries = s.entries[n:]
+	return n
+}
+
+// seek returns the index of the first entry with an ID >= id.
+func (s *Stream) seek(id StreamID) int {
+	return sort.Search(len(s.entries), func(i int) bool {
+		return !s.entries[i].ID.Less(id)
+	})
+}
+
+func (s *Stream) lookup(id StreamID) (StreamEntry, bool) {
+	i := s.seek(id)
+	if i < len(s.entries) && s.entries[i].ID == id {
+		return s.entries[i], true
+	}
+	return StreamEntry{}, false
+}
+
+// Range returns the entries with IDs between start and end, inclusive,
+// at most count of them (count <= 0 means all). With reverse the walk
+// starts at end.
+func (s *Stream) Range(start, end StreamID, count int, reverse bool) []StreamEntry {
+	out := []StreamEntry{}
+	if end.Less(start) {
+		return out
+	}
+	lo := s.seek(start)
+	hi := sort.Search(len(s.entries), func(i int) bool {
+		return end.Less(s.entries[i].ID)
+	})
+
+	if reverse {
+		for i := hi - 1; i >= lo && (count <= 0 || len(out) < count); i-- {
+			out = append(out, s.entries[i])
+		}
+		return out
+	}
+	for i := lo; i < hi && (count <= 0 || len(out) < count); i++ {
+		out = append(out, s.entries[i])
+	}
+	return out
+}
+
+// after returns up to count entries with an ID greater than id.
+func (s *Stream) after(id StreamID, count int) []StreamEntry {
+	next, ok := id.Next()
+	if !ok {
+		return []StreamEntry{}
+	}
+	return s.Range(next, MaxStreamID, count, false)
+}
+
+// readGroup delivers entries to consumer. New entries (newOnly) advance
+// the group and are added to the pending list unless noAck is set; the
+// history form re-reads the consumer's own pending entries after id.
+func (s *Stream) readGroup(g *streamGroup, consumer string, after StreamID, newOnly bool, count int, noAck bool, now time.Time) []StreamEntry {
+	g.consumers[consumer] = now
+
+	if newOnly {
+		entries := s.after(g.lastDelivered, count)
+		for _, e := range entries {
+			g.lastDelivered = e.ID
+			if noAck {
+				continue
+			}
+			if pe, ok := g.pending[e.ID]; ok {
+				pe.Consumer, pe.DeliveredAt, pe.Deliveries = consumer, now, 1
+				continue
+			}
+			g.pending[e.ID] = &PendingEntry{ID: e.ID, Consumer: consumer, DeliveredAt: now, Deliveries: 1}
+		}
+		return entries
+	}
+
+	out := []StreamEntry{}
+	for _, pe := range g.sortedPending() {
+		if count > 0 && len(out) >= count {
+			break
+		}
+		if pe.Consumer != consumer || !after.Less(pe.ID) {
+			continue
+		}
+		e, ok := s.lookup(pe.ID)
+		if !ok {
+			e = StreamEntry{ID: pe.ID}
+		}
+		out = append(out, e)
+	}
+	return out
+}
+
+type streamJSON struct {
+	LastID  StreamID             `json:"last_id"`
+	Added   uint64               `json:"entries_added"`
+	Entries []StreamEntry        `json:"entries"`
+	Groups  map[string]groupJSON `json:"groups,omitempty"`
+}
+
+type groupJSON struct {
+	LastDelivered StreamID             `json:"last_delivered"`
+	Pending       []*PendingEntry      `json:"pending"`
+	Consumers     map[string]time.Time `json:"consumers"`
+}
+
+// MarshalJSON encodes the entries together with the consumer groups, so
+// a persisted stream resumes where its readers left off.
+func (s *Stream) MarshalJSON() ([]byte, error) {
+	out := streamJSON{LastID: s.lastID, Added: s.added, Entries: s.entries}
+	if out.Entries == nil {
+		out.Entries = []StreamEntry{}
+	}
+	if len(s.groups) > 0 {
+		out.Groups = make(map[string]groupJSON, len(s.groups))
+		for name, g := range s.groups {
+			out.Groups[name] = groupJSON{
+				LastDelivered: g.lastDelivered,
+				Pending:       g.sortedPending(),
+				Consumers:     g.consumers,
+			}
+		}
+	}
+	return json.Marshal(out)
+}
+
+func (s *Stream) UnmarshalJSON(data []byte) error {
+	var in streamJSON
+	if err := json.Unmarshal(data, &in); err != nil {
+		return err
+	}
+
+	*s = Stream{lastID: in.LastID, added: in.Added, groups: make(map[string]*streamGroup)}
+	for _, e := range in.Entries {
+		s.entries = append(s.entries, e)
+		s.bytes += entrySize(e.Fields)
+	}
+	for name, gj := range in.Groups {
+		g := newStreamGroup(gj.LastDelivered)
+		for _, pe := range gj.Pending {
+			g.pending[pe.ID] = pe
+		}
+		for consumer, seen := range gj.Consumers {
+			g.consumers[consumer] = seen
+		}
+		s.groups[name] = g
+	}
+	return nil
+}
+
+// loadStream returns the stream at key, nil if the key is missing.
+func (c *BoltCache) loadStream(key string) (*Stream, error) {
+	val, ok := c.Get(key)
+	if !ok {
+		return nil, nil
+	}
+	s, ok := val.(*Stream)
+	if !ok {
+		return nil, ErrWrongType
+	}
+	return s, nil
+}
+
+// storeStream writes s back so its size and version are refreshed,
+// keeping the key's TTL. Unlike other collections, empty streams stay.
+func (c *BoltCache) storeStream(key string, s *Stream) {
+	c.setWithOptions(key, s, SetOptions{KeepTTL: true}, false)
+}
+
+// loadGroup returns the stream at key and its consumer group.
+func (c *BoltCache) loadGroup(key, group string) (*Stream, *streamGroup, error) {
+	s, err := c.loadStream(key)
+	if err != nil {
+		return nil, nil, err
+	}
+	if s == nil || s.groups[group] == nil {
+		return nil, nil, noGroupError(key, group)
+	}
+	return s, s.groups[group], nil
+}
+
+// XAddOptions are the flags of XADD.
+type XAddOptions struct {
+	NoMkStream bool // don't create a missing stream
+	Trim       bool // trim to MaxLen entries after adding
+	MaxLen     int
+}
+
+// XAdd appends an entry and returns its ID. id is "*", "ms-*" or an
+// explicit ID greater than the last one. ok is false when NoMkStream
+// kept a missing stream from being created.
+func (c *BoltCache) XAdd(key, id string, fields []string, opts XAddOptions) (StreamID, bool, error) {
+	c.Mu.Lock()
+	defer c.Mu.Unlock()
+
+	s, err := c.loadStream(key)
+	if err != nil {
+		return StreamID{}, false, err
+	}
+	if s == nil {
+		if opts.NoMkStream {
+			return StreamID{}, false, nil
+		}
+		s = NewStream()
+	}
+
+	newID, err := s.nextID(id, time.Now())
+	if err != nil {
+		return StreamID{}, false, err
+	}
+	s.add(newID, fields)
+	trimmed := 0
+	if opts.Trim {
+		trimmed = s.trim(opts.MaxLen)
+	}
+
+	c.storeStream(key, s)
+	c.signalKey(key)
+	c.propagate(append([]string{"XADD", key, newID.String()}, fields...)...)
+	if trimmed > 0 {
+		c.propagate("XTRIM", key, "MAXLEN", strconv.Itoa(opts.MaxLen))
+	}
+	return newID, true, nil
+}
+
+// XLen returns the number of entries in the stream at key.
+func (c *BoltCache) XLen(key string) (int, error) {
+	c.Mu.RLock()
+	defer c.Mu.RUnlock()
+
+	s, err := c.loadStream(key)
+	if s == nil || err != nil {
+		return 0, err
+	}
+	return s.Len(), nil
+}
+
+// XRange returns the entries between start and end; see Stream.Range.
+func (c *BoltCache) XRange(key string, start, end StreamID, count int, reverse bool) ([]StreamEntry, error) {
+	c.Mu.RLock()
+	defer c.Mu.RUnlock()
+
+	s, err := c.loadStream(key)
+	if s == nil || err != nil {
+		return []StreamEntry{}, err
+	}
+	return s.Range(start, end, count, reverse), nil
+}
+
+// XRead returns up to count entries with an ID greater than after.
+func (c *BoltCache) XRead(key string, after StreamID, count int) ([]StreamEntry, error) {
+	c.Mu.RLock()
+	defer c.Mu.RUnlock()
+
+	s, err := c.loadStream(key)
+	if s == nil || err != nil {
+		return nil, err
+	}
+	return s.after(after, count), nil
+}
+
+// XLastID returns the ID of the last entry added to the stream at key,
+// 0-0 when the key is missing.
+func (c *BoltCache) XLastID(key string) (StreamID, error) {
+	c.Mu.RLock()
+	defer c.Mu.RUnlock()
+
+	s, err := c.loadStream(key)
+	if s == nil || err != nil {
+		return StreamID{}, err
+	}
+	return s.lastID, nil
+}
+
+// XTrim trims the stream to at most maxLen entries and returns how many
+// were removed.
+func (c *BoltCache) XTrim(key string, maxLen int) (int, error) {
+	c.Mu.Lock()
+	defer c.Mu.Unlock()
+
+	s, err := c.loadStream(key)
+	if s == nil || err != nil {
+		return 0, err
+	}
+	n := s.trim(maxLen)
+	if n > 0 {
+		c.storeStream(key, s)
+		c.propagate("XTRIM", key, "MAXLEN", strconv.Itoa(maxLen))
+	}
+	return n, nil
+}
+
+// resolveGroupID parses the ID of XGROUP CREATE and SETID, where "$"
+// means the last entry of the stream.
+func (s *Stream) resolveGroupID(id string) (StreamID, error) {
+	if id == "$" {
+		return s.lastID, nil
+	}
+	return ParseStreamID(id, 0)
+}
+
+// XGroupCreate creates a consumer group that will deliver entries after
+// id. With mkStream a missing key becomes an empty stream.
+func (c *BoltCache) XGroupCreate(key, group, id string, mkStream bool) error {
+	c.Mu.Lock()
+	defer c.Mu.Unlock()
+
+	s, err := c.loadStream(key)
+	if err != nil {
+		return err
+	}
+	if s == nil {
+		if !mkStream {
+			return ErrNoStream
+		}
+		s = NewStream()
+	}
+
+	start, err := s.resolveGroupID(id)
+	if err != nil {
+		return err
+	}
+	if _, exists := s.groups[group]; exists {
+		return ErrBusyGroup
+	}
+	s.groups[group] = newStreamGroup(start)
+	c.storeStream(key, s)
+	if mkStream {
+		c.propagate("XGROUP", "CREATE", key, group, start.String(), "MKSTREAM")
+	} else {
+		c.propagate("XGROUP", "CREATE", key, group, start.String())
+	}
+	return nil
+}
+
+// XGroupSetID moves the last delivered ID of a group.
+func (c *BoltCache) XGroupSetID(key, group, id string) error {
+	c.Mu.Lock()
+	defer c.Mu.Unlock()
+
+	s, g, err := c.loadGroup(key, group)
+	if err != nil {
+		return err
+	}
+	start, err := s.resolveGroupID(id)
+	if err != nil {
+		return err
+	}
+	g.lastDelivered = start
+	c.storeStream(key, s)
+	c.propagate("XGROUP", "SETID", key, group, start.String())
+	return nil
+}
+
+// XGroupDestroy removes a consumer group with its pending entries.
+func (c *BoltCache) XGroupDestroy(key, group string) (bool, error) {
+	c.Mu.Lock()
+	defer c.Mu.Unlock()
+
+	s, err := c.loadStream(key)
+	if err != nil {
+		return false, err
+	}
+	if s == nil {
+		return false, ErrNoStream
+	}
+	if _, ok := s.groups[group]; !ok {
+		return false, nil
+	}
+	delete(s.groups, group)
+	c.storeStream(key, s)
+	c.propagate("XGROUP", "DESTROY", key, group)
+	return true, nil
+}
+
+// XGroupCreateConsumer adds a consumer and reports whether it was new.
+func (c *BoltCache) XGroupCreateConsumer(key, group, consumer string) (bool, error) {
+	c.Mu.Lock()
+	defer c.Mu.Unlock()
+
+	s, g, err := c.loadGroup(key, group)
+	if err != nil {
+		return false, err
+	}
+	if _, ok := g.consumers[consumer]; ok {
+		return false, nil
+	}
+	g.consumers[consumer] = time.Now()
+	c.storeStream(key, s)
+	c.propagate("XGROUP", "CREATECONSUMER", key, group, consumer)
+	return true, nil
+}
+
+// XGroupDelConsumer removes a consumer and returns how many pending
+// entries it still owned; those entries are dropped too.
+func (c *BoltCache) XGroupDelConsumer(key, group, consumer string) (int, error) {
+	c.Mu.Lock()
+	defer c.Mu.Unlock()
+
+	s, g, err := c.loadGroup(key, group)
+	if err != nil {
+		return 0, err
+	}
+	if _, ok := g.consumers[consumer]; !ok {
+		return 0, nil
+	}
+	n := 0
+	for id, pe := range g.pending {
+		if pe.Consumer == consumer {
+			delete(g.pending, id)
+			n++
+		}
+	}
+	delete(g.consumers, consumer)
+	c.storeStream(key, s)
+	c.propagate("XGROUP", "DELCONSUMER", key, group, consumer)
+	return n, nil
+}
+
+// XReadGroup reads entries for consumer of group. With newOnly (the ">"
+// ID) it returns entries never delivered to the group, otherwise the
+// consumer's pending entries after the given ID.
+func (c *BoltCache) XReadGroup(key, group, consumer string, after StreamID, newOnly bool, count int, noAck bool) ([]StreamEntry, error) {
+	c.Mu.Lock()
+	defer c.Mu.Unlock()
+
+	s, g, err := c.loadGroup(key, group)
+	if err != nil {
+		return nil, err
+	}
+	_, known := g.consumers[consumer]
+	now := time.Now()
+	entries := s.readGroup(g, consumer, after, newOnly, count, noAck, now)
+	c.storeStream(key, s)
+
+	// Replicate the effect: new consumers, the entries that became
+	// pending and the group's new position.
+	if !known {
+		c.propagate("XGROUP", "CREATECONSUMER", key, group, consumer)
+	}
+	if newOnly && len(entries) > 0 {
+		if !noAck {
+			claim := []string{"XCLAIM", key, group, consumer, "0"}
+			for _, e := range entries {
+				claim = append(claim, e.ID.String())
+			}
+			claim = append(claim, "TIME", formatUnixMilli(now), "RETRYCOUNT", "1", "FORCE", "JUSTID")
+			c.propagate(claim...)
+		}
+		c.propagate("XGROUP", "SETID", key, group, g.lastDelivered.String())
+	}
+	return entries, nil
+}
+
+// XAck acknowledges entries of a group and returns how many were pending.
+func (c *BoltCache) XAck(key, group string, ids ...StreamID) (int, error) {
+	c.Mu.Lock()
+	defer c.Mu.Unlock()
+
+	s, err := c.loadStream(key)
+	if s == nil || err != nil {
+		return 0, err
+	}
+	g := s.groups[group]
+	if g == nil {
+		return 0, nil
+	}
+
+	acked := []string{"XACK", key, group}
+	for _, id := range ids {
+		if _, ok := g.pending[id]; ok {
+			delete(g.pending, id)
+			acked = append(acked, id.String())
+		}
+	}
+	if len(acked) > 3 {
+		c.storeStream(key, s)
+		c.propagate(acked...)
+	}
+	return len(acked) - 3, nil
+}
+
+// XClaimOptions are the flags of XCLAIM.
+type XClaimOptions struct {
+	Idle       time.Duration // set the idle time instead of resetting it
+	Time       time.Time     // set the delivery time; overrides Idle
+	Retry      bool          // set the delivery count to RetryCount
+	RetryCount int
+	Force      bool // claim entries that aren't pending yet
+	JustID     bool // don't count the claim as a delivery
+}
+
+// XClaim moves pending entries idle for at least minIdle to consumer and
+// returns them. Entries trimmed from the stream are dropped from the
+// pending list instead.
+func (c *BoltCache) XClaim(key, group, consumer string, minIdle time.Duration, ids []StreamID, opts XClaimOptions) ([]StreamEntry, error) {
+	c.Mu.Lock()
+	defer c.Mu.Unlock()
+
+	s, g, err := c.loadGroup(key, group)
+	if err != nil {
+		return nil, err
+	}
+
+	now := time.Now()
+	deliveredAt := now.Add(-opts.Idle)
+	if !opts.Time.IsZero() {
+		deliveredAt = opts.Time
+	}
+
+	_, known := g.consumers[consumer]
+	out := []StreamEntry{}
+	dropped := []string{"XACK", key, group}
+	var claimed []*PendingEntry
+	for _, id := range ids {
+		e, exists := s.lookup(id)
+		pe := g.pending[id]
+		if !exists {
+			if pe != nil {
+				delete(g.pending, id)
+				dropped = append(dropped, id.String())
+			}
+			continue
+		}
+		if pe == nil {
+			if !opts.Force {
+				continue
+			}
+			pe = &PendingEntry{ID: id}
+			g.pending[id] = pe
+		} else if minIdle > 0 && now.Sub(pe.DeliveredAt) < minIdle {
+			continue
+		}
+
+		pe.Consumer = consumer
+		pe.DeliveredAt = deliveredAt
+		if opts.Retry {
+			pe.Deliveries = opts.RetryCount
+		} else if !opts.JustID {
+			pe.Deliveries++
+		}
+		out = append(out, e)
+		claimed = append(claimed, pe)
+	}
+
+	g.consumers[consumer] = now
+	c.storeStream(key, s)
+
+	// Replicate the resulting pending entries rather than the request,
+	// which depends on the current time.
+	if !known {
+		c.propagate("XGROUP", "CREATECONSUMER", key, group, consumer)
+	}
+	if len(dropped) > 3 {
+		c.propagate(dropped...)
+	}
+	for _, pe := range claimed {
+		c.propagate("XCLAIM", key, group, consumer, "0", pe.ID.String(),
+			"TIME", formatUnixMilli(pe.DeliveredAt), "RETRYCOUNT", strconv.Itoa(pe.Deliveries), "FORCE", "JUSTID")
+	}
+	return out, nil
+}
+
+// XPendingSummary returns the number of pending entries of a group, their
+// ID range and the count per consumer.
+func (c *BoltCache) XPendingSummary(key, group string) (PendingSummary, error) {
+	c.Mu.RLock()
+	defer c.Mu.RUnlock()
+
+	_, g, err := c.loadGroup(key, group)
+	if err != nil {
+		return PendingSummary{}, err
+	}
+
+	pending := g.sortedPending()
+	sum := PendingSummary{Count: len(pending)}
+	if len(pending) == 0 {
+		return sum, nil
+	}
+	sum.Min, sum.Max = pending[0].ID, pending[len(pending)-1].ID
+
+	counts := make(map[string]int)
+	for _, pe := range pending {
+		counts[pe.Consumer]++
+	}
+	for consumer, n := range counts {
+		sum.Consumers = append(sum.Consumers, ConsumerPending{consumer, n})
+	}
+	sort.Slice(sum.Consumers, func(i, j int) bool {
+		return sum.Consumers[i].Consumer < sum.Consumers[j].Consumer
+	})
+	return sum, nil
+}
+
+// XPending returns up to count pending entries between start and end,
+// optionally only those of consumer or idle for at least minIdle.
+func (c *BoltCache) XPending(key, group string, start, end StreamID, count int, consumer string, minIdle time.Duration) ([]PendingEntry, error) {
+	c.Mu.RLock()
+	defer c.Mu.RUnlock()
+
+	_, g, err := c.loadGroup(key, group)
+	if err != nil {
+		return nil, err
+	}
+
+	now := time.Now()
+	out := []PendingEntry{}
+	for _, pe := range g.sortedPending() {
+		if len(out) >= count {
+			break
+		}
+		if pe.ID.Less(start) || end.Less(pe.ID) {
+			continue
+		}
+		if (consumer != "" && pe.Consumer != consumer) || now.Sub(pe.DeliveredAt) < minIdle {
+			continue
+		}
+		out = append(out, *pe)
+	}
+	return out, nil
+}
@@ -0,0 +1,170 @@
+package cache
+
+import (
+	"encoding/json"
+	"testing"
+	"time"
+)
+
+func TestStreamIDs(t *testing.T) {
+	c := &BoltCache{Data: NewShardedMap()}
+
+	add := func(id string) (StreamID, error) {
+		got, _, err := c.XAdd("s", id, []string{"f", "v"}, XAddOptions{})
+		return got, err
+	}
+
+	if _, err := add("0-0"); err != ErrStreamIDZero {
+		t.Fatalf("expected 0-0 to be rejected, got %v", err)
+	}
+	if id, _ := add("5-*"); id != (StreamID{5, 0}) {
+		t.Fatalf("5-* on an empty stream: got %v", id)
+	}
+	if id, _ := add("5-*"); id != (StreamID{5, 1}) {
+		t.Fatalf("5-* after 5-0: got %v", id)
+	}
+	if _, err := add("5-1"); err != ErrStreamIDTooSmall {
+		t.Fatalf("expected a duplicate ID to be rejected, got %v", err)
+	}
+	if _, err := add("4-*"); err != ErrStreamIDTooSmall {
+		t.Fatalf("expected an older ms to be rejected, got %v", err)
+	}
+	if id, _ := add("*"); id.Ms < uint64(time.Now().Add(-time.Minute).UnixMilli()) {
+		t.Fatalf("* should use the current time, got %v", id)
+	}
+
+	c.Set("str", "value", 0)
+	if _, _, err := c.XAdd("str", "*", []string{"f", "v"}, XAddOptions{}); err != ErrWrongType {
+		t.Fatalf("expected WRONGTYPE, got %v", err)
+	}
+	if _, ok, _ := c.XAdd("missing", "*", []string{"f", "v"}, XAddOptions{NoMkStream: true}); ok {
+		t.Fatalf("NOMKSTREAM must not create the key")
+	}
+}
+
+func TestStreamRangeAndTrim(t *testing.T) {
+	c := &BoltCache{Data: NewShardedMap()}
+	for i := 1; i <= 10; i++ {
+		c.XAdd("s", StreamID{uint64(i), 0}.String(), []string{"n", "x"}, XAddOptions{})
+	}
+
+	got, _ := c.XRange("s", StreamID{3, 0}, StreamID{6, 0}, 0, false)
+	if len(got) != 4 || got[0].ID.Ms != 3 || got[3].ID.Ms != 6 {
+		t.Fatalf("range 3..6: got %v", got)
+	}
+	got, _ = c.XRange("s", StreamID{}, MaxStreamID, 3, true)
+	if len(got) != 3 || got[0].ID.Ms != 10 || got[2].ID.Ms != 8 {
+		t.Fatalf("reverse range with count: got %v", got)
+	}
+	got, _ = c.XRead("s", StreamID{9, 0}, 0)
+	if len(got) != 1 || got[0].ID.Ms != 10 {
+		t.Fatalf("read after 9-0: got %v", got)
+	}
+
+	c.XAdd("s", "*", []string{"n", "x"}, XAddOptions{Trim: true, MaxLen: 5})
+	if n, _ := c.XLen("s"); n != 5 {
+		t.Fatalf("expected 5 entries after MAXLEN, got %d", n)
+	}
+	if n, _ := c.XTrim("s", 2); n != 3 {
+		t.Fatalf("expected 3 trimmed, got %d", n)
+	}
+	if got, _ := c.XRange("s", StreamID{}, MaxStreamID, 0, false); got[0].ID.Ms != 10 {
+		t.Fatalf("trimming must drop the oldest entries, got %v", got)
+	}
+}
+
+func TestStreamConsumerGroups(t *testing.T) {
+	c := &BoltCache{Data: NewShardedMap()}
+
+	if err := c.XGroupCreate("s", "g", "$", false); err != ErrNoStream {
+		t.Fatalf("expected missing key error, got %v", err)
+	}
+	if err := c.XGroupCreate("s", "g", "$", true); err != nil {
+		t.Fatal(err)
+	}
+	if err := c.XGroupCreate("s", "g", "$", true); err != ErrBusyGroup {
+		t.Fatalf("expected BUSYGROUP, got %v", err)
+	}
+	for i := 1; i <= 3; i++ {
+		c.XAdd("s", StreamID{uint64(i), 0}.String(), []string{"job", "x"}, XAddOptions{})
+	}
+
+	got, _ := c.XReadGroup("s", "g", "alice", StreamID{}, true, 2, false)
+	if len(got) != 2 || got[1].ID.Ms != 2 {
+		t.Fatalf("alice: got %v", got)
+	}
+	got, _ = c.XReadGroup("s", "g", "bob", StreamID{}, true, 0, false)
+	if len(got) != 1 || got[0].ID.Ms != 3 {
+		t.Fatalf("bob should only get the undelivered entry, got %v", got)
+	}
+	got, _ = c.XReadGroup("s", "g", "alice", StreamID{}, false, 0, false)
+	if len(got) != 2 {
+		t.Fatalf("alice's history: got %v", got)
+	}
+
+	if n, _ := c.XAck("s", "g", StreamID{1, 0}, StreamID{1, 0}, StreamID{9, 0}); n != 1 {
+		t.Fatalf("expected 1 acked, got %d", n)
+	}
+	sum, _ := c.XPendingSummary("s", "g")
+	if sum.Count != 2 || sum.Min != (StreamID{2, 0}) || len(sum.Consumers) != 2 {
+		t.Fatalf("pending summary: %+v", sum)
+	}
+
+	// Entry 2 was delivered just now, so a min idle time keeps it with alice.
+	claimed, _ := c.XClaim("s", "g", "bob", time.Hour, []StreamID{{2, 0}}, XClaimOptions{})
+	if len(claimed) != 0 {
+		t.Fatalf("claimed a fresh entry: %v", claimed)
+	}
+	claimed, _ = c.XClaim("s", "g", "bob", 0, []StreamID{{2, 0}}, XClaimOptions{})
+	if len(claimed) != 1 {
+		t.Fatalf("expected entry 2 to be claimed, got %v", claimed)
+	}
+	pending, _ := c.XPending("s", "g", StreamID{}, MaxStreamID, 10, "bob", 0)
+	if len(pending) != 2 || pending[0].Deliveries != 2 {
+		t.Fatalf("bob's pending entries: %+v", pending)
+	}
+
+	if _, err := c.XReadGroup("s", "nope", "alice", StreamID{}, true, 0, false); err == nil {
+		t.Fatalf("expected NOGROUP")
+	}
+}
+
+func TestStreamJSONRoundTrip(t *testing.T) {
+	c := &BoltCache{Data: NewShardedMap()}
+	c.XAdd("s", "1-1", []string{"a", "1", "b", "2"}, XAddOptions{})
+	c.XAdd("s", "2-0", []string{"c", "3"}, XAddOptions{})
+	c.XGroupCreate("s", "g", "0", false)
+	c.XReadGroup("s", "g", "alice", StreamID{}, true, 1, false)
+
+	item, _ := c.Data.Load("s")
+	p, err := newPersistedItem(item)
+	if err != nil {
+		t.Fatal(err)
+	}
+	data, _ := json.Marshal(p)
+	var loaded persistedItem
+	if err := json.Unmarshal(data, &loaded); err != nil {
+		t.Fatal(err)
+	}
+	reloaded, err := loaded.item()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	c2 := &BoltCache{Data: NewShardedMap()}
+	c2.Data.Store("s", reloaded)
+	got, err := c2.XRange("s", StreamID{}, MaxStreamID, 0, false)
+	if err != nil || len(got) != 2 || got[0].Fields[3] != "2" {
+		t.Fatalf("entries after reload: %v, %v", got, err)
+	}
+	if _, _, err := c2.XAdd("s", "1-5", []string{"x", "y"}, XAddOptions{}); err != ErrStreamIDTooSmall {
+		t.Fatalf("last ID must survive a reload, got %v", err)
+	}
+	got, _ = c2.XReadGroup("s", "g", "bob", StreamID{}, true, 0, false)
+	if len(got) != 1 || got[0].ID != (StreamID{2, 0}) {
+		t.Fatalf("group position must survive a reload, got %v", got)
+	}
+	if sum, _ := c2.XPendingSummary("s", "g"); sum.Count != 2 {
+		t.Fatalf("pending entries must survive a reload, got %+v", sum)
+	}
+}
@@ -1,48 +1,16 @@
 package cache
 
 import (
-	"encoding/json"
+	"fmt"
+	"io"
 	"os"
-	"time"
 	"path/filepath"
-)
-
-import (
-	logger "boltcache/logger"
+	"sort"
+	"strings"
+	"time"
 )
 
 
-func (c *BoltCache) CleanupExpiredWithConfig() {
-	interval := c.Config.Cache.CleanupInterval
-	if interval == 0 {
-		interval = time.Minute
-	}
-
-	ticker := time.NewTicker(interval)
-	defer ticker.Stop()
-
-	for range ticker.C {
-		now := time.Now()
-		expiredKeys := make([]interface{}, 0)
-
-		c.Data.Range(func(key, value interface{}) bool {
-			item := value.(*CacheItem)
-			if !item.ExpiresAt.IsZero() && now.After(item.ExpiresAt) {
-				expiredKeys = append(expiredKeys, key)
-			}
-			return true
-		})
-
-		for _, key := range expiredKeys {
-			c.Data.Delete(key.(string))
-		}
-
-		if len(expiredKeys) > 0 {
-			logger.Log("Cleaned up %d expired keys", len(expiredKeys))
-		}
-	}
-}
-
 func (c *BoltCache) PersistToDiskWithConfig() {
 	if !c.Config.Persistence.Enabled {
 		return
@@ -62,43 +30,58 @@ func (c *BoltCache) PersistToDiskWithConfig() {
 	}
 }
 
-func (c *BoltCache) ForcePersist() {
+// ForcePersist saves the dataset when persistence is enabled; see Save.
+func (c *BoltCache) ForcePersist() error {
 	if !c.Config.Persistence.Enabled {
-		return
+		return nil
 	}
+	return c.Save()
+}
 
-	items := make(map[string]*CacheItem)
-	c.Data.Range(func(key, value interface{}) bool {
-		items[key.(string)] = value.(*CacheItem)
-		return true
-	})
+// backupTimeFormat names backups. Millisecond resolution keeps backups taken
+// in the same second apart, and the names sort chronologically.
+const backupTimeFormat = "20060102-150405.000"
 
-	data, err := json.Marshal(items)
+// CreateBackup copies the persistence file to a timestamped .backup file and
+// returns its path. The file is verified as it is copied, one key at a time,
+// so a damaged file never replaces a good backup.
+func (c *BoltCache) CreateBackup() (string, error) {
+	file := c.Config.Persistence.File
+	src, err := os.Open(file)
 	if err != nil {
-		logger.Log("Failed to marshal data: %v", err)
-		return
+		return "", err
 	}
+	defer src.Close()
 
-	// Create backup if enabled
-	if c.Config.Persistence.BackupCount > 0 {
-		c.CreateBackup()
+	backupFile := file + ".backup." + time.Now().Format(backupTimeFormat)
+	if _, err := os.Stat(backupFile); err == nil {
+		return "", fmt.Errorf("backup %s already exists", backupFile)
 	}
-
-	// Write to file
-	os.MkdirAll(filepath.Dir(c.Config.Persistence.File), 0755)
-	if err := os.WriteFile(c.Config.Persistence.File, data, 0644); err != nil {
-		logger.Log("Failed to write persistence file: %v", err)
+	err = writeFileAtomic(backupFile, func(w io.Writer) error {
+		err := scanPersistFile(io.TeeReader(src, w), func(string, *CacheItem) error { return nil })
+		if err != nil {
+			return err
+		}
+		// Whatever the decoder didn't read ahead.
+		_, err = io.Copy(w, src)
+		return err
+	})
+	if err != nil {
+		return "", err
 	}
+	return backupFile, nil
 }
 
-func (c *BoltCache) CreateBackup() {
-	// Backup implementation
-	backupFile := c.Config.Persistence.File + ".backup." + time.Now().Format("20060102-150405")
-
-	if data, err := os.ReadFile(c.Config.Persistence.File); err == nil {
-		os.WriteFile(backupFile, data, 0644)
+// listBackups returns the backups of file, newest first.
+func listBackups(file string) []string {
+	matches, _ := filepath.Glob(file + ".backup.*")
+	var backups []string
+	for _, m := range matches {
+		// Skip temporary files of backups being written.
+		if !strings.Contains(filepath.Base(m), ".tmp-") {
+			backups = append(backups, m)
+		}
 	}
+	sort.Sort(sort.Reverse(sort.StringSlice(backups)))
+	return backups
 }
-
-
-
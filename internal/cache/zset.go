@@ -0,0 +1,383 @@
+package cache
+
+import (
+	"encoding/json"
+	"errors"
+	"math"
+	"strconv"
+)
+
+// Sorted set operations
+
+// ErrWrongType is returned when a key holds a value of another type.
+var ErrWrongType = errors.New("WRONGTYPE Operation against a key holding the wrong kind of value")
+
+// ErrNotANumber is returned when an increment would make a score NaN.
+var ErrNotANumber = errors.New("ERR resulting score is not a number (NaN)")
+
+// ZMember is a member of a sorted set with its score.
+type ZMember struct {
+	Member string  `json:"member"`
+	Score  float64 `json:"score"`
+}
+
+// SortedSet keeps members ordered by score in a skiplist, with a map for
+// O(1) score lookups.
+type SortedSet struct {
+	scores map[string]float64
+	list   *skiplist
+	bytes  int64
+}
+
+// Per-member overhead of the map entry and the skiplist node.
+const zsetMemberOverhead = 96
+
+func NewSortedSet() *SortedSet {
+	return &SortedSet{
+		scores: make(map[string]float64),
+		list:   newSkiplist(),
+	}
+}
+
+func (z *SortedSet) Len() int {
+	return z.list.length
+}
+
+// MarshalJSON encodes the set as its members in score order.
+func (z *SortedSet) MarshalJSON() ([]byte, error) {
+	return json.Marshal(z.Range(0, -1, false))
+}
+
+func (z *SortedSet) memoryUsage() int64 {
+	return 64 + z.bytes
+}
+
+// set adds member or moves it to a new score. It reports whether the
+// member is new.
+func (z *SortedSet) set(member string, score float64) bool {
+	old, exists := z.scores[member]
+	if exists {
+		if old == score {
+			return false
+		}
+		z.list.delete(old, member)
+	} else {
+		z.bytes += int64(2*len(member)) + zsetMemberOverhead
+	}
+	z.scores[member] = score
+	z.list.insert(score, member)
+	return !exists
+}
+
+func (z *SortedSet) remove(member string) bool {
+	score, ok := z.scores[member]
+	if !ok {
+		return false
+	}
+	delete(z.scores, member)
+	z.list.delete(score, member)
+	z.bytes -= int64(2*len(member)) + zsetMemberOverhead
+	return true
+}
+
+// Score returns the score of member.
+func (z *SortedSet) Score(member string) (float64, bool) {
+	score, ok := z.scores[member]
+	return score, ok
+}
+
+// Rank returns the 0-based rank of member, counted from the highest
+// score when reverse is set.
+func (z *SortedSet) Rank(member string, reverse bool) (int, bool) {
+	score, ok := z.scores[member]
+	if !ok {
+		return 0, false
+	}
+	rank := z.list.rank(score, member)
+	if reverse {
+		return z.list.length - rank, true
+	}
+	return rank - 1, true
+}
+
+// Range returns the members between the 0-based ranks start and stop,
+// inclusive. Negative indexes count from the end, as in Redis.
+func (z *SortedSet) Range(start, stop int, reverse bool) []ZMember {
+	n := z.list.length
+	if start < 0 {
+		start += n
+	}
+	if stop < 0 {
+		stop += n
+	}
+	if start < 0 {
+		start = 0
+	}
+	if stop >= n {
+		stop = n - 1
+	}
+	if start > stop || start >= n {
+		return []ZMember{}
+	}
+
+	out := make([]ZMember, 0, stop-start+1)
+	if reverse {
+		x := z.list.byRank(n - start)
+		for i := start; i <= stop && x != nil; i++ {
+			out = append(out, ZMember{x.member, x.score})
+			x = x.backward
+		}
+		return out
+	}
+
+	x := z.list.byRank(start + 1)
+	for i := start; i <= stop && x != nil; i++ {
+		out = append(out, ZMember{x.member, x.score})
+		x = x.level[0].forward
+	}
+	return out
+}
+
+// RangeByScore returns the members with a score between min and max,
+// skipping offset matches and returning at most count (count < 0 means
+// all). With reverse the walk starts at max.
+func (z *SortedSet) RangeByScore(min, max ScoreBound, reverse bool, offset, count int) []ZMember {
+	out := []ZMember{}
+	if offset < 0 || count == 0 {
+		return out
+	}
+
+	if reverse {
+		x, rank := z.list.lastInRange(min, max)
+		if x == nil {
+			return out
+		}
+		if offset > 0 {
+			x = z.list.byRank(rank - offset)
+		}
+		for x != nil && min.aboveMin(x.score) && (count < 0 || len(out) < count) {
+			out = append(out, ZMember{x.member, x.score})
+			x = x.backward
+		}
+		return out
+	}
+
+	x, rank := z.list.firstInRange(min, max)
+	if x == nil {
+		return out
+	}
+	if offset > 0 {
+		// Jump by rank instead of walking the skipped members.
+		x = z.list.byRank(rank + offset)
+	}
+	for x != nil && max.belowMax(x.score) && (count < 0 || len(out) < count) {
+		out = append(out, ZMember{x.member, x.score})
+		x = x.level[0].forward
+	}
+	return out
+}
+
+// ZAddOptions are the flags of ZADD.
+type ZAddOptions struct {
+	NX bool // only add new members
+	XX bool // only update existing members
+	GT bool // only update when the new score is greater
+	LT bool // only update when the new score is less
+	CH bool // count changed members, not only added ones
+}
+
+// loadZSet returns the sorted set at key, nil if the key is missing.
+func (c *BoltCache) loadZSet(key string) (*SortedSet, error) {
+	val, ok := c.Get(key)
+	if !ok {
+		return nil, nil
+	}
+	z, ok := val.(*SortedSet)
+	if !ok {
+		return nil, ErrWrongType
+	}
+	return z, nil
+}
+
+// storeZSet writes z back so its size and version are refreshed, keeping
+// the key's TTL. Empty sets are removed.
+func (c *BoltCache) storeZSet(key string, z *SortedSet) {
+	if z.Len() == 0 {
+		c.delete(key, false)
+		return
+	}
+	c.setWithOptions(key, z, SetOptions{KeepTTL: true}, false)
+}
+
+// formatScore formats a score so that it parses back to the same value.
+func formatScore(score float64) string {
+	return strconv.FormatFloat(score, 'g', -1, 64)
+}
+
+// ZAdd adds or updates members and returns the number of added members,
+// or of changed members with opts.CH.
+func (c *BoltCache) ZAdd(key string, opts ZAddOptions, members ...ZMember) (int, error) {
+	c.Mu.Lock()
+	defer c.Mu.Unlock()
+
+	z, err := c.loadZSet(key)
+	if err != nil {
+		return 0, err
+	}
+	if z == nil {
+		if opts.XX {
+			return 0, nil
+		}
+		z = NewSortedSet()
+	}
+
+	changed := 0
+	applied := []string{"ZADD", key}
+	for _, m := range members {
+		old, exists := z.scores[m.Member]
+		if (opts.NX && exists) || (opts.XX && !exists) {
+			continue
+		}
+		if exists && ((opts.GT && m.Score <= old) || (opts.LT && m.Score >= old)) {
+			continue
+		}
+		if z.set(m.Member, m.Score) || (opts.CH && old != m.Score) {
+			changed++
+		}
+		applied = append(applied, formatScore(m.Score), m.Member)
+	}
+
+	c.storeZSet(key, z)
+	if len(applied) > 2 {
+		c.propagate(applied...)
+	}
+	return changed, nil
+}
+
+// ZAddIncr increments the score of member under the ZADD flags and returns
+// the new score. ok is false when a flag prevented the update.
+func (c *BoltCache) ZAddIncr(key string, opts ZAddOptions, member string, incr float64) (float64, bool, error) {
+	c.Mu.Lock()
+	defer c.Mu.Unlock()
+
+	z, err := c.loadZSet(key)
+	if err != nil {
+		return 0, false, err
+	}
+	if z == nil {
+		if opts.XX {
+			return 0, false, nil
+		}
+		z = NewSortedSet()
+	}
+
+	old, exists := z.scores[member]
+	if (opts.NX && exists) || (opts.XX && !exists) {
+		return 0, false, nil
+	}
+	score := old + incr
+	if math.IsNaN(score) {
+		return 0, false, ErrNotANumber
+	}
+	if exists && ((opts.GT && score <= old) || (opts.LT && score >= old)) {
+		return 0, false, nil
+	}
+
+	z.set(member, score)
+	c.storeZSet(key, z)
+	c.propagate("ZADD", key, formatScore(score), member)
+	return score, true, nil
+}
+
+// ZIncrBy increments the score of member and returns the new score.
+func (c *BoltCache) ZIncrBy(key, member string, incr float64) (float64, error) {
+	score, _, err := c.ZAddIncr(key, ZAddOptions{}, member, incr)
+	return score, err
+}
+
+// ZRem removes members and returns how many were present.
+func (c *BoltCache) ZRem(key string, members ...string) (int, error) {
+	c.Mu.Lock()
+	defer c.Mu.Unlock()
+
+	z, err := c.loadZSet(key)
+	if z == nil || err != nil {
+		return 0, err
+	}
+
+	removed := []string{"ZREM", key}
+	for _, m := range members {
+		if z.remove(m) {
+			removed = append(removed, m)
+		}
+	}
+	if len(removed) > 2 {
+		c.storeZSet(key, z)
+		c.propagate(removed...)
+	}
+	return len(removed) - 2, nil
+}
+
+// ZScore returns the score of member.
+func (c *BoltCache) ZScore(key, member string) (float64, bool, error) {
+	c.Mu.RLock()
+	defer c.Mu.RUnlock()
+
+	z, err := c.loadZSet(key)
+	if z == nil || err != nil {
+		return 0, false, err
+	}
+	score, ok := z.Score(member)
+	return score, ok, nil
+}
+
+// ZCard returns the number of members of the sorted set at key.
+func (c *BoltCache) ZCard(key string) (int, error) {
+	c.Mu.RLock()
+	defer c.Mu.RUnlock()
+
+	z, err := c.loadZSet(key)
+	if z == nil || err != nil {
+		return 0, err
+	}
+	return z.Len(), nil
+}
+
+// ZRank returns the 0-based rank of member, from the highest score when
+// reverse is set.
+func (c *BoltCache) ZRank(key, member string, reverse bool) (int, bool, error) {
+	c.Mu.RLock()
+	defer c.Mu.RUnlock()
+
+	z, err := c.loadZSet(key)
+	if z == nil || err != nil {
+		return 0, false, err
+	}
+	rank, ok := z.Rank(member, reverse)
+	return rank, ok, nil
+}
+
+// ZRange returns the members between the ranks start and stop, inclusive.
+func (c *BoltCache) ZRange(key string, start, stop int, reverse bool) ([]ZMember, error) {
+	c.Mu.RLock()
+	defer c.Mu.RUnlock()
+
+	z, err := c.loadZSet(key)
+	if z == nil || err != nil {
+		return []ZMember{}, err
+	}
+	return z.Range(start, stop, reverse), nil
+}
+
+// ZRangeByScore returns the members with a score between min and max.
+// See SortedSet.RangeByScore for offset and count.
+func (c *BoltCache) ZRangeByScore(key string, min, max ScoreBound, reverse bool, offset, count int) ([]ZMember, error) {
+	c.Mu.RLock()
+	defer c.Mu.RUnlock()
+
+	z, err := c.loadZSet(key)
+	if z == nil || err != nil {
+		return []ZMember{}, err
+	}
+	return z.RangeByScore(min, max, reverse, offset, count), nil
+}
@@ -0,0 +1,118 @@
+package cache
+
+import (
+	"math"
+	"math/rand"
+	"sort"
+	"strconv"
+	"testing"
+)
+
+// sortedMembers is the reference model: members ordered by (score, member).
+func sortedMembers(m map[string]float64) []ZMember {
+	out := make([]ZMember, 0, len(m))
+	for member, score := range m {
+		out = append(out, ZMember{member, score})
+	}
+	sort.Slice(out, func(i, j int) bool {
+		if out[i].Score != out[j].Score {
+			return out[i].Score < out[j].Score
+		}
+		return out[i].Member < out[j].Member
+	})
+	return out
+}
+
+func TestSortedSetMatchesModel(t *testing.T) {
+	rng := rand.New(rand.NewSource(1))
+	z := NewSortedSet()
+	model := map[string]float64{}
+
+	for i := 0; i < 5000; i++ {
+		member := "m" + strconv.Itoa(rng.Intn(300))
+		if rng.Intn(4) == 0 {
+			z.remove(member)
+			delete(model, member)
+		} else {
+			score := float64(rng.Intn(50))
+			z.set(member, score)
+			model[member] = score
+		}
+	}
+
+	want := sortedMembers(model)
+	if z.Len() != len(want) {
+		t.Fatalf("len %d, want %d", z.Len(), len(want))
+	}
+
+	got := z.Range(0, -1, false)
+	for i := range want {
+		if got[i] != want[i] {
+			t.Fatalf("rank %d: got %v, want %v", i, got[i], want[i])
+		}
+		if rank, ok := z.Rank(want[i].Member, false); !ok || rank != i {
+			t.Fatalf("Rank(%s) = %d, want %d", want[i].Member, rank, i)
+		}
+		if rank, _ := z.Rank(want[i].Member, true); rank != len(want)-1-i {
+			t.Fatalf("reverse Rank(%s) = %d, want %d", want[i].Member, rank, len(want)-1-i)
+		}
+	}
+
+	rev := z.Range(0, 4, true)
+	for i, m := range rev {
+		if m != want[len(want)-1-i] {
+			t.Fatalf("reverse rank %d: got %v", i, m)
+		}
+	}
+
+	min, max := ScoreBound{Value: 10}, ScoreBound{Value: 20, Exclusive: true}
+	var inRange []ZMember
+	for _, m := range want {
+		if m.Score >= 10 && m.Score < 20 {
+			inRange = append(inRange, m)
+		}
+	}
+	byScore := z.RangeByScore(min, max, false, 3, 5)
+	for i, m := range byScore {
+		if m != inRange[3+i] {
+			t.Fatalf("by score %d: got %v, want %v", i, m, inRange[3+i])
+		}
+	}
+	byScore = z.RangeByScore(min, max, true, 2, -1)
+	if len(byScore) != len(inRange)-2 || byScore[0] != inRange[len(inRange)-3] {
+		t.Fatalf("reverse by score: got %v", byScore)
+	}
+}
+
+func TestZAddOptions(t *testing.T) {
+	c := &BoltCache{Data: NewShardedMap()}
+
+	if n, _ := c.ZAdd("z", ZAddOptions{}, ZMember{"a", 1}, ZMember{"b", 2}); n != 2 {
+		t.Fatalf("expected 2 added, got %d", n)
+	}
+	if n, _ := c.ZAdd("z", ZAddOptions{GT: true, CH: true}, ZMember{"a", 0}, ZMember{"b", 3}); n != 1 {
+		t.Fatalf("expected 1 changed, got %d", n)
+	}
+	if score, _, _ := c.ZScore("z", "a"); score != 1 {
+		t.Fatalf("GT must not lower a score, got %v", score)
+	}
+	if _, ok, _ := c.ZAddIncr("z", ZAddOptions{XX: true}, "missing", 1); ok {
+		t.Fatalf("XX must not create members")
+	}
+	if score, _ := c.ZIncrBy("z", "a", math.Inf(1)); !math.IsInf(score, 1) {
+		t.Fatalf("expected +inf, got %v", score)
+	}
+	if _, err := c.ZIncrBy("z", "a", math.Inf(-1)); err != ErrNotANumber {
+		t.Fatalf("expected NaN error, got %v", err)
+	}
+
+	c.Set("s", "string", 0)
+	if _, err := c.ZAdd("s", ZAddOptions{}, ZMember{"a", 1}); err != ErrWrongType {
+		t.Fatalf("expected WRONGTYPE, got %v", err)
+	}
+
+	c.ZRem("z", "a", "b")
+	if _, ok := c.Get("z"); ok {
+		t.Fatalf("empty sorted set should be deleted")
+	}
+}
@@ -0,0 +1,566 @@
+package cluster
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"net"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+import (
+	config "boltcache/config"
+	logger "boltcache/logger"
+)
+
+var (
+	ErrUnknownNode = errors.New("ERR Unknown node")
+	ErrForgetSelf  = errors.New("ERR I tried hard but I can't forget myself...")
+	ErrForgotten   = errors.New("ERR node was forgotten recently")
+	ErrInvalidNode = errors.New("ERR invalid node id or address")
+)
+
+const (
+	RoleMaster  = "master"
+	RoleReplica = "replica"
+
+	// forgetTTL keeps a forgotten node from being added back by the
+	// heartbeats of nodes that still know it, as in Redis.
+	forgetTTL = time.Minute
+
+	dialTimeout = 2 * time.Second
+)
+
+// Node is a member of the cluster as seen by this node.
+type Node struct {
+	ID     string
+	Addr   string // TCP address
+	Role   string // master or replica
+	Master string // address of the master of a replica
+	Myself bool
+
+	// Epoch orders conflicting slot claims: the higher epoch wins.
+	Epoch  uint64
+	Slots  []SlotRange // filled in by Nodes and Node
+	Offset int64       // replication offset, ranks replicas in failover
+
+	LastSeen time.Time // last heartbeat received from or answered by it
+	Failed   bool      // not heard from for NodeTimeout
+}
+
+// Cluster is the membership table of a node. Nodes join with CLUSTER JOIN
+// and then exchange heartbeats; every heartbeat carries the sender's
+// member list, so nodes learn about each other through any member.
+type Cluster struct {
+	heartbeat time.Duration
+	timeout   time.Duration
+
+	mu        sync.RWMutex
+	self      *Node
+	nodes     map[string]*Node // by ID, self included
+	forgotten map[string]time.Time
+	links     map[string]*link // outgoing heartbeat connections by ID
+
+	owner     [SlotCount]string // ID of the node serving each slot
+	assigned  int               // slots with an owner
+	migrating map[int]string    // slots this node moves away, to node ID
+	importing map[int]string    // slots this node takes over, from node ID
+
+	repl    Replication
+	changes chan func(Replication) error
+
+	lastVote     uint64               // epoch this master last voted in
+	votedFor     map[string]time.Time // failed master ID -> when this master voted to replace it
+	election     time.Time            // when this replica may start an election
+	electing     bool
+	lastElection uint64 // epoch of this replica's last election
+
+	stop     chan struct{}
+	stopOnce sync.Once
+}
+
+type link struct {
+	conn net.Conn
+	r    *bufio.Reader
+}
+
+// New creates the table of a cluster holding only this node.
+func New(id, addr, role, master string, cfg config.ClusterConfig) *Cluster {
+	self := &Node{ID: id, Addr: addr, Role: role, Master: master, Myself: true, LastSeen: time.Now()}
+	c := &Cluster{
+		heartbeat: cfg.HeartbeatInterval,
+		timeout:   cfg.NodeTimeout,
+		self:      self,
+		nodes:     map[string]*Node{id: self},
+		forgotten: make(map[string]time.Time),
+		links:     make(map[string]*link),
+		migrating: make(map[int]string),
+		importing: make(map[int]string),
+		votedFor:  make(map[string]time.Time),
+		changes:   make(chan func(Replication) error, 16),
+		stop:      make(chan struct{}),
+	}
+	if c.heartbeat <= 0 {
+		c.heartbeat = time.Second
+	}
+	if c.timeout <= 0 {
+		c.timeout = 5 * c.heartbeat
+	}
+	return c
+}
+
+// Myself returns this node.
+func (c *Cluster) Myself() Node {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	self := *c.self
+	self.Slots = slotRanges(c.slotsByNode()[self.ID])
+	self.Offset = c.offset()
+	return self
+}
+
+// Nodes returns the members ordered by ID.
+func (c *Cluster) Nodes() []Node {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	slots := c.slotsByNode()
+	nodes := make([]Node, 0, len(c.nodes))
+	for _, n := range c.nodes {
+		node := *n
+		node.Slots = slotRanges(slots[n.ID])
+		if n.Myself {
+			node.Offset = c.offset()
+		}
+		nodes = append(nodes, node)
+	}
+	sort.Slice(nodes, func(i, j int) bool { return nodes[i].ID < nodes[j].ID })
+	return nodes
+}
+
+// Node returns the member with the given ID.
+func (c *Cluster) Node(id string) (Node, bool) {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	n, ok := c.nodes[id]
+	if !ok {
+		return Node{}, false
+	}
+	node := *n
+	node.Slots = slotRanges(c.slotsByNode()[id])
+	if n.Myself {
+		node.Offset = c.offset()
+	}
+	return node, true
+}
+
+// Heard records a heartbeat or join from node, adding it to the table when
+// it is new, and reports whether it was new. When node took over from this
+// node or its master in a failover, this node starts replicating it.
+func (c *Cluster) Heard(node Node) (bool, error) {
+	if !validNode(node) {
+		return false, ErrInvalidNode
+	}
+	c.mu.Lock()
+	added, err := c.heard(node)
+	c.mu.Unlock()
+	return added, err
+}
+
+func (c *Cluster) heard(node Node) (bool, error) {
+	if node.ID == c.self.ID {
+		return false, nil
+	}
+	if c.isForgotten(node.ID) {
+		return false, ErrForgotten
+	}
+
+	n, ok := c.nodes[node.ID]
+	if !ok {
+		n = &Node{ID: node.ID}
+		c.nodes[node.ID] = n
+		logger.Log("Cluster node %s (%s, %s) joined", node.ID, node.Addr, node.Role)
+	} else if n.Failed {
+		logger.Log("Cluster node %s is reachable again", node.ID)
+	}
+	if n.Addr != node.Addr {
+		c.closeLink(node.ID)
+	}
+	prev := *n
+	lead := c.leader()
+	had := c.slotCount(lead)
+	n.Addr, n.Role, n.Master, n.Offset = node.Addr, node.Role, node.Master, node.Offset
+	n.LastSeen, n.Failed = time.Now(), false
+	c.claim(n, node.Epoch, node.Slots)
+	if lead != nil && c.tookOver(n, prev, lead, had) {
+		c.follow(n)
+	}
+	return !ok, nil
+}
+
+// learn adds the members another node told us about. Nodes already known
+// keep their state, since each node judges failures by its own heartbeats.
+func (c *Cluster) learn(nodes []Node) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for _, node := range nodes {
+		if _, ok := c.nodes[node.ID]; ok || !validNode(node) || c.isForgotten(node.ID) {
+			continue
+		}
+		// Not heard from yet: the first failed heartbeat after the
+		// timeout marks it failed.
+		n := &Node{ID: node.ID, Addr: node.Addr, Role: node.Role, Master: node.Master, Offset: node.Offset, LastSeen: time.Now()}
+		c.nodes[node.ID] = n
+		c.claim(n, node.Epoch, node.Slots)
+		logger.Log("Cluster node %s (%s) learned from a peer", node.ID, node.Addr)
+	}
+}
+
+// SetRole updates the role this node announces.
+func (c *Cluster) SetRole(role, master string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.self.Role, c.self.Master = role, master
+}
+
+// Forget removes a node and ignores it for a minute, so heartbeats of
+// nodes that still know it don't bring it back.
+func (c *Cluster) Forget(id string) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if id == c.self.ID {
+		return ErrForgetSelf
+	}
+	if _, ok := c.nodes[id]; !ok {
+		return ErrUnknownNode
+	}
+	delete(c.nodes, id)
+	c.closeLink(id)
+	for slot, owner := range c.owner {
+		if owner == id {
+			c.setOwner(slot, "")
+		}
+	}
+	for slot, to := range c.migrating {
+		if to == id {
+			delete(c.migrating, slot)
+		}
+	}
+	for slot, from := range c.importing {
+		if from == id {
+			delete(c.importing, slot)
+		}
+	}
+	c.forgotten[id] = time.Now().Add(forgetTTL)
+	logger.Log("Cluster node %s forgotten", id)
+	return nil
+}
+
+func (c *Cluster) isForgotten(id string) bool {
+	until, ok := c.forgotten[id]
+	if ok && time.Now().After(until) {
+		delete(c.forgotten, id)
+		return false
+	}
+	return ok
+}
+
+func (c *Cluster) closeLink(id string) {
+	if l := c.links[id]; l != nil {
+		l.conn.Close()
+		delete(c.links, id)
+	}
+}
+
+func validNode(n Node) bool {
+	valid := func(s string) bool { return s != "" && !strings.ContainsAny(s, " \t\r\n") }
+	return valid(n.ID) && valid(n.Addr) && (n.Role == RoleMaster || n.Role == RoleReplica)
+}
+
+// Info summarizes the membership for CLUSTER INFO.
+type Info struct {
+	State         string // ok, or fail when a master is unreachable or slots are unassigned
+	SlotsAssigned int
+	KnownNodes    int
+	Masters       int
+	FailedNodes   int
+}
+
+// Info returns the state of the cluster as seen by this node.
+func (c *Cluster) Info() Info {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	info := Info{State: "ok", SlotsAssigned: c.assigned, KnownNodes: len(c.nodes)}
+	if c.assigned > 0 && c.assigned < SlotCount {
+		info.State = "fail"
+	}
+	for _, n := range c.nodes {
+		if n.Role == RoleMaster {
+			info.Masters++
+		}
+		if n.Failed {
+			info.FailedNodes++
+			if n.Role == RoleMaster {
+				info.State = "fail"
+			}
+		}
+	}
+	return info
+}
+
+// Start begins sending heartbeats and joins the cluster through seeds, the
+// addresses of members that may already be running.
+func (c *Cluster) Start(seeds []string) {
+	self := c.Myself()
+	for _, addr := range seeds {
+		if addr == self.Addr {
+			continue
+		}
+		go func(addr string) {
+			// Seeds started together may not be listening yet.
+			for attempt := 0; attempt < 10; attempt++ {
+				err := c.Meet(addr)
+				if err == nil {
+					return
+				}
+				logger.Log("Failed to join cluster through %s: %v", addr, err)
+				time.Sleep(c.heartbeat)
+			}
+		}(addr)
+	}
+	go c.heartbeatLoop()
+}
+
+// Meet sends CLUSTER JOIN to the node at addr and adds the members it
+// knows.
+func (c *Cluster) Meet(addr string) error {
+	conn, err := net.DialTimeout("tcp", addr, dialTimeout)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	nodes, err := c.exchange(conn, bufio.NewReader(conn), "JOIN")
+	if err != nil {
+		return err
+	}
+	c.heardFrom(nodes, addr)
+	logger.Log("Joined cluster through %s, %d nodes known", addr, len(c.Nodes()))
+	return nil
+}
+
+// exchange sends our node with CLUSTER <cmd> and reads back the member
+// list of the peer, its own node first.
+func (c *Cluster) exchange(conn net.Conn, r *bufio.Reader, cmd string) ([]Node, error) {
+	self := c.Myself()
+	master := self.Master
+	if master == "" {
+		master = "-"
+	}
+	conn.SetDeadline(time.Now().Add(dialTimeout))
+	defer conn.SetDeadline(time.Time{})
+	slots := FormatSlots(self.Slots)
+	if _, err := fmt.Fprintf(conn, "CLUSTER %s %s %s %s %s %d %s %d\r\n", cmd, self.ID, self.Addr, self.Role, master, self.Epoch, slots, self.Offset); err != nil {
+		return nil, err
+	}
+	line, err := r.ReadString('\n')
+	if err != nil {
+		return nil, err
+	}
+	return ParseNodeList(strings.TrimSpace(line))
+}
+
+// heardFrom records the answer of the node at addr to a join or heartbeat.
+func (c *Cluster) heardFrom(nodes []Node, addr string) {
+	if len(nodes) == 0 {
+		return
+	}
+	// The address we dialed is known to work, whatever the peer announces.
+	peer := nodes[0]
+	peer.Addr = addr
+	c.Heard(peer)
+	c.learn(nodes[1:])
+}
+
+// Stop stops the heartbeats and closes the links to other nodes.
+func (c *Cluster) Stop() {
+	c.stopOnce.Do(func() {
+		close(c.stop)
+		c.mu.Lock()
+		for id := range c.links {
+			c.closeLink(id)
+		}
+		c.mu.Unlock()
+	})
+}
+
+func (c *Cluster) stopped() bool {
+	select {
+	case <-c.stop:
+		return true
+	default:
+		return false
+	}
+}
+
+func (c *Cluster) heartbeatLoop() {
+	ticker := time.NewTicker(c.heartbeat)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-c.stop:
+			return
+		case <-ticker.C:
+		}
+		for _, n := range c.Nodes() {
+			if !n.Myself {
+				c.ping(n)
+			}
+		}
+		c.checkFailures()
+		c.checkFailover()
+	}
+}
+
+// ping sends a heartbeat to n over its link, dialing it when needed.
+func (c *Cluster) ping(n Node) {
+	c.mu.Lock()
+	l := c.links[n.ID]
+	c.mu.Unlock()
+	if l == nil {
+		conn, err := net.DialTimeout("tcp", n.Addr, dialTimeout)
+		if err != nil {
+			return
+		}
+		l = &link{conn: conn, r: bufio.NewReader(conn)}
+		c.mu.Lock()
+		if _, ok := c.nodes[n.ID]; !ok || c.links[n.ID] != nil || c.stopped() {
+			// Forgotten, linked or stopped meanwhile.
+			c.mu.Unlock()
+			conn.Close()
+			return
+		}
+		c.links[n.ID] = l
+		c.mu.Unlock()
+	}
+
+	nodes, err := c.exchange(l.conn, l.r, "HEARTBEAT")
+	if err != nil {
+		c.mu.Lock()
+		if c.links[n.ID] == l {
+			c.closeLink(n.ID)
+		}
+		c.mu.Unlock()
+		return
+	}
+	if len(nodes) > 0 && nodes[0].ID != n.ID {
+		// Another node took over the address.
+		c.mu.Lock()
+		c.closeLink(n.ID)
+		c.mu.Unlock()
+		c.learn(nodes)
+		return
+	}
+	c.heardFrom(nodes, n.Addr)
+}
+
+// checkFailures marks nodes not heard from for the node timeout as failed.
+func (c *Cluster) checkFailures() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	now := time.Now()
+	for _, n := range c.nodes {
+		if !n.Myself && !n.Failed && now.Sub(n.LastSeen) > c.timeout {
+			n.Failed = true
+			logger.Log("Cluster node %s (%s) failed: no heartbeat for %v", n.ID, n.Addr, now.Sub(n.LastSeen).Round(time.Millisecond))
+		}
+	}
+}
+
+// Announce returns the NodeList this node answers joins and heartbeats
+// with, itself first.
+func (c *Cluster) Announce() []string {
+	nodes := c.Nodes()
+	sort.SliceStable(nodes, func(i, j int) bool { return nodes[i].Myself && !nodes[j].Myself })
+	return NodeList(nodes)
+}
+
+// NodeList encodes nodes as the flat list CLUSTER JOIN and HEARTBEAT
+// answer with: id, address, role, master address (or -), epoch, slots and
+// replication offset of each.
+func NodeList(nodes []Node) []string {
+	list := make([]string, 0, nodeFields*len(nodes))
+	for _, n := range nodes {
+		master := n.Master
+		if master == "" {
+			master = "-"
+		}
+		list = append(list, n.ID, n.Addr, n.Role, master, strconv.FormatUint(n.Epoch, 10), FormatSlots(n.Slots),
+			strconv.FormatInt(n.Offset, 10))
+	}
+	return list
+}
+
+// nodeFields is the number of fields per node in a NodeList.
+const nodeFields = 7
+
+// ParseNodeList decodes a CLUSTER JOIN or HEARTBEAT answer in the text
+// protocol, an ARRAY line holding a NodeList.
+func ParseNodeList(line string) ([]Node, error) {
+	if msg, ok := strings.CutPrefix(line, "ERROR: "); ok {
+		return nil, errors.New(msg)
+	}
+	fields := strings.Fields(line)
+	if len(fields) == 0 || fields[0] != "ARRAY" || (len(fields)-1)%nodeFields != 0 {
+		return nil, fmt.Errorf("unexpected cluster reply %q", line)
+	}
+	fields = fields[1:]
+	nodes := make([]Node, 0, len(fields)/nodeFields)
+	for i := 0; i < len(fields); i += nodeFields {
+		n, err := ParseNode(fields[i : i+nodeFields])
+		if err != nil {
+			return nil, err
+		}
+		nodes = append(nodes, n)
+	}
+	return nodes, nil
+}
+
+// ParseNode decodes the id, address, role, master, epoch, slots and
+// offset of a node; trailing fields may be left out.
+func ParseNode(fields []string) (Node, error) {
+	if len(fields) < 2 || len(fields) > nodeFields {
+		return Node{}, ErrInvalidNode
+	}
+	n := Node{ID: fields[0], Addr: fields[1], Role: RoleMaster}
+	if len(fields) > 2 {
+		n.Role = fields[2]
+	}
+	if len(fields) > 3 && fields[3] != "-" {
+		n.Master = fields[3]
+	}
+	if len(fields) > 4 {
+		epoch, err := strconv.ParseUint(fields[4], 10, 64)
+		if err != nil {
+			return Node{}, ErrInvalidNode
+		}
+		n.Epoch = epoch
+	}
+	if len(fields) > 5 {
+		slots, err := ParseSlots(fields[5])
+		if err != nil {
+			return Node{}, err
+		}
+		n.Slots = slotRanges(slots)
+	}
+	if len(fields) > 6 {
+		offset, err := strconv.ParseInt(fields[6], 10, 64)
+		if err != nil {
+			return Node{}, ErrInvalidNode
+		}
+		n.Offset = offset
+	}
+	return n, nil
+}
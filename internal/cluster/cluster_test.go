@@ -0,0 +1,140 @@
+package cluster
+
+import (
+	"reflect"
+	"testing"
+	"time"
+)
+
+import (
+	config "boltcache/config"
+)
+
+func TestMembership(t *testing.T) {
+	c := New("a", "127.0.0.1:7000", RoleMaster, "", config.ClusterConfig{NodeTimeout: time.Hour})
+
+	if added, err := c.Heard(Node{ID: "b", Addr: "127.0.0.1:7001", Role: RoleReplica, Master: "127.0.0.1:7000"}); !added || err != nil {
+		t.Fatalf("join: %v, %v", added, err)
+	}
+	if _, err := c.Heard(Node{ID: "bad id", Addr: "x", Role: RoleMaster}); err != ErrInvalidNode {
+		t.Fatalf("invalid node: %v", err)
+	}
+	c.learn([]Node{{ID: "c", Addr: "127.0.0.1:7002", Role: RoleMaster}, {ID: "b", Addr: "elsewhere:1", Role: RoleMaster}})
+
+	nodes := c.Nodes()
+	if len(nodes) != 3 || !nodes[0].Myself || nodes[1].Addr != "127.0.0.1:7001" || nodes[2].ID != "c" {
+		t.Fatalf("nodes %+v", nodes)
+	}
+	if info := c.Info(); info.KnownNodes != 3 || info.Masters != 2 || info.State != "ok" {
+		t.Fatalf("info %+v", info)
+	}
+
+	// A master not heard from for the node timeout fails the cluster.
+	c.timeout = 0
+	c.checkFailures()
+	if info := c.Info(); info.FailedNodes != 2 || info.State != "fail" {
+		t.Fatalf("info %+v", info)
+	}
+	c.Heard(Node{ID: "c", Addr: "127.0.0.1:7002", Role: RoleMaster})
+	if n, _ := c.Node("c"); n.Failed {
+		t.Fatal("node still failed after a heartbeat")
+	}
+
+	if err := c.Forget("a"); err != ErrForgetSelf {
+		t.Fatalf("forget self: %v", err)
+	}
+	if err := c.Forget("c"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := c.Heard(Node{ID: "c", Addr: "127.0.0.1:7002", Role: RoleMaster}); err != ErrForgotten {
+		t.Fatalf("forgotten node came back: %v", err)
+	}
+	c.learn([]Node{{ID: "c", Addr: "127.0.0.1:7002", Role: RoleMaster}})
+	if _, ok := c.Node("c"); ok {
+		t.Fatal("forgotten node learned from a peer")
+	}
+}
+
+func TestNodeList(t *testing.T) {
+	nodes := []Node{
+		{ID: "a", Addr: "h:1", Role: RoleMaster},
+		{ID: "b", Addr: "h:2", Role: RoleReplica, Master: "h:1"},
+	}
+	line := "ARRAY"
+	for _, s := range NodeList(nodes) {
+		line += " " + s
+	}
+	got, err := ParseNodeList(line)
+	if err != nil || !reflect.DeepEqual(got, nodes) {
+		t.Fatalf("got %+v, %v", got, err)
+	}
+	if _, err := ParseNodeList("ERROR: node was forgotten recently"); err == nil || err.Error() != "node was forgotten recently" {
+		t.Fatalf("error reply: %v", err)
+	}
+}
+
+// fakeReplication records the reconfigurations failover asks for.
+type fakeReplication struct {
+	changes chan string
+}
+
+func (f *fakeReplication) ReplicationOffset() int64 { return 0 }
+func (f *fakeReplication) Promote() error           { f.changes <- "promote"; return nil }
+func (f *fakeReplication) Follow(addr string) error { f.changes <- "follow " + addr; return nil }
+
+func TestFailoverVotes(t *testing.T) {
+	c := New("b", "h:2", RoleMaster, "", config.ClusterConfig{NodeTimeout: time.Hour})
+	c.AddSlots([]int{100})
+	c.Heard(Node{ID: "a", Addr: "h:1", Role: RoleMaster, Epoch: 1, Slots: []SlotRange{{0, 99}}})
+	c.Heard(Node{ID: "d", Addr: "h:4", Role: RoleReplica, Master: "h:1"})
+	c.Heard(Node{ID: "e", Addr: "h:5", Role: RoleReplica, Master: "h:1"})
+
+	if c.Vote("d", 2, "a") {
+		t.Fatal("voted to replace a master that didn't fail")
+	}
+	c.nodes["a"].Failed = true
+	if c.Vote("d", 1, "a") {
+		t.Fatal("voted in a stale epoch")
+	}
+	if !c.Vote("d", 2, "a") {
+		t.Fatal("vote not granted")
+	}
+	if c.Vote("e", 2, "a") || c.Vote("e", 3, "a") {
+		t.Fatal("voted twice for the same failover")
+	}
+
+	// The winner's claim in the new epoch moves the slots.
+	c.Heard(Node{ID: "d", Addr: "h:4", Role: RoleMaster, Epoch: 2, Slots: []SlotRange{{0, 99}}})
+	if r := c.Route(50); r.Owner.ID != "d" {
+		t.Fatalf("slot 50 served by %q", r.Owner.ID)
+	}
+}
+
+func TestFollowTakeover(t *testing.T) {
+	// The old master comes back and learns that its replica took over.
+	a := New("a", "h:1", RoleMaster, "", config.ClusterConfig{NodeTimeout: time.Hour})
+	repl := &fakeReplication{changes: make(chan string, 1)}
+	a.SetReplication(repl)
+	defer a.Stop()
+	a.AddSlots([]int{0, 1})
+	a.Heard(Node{ID: "d", Addr: "h:4", Role: RoleReplica, Master: "h:1"})
+	a.Heard(Node{ID: "d", Addr: "h:4", Role: RoleMaster, Epoch: 2, Slots: []SlotRange{{0, 1}}})
+	if self := a.Myself(); self.Role != RoleReplica || self.Master != "h:4" || len(self.Slots) != 0 {
+		t.Fatalf("old master %+v", self)
+	}
+	if got := <-repl.changes; got != "follow h:4" {
+		t.Fatalf("replication %q", got)
+	}
+
+	// A sibling replica follows the promoted replica.
+	e := New("e", "h:5", RoleReplica, "h:1", config.ClusterConfig{NodeTimeout: time.Hour})
+	repl = &fakeReplication{changes: make(chan string, 1)}
+	e.SetReplication(repl)
+	defer e.Stop()
+	e.Heard(Node{ID: "a", Addr: "h:1", Role: RoleMaster, Epoch: 1})
+	e.Heard(Node{ID: "d", Addr: "h:4", Role: RoleReplica, Master: "h:1"})
+	e.Heard(Node{ID: "d", Addr: "h:4", Role: RoleMaster, Epoch: 2})
+	if got := <-repl.changes; got != "follow h:4" || e.Myself().Master != "h:4" {
+		t.Fatalf("replication %q, master %q", got, e.Myself().Master)
+	}
+}
@@ -0,0 +1,266 @@
+package cluster
+
+import (
+	"bufio"
+	"fmt"
+	"math/rand"
+	"net"
+	"strings"
+	"time"
+)
+
+import (
+	logger "boltcache/logger"
+)
+
+// Failover follows Redis Cluster. Every node judges failures by its own
+// heartbeats. A replica whose master failed waits a moment, longer the
+// more sibling replicas are ahead of it, and then asks the masters for
+// their votes in a new epoch with CLUSTER VOTE. A master votes once per
+// epoch, only for a replica of a master it considers failed itself. With
+// the votes of a majority of the masters serving slots (or of all masters
+// when no slot is assigned) the replica becomes a master, takes over the
+// slots with the new epoch and announces itself. The other replicas, and
+// the old master when it comes back, follow the node that took over.
+
+// Replication is the replication of this node, which failover promotes and
+// points at new masters.
+type Replication interface {
+	ReplicationOffset() int64
+	Promote() error
+	Follow(addr string) error
+}
+
+// SetReplication lets failover reconfigure r. Changes are applied in the
+// background, in the order they were decided.
+func (c *Cluster) SetReplication(r Replication) {
+	c.mu.Lock()
+	c.repl = r
+	c.mu.Unlock()
+	go func() {
+		for {
+			select {
+			case <-c.stop:
+				return
+			case change := <-c.changes:
+				if err := change(r); err != nil {
+					logger.Log("Failed to reconfigure replication: %v", err)
+				}
+			}
+		}
+	}()
+}
+
+// reconfigure queues a change of the replication. c.mu is held.
+func (c *Cluster) reconfigure(change func(Replication) error) {
+	if c.repl != nil {
+		c.changes <- change
+	}
+}
+
+// offset returns the replication offset of this node. c.mu is held.
+func (c *Cluster) offset() int64 {
+	if c.repl == nil {
+		return 0
+	}
+	return c.repl.ReplicationOffset()
+}
+
+func (c *Cluster) nodeByAddr(addr string) *Node {
+	for _, n := range c.nodes {
+		if n.Addr == addr {
+			return n
+		}
+	}
+	return nil
+}
+
+// leader returns this node when it is a master, or its master. c.mu is
+// held.
+func (c *Cluster) leader() *Node {
+	if c.self.Role == RoleMaster {
+		return c.self
+	}
+	return c.nodeByAddr(c.self.Master)
+}
+
+// slotCount returns the number of slots n serves. c.mu is held.
+func (c *Cluster) slotCount(n *Node) int {
+	if n == nil {
+		return 0
+	}
+	count := 0
+	for _, id := range c.owner {
+		if id == n.ID {
+			count++
+		}
+	}
+	return count
+}
+
+// tookOver reports whether master n, whose previous state was prev,
+// replaced lead, this node or its master that had the given number of
+// slots: n was a replica of lead and got promoted in a later epoch, or its
+// claim took the last slots of lead. c.mu is held.
+func (c *Cluster) tookOver(n *Node, prev Node, lead *Node, had int) bool {
+	if n.Role != RoleMaster || n == lead || n.Epoch <= lead.Epoch {
+		return false
+	}
+	promoted := prev.Role == RoleReplica && prev.Master == lead.Addr
+	emptied := had > 0 && c.slotCount(lead) == 0
+	return promoted || emptied
+}
+
+// follow makes this node a replica of n. c.mu is held.
+func (c *Cluster) follow(n *Node) {
+	if c.self.Role == RoleMaster {
+		logger.Log("Node %s took over in epoch %d, becoming its replica", n.ID, n.Epoch)
+	} else {
+		logger.Log("Master failed over to %s in epoch %d, following it", n.ID, n.Epoch)
+	}
+	c.self.Role, c.self.Master = RoleReplica, n.Addr
+	c.election, c.electing = time.Time{}, false
+	addr := n.Addr
+	c.reconfigure(func(r Replication) error { return r.Follow(addr) })
+}
+
+// failedMaster returns the master of this replica when it failed. c.mu is
+// held.
+func (c *Cluster) failedMaster() *Node {
+	if c.self.Role != RoleReplica {
+		return nil
+	}
+	if m := c.nodeByAddr(c.self.Master); m != nil && m.Failed && m.Role == RoleMaster {
+		return m
+	}
+	return nil
+}
+
+// voters returns the masters that decide a failover: those serving slots,
+// or all of them when no slot is assigned. c.mu is held.
+func (c *Cluster) voters() []Node {
+	serving := c.slotsByNode()
+	var voters []Node
+	for _, n := range c.nodes {
+		if n.Role == RoleMaster && (c.assigned == 0 || len(serving[n.ID]) > 0) {
+			voters = append(voters, *n)
+		}
+	}
+	return voters
+}
+
+// checkFailover starts an election when the master of this replica failed.
+func (c *Cluster) checkFailover() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	master := c.failedMaster()
+	if master == nil {
+		c.election = time.Time{}
+		return
+	}
+	now := time.Now()
+	if c.election.IsZero() {
+		// The most up-to-date replica goes first.
+		rank := 0
+		offset := c.offset()
+		for _, n := range c.nodes {
+			if n.Role == RoleReplica && n.Master == master.Addr && !n.Myself && !n.Failed && n.Offset > offset {
+				rank++
+			}
+		}
+		delay := c.heartbeat + time.Duration(2*rank)*c.heartbeat + time.Duration(rand.Int63n(int64(c.heartbeat)))
+		c.election = now.Add(delay)
+		return
+	}
+	if c.electing || now.Before(c.election) {
+		return
+	}
+
+	c.electing = true
+	c.lastElection = max(c.maxEpoch(), c.lastElection) + 1
+	voters := c.voters()
+	go c.elect(c.lastElection, master.ID, voters)
+}
+
+// elect asks voters to let this replica replace the failed master in
+// epoch, and takes over when a majority agrees.
+func (c *Cluster) elect(epoch uint64, masterID string, voters []Node) {
+	self := c.Myself()
+	logger.Log("Master %s failed, requesting votes for epoch %d", masterID, epoch)
+	votes := make(chan bool, len(voters))
+	for _, v := range voters {
+		go func(v Node) {
+			votes <- !v.Failed && c.requestVote(v.Addr, self.ID, epoch, masterID)
+		}(v)
+	}
+	granted := 0
+	for range voters {
+		if <-votes {
+			granted++
+		}
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.electing = false
+	master := c.failedMaster()
+	if granted <= len(voters)/2 || master == nil || master.ID != masterID {
+		logger.Log("Failover election for epoch %d lost with %d of %d votes", epoch, granted, len(voters))
+		// Retry later, in a new epoch, unless the master came back.
+		c.election = time.Now().Add(2 * c.timeout)
+		return
+	}
+
+	c.self.Role, c.self.Master = RoleMaster, ""
+	c.self.Epoch = max(epoch, c.maxEpoch()+1)
+	for slot, id := range c.owner {
+		if id == masterID {
+			c.setOwner(slot, c.self.ID)
+		}
+	}
+	c.election = time.Time{}
+	logger.Log("Won failover election with %d of %d votes, replacing %s in epoch %d", granted, len(voters), masterID, c.self.Epoch)
+	c.reconfigure(func(r Replication) error { return r.Promote() })
+}
+
+// requestVote sends CLUSTER VOTE to the master at addr and reports whether
+// it granted its vote.
+func (c *Cluster) requestVote(addr, candidate string, epoch uint64, masterID string) bool {
+	conn, err := net.DialTimeout("tcp", addr, dialTimeout)
+	if err != nil {
+		return false
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(dialTimeout))
+	if _, err := fmt.Fprintf(conn, "CLUSTER VOTE %s %d %s\r\n", candidate, epoch, masterID); err != nil {
+		return false
+	}
+	line, err := bufio.NewReader(conn).ReadString('\n')
+	return err == nil && strings.TrimSpace(line) == "INTEGER 1"
+}
+
+// Vote answers the request of candidate to replace its failed master in
+// epoch. A master serving slots votes at most once per epoch, only for a
+// replica of a master it considers failed, and only once per failed
+// master within twice the node timeout.
+func (c *Cluster) Vote(candidate string, epoch uint64, masterID string) bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.self.Role != RoleMaster || c.assigned > 0 && c.slotCount(c.self) == 0 {
+		return false
+	}
+	if epoch <= c.lastVote || epoch <= c.maxEpoch() {
+		return false
+	}
+	cand, master := c.nodes[candidate], c.nodes[masterID]
+	if cand == nil || master == nil || cand.Role != RoleReplica || cand.Master != master.Addr || !master.Failed {
+		return false
+	}
+	if at, ok := c.votedFor[masterID]; ok && time.Since(at) < 2*c.timeout {
+		return false
+	}
+	c.lastVote = epoch
+	c.votedFor[masterID] = time.Now()
+	logger.Log("Voted for %s to replace %s in epoch %d", candidate, masterID, epoch)
+	return true
+}
@@ -0,0 +1,361 @@
+package cluster
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+import (
+	logger "boltcache/logger"
+)
+
+// SlotCount is the number of hash slots keys are sharded over, as in
+// Redis Cluster.
+const SlotCount = 16384
+
+var ErrInvalidSlot = errors.New("ERR Invalid or out of range slot")
+
+// crc16Table is CRC-16/XMODEM (polynomial 0x1021), the hash Redis Cluster
+// uses for key slots.
+var crc16Table = func() (t [256]uint16) {
+	for i := range t {
+		crc := uint16(i) << 8
+		for j := 0; j < 8; j++ {
+			if crc&0x8000 != 0 {
+				crc = crc<<1 ^ 0x1021
+			} else {
+				crc <<= 1
+			}
+		}
+		t[i] = crc
+	}
+	return t
+}()
+
+func crc16(b []byte) uint16 {
+	var crc uint16
+	for _, c := range b {
+		crc = crc<<8 ^ crc16Table[byte(crc>>8)^c]
+	}
+	return crc
+}
+
+// KeySlot returns the hash slot of key. When the key contains a non-empty
+// {hashtag}, only the tag is hashed, so related keys share a slot.
+func KeySlot(key []byte) int {
+	if i := bytes.IndexByte(key, '{'); i >= 0 {
+		if j := bytes.IndexByte(key[i+1:], '}'); j > 0 {
+			key = key[i+1 : i+1+j]
+		}
+	}
+	return int(crc16(key) & (SlotCount - 1))
+}
+
+// SlotRange is an inclusive range of slots.
+type SlotRange struct {
+	Start, End int
+}
+
+// slotRanges collapses sorted slots into ranges.
+func slotRanges(slots []int) []SlotRange {
+	var ranges []SlotRange
+	for _, s := range slots {
+		if n := len(ranges); n > 0 && ranges[n-1].End == s-1 {
+			ranges[n-1].End = s
+		} else {
+			ranges = append(ranges, SlotRange{s, s})
+		}
+	}
+	return ranges
+}
+
+// FormatSlots encodes ranges as "0-5460,5461", or "-" when there are none.
+func FormatSlots(ranges []SlotRange) string {
+	if len(ranges) == 0 {
+		return "-"
+	}
+	parts := make([]string, len(ranges))
+	for i, r := range ranges {
+		if r.Start == r.End {
+			parts[i] = strconv.Itoa(r.Start)
+		} else {
+			parts[i] = fmt.Sprintf("%d-%d", r.Start, r.End)
+		}
+	}
+	return strings.Join(parts, ",")
+}
+
+// ParseSlots decodes FormatSlots into a sorted list of slots.
+func ParseSlots(s string) ([]int, error) {
+	if s == "-" || s == "" {
+		return nil, nil
+	}
+	var slots []int
+	for _, part := range strings.Split(s, ",") {
+		lo, hi, isRange := strings.Cut(part, "-")
+		start, err := ParseSlot(lo)
+		if err != nil {
+			return nil, err
+		}
+		end := start
+		if isRange {
+			if end, err = ParseSlot(hi); err != nil || end < start {
+				return nil, ErrInvalidSlot
+			}
+		}
+		for i := start; i <= end; i++ {
+			slots = append(slots, i)
+		}
+	}
+	sort.Ints(slots)
+	return slots, nil
+}
+
+// ParseSlot parses a slot number.
+func ParseSlot(s string) (int, error) {
+	n, err := strconv.Atoi(s)
+	if err != nil || n < 0 || n >= SlotCount {
+		return 0, ErrInvalidSlot
+	}
+	return n, nil
+}
+
+// slotsByNode returns the slots of every node owning some. c.mu is held.
+func (c *Cluster) slotsByNode() map[string][]int {
+	slots := make(map[string][]int)
+	for slot, id := range c.owner {
+		if id != "" {
+			slots[id] = append(slots[id], slot)
+		}
+	}
+	return slots
+}
+
+func (c *Cluster) setOwner(slot int, id string) {
+	switch {
+	case c.owner[slot] == "" && id != "":
+		c.assigned++
+	case c.owner[slot] != "" && id == "":
+		c.assigned--
+	}
+	c.owner[slot] = id
+}
+
+// claim applies the slots node n announced with epoch. A slot held by
+// another node changes hands only when the claim has the higher epoch, or
+// the same epoch and the smaller node ID, so every node settles on the
+// same owner. Slots n no longer announces become unassigned.
+func (c *Cluster) claim(n *Node, epoch uint64, ranges []SlotRange) {
+	n.Epoch = epoch
+	claimed := make(map[int]bool)
+	for _, r := range ranges {
+		for slot := r.Start; slot <= r.End; slot++ {
+			claimed[slot] = true
+			cur, ok := c.nodes[c.owner[slot]]
+			switch {
+			case cur == n:
+				continue
+			case !ok:
+			case cur.Epoch > epoch, cur.Epoch == epoch && cur.ID < n.ID:
+				continue
+			case cur.Myself:
+				logger.Log("Slot %d taken over by node %s", slot, n.ID)
+				delete(c.migrating, slot)
+			}
+			c.setOwner(slot, n.ID)
+			delete(c.importing, slot)
+		}
+	}
+	for slot, id := range c.owner {
+		if id == n.ID && !claimed[slot] {
+			c.setOwner(slot, "")
+		}
+	}
+}
+
+// AddSlots assigns unassigned slots to this node.
+func (c *Cluster) AddSlots(slots []int) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for _, slot := range slots {
+		if c.owner[slot] != "" {
+			return fmt.Errorf("ERR Slot %d is already busy", slot)
+		}
+	}
+	for _, slot := range slots {
+		c.setOwner(slot, c.self.ID)
+	}
+	return nil
+}
+
+// DelSlots makes slots unassigned in this node's view. Owners that still
+// announce them get them back with their next heartbeat.
+func (c *Cluster) DelSlots(slots []int) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for _, slot := range slots {
+		if c.owner[slot] == "" {
+			return fmt.Errorf("ERR Slot %d is already unassigned", slot)
+		}
+	}
+	for _, slot := range slots {
+		c.setOwner(slot, "")
+		delete(c.migrating, slot)
+		delete(c.importing, slot)
+	}
+	return nil
+}
+
+// SetSlotNode assigns slot to the node with the given ID. Taking a slot
+// over bumps this node's epoch past every epoch it knows, so its claim
+// wins over the previous owner's.
+func (c *Cluster) SetSlotNode(slot int, id string) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	n, ok := c.nodes[id]
+	if !ok {
+		return fmt.Errorf("ERR Unknown node %s", id)
+	}
+	if n.Role != RoleMaster {
+		return errors.New("ERR Target node is not a master")
+	}
+	if n.Myself && c.owner[slot] != id {
+		c.bumpEpoch()
+	}
+	c.setOwner(slot, id)
+	delete(c.migrating, slot)
+	delete(c.importing, slot)
+	return nil
+}
+
+// SetSlotMigrating marks slot, which this node serves, as moving to the
+// node with the given ID. Keys of the slot this node no longer has are
+// answered with ASK redirections to it.
+func (c *Cluster) SetSlotMigrating(slot int, id string) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.owner[slot] != c.self.ID {
+		return fmt.Errorf("ERR I'm not the owner of hash slot %d", slot)
+	}
+	n, ok := c.nodes[id]
+	if !ok {
+		return fmt.Errorf("ERR Unknown node %s", id)
+	}
+	if n.Myself {
+		return errors.New("ERR Target node is myself")
+	}
+	if n.Role != RoleMaster {
+		return errors.New("ERR Target node is not a master")
+	}
+	c.migrating[slot] = id
+	return nil
+}
+
+// SetSlotImporting marks slot as moving to this node from the node with
+// the given ID. Commands preceded by ASKING are served for it.
+func (c *Cluster) SetSlotImporting(slot int, id string) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.owner[slot] == c.self.ID {
+		return fmt.Errorf("ERR I'm already the owner of hash slot %d", slot)
+	}
+	n, ok := c.nodes[id]
+	if !ok {
+		return fmt.Errorf("ERR Unknown node %s", id)
+	}
+	if n.Myself {
+		return errors.New("ERR Source node is myself")
+	}
+	c.importing[slot] = id
+	return nil
+}
+
+// SetSlotStable clears the migrating and importing state of slot.
+func (c *Cluster) SetSlotStable(slot int) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	delete(c.migrating, slot)
+	delete(c.importing, slot)
+}
+
+// OpenSlots returns the slots being migrated away and imported, with the
+// ID of the target and source node.
+func (c *Cluster) OpenSlots() (migrating, importing map[int]string) {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	migrating = make(map[int]string, len(c.migrating))
+	for slot, id := range c.migrating {
+		migrating[slot] = id
+	}
+	importing = make(map[int]string, len(c.importing))
+	for slot, id := range c.importing {
+		importing[slot] = id
+	}
+	return migrating, importing
+}
+
+// BumpEpoch moves this node's epoch past every epoch it knows and returns
+// it.
+func (c *Cluster) BumpEpoch() uint64 {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.bumpEpoch()
+}
+
+func (c *Cluster) bumpEpoch() uint64 {
+	c.self.Epoch = c.maxEpoch() + 1
+	return c.self.Epoch
+}
+
+// CurrentEpoch returns the highest epoch known.
+func (c *Cluster) CurrentEpoch() uint64 {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	return c.maxEpoch()
+}
+
+func (c *Cluster) maxEpoch() uint64 {
+	var max uint64
+	for _, n := range c.nodes {
+		if n.Epoch > max {
+			max = n.Epoch
+		}
+	}
+	return max
+}
+
+// SlotsAssigned returns the number of slots with an owner. A cluster
+// without assigned slots isn't sharded: every node serves every key.
+func (c *Cluster) SlotsAssigned() int {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	return c.assigned
+}
+
+// SlotRoute describes who serves a slot. IDs are empty where unset.
+type SlotRoute struct {
+	Owner     Node
+	Migrating Node // target, while this node moves the slot away
+	Importing Node // source, while this node takes the slot over
+}
+
+// Route returns who serves slot.
+func (c *Cluster) Route(slot int) SlotRoute {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	var r SlotRoute
+	if n, ok := c.nodes[c.owner[slot]]; ok {
+		r.Owner = *n
+	}
+	if n, ok := c.nodes[c.migrating[slot]]; ok {
+		r.Migrating = *n
+	}
+	if n, ok := c.nodes[c.importing[slot]]; ok {
+		r.Importing = *n
+	}
+	return r
+}
@@ -0,0 +1,81 @@
+package cluster
+
+import (
+	"reflect"
+	"testing"
+)
+
+import (
+	config "boltcache/config"
+)
+
+func TestKeySlot(t *testing.T) {
+	if got := crc16([]byte("123456789")); got != 0x31C3 {
+		t.Fatalf("crc16 = %x", got)
+	}
+	for key, want := range map[string]int{
+		"foo":                  12182,
+		"somekey":              11058,
+		"{user1000}.following": 3443,
+		"{user1000}.followers": 3443,
+		"{}":                   15257,
+	} {
+		if got := KeySlot([]byte(key)); got != want {
+			t.Errorf("KeySlot(%q) = %d, want %d", key, got, want)
+		}
+	}
+	if KeySlot([]byte("foo{}{bar}")) == KeySlot([]byte("bar")) {
+		t.Error("empty hashtag was skipped")
+	}
+}
+
+func TestSlotRanges(t *testing.T) {
+	slots, err := ParseSlots("5-7,0,9")
+	if err != nil || !reflect.DeepEqual(slots, []int{0, 5, 6, 7, 9}) {
+		t.Fatalf("got %v, %v", slots, err)
+	}
+	if s := FormatSlots(slotRanges(slots)); s != "0,5-7,9" {
+		t.Fatalf("formatted %q", s)
+	}
+	for _, bad := range []string{"16384", "3-1", "x"} {
+		if _, err := ParseSlots(bad); err == nil {
+			t.Errorf("%q parsed", bad)
+		}
+	}
+}
+
+func TestSlotClaims(t *testing.T) {
+	c := New("b", "h:2", RoleMaster, "", config.ClusterConfig{})
+	if err := c.AddSlots([]int{0, 1, 2}); err != nil {
+		t.Fatal(err)
+	}
+	if err := c.AddSlots([]int{2}); err == nil {
+		t.Fatal("busy slot added")
+	}
+
+	// Equal epochs: the smaller ID wins.
+	c.Heard(Node{ID: "a", Addr: "h:1", Role: RoleMaster, Slots: []SlotRange{{2, 3}}})
+	// A lower epoch loses to a higher one.
+	c.Heard(Node{ID: "z", Addr: "h:3", Role: RoleMaster, Epoch: 0, Slots: []SlotRange{{1, 1}}})
+	if got := c.Route(2).Owner.ID; got != "a" {
+		t.Fatalf("slot 2 owned by %q", got)
+	}
+	if got := c.Route(1).Owner.ID; got != "b" {
+		t.Fatalf("slot 1 owned by %q", got)
+	}
+
+	// Taking a slot over bumps the epoch, so the claim sticks.
+	if err := c.SetSlotNode(3, "b"); err != nil {
+		t.Fatal(err)
+	}
+	c.Heard(Node{ID: "a", Addr: "h:1", Role: RoleMaster, Slots: []SlotRange{{2, 3}}})
+	if self := c.Myself(); self.Epoch != 1 || !reflect.DeepEqual(self.Slots, []SlotRange{{0, 1}, {3, 3}}) {
+		t.Fatalf("self %+v", self)
+	}
+
+	// Slots a node stops announcing become unassigned.
+	c.Heard(Node{ID: "a", Addr: "h:1", Role: RoleMaster})
+	if c.Route(2).Owner.ID != "" || c.SlotsAssigned() != 3 {
+		t.Fatalf("slot 2 owned by %q, %d assigned", c.Route(2).Owner.ID, c.SlotsAssigned())
+	}
+}
@@ -0,0 +1,145 @@
+package discovery
+
+import (
+	"fmt"
+	"sync"
+	"time"
+)
+
+import (
+	config "boltcache/config"
+	logger "boltcache/logger"
+)
+
+// Discoverer finds the nodes of the cluster.
+type Discoverer interface {
+	// Peers returns the TCP addresses of the nodes found, this node's
+	// possibly included.
+	Peers() ([]string, error)
+}
+
+// Registry is a Discoverer nodes announce themselves to. A registration
+// expires unless renewed within its ttl, so nodes that die drop out.
+type Registry interface {
+	Discoverer
+	// Register announces the node id at addr, or renews its registration.
+	Register(id, addr string, ttl time.Duration) error
+	// Deregister removes the registration.
+	Deregister() error
+}
+
+// Notifier is a Discoverer that also tells when its peers may have
+// changed, between the periodic lookups.
+type Notifier interface {
+	Discoverer
+	Changes(stop <-chan struct{}) <-chan struct{}
+}
+
+// New returns the Discoverer of cfg.
+func New(cfg config.DiscoveryConfig) (Discoverer, error) {
+	switch cfg.Method {
+	case "", "static":
+		return Static(cfg.Endpoints), nil
+	case "dns":
+		return &SRV{Names: cfg.Endpoints}, nil
+	case "file":
+		return &File{Paths: cfg.Endpoints}, nil
+	case "consul":
+		return NewConsul(cfg.Endpoints, cfg.Prefix), nil
+	case "etcd":
+		return NewEtcd(cfg.Endpoints, cfg.Prefix), nil
+	}
+	return nil, fmt.Errorf("unknown discovery method %q", cfg.Method)
+}
+
+// Static is a fixed list of node addresses.
+type Static []string
+
+func (s Static) Peers() ([]string, error) {
+	return append([]string(nil), s...), nil
+}
+
+// Watcher looks up the peers periodically, and keeps this node registered
+// when the Discoverer is a Registry.
+type Watcher struct {
+	d        Discoverer
+	id, addr string
+	interval time.Duration
+	found    func(peers []string)
+
+	stop     chan struct{}
+	done     chan struct{}
+	stopOnce sync.Once
+}
+
+// Watch registers the node id at addr, then calls found with the other
+// peers every interval, and whenever a Notifier reports a change.
+func Watch(d Discoverer, id, addr string, interval time.Duration, found func(peers []string)) *Watcher {
+	if interval <= 0 {
+		interval = 10 * time.Second
+	}
+	w := &Watcher{
+		d:        d,
+		id:       id,
+		addr:     addr,
+		interval: interval,
+		found:    found,
+		stop:     make(chan struct{}),
+		done:     make(chan struct{}),
+	}
+	go w.run()
+	return w
+}
+
+// Stop stops the lookups and removes the registration.
+func (w *Watcher) Stop() {
+	w.stopOnce.Do(func() {
+		close(w.stop)
+		<-w.done
+		if r, ok := w.d.(Registry); ok {
+			if err := r.Deregister(); err != nil {
+				logger.Log("Failed to deregister from discovery: %v", err)
+			}
+		}
+	})
+}
+
+func (w *Watcher) run() {
+	defer close(w.done)
+	var changes <-chan struct{}
+	if n, ok := w.d.(Notifier); ok {
+		changes = n.Changes(w.stop)
+	}
+	ticker := time.NewTicker(w.interval)
+	defer ticker.Stop()
+	for {
+		w.lookup()
+		select {
+		case <-w.stop:
+			return
+		case <-ticker.C:
+		case <-changes:
+		}
+	}
+}
+
+func (w *Watcher) lookup() {
+	if r, ok := w.d.(Registry); ok {
+		// Three intervals leave room for a failed renewal or two.
+		if err := r.Register(w.id, w.addr, 3*w.interval); err != nil {
+			logger.Log("Failed to register with discovery: %v", err)
+		}
+	}
+	peers, err := w.d.Peers()
+	if err != nil {
+		logger.Log("Failed to discover nodes: %v", err)
+		return
+	}
+	others := peers[:0]
+	for _, p := range peers {
+		if p != w.addr {
+			others = append(others, p)
+		}
+	}
+	w.found(others)
+}
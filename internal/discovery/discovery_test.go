@@ -0,0 +1,250 @@
+package discovery
+
+import (
+	"context"
+	"encoding/json"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// kvStub serves the Consul and etcd v3 gateway calls of the registries
+// from memory. Sessions and leases are the same thing here.
+type kvStub struct {
+	mu     sync.Mutex
+	data   map[string]string
+	owner  map[string]string // key -> session or lease
+	leases map[string]bool
+	next   int
+}
+
+func newKVStub(t *testing.T) (*kvStub, *httptest.Server) {
+	s := &kvStub{data: make(map[string]string), owner: make(map[string]string), leases: make(map[string]bool)}
+	srv := httptest.NewServer(s)
+	t.Cleanup(srv.Close)
+	return s, srv
+}
+
+func (s *kvStub) grant() string {
+	s.next++
+	id := strconv.Itoa(s.next)
+	s.leases[id] = true
+	return id
+}
+
+// expire drops a session or lease with its keys.
+func (s *kvStub) expire(id string) {
+	delete(s.leases, id)
+	for k, owner := range s.owner {
+		if owner == id {
+			delete(s.data, k)
+			delete(s.owner, k)
+		}
+	}
+}
+
+func (s *kvStub) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	var req struct {
+		ID       string `json:"ID"`
+		Key      []byte `json:"key"`
+		RangeEnd []byte `json:"range_end"`
+		Value    []byte `json:"value"`
+		Lease    string `json:"lease"`
+	}
+	if strings.HasPrefix(r.URL.Path, "/v3/") {
+		json.NewDecoder(r.Body).Decode(&req)
+	}
+	reply := func(v interface{}) { json.NewEncoder(w).Encode(v) }
+	path := r.URL.Path
+	switch {
+	case path == "/v1/session/create":
+		reply(map[string]string{"ID": s.grant()})
+	case strings.HasPrefix(path, "/v1/session/renew/"):
+		if !s.leases[strings.TrimPrefix(path, "/v1/session/renew/")] {
+			http.NotFound(w, r)
+			return
+		}
+		reply([]struct{}{{}})
+	case strings.HasPrefix(path, "/v1/session/destroy/"):
+		s.expire(strings.TrimPrefix(path, "/v1/session/destroy/"))
+		reply(true)
+	case strings.HasPrefix(path, "/v1/kv/") && r.Method == "PUT":
+		key, session := strings.TrimPrefix(path, "/v1/kv/"), r.URL.Query().Get("acquire")
+		if !s.leases[session] {
+			http.Error(w, "invalid session", http.StatusInternalServerError)
+			return
+		}
+		if owner, ok := s.owner[key]; ok && owner != session {
+			reply(false)
+			return
+		}
+		value, _ := io.ReadAll(r.Body)
+		s.data[key], s.owner[key] = string(value), session
+		reply(true)
+	case strings.HasPrefix(path, "/v1/kv/"):
+		prefix := strings.TrimPrefix(path, "/v1/kv/")
+		var pairs []map[string]interface{}
+		for k, v := range s.data {
+			if strings.HasPrefix(k, prefix) {
+				pairs = append(pairs, map[string]interface{}{"Key": k, "Value": []byte(v)})
+			}
+		}
+		if len(pairs) == 0 {
+			http.NotFound(w, r)
+			return
+		}
+		reply(pairs)
+	case path == "/v3/lease/grant":
+		reply(map[string]string{"ID": s.grant(), "TTL": "30"})
+	case path == "/v3/lease/keepalive":
+		ttl := "0"
+		if s.leases[req.ID] {
+			ttl = "30"
+		}
+		reply(map[string]interface{}{"result": map[string]string{"ID": req.ID, "TTL": ttl}})
+	case path == "/v3/lease/revoke":
+		s.expire(req.ID)
+		reply(struct{}{})
+	case path == "/v3/kv/put":
+		if !s.leases[req.Lease] {
+			http.Error(w, "requested lease not found", http.StatusBadRequest)
+			return
+		}
+		s.data[string(req.Key)], s.owner[string(req.Key)] = string(req.Value), req.Lease
+		reply(struct{}{})
+	case path == "/v3/kv/range":
+		var kvs []etcdKV
+		for k, v := range s.data {
+			if k >= string(req.Key) && k < string(req.RangeEnd) {
+				kvs = append(kvs, etcdKV{Key: []byte(k), Value: []byte(v)})
+			}
+		}
+		reply(map[string]interface{}{"kvs": kvs})
+	default:
+		http.NotFound(w, r)
+	}
+}
+
+func sortedPeers(t *testing.T, d Discoverer) []string {
+	t.Helper()
+	peers, err := d.Peers()
+	if err != nil {
+		t.Fatal(err)
+	}
+	sort.Strings(peers)
+	return peers
+}
+
+func expectPeers(t *testing.T, d Discoverer, want ...string) {
+	t.Helper()
+	if got := sortedPeers(t, d); strings.Join(got, " ") != strings.Join(want, " ") {
+		t.Fatalf("peers %q, want %q", got, want)
+	}
+}
+
+func TestRegistries(t *testing.T) {
+	for _, method := range []string{"consul", "etcd"} {
+		t.Run(method, func(t *testing.T) {
+			stub, srv := newKVStub(t)
+			// The first endpoint is down; the registries fall back to the next.
+			endpoints := []string{"127.0.0.1:1", srv.URL}
+			newRegistry := func() Registry {
+				if method == "consul" {
+					return NewConsul(endpoints, "boltcache/nodes/")
+				}
+				return NewEtcd(endpoints, "boltcache/nodes/")
+			}
+			a, b := newRegistry(), newRegistry()
+			expectPeers(t, a)
+
+			for _, r := range []struct {
+				reg      Registry
+				id, addr string
+			}{{a, "a", "10.0.0.1:6380"}, {b, "b", "10.0.0.2:6380"}} {
+				if err := r.reg.Register(r.id, r.addr, time.Second); err != nil {
+					t.Fatal(err)
+				}
+			}
+			expectPeers(t, a, "10.0.0.1:6380", "10.0.0.2:6380")
+
+			// An expired registration is renewed with a new session or lease.
+			stub.mu.Lock()
+			stub.expire(stub.owner["boltcache/nodes/b"])
+			stub.mu.Unlock()
+			expectPeers(t, a, "10.0.0.1:6380")
+			if err := b.Register("b", "10.0.0.2:6380", time.Second); err != nil {
+				t.Fatal(err)
+			}
+			expectPeers(t, a, "10.0.0.1:6380", "10.0.0.2:6380")
+
+			if err := a.Deregister(); err != nil {
+				t.Fatal(err)
+			}
+			expectPeers(t, b, "10.0.0.2:6380")
+		})
+	}
+}
+
+func TestSRV(t *testing.T) {
+	d := &SRV{Names: []string{"_boltcache._tcp.example.com"}}
+	d.lookup = func(ctx context.Context, name string) ([]*net.SRV, error) {
+		if name != "_boltcache._tcp.example.com" {
+			return nil, &net.DNSError{Err: "no such host", Name: name, IsNotFound: true}
+		}
+		return []*net.SRV{{Target: "node1.example.com.", Port: 6380}, {Target: "node2.example.com.", Port: 6381}}, nil
+	}
+	expectPeers(t, d, "node1.example.com:6380", "node2.example.com:6381")
+}
+
+func TestFileWatch(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "nodes")
+	if err := os.WriteFile(path, []byte("# cluster nodes\n10.0.0.1:6380 10.0.0.2:6380\n\n10.0.0.3:6380 # new\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	d := &File{Paths: []string{path}}
+	expectPeers(t, d, "10.0.0.1:6380", "10.0.0.2:6380", "10.0.0.3:6380")
+
+	// The watcher looks up the peers again as soon as the file changes.
+	found := make(chan []string, 10)
+	w := Watch(d, "a", "10.0.0.1:6380", time.Hour, func(peers []string) { found <- peers })
+	defer w.Stop()
+	if peers := <-found; !reflect.DeepEqual(peers, []string{"10.0.0.2:6380", "10.0.0.3:6380"}) {
+		t.Fatalf("first lookup %q", peers)
+	}
+	if err := os.WriteFile(path, []byte("10.0.0.1:6380\n10.0.0.4:6380\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case peers := <-found:
+		if !reflect.DeepEqual(peers, []string{"10.0.0.4:6380"}) {
+			t.Fatalf("lookup after the change %q", peers)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("file change not noticed")
+	}
+}
+
+func TestWatchRegisters(t *testing.T) {
+	_, srv := newKVStub(t)
+	d := NewEtcd([]string{srv.URL}, "boltcache/nodes/")
+	found := make(chan []string, 10)
+	w := Watch(d, "a", "10.0.0.1:6380", time.Hour, func(peers []string) { found <- peers })
+	if peers := <-found; len(peers) != 0 {
+		t.Fatalf("found %q, not only this node", peers)
+	}
+	expectPeers(t, d, "10.0.0.1:6380")
+	w.Stop()
+	expectPeers(t, d)
+}
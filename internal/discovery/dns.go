@@ -0,0 +1,45 @@
+package discovery
+
+import (
+	"context"
+	"net"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// lookupTimeout bounds a DNS or HTTP request.
+const lookupTimeout = 5 * time.Second
+
+// SRV finds the nodes through DNS SRV records, e.g.
+// _boltcache._tcp.example.com, each naming the host and TCP port of a
+// node.
+type SRV struct {
+	Names []string
+
+	lookup func(ctx context.Context, name string) ([]*net.SRV, error) // for tests
+}
+
+func (s *SRV) Peers() ([]string, error) {
+	lookup := s.lookup
+	if lookup == nil {
+		lookup = func(ctx context.Context, name string) ([]*net.SRV, error) {
+			_, records, err := net.DefaultResolver.LookupSRV(ctx, "", "", name)
+			return records, err
+		}
+	}
+	var peers []string
+	for _, name := range s.Names {
+		ctx, cancel := context.WithTimeout(context.Background(), lookupTimeout)
+		records, err := lookup(ctx, name)
+		cancel()
+		if err != nil {
+			return nil, err
+		}
+		for _, r := range records {
+			host := strings.TrimSuffix(r.Target, ".")
+			peers = append(peers, net.JoinHostPort(host, strconv.Itoa(int(r.Port))))
+		}
+	}
+	return peers, nil
+}
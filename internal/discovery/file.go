@@ -0,0 +1,70 @@
+package discovery
+
+import (
+	"fmt"
+	"os"
+	"strings"
+	"time"
+)
+
+// filePoll is how often File checks its files for changes.
+const filePoll = time.Second
+
+// File reads the node addresses from files, separated by spaces or lines;
+// "#" starts a comment. The files are watched, so editing one is picked
+// up within a second.
+type File struct {
+	Paths []string
+}
+
+func (f *File) Peers() ([]string, error) {
+	var peers []string
+	for _, path := range f.Paths {
+		data, err := os.ReadFile(path)
+		if err != nil {
+			return nil, err
+		}
+		for _, line := range strings.Split(string(data), "\n") {
+			line, _, _ = strings.Cut(line, "#")
+			peers = append(peers, strings.Fields(line)...)
+		}
+	}
+	return peers, nil
+}
+
+// Changes signals when a file was modified, created or removed.
+func (f *File) Changes(stop <-chan struct{}) <-chan struct{} {
+	changes := make(chan struct{}, 1)
+	last := f.stat()
+	go func() {
+		ticker := time.NewTicker(filePoll)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-stop:
+				return
+			case <-ticker.C:
+			}
+			if cur := f.stat(); cur != last {
+				last = cur
+				select {
+				case changes <- struct{}{}:
+				default:
+				}
+			}
+		}
+	}()
+	return changes
+}
+
+// stat sums up the size and modification time of the files.
+func (f *File) stat() string {
+	var b strings.Builder
+	for _, path := range f.Paths {
+		if fi, err := os.Stat(path); err == nil {
+			fmt.Fprintf(&b, "%d %d", fi.ModTime().UnixNano(), fi.Size())
+		}
+		b.WriteByte('\n')
+	}
+	return b.String()
+}
@@ -0,0 +1,259 @@
+package discovery
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Consul and Etcd keep the nodes in a key-value store: each node puts its
+// address under prefix+id, attached to a Consul session or an etcd lease
+// that expires when the node stops renewing it, and the nodes are the
+// values under the prefix.
+
+var errNotFound = errors.New("not found")
+
+// httpAPI sends JSON requests to the first of its endpoints that answers.
+type httpAPI struct {
+	endpoints []string
+	client    *http.Client
+}
+
+func newHTTPAPI(endpoints []string) httpAPI {
+	var urls []string
+	for _, e := range endpoints {
+		if !strings.Contains(e, "://") {
+			e = "http://" + e
+		}
+		urls = append(urls, strings.TrimSuffix(e, "/"))
+	}
+	return httpAPI{endpoints: urls, client: &http.Client{Timeout: lookupTimeout}}
+}
+
+// call sends body, JSON encoded unless it is a string, and decodes the
+// response into out. A 404 returns errNotFound.
+func (h httpAPI) call(method, path string, body, out interface{}) error {
+	var payload []byte
+	switch b := body.(type) {
+	case nil:
+	case string:
+		payload = []byte(b)
+	default:
+		var err error
+		if payload, err = json.Marshal(b); err != nil {
+			return err
+		}
+	}
+	var lastErr error
+	for _, endpoint := range h.endpoints {
+		req, err := http.NewRequest(method, endpoint+path, bytes.NewReader(payload))
+		if err != nil {
+			return err
+		}
+		resp, err := h.client.Do(req)
+		if err != nil {
+			lastErr = err
+			continue
+		}
+		data, err := io.ReadAll(resp.Body)
+		resp.Body.Close()
+		switch {
+		case err != nil:
+			lastErr = err
+			continue
+		case resp.StatusCode == http.StatusNotFound:
+			return errNotFound
+		case resp.StatusCode/100 != 2:
+			return fmt.Errorf("%s %s: %s: %s", method, path, resp.Status, bytes.TrimSpace(data))
+		}
+		if out == nil {
+			return nil
+		}
+		return json.Unmarshal(data, out)
+	}
+	if lastErr == nil {
+		lastErr = errors.New("no endpoints")
+	}
+	return lastErr
+}
+
+// Consul registers the nodes in the Consul KV store.
+type Consul struct {
+	api    httpAPI
+	prefix string
+
+	mu      sync.Mutex
+	session string
+}
+
+func NewConsul(endpoints []string, prefix string) *Consul {
+	return &Consul{api: newHTTPAPI(endpoints), prefix: strings.TrimPrefix(prefix, "/")}
+}
+
+func (c *Consul) Register(id, addr string, ttl time.Duration) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.session != "" {
+		err := c.api.call("PUT", "/v1/session/renew/"+c.session, nil, nil)
+		if err == errNotFound {
+			c.session = ""
+		} else if err != nil {
+			return err
+		}
+	}
+	if c.session == "" {
+		// Consul refuses session TTLs under 10s.
+		ttl = max(ttl, 10*time.Second)
+		var created struct{ ID string }
+		body := map[string]string{"Name": "boltcache " + id, "TTL": ttl.String(), "Behavior": "delete"}
+		if err := c.api.call("PUT", "/v1/session/create", body, &created); err != nil {
+			return err
+		}
+		c.session = created.ID
+	}
+	var acquired bool
+	path := "/v1/kv/" + c.prefix + url.PathEscape(id) + "?acquire=" + url.QueryEscape(c.session)
+	if err := c.api.call("PUT", path, addr, &acquired); err != nil {
+		return err
+	}
+	if !acquired {
+		return fmt.Errorf("node %s is registered by another session", id)
+	}
+	return nil
+}
+
+func (c *Consul) Deregister() error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.session == "" {
+		return nil
+	}
+	// The session deletes the key with it.
+	err := c.api.call("PUT", "/v1/session/destroy/"+c.session, nil, nil)
+	c.session = ""
+	return err
+}
+
+func (c *Consul) Peers() ([]string, error) {
+	var pairs []struct {
+		Key   string
+		Value []byte // base64 in JSON
+	}
+	err := c.api.call("GET", "/v1/kv/"+c.prefix+"?recurse=true", nil, &pairs)
+	if err == errNotFound {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	var peers []string
+	for _, p := range pairs {
+		if len(p.Value) > 0 {
+			peers = append(peers, string(p.Value))
+		}
+	}
+	return peers, nil
+}
+
+// Etcd registers the nodes in etcd through its v3 JSON gateway.
+type Etcd struct {
+	api    httpAPI
+	prefix string
+
+	mu    sync.Mutex
+	lease string
+}
+
+func NewEtcd(endpoints []string, prefix string) *Etcd {
+	return &Etcd{api: newHTTPAPI(endpoints), prefix: prefix}
+}
+
+// etcdKV is a key-value pair of the gateway; bytes are base64 in JSON and
+// 64-bit integers are strings.
+type etcdKV struct {
+	Key   []byte `json:"key"`
+	Value []byte `json:"value,omitempty"`
+	Lease string `json:"lease,omitempty"`
+}
+
+func (e *Etcd) Register(id, addr string, ttl time.Duration) error {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	if e.lease != "" {
+		var kept struct {
+			Result struct {
+				TTL string `json:"TTL"`
+			} `json:"result"`
+		}
+		if err := e.api.call("POST", "/v3/lease/keepalive", map[string]string{"ID": e.lease}, &kept); err != nil {
+			return err
+		}
+		if n, _ := strconv.ParseInt(kept.Result.TTL, 10, 64); n <= 0 {
+			e.lease = "" // expired
+		}
+	}
+	if e.lease == "" {
+		var granted struct {
+			ID string `json:"ID"`
+		}
+		seconds := int64((ttl + time.Second - 1) / time.Second)
+		if err := e.api.call("POST", "/v3/lease/grant", map[string]int64{"TTL": seconds}, &granted); err != nil {
+			return err
+		}
+		e.lease = granted.ID
+	}
+	return e.api.call("POST", "/v3/kv/put", etcdKV{Key: []byte(e.prefix + id), Value: []byte(addr), Lease: e.lease}, nil)
+}
+
+func (e *Etcd) Deregister() error {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	if e.lease == "" {
+		return nil
+	}
+	// Revoking the lease deletes the key with it.
+	err := e.api.call("POST", "/v3/lease/revoke", map[string]string{"ID": e.lease}, nil)
+	e.lease = ""
+	return err
+}
+
+func (e *Etcd) Peers() ([]string, error) {
+	req := map[string]string{
+		"key":       base64.StdEncoding.EncodeToString([]byte(e.prefix)),
+		"range_end": base64.StdEncoding.EncodeToString(prefixEnd([]byte(e.prefix))),
+	}
+	var resp struct {
+		KVs []etcdKV `json:"kvs"`
+	}
+	if err := e.api.call("POST", "/v3/kv/range", req, &resp); err != nil {
+		return nil, err
+	}
+	var peers []string
+	for _, kv := range resp.KVs {
+		if len(kv.Value) > 0 {
+			peers = append(peers, string(kv.Value))
+		}
+	}
+	return peers, nil
+}
+
+// prefixEnd returns the end of the key range starting with prefix.
+func prefixEnd(prefix []byte) []byte {
+	end := bytes.Clone(prefix)
+	for i := len(end) - 1; i >= 0; i-- {
+		if end[i] < 0xff {
+			end[i]++
+			return end[:i+1]
+		}
+	}
+	return []byte{0} // all keys
+}
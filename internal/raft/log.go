@@ -0,0 +1,307 @@
+package raft
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"os"
+	"path/filepath"
+)
+
+// Entry is a record of the replicated log.
+type Entry struct {
+	Index  uint64
+	Term   uint64
+	Origin string // node the proposal came from, "" for a leader's no-op
+	Seq    uint64 // proposal number at Origin
+	Data   []byte // nil for a no-op
+}
+
+var crc32c = crc32.MakeTable(crc32.Castagnoli)
+
+var errCorrupt = errors.New("corrupt raft record")
+
+// storage keeps the state a node must not lose in dir: the term and vote
+// in "state", the last snapshot in "snapshot" and the entries after it in
+// "log". Log records are framed like snapshot records:
+//
+//	record   length:uvarint payload crc:u32
+//	payload  index:uvarint term:uvarint origin:bytes seq:uvarint data:bytes
+//
+// Without a directory nothing is kept, which only suits tests.
+type storage struct {
+	dir string
+	log *os.File
+	buf []byte
+}
+
+func openStorage(dir string) (*storage, error) {
+	s := &storage{dir: dir}
+	if dir == "" {
+		return s, nil
+	}
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, err
+	}
+	f, err := os.OpenFile(filepath.Join(dir, "log"), os.O_RDWR|os.O_CREATE, 0644)
+	if err != nil {
+		return nil, err
+	}
+	s.log = f
+	return s, nil
+}
+
+func (s *storage) close() {
+	if s.log != nil {
+		s.log.Close()
+	}
+}
+
+func (s *storage) loadState() (term uint64, vote string, err error) {
+	if s.dir == "" {
+		return 0, "", nil
+	}
+	data, err := os.ReadFile(filepath.Join(s.dir, "state"))
+	if os.IsNotExist(err) {
+		return 0, "", nil
+	}
+	if err != nil {
+		return 0, "", err
+	}
+	if _, err := fmt.Sscan(string(data), &term, &vote); err != nil && err != io.EOF {
+		return 0, "", fmt.Errorf("invalid raft state: %v", err)
+	}
+	if vote == "-" {
+		vote = ""
+	}
+	return term, vote, nil
+}
+
+func (s *storage) saveState(term uint64, vote string) error {
+	if s.dir == "" {
+		return nil
+	}
+	if vote == "" {
+		vote = "-"
+	}
+	return writeFileAtomic(filepath.Join(s.dir, "state"), []byte(fmt.Sprintf("%d %s\n", term, vote)))
+}
+
+// loadSnapshot returns the last snapshot, or nil data when there is none.
+func (s *storage) loadSnapshot() (index, term uint64, data []byte, err error) {
+	if s.dir == "" {
+		return 0, 0, nil, nil
+	}
+	b, err := os.ReadFile(filepath.Join(s.dir, "snapshot"))
+	if os.IsNotExist(err) {
+		return 0, 0, nil, nil
+	}
+	if err != nil {
+		return 0, 0, nil, err
+	}
+	if len(b) < 16 {
+		return 0, 0, nil, errCorrupt
+	}
+	return binary.LittleEndian.Uint64(b), binary.LittleEndian.Uint64(b[8:]), b[16:], nil
+}
+
+func (s *storage) saveSnapshot(index, term uint64, data []byte) error {
+	if s.dir == "" {
+		return nil
+	}
+	b := binary.LittleEndian.AppendUint64(make([]byte, 0, 16+len(data)), index)
+	b = binary.LittleEndian.AppendUint64(b, term)
+	return writeFileAtomic(filepath.Join(s.dir, "snapshot"), append(b, data...))
+}
+
+// loadLog reads the log. A torn record at the end, left by a crash in the
+// middle of an append, is cut off.
+func (s *storage) loadLog() ([]Entry, error) {
+	if s.log == nil {
+		return nil, nil
+	}
+	if _, err := s.log.Seek(0, io.SeekStart); err != nil {
+		return nil, err
+	}
+	r := bufio.NewReader(s.log)
+	var entries []Entry
+	var good int64
+	for {
+		e, n, err := readRecord(r)
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			if err := s.log.Truncate(good); err != nil {
+				return nil, err
+			}
+			break
+		}
+		entries = append(entries, e)
+		good += int64(n)
+	}
+	_, err := s.log.Seek(good, io.SeekStart)
+	return entries, err
+}
+
+// append adds entries to the log and syncs it. On failure the log is cut
+// back to where it ended, so it never keeps entries that weren't stored.
+func (s *storage) append(entries []Entry) error {
+	if s.log == nil || len(entries) == 0 {
+		return nil
+	}
+	s.buf = s.buf[:0]
+	for i := range entries {
+		s.buf = appendRecord(s.buf, &entries[i])
+	}
+	end, err := s.log.Seek(0, io.SeekCurrent)
+	if err != nil {
+		return err
+	}
+	if _, err = s.log.Write(s.buf); err == nil {
+		err = s.log.Sync()
+	}
+	if err != nil {
+		s.log.Truncate(end)
+		s.log.Seek(end, io.SeekStart)
+	}
+	return err
+}
+
+// rewrite replaces the log with entries, after a conflict truncated it or
+// a snapshot compacted it.
+func (s *storage) rewrite(entries []Entry) error {
+	if s.log == nil {
+		return nil
+	}
+	var buf []byte
+	for i := range entries {
+		buf = appendRecord(buf, &entries[i])
+	}
+	path := filepath.Join(s.dir, "log")
+	if err := writeFileAtomic(path, buf); err != nil {
+		return err
+	}
+	f, err := os.OpenFile(path, os.O_RDWR, 0644)
+	if err != nil {
+		return err
+	}
+	if _, err := f.Seek(0, io.SeekEnd); err != nil {
+		f.Close()
+		return err
+	}
+	s.log.Close()
+	s.log = f
+	return nil
+}
+
+func appendRecord(b []byte, e *Entry) []byte {
+	p := appendEntry(nil, e)
+	b = binary.AppendUvarint(b, uint64(len(p)))
+	b = append(b, p...)
+	return binary.LittleEndian.AppendUint32(b, crc32.Checksum(p, crc32c))
+}
+
+func readRecord(r *bufio.Reader) (Entry, int, error) {
+	n, err := binary.ReadUvarint(r)
+	if err != nil {
+		return Entry{}, 0, err
+	}
+	if n > 1<<30 {
+		return Entry{}, 0, errCorrupt
+	}
+	p := make([]byte, n+4)
+	if _, err := io.ReadFull(r, p); err != nil {
+		return Entry{}, 0, errCorrupt
+	}
+	if crc32.Checksum(p[:n], crc32c) != binary.LittleEndian.Uint32(p[n:]) {
+		return Entry{}, 0, errCorrupt
+	}
+	d := &decoder{b: p[:n]}
+	e := d.entry()
+	if d.err != nil {
+		return Entry{}, 0, d.err
+	}
+	return e, len(binary.AppendUvarint(nil, n)) + int(n) + 4, nil
+}
+
+func appendEntry(b []byte, e *Entry) []byte {
+	b = binary.AppendUvarint(b, e.Index)
+	b = binary.AppendUvarint(b, e.Term)
+	b = appendBytes(b, []byte(e.Origin))
+	b = binary.AppendUvarint(b, e.Seq)
+	return appendBytes(b, e.Data)
+}
+
+func appendBytes(b, s []byte) []byte {
+	b = binary.AppendUvarint(b, uint64(len(s)))
+	return append(b, s...)
+}
+
+// decoder reads the fields of a record or message.
+type decoder struct {
+	b   []byte
+	err error
+}
+
+func (d *decoder) uvarint() uint64 {
+	v, n := binary.Uvarint(d.b)
+	if n <= 0 {
+		d.err = errCorrupt
+		return 0
+	}
+	d.b = d.b[n:]
+	return v
+}
+
+func (d *decoder) bytes() []byte {
+	n := d.uvarint()
+	if d.err != nil || n > uint64(len(d.b)) {
+		d.err = errCorrupt
+		return nil
+	}
+	if n == 0 {
+		return nil
+	}
+	s := bytes.Clone(d.b[:n])
+	d.b = d.b[n:]
+	return s
+}
+
+func (d *decoder) string() string {
+	return string(d.bytes())
+}
+
+func (d *decoder) bool() bool {
+	return d.uvarint() != 0
+}
+
+func (d *decoder) entry() Entry {
+	return Entry{Index: d.uvarint(), Term: d.uvarint(), Origin: d.string(), Seq: d.uvarint(), Data: d.bytes()}
+}
+
+// writeFileAtomic replaces path with data, synced, so a crash leaves
+// either the old or the new content.
+func writeFileAtomic(path string, data []byte) error {
+	tmp, err := os.CreateTemp(filepath.Dir(path), filepath.Base(path)+".tmp-*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Sync(); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), path)
+}
@@ -0,0 +1,953 @@
+package raft
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"math/rand"
+	"sort"
+	"sync"
+	"time"
+)
+
+import (
+	logger "boltcache/logger"
+)
+
+// Raft follows "In Search of an Understandable Consensus Algorithm" with a
+// fixed membership. A leader is elected per term by a majority of votes;
+// it appends proposals to its log and replicates them, and an entry stored
+// by a majority is committed and applied to the state machine of every
+// member in log order. Followers forward proposals to the leader. Reads
+// are made linearizable with a read index: the leader confirms it still
+// leads with a round of heartbeats and the reader waits until it applied
+// the leader's commit index. Once enough entries were applied the state
+// machine is snapshotted and the log before it dropped; followers too far
+// behind get the snapshot instead of the entries.
+
+var (
+	ErrNoLeader  = errors.New("CLUSTERDOWN No Raft leader")
+	ErrNotLeader = errors.New("TRYAGAIN Not the Raft leader")
+	ErrTimeout   = errors.New("TRYAGAIN Raft timed out")
+	ErrStopped   = errors.New("ERR Raft stopped")
+)
+
+// State is the role of a node in its current term.
+type State int
+
+const (
+	Follower State = iota
+	Candidate
+	Leader
+)
+
+func (s State) String() string {
+	switch s {
+	case Candidate:
+		return "candidate"
+	case Leader:
+		return "leader"
+	}
+	return "follower"
+}
+
+// StateMachine is what the log is applied to.
+type StateMachine interface {
+	// Apply applies the data of a committed entry and returns the result
+	// for the proposer.
+	Apply(data []byte) interface{}
+
+	// Snapshot writes the state; Restore replaces it with a snapshot, or
+	// with the empty state when r is nil.
+	Snapshot(w io.Writer) error
+	Restore(r io.Reader) error
+}
+
+type Config struct {
+	ID    string   // address of this node, one of Peers
+	Peers []string // addresses of all members
+	Dir   string   // persistent state, "" keeps nothing
+
+	// ElectionTimeout defaults to a second; the leader sends heartbeats
+	// ten times as often.
+	ElectionTimeout time.Duration
+
+	// SnapshotEntries applied entries trigger a snapshot, default 10000.
+	SnapshotEntries uint64
+}
+
+// Status describes a node for INFO.
+type Status struct {
+	State     State
+	Term      uint64
+	Leader    string
+	LastIndex uint64
+	Commit    uint64
+	Applied   uint64
+	Snapshot  uint64 // index of the last snapshot
+}
+
+// maxBatch bounds the entries of one append message.
+const maxBatch = 256
+
+// Node is a member of a Raft group.
+type Node struct {
+	id              string
+	peers           []string // the other members
+	sm              StateMachine
+	trans           Transport
+	electionTimeout time.Duration
+	heartbeat       time.Duration
+	snapshotEntries uint64
+
+	// applyMu is held while the state machine changes, by the applier or
+	// by a snapshot being installed. It is taken before mu.
+	applyMu sync.Mutex
+
+	mu       sync.Mutex
+	changed  *sync.Cond // commit, applied, acks or state changed
+	store    *storage
+	state    State
+	term     uint64
+	vote     string
+	leader   string
+	deadline time.Time // when a follower starts an election
+
+	entries   []Entry // the log after the snapshot
+	snapIndex uint64
+	snapTerm  uint64
+	snapshot  []byte
+	commit    uint64
+	applied   uint64
+
+	// Leader state.
+	next      map[string]uint64
+	match     map[string]uint64
+	acked     map[string]uint64 // last heartbeat round each peer answered
+	round     uint64
+	termStart uint64 // index of the no-op that starts the leader's term
+
+	seq     uint64
+	pending map[uint64]chan interface{} // local proposals by seq
+	kick    map[string]chan struct{}    // wakes the replication to a peer
+
+	stop    chan struct{}
+	stopped bool
+}
+
+// New creates a node, restoring sm from the snapshot in cfg.Dir.
+func New(cfg Config, sm StateMachine, trans Transport) (*Node, error) {
+	n := &Node{
+		id:              cfg.ID,
+		sm:              sm,
+		trans:           trans,
+		electionTimeout: cfg.ElectionTimeout,
+		snapshotEntries: cfg.SnapshotEntries,
+		next:            make(map[string]uint64),
+		match:           make(map[string]uint64),
+		acked:           make(map[string]uint64),
+		pending:         make(map[uint64]chan interface{}),
+		kick:            make(map[string]chan struct{}),
+		stop:            make(chan struct{}),
+	}
+	n.changed = sync.NewCond(&n.mu)
+	if n.electionTimeout <= 0 {
+		n.electionTimeout = time.Second
+	}
+	n.heartbeat = n.electionTimeout / 10
+	if n.snapshotEntries == 0 {
+		n.snapshotEntries = 10000
+	}
+	member := false
+	for _, p := range cfg.Peers {
+		switch {
+		case p == cfg.ID:
+			member = true
+		case n.kick[p] == nil:
+			n.peers = append(n.peers, p)
+			n.kick[p] = make(chan struct{}, 1)
+		}
+	}
+	if !member {
+		return nil, fmt.Errorf("%s is not one of the raft peers %v", cfg.ID, cfg.Peers)
+	}
+
+	store, err := openStorage(cfg.Dir)
+	if err != nil {
+		return nil, err
+	}
+	n.store = store
+	if err := n.load(); err != nil {
+		store.close()
+		return nil, err
+	}
+	return n, nil
+}
+
+// load restores the persistent state and the state machine.
+func (n *Node) load() error {
+	var err error
+	if n.term, n.vote, err = n.store.loadState(); err != nil {
+		return err
+	}
+	index, term, data, err := n.store.loadSnapshot()
+	if err != nil {
+		return err
+	}
+	if data != nil {
+		err = n.sm.Restore(bytes.NewReader(data))
+	} else {
+		err = n.sm.Restore(nil)
+	}
+	if err != nil {
+		return fmt.Errorf("restoring raft snapshot: %v", err)
+	}
+	n.snapIndex, n.snapTerm, n.snapshot = index, term, data
+	n.commit, n.applied = index, index
+
+	entries, err := n.store.loadLog()
+	if err != nil {
+		return err
+	}
+	for _, e := range entries {
+		if e.Index > index {
+			n.entries = append(n.entries, e)
+		}
+	}
+	return nil
+}
+
+// Start runs the node until Stop.
+func (n *Node) Start() {
+	n.mu.Lock()
+	n.resetDeadline()
+	n.mu.Unlock()
+	go n.run()
+	go n.applier()
+	for _, p := range n.peers {
+		go n.replicate(p)
+	}
+}
+
+// Stop stops the node. Pending proposals and reads fail.
+func (n *Node) Stop() {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	if n.stopped {
+		return
+	}
+	n.stopped = true
+	close(n.stop)
+	n.changed.Broadcast()
+	n.store.close()
+	n.store = &storage{}
+}
+
+// ID returns the address of this node.
+func (n *Node) ID() string {
+	return n.id
+}
+
+// Status returns the state of this node.
+func (n *Node) Status() Status {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	return Status{
+		State:     n.state,
+		Term:      n.term,
+		Leader:    n.leader,
+		LastIndex: n.lastIndex(),
+		Commit:    n.commit,
+		Applied:   n.applied,
+		Snapshot:  n.snapIndex,
+	}
+}
+
+func (n *Node) lastIndex() uint64 {
+	return n.snapIndex + uint64(len(n.entries))
+}
+
+// termAt returns the term of the entry at index, 0 when it is unknown.
+func (n *Node) termAt(index uint64) uint64 {
+	switch {
+	case index == n.snapIndex:
+		return n.snapTerm
+	case index < n.snapIndex || index > n.lastIndex():
+		return 0
+	}
+	return n.entries[index-n.snapIndex-1].Term
+}
+
+// slice copies the entries from lo to hi inclusive.
+func (n *Node) slice(lo, hi uint64) []Entry {
+	if lo > hi {
+		return nil
+	}
+	return append([]Entry(nil), n.entries[lo-n.snapIndex-1:hi-n.snapIndex]...)
+}
+
+// quorum is the number of members that make a majority.
+func (n *Node) quorum() int {
+	return (len(n.peers)+1)/2 + 1
+}
+
+func (n *Node) resetDeadline() {
+	n.deadline = time.Now().Add(n.electionTimeout + time.Duration(rand.Int63n(int64(n.electionTimeout))))
+}
+
+func (n *Node) saveState() {
+	if err := n.store.saveState(n.term, n.vote); err != nil {
+		logger.Log("Failed to save raft state: %v", err)
+	}
+}
+
+// becomeFollower follows leader, "" when unknown, in term.
+func (n *Node) becomeFollower(term uint64, leader string) {
+	if term > n.term {
+		n.term, n.vote = term, ""
+		n.saveState()
+	}
+	if n.state == Leader {
+		logger.Log("Raft leader %s stepping down in term %d", n.id, n.term)
+	}
+	n.state = Follower
+	if leader != "" && leader != n.leader {
+		logger.Log("Raft leader is %s in term %d", leader, n.term)
+	}
+	n.leader = leader
+	n.changed.Broadcast()
+}
+
+func (n *Node) run() {
+	ticker := time.NewTicker(n.heartbeat)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-n.stop:
+			return
+		case <-ticker.C:
+		}
+		n.mu.Lock()
+		switch {
+		case n.state == Leader:
+			n.kickAll()
+		case !time.Now().Before(n.deadline):
+			n.campaign()
+		}
+		n.mu.Unlock()
+	}
+}
+
+// campaign starts an election in a new term. n.mu is held.
+func (n *Node) campaign() {
+	n.state, n.leader = Candidate, ""
+	n.term++
+	n.vote = n.id
+	n.saveState()
+	n.resetDeadline()
+	term := n.term
+	last := n.lastIndex()
+	req := &voteRequest{Term: term, Candidate: n.id, LastIndex: last, LastTerm: n.termAt(last)}
+	logger.Log("Raft node %s starting an election in term %d", n.id, term)
+
+	votes := 1
+	if votes >= n.quorum() {
+		n.becomeLeader()
+		return
+	}
+	msg := req.encode()
+	for _, p := range n.peers {
+		go func(p string) {
+			b, err := n.trans.Call(p, msgVote, msg, n.electionTimeout/2)
+			if err != nil {
+				return
+			}
+			var resp voteResponse
+			if !decode(b, &resp) {
+				return
+			}
+			n.mu.Lock()
+			defer n.mu.Unlock()
+			if resp.Term > n.term {
+				n.becomeFollower(resp.Term, "")
+				return
+			}
+			if n.state != Candidate || n.term != term || !resp.Granted {
+				return
+			}
+			if votes++; votes >= n.quorum() {
+				n.becomeLeader()
+			}
+		}(p)
+	}
+}
+
+// becomeLeader takes over after winning an election. The no-op entry it
+// appends commits the entries of earlier terms. n.mu is held.
+func (n *Node) becomeLeader() {
+	logger.Log("Raft node %s elected leader in term %d", n.id, n.term)
+	n.state, n.leader = Leader, n.id
+	for _, p := range n.peers {
+		n.next[p] = n.lastIndex() + 1
+		n.match[p] = 0
+		n.acked[p] = 0
+	}
+	if err := n.appendLocal(Entry{}); err != nil {
+		// Without the no-op, entries of earlier terms can't commit.
+		n.becomeFollower(n.term, "")
+		return
+	}
+	n.termStart = n.lastIndex()
+	n.changed.Broadcast()
+}
+
+// appendLocal appends e to the leader's log. An entry that can't be
+// stored is not appended, since the leader counts itself in the majority
+// that stored it. n.mu is held.
+func (n *Node) appendLocal(e Entry) error {
+	e.Index, e.Term = n.lastIndex()+1, n.term
+	if err := n.store.append([]Entry{e}); err != nil {
+		logger.Log("Failed to append to raft log: %v", err)
+		return err
+	}
+	n.entries = append(n.entries, e)
+	n.advanceCommit()
+	n.kickAll()
+	return nil
+}
+
+func (n *Node) kickAll() {
+	for _, ch := range n.kick {
+		select {
+		case ch <- struct{}{}:
+		default:
+		}
+	}
+}
+
+// advanceCommit commits the entries a majority stored, once one of them
+// is from the current term. n.mu is held.
+func (n *Node) advanceCommit() {
+	matches := []uint64{n.lastIndex()}
+	for _, p := range n.peers {
+		matches = append(matches, n.match[p])
+	}
+	sort.Slice(matches, func(i, j int) bool { return matches[i] > matches[j] })
+	if index := matches[len(matches)/2]; index > n.commit && n.termAt(index) == n.term {
+		n.commit = index
+		n.changed.Broadcast()
+	}
+}
+
+// replicate sends the log to peer while this node leads.
+func (n *Node) replicate(peer string) {
+	for {
+		select {
+		case <-n.stop:
+			return
+		case <-n.kick[peer]:
+		}
+		for n.sendTo(peer) {
+		}
+	}
+}
+
+// sendTo sends peer the entries it misses, a heartbeat when it has them
+// all, and reports whether more are to be sent right away.
+func (n *Node) sendTo(peer string) bool {
+	n.mu.Lock()
+	if n.state != Leader {
+		n.mu.Unlock()
+		return false
+	}
+	term, round, next := n.term, n.round, n.next[peer]
+
+	var typ byte
+	var msg []byte
+	var sent uint64 // last index the message carries
+	timeout := n.electionTimeout / 2
+	if next <= n.snapIndex {
+		req := &snapshotRequest{Term: term, Leader: n.id, Index: n.snapIndex, STerm: n.snapTerm, Data: n.snapshot}
+		typ, msg, sent = msgSnapshot, req.encode(), n.snapIndex
+		timeout = 10 * n.electionTimeout
+	} else {
+		last := min(n.lastIndex(), next+maxBatch-1)
+		req := &appendRequest{
+			Term:      term,
+			Leader:    n.id,
+			PrevIndex: next - 1,
+			PrevTerm:  n.termAt(next - 1),
+			Commit:    n.commit,
+			Entries:   n.slice(next, last),
+		}
+		typ, msg, sent = msgAppend, req.encode(), last
+	}
+	n.mu.Unlock()
+
+	b, err := n.trans.Call(peer, typ, msg, timeout)
+	var resp appendResponse
+	if err != nil || !decode(b, &resp) {
+		return false
+	}
+
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	if resp.Term > n.term {
+		n.becomeFollower(resp.Term, "")
+		return false
+	}
+	if n.state != Leader || n.term != term {
+		return false
+	}
+	if round > n.acked[peer] {
+		n.acked[peer] = round
+		n.changed.Broadcast()
+	}
+	if !resp.Success {
+		// Back off to the follower's hint.
+		n.next[peer] = max(1, min(resp.Index+1, next-1))
+		return n.next[peer] < next
+	}
+	if sent > n.match[peer] {
+		n.match[peer] = sent
+		n.advanceCommit()
+	}
+	n.next[peer] = n.match[peer] + 1
+	return n.next[peer] <= n.lastIndex()
+}
+
+func decode(b []byte, m interface{ decode(*decoder) }) bool {
+	d := &decoder{b: b}
+	m.decode(d)
+	return d.err == nil
+}
+
+// applier applies committed entries in order and hands the results of
+// local proposals to their waiters.
+func (n *Node) applier() {
+	for {
+		n.mu.Lock()
+		for n.applied >= n.commit && !n.stopped {
+			n.changed.Wait()
+		}
+		if n.stopped {
+			n.mu.Unlock()
+			return
+		}
+		batch := n.slice(n.applied+1, n.commit)
+		n.mu.Unlock()
+
+		n.applyMu.Lock()
+		for _, e := range batch {
+			n.mu.Lock()
+			// A snapshot may have been installed meanwhile.
+			skip := e.Index != n.applied+1
+			n.mu.Unlock()
+			if skip {
+				continue
+			}
+
+			var result interface{}
+			if e.Data != nil {
+				result = n.sm.Apply(e.Data)
+			}
+			n.mu.Lock()
+			n.applied = e.Index
+			if ch := n.pending[e.Seq]; ch != nil && e.Origin == n.id {
+				ch <- result
+				delete(n.pending, e.Seq)
+			}
+			n.changed.Broadcast()
+			n.mu.Unlock()
+		}
+		n.maybeSnapshot()
+		n.applyMu.Unlock()
+	}
+}
+
+// maybeSnapshot compacts the log once enough entries were applied since
+// the last snapshot. n.applyMu is held.
+func (n *Node) maybeSnapshot() {
+	n.mu.Lock()
+	index := n.applied
+	if index-n.snapIndex < n.snapshotEntries {
+		n.mu.Unlock()
+		return
+	}
+	term := n.termAt(index)
+	n.mu.Unlock()
+
+	var buf bytes.Buffer
+	if err := n.sm.Snapshot(&buf); err != nil {
+		logger.Log("Failed to snapshot raft state: %v", err)
+		return
+	}
+
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	n.entries = n.slice(index+1, n.lastIndex())
+	n.snapIndex, n.snapTerm, n.snapshot = index, term, buf.Bytes()
+	n.persistSnapshot()
+	logger.Log("Raft log compacted up to index %d", index)
+}
+
+// persistSnapshot saves the snapshot and the log after it. n.mu is held.
+func (n *Node) persistSnapshot() {
+	if err := n.store.saveSnapshot(n.snapIndex, n.snapTerm, n.snapshot); err != nil {
+		logger.Log("Failed to save raft snapshot: %v", err)
+		return
+	}
+	if err := n.store.rewrite(n.entries); err != nil {
+		logger.Log("Failed to rewrite raft log: %v", err)
+	}
+}
+
+// wait blocks until ok holds, the deadline passes or the node stops.
+// n.mu is held.
+func (n *Node) wait(ok func() bool, deadline time.Time) error {
+	t := time.AfterFunc(time.Until(deadline), func() {
+		n.mu.Lock()
+		n.changed.Broadcast()
+		n.mu.Unlock()
+	})
+	defer t.Stop()
+	for !ok() {
+		if n.stopped {
+			return ErrStopped
+		}
+		if !time.Now().Before(deadline) {
+			return ErrTimeout
+		}
+		n.changed.Wait()
+	}
+	return nil
+}
+
+// retryable reports whether err may go away once a leader is elected.
+func retryable(err error) bool {
+	return err == ErrNoLeader || err == ErrNotLeader || err.Error() == ErrNotLeader.Error()
+}
+
+// Propose appends data to the log, through the leader, and returns the
+// result of applying it on this node.
+func (n *Node) Propose(data []byte, timeout time.Duration) (interface{}, error) {
+	deadline := time.Now().Add(timeout)
+	ch := make(chan interface{}, 1)
+	n.mu.Lock()
+	n.seq++
+	seq := n.seq
+	n.pending[seq] = ch
+	n.mu.Unlock()
+	defer func() {
+		n.mu.Lock()
+		delete(n.pending, seq)
+		n.mu.Unlock()
+	}()
+
+	for {
+		err := n.submit(seq, data, deadline)
+		if err == nil {
+			break
+		}
+		if !retryable(err) || !time.Now().Add(n.heartbeat).Before(deadline) {
+			return nil, err
+		}
+		time.Sleep(n.heartbeat)
+	}
+
+	timer := time.NewTimer(time.Until(deadline))
+	defer timer.Stop()
+	select {
+	case result := <-ch:
+		return result, nil
+	case <-timer.C:
+		return nil, ErrTimeout
+	case <-n.stop:
+		return nil, ErrStopped
+	}
+}
+
+// submit appends a proposal of this node to the leader's log.
+func (n *Node) submit(seq uint64, data []byte, deadline time.Time) error {
+	n.mu.Lock()
+	if n.state == Leader {
+		err := n.appendLocal(Entry{Origin: n.id, Seq: seq, Data: data})
+		n.mu.Unlock()
+		return err
+	}
+	leader := n.leader
+	n.mu.Unlock()
+	if leader == "" {
+		return ErrNoLeader
+	}
+	msg := appendBytes(nil, []byte(n.id))
+	msg = binary.AppendUvarint(msg, seq)
+	msg = appendBytes(msg, data)
+	_, err := n.trans.Call(leader, msgPropose, msg, time.Until(deadline))
+	return err
+}
+
+// ReadIndex waits until this node applied every entry committed when it
+// was called, so that reading its state afterwards is linearizable.
+func (n *Node) ReadIndex(timeout time.Duration) error {
+	deadline := time.Now().Add(timeout)
+	for {
+		index, err := n.readIndex(deadline)
+		if err == nil {
+			n.mu.Lock()
+			defer n.mu.Unlock()
+			return n.wait(func() bool { return n.applied >= index }, deadline)
+		}
+		if !retryable(err) || !time.Now().Add(n.heartbeat).Before(deadline) {
+			return err
+		}
+		time.Sleep(n.heartbeat)
+	}
+}
+
+func (n *Node) readIndex(deadline time.Time) (uint64, error) {
+	n.mu.Lock()
+	if n.state == Leader {
+		defer n.mu.Unlock()
+		return n.leaderReadIndex(deadline)
+	}
+	leader := n.leader
+	n.mu.Unlock()
+	if leader == "" {
+		return 0, ErrNoLeader
+	}
+	b, err := n.trans.Call(leader, msgReadIndex, nil, time.Until(deadline))
+	if err != nil {
+		return 0, err
+	}
+	d := &decoder{b: b}
+	index := d.uvarint()
+	return index, d.err
+}
+
+// leaderReadIndex returns the commit index once a majority confirmed that
+// this node still leads. n.mu is held.
+func (n *Node) leaderReadIndex(deadline time.Time) (uint64, error) {
+	term := n.term
+	leading := func() bool { return n.state == Leader && n.term == term }
+	// The commit index is only current once the term's no-op committed.
+	if err := n.wait(func() bool { return !leading() || n.commit >= n.termStart }, deadline); err != nil {
+		return 0, err
+	}
+	if !leading() {
+		return 0, ErrNotLeader
+	}
+	index := n.commit
+	n.round++
+	round := n.round
+	n.kickAll()
+	confirmed := func() bool {
+		acks := 1
+		for _, p := range n.peers {
+			if n.acked[p] >= round {
+				acks++
+			}
+		}
+		return acks >= n.quorum()
+	}
+	if err := n.wait(func() bool { return !leading() || confirmed() }, deadline); err != nil {
+		return 0, err
+	}
+	if !leading() {
+		return 0, ErrNotLeader
+	}
+	return index, nil
+}
+
+// handle answers a message from a peer.
+func (n *Node) handle(typ byte, msg []byte) ([]byte, error) {
+	switch typ {
+	case msgVote:
+		var req voteRequest
+		if !decode(msg, &req) {
+			return nil, errCorrupt
+		}
+		resp := n.handleVote(&req)
+		return resp.encode(), nil
+	case msgAppend:
+		var req appendRequest
+		if !decode(msg, &req) {
+			return nil, errCorrupt
+		}
+		resp := n.handleAppend(&req)
+		return resp.encode(), nil
+	case msgSnapshot:
+		var req snapshotRequest
+		if !decode(msg, &req) {
+			return nil, errCorrupt
+		}
+		resp, err := n.handleSnapshot(&req)
+		if err != nil {
+			return nil, err
+		}
+		return resp.encode(), nil
+	case msgPropose:
+		d := &decoder{b: msg}
+		e := Entry{Origin: d.string(), Seq: d.uvarint(), Data: d.bytes()}
+		if d.err != nil {
+			return nil, d.err
+		}
+		n.mu.Lock()
+		defer n.mu.Unlock()
+		if n.state != Leader {
+			return nil, ErrNotLeader
+		}
+		return nil, n.appendLocal(e)
+	case msgReadIndex:
+		n.mu.Lock()
+		defer n.mu.Unlock()
+		if n.state != Leader {
+			return nil, ErrNotLeader
+		}
+		index, err := n.leaderReadIndex(time.Now().Add(n.electionTimeout))
+		if err != nil {
+			return nil, err
+		}
+		return binary.AppendUvarint(nil, index), nil
+	}
+	return nil, fmt.Errorf("unknown raft message %d", typ)
+}
+
+func (n *Node) handleVote(req *voteRequest) *voteResponse {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	if req.Term > n.term {
+		n.becomeFollower(req.Term, "")
+	}
+	resp := &voteResponse{Term: n.term}
+	if req.Term < n.term {
+		return resp
+	}
+	last := n.lastIndex()
+	lastTerm := n.termAt(last)
+	upToDate := req.LastTerm > lastTerm || req.LastTerm == lastTerm && req.LastIndex >= last
+	if (n.vote == "" || n.vote == req.Candidate) && upToDate {
+		n.vote = req.Candidate
+		n.saveState()
+		n.resetDeadline()
+		resp.Granted = true
+	}
+	return resp
+}
+
+func (n *Node) handleAppend(req *appendRequest) *appendResponse {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	resp := &appendResponse{Term: n.term}
+	if req.Term < n.term {
+		return resp
+	}
+	n.becomeFollower(req.Term, req.Leader)
+	n.resetDeadline()
+	resp.Term = n.term
+
+	prev, entries := req.PrevIndex, req.Entries
+	if prev < n.snapIndex {
+		// Entries up to the snapshot are committed, so they match.
+		skip := n.snapIndex - prev
+		if skip >= uint64(len(entries)) {
+			entries = nil
+		} else {
+			entries = entries[skip:]
+		}
+		prev = n.snapIndex
+	} else {
+		if prev > n.lastIndex() {
+			resp.Index = n.lastIndex()
+			return resp
+		}
+		if t := n.termAt(prev); t != req.PrevTerm {
+			// Skip the whole conflicting term.
+			i := prev
+			for i > n.snapIndex+1 && n.termAt(i-1) == t {
+				i--
+			}
+			resp.Index = i - 1
+			return resp
+		}
+	}
+
+	// Entries are only acknowledged once stored. When storing fails the
+	// log stays as it was and the leader sends them again.
+	for i, e := range entries {
+		if e.Index > n.lastIndex() {
+			if err := n.store.append(entries[i:]); err != nil {
+				logger.Log("Failed to append to raft log: %v", err)
+				resp.Index = prev
+				return resp
+			}
+			n.entries = append(n.entries, entries[i:]...)
+			break
+		}
+		if n.termAt(e.Index) != e.Term {
+			kept := n.entries[:e.Index-n.snapIndex-1]
+			log := append(kept[:len(kept):len(kept)], entries[i:]...)
+			if err := n.store.rewrite(log); err != nil {
+				logger.Log("Failed to rewrite raft log: %v", err)
+				resp.Index = prev
+				return resp
+			}
+			n.entries = log
+			break
+		}
+	}
+
+	last := prev + uint64(len(entries))
+	if commit := min(req.Commit, last); commit > n.commit {
+		n.commit = commit
+		n.changed.Broadcast()
+	}
+	resp.Success, resp.Index = true, last
+	return resp
+}
+
+// handleSnapshot replaces the state machine with the leader's snapshot.
+func (n *Node) handleSnapshot(req *snapshotRequest) (*appendResponse, error) {
+	n.mu.Lock()
+	resp := &appendResponse{Term: n.term}
+	if req.Term < n.term {
+		n.mu.Unlock()
+		return resp, nil
+	}
+	n.becomeFollower(req.Term, req.Leader)
+	n.resetDeadline()
+	resp.Term = n.term
+	n.mu.Unlock()
+
+	n.applyMu.Lock()
+	defer n.applyMu.Unlock()
+	n.mu.Lock()
+	if req.Index <= n.applied {
+		n.mu.Unlock()
+		resp.Success, resp.Index = true, req.Index
+		return resp, nil
+	}
+	n.mu.Unlock()
+
+	if err := n.sm.Restore(bytes.NewReader(req.Data)); err != nil {
+		return nil, fmt.Errorf("restoring raft snapshot: %v", err)
+	}
+
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	if n.termAt(req.Index) == req.STerm {
+		n.entries = n.slice(req.Index+1, n.lastIndex())
+	} else {
+		n.entries = nil
+	}
+	n.snapIndex, n.snapTerm, n.snapshot = req.Index, req.STerm, req.Data
+	n.commit = max(n.commit, req.Index)
+	n.applied = req.Index
+	n.persistSnapshot()
+	n.changed.Broadcast()
+	logger.Log("Raft snapshot installed up to index %d", req.Index)
+	resp.Success, resp.Index = true, req.Index
+	return resp, nil
+}
@@ -0,0 +1,328 @@
+package raft
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// kv is a state machine of "key=value" entries.
+type kv struct {
+	mu   sync.Mutex
+	data map[string]string
+}
+
+func (m *kv) Apply(data []byte) interface{} {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	k, v, _ := strings.Cut(string(data), "=")
+	m.data[k] = v
+	return len(m.data)
+}
+
+func (m *kv) Snapshot(w io.Writer) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	for k, v := range m.data {
+		fmt.Fprintf(w, "%s=%s\n", k, v)
+	}
+	return nil
+}
+
+func (m *kv) Restore(r io.Reader) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.data = make(map[string]string)
+	if r == nil {
+		return nil
+	}
+	s := bufio.NewScanner(r)
+	for s.Scan() {
+		k, v, _ := strings.Cut(s.Text(), "=")
+		m.data[k] = v
+	}
+	return s.Err()
+}
+
+func (m *kv) get(k string) string {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.data[k]
+}
+
+// network connects nodes in memory; nodes marked down are cut off.
+type network struct {
+	mu    sync.Mutex
+	nodes map[string]*Node
+	down  map[string]bool
+}
+
+type memTransport struct {
+	net  *network
+	from string
+}
+
+func (t *memTransport) Call(peer string, typ byte, msg []byte, timeout time.Duration) ([]byte, error) {
+	t.net.mu.Lock()
+	n := t.net.nodes[peer]
+	down := t.net.down[t.from] || t.net.down[peer]
+	t.net.mu.Unlock()
+	if n == nil || down {
+		return nil, errors.New("unreachable")
+	}
+	resp, err := n.handle(typ, msg)
+	if err != nil {
+		return nil, remoteError(err.Error())
+	}
+	return resp, nil
+}
+
+func (net *network) setDown(id string, down bool) {
+	net.mu.Lock()
+	defer net.mu.Unlock()
+	net.down[id] = down
+}
+
+type testNode struct {
+	*Node
+	kv *kv
+}
+
+func startNode(t *testing.T, net *network, id string, peers []string, dir string, snapshotEntries uint64) testNode {
+	t.Helper()
+	sm := &kv{}
+	cfg := Config{ID: id, Peers: peers, Dir: dir, ElectionTimeout: 50 * time.Millisecond, SnapshotEntries: snapshotEntries}
+	n, err := New(cfg, sm, &memTransport{net: net, from: id})
+	if err != nil {
+		t.Fatal(err)
+	}
+	net.mu.Lock()
+	net.nodes[id] = n
+	net.mu.Unlock()
+	n.Start()
+	t.Cleanup(n.Stop)
+	return testNode{n, sm}
+}
+
+func startGroup(t *testing.T, size int, snapshotEntries uint64) (*network, []testNode) {
+	net := &network{nodes: make(map[string]*Node), down: make(map[string]bool)}
+	var peers []string
+	for i := 0; i < size; i++ {
+		peers = append(peers, fmt.Sprintf("n%d", i))
+	}
+	var nodes []testNode
+	for _, id := range peers {
+		nodes = append(nodes, startNode(t, net, id, peers, "", snapshotEntries))
+	}
+	return net, nodes
+}
+
+func waitFor(t *testing.T, what string, cond func() bool) {
+	t.Helper()
+	deadline := time.Now().Add(5 * time.Second)
+	for !cond() {
+		if time.Now().After(deadline) {
+			t.Fatalf("timed out waiting for %s", what)
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+}
+
+// leader waits for a single leader among the nodes that are up.
+func leader(t *testing.T, net *network, nodes []testNode) testNode {
+	t.Helper()
+	var found testNode
+	waitFor(t, "a leader", func() bool {
+		var leaders []testNode
+		for _, n := range nodes {
+			net.mu.Lock()
+			down := net.down[n.id]
+			net.mu.Unlock()
+			if !down && n.Status().State == Leader {
+				leaders = append(leaders, n)
+			}
+		}
+		if len(leaders) != 1 {
+			return false
+		}
+		found = leaders[0]
+		return true
+	})
+	return found
+}
+
+func follower(nodes []testNode, leader testNode) testNode {
+	for _, n := range nodes {
+		if n.id != leader.id {
+			return n
+		}
+	}
+	return testNode{}
+}
+
+func TestReplication(t *testing.T) {
+	net, nodes := startGroup(t, 3, 0)
+	lead := leader(t, net, nodes)
+	f := follower(nodes, lead)
+
+	// Proposals are applied everywhere; the proposer gets its result.
+	if res, err := f.Propose([]byte("a=1"), time.Second); err != nil || res != 1 {
+		t.Fatalf("propose through a follower: %v, %v", res, err)
+	}
+	if res, err := lead.Propose([]byte("b=2"), time.Second); err != nil || res != 2 {
+		t.Fatalf("propose on the leader: %v, %v", res, err)
+	}
+	for _, n := range nodes {
+		n := n
+		waitFor(t, "replication to "+n.id, func() bool { return n.kv.get("b") == "2" })
+	}
+
+	// A read index makes the last write visible on any node.
+	for _, n := range nodes {
+		if _, err := lead.Propose([]byte("c=3"), time.Second); err != nil {
+			t.Fatal(err)
+		}
+		if err := n.ReadIndex(time.Second); err != nil {
+			t.Fatal(err)
+		}
+		if v := n.kv.get("c"); v != "3" {
+			t.Fatalf("%s read %q after read index", n.id, v)
+		}
+	}
+}
+
+func TestLeaderFailure(t *testing.T) {
+	net, nodes := startGroup(t, 3, 0)
+	old := leader(t, net, nodes)
+	if _, err := old.Propose([]byte("a=1"), time.Second); err != nil {
+		t.Fatal(err)
+	}
+
+	// The old leader can't commit or serve reads on its own.
+	net.setDown(old.id, true)
+	if _, err := old.Propose([]byte("lost=1"), 200*time.Millisecond); err != ErrTimeout {
+		t.Fatalf("propose without a majority: %v", err)
+	}
+	if err := old.ReadIndex(200 * time.Millisecond); err == nil {
+		t.Fatal("read index without a majority")
+	}
+
+	lead := leader(t, net, nodes)
+	if lead.id == old.id {
+		t.Fatal("cut off leader still leads")
+	}
+	if _, err := lead.Propose([]byte("a=2"), time.Second); err != nil {
+		t.Fatal(err)
+	}
+
+	// Back in the group, the old leader drops its uncommitted entry.
+	net.setDown(old.id, false)
+	waitFor(t, "old leader to catch up", func() bool { return old.kv.get("a") == "2" })
+	if v := old.kv.get("lost"); v != "" {
+		t.Fatalf("uncommitted entry applied: %q", v)
+	}
+}
+
+func TestSnapshots(t *testing.T) {
+	dir := t.TempDir()
+	net := &network{nodes: make(map[string]*Node), down: make(map[string]bool)}
+	peers := []string{"n0", "n1", "n2"}
+	var nodes []testNode
+	for _, id := range peers {
+		nodes = append(nodes, startNode(t, net, id, peers, dir+"/"+id, 5))
+	}
+	lead := leader(t, net, nodes)
+	lagging := follower(nodes, lead)
+	net.setDown(lagging.id, true)
+	lead = leader(t, net, nodes)
+
+	for i := 0; i < 20; i++ {
+		if _, err := lead.Propose([]byte(fmt.Sprintf("k%d=%d", i, i)), time.Second); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if s := lead.Status(); s.Snapshot == 0 {
+		t.Fatalf("no snapshot after 20 entries: %+v", s)
+	}
+
+	// The lagging follower gets the snapshot instead of the entries.
+	net.setDown(lagging.id, false)
+	waitFor(t, "snapshot install", func() bool { return lagging.kv.get("k19") == "19" })
+	if s := lagging.Status(); s.Snapshot == 0 {
+		t.Fatalf("follower caught up without a snapshot: %+v", s)
+	}
+
+	// A restarted node recovers its state from disk and the leader.
+	lead.Stop()
+	net.mu.Lock()
+	delete(net.nodes, lead.id)
+	net.mu.Unlock()
+	restarted := startNode(t, net, lead.id, peers, dir+"/"+lead.id, 5)
+	if v := restarted.kv.get("k0"); v != "0" {
+		t.Fatalf("snapshot not restored: %q", v)
+	}
+	var keys []string
+	waitFor(t, "restarted node to catch up", func() bool {
+		restarted.kv.mu.Lock()
+		defer restarted.kv.mu.Unlock()
+		keys = keys[:0]
+		for k := range restarted.kv.data {
+			keys = append(keys, k)
+		}
+		return len(keys) == 20
+	})
+	sort.Strings(keys)
+	if keys[0] != "k0" || keys[19] != "k9" {
+		t.Fatalf("keys %v", keys)
+	}
+}
+
+func TestAppendNotStored(t *testing.T) {
+	dir := t.TempDir()
+	n, err := New(Config{ID: "n0", Peers: []string{"n0", "n1"}, Dir: dir}, &kv{}, &memTransport{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer n.Stop()
+	appendEntries := func(prev, prevTerm uint64, entries ...Entry) *appendResponse {
+		return n.handleAppend(&appendRequest{Term: 2, Leader: "n1", PrevIndex: prev, PrevTerm: prevTerm, Commit: 2, Entries: entries})
+	}
+
+	// Entries the log can't take are neither acknowledged nor committed.
+	writable := n.store.log
+	readOnly, err := os.Open(filepath.Join(dir, "log"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer readOnly.Close()
+	n.store.log = readOnly
+	if resp := appendEntries(0, 0, Entry{Index: 1, Term: 1}); resp.Success || n.lastIndex() != 0 || n.commit != 0 {
+		t.Fatalf("failed append: %+v, last %d, commit %d", resp, n.lastIndex(), n.commit)
+	}
+	n.store.log = writable
+	if resp := appendEntries(0, 0, Entry{Index: 1, Term: 1}, Entry{Index: 2, Term: 1}); !resp.Success || n.lastIndex() != 2 {
+		t.Fatalf("append: %+v, last %d", resp, n.lastIndex())
+	}
+
+	// Neither are entries replacing a conflicting suffix.
+	n.store.dir = filepath.Join(dir, "missing")
+	if resp := appendEntries(1, 1, Entry{Index: 2, Term: 2}); resp.Success || n.termAt(2) != 1 {
+		t.Fatalf("failed rewrite: %+v, term %d", resp, n.termAt(2))
+	}
+	n.store.dir = dir
+	if resp := appendEntries(1, 1, Entry{Index: 2, Term: 2}); !resp.Success || n.termAt(2) != 2 {
+		t.Fatalf("rewrite: %+v, term %d", resp, n.termAt(2))
+	}
+	entries, err := n.store.loadLog()
+	if err != nil || len(entries) != 2 || entries[1].Term != 2 {
+		t.Fatalf("stored log %+v, %v", entries, err)
+	}
+}
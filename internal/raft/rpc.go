@@ -0,0 +1,294 @@
+package raft
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"io"
+	"net"
+	"sync"
+	"time"
+)
+
+// Message types of the peer protocol.
+const (
+	msgVote byte = iota + 1
+	msgAppend
+	msgSnapshot
+	msgPropose
+	msgReadIndex
+)
+
+type voteRequest struct {
+	Term      uint64
+	Candidate string
+	LastIndex uint64
+	LastTerm  uint64
+}
+
+type voteResponse struct {
+	Term    uint64
+	Granted bool
+}
+
+type appendRequest struct {
+	Term      uint64
+	Leader    string
+	PrevIndex uint64
+	PrevTerm  uint64
+	Commit    uint64
+	Entries   []Entry
+}
+
+// appendResponse answers appendRequest and snapshotRequest. Index is the
+// last entry known to match the leader's log, or on failure a hint where
+// to retry from.
+type appendResponse struct {
+	Term    uint64
+	Success bool
+	Index   uint64
+}
+
+type snapshotRequest struct {
+	Term   uint64
+	Leader string
+	Index  uint64
+	STerm  uint64 // term of the entry at Index
+	Data   []byte
+}
+
+func (m *voteRequest) encode() []byte {
+	b := binary.AppendUvarint(nil, m.Term)
+	b = appendBytes(b, []byte(m.Candidate))
+	b = binary.AppendUvarint(b, m.LastIndex)
+	return binary.AppendUvarint(b, m.LastTerm)
+}
+
+func (m *voteRequest) decode(d *decoder) {
+	m.Term, m.Candidate, m.LastIndex, m.LastTerm = d.uvarint(), d.string(), d.uvarint(), d.uvarint()
+}
+
+func (m *voteResponse) encode() []byte {
+	return binary.AppendUvarint(binary.AppendUvarint(nil, m.Term), boolInt(m.Granted))
+}
+
+func (m *voteResponse) decode(d *decoder) {
+	m.Term, m.Granted = d.uvarint(), d.bool()
+}
+
+func (m *appendRequest) encode() []byte {
+	b := binary.AppendUvarint(nil, m.Term)
+	b = appendBytes(b, []byte(m.Leader))
+	b = binary.AppendUvarint(b, m.PrevIndex)
+	b = binary.AppendUvarint(b, m.PrevTerm)
+	b = binary.AppendUvarint(b, m.Commit)
+	b = binary.AppendUvarint(b, uint64(len(m.Entries)))
+	for i := range m.Entries {
+		b = appendEntry(b, &m.Entries[i])
+	}
+	return b
+}
+
+func (m *appendRequest) decode(d *decoder) {
+	m.Term, m.Leader, m.PrevIndex, m.PrevTerm, m.Commit = d.uvarint(), d.string(), d.uvarint(), d.uvarint(), d.uvarint()
+	n := d.uvarint()
+	if n > uint64(len(d.b)) {
+		d.err = errCorrupt
+		return
+	}
+	for i := uint64(0); i < n && d.err == nil; i++ {
+		m.Entries = append(m.Entries, d.entry())
+	}
+}
+
+func (m *appendResponse) encode() []byte {
+	b := binary.AppendUvarint(nil, m.Term)
+	b = binary.AppendUvarint(b, boolInt(m.Success))
+	return binary.AppendUvarint(b, m.Index)
+}
+
+func (m *appendResponse) decode(d *decoder) {
+	m.Term, m.Success, m.Index = d.uvarint(), d.bool(), d.uvarint()
+}
+
+func (m *snapshotRequest) encode() []byte {
+	b := binary.AppendUvarint(nil, m.Term)
+	b = appendBytes(b, []byte(m.Leader))
+	b = binary.AppendUvarint(b, m.Index)
+	b = binary.AppendUvarint(b, m.STerm)
+	return appendBytes(b, m.Data)
+}
+
+func (m *snapshotRequest) decode(d *decoder) {
+	m.Term, m.Leader, m.Index, m.STerm, m.Data = d.uvarint(), d.string(), d.uvarint(), d.uvarint(), d.bytes()
+}
+
+func boolInt(b bool) uint64 {
+	if b {
+		return 1
+	}
+	return 0
+}
+
+// Transport carries messages between the members.
+type Transport interface {
+	// Call sends a message of type typ to peer and returns its response.
+	Call(peer string, typ byte, msg []byte, timeout time.Duration) ([]byte, error)
+}
+
+// remoteError is an error returned by the peer rather than the network.
+type remoteError string
+
+func (e remoteError) Error() string { return string(e) }
+
+// TCPTransport reaches peers at their TCP text port. A connection starts
+// with the line "RAFT", after which the server hands it over to ServeConn
+// and both sides exchange frames:
+//
+//	request   type:u8 length:uvarint message
+//	response  status:u8 length:uvarint message-or-error
+//
+// Connections are pooled, so a slow call doesn't hold up the others.
+type TCPTransport struct {
+	mu   sync.Mutex
+	idle map[string][]*peerConn
+}
+
+type peerConn struct {
+	net.Conn
+	r *bufio.Reader
+}
+
+func NewTCPTransport() *TCPTransport {
+	return &TCPTransport{idle: make(map[string][]*peerConn)}
+}
+
+// maxIdle bounds the idle connections kept per peer.
+const maxIdle = 4
+
+func (t *TCPTransport) Call(peer string, typ byte, msg []byte, timeout time.Duration) ([]byte, error) {
+	c, err := t.get(peer, timeout)
+	if err != nil {
+		return nil, err
+	}
+	c.SetDeadline(time.Now().Add(timeout))
+	resp, err := call(c, typ, msg)
+	if _, remote := err.(remoteError); err != nil && !remote {
+		c.Close()
+		return nil, err
+	}
+	t.put(peer, c)
+	return resp, err
+}
+
+func (t *TCPTransport) get(peer string, timeout time.Duration) (*peerConn, error) {
+	t.mu.Lock()
+	if idle := t.idle[peer]; len(idle) > 0 {
+		c := idle[len(idle)-1]
+		t.idle[peer] = idle[:len(idle)-1]
+		t.mu.Unlock()
+		return c, nil
+	}
+	t.mu.Unlock()
+
+	conn, err := net.DialTimeout("tcp", peer, timeout)
+	if err != nil {
+		return nil, err
+	}
+	if _, err := conn.Write([]byte("RAFT\r\n")); err != nil {
+		conn.Close()
+		return nil, err
+	}
+	return &peerConn{Conn: conn, r: bufio.NewReader(conn)}, nil
+}
+
+func (t *TCPTransport) put(peer string, c *peerConn) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if len(t.idle[peer]) >= maxIdle {
+		c.Close()
+		return
+	}
+	t.idle[peer] = append(t.idle[peer], c)
+}
+
+// Close closes the idle connections.
+func (t *TCPTransport) Close() {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	for peer, idle := range t.idle {
+		for _, c := range idle {
+			c.Close()
+		}
+		delete(t.idle, peer)
+	}
+}
+
+func call(c *peerConn, typ byte, msg []byte) ([]byte, error) {
+	if err := writeFrame(c, typ, msg); err != nil {
+		return nil, err
+	}
+	status, resp, err := readFrame(c.r)
+	if err != nil {
+		return nil, err
+	}
+	if status != 0 {
+		return nil, remoteError(resp)
+	}
+	return resp, nil
+}
+
+func writeFrame(w io.Writer, kind byte, msg []byte) error {
+	b := binary.AppendUvarint([]byte{kind}, uint64(len(msg)))
+	_, err := w.Write(append(b, msg...))
+	return err
+}
+
+// maxFrame bounds a message, snapshots included.
+const maxFrame = 1 << 30
+
+func readFrame(r *bufio.Reader) (byte, []byte, error) {
+	kind, err := r.ReadByte()
+	if err != nil {
+		return 0, nil, err
+	}
+	n, err := binary.ReadUvarint(r)
+	if err != nil {
+		return 0, nil, err
+	}
+	if n > maxFrame {
+		return 0, nil, errors.New("raft frame too large")
+	}
+	msg := make([]byte, n)
+	if _, err := io.ReadFull(r, msg); err != nil {
+		return 0, nil, err
+	}
+	return kind, msg, nil
+}
+
+// ServeConn answers the messages of a peer on conn, after the "RAFT" line
+// the server read through r, until the connection closes.
+func (n *Node) ServeConn(conn net.Conn, r *bufio.Reader) error {
+	defer conn.Close()
+	w := bufio.NewWriter(conn)
+	for {
+		typ, msg, err := readFrame(r)
+		if err != nil {
+			if err == io.EOF {
+				return nil
+			}
+			return err
+		}
+		var status byte
+		resp, err := n.handle(typ, msg)
+		if err != nil {
+			status, resp = 1, []byte(err.Error())
+		}
+		if err := writeFrame(w, status, resp); err != nil {
+			return err
+		}
+		if err := w.Flush(); err != nil {
+			return err
+		}
+	}
+}
@@ -12,6 +12,7 @@ import (
 import (
 	config "boltcache/config"
 	cache "boltcache/internal/cache"
+	cluster "boltcache/internal/cluster"
 	logger "boltcache/logger"
 )
 
@@ -19,22 +20,29 @@ type ClusterNode struct {
 	ID      string
 	Address string
 	Port    int
-	Role    string // master, slave
+	Role    string // master, slave; failover changes Cache.Cluster.Myself().Role
 	Cache *cache.BoltCache
 }
 
 func NewClusterNode(id, address string, port int, role string) *ClusterNode {
-	return &ClusterNode{
+	n := &ClusterNode{
 		ID:      id,
 		Address: address,
 		Port:    port,
 		Role:    role,
 		Cache:   cache.NewBoltCache(fmt.Sprintf("./data/node_%s.json", id)),
 	}
+	clusterRole := cluster.RoleMaster
+	if role == "slave" {
+		clusterRole = cluster.RoleReplica
+	}
+	n.Cache.Cluster = cluster.New(id, fmt.Sprintf("%s:%d", address, port), clusterRole, "", config.ClusterConfig{})
+	n.Cache.Data.IndexSlots()
+	return n
 }
 
 func (n *ClusterNode) Start(cfg *config.Config) {
-
+	n.Cache.Cluster.Start(nil)
 
 	listener, err := net.Listen("tcp", fmt.Sprintf(":%d", n.Port))
 	if err != nil {
@@ -56,14 +64,10 @@ func (n *ClusterNode) Start(cfg *config.Config) {
 }
 
 func (n *ClusterNode) JoinCluster(masterAddr string) {
-	conn, err := net.Dial("tcp", masterAddr)
-	if err != nil {
+	if err := n.Cache.Cluster.Meet(masterAddr); err != nil {
 		logger.Log("Failed to join cluster: %v", err)
 		return
 	}
-	defer conn.Close()
-
-	fmt.Fprintf(conn, "CLUSTER JOIN %s %s:%d\n", n.ID, n.Address, n.Port)
 	fmt.Printf("Joined cluster with master %s\n", masterAddr)
 }
 
@@ -99,26 +103,84 @@ func startCluster(cfg *config.Config) {
 	node.Start(cfg)
 }
 
-func RunClusterCMD(cfg *config.Config, nodeID string, port int, replicas []string) {
+// ClusterOptions are the command line settings of a cluster node.
+type ClusterOptions struct {
+	NodeID   string   // defaults to cluster.node_id
+	Port     int      // TCP port
+	Replicas []string // replicas sync mode waits for
+	Master   string   // run as a replica of this address
+	Join     []string // nodes to join the cluster through
+	Slots    string   // slots to serve, e.g. "0-5460"
+}
+
+// RunClusterCMD runs a cluster node: a replica of opts.Master when set,
+// otherwise a master expecting opts.Replicas. The node joins the cluster
+// through the join addresses, its master and the nodes discovery finds.
+func RunClusterCMD(cfg *config.Config, opts ClusterOptions) {
+	nodeID, port, master := opts.NodeID, opts.Port, opts.Master
+	if nodeID == "" {
+		nodeID = cfg.Cluster.NodeID
+	}
+	if nodeID == "" {
+		log.Fatalf("No node ID: pass --node or set cluster.node_id")
+	}
 	persistFile := fmt.Sprintf("./data/boltcache_%s.json", nodeID)
 
 	cache := cache.NewBoltCache(persistFile)
 	cache.StartDataCleaner()
+	addr := clusterAddr(cfg.Cluster.Announce, "localhost", port)
+	if err := startConsensus(cache, cfg.Cluster.Consensus, nodeID, addr); err != nil {
+		log.Fatalf("Failed to start consensus: %v", err)
+	}
+
+	repl := cfg.Cluster.Replication
+	repl.Enabled = true
+	if len(opts.Replicas) > 0 {
+		repl.Replicas = opts.Replicas
+	}
+	if master != "" {
+		repl.Role, repl.Master = "replica", master
+	}
+	if err := cache.StartReplication(repl); err != nil {
+		log.Fatalf("Failed to start replication: %v", err)
+	}
+
+	if aa := cfg.Cluster.ActiveActive; len(aa.Peers) > 0 && master == "" {
+		if err := cache.StartActiveReplication(nodeID, aa); err != nil {
+			log.Fatalf("Failed to start active-active replication: %v", err)
+		}
+	}
 
-	for _, r := range replicas {
-		cache.AddReplica(r)
+	seeds := append([]string(nil), opts.Join...)
+	if master != "" {
+		seeds = append(seeds, master)
+	}
+	startClusterMembership(cache, cfg, nodeID, addr, seeds)
+	if opts.Slots != "" {
+		slots, err := cluster.ParseSlots(opts.Slots)
+		if err == nil {
+			err = cache.Cluster.AddSlots(slots)
+		}
+		if err != nil {
+			log.Fatalf("Invalid --slots %q: %v", opts.Slots, err)
+		}
 	}
 
-	addr := fmt.Sprintf(":%d", port)
-	listener, err := net.Listen("tcp", addr)
+	listen := fmt.Sprintf(":%d", port)
+	listener, err := net.Listen("tcp", listen)
 	if err != nil {
-		log.Fatalf("Failed to start server on %s: %v", addr, err)
+		log.Fatalf("Failed to start server on %s: %v", listen, err)
 	}
 	defer listener.Close()
 
-	fmt.Printf("BoltCache node %s started on %s\n", nodeID, addr)
+	fmt.Printf("BoltCache node %s started on %s\n", nodeID, listen)
+	fmt.Printf("Cluster address: %s\n", cache.Cluster.Myself().Addr)
 	fmt.Printf("Persistence: %s\n", persistFile)
-	fmt.Printf("Replicas: %v\n", cache.Replicas)
+	if master != "" {
+		fmt.Printf("Replica of: %s\n", master)
+	} else {
+		fmt.Printf("Replicas: %v\n", cache.GetReplicas())
+	}
 
 	for {
 		conn, err := listener.Accept()
@@ -129,3 +191,39 @@ func RunClusterCMD(cfg *config.Config, nodeID string, port int, replicas []strin
 		go handleConnection(conn, cache)
 	}
 }
+
+// startClusterMembership creates the membership table of c and joins the
+// cluster through seeds and the nodes discovery finds.
+func startClusterMembership(c *cache.BoltCache, cfg *config.Config, id, addr string, seeds []string) {
+	role, master := cluster.RoleMaster, ""
+	if c.IsReplica() {
+		role, master = cluster.RoleReplica, c.ReplicationInfo().Master
+	}
+	c.Cluster = cluster.New(id, addr, role, master, cfg.Cluster)
+	// Resharding lists the keys of the slots it moves.
+	c.Data.IndexSlots()
+	if c.ReplicationEnabled() {
+		c.Cluster.SetReplication(c)
+	}
+
+	// Static endpoints are known up front and join with retries.
+	if d := cfg.Cluster.Discovery; d.Method == "" || d.Method == "static" {
+		seeds = append(seeds, d.Endpoints...)
+	}
+	c.Cluster.Start(seeds)
+	if _, err := startDiscovery(c, cfg.Cluster.Discovery, id, addr); err != nil {
+		log.Fatalf("Failed to start discovery: %v", err)
+	}
+}
+
+// clusterAddr is the address other nodes reach a node listening on port
+// at: the announce address, or host and port.
+func clusterAddr(announce, host string, port int) string {
+	if announce != "" {
+		return announce
+	}
+	if host == "" || host == "0.0.0.0" || host == "::" {
+		host = "127.0.0.1"
+	}
+	return net.JoinHostPort(host, strconv.Itoa(port))
+}
@@ -0,0 +1,480 @@
+package server
+
+import (
+	"bufio"
+	"io"
+	"net"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+import (
+	config "boltcache/config"
+	cache "boltcache/internal/cache"
+	cluster "boltcache/internal/cluster"
+)
+
+// testNode serves the text protocol for a cluster member until stop.
+type testNode struct {
+	cache *cache.BoltCache
+	ln    net.Listener
+
+	mu    sync.Mutex
+	conns []net.Conn
+}
+
+func startTestNode(t *testing.T, id string) *testNode {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	cfg := config.ClusterConfig{HeartbeatInterval: 10 * time.Millisecond, NodeTimeout: 100 * time.Millisecond}
+	n := &testNode{cache: &cache.BoltCache{Data: cache.NewShardedMap()}, ln: ln}
+	n.cache.Cluster = cluster.New(id, ln.Addr().String(), cluster.RoleMaster, "", cfg)
+	n.cache.Data.IndexSlots()
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			n.mu.Lock()
+			n.conns = append(n.conns, conn)
+			n.mu.Unlock()
+			go handleConnection(conn, n.cache)
+		}
+	}()
+	t.Cleanup(n.stop)
+	return n
+}
+
+func (n *testNode) stop() {
+	n.cache.Cluster.Stop()
+	n.ln.Close()
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	for _, c := range n.conns {
+		c.Close()
+	}
+}
+
+func (n *testNode) knows(id string, failed bool) bool {
+	node, ok := n.cache.Cluster.Node(id)
+	return ok && node.Failed == failed
+}
+
+func TestClusterMembership(t *testing.T) {
+	a, b, c := startTestNode(t, "a"), startTestNode(t, "b"), startTestNode(t, "c")
+	a.cache.Cluster.Start(nil)
+	b.cache.Cluster.Start([]string{a.ln.Addr().String()})
+	c.cache.Cluster.Start([]string{a.ln.Addr().String()})
+
+	// b and c only joined through a; heartbeats introduce them.
+	waitUntil(t, "membership", func() bool {
+		return b.knows("c", false) && c.knows("b", false) && a.knows("b", false)
+	})
+
+	sess := newSession(a.cache, protoRESP2, nil)
+	reply := &respReply{}
+	run(sess, reply, "CLUSTER NODES")
+	if strings.Count(string(reply.buf), " connected\n") != 3 || !strings.Contains(string(reply.buf), "a "+a.ln.Addr().String()+" myself,master - ") {
+		t.Fatalf("CLUSTER NODES %q", reply.buf)
+	}
+
+	c.stop()
+	waitUntil(t, "failure", func() bool { return a.knows("c", true) && b.knows("c", true) })
+	reply = &respReply{}
+	run(sess, reply, "CLUSTER INFO")
+	if !strings.Contains(string(reply.buf), "cluster_state:fail") || !strings.Contains(string(reply.buf), "cluster_nodes_failed:1") {
+		t.Fatalf("CLUSTER INFO %q", reply.buf)
+	}
+
+	reply = &respReply{}
+	run(sess, reply, "CLUSTER FORGET c")
+	if string(reply.buf) != "+OK\r\n" || a.knows("c", true) {
+		t.Fatalf("CLUSTER FORGET %q", reply.buf)
+	}
+}
+
+func TestClusterRouting(t *testing.T) {
+	c := &cache.BoltCache{Data: cache.NewShardedMap()}
+	c.Cluster = cluster.New("a", "127.0.0.1:7000", cluster.RoleMaster, "", config.ClusterConfig{})
+	sess := newSession(c, protoRESP2, nil)
+
+	// foo is in slot 12182, key63 in 16174, {user}x and {user}y in 5474.
+	cases := []struct {
+		line string
+		want string
+	}{
+		{"SET foo 1", "+OK\r\n"}, // no slots assigned: not sharded
+		{"CLUSTER ADDSLOTSRANGE 0 8191", "+OK\r\n"},
+		{"CLUSTER HEARTBEAT b 127.0.0.1:7001 master - 0 8192-16000", "*14\r\n"},
+		{"GET foo", "-MOVED 12182 127.0.0.1:7001\r\n"},
+		{"SET {user}x 1", "+OK\r\n"},
+		{"MGET {user}x {user}y", "*2\r\n$1\r\n1\r\n$-1\r\n"},
+		{"MGET {user}x foo", "-CROSSSLOT Keys in request don't hash to the same slot\r\n"},
+		{"GET key63", "-CLUSTERDOWN Hash slot not served\r\n"},
+		{"CLUSTER KEYSLOT foo", ":12182\r\n"},
+		{"PING", "+PONG\r\n"},
+		{"CLUSTER SLOTS", "*2\r\n*3\r\n:0\r\n:8191\r\n*3\r\n$9\r\n127.0.0.1\r\n:7000\r\n$1\r\na\r\n" +
+			"*3\r\n:8192\r\n:16000\r\n*3\r\n$9\r\n127.0.0.1\r\n:7001\r\n$1\r\nb\r\n"},
+		{"CLUSTER SETSLOT 100 NODE b", "+OK\r\n"},
+		{"CLUSTER ADDSLOTS 100", "-ERR Slot 100 is already busy\r\n"},
+	}
+	for i, tc := range cases {
+		reply := &respReply{}
+		run(sess, reply, tc.line)
+		if !strings.HasPrefix(string(reply.buf), tc.want) {
+			t.Fatalf("%d %s: got %q, want %q", i, tc.line, reply.buf, tc.want)
+		}
+	}
+}
+
+// respCall sends args as a RESP array and reads one simple reply line.
+func respCall(t *testing.T, conn net.Conn, r *bufio.Reader, args ...string) string {
+	t.Helper()
+	buf := []byte("*" + strconv.Itoa(len(args)) + "\r\n")
+	for _, arg := range args {
+		buf = append(buf, "$"+strconv.Itoa(len(arg))+"\r\n"+arg+"\r\n"...)
+	}
+	if _, err := conn.Write(buf); err != nil {
+		t.Fatal(err)
+	}
+	line, err := r.ReadString('\n')
+	if err != nil {
+		t.Fatal(err)
+	}
+	if line[0] == '$' && line != "$-1\r\n" {
+		n, _ := strconv.Atoi(strings.TrimSpace(line[1:]))
+		data := make([]byte, n+2)
+		if _, err := io.ReadFull(r, data); err != nil {
+			t.Fatal(err)
+		}
+		line += string(data)
+	}
+	return line
+}
+
+func TestClusterRedirectRESP(t *testing.T) {
+	a, b := startTestNode(t, "a"), startTestNode(t, "b")
+	a.cache.Cluster.AddSlots(slotRange(0, 8191))
+	b.cache.Cluster.AddSlots(slotRange(8192, 16383))
+	a.cache.Cluster.Start(nil)
+	b.cache.Cluster.Start([]string{a.ln.Addr().String()})
+	waitUntil(t, "slot ownership", func() bool {
+		return a.cache.Cluster.SlotsAssigned() == cluster.SlotCount && b.cache.Cluster.SlotsAssigned() == cluster.SlotCount
+	})
+
+	// A RESP client follows MOVED to the announced address.
+	addr := a.ln.Addr().String()
+	for hop := 0; ; hop++ {
+		conn, err := net.Dial("tcp", addr)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer conn.Close()
+		r := bufio.NewReader(conn)
+		reply := respCall(t, conn, r, "SET", "foo", "bar")
+		if hop == 0 {
+			if want := "-MOVED 12182 " + b.ln.Addr().String() + "\r\n"; reply != want {
+				t.Fatalf("SET on a: %q, want %q", reply, want)
+			}
+			addr = strings.Fields(reply)[2]
+			continue
+		}
+		if reply != "+OK\r\n" {
+			t.Fatalf("SET after MOVED: %q", reply)
+		}
+		if reply := respCall(t, conn, r, "GET", "foo"); reply != "$3\r\nbar\r\n" {
+			t.Fatalf("GET after MOVED: %q", reply)
+		}
+		break
+	}
+
+	// Protocol errors are reported before the connection closes.
+	conn, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	conn.Write([]byte("*1\r\n$x\r\n"))
+	if line, _ := bufio.NewReader(conn).ReadString('\n'); !strings.HasPrefix(line, "-") {
+		t.Fatalf("protocol error: %q", line)
+	}
+}
+
+func waitUntil(t *testing.T, what string, cond func() bool) {
+	t.Helper()
+	for deadline := time.Now().Add(5 * time.Second); !cond(); {
+		if time.Now().After(deadline) {
+			t.Fatalf("timed out waiting for %s", what)
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+}
+
+func TestReshard(t *testing.T) {
+	a, b := startTestNode(t, "a"), startTestNode(t, "b")
+	all := make([]int, cluster.SlotCount)
+	for i := range all {
+		all[i] = i
+	}
+	if err := a.cache.Cluster.AddSlots(all); err != nil {
+		t.Fatal(err)
+	}
+	a.cache.Cluster.Start(nil)
+	b.cache.Cluster.Start([]string{a.ln.Addr().String()})
+	waitUntil(t, "membership", func() bool { return a.knows("b", false) && b.knows("a", false) })
+
+	// Keys of slots 0 and 1, and one of slot 2 that stays.
+	var moving []string
+	for i := 0; len(moving) < 20; i++ {
+		key := "key" + strconv.Itoa(i)
+		switch cluster.KeySlot([]byte(key)) {
+		case 0, 1:
+			moving = append(moving, key)
+			a.cache.Set(key, key, 0)
+		case 2:
+			a.cache.Set("stay", "x", 0)
+		}
+	}
+	gone := moving[1]
+	a.cache.HSet(moving[0], "f", "v") // not a string
+
+	// A key gone from a migrating slot is answered with ASK.
+	slot := strconv.Itoa(cluster.KeySlot([]byte(gone)))
+	sess := newSession(a.cache, protoRESP2, nil)
+	run(sess, &respReply{}, "CLUSTER SETSLOT "+slot+" MIGRATING b")
+	a.cache.Delete(gone)
+	reply := &respReply{}
+	run(sess, reply, "GET "+gone)
+	if want := "-ASK " + slot + " " + b.ln.Addr().String() + "\r\n"; string(reply.buf) != want {
+		t.Fatalf("GET during migration: %q, want %q", reply.buf, want)
+	}
+	reply = &respReply{}
+	run(sess, reply, "CLUSTER NODES")
+	if !strings.Contains(string(reply.buf), " 0-16383 ["+slot+"->-b]\n") {
+		t.Fatalf("CLUSTER NODES %q", reply.buf)
+	}
+	run(sess, &respReply{}, "CLUSTER SETSLOT "+slot+" STABLE")
+
+	var moved []int
+	err := Reshard(a.ln.Addr().String(), ReshardOptions{From: "a", To: "b", Slots: 2, Pipeline: 3}, func(slot, keys int) {
+		moved = append(moved, slot, keys)
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(moved) != 4 || moved[0] != 0 || moved[2] != 1 || moved[1]+moved[3] != len(moving)-1 {
+		t.Fatalf("moved %v", moved)
+	}
+
+	for _, key := range moving[1:] {
+		if key == gone {
+			continue
+		}
+		if _, ok := a.cache.Get(key); ok {
+			t.Fatalf("%s still on the source", key)
+		}
+		if v, ok := b.cache.Get(key); !ok || v != key {
+			t.Fatalf("%s on the target: %v", key, v)
+		}
+	}
+	if v, ok := b.cache.Get(moving[0]); !ok || v.(map[string]string)["f"] != "v" {
+		t.Fatalf("hash on the target: %v", v)
+	}
+	if _, ok := a.cache.Get("stay"); !ok {
+		t.Fatal("key of another slot moved")
+	}
+	if n := a.cache.Data.CountKeysInSlot(0); n != 0 {
+		t.Fatalf("%d keys left in slot 0", n)
+	}
+
+	reply = &respReply{}
+	run(sess, reply, "GET "+moving[0])
+	if !strings.HasPrefix(string(reply.buf), "-MOVED ") || !strings.HasSuffix(string(reply.buf), b.ln.Addr().String()+"\r\n") {
+		t.Fatalf("GET after reshard: %q", reply.buf)
+	}
+	waitUntil(t, "slot ownership", func() bool {
+		return a.cache.Cluster.Route(1).Owner.ID == "b" && b.cache.Cluster.Route(0).Owner.ID == "b" &&
+			b.cache.Cluster.Route(2).Owner.ID == "a"
+	})
+}
+
+// startReplicatedNode starts a cluster member that replicates: a master,
+// or a replica of master.
+func startReplicatedNode(t *testing.T, id string, master *testNode) *testNode {
+	n := startTestNode(t, id)
+	cfg := config.ReplicationConfig{Enabled: true, Mode: "async"}
+	if master != nil {
+		cfg.Role, cfg.Master = "replica", master.ln.Addr().String()
+		n.cache.Cluster.SetRole(cluster.RoleReplica, cfg.Master)
+	}
+	if err := n.cache.StartReplication(cfg); err != nil {
+		t.Fatal(err)
+	}
+	n.cache.Cluster.SetReplication(n.cache)
+	return n
+}
+
+func slotRange(start, end int) []int {
+	slots := make([]int, 0, end-start+1)
+	for slot := start; slot <= end; slot++ {
+		slots = append(slots, slot)
+	}
+	return slots
+}
+
+func TestFailover(t *testing.T) {
+	a, b, c := startReplicatedNode(t, "a", nil), startReplicatedNode(t, "b", nil), startReplicatedNode(t, "c", nil)
+	d, e := startReplicatedNode(t, "d", a), startReplicatedNode(t, "e", a)
+	a.cache.Cluster.AddSlots(slotRange(0, 5460))
+	b.cache.Cluster.AddSlots(slotRange(5461, 10922))
+	c.cache.Cluster.AddSlots(slotRange(10923, 16383))
+	a.cache.Cluster.Start(nil)
+	for _, n := range []*testNode{b, c, d, e} {
+		n.cache.Cluster.Start([]string{a.ln.Addr().String()})
+	}
+	nodes := []*testNode{a, b, c, d, e}
+	waitUntil(t, "membership", func() bool {
+		for _, n := range nodes {
+			for _, id := range []string{"a", "b", "c", "d", "e"} {
+				if _, ok := n.cache.Cluster.Node(id); !ok {
+					return false
+				}
+			}
+			if n.cache.Cluster.SlotsAssigned() != cluster.SlotCount {
+				return false
+			}
+		}
+		return true
+	})
+
+	key := "key0"
+	for i := 1; cluster.KeySlot([]byte(key)) > 5460; i++ {
+		key = "key" + strconv.Itoa(i)
+	}
+	a.cache.Set(key, "v1", 0)
+	waitUntil(t, "replication", func() bool {
+		v1, _ := d.cache.Get(key)
+		v2, _ := e.cache.Get(key)
+		return v1 == "v1" && v2 == "v1"
+	})
+
+	a.stop()
+	var winner, other *testNode
+	waitUntil(t, "failover", func() bool {
+		owner := b.cache.Cluster.Route(0).Owner.ID
+		switch owner {
+		case "d":
+			winner, other = d, e
+		case "e":
+			winner, other = e, d
+		default:
+			return false
+		}
+		addr := winner.ln.Addr().String()
+		return c.cache.Cluster.Route(0).Owner.ID == owner && !winner.cache.IsReplica() &&
+			other.cache.Cluster.Myself().Master == addr && other.cache.ReplicationInfo().Master == addr
+	})
+
+	// The new master takes writes and its sibling replicates them.
+	sess := newSession(winner.cache, protoRESP2, nil)
+	reply := &respReply{}
+	run(sess, reply, "SET "+key+" v2")
+	if string(reply.buf) != "+OK\r\n" {
+		t.Fatalf("SET on the new master: %q", reply.buf)
+	}
+	waitUntil(t, "replication from the new master", func() bool {
+		v, _ := other.cache.Get(key)
+		return v == "v2"
+	})
+	reply = &respReply{}
+	run(newSession(b.cache, protoRESP2, nil), reply, "GET "+key)
+	if want := "-MOVED " + strconv.Itoa(cluster.KeySlot([]byte(key))) + " " + winner.ln.Addr().String() + "\r\n"; string(reply.buf) != want {
+		t.Fatalf("GET on another master: %q, want %q", reply.buf, want)
+	}
+}
+
+func TestDiscovery(t *testing.T) {
+	a := startReplicatedNode(t, "a", nil)
+	d := startReplicatedNode(t, "d", a)
+	path := filepath.Join(t.TempDir(), "nodes")
+	nodes := a.ln.Addr().String() + "\n" + d.ln.Addr().String() + "\n"
+	if err := os.WriteFile(path, []byte(nodes), 0644); err != nil {
+		t.Fatal(err)
+	}
+	cfg := config.DiscoveryConfig{Method: "file", Endpoints: []string{path}, Interval: 20 * time.Millisecond}
+	for _, n := range []*testNode{a, d} {
+		n.cache.Cluster.Start(nil)
+		w, err := startDiscovery(n.cache, cfg, n.cache.Cluster.Myself().ID, n.ln.Addr().String())
+		if err != nil {
+			t.Fatal(err)
+		}
+		t.Cleanup(w.Stop)
+	}
+
+	// The nodes meet, and the master waits for the replica it found.
+	waitUntil(t, "membership and replicas", func() bool {
+		replicas := a.cache.GetReplicas()
+		return a.knows("d", false) && d.knows("a", false) && len(replicas) == 1 && replicas[0] == d.ln.Addr().String()
+	})
+	if err := os.WriteFile(path, []byte(a.ln.Addr().String()+"\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	waitUntil(t, "replica removal", func() bool { return len(a.cache.GetReplicas()) == 0 })
+}
+
+func TestConsensus(t *testing.T) {
+	nodes := []*testNode{startTestNode(t, "a"), startTestNode(t, "b"), startTestNode(t, "c")}
+	var peers []string
+	for _, n := range nodes {
+		peers = append(peers, n.ln.Addr().String())
+	}
+	cfg := config.ConsensusConfig{Prefixes: []string{"lock:"}, Peers: peers, Directory: t.TempDir(), ElectionTimeout: 100 * time.Millisecond}
+	var sessions []*Session
+	for _, n := range nodes {
+		if err := startConsensus(n.cache, cfg, n.cache.Cluster.Myself().ID, n.ln.Addr().String()); err != nil {
+			t.Fatal(err)
+		}
+		t.Cleanup(n.cache.Consensus.Stop)
+		sessions = append(sessions, newSession(n.cache, protoRESP2, nil))
+	}
+	expect := func(sess *Session, line, want string) {
+		t.Helper()
+		reply := &respReply{}
+		run(sess, reply, line)
+		if string(reply.buf) != want {
+			t.Fatalf("%s: got %q, want %q", line, reply.buf, want)
+		}
+	}
+
+	// Writes go through the log from any member; reads see the last one.
+	expect(sessions[0], "SET lock:a 1 NX", "+OK\r\n")
+	expect(sessions[1], "SET lock:a 2 NX", "$-1\r\n")
+	expect(sessions[2], "GET lock:a", "$1\r\n1\r\n")
+	for i, sess := range sessions {
+		expect(sess, "SADD lock:s m"+strconv.Itoa(i), ":1\r\n")
+	}
+	expect(sessions[1], "SADD lock:s m0", ":0\r\n")
+
+	// Regular keys stay local.
+	expect(sessions[0], "SET other 1", "+OK\r\n")
+	expect(sessions[1], "GET other", "$-1\r\n")
+
+	expect(sessions[0], "MGET lock:a other", "-CROSSSLOT Keys in request mix consistent and regular keys\r\n")
+	expect(sessions[0], "MULTI", "+OK\r\n")
+	expect(sessions[0], "SET lock:a 3", "-ERR consistent keys can't be used in MULTI\r\n")
+	expect(sessions[0], "DISCARD", "+OK\r\n")
+
+	reply := &respReply{}
+	run(sessions[0], reply, "INFO consensus")
+	if !strings.Contains(string(reply.buf), "consensus_prefixes:lock:") || !strings.Contains(string(reply.buf), "raft_state:") {
+		t.Fatalf("INFO consensus %q", reply.buf)
+	}
+}
@@ -0,0 +1,411 @@
+package server
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+)
+
+import (
+	cache "boltcache/internal/cache"
+	logger "boltcache/logger"
+)
+
+// CommandFlags describe how a command interacts with the dataset.
+type CommandFlags uint16
+
+const (
+	FlagRead        CommandFlags = 1 << iota // reads the keyspace
+	FlagWrite                                // may modify the keyspace
+	FlagAdmin                                // server administration
+	FlagPubSub                               // allowed while a RESP2 connection is subscribed
+	FlagFast                                 // O(1) or O(log N)
+	FlagTransaction                          // transaction control, never queued by MULTI
+	FlagBlocking                             // may wait for other clients' writes
+	FlagExclusive                            // runs holding TxMu exclusively, like EXEC
+)
+
+var commandFlagNames = []struct {
+	flag CommandFlags
+	name string
+}{
+	{FlagRead, "readonly"},
+	{FlagWrite, "write"},
+	{FlagAdmin, "admin"},
+	{FlagPubSub, "pubsub"},
+	{FlagFast, "fast"},
+	{FlagTransaction, "transaction"},
+	{FlagBlocking, "blocking"},
+	{FlagExclusive, "exclusive"},
+}
+
+func (f CommandFlags) Names() []string {
+	names := []string{}
+	for _, fn := range commandFlagNames {
+		if f&fn.flag != 0 {
+			names = append(names, fn.name)
+		}
+	}
+	return names
+}
+
+// CommandHandler executes a command and answers through ctx.Reply.
+type CommandHandler func(ctx *CommandContext)
+
+// Command is an entry of the command table shared by every protocol.
+//
+// Arity follows the Redis convention and counts the command name itself:
+// a positive value is the exact number of arguments, a negative value -N
+// means at least N. FirstKey, LastKey and KeyStep locate the key arguments
+// (LastKey -1 means the last argument); FirstKey 0 means no keys.
+type Command struct {
+	Name     string
+	Arity    int
+	Flags    CommandFlags
+	FirstKey int
+	LastKey  int
+	KeyStep  int
+	Feature  string // config feature flag gating the command, "" = always on
+	Handler  CommandHandler
+}
+
+// CommandContext carries everything a handler needs for one invocation.
+type CommandContext struct {
+	Cache   *cache.BoltCache
+	Session *Session
+	Command *Command
+	Args    [][]byte
+	Reply   Reply
+}
+
+// Arg returns argument i as a string.
+func (ctx *CommandContext) Arg(i int) string {
+	return string(ctx.Args[i])
+}
+
+// SyntaxError answers with the standard syntax error.
+func (ctx *CommandContext) SyntaxError() {
+	ctx.Reply.WriteError("ERR syntax error")
+}
+
+var commandTable = make(map[string]*Command)
+
+// registerCommands adds commands to the table; called from init functions.
+func registerCommands(cmds ...*Command) {
+	for _, c := range cmds {
+		name := strings.ToUpper(c.Name)
+		if _, dup := commandTable[name]; dup {
+			panic("duplicate command " + name)
+		}
+		c.Name = name
+		commandTable[name] = c
+	}
+}
+
+// lookupCommand finds a command case-insensitively without allocating.
+func lookupCommand(name []byte) *Command {
+	var buf [32]byte
+	if len(name) > len(buf) {
+		return nil
+	}
+	for i, ch := range name {
+		if ch >= 'a' && ch <= 'z' {
+			ch -= 'a' - 'A'
+		}
+		buf[i] = ch
+	}
+	return commandTable[string(buf[:len(name)])]
+}
+
+func (c *Command) arityOK(n int) bool {
+	if c.Arity >= 0 {
+		return n == c.Arity
+	}
+	return n >= -c.Arity
+}
+
+// Keys returns the key arguments of args according to the key spec.
+func (c *Command) Keys(args [][]byte) [][]byte {
+	if c.FirstKey <= 0 || c.FirstKey >= len(args) {
+		return nil
+	}
+	last := c.LastKey
+	if last < 0 {
+		last = len(args) + last
+	}
+	if last >= len(args) {
+		last = len(args) - 1
+	}
+	step := c.KeyStep
+	if step <= 0 {
+		step = 1
+	}
+
+	keys := make([][]byte, 0, (last-c.FirstKey)/step+1)
+	for i := c.FirstKey; i <= last; i += step {
+		keys = append(keys, args[i])
+	}
+	return keys
+}
+
+func featureEnabled(c *cache.BoltCache, feature string) bool {
+	if c.Config == nil {
+		// Bare caches (cluster nodes without a config file) serve everything.
+		return true
+	}
+	return c.Config.IsFeatureEnabled(feature)
+}
+
+// Execute runs one command for the session and writes the answer to reply.
+func (s *Session) Execute(args [][]byte, reply Reply) {
+	if len(args) == 0 {
+		reply.WriteError("ERR empty command")
+		return
+	}
+
+	cmd := lookupCommand(args[0])
+	if cmd == nil {
+		s.queueError()
+		reply.WriteError(fmt.Sprintf("ERR unknown command '%s'", args[0]))
+		return
+	}
+
+	if !cmd.arityOK(len(args)) {
+		s.queueError()
+		reply.WriteError(fmt.Sprintf("ERR wrong number of arguments for '%s' command", strings.ToLower(cmd.Name)))
+		return
+	}
+
+	if cmd.Feature != "" && !featureEnabled(s.cache, cmd.Feature) {
+		s.queueError()
+		reply.WriteError(fmt.Sprintf("ERR '%s' is disabled (features.%s)", strings.ToLower(cmd.Name), cmd.Feature))
+		return
+	}
+
+	// Consistent keys are on every Raft member, whatever their slot.
+	consistent, msg := s.consistent(cmd, args)
+	if msg != "" {
+		s.queueError()
+		reply.WriteError(msg)
+		return
+	}
+	redirect := ""
+	if !consistent {
+		redirect = s.route(cmd, args)
+	}
+	if cmd.Name != "ASKING" {
+		s.asking = false
+	}
+	if redirect != "" {
+		s.queueError()
+		reply.WriteError(redirect)
+		return
+	}
+
+	if cmd.Flags&FlagWrite != 0 && !consistent && s.cache.IsReplica() {
+		s.queueError()
+		reply.WriteError("READONLY You can't write against a read only replica.")
+		return
+	}
+
+	proto := s.Proto()
+	if r, ok := reply.(*respReply); ok {
+		r.resp3 = proto == protoRESP3
+	}
+
+	// RESP3 delivers messages as push frames, so subscribed RESP3
+	// connections may keep issuing regular commands.
+	if proto == protoRESP2 && s.subscriptions() > 0 && cmd.Flags&FlagPubSub == 0 {
+		reply.WriteError(fmt.Sprintf("ERR Can't execute '%s': only (P)SUBSCRIBE / (P)UNSUBSCRIBE / PING are allowed in this context", strings.ToLower(cmd.Name)))
+		return
+	}
+
+	if cmd.Flags&FlagTransaction != 0 {
+		// EXEC takes TxMu exclusively itself.
+		s.call(cmd, args, reply)
+		if cmd.Name == "EXEC" {
+			s.waitReplicas()
+		}
+		return
+	}
+
+	if s.multi {
+		if consistent {
+			s.queueError()
+			reply.WriteError("ERR consistent keys can't be used in MULTI")
+			return
+		}
+		s.queue = append(s.queue, queuedCommand{cmd: cmd, args: copyArgs(args)})
+		reply.WriteString("QUEUED")
+		return
+	}
+
+	if consistent {
+		s.executeConsistent(cmd, args, reply)
+		return
+	}
+
+	if cmd.Flags&FlagBlocking != 0 {
+		// Blocking commands take TxMu around each attempt themselves, so
+		// they never wait while holding it.
+		s.call(cmd, args, reply)
+	} else if cmd.Flags&FlagExclusive != 0 {
+		// Keep transactions and other commands from interleaving with it.
+		s.cache.TxMu.Lock()
+		s.call(cmd, args, reply)
+		s.cache.TxMu.Unlock()
+	} else {
+		s.cache.TxMu.RLock()
+		s.call(cmd, args, reply)
+		s.cache.TxMu.RUnlock()
+	}
+	if cmd.Flags&FlagWrite != 0 {
+		s.waitReplicas()
+	}
+}
+
+// waitReplicas holds the reply to a write until the replicas have it when
+// replication is synchronous. A write the replicas don't confirm in time
+// is answered anyway and counted in INFO replication.
+func (s *Session) waitReplicas() {
+	if !s.cache.SyncReplication() {
+		return
+	}
+	offset := s.cache.ReplicationOffset()
+	if !s.cache.WaitReplicas(offset) {
+		logger.Log("Replicas did not acknowledge offset %d in time", offset)
+	}
+}
+
+// call runs the handler of cmd.
+func (s *Session) call(cmd *Command, args [][]byte, reply Reply) {
+	cmd.Handler(&CommandContext{
+		Cache:   s.cache,
+		Session: s,
+		Command: cmd,
+		Args:    args,
+		Reply:   reply,
+	})
+}
+
+// queueError marks an open transaction as failed, like Redis does when a
+// command is rejected before it could be queued.
+func (s *Session) queueError() {
+	if s.multi {
+		s.dirty = true
+	}
+}
+
+// copyArgs detaches args from the connection's read buffer.
+func copyArgs(args [][]byte) [][]byte {
+	out := make([][]byte, len(args))
+	for i, a := range args {
+		out[i] = append([]byte(nil), a...)
+	}
+	return out
+}
+
+// sortedCommands returns the command table ordered by name.
+func sortedCommands() []*Command {
+	cmds := make([]*Command, 0, len(commandTable))
+	for _, c := range commandTable {
+		cmds = append(cmds, c)
+	}
+	sort.Slice(cmds, func(i, j int) bool { return cmds[i].Name < cmds[j].Name })
+	return cmds
+}
+
+// splitArgs splits an inline command line into arguments. Double quotes
+// support the usual escapes (\n, \t, \", \xHH, ...) and single quotes
+// only \', the same rules as redis-cli.
+func splitArgs(line []byte) ([][]byte, error) {
+	var args [][]byte
+	i := 0
+	for {
+		for i < len(line) && (line[i] == ' ' || line[i] == '\t') {
+			i++
+		}
+		if i >= len(line) {
+			return args, nil
+		}
+
+		switch line[i] {
+		case '"', '\'':
+			quote := line[i]
+			i++
+			var arg []byte
+			closed := false
+			for i < len(line) {
+				ch := line[i]
+				if ch == '\\' && i+1 < len(line) {
+					next := line[i+1]
+					if quote == '\'' {
+						if next == '\'' {
+							arg = append(arg, '\'')
+							i += 2
+							continue
+						}
+					} else if next == 'x' && i+3 < len(line) && isHex(line[i+2]) && isHex(line[i+3]) {
+						arg = append(arg, unhex(line[i+2])<<4|unhex(line[i+3]))
+						i += 4
+						continue
+					} else {
+						switch next {
+						case 'n':
+							ch = '\n'
+						case 'r':
+							ch = '\r'
+						case 't':
+							ch = '\t'
+						case 'b':
+							ch = '\b'
+						case 'a':
+							ch = '\a'
+						default:
+							ch = next
+						}
+						arg = append(arg, ch)
+						i += 2
+						continue
+					}
+				}
+				if ch == quote {
+					closed = true
+					i++
+					break
+				}
+				arg = append(arg, ch)
+				i++
+			}
+			if !closed || (i < len(line) && line[i] != ' ' && line[i] != '\t') {
+				return nil, fmt.Errorf("ERR Protocol error: unbalanced quotes in request")
+			}
+			if arg == nil {
+				arg = []byte{}
+			}
+			args = append(args, arg)
+
+		default:
+			start := i
+			for i < len(line) && line[i] != ' ' && line[i] != '\t' {
+				i++
+			}
+			args = append(args, line[start:i])
+		}
+	}
+}
+
+func isHex(c byte) bool {
+	return (c >= '0' && c <= '9') || (c >= 'a' && c <= 'f') || (c >= 'A' && c <= 'F')
+}
+
+func unhex(c byte) byte {
+	switch {
+	case c >= '0' && c <= '9':
+		return c - '0'
+	case c >= 'a' && c <= 'f':
+		return c - 'a' + 10
+	default:
+		return c - 'A' + 10
+	}
+}
@@ -0,0 +1,499 @@
+package server
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"math"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+import (
+	config "boltcache/config"
+	cache "boltcache/internal/cache"
+)
+
+func run(sess *Session, reply Reply, line string) {
+	args, err := splitArgs([]byte(line))
+	if err != nil {
+		reply.WriteError(err.Error())
+		return
+	}
+	sess.Execute(args, reply)
+}
+
+func TestSplitArgs(t *testing.T) {
+	cases := map[string][]string{
+		`SET k v`:                {"SET", "k", "v"},
+		`  SET   "a b"  'c d'  `: {"SET", "a b", "c d"},
+		`SET k "line\nbreak"`:    {"SET", "k", "line\nbreak"},
+		`SET k "\x41\x42"`:       {"SET", "k", "AB"},
+		`SET k 'it\'s'`:          {"SET", "k", "it's"},
+		`SET k ""`:               {"SET", "k", ""},
+	}
+	for line, want := range cases {
+		args, err := splitArgs([]byte(line))
+		if err != nil {
+			t.Fatalf("%q: %v", line, err)
+		}
+		if len(args) != len(want) {
+			t.Fatalf("%q: got %q", line, args)
+		}
+		for i := range want {
+			if string(args[i]) != want[i] {
+				t.Fatalf("%q: arg %d = %q, want %q", line, i, args[i], want[i])
+			}
+		}
+	}
+
+	for _, line := range []string{`SET "k`, `SET "k"v`, `SET 'k`} {
+		if _, err := splitArgs([]byte(line)); err == nil {
+			t.Fatalf("%q: expected unbalanced quotes error", line)
+		}
+	}
+}
+
+func TestExecuteRESP(t *testing.T) {
+	sess := newSession(&cache.BoltCache{Data: cache.NewShardedMap()}, protoRESP2, nil)
+
+	cases := []struct {
+		line string
+		want string
+	}{
+		{"PING", "+PONG\r\n"},
+		{"set k v", "+OK\r\n"},
+		{"SET k v2 NX", "$-1\r\n"},
+		{"GET k", "$1\r\nv\r\n"},
+		{"SET k v EX 0", "-ERR invalid expire time in 'set' command\r\n"},
+		{"SET k v EX 10 KEEPTTL", "-ERR syntax error\r\n"},
+		{"SET k v EX 9223372036854775807", "-ERR invalid expire time in 'set' command\r\n"},
+		{"SET k v 2500000h", "-ERR invalid expire time in 'set' command\r\n"},
+		{"EXPIRE k 9223372036854775807", "-ERR invalid expire time in 'expire' command\r\n"},
+		{"PEXPIRE k 9223372036854775807", "-ERR invalid expire time in 'pexpire' command\r\n"},
+		{"EXPIREAT k -9223372036854775807", "-ERR invalid expire time in 'expireat' command\r\n"},
+		{"EXPIRE k 100", ":1\r\n"},
+		{"TTL k", ":100\r\n"},
+		{"PEXPIREAT k 9223372036854", ":1\r\n"},
+		{"EXISTS k k missing", ":2\r\n"},
+		{"DEL k missing", ":1\r\n"},
+		{"INCRBY n 9223372036854775807", ":9223372036854775807\r\n"},
+		{"INCR n", "-ERR increment or decrement would overflow\r\n"},
+		{"DECRBY n -9223372036854775808", "-ERR increment or decrement would overflow\r\n"},
+		{"GET", "-ERR wrong number of arguments for 'get' command\r\n"},
+		{"NOPE", "-ERR unknown command 'NOPE'\r\n"},
+		{"HSET h a 1 b 2", ":2\r\n"},
+		{"HSET h a 1 b", "-ERR wrong number of arguments for 'hset' command\r\n"},
+		{"GET h", "-" + errWrongType + "\r\n"},
+		{"LPUSH l a b", ":2\r\n"},
+		{"LPOP missing", "$-1\r\n"},
+	}
+	for _, tc := range cases {
+		reply := &respReply{}
+		run(sess, reply, tc.line)
+		if string(reply.buf) != tc.want {
+			t.Fatalf("%s: got %q, want %q", tc.line, reply.buf, tc.want)
+		}
+	}
+}
+
+func TestExecuteText(t *testing.T) {
+	sess := newSession(&cache.BoltCache{Data: cache.NewShardedMap()}, protoText, nil)
+
+	cases := []struct {
+		line string
+		want string
+	}{
+		{"PING", "PONG\n"},
+		{"SET k v 1m", "OK\n"},
+		{`SET msg "hello world"`, "OK\n"},
+		{"GET msg", "VALUE hello world\n"},
+		{"GET missing", "NIL\n"},
+		{"SADD s a", "INTEGER 1\n"},
+		{"SMEMBERS s", "ARRAY a\n"},
+		{"SMEMBERS none", "ARRAY\n"},
+		{"GET", "ERROR: wrong number of arguments for 'get' command\n"},
+	}
+	for _, tc := range cases {
+		reply := &textReply{}
+		run(sess, reply, tc.line)
+		if string(reply.buf) != tc.want {
+			t.Fatalf("%s: got %q, want %q", tc.line, reply.buf, tc.want)
+		}
+	}
+}
+
+func TestTextLineTooBig(t *testing.T) {
+	client, server := net.Pipe()
+	defer client.Close()
+	go handleConnection(server, &cache.BoltCache{Data: cache.NewShardedMap()})
+
+	// The line is written in the background, since the server stops
+	// reading once it is over the limit.
+	go client.Write([]byte("PING\nSET k " + strings.Repeat("v", maxInlineSize) + "\n"))
+
+	got, _ := io.ReadAll(client)
+	if want := "PONG\nERROR: Protocol error: too big inline request\n"; string(got) != want {
+		t.Fatalf("got %q, want %q", got, want)
+	}
+}
+
+func TestCommandKeys(t *testing.T) {
+	args := [][]byte{[]byte("DEL"), []byte("a"), []byte("b"), []byte("c")}
+	keys := lookupCommand([]byte("del")).Keys(args)
+	if len(keys) != 3 || !bytes.Equal(keys[2], []byte("c")) {
+		t.Fatalf("unexpected keys %q", keys)
+	}
+	if keys := lookupCommand([]byte("PING")).Keys([][]byte{[]byte("PING")}); keys != nil {
+		t.Fatalf("PING has no keys, got %q", keys)
+	}
+}
+
+func TestExecuteRESP3(t *testing.T) {
+	sess := newSession(&cache.BoltCache{Data: cache.NewShardedMap()}, protoRESP2, nil)
+
+	cases := []struct {
+		line string
+		want string
+	}{
+		{"HSET h f v", ":1\r\n"},
+		{"HGETALL h", "*2\r\n$1\r\nf\r\n$1\r\nv\r\n"},
+		{"HELLO 4", "-NOPROTO unsupported protocol version\r\n"},
+		{"HELLO 3 SETNAME", "-ERR syntax error\r\n"},
+		{"HGETALL h", "*2\r\n$1\r\nf\r\n$1\r\nv\r\n"},
+		{"HELLO 3", ""},
+		{"HGETALL h", "%1\r\n$1\r\nf\r\n$1\r\nv\r\n"},
+		{"SADD s a", ":1\r\n"},
+		{"SMEMBERS s", "~1\r\n$1\r\na\r\n"},
+		{"GET missing", "_\r\n"},
+		{"HELLO 2", ""},
+		{"GET missing", "$-1\r\n"},
+	}
+	for _, tc := range cases {
+		reply := &respReply{}
+		run(sess, reply, tc.line)
+		if tc.want == "" {
+			if reply.buf[0] == '-' {
+				t.Fatalf("%s: %q", tc.line, reply.buf)
+			}
+			continue
+		}
+		if string(reply.buf) != tc.want {
+			t.Fatalf("%s: got %q, want %q", tc.line, reply.buf, tc.want)
+		}
+	}
+}
+
+func TestRESP3Encoding(t *testing.T) {
+	r := &respReply{resp3: true}
+	r.WriteDouble(1.5)
+	r.WriteDouble(math.Inf(-1))
+	r.WriteVerbatim("txt", "hi")
+	if r.WriteAttribute(1) {
+		r.WriteBulkString("ttl")
+		r.WriteInt(10)
+	}
+	r.WriteString("OK")
+	want := ",1.5\r\n,-inf\r\n=6\r\ntxt:hi\r\n|1\r\n$3\r\nttl\r\n:10\r\n+OK\r\n"
+	if string(r.buf) != want {
+		t.Fatalf("got %q, want %q", r.buf, want)
+	}
+
+	r = &respReply{}
+	r.WriteDouble(1.5)
+	r.WriteVerbatim("txt", "hi")
+	if r.WriteAttribute(1) {
+		t.Fatalf("RESP2 has no attributes")
+	}
+	want = "$3\r\n1.5\r\n$2\r\nhi\r\n"
+	if string(r.buf) != want {
+		t.Fatalf("got %q, want %q", r.buf, want)
+	}
+
+	if msg := respMessage(protoRESP3, "c", "m"); string(msg) != ">3\r\n$7\r\nmessage\r\n$1\r\nc\r\n$1\r\nm\r\n" {
+		t.Fatalf("unexpected push %q", msg)
+	}
+}
+
+func TestTransactions(t *testing.T) {
+	c := &cache.BoltCache{Data: cache.NewShardedMap()}
+	sess := newSession(c, protoRESP2, nil)
+	other := newSession(c, protoRESP2, nil)
+
+	cases := []struct {
+		sess *Session
+		line string
+		want string
+	}{
+		{sess, "EXEC", "-ERR EXEC without MULTI\r\n"},
+		{sess, "MULTI", "+OK\r\n"},
+		{sess, "MULTI", "-ERR MULTI calls can not be nested\r\n"},
+		{sess, "SET k v", "+QUEUED\r\n"},
+		{sess, "GET k", "+QUEUED\r\n"},
+		{other, "GET k", "$-1\r\n"},
+		{sess, "EXEC", "*2\r\n+OK\r\n$1\r\nv\r\n"},
+
+		{sess, "WATCH k", "+OK\r\n"},
+		{other, "SET k changed", "+OK\r\n"},
+		{sess, "MULTI", "+OK\r\n"},
+		{sess, "SET k mine", "+QUEUED\r\n"},
+		{sess, "EXEC", "$-1\r\n"},
+		{sess, "GET k", "$7\r\nchanged\r\n"},
+
+		{sess, "WATCH k", "+OK\r\n"},
+		{sess, "MULTI", "+OK\r\n"},
+		{sess, "WATCH k", "-ERR WATCH inside MULTI is not allowed\r\n"},
+		{sess, "INCRBYFLOAT k", "-ERR unknown command 'INCRBYFLOAT'\r\n"},
+		{sess, "EXEC", "-EXECABORT Transaction discarded because of previous errors.\r\n"},
+
+		{sess, "MULTI", "+OK\r\n"},
+		{sess, "DEL k", "+QUEUED\r\n"},
+		{sess, "DISCARD", "+OK\r\n"},
+		{sess, "EXISTS k", ":1\r\n"},
+	}
+	for i, tc := range cases {
+		reply := &respReply{}
+		run(tc.sess, reply, tc.line)
+		if string(reply.buf) != tc.want {
+			t.Fatalf("%d %s: got %q, want %q", i, tc.line, reply.buf, tc.want)
+		}
+	}
+}
+
+func TestRESTTransactionLock(t *testing.T) {
+	c := &cache.BoltCache{Data: cache.NewShardedMap()}
+	s := NewRestServer(c)
+	handler := s.txMiddleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		c.Set("k", r.URL.Path, 0)
+		w.WriteHeader(http.StatusCreated)
+	}))
+
+	// A REST write waits for a running EXEC.
+	c.TxMu.Lock()
+	done := make(chan *httptest.ResponseRecorder)
+	go func() {
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, httptest.NewRequest("PUT", "/cache/k", nil))
+		done <- w
+	}()
+	select {
+	case <-done:
+		t.Fatal("REST write ran during EXEC")
+	case <-time.After(20 * time.Millisecond):
+	}
+	c.TxMu.Unlock()
+	if w := <-done; w.Code != http.StatusCreated {
+		t.Fatalf("status %d", w.Code)
+	}
+
+	// Requests that don't touch keys, or lock themselves, pass through.
+	for _, path := range []string{"/info", "/tx", "/admin/restore"} {
+		c.TxMu.Lock()
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, httptest.NewRequest("POST", path, nil))
+		c.TxMu.Unlock()
+		if v, _ := c.Get("k"); v != path {
+			t.Fatalf("%s: %v", path, v)
+		}
+	}
+}
+
+func TestRESTExpireRange(t *testing.T) {
+	c := &cache.BoltCache{Data: cache.NewShardedMap()}
+	s := NewRestServer(c)
+	c.Set("k", "v", 0)
+	call := func(handler http.HandlerFunc, body string) int {
+		r := mux.SetURLVars(httptest.NewRequest("PUT", "/cache/k", strings.NewReader(body)), map[string]string{"key": "k"})
+		w := httptest.NewRecorder()
+		handler(w, r)
+		return w.Code
+	}
+
+	// Deadlines past what the expiry index holds are refused, and the key
+	// stays.
+	for _, tc := range []struct {
+		handler http.HandlerFunc
+		body    string
+	}{
+		{s.setTTL, `{"expire_at":10000000000}`},
+		{s.setTTL, `{"ttl":"2500000h"}`},
+		{s.setValue, `{"value":"v2","ttl":"2500000h"}`},
+	} {
+		if code := call(tc.handler, tc.body); code != http.StatusBadRequest {
+			t.Fatalf("%s: status %d", tc.body, code)
+		}
+	}
+	if v, _ := c.Get("k"); v != "v" || c.TTL("k") != cache.NoExpiry {
+		t.Fatalf("k = %v, ttl %v", v, c.TTL("k"))
+	}
+	if code := call(s.setTTL, `{"expire_at":9000000000}`); code != http.StatusOK || c.TTL("k") <= 0 {
+		t.Fatalf("expire_at in range: status %d, ttl %v", code, c.TTL("k"))
+	}
+}
+
+func TestSaveCommands(t *testing.T) {
+	cfg := &config.Config{}
+	cfg.Persistence.File = filepath.Join(t.TempDir(), "cache.json")
+	cfg.Persistence.BackupCount = 1
+	c := &cache.BoltCache{Data: cache.NewShardedMap(), Config: cfg}
+	sess := newSession(c, protoRESP2, nil)
+
+	cases := []struct {
+		line string
+		want string
+	}{
+		{"LASTSAVE", ":0\r\n"},
+		{"SET k v", "+OK\r\n"},
+		{"SAVE", "+OK\r\n"},
+		{"SET k v2", "+OK\r\n"},
+		{"SAVE", "+OK\r\n"},
+		{"BGSAVE NOW", "-ERR syntax error\r\n"},
+		{"BACKUP RESTORE nope", "-ERR no such backup\r\n"},
+		{"BACKUP NOPE", "-ERR unknown subcommand 'NOPE'\r\n"},
+	}
+	for _, tc := range cases {
+		reply := &respReply{}
+		run(sess, reply, tc.line)
+		if string(reply.buf) != tc.want {
+			t.Fatalf("%s: got %q, want %q", tc.line, reply.buf, tc.want)
+		}
+	}
+
+	reply := &respReply{}
+	run(sess, reply, "LASTSAVE")
+	if string(reply.buf) == ":0\r\n" {
+		t.Fatal("LASTSAVE not updated by SAVE")
+	}
+
+	backups := c.Backups()
+	if len(backups) != 1 {
+		t.Fatalf("got %d backups, want 1", len(backups))
+	}
+	reply = &respReply{}
+	run(sess, reply, "BACKUP LIST")
+	if want := fmt.Sprintf("*1\r\n$%d\r\n%s\r\n", len(backups[0].Name), backups[0].Name); string(reply.buf) != want {
+		t.Fatalf("BACKUP LIST: got %q, want %q", reply.buf, want)
+	}
+	reply = &respReply{}
+	run(sess, reply, "BACKUP RESTORE "+backups[0].Name)
+	if string(reply.buf) != ":1\r\n" {
+		t.Fatalf("BACKUP RESTORE: got %q", reply.buf)
+	}
+	if v, _ := c.Get("k"); v != "v" {
+		t.Fatalf("k = %v after restore", v)
+	}
+
+	// A restore waits for running commands, like EXEC.
+	c.TxMu.RLock()
+	done := make(chan struct{})
+	go func() {
+		run(sess, &respReply{}, "BACKUP RESTORE "+backups[0].Name)
+		close(done)
+	}()
+	select {
+	case <-done:
+		t.Fatal("BACKUP RESTORE ran alongside a command")
+	case <-time.After(20 * time.Millisecond):
+	}
+	c.TxMu.RUnlock()
+	<-done
+}
+
+func TestReplicaIsReadOnly(t *testing.T) {
+	c := &cache.BoltCache{Data: cache.NewShardedMap()}
+	// Nothing listens on the master address, so the link stays down.
+	if err := c.StartReplication(config.ReplicationConfig{Role: "replica", Master: "127.0.0.1:1"}); err != nil {
+		t.Fatal(err)
+	}
+	sess := newSession(c, protoRESP2, nil)
+
+	cases := []struct {
+		line string
+		want string
+	}{
+		{"SET k v", "-READONLY You can't write against a read only replica.\r\n"},
+		{"GET k", "$-1\r\n"},
+		{"MULTI", "+OK\r\n"},
+		{"DEL k", "-READONLY You can't write against a read only replica.\r\n"},
+		{"EXEC", "-EXECABORT Transaction discarded because of previous errors.\r\n"},
+		{"PSYNC ? 0", "-ERR PSYNC is only supported on the TCP text port\r\n"},
+		{"ROLE", "*5\r\n$5\r\nslave\r\n$9\r\n127.0.0.1\r\n:1\r\n$10\r\nconnecting\r\n:0\r\n"},
+	}
+	for i, tc := range cases {
+		reply := &respReply{}
+		run(sess, reply, tc.line)
+		if string(reply.buf) != tc.want {
+			t.Fatalf("%d %s: got %q, want %q", i, tc.line, reply.buf, tc.want)
+		}
+	}
+}
+
+func TestJSONReply(t *testing.T) {
+	r := &jsonReply{}
+	r.WriteArray(3)
+	r.WriteInt(1)
+	r.WriteMap(1)
+	r.WriteBulkString("f")
+	r.WriteArray(0)
+	r.WriteError("ERR boom")
+
+	got, _ := json.Marshal(r.last())
+	if want := `[1,{"f":[]},{"error":"ERR boom"}]`; string(got) != want {
+		t.Fatalf("got %s, want %s", got, want)
+	}
+}
+
+func TestStreamBlockingRead(t *testing.T) {
+	c := &cache.BoltCache{Data: cache.NewShardedMap()}
+	reader := newSession(c, protoRESP2, nil)
+	writer := newSession(c, protoRESP2, nil)
+
+	reply := &respReply{}
+	run(writer, reply, "XADD s 1-0 f v")
+	if got := string(reply.buf); got != "$3\r\n1-0\r\n" {
+		t.Fatalf("XADD: got %q", got)
+	}
+
+	reply = &respReply{}
+	run(reader, reply, "XREAD BLOCK 10 STREAMS s $")
+	if got := string(reply.buf); got != "$-1\r\n" {
+		t.Fatalf("XREAD timeout: got %q", got)
+	}
+
+	done := make(chan string)
+	go func() {
+		r := &respReply{}
+		run(reader, r, "XREAD BLOCK 0 STREAMS s $")
+		done <- string(r.buf)
+	}()
+
+	// Give the reader time to block, then wake it with a write.
+	time.Sleep(20 * time.Millisecond)
+	run(writer, &respReply{}, "XADD s 2-0 f w")
+	select {
+	case got := <-done:
+		want := "*1\r\n*2\r\n$1\r\ns\r\n*1\r\n*2\r\n$3\r\n2-0\r\n*2\r\n$1\r\nf\r\n$1\r\nw\r\n"
+		if got != want {
+			t.Fatalf("woken XREAD: got %q, want %q", got, want)
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatalf("XREAD BLOCK was not woken by XADD")
+	}
+
+	// Inside a transaction the read must not block.
+	reply = &respReply{}
+	for _, line := range []string{"MULTI", "XREAD BLOCK 0 STREAMS s 2-0", "EXEC"} {
+		run(reader, reply, line)
+	}
+	if got := string(reply.buf); got != "+OK\r\n+QUEUED\r\n*1\r\n$-1\r\n" {
+		t.Fatalf("XREAD in EXEC: got %q", got)
+	}
+}
@@ -0,0 +1,72 @@
+package server
+
+import (
+	"bufio"
+	"net"
+	"strconv"
+)
+
+import (
+	cache "boltcache/internal/cache"
+	logger "boltcache/logger"
+)
+
+// Active-active replication commands.
+func init() {
+	registerCommands(
+		&Command{Name: "CRDTSYNC", Arity: 2, Flags: FlagAdmin, Handler: cmdCRDTSync},
+	)
+}
+
+// CRDTSYNC node-id hands the connection over to the active-active peer
+// protocol.
+func cmdCRDTSync(ctx *CommandContext) {
+	sess := ctx.Session
+	if sess.conn == nil {
+		ctx.Reply.WriteError("ERR CRDTSYNC is only supported on the TCP text port")
+		return
+	}
+	if !ctx.Cache.ActiveEnabled() {
+		ctx.Reply.WriteError(cache.ErrActiveDisabled.Error())
+		return
+	}
+	node := ctx.Arg(1)
+	sess.handoff = func(conn net.Conn, r *bufio.Reader) {
+		if err := ctx.Cache.ServeActivePeer(conn, r, node); err != nil {
+			logger.Log("Active-active replication to %s ended: %v", node, err)
+		}
+	}
+}
+
+// activeInfo is the Active section of INFO.
+func activeInfo(c *cache.BoltCache) []infoField {
+	info, ok := c.ActiveInfo()
+	if !ok {
+		return []infoField{{"active_enabled", "0"}}
+	}
+	utoa := func(n uint64) string { return strconv.FormatUint(n, 10) }
+	fields := []infoField{
+		{"active_enabled", "1"},
+		{"active_node", info.Node},
+		{"active_clock", info.Clock.String()},
+		{"active_keys", strconv.Itoa(info.Keys)},
+		{"active_connected_peers", strconv.Itoa(info.Pulling)},
+		{"active_peers", strconv.Itoa(len(info.Peers))},
+	}
+	for i, p := range info.Peers {
+		status := "down"
+		if p.LinkUp {
+			status = "up"
+		}
+		fields = append(fields, infoField{"active_peer" + strconv.Itoa(i),
+			"addr=" + p.Addr + ",node=" + p.Node + ",link=" + status +
+				",since=" + strconv.FormatInt(int64(p.LinkDuration.Seconds()), 10)})
+	}
+	return append(fields,
+		infoField{"active_ops_sent", utoa(info.OpsSent)},
+		infoField{"active_ops_merged", utoa(info.OpsMerged)},
+		infoField{"active_conflicts_lww", utoa(info.ConflictsLWW)},
+		infoField{"active_conflicts_cleared", utoa(info.ConflictsCleared)},
+		infoField{"active_conflicts_add_wins", utoa(info.ConflictsAddWins)},
+	)
+}
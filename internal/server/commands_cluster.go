@@ -0,0 +1,530 @@
+package server
+
+import (
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+import (
+	cache "boltcache/internal/cache"
+	cluster "boltcache/internal/cluster"
+)
+
+// Cluster commands.
+func init() {
+	registerCommands(
+		&Command{Name: "CLUSTER", Arity: -2, Flags: FlagAdmin, Handler: cmdCluster},
+		&Command{Name: "ASKING", Arity: 1, Flags: FlagFast, Handler: cmdAsking},
+		&Command{Name: "READONLY", Arity: 1, Flags: FlagFast, Handler: cmdReadOnly},
+		&Command{Name: "READWRITE", Arity: 1, Flags: FlagFast, Handler: cmdReadWrite},
+	)
+}
+
+// CLUSTER JOIN|HEARTBEAT id addr [role [master [epoch [slots [offset]]]]] |
+// VOTE candidate epoch master |
+// NODES | INFO | MYID | FORGET id | KEYSLOT key | SLOTS | SHARDS |
+// ADDSLOTS slot ... | ADDSLOTSRANGE start end ... | DELSLOTS slot ... |
+// DELSLOTSRANGE start end ... | SETSLOT slot NODE|MIGRATING|IMPORTING id |
+// SETSLOT slot STABLE | GETKEYSINSLOT slot count | COUNTKEYSINSLOT slot |
+// CHECK [addr ...]
+func cmdCluster(ctx *CommandContext) {
+	sub := strings.ToUpper(ctx.Arg(1))
+	if sub == "KEYSLOT" && len(ctx.Args) == 3 {
+		ctx.Reply.WriteInt(int64(cluster.KeySlot(ctx.Args[2])))
+		return
+	}
+	// Replicas are checked with or without cluster mode.
+	if sub == "CHECK" {
+		clusterCheck(ctx)
+		return
+	}
+	c := ctx.Cache.Cluster
+	if c == nil {
+		ctx.Reply.WriteError("ERR This instance has cluster support disabled")
+		return
+	}
+
+	switch {
+	case (sub == "JOIN" || sub == "HEARTBEAT") && len(ctx.Args) >= 4 && len(ctx.Args) <= 9:
+		node, err := cluster.ParseNode(stringArgs(ctx.Args[2:]))
+		if err == nil {
+			_, err = c.Heard(node)
+		}
+		if err != nil {
+			ctx.Reply.WriteError(err.Error())
+			return
+		}
+		list := c.Announce()
+		ctx.Reply.WriteArray(len(list))
+		for _, s := range list {
+			ctx.Reply.WriteBulkString(s)
+		}
+
+	case sub == "VOTE" && len(ctx.Args) == 5:
+		epoch, err := strconv.ParseUint(ctx.Arg(3), 10, 64)
+		if err != nil {
+			ctx.Reply.WriteError(errNotInteger)
+			return
+		}
+		granted := int64(0)
+		if c.Vote(ctx.Arg(2), epoch, ctx.Arg(4)) {
+			granted = 1
+		}
+		ctx.Reply.WriteInt(granted)
+
+	case sub == "NODES" && len(ctx.Args) == 2:
+		ctx.Reply.WriteVerbatim("txt", clusterNodes(c))
+
+	case sub == "INFO" && len(ctx.Args) == 2:
+		info := c.Info()
+		self := c.Myself()
+		ctx.Reply.WriteVerbatim("txt", fmt.Sprintf(
+			"cluster_enabled:1\r\ncluster_state:%s\r\ncluster_slots_assigned:%d\r\ncluster_known_nodes:%d\r\ncluster_size:%d\r\ncluster_nodes_failed:%d\r\ncluster_current_epoch:%d\r\ncluster_my_epoch:%d\r\ncluster_my_id:%s\r\n",
+			info.State, info.SlotsAssigned, info.KnownNodes, info.Masters, info.FailedNodes, c.CurrentEpoch(), self.Epoch, self.ID))
+
+	case sub == "SLOTS" && len(ctx.Args) == 2:
+		clusterSlots(ctx, c)
+
+	case sub == "SHARDS" && len(ctx.Args) == 2:
+		clusterShards(ctx, c)
+
+	case (sub == "ADDSLOTS" || sub == "DELSLOTS") && len(ctx.Args) >= 3,
+		(sub == "ADDSLOTSRANGE" || sub == "DELSLOTSRANGE") && len(ctx.Args) >= 4 && len(ctx.Args)%2 == 0:
+		slots, err := slotArgs(stringArgs(ctx.Args[2:]), strings.HasSuffix(sub, "RANGE"))
+		if err == nil {
+			if strings.HasPrefix(sub, "ADD") {
+				err = c.AddSlots(slots)
+			} else {
+				err = c.DelSlots(slots)
+			}
+		}
+		if err != nil {
+			ctx.Reply.WriteError(err.Error())
+			return
+		}
+		ctx.Reply.WriteString("OK")
+
+	case sub == "SETSLOT" && (len(ctx.Args) == 4 || len(ctx.Args) == 5):
+		slot, err := cluster.ParseSlot(ctx.Arg(2))
+		if err != nil {
+			ctx.Reply.WriteError(err.Error())
+			return
+		}
+		switch state := strings.ToUpper(ctx.Arg(3)); {
+		case state == "NODE" && len(ctx.Args) == 5:
+			err = c.SetSlotNode(slot, ctx.Arg(4))
+		case state == "MIGRATING" && len(ctx.Args) == 5:
+			err = c.SetSlotMigrating(slot, ctx.Arg(4))
+		case state == "IMPORTING" && len(ctx.Args) == 5:
+			err = c.SetSlotImporting(slot, ctx.Arg(4))
+		case state == "STABLE" && len(ctx.Args) == 4:
+			c.SetSlotStable(slot)
+		default:
+			ctx.SyntaxError()
+			return
+		}
+		if err != nil {
+			ctx.Reply.WriteError(err.Error())
+			return
+		}
+		ctx.Reply.WriteString("OK")
+
+	case sub == "GETKEYSINSLOT" && len(ctx.Args) == 4:
+		slot, err := cluster.ParseSlot(ctx.Arg(2))
+		if err != nil {
+			ctx.Reply.WriteError(err.Error())
+			return
+		}
+		count, err := strconv.Atoi(ctx.Arg(3))
+		if err != nil || count < 0 {
+			ctx.Reply.WriteError("ERR Invalid number of keys")
+			return
+		}
+		keys := keysInSlot(ctx.Cache, slot, count)
+		ctx.Reply.WriteArray(len(keys))
+		for _, key := range keys {
+			ctx.Reply.WriteBulkString(key)
+		}
+
+	case sub == "COUNTKEYSINSLOT" && len(ctx.Args) == 3:
+		slot, err := cluster.ParseSlot(ctx.Arg(2))
+		if err != nil {
+			ctx.Reply.WriteError(err.Error())
+			return
+		}
+		n := ctx.Cache.Data.CountKeysInSlot(slot)
+		if ctx.Cache.Consensus != nil {
+			n = len(keysInSlot(ctx.Cache, slot, n))
+		}
+		ctx.Reply.WriteInt(int64(n))
+
+	case sub == "MYID" && len(ctx.Args) == 2:
+		ctx.Reply.WriteBulkString(c.Myself().ID)
+
+	case sub == "FORGET" && len(ctx.Args) == 3:
+		if err := c.Forget(ctx.Arg(2)); err != nil {
+			ctx.Reply.WriteError(err.Error())
+			return
+		}
+		ctx.Reply.WriteString("OK")
+
+	default:
+		ctx.SyntaxError()
+	}
+}
+
+// checkKeys is how many of the keys that differ CLUSTER CHECK lists.
+const checkKeys = 10
+
+// clusterCheck compares the dataset with the master's on a replica, with
+// each replica's on a master, or with the nodes given, and reports what
+// differs without repairing it.
+func clusterCheck(ctx *CommandContext) {
+	peers := stringArgs(ctx.Args[2:])
+	if len(peers) == 0 {
+		if info := ctx.Cache.ReplicationInfo(); info.Role == "replica" {
+			peers = []string{info.Master}
+		} else {
+			peers = ctx.Cache.GetReplicas()
+		}
+	}
+	if len(peers) == 0 {
+		ctx.Reply.WriteError("ERR No replicas to check, pass their addresses")
+		return
+	}
+
+	var b strings.Builder
+	diverged := 0
+	for i, addr := range peers {
+		d, err := ctx.Cache.CheckPeer(addr)
+		if err != nil {
+			fmt.Fprintf(&b, "peer%d:addr=%s,status=error,error=%s\r\n", i, addr, err)
+			continue
+		}
+		keys := d.Keys()
+		status := "ok"
+		if len(keys) > 0 {
+			status = "diverged"
+			diverged++
+		}
+		fmt.Fprintf(&b, "peer%d:addr=%s,status=%s,offset=%d,ranges=%d,missing=%d,extra=%d,changed=%d\r\n",
+			i, addr, status, d.Offset, d.Ranges, len(d.Missing), len(d.Extra), len(d.Changed))
+		if len(keys) > 0 {
+			quoted := make([]string, 0, checkKeys+1)
+			for _, key := range keys[:min(len(keys), checkKeys)] {
+				quoted = append(quoted, string(quoteArg([]byte(key))))
+			}
+			if len(keys) > checkKeys {
+				quoted = append(quoted, "...")
+			}
+			fmt.Fprintf(&b, "peer%d_keys:%s\r\n", i, strings.Join(quoted, " "))
+		}
+	}
+	ctx.Reply.WriteVerbatim("txt", fmt.Sprintf("check_peers:%d\r\ncheck_diverged_peers:%d\r\n", len(peers), diverged)+b.String())
+}
+
+// clusterNodes formats the membership like Redis CLUSTER NODES:
+// id addr flags master-id ping-sent pong-recv config-epoch link-state.
+func clusterNodes(c *cluster.Cluster) string {
+	nodes := c.Nodes()
+	byAddr := make(map[string]string, len(nodes))
+	for _, n := range nodes {
+		byAddr[n.Addr] = n.ID
+	}
+
+	migrating, importing := c.OpenSlots()
+
+	var b strings.Builder
+	for _, n := range nodes {
+		var flags []string
+		if n.Myself {
+			flags = append(flags, "myself")
+		}
+		if n.Role == cluster.RoleReplica {
+			flags = append(flags, "slave")
+		} else {
+			flags = append(flags, "master")
+		}
+		if n.Failed {
+			flags = append(flags, "fail")
+		}
+
+		master := "-"
+		if id, ok := byAddr[n.Master]; ok && n.Master != "" {
+			master = id
+		}
+		state := "connected"
+		if n.Failed {
+			state = "disconnected"
+		}
+		pong := int64(0)
+		if !n.Myself {
+			pong = n.LastSeen.UnixMilli()
+		}
+		fmt.Fprintf(&b, "%s %s %s %s 0 %d %d %s", n.ID, n.Addr, strings.Join(flags, ","), master, pong, n.Epoch, state)
+		for _, r := range n.Slots {
+			if r.Start == r.End {
+				fmt.Fprintf(&b, " %d", r.Start)
+			} else {
+				fmt.Fprintf(&b, " %d-%d", r.Start, r.End)
+			}
+		}
+		if n.Myself {
+			b.WriteString(openSlots(migrating, "->-"))
+			b.WriteString(openSlots(importing, "-<-"))
+		}
+		b.WriteByte('\n')
+	}
+	return b.String()
+}
+
+// openSlots formats slots being migrated or imported as " [slot->-id]"
+// or " [slot-<-id]", in slot order.
+func openSlots(slots map[int]string, arrow string) string {
+	sorted := make([]int, 0, len(slots))
+	for slot := range slots {
+		sorted = append(sorted, slot)
+	}
+	sort.Ints(sorted)
+	var b strings.Builder
+	for _, slot := range sorted {
+		fmt.Fprintf(&b, " [%d%s%s]", slot, arrow, slots[slot])
+	}
+	return b.String()
+}
+
+// slotArgs parses slot numbers, or start and end pairs when ranges is set.
+func slotArgs(args []string, ranges bool) ([]int, error) {
+	var slots []int
+	seen := make(map[int]bool)
+	for i := 0; i < len(args); i++ {
+		start, err := cluster.ParseSlot(args[i])
+		if err != nil {
+			return nil, err
+		}
+		end := start
+		if ranges {
+			i++
+			if end, err = cluster.ParseSlot(args[i]); err != nil {
+				return nil, err
+			}
+			if end < start {
+				return nil, fmt.Errorf("ERR start slot number %d is greater than end slot number %d", start, end)
+			}
+		}
+		for slot := start; slot <= end; slot++ {
+			if seen[slot] {
+				return nil, fmt.Errorf("ERR Slot %d specified multiple times", slot)
+			}
+			seen[slot] = true
+			slots = append(slots, slot)
+		}
+	}
+	return slots, nil
+}
+
+// shard is a master with its slots and replicas.
+type shard struct {
+	master   cluster.Node
+	replicas []cluster.Node
+}
+
+func clusterShardList(c *cluster.Cluster) []shard {
+	nodes := c.Nodes()
+	var shards []shard
+	for _, n := range nodes {
+		if n.Role != cluster.RoleMaster {
+			continue
+		}
+		sh := shard{master: n}
+		for _, r := range nodes {
+			if r.Role == cluster.RoleReplica && r.Master == n.Addr {
+				sh.replicas = append(sh.replicas, r)
+			}
+		}
+		shards = append(shards, sh)
+	}
+	return shards
+}
+
+func writeSlotNode(reply Reply, n cluster.Node) {
+	host, port := splitHostPort(n.Addr)
+	reply.WriteArray(3)
+	reply.WriteBulkString(host)
+	reply.WriteInt(port)
+	reply.WriteBulkString(n.ID)
+}
+
+// CLUSTER SLOTS lists every slot range with its master and replicas.
+func clusterSlots(ctx *CommandContext, c *cluster.Cluster) {
+	type entry struct {
+		r  cluster.SlotRange
+		sh shard
+	}
+	var entries []entry
+	for _, sh := range clusterShardList(c) {
+		for _, r := range sh.master.Slots {
+			entries = append(entries, entry{r, sh})
+		}
+	}
+	sort.Slice(entries, func(i, j int) bool { return entries[i].r.Start < entries[j].r.Start })
+
+	ctx.Reply.WriteArray(len(entries))
+	for _, e := range entries {
+		ctx.Reply.WriteArray(3 + len(e.sh.replicas))
+		ctx.Reply.WriteInt(int64(e.r.Start))
+		ctx.Reply.WriteInt(int64(e.r.End))
+		writeSlotNode(ctx.Reply, e.sh.master)
+		for _, r := range e.sh.replicas {
+			writeSlotNode(ctx.Reply, r)
+		}
+	}
+}
+
+// CLUSTER SHARDS lists every master with its slots and nodes.
+func clusterShards(ctx *CommandContext, c *cluster.Cluster) {
+	shards := clusterShardList(c)
+	ctx.Reply.WriteArray(len(shards))
+	for _, sh := range shards {
+		ctx.Reply.WriteMap(2)
+		ctx.Reply.WriteBulkString("slots")
+		ctx.Reply.WriteArray(2 * len(sh.master.Slots))
+		for _, r := range sh.master.Slots {
+			ctx.Reply.WriteInt(int64(r.Start))
+			ctx.Reply.WriteInt(int64(r.End))
+		}
+		ctx.Reply.WriteBulkString("nodes")
+		ctx.Reply.WriteArray(1 + len(sh.replicas))
+		for _, n := range append([]cluster.Node{sh.master}, sh.replicas...) {
+			host, port := splitHostPort(n.Addr)
+			health := "online"
+			if n.Failed {
+				health = "fail"
+			}
+			ctx.Reply.WriteMap(6)
+			ctx.Reply.WriteBulkString("id")
+			ctx.Reply.WriteBulkString(n.ID)
+			ctx.Reply.WriteBulkString("port")
+			ctx.Reply.WriteInt(port)
+			ctx.Reply.WriteBulkString("ip")
+			ctx.Reply.WriteBulkString(host)
+			ctx.Reply.WriteBulkString("endpoint")
+			ctx.Reply.WriteBulkString(host)
+			ctx.Reply.WriteBulkString("role")
+			ctx.Reply.WriteBulkString(n.Role)
+			ctx.Reply.WriteBulkString("health")
+			ctx.Reply.WriteBulkString(health)
+		}
+	}
+}
+
+// ASKING lets the next command use a slot this node is importing.
+func cmdAsking(ctx *CommandContext) {
+	ctx.Session.asking = true
+	ctx.Reply.WriteString("OK")
+}
+
+// READONLY lets a replica serve reads for the slots of its master.
+func cmdReadOnly(ctx *CommandContext) {
+	ctx.Session.readonly = true
+	ctx.Reply.WriteString("OK")
+}
+
+func cmdReadWrite(ctx *CommandContext) {
+	ctx.Session.readonly = false
+	ctx.Reply.WriteString("OK")
+}
+
+// keysInSlot returns up to count keys of slot that move with it. Keys
+// under consensus are on every Raft member and stay where they are.
+func keysInSlot(c *cache.BoltCache, slot, count int) []string {
+	if c.Consensus == nil {
+		return c.Data.KeysInSlot(slot, count)
+	}
+	keys := []string{}
+	for _, key := range c.Data.KeysInSlot(slot, c.Data.CountKeysInSlot(slot)) {
+		if len(keys) == count {
+			break
+		}
+		if !c.Consensus.Covers(key) {
+			keys = append(keys, key)
+		}
+	}
+	return keys
+}
+
+// routingKeys returns the keys of args, including those of commands whose
+// keys the key spec can't describe.
+func routingKeys(cmd *Command, args [][]byte) [][]byte {
+	switch cmd.Name {
+	case "EVAL":
+		if n, err := strconv.Atoi(string(args[2])); err == nil && n >= 0 && 3+n <= len(args) {
+			return args[3 : 3+n]
+		}
+		return nil
+	case "MIGRATE":
+		// MIGRATE moves keys this node has, whoever serves their slot.
+		return nil
+	case "XREAD", "XREADGROUP":
+		for i, a := range args {
+			if strings.EqualFold(string(a), "STREAMS") {
+				rest := args[i+1:]
+				return rest[:len(rest)/2]
+			}
+		}
+		return nil
+	}
+	return cmd.Keys(args)
+}
+
+// route checks that this node serves the keys of args and returns the
+// redirection error otherwise, like a Redis Cluster node. Nodes of a
+// cluster without assigned slots serve every key.
+func (s *Session) route(cmd *Command, args [][]byte) string {
+	c := s.cache.Cluster
+	if c == nil || c.SlotsAssigned() == 0 {
+		return ""
+	}
+	keys := routingKeys(cmd, args)
+	if len(keys) == 0 {
+		return ""
+	}
+	slot := cluster.KeySlot(keys[0])
+	for _, key := range keys[1:] {
+		if cluster.KeySlot(key) != slot {
+			return "CROSSSLOT Keys in request don't hash to the same slot"
+		}
+	}
+
+	route := c.Route(slot)
+	self := c.Myself()
+	switch {
+	case route.Owner.ID == self.ID:
+		if route.Migrating.ID == "" {
+			return ""
+		}
+		// Keys already moved are served by the target.
+		missing := 0
+		for _, key := range keys {
+			if _, ok := s.cache.Get(string(key)); !ok {
+				missing++
+			}
+		}
+		switch {
+		case missing == 0:
+			return ""
+		case missing < len(keys):
+			return "TRYAGAIN Multiple keys request during rehashing of slot"
+		}
+		return fmt.Sprintf("ASK %d %s", slot, route.Migrating.Addr)
+	case route.Importing.ID != "" && s.asking:
+		return ""
+	case route.Owner.ID == "":
+		return "CLUSTERDOWN Hash slot not served"
+	case s.readonly && cmd.Flags&FlagWrite == 0 && self.Role == cluster.RoleReplica && self.Master == route.Owner.Addr:
+		return ""
+	}
+	return fmt.Sprintf("MOVED %d %s", slot, route.Owner.Addr)
+}
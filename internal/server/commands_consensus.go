@@ -0,0 +1,60 @@
+package server
+
+import (
+	"bufio"
+	"net"
+	"strconv"
+	"strings"
+)
+
+import (
+	cache "boltcache/internal/cache"
+	logger "boltcache/logger"
+)
+
+// Consensus commands.
+func init() {
+	registerCommands(
+		&Command{Name: "RAFT", Arity: 1, Flags: FlagAdmin, Handler: cmdRaft},
+	)
+}
+
+// RAFT hands the connection over to the Raft peer protocol.
+func cmdRaft(ctx *CommandContext) {
+	sess := ctx.Session
+	if sess.conn == nil {
+		ctx.Reply.WriteError("ERR RAFT is only supported on the TCP text port")
+		return
+	}
+	cons := ctx.Cache.Consensus
+	if cons == nil {
+		ctx.Reply.WriteError("ERR This instance has consensus disabled")
+		return
+	}
+	sess.handoff = func(conn net.Conn, r *bufio.Reader) {
+		if err := cons.ServeConn(conn, r); err != nil {
+			logger.Log("Raft connection from %s ended: %v", conn.RemoteAddr(), err)
+		}
+	}
+}
+
+// consensusInfo is the Consensus section of INFO.
+func consensusInfo(c *cache.BoltCache) []infoField {
+	cons := c.Consensus
+	if cons == nil {
+		return []infoField{{"consensus_enabled", "0"}}
+	}
+	st := cons.Status()
+	utoa := func(n uint64) string { return strconv.FormatUint(n, 10) }
+	return []infoField{
+		{"consensus_enabled", "1"},
+		{"consensus_prefixes", strings.Join(cons.Prefixes, ",")},
+		{"raft_state", st.State.String()},
+		{"raft_term", utoa(st.Term)},
+		{"raft_leader", st.Leader},
+		{"raft_last_index", utoa(st.LastIndex)},
+		{"raft_commit_index", utoa(st.Commit)},
+		{"raft_applied_index", utoa(st.Applied)},
+		{"raft_snapshot_index", utoa(st.Snapshot)},
+	}
+}
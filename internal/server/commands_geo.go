@@ -0,0 +1,306 @@
+package server
+
+import (
+	"strconv"
+	"strings"
+)
+
+import (
+	cache "boltcache/internal/cache"
+)
+
+// Geospatial commands. Geo sets are sorted sets, so ZRANGE, ZREM and the
+// other sorted set commands work on them as well.
+func init() {
+	registerCommands(
+		&Command{Name: "GEOADD", Arity: -5, Flags: FlagWrite, FirstKey: 1, LastKey: 1, KeyStep: 1, Feature: "geo_commands", Handler: cmdGeoAdd},
+		&Command{Name: "GEODIST", Arity: -4, Flags: FlagRead, FirstKey: 1, LastKey: 1, KeyStep: 1, Feature: "geo_commands", Handler: cmdGeoDist},
+		&Command{Name: "GEOPOS", Arity: -2, Flags: FlagRead, FirstKey: 1, LastKey: 1, KeyStep: 1, Feature: "geo_commands", Handler: cmdGeoPos},
+		&Command{Name: "GEOHASH", Arity: -2, Flags: FlagRead, FirstKey: 1, LastKey: 1, KeyStep: 1, Feature: "geo_commands", Handler: cmdGeoHash},
+		&Command{Name: "GEOSEARCH", Arity: -7, Flags: FlagRead, FirstKey: 1, LastKey: 1, KeyStep: 1, Feature: "geo_commands", Handler: cmdGeoSearch},
+	)
+}
+
+const errGeoUnit = "ERR unsupported unit provided. please use M, KM, FT, MI"
+
+// geoUnit returns the number of meters in unit.
+func geoUnit(unit string) (float64, bool) {
+	switch strings.ToLower(unit) {
+	case "m":
+		return 1, true
+	case "km":
+		return 1000, true
+	case "ft":
+		return 0.3048, true
+	case "mi":
+		return 1609.34, true
+	}
+	return 0, false
+}
+
+// formatDistance formats a distance in meters in unit the way Redis does.
+func formatDistance(meters, unit float64) string {
+	return strconv.FormatFloat(meters/unit, 'f', 4, 64)
+}
+
+// parseGeoPoint parses a longitude, latitude pair.
+func parseGeoPoint(lon, lat string) (cache.GeoPoint, bool) {
+	x, err1 := strconv.ParseFloat(lon, 64)
+	y, err2 := strconv.ParseFloat(lat, 64)
+	return cache.GeoPoint{Longitude: x, Latitude: y}, err1 == nil && err2 == nil
+}
+
+func writeGeoPoint(reply Reply, p cache.GeoPoint) {
+	reply.WriteArray(2)
+	reply.WriteDouble(p.Longitude)
+	reply.WriteDouble(p.Latitude)
+}
+
+// GEOADD key [NX|XX] [CH] longitude latitude member [longitude latitude member ...]
+func cmdGeoAdd(ctx *CommandContext) {
+	var opts cache.ZAddOptions
+
+	i := 2
+options:
+	for ; i < len(ctx.Args); i++ {
+		switch strings.ToUpper(ctx.Arg(i)) {
+		case "NX":
+			opts.NX = true
+		case "XX":
+			opts.XX = true
+		case "CH":
+			opts.CH = true
+		default:
+			break options
+		}
+	}
+
+	triples := ctx.Args[i:]
+	if len(triples) == 0 || len(triples)%3 != 0 {
+		ctx.Reply.WriteError("ERR syntax error. Try GEOADD key [x1] [y1] [name1] [x2] [y2] [name2] ... ")
+		return
+	}
+	if opts.NX && opts.XX {
+		ctx.Reply.WriteError("ERR XX and NX options at the same time are not compatible")
+		return
+	}
+
+	members := make([]cache.GeoMember, 0, len(triples)/3)
+	for j := 0; j < len(triples); j += 3 {
+		p, ok := parseGeoPoint(string(triples[j]), string(triples[j+1]))
+		if !ok {
+			ctx.Reply.WriteError(errNotFloat)
+			return
+		}
+		members = append(members, cache.GeoMember{Member: string(triples[j+2]), GeoPoint: p})
+	}
+
+	n, err := ctx.Cache.GeoAdd(ctx.Arg(1), opts, members...)
+	if err != nil {
+		ctx.Reply.WriteError(err.Error())
+		return
+	}
+	ctx.Reply.WriteInt(int64(n))
+}
+
+// GEODIST key member1 member2 [M|KM|FT|MI]
+func cmdGeoDist(ctx *CommandContext) {
+	unit := 1.0
+	switch len(ctx.Args) {
+	case 4:
+	case 5:
+		var ok bool
+		if unit, ok = geoUnit(ctx.Arg(4)); !ok {
+			ctx.Reply.WriteError(errGeoUnit)
+			return
+		}
+	default:
+		ctx.SyntaxError()
+		return
+	}
+
+	dist, ok, err := ctx.Cache.GeoDist(ctx.Arg(1), ctx.Arg(2), ctx.Arg(3))
+	switch {
+	case err != nil:
+		ctx.Reply.WriteError(err.Error())
+	case !ok:
+		ctx.Reply.WriteNull()
+	default:
+		ctx.Reply.WriteBulkString(formatDistance(dist, unit))
+	}
+}
+
+// GEOPOS key [member ...]
+func cmdGeoPos(ctx *CommandContext) {
+	pos, err := ctx.Cache.GeoPos(ctx.Arg(1), stringArgs(ctx.Args[2:])...)
+	if err != nil {
+		ctx.Reply.WriteError(err.Error())
+		return
+	}
+	ctx.Reply.WriteArray(len(pos))
+	for _, p := range pos {
+		if p == nil {
+			ctx.Reply.WriteNull()
+			continue
+		}
+		writeGeoPoint(ctx.Reply, *p)
+	}
+}
+
+// GEOHASH key [member ...]
+func cmdGeoHash(ctx *CommandContext) {
+	if _, err := ctx.Cache.ZCard(ctx.Arg(1)); err != nil {
+		ctx.Reply.WriteError(err.Error())
+		return
+	}
+
+	ctx.Reply.WriteArray(len(ctx.Args) - 2)
+	for _, member := range ctx.Args[2:] {
+		score, ok, _ := ctx.Cache.ZScore(ctx.Arg(1), string(member))
+		if !ok {
+			ctx.Reply.WriteNull()
+			continue
+		}
+		ctx.Reply.WriteBulkString(cache.GeoHashString(score))
+	}
+}
+
+// GEOSEARCH key FROMMEMBER member|FROMLONLAT longitude latitude
+// BYRADIUS radius unit|BYBOX width height unit [ASC|DESC] [COUNT count [ANY]]
+// [WITHCOORD] [WITHDIST] [WITHHASH]
+func cmdGeoSearch(ctx *CommandContext) {
+	var q cache.GeoQuery
+	fromMember, fromLonLat, byRadius, byBox := false, false, false, false
+	withCoord, withDist, withHash := false, false, false
+	unit := 1.0
+
+	for i := 2; i < len(ctx.Args); i++ {
+		opt := strings.ToUpper(ctx.Arg(i))
+		left := len(ctx.Args) - i - 1
+		switch {
+		case opt == "FROMMEMBER" && left >= 1:
+			q.Member, fromMember = ctx.Arg(i+1), true
+			i++
+		case opt == "FROMLONLAT" && left >= 2:
+			p, ok := parseGeoPoint(ctx.Arg(i+1), ctx.Arg(i+2))
+			if !ok {
+				ctx.Reply.WriteError(errNotFloat)
+				return
+			}
+			if !cache.ValidGeoPoint(p) {
+				ctx.Reply.WriteError("ERR invalid longitude,latitude pair " + ctx.Arg(i+1) + "," + ctx.Arg(i+2))
+				return
+			}
+			q.Center, fromLonLat = p, true
+			i += 2
+		case opt == "BYRADIUS" && left >= 2:
+			r, err := strconv.ParseFloat(ctx.Arg(i+1), 64)
+			if err != nil {
+				ctx.Reply.WriteError("ERR need numeric radius")
+				return
+			}
+			if r < 0 {
+				ctx.Reply.WriteError("ERR radius cannot be negative")
+				return
+			}
+			var ok bool
+			if unit, ok = geoUnit(ctx.Arg(i + 2)); !ok {
+				ctx.Reply.WriteError(errGeoUnit)
+				return
+			}
+			q.Shape.Radius, byRadius = r*unit, true
+			i += 2
+		case opt == "BYBOX" && left >= 3:
+			w, err1 := strconv.ParseFloat(ctx.Arg(i+1), 64)
+			h, err2 := strconv.ParseFloat(ctx.Arg(i+2), 64)
+			if err1 != nil || err2 != nil {
+				ctx.Reply.WriteError("ERR need numeric width and height")
+				return
+			}
+			if w < 0 || h < 0 {
+				ctx.Reply.WriteError("ERR height or width cannot be negative")
+				return
+			}
+			var ok bool
+			if unit, ok = geoUnit(ctx.Arg(i + 3)); !ok {
+				ctx.Reply.WriteError(errGeoUnit)
+				return
+			}
+			q.Shape = cache.GeoShape{Box: true, Width: w * unit, Height: h * unit}
+			byBox = true
+			i += 3
+		case opt == "ASC":
+			q.Sort = 1
+		case opt == "DESC":
+			q.Sort = -1
+		case opt == "COUNT" && left >= 1:
+			n, err := strconv.Atoi(ctx.Arg(i + 1))
+			if err != nil {
+				ctx.Reply.WriteError(errNotInteger)
+				return
+			}
+			if n <= 0 {
+				ctx.Reply.WriteError("ERR COUNT must be > 0")
+				return
+			}
+			q.Count = n
+			i++
+			if i+1 < len(ctx.Args) && strings.EqualFold(ctx.Arg(i+1), "ANY") {
+				q.Any = true
+				i++
+			}
+		case opt == "ANY":
+			ctx.Reply.WriteError("ERR the ANY argument requires COUNT argument")
+			return
+		case opt == "WITHCOORD":
+			withCoord = true
+		case opt == "WITHDIST":
+			withDist = true
+		case opt == "WITHHASH":
+			withHash = true
+		default:
+			ctx.SyntaxError()
+			return
+		}
+	}
+
+	if fromMember == fromLonLat {
+		ctx.Reply.WriteError("ERR exactly one of FROMMEMBER or FROMLONLAT can be specified for geosearch")
+		return
+	}
+	if byRadius == byBox {
+		ctx.Reply.WriteError("ERR exactly one of BYRADIUS and BYBOX can be specified for geosearch")
+		return
+	}
+
+	results, err := ctx.Cache.GeoSearch(ctx.Arg(1), q)
+	if err != nil {
+		ctx.Reply.WriteError(err.Error())
+		return
+	}
+
+	extra := 0
+	for _, with := range []bool{withCoord, withDist, withHash} {
+		if with {
+			extra++
+		}
+	}
+	ctx.Reply.WriteArray(len(results))
+	for _, r := range results {
+		if extra == 0 {
+			ctx.Reply.WriteBulkString(r.Member)
+			continue
+		}
+		ctx.Reply.WriteArray(1 + extra)
+		ctx.Reply.WriteBulkString(r.Member)
+		if withDist {
+			ctx.Reply.WriteBulkString(formatDistance(r.Dist, unit))
+		}
+		if withHash {
+			ctx.Reply.WriteInt(int64(r.Hash))
+		}
+		if withCoord {
+			writeGeoPoint(ctx.Reply, r.GeoPoint)
+		}
+	}
+}
@@ -0,0 +1,235 @@
+package server
+
+import (
+	"fmt"
+	"math"
+	"strconv"
+	"strings"
+	"time"
+)
+
+import (
+	cache "boltcache/internal/cache"
+)
+
+// String and keyspace commands.
+func init() {
+	registerCommands(
+		&Command{Name: "GET", Arity: 2, Flags: FlagRead | FlagFast, FirstKey: 1, LastKey: 1, KeyStep: 1, Handler: cmdGet},
+		&Command{Name: "SET", Arity: -3, Flags: FlagWrite, FirstKey: 1, LastKey: 1, KeyStep: 1, Handler: cmdSet},
+		&Command{Name: "MGET", Arity: -2, Flags: FlagRead | FlagFast, FirstKey: 1, LastKey: -1, KeyStep: 1, Handler: cmdMGet},
+		&Command{Name: "MSET", Arity: -3, Flags: FlagWrite, FirstKey: 1, LastKey: -1, KeyStep: 2, Handler: cmdMSet},
+		&Command{Name: "INCR", Arity: 2, Flags: FlagWrite | FlagFast, FirstKey: 1, LastKey: 1, KeyStep: 1, Handler: cmdIncr},
+		&Command{Name: "DECR", Arity: 2, Flags: FlagWrite | FlagFast, FirstKey: 1, LastKey: 1, KeyStep: 1, Handler: cmdIncr},
+		&Command{Name: "INCRBY", Arity: 3, Flags: FlagWrite | FlagFast, FirstKey: 1, LastKey: 1, KeyStep: 1, Handler: cmdIncr},
+		&Command{Name: "DECRBY", Arity: 3, Flags: FlagWrite | FlagFast, FirstKey: 1, LastKey: 1, KeyStep: 1, Handler: cmdIncr},
+		&Command{Name: "DEL", Arity: -2, Flags: FlagWrite, FirstKey: 1, LastKey: -1, KeyStep: 1, Handler: cmdDel},
+		&Command{Name: "EXISTS", Arity: -2, Flags: FlagRead | FlagFast, FirstKey: 1, LastKey: -1, KeyStep: 1, Handler: cmdExists},
+		&Command{Name: "EXPIRE", Arity: 3, Flags: FlagWrite | FlagFast, FirstKey: 1, LastKey: 1, KeyStep: 1, Handler: cmdExpire},
+		&Command{Name: "PEXPIRE", Arity: 3, Flags: FlagWrite | FlagFast, FirstKey: 1, LastKey: 1, KeyStep: 1, Handler: cmdExpire},
+		&Command{Name: "EXPIREAT", Arity: 3, Flags: FlagWrite | FlagFast, FirstKey: 1, LastKey: 1, KeyStep: 1, Handler: cmdExpire},
+		&Command{Name: "PEXPIREAT", Arity: 3, Flags: FlagWrite | FlagFast, FirstKey: 1, LastKey: 1, KeyStep: 1, Handler: cmdExpire},
+		&Command{Name: "TTL", Arity: 2, Flags: FlagRead | FlagFast, FirstKey: 1, LastKey: 1, KeyStep: 1, Handler: cmdTTL},
+		&Command{Name: "PTTL", Arity: 2, Flags: FlagRead | FlagFast, FirstKey: 1, LastKey: 1, KeyStep: 1, Handler: cmdTTL},
+		&Command{Name: "PERSIST", Arity: 2, Flags: FlagWrite | FlagFast, FirstKey: 1, LastKey: 1, KeyStep: 1, Handler: cmdPersist},
+	)
+}
+
+// writeValue answers with a string value. Scalars stored through the REST
+// API are formatted; lists, sets and hashes are WRONGTYPE.
+func writeValue(reply Reply, value interface{}) {
+	switch v := value.(type) {
+	case string:
+		reply.WriteBulkString(v)
+	case []byte:
+		reply.WriteBulk(v)
+	default:
+		if isCollection(v) {
+			reply.WriteError(errWrongType)
+			return
+		}
+		reply.WriteBulkString(fmt.Sprintf("%v", v))
+	}
+}
+
+// isCollection reports whether value is one of the aggregate data types
+// rather than a string.
+func isCollection(value interface{}) bool {
+	switch value.(type) {
+	case []string, map[string]struct{}, map[string]string, *cache.SortedSet, *cache.Stream:
+		return true
+	}
+	return false
+}
+
+var errWrongType = cache.ErrWrongType.Error()
+
+func cmdGet(ctx *CommandContext) {
+	value, ok := ctx.Cache.Get(ctx.Arg(1))
+	if !ok {
+		ctx.Reply.WriteNull()
+		return
+	}
+	writeValue(ctx.Reply, value)
+}
+
+// SET key value [NX|XX] [EX s|PX ms|EXAT ts|PXAT ts|KEEPTTL]
+//
+// The text protocol's SET key value <duration> form is still accepted.
+func cmdSet(ctx *CommandContext) {
+	var opts cache.SetOptions
+	expireSet := false
+
+	for i := 3; i < len(ctx.Args); i++ {
+		opt := strings.ToUpper(ctx.Arg(i))
+		switch opt {
+		case "NX":
+			opts.NX = true
+		case "XX":
+			opts.XX = true
+		case "KEEPTTL":
+			opts.KeepTTL = true
+		case "EX", "PX", "EXAT", "PXAT":
+			if expireSet || i+1 >= len(ctx.Args) {
+				ctx.SyntaxError()
+				return
+			}
+			n, err := strconv.ParseInt(ctx.Arg(i+1), 10, 64)
+			if err != nil {
+				ctx.Reply.WriteError("ERR value is not an integer or out of range")
+				return
+			}
+			unit := time.Second
+			if opt[0] == 'P' {
+				unit = time.Millisecond
+			}
+			if n <= 0 || !expireInRange(n, unit, len(opt) == 2) {
+				ctx.Reply.WriteError("ERR invalid expire time in 'set' command")
+				return
+			}
+			switch opt {
+			case "EX":
+				opts.TTL = time.Duration(n) * time.Second
+			case "PX":
+				opts.TTL = time.Duration(n) * time.Millisecond
+			case "EXAT":
+				opts.ExpireAt = time.Unix(n, 0)
+			case "PXAT":
+				opts.ExpireAt = time.UnixMilli(n)
+			}
+			expireSet = true
+			i++
+		default:
+			d, err := time.ParseDuration(ctx.Arg(i))
+			if i != 3 || len(ctx.Args) != 4 || err != nil {
+				ctx.SyntaxError()
+				return
+			}
+			if !expireInRange(int64(d), time.Nanosecond, true) {
+				ctx.Reply.WriteError("ERR invalid expire time in 'set' command")
+				return
+			}
+			opts.TTL = d
+			expireSet = true
+		}
+	}
+
+	if (opts.NX && opts.XX) || (opts.KeepTTL && expireSet) {
+		ctx.SyntaxError()
+		return
+	}
+
+	if !ctx.Cache.SetWithOptions(ctx.Arg(1), ctx.Arg(2), opts) {
+		ctx.Reply.WriteNull()
+		return
+	}
+	ctx.Reply.WriteString("OK")
+}
+
+func cmdMGet(ctx *CommandContext) {
+	ctx.Reply.WriteArray(len(ctx.Args) - 1)
+	for _, key := range ctx.Args[1:] {
+		value, ok := ctx.Cache.Get(string(key))
+		if !ok || isCollection(value) {
+			// MGET answers nil for keys that don't hold a string.
+			ctx.Reply.WriteNull()
+			continue
+		}
+		writeValue(ctx.Reply, value)
+	}
+}
+
+// MSET key value [key value ...]
+func cmdMSet(ctx *CommandContext) {
+	if len(ctx.Args)%2 != 1 {
+		ctx.Reply.WriteError("ERR wrong number of arguments for 'mset' command")
+		return
+	}
+	for i := 1; i < len(ctx.Args); i += 2 {
+		ctx.Cache.Set(ctx.Arg(i), ctx.Arg(i+1), 0)
+	}
+	ctx.Reply.WriteString("OK")
+}
+
+// INCR key | DECR key | INCRBY key n | DECRBY key n
+func cmdIncr(ctx *CommandContext) {
+	delta := int64(1)
+	if len(ctx.Args) == 3 {
+		n, err := strconv.ParseInt(ctx.Arg(2), 10, 64)
+		if err != nil {
+			ctx.Reply.WriteError("ERR value is not an integer or out of range")
+			return
+		}
+		delta = n
+	}
+	if strings.HasPrefix(ctx.Command.Name, "DECR") {
+		if delta == math.MinInt64 {
+			ctx.Reply.WriteError(cache.ErrOverflow.Error())
+			return
+		}
+		delta = -delta
+	}
+	n, err := ctx.Cache.IncrBy(ctx.Arg(1), delta)
+	if err != nil {
+		ctx.Reply.WriteError(err.Error())
+		return
+	}
+	ctx.Reply.WriteInt(n)
+}
+
+func cmdDel(ctx *CommandContext) {
+	deleted := 0
+	for _, key := range ctx.Args[1:] {
+		if ctx.Cache.Delete(string(key)) {
+			deleted++
+		}
+	}
+	ctx.Reply.WriteInt(int64(deleted))
+}
+
+func cmdExists(ctx *CommandContext) {
+	count := 0
+	for _, key := range ctx.Args[1:] {
+		if _, ok := ctx.Cache.Get(string(key)); ok {
+			count++
+		}
+	}
+	ctx.Reply.WriteInt(int64(count))
+}
+
+func cmdExpire(ctx *CommandContext) {
+	n, err := runExpire(ctx.Cache, ctx.Command.Name, ctx.Arg(1), ctx.Arg(2))
+	if err != nil {
+		ctx.Reply.WriteError(err.Error())
+		return
+	}
+	ctx.Reply.WriteInt(int64(n))
+}
+
+func cmdTTL(ctx *CommandContext) {
+	ctx.Reply.WriteInt(runTTL(ctx.Cache, ctx.Command.Name, ctx.Arg(1)))
+}
+
+func cmdPersist(ctx *CommandContext) {
+	ctx.Reply.WriteInt(int64(runPersist(ctx.Cache, ctx.Arg(1))))
+}
@@ -0,0 +1,245 @@
+package server
+
+import (
+	"bufio"
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+	"time"
+)
+
+import (
+	cache "boltcache/internal/cache"
+)
+
+// Key transfer commands, used to move the keys of a slot between cluster
+// nodes.
+func init() {
+	registerCommands(
+		&Command{Name: "DUMP", Arity: 2, Flags: FlagRead, FirstKey: 1, LastKey: 1, KeyStep: 1, Handler: cmdDump},
+		&Command{Name: "RESTORE", Arity: -4, Flags: FlagWrite, FirstKey: 1, LastKey: 1, KeyStep: 1, Handler: cmdRestore},
+		// MIGRATE waits on another server, so it runs off the event loop
+		// like blocking commands.
+		&Command{Name: "MIGRATE", Arity: -6, Flags: FlagWrite | FlagBlocking, FirstKey: 3, LastKey: 3, KeyStep: 1, Handler: cmdMigrate},
+	)
+}
+
+// defaultMigrateTimeout applies to MIGRATE with a timeout of 0.
+const defaultMigrateTimeout = time.Second
+
+// DUMP key
+func cmdDump(ctx *CommandContext) {
+	d, err := ctx.Cache.Dump(ctx.Arg(1))
+	switch {
+	case err != nil:
+		ctx.Reply.WriteError("ERR " + err.Error())
+	case d == nil:
+		ctx.Reply.WriteNull()
+	default:
+		ctx.Reply.WriteBulk(d.Payload)
+	}
+}
+
+// RESTORE key ttl payload [REPLACE] [ABSTTL]
+func cmdRestore(ctx *CommandContext) {
+	ttl, err := strconv.ParseInt(ctx.Arg(2), 10, 64)
+	if err != nil {
+		ctx.Reply.WriteError(errNotInteger)
+		return
+	}
+	if ttl < 0 {
+		ctx.Reply.WriteError("ERR Invalid TTL value, must be >= 0")
+		return
+	}
+
+	replace, absolute := false, false
+	for _, opt := range ctx.Args[4:] {
+		switch strings.ToUpper(string(opt)) {
+		case "REPLACE":
+			replace = true
+		case "ABSTTL":
+			absolute = true
+		default:
+			ctx.SyntaxError()
+			return
+		}
+	}
+
+	var expiresAt time.Time
+	switch {
+	case ttl > 0 && absolute:
+		expiresAt = time.UnixMilli(ttl)
+	case ttl > 0:
+		expiresAt = time.Now().Add(time.Duration(ttl) * time.Millisecond)
+	}
+	if err := ctx.Cache.Restore(ctx.Arg(1), ctx.Args[3], expiresAt, replace); err != nil {
+		ctx.Reply.WriteError(err.Error())
+		return
+	}
+	ctx.Reply.WriteString("OK")
+}
+
+// MIGRATE host port key|"" destination-db timeout [COPY] [REPLACE]
+// [KEYS key ...] moves keys to another node with RESTORE, preceded by
+// ASKING so a node importing their slot accepts them. Keys written while
+// they were in flight stay here, so moving them again sends the new value.
+func cmdMigrate(ctx *CommandContext) {
+	port, err := strconv.Atoi(ctx.Arg(2))
+	if err != nil {
+		ctx.Reply.WriteError(errNotInteger)
+		return
+	}
+	db, err := strconv.Atoi(ctx.Arg(4))
+	if err != nil {
+		ctx.Reply.WriteError(errNotInteger)
+		return
+	}
+	if db != 0 {
+		ctx.Reply.WriteError("ERR DB index is out of range")
+		return
+	}
+	ms, err := strconv.ParseInt(ctx.Arg(5), 10, 64)
+	if err != nil || ms < 0 {
+		ctx.Reply.WriteError(errNotInteger)
+		return
+	}
+	timeout := time.Duration(ms) * time.Millisecond
+	if timeout == 0 {
+		timeout = defaultMigrateTimeout
+	}
+
+	keys := []string{ctx.Arg(3)}
+	copyKeys, replace := false, false
+	for i := 6; i < len(ctx.Args); i++ {
+		switch strings.ToUpper(ctx.Arg(i)) {
+		case "COPY":
+			copyKeys = true
+		case "REPLACE":
+			replace = true
+		case "KEYS":
+			if ctx.Arg(3) != "" {
+				ctx.Reply.WriteError("ERR When using MIGRATE KEYS option, the key argument must be set to the empty string")
+				return
+			}
+			keys = stringArgs(ctx.Args[i+1:])
+			i = len(ctx.Args)
+		default:
+			ctx.SyntaxError()
+			return
+		}
+	}
+
+	// The transfer runs without TxMu, so a transaction never waits for
+	// the network; EXEC holds it already.
+	locked := func(fn func()) {
+		if !ctx.Session.inExec {
+			ctx.Cache.TxMu.RLock()
+			defer ctx.Cache.TxMu.RUnlock()
+		}
+		fn()
+	}
+
+	var dumps []*cache.Dumped
+	locked(func() {
+		for _, key := range keys {
+			// Keys under consensus are on every Raft member already.
+			if cons := ctx.Cache.Consensus; cons != nil && cons.Covers(key) {
+				continue
+			}
+			d, derr := ctx.Cache.Dump(key)
+			if derr != nil {
+				err = derr
+				return
+			}
+			if d != nil {
+				dumps = append(dumps, d)
+			}
+		}
+	})
+	if err != nil {
+		ctx.Reply.WriteError("ERR " + err.Error())
+		return
+	}
+	if len(dumps) == 0 {
+		ctx.Reply.WriteString("NOKEY")
+		return
+	}
+
+	moved, err := migrateKeys(net.JoinHostPort(ctx.Arg(1), strconv.Itoa(port)), timeout, dumps, replace)
+	if !copyKeys {
+		locked(func() {
+			for _, d := range dumps[:moved] {
+				ctx.Cache.DeleteDumped(d)
+			}
+		})
+	}
+	if err != nil {
+		ctx.Reply.WriteError(err.Error())
+		return
+	}
+	ctx.Reply.WriteString("OK")
+}
+
+// migrateKeys restores dumps on the node at addr over the text protocol
+// and returns how many of them, in order, the node accepted.
+func migrateKeys(addr string, timeout time.Duration, dumps []*cache.Dumped, replace bool) (int, error) {
+	conn, err := net.DialTimeout("tcp", addr, timeout)
+	if err != nil {
+		return 0, fmt.Errorf("IOERR error or timeout connecting to the client")
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(timeout))
+
+	w := bufio.NewWriter(conn)
+	for _, d := range dumps {
+		var ttl int64
+		if !d.ExpiresAt.IsZero() {
+			ttl = d.ExpiresAt.UnixMilli()
+		}
+		w.WriteString("ASKING\r\nRESTORE ")
+		w.Write(quoteArg([]byte(d.Key)))
+		fmt.Fprintf(w, " %d ", ttl)
+		w.Write(quoteArg(d.Payload))
+		w.WriteString(" ABSTTL")
+		if replace {
+			w.WriteString(" REPLACE")
+		}
+		w.WriteString("\r\n")
+	}
+	if err := w.Flush(); err != nil {
+		return 0, fmt.Errorf("IOERR error or timeout writing to target instance")
+	}
+
+	r := bufio.NewReader(conn)
+	for i := range dumps {
+		// One reply to ASKING, one to RESTORE.
+		for j := 0; j < 2; j++ {
+			line, err := r.ReadString('\n')
+			if err != nil {
+				return i, fmt.Errorf("IOERR error or timeout reading to target instance")
+			}
+			if msg, ok := strings.CutPrefix(strings.TrimSpace(line), "ERROR: "); ok {
+				return i, fmt.Errorf("ERR Target instance replied with error: %s", msg)
+			}
+		}
+	}
+	return len(dumps), nil
+}
+
+// quoteArg quotes b for the text protocol, the inverse of splitArgs.
+func quoteArg(b []byte) []byte {
+	out := make([]byte, 0, len(b)+2)
+	out = append(out, '"')
+	for _, c := range b {
+		switch {
+		case c == '"' || c == '\\':
+			out = append(out, '\\', c)
+		case c < ' ' || c > '~':
+			out = append(out, fmt.Sprintf("\\x%02x", c)...)
+		default:
+			out = append(out, c)
+		}
+	}
+	return append(out, '"')
+}
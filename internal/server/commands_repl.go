@@ -0,0 +1,150 @@
+package server
+
+import (
+	"bufio"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+)
+
+import (
+	cache "boltcache/internal/cache"
+	logger "boltcache/logger"
+)
+
+// Replication commands.
+func init() {
+	registerCommands(
+		&Command{Name: "PSYNC", Arity: 3, Flags: FlagAdmin, Handler: cmdPsync},
+		&Command{Name: "MERKLE", Arity: 1, Flags: FlagAdmin, Handler: cmdMerkle},
+		&Command{Name: "ROLE", Arity: 1, Flags: FlagFast, Handler: cmdRole},
+	)
+}
+
+// PSYNC replid offset hands the connection over to the replication stream.
+// A replica sends "?" as replid on its first sync.
+func cmdPsync(ctx *CommandContext) {
+	sess := ctx.Session
+	if sess.conn == nil {
+		ctx.Reply.WriteError("ERR PSYNC is only supported on the TCP text port")
+		return
+	}
+	if ctx.Cache.IsReplica() {
+		ctx.Reply.WriteError(cache.ErrReplicaOfReplica.Error())
+		return
+	}
+	if !ctx.Cache.ReplicationEnabled() {
+		ctx.Reply.WriteError(cache.ErrReplicationDisabled.Error())
+		return
+	}
+	offset, err := strconv.ParseInt(ctx.Arg(2), 10, 64)
+	if err != nil {
+		ctx.Reply.WriteError("ERR value is not an integer or out of range")
+		return
+	}
+
+	id := ctx.Arg(1)
+	sess.handoff = func(conn net.Conn, r *bufio.Reader) {
+		if err := ctx.Cache.ServeReplica(conn, r, id, offset); err != nil {
+			logger.Log("Replication to %s ended: %v", conn.RemoteAddr(), err)
+		}
+	}
+}
+
+// MERKLE hands the connection over to the anti-entropy protocol, through
+// which replicas compare their dataset with the master's.
+func cmdMerkle(ctx *CommandContext) {
+	sess := ctx.Session
+	if sess.conn == nil {
+		ctx.Reply.WriteError("ERR MERKLE is only supported on the TCP text port")
+		return
+	}
+	sess.handoff = func(conn net.Conn, r *bufio.Reader) {
+		if err := ctx.Cache.ServeMerkle(conn, r); err != nil && err != io.EOF {
+			logger.Log("Anti-entropy with %s ended: %v", conn.RemoteAddr(), err)
+		}
+	}
+}
+
+// ROLE replies like Redis: the master lists its replicas with their
+// acknowledged offsets, a replica reports its master and link state.
+func cmdRole(ctx *CommandContext) {
+	info := ctx.Cache.ReplicationInfo()
+	if info.Role == "replica" {
+		host, port := splitHostPort(info.Master)
+		state := "connecting"
+		if info.LinkUp {
+			state = "connected"
+		}
+		ctx.Reply.WriteArray(5)
+		ctx.Reply.WriteBulkString("slave")
+		ctx.Reply.WriteBulkString(host)
+		ctx.Reply.WriteInt(port)
+		ctx.Reply.WriteBulkString(state)
+		ctx.Reply.WriteInt(info.Offset)
+		return
+	}
+
+	ctx.Reply.WriteArray(3)
+	ctx.Reply.WriteBulkString("master")
+	ctx.Reply.WriteInt(info.Offset)
+	ctx.Reply.WriteArray(len(info.Replicas))
+	for _, r := range info.Replicas {
+		host, port := splitHostPort(r.Addr)
+		ctx.Reply.WriteArray(3)
+		ctx.Reply.WriteBulkString(host)
+		ctx.Reply.WriteBulkString(strconv.FormatInt(port, 10))
+		ctx.Reply.WriteBulkString(strconv.FormatInt(r.Offset, 10))
+	}
+}
+
+func splitHostPort(addr string) (string, int64) {
+	host, port, err := net.SplitHostPort(addr)
+	if err != nil {
+		return addr, 0
+	}
+	p, _ := strconv.ParseInt(port, 10, 64)
+	return strings.Trim(host, "[]"), p
+}
+
+// replicationInfo is the Replication section of INFO.
+func replicationInfo(c *cache.BoltCache) []infoField {
+	info := c.ReplicationInfo()
+	itoa := func(n int64) string { return strconv.FormatInt(n, 10) }
+
+	role := "master"
+	if info.Role == "replica" {
+		role = "slave"
+	}
+	fields := []infoField{{"role", role}}
+	if info.Role == "replica" {
+		host, port := splitHostPort(info.Master)
+		status := "down"
+		if info.LinkUp {
+			status = "up"
+		}
+		fields = append(fields,
+			infoField{"master_host", host},
+			infoField{"master_port", itoa(port)},
+			infoField{"master_link_status", status},
+		)
+		if !info.LinkUp {
+			fields = append(fields, infoField{"master_link_down_since_seconds", itoa(int64(info.LinkDuration.Seconds()))})
+		}
+	}
+	fields = append(fields, infoField{"connected_slaves", strconv.Itoa(len(info.Replicas))})
+	for i, r := range info.Replicas {
+		host, port := splitHostPort(r.Addr)
+		fields = append(fields, infoField{"slave" + strconv.Itoa(i),
+			"ip=" + host + ",port=" + itoa(port) + ",state=online,offset=" + itoa(r.Offset) + ",lag=" + itoa(int64(r.Lag.Seconds()))})
+	}
+	return append(fields,
+		infoField{"master_replid", info.ReplID},
+		infoField{"master_repl_offset", itoa(info.Offset)},
+		infoField{"repl_backlog_first_byte_offset", itoa(info.BacklogStart)},
+		infoField{"repl_sync_timeouts", strconv.FormatUint(info.SyncTimeouts, 10)},
+		infoField{"repl_anti_entropy_runs", strconv.FormatUint(info.AntiEntropyRuns, 10)},
+		infoField{"repl_anti_entropy_repaired_keys", strconv.FormatUint(info.AntiEntropyRepaired, 10)},
+	)
+}
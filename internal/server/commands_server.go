@@ -0,0 +1,444 @@
+package server
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+import (
+	appinfo "boltcache/appinfo"
+	cache "boltcache/internal/cache"
+)
+
+// Connection, server, scripting and pub/sub commands.
+func init() {
+	registerCommands(
+		&Command{Name: "PING", Arity: -1, Flags: FlagFast | FlagPubSub, Handler: cmdPing},
+		&Command{Name: "HELLO", Arity: -1, Flags: FlagFast | FlagPubSub, Handler: cmdHello},
+		&Command{Name: "ECHO", Arity: 2, Flags: FlagFast, Handler: cmdEcho},
+		&Command{Name: "INFO", Arity: -1, Handler: cmdInfo},
+		&Command{Name: "COMMAND", Arity: -1, Handler: cmdCommand},
+		&Command{Name: "BGREWRITEAOF", Arity: 1, Flags: FlagAdmin, Handler: cmdBgRewriteAOF},
+		&Command{Name: "SAVE", Arity: 1, Flags: FlagAdmin, Handler: cmdSave},
+		&Command{Name: "BGSAVE", Arity: -1, Flags: FlagAdmin, Handler: cmdBgSave},
+		&Command{Name: "LASTSAVE", Arity: 1, Flags: FlagAdmin | FlagFast, Handler: cmdLastSave},
+		&Command{Name: "BACKUP", Arity: -2, Flags: FlagAdmin | FlagExclusive, Handler: cmdBackup},
+		&Command{Name: "EVAL", Arity: -3, Flags: FlagWrite, Feature: "lua_scripting", Handler: cmdEval},
+		&Command{Name: "PUBLISH", Arity: -3, Flags: FlagPubSub | FlagFast, Feature: "pub_sub", Handler: cmdPublish},
+		&Command{Name: "SUBSCRIBE", Arity: -2, Flags: FlagPubSub, Feature: "pub_sub", Handler: cmdSubscribe},
+		&Command{Name: "UNSUBSCRIBE", Arity: -1, Flags: FlagPubSub, Feature: "pub_sub", Handler: cmdUnsubscribe},
+	)
+}
+
+func cmdPing(ctx *CommandContext) {
+	if len(ctx.Args) > 2 {
+		ctx.Reply.WriteError("ERR wrong number of arguments for 'ping' command")
+		return
+	}
+
+	if ctx.Session.Proto() == protoRESP2 && ctx.Session.subscriptions() > 0 {
+		ctx.Reply.WriteArray(2)
+		ctx.Reply.WriteBulkString("pong")
+		if len(ctx.Args) == 2 {
+			ctx.Reply.WriteBulk(ctx.Args[1])
+		} else {
+			ctx.Reply.WriteBulkString("")
+		}
+		return
+	}
+
+	if len(ctx.Args) == 2 {
+		ctx.Reply.WriteBulk(ctx.Args[1])
+		return
+	}
+	ctx.Reply.WriteString("PONG")
+}
+
+// HELLO [protover [AUTH username password] [SETNAME clientname]]
+func cmdHello(ctx *CommandContext) {
+	if ctx.Session.Proto() == protoText {
+		ctx.Reply.WriteError("ERR HELLO is only supported on RESP connections")
+		return
+	}
+
+	proto := ctx.Session.Proto()
+	if len(ctx.Args) > 1 {
+		v, err := strconv.Atoi(ctx.Arg(1))
+		if err != nil {
+			ctx.Reply.WriteError("ERR Protocol version is not an integer or out of range")
+			return
+		}
+		if v != protoRESP2 && v != protoRESP3 {
+			ctx.Reply.WriteError("NOPROTO unsupported protocol version")
+			return
+		}
+		proto = v
+	}
+
+	name := ""
+	for i := 2; i < len(ctx.Args); i++ {
+		switch strings.ToUpper(ctx.Arg(i)) {
+		case "AUTH":
+			// The TCP front-ends don't authenticate; credentials are
+			// accepted so clients that always send them can connect.
+			if i+2 >= len(ctx.Args) {
+				ctx.SyntaxError()
+				return
+			}
+			i += 2
+		case "SETNAME":
+			if i+1 >= len(ctx.Args) {
+				ctx.SyntaxError()
+				return
+			}
+			name = ctx.Arg(i + 1)
+			i++
+		default:
+			ctx.SyntaxError()
+			return
+		}
+	}
+
+	ctx.Session.setProto(proto)
+	if name != "" {
+		ctx.Session.mu.Lock()
+		ctx.Session.name = name
+		ctx.Session.mu.Unlock()
+	}
+	if r, ok := ctx.Reply.(*respReply); ok {
+		r.resp3 = proto == protoRESP3
+	}
+
+	ctx.Reply.WriteMap(7)
+	ctx.Reply.WriteBulkString("server")
+	ctx.Reply.WriteBulkString(appinfo.Name)
+	ctx.Reply.WriteBulkString("version")
+	ctx.Reply.WriteBulkString(appinfo.Version)
+	ctx.Reply.WriteBulkString("proto")
+	ctx.Reply.WriteInt(int64(proto))
+	ctx.Reply.WriteBulkString("id")
+	ctx.Reply.WriteInt(ctx.Session.id)
+	ctx.Reply.WriteBulkString("mode")
+	ctx.Reply.WriteBulkString("standalone")
+	ctx.Reply.WriteBulkString("role")
+	ctx.Reply.WriteBulkString(ctx.Cache.ReplicationInfo().Role)
+	ctx.Reply.WriteBulkString("modules")
+	ctx.Reply.WriteArray(0)
+}
+
+func cmdEcho(ctx *CommandContext) {
+	ctx.Reply.WriteBulk(ctx.Args[1])
+}
+
+type infoField struct {
+	Key   string
+	Value string
+}
+
+type infoSection struct {
+	Name   string
+	Fields []infoField
+}
+
+func infoSections(c *cache.BoltCache) []infoSection {
+	stats := c.Data.EvictionStats()
+	aof := c.AOFStats()
+	aofStatus := "ok"
+	if aof.Enabled && !aof.LastRewriteOK {
+		aofStatus = "err"
+	}
+	saves := c.SaveStats()
+	saveStatus := "ok"
+	if !saves.LastSaveOK {
+		saveStatus = "err"
+	}
+	lastSave := int64(0)
+	if !saves.LastSave.IsZero() {
+		lastSave = saves.LastSave.Unix()
+	}
+	itoa := func(n int64) string { return strconv.FormatInt(n, 10) }
+	features := func(name string) string {
+		return boolInfo(featureEnabled(c, name))
+	}
+
+	return []infoSection{
+		{"Server", []infoField{
+			{"boltcache_version", appinfo.Version},
+			{"uptime_in_seconds", itoa(int64(time.Since(appinfo.StartTime).Seconds()))},
+		}},
+		{"Memory", []infoField{
+			{"used_memory", itoa(stats.UsedMemory)},
+			{"maxmemory", itoa(stats.MaxMemory)},
+			{"maxkeys", itoa(stats.MaxKeys)},
+			{"maxmemory_policy", stats.Policy},
+		}},
+		{"Persistence", []infoField{
+			{"rdb_bgsave_in_progress", boolInfo(saves.InProgress)},
+			{"rdb_last_save_time", itoa(lastSave)},
+			{"rdb_last_bgsave_status", saveStatus},
+			{"aof_enabled", boolInfo(aof.Enabled)},
+			{"aof_rewrite_in_progress", boolInfo(aof.RewriteInProgress)},
+			{"aof_last_bgrewrite_status", aofStatus},
+			{"aof_current_size", itoa(aof.CurrentSize)},
+			{"aof_base_size", itoa(aof.BaseSize)},
+		}},
+		{"Replication", replicationInfo(c)},
+		{"Cluster", []infoField{
+			{"cluster_enabled", boolInfo(c.Cluster != nil)},
+		}},
+		{"Consensus", consensusInfo(c)},
+		{"Active", activeInfo(c)},
+		{"Stats", []infoField{
+			{"evicted_keys", strconv.FormatUint(stats.EvictedKeys, 10)},
+			{"expired_keys", strconv.FormatUint(c.Data.ExpiredKeys(), 10)},
+		}},
+		{"Features", []infoField{
+			{"lua_scripting", features("lua_scripting")},
+			{"pub_sub", features("pub_sub")},
+			{"complex_types", features("complex_types")},
+			{"transactions", features("transactions")},
+			{"geo_commands", features("geo_commands")},
+			{"streams", features("streams")},
+		}},
+		{"Keyspace", []infoField{
+			{"keys", strconv.Itoa(stats.Keys)},
+		}},
+	}
+}
+
+func boolInfo(b bool) string {
+	if b {
+		return "1"
+	}
+	return "0"
+}
+
+// INFO [section ...]
+func cmdInfo(ctx *CommandContext) {
+	wanted := map[string]bool{}
+	for _, a := range ctx.Args[1:] {
+		wanted[strings.ToLower(string(a))] = true
+	}
+	all := len(wanted) == 0 || wanted["all"] || wanted["everything"]
+
+	var b strings.Builder
+	for _, section := range infoSections(ctx.Cache) {
+		if !all && !wanted[strings.ToLower(section.Name)] {
+			continue
+		}
+		if b.Len() > 0 {
+			b.WriteString("\r\n")
+		}
+		fmt.Fprintf(&b, "# %s\r\n", section.Name)
+		for _, f := range section.Fields {
+			fmt.Fprintf(&b, "%s:%s\r\n", f.Key, f.Value)
+		}
+	}
+	ctx.Reply.WriteVerbatim("txt", b.String())
+}
+
+// BGREWRITEAOF
+func cmdBgRewriteAOF(ctx *CommandContext) {
+	if err := ctx.Cache.BackgroundRewriteAOF(); err != nil {
+		ctx.Reply.WriteError(err.Error())
+		return
+	}
+	ctx.Reply.WriteString("Background append only file rewriting started")
+}
+
+// SAVE
+func cmdSave(ctx *CommandContext) {
+	if err := ctx.Cache.Save(); err != nil {
+		ctx.Reply.WriteError(saveError(err))
+		return
+	}
+	ctx.Reply.WriteString("OK")
+}
+
+// BGSAVE [SCHEDULE]
+//
+// SCHEDULE is accepted for compatibility; a save already running is
+// reported as an error either way.
+func cmdBgSave(ctx *CommandContext) {
+	if len(ctx.Args) > 2 || (len(ctx.Args) == 2 && !strings.EqualFold(ctx.Arg(1), "SCHEDULE")) {
+		ctx.SyntaxError()
+		return
+	}
+	if err := ctx.Cache.BackgroundSave(); err != nil {
+		ctx.Reply.WriteError(saveError(err))
+		return
+	}
+	ctx.Reply.WriteString("Background saving started")
+}
+
+// LASTSAVE
+func cmdLastSave(ctx *CommandContext) {
+	var ts int64
+	if t := ctx.Cache.LastSave(); !t.IsZero() {
+		ts = t.Unix()
+	}
+	ctx.Reply.WriteInt(ts)
+}
+
+// BACKUP LIST | BACKUP RESTORE name
+func cmdBackup(ctx *CommandContext) {
+	switch strings.ToUpper(ctx.Arg(1)) {
+	case "LIST":
+		if len(ctx.Args) != 2 {
+			ctx.SyntaxError()
+			return
+		}
+		backups := ctx.Cache.Backups()
+		ctx.Reply.WriteArray(len(backups))
+		for _, b := range backups {
+			ctx.Reply.WriteBulkString(b.Name)
+		}
+	case "RESTORE":
+		if len(ctx.Args) != 3 {
+			ctx.SyntaxError()
+			return
+		}
+		n, err := ctx.Cache.RestoreBackup(ctx.Arg(2))
+		if err != nil {
+			ctx.Reply.WriteError(saveError(err))
+			return
+		}
+		ctx.Reply.WriteInt(int64(n))
+	default:
+		ctx.Reply.WriteError(fmt.Sprintf("ERR unknown subcommand '%s'", ctx.Arg(1)))
+	}
+}
+
+// saveError formats a persistence error as a reply; I/O errors don't carry
+// an error code of their own.
+func saveError(err error) string {
+	msg := err.Error()
+	if strings.HasPrefix(msg, "ERR ") {
+		return msg
+	}
+	return "ERR " + msg
+}
+
+func writeCommandInfo(reply Reply, c *Command) {
+	reply.WriteArray(6)
+	reply.WriteBulkString(strings.ToLower(c.Name))
+	reply.WriteInt(int64(c.Arity))
+	flags := c.Flags.Names()
+	reply.WriteArray(len(flags))
+	for _, f := range flags {
+		reply.WriteString(f)
+	}
+	reply.WriteInt(int64(c.FirstKey))
+	reply.WriteInt(int64(c.LastKey))
+	reply.WriteInt(int64(c.KeyStep))
+}
+
+// COMMAND [COUNT | INFO name ... | DOCS [name ...]]
+func cmdCommand(ctx *CommandContext) {
+	if len(ctx.Args) == 1 {
+		cmds := sortedCommands()
+		ctx.Reply.WriteArray(len(cmds))
+		for _, c := range cmds {
+			writeCommandInfo(ctx.Reply, c)
+		}
+		return
+	}
+
+	switch strings.ToUpper(ctx.Arg(1)) {
+	case "COUNT":
+		ctx.Reply.WriteInt(int64(len(commandTable)))
+	case "INFO":
+		names := ctx.Args[2:]
+		ctx.Reply.WriteArray(len(names))
+		for _, name := range names {
+			if c := lookupCommand(name); c != nil {
+				writeCommandInfo(ctx.Reply, c)
+			} else {
+				ctx.Reply.WriteNull()
+			}
+		}
+	case "DOCS":
+		// No documentation is shipped; clients fall back to COMMAND INFO.
+		ctx.Reply.WriteArray(0)
+	default:
+		ctx.Reply.WriteError(fmt.Sprintf("ERR unknown subcommand '%s'", ctx.Arg(1)))
+	}
+}
+
+// EVAL script numkeys [key ...] [arg ...]
+func cmdEval(ctx *CommandContext) {
+	if ctx.Cache.LuaEngine == nil {
+		ctx.Reply.WriteError("ERR Lua scripting disabled")
+		return
+	}
+
+	numKeys, err := strconv.Atoi(ctx.Arg(2))
+	if err != nil || numKeys < 0 {
+		ctx.Reply.WriteError("ERR value is not an integer or out of range")
+		return
+	}
+	if numKeys > len(ctx.Args)-3 {
+		ctx.Reply.WriteError("ERR Number of keys can't be greater than number of args")
+		return
+	}
+
+	keys := stringArgs(ctx.Args[3 : 3+numKeys])
+	args := stringArgs(ctx.Args[3+numKeys:])
+	result := ctx.Cache.LuaEngine.Execute(ctx.Arg(1), keys, args)
+	ctx.Reply.WriteBulkString(result)
+}
+
+// PUBLISH channel message
+//
+// Extra arguments are joined with spaces so unquoted text protocol
+// messages keep working.
+func cmdPublish(ctx *CommandContext) {
+	message := ctx.Arg(2)
+	if len(ctx.Args) > 3 {
+		message = strings.Join(stringArgs(ctx.Args[2:]), " ")
+	}
+	count := ctx.Cache.Publish(ctx.Arg(1), message)
+	if ctx.Session.Proto() == protoText {
+		ctx.Reply.WriteString(fmt.Sprintf("PUBLISHED %d", count))
+		return
+	}
+	ctx.Reply.WriteInt(int64(count))
+}
+
+func cmdSubscribe(ctx *CommandContext) {
+	for _, ch := range ctx.Args[1:] {
+		count := ctx.Session.Subscribe(string(ch))
+		if ctx.Session.Proto() == protoText {
+			ctx.Reply.WriteString("SUBSCRIBED " + string(ch))
+			continue
+		}
+		ctx.Reply.WritePush(3)
+		ctx.Reply.WriteBulkString("subscribe")
+		ctx.Reply.WriteBulk(ch)
+		ctx.Reply.WriteInt(int64(count))
+	}
+}
+
+func cmdUnsubscribe(ctx *CommandContext) {
+	channels := stringArgs(ctx.Args[1:])
+	if len(channels) == 0 {
+		channels = ctx.Session.Channels()
+	}
+	if len(channels) == 0 {
+		ctx.Reply.WritePush(3)
+		ctx.Reply.WriteBulkString("unsubscribe")
+		ctx.Reply.WriteNull()
+		ctx.Reply.WriteInt(0)
+		return
+	}
+
+	for _, ch := range channels {
+		count := ctx.Session.Unsubscribe(ch)
+		ctx.Reply.WritePush(3)
+		ctx.Reply.WriteBulkString("unsubscribe")
+		ctx.Reply.WriteBulkString(ch)
+		ctx.Reply.WriteInt(int64(count))
+	}
+}
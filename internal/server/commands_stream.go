@@ -0,0 +1,645 @@
+package server
+
+import (
+	"errors"
+	"strconv"
+	"strings"
+	"time"
+)
+
+import (
+	cache "boltcache/internal/cache"
+)
+
+// Stream commands.
+func init() {
+	registerCommands(
+		&Command{Name: "XADD", Arity: -5, Flags: FlagWrite | FlagFast, FirstKey: 1, LastKey: 1, KeyStep: 1, Feature: "streams", Handler: cmdXAdd},
+		&Command{Name: "XLEN", Arity: 2, Flags: FlagRead | FlagFast, FirstKey: 1, LastKey: 1, KeyStep: 1, Feature: "streams", Handler: cmdXLen},
+		&Command{Name: "XRANGE", Arity: -4, Flags: FlagRead, FirstKey: 1, LastKey: 1, KeyStep: 1, Feature: "streams", Handler: cmdXRange},
+		&Command{Name: "XREVRANGE", Arity: -4, Flags: FlagRead, FirstKey: 1, LastKey: 1, KeyStep: 1, Feature: "streams", Handler: cmdXRange},
+		&Command{Name: "XTRIM", Arity: -4, Flags: FlagWrite, FirstKey: 1, LastKey: 1, KeyStep: 1, Feature: "streams", Handler: cmdXTrim},
+		&Command{Name: "XREAD", Arity: -4, Flags: FlagRead | FlagBlocking, Feature: "streams", Handler: cmdXRead},
+		&Command{Name: "XREADGROUP", Arity: -7, Flags: FlagWrite | FlagBlocking, Feature: "streams", Handler: cmdXRead},
+		&Command{Name: "XGROUP", Arity: -2, Flags: FlagWrite, FirstKey: 2, LastKey: 2, KeyStep: 1, Feature: "streams", Handler: cmdXGroup},
+		&Command{Name: "XACK", Arity: -4, Flags: FlagWrite | FlagFast, FirstKey: 1, LastKey: 1, KeyStep: 1, Feature: "streams", Handler: cmdXAck},
+		&Command{Name: "XCLAIM", Arity: -6, Flags: FlagWrite | FlagFast, FirstKey: 1, LastKey: 1, KeyStep: 1, Feature: "streams", Handler: cmdXClaim},
+		&Command{Name: "XPENDING", Arity: -3, Flags: FlagRead, FirstKey: 1, LastKey: 1, KeyStep: 1, Feature: "streams", Handler: cmdXPending},
+	)
+}
+
+const errNotInteger = "ERR value is not an integer or out of range"
+
+// writeStreamEntries answers with [id, [field, value, ...]] pairs. A
+// pending entry trimmed from the stream has nil fields.
+func writeStreamEntries(reply Reply, entries []cache.StreamEntry) {
+	reply.WriteArray(len(entries))
+	for _, e := range entries {
+		reply.WriteArray(2)
+		reply.WriteBulkString(e.ID.String())
+		if e.Fields == nil {
+			reply.WriteNull()
+			continue
+		}
+		reply.WriteArray(len(e.Fields))
+		for _, f := range e.Fields {
+			reply.WriteBulkString(f)
+		}
+	}
+}
+
+// parseRangeID parses an end of an ID range: "-", "+", a full or a
+// millisecond-only ID, and "(" for an exclusive end.
+func parseRangeID(s string, isEnd bool) (cache.StreamID, error) {
+	switch s {
+	case "-":
+		return cache.StreamID{}, nil
+	case "+":
+		return cache.MaxStreamID, nil
+	}
+
+	exclusive := strings.HasPrefix(s, "(")
+	s = strings.TrimPrefix(s, "(")
+	var missingSeq uint64
+	if isEnd {
+		missingSeq = cache.MaxStreamID.Seq
+	}
+	id, err := cache.ParseStreamID(s, missingSeq)
+	if err != nil || !exclusive {
+		return id, err
+	}
+
+	ok := false
+	if isEnd {
+		if id, ok = id.Prev(); !ok {
+			return id, errors.New("ERR invalid end ID for the interval")
+		}
+	} else if id, ok = id.Next(); !ok {
+		return id, errors.New("ERR invalid start ID for the interval")
+	}
+	return id, nil
+}
+
+// parseMaxLen parses the MAXLEN [=|~] threshold [LIMIT count] clause
+// starting at args[i] and returns the threshold and the index of the
+// last argument consumed. Approximate trimming is exact here.
+func parseMaxLen(ctx *CommandContext, i int) (int, int, bool) {
+	i++
+	if i < len(ctx.Args) && (ctx.Arg(i) == "=" || ctx.Arg(i) == "~") {
+		i++
+	}
+	if i >= len(ctx.Args) {
+		ctx.SyntaxError()
+		return 0, i, false
+	}
+	n, err := strconv.Atoi(ctx.Arg(i))
+	if err != nil {
+		ctx.Reply.WriteError(errNotInteger)
+		return 0, i, false
+	}
+	if n < 0 {
+		ctx.Reply.WriteError("ERR The MAXLEN argument must be >= 0.")
+		return 0, i, false
+	}
+	if i+2 < len(ctx.Args) && strings.EqualFold(ctx.Arg(i+1), "LIMIT") {
+		if _, err := strconv.Atoi(ctx.Arg(i + 2)); err != nil {
+			ctx.Reply.WriteError(errNotInteger)
+			return 0, i, false
+		}
+		i += 2
+	}
+	return n, i, true
+}
+
+// XADD key [NOMKSTREAM] [MAXLEN [=|~] threshold [LIMIT count]] *|id field value [field value ...]
+func cmdXAdd(ctx *CommandContext) {
+	var opts cache.XAddOptions
+
+	i := 2
+options:
+	for ; i < len(ctx.Args); i++ {
+		switch strings.ToUpper(ctx.Arg(i)) {
+		case "NOMKSTREAM":
+			opts.NoMkStream = true
+		case "MAXLEN":
+			var ok bool
+			if opts.MaxLen, i, ok = parseMaxLen(ctx, i); !ok {
+				return
+			}
+			opts.Trim = true
+		default:
+			break options
+		}
+	}
+
+	if n := len(ctx.Args) - i - 1; n <= 0 || n%2 != 0 {
+		ctx.Reply.WriteError("ERR wrong number of arguments for 'xadd' command")
+		return
+	}
+	fields := ctx.Args[i+1:]
+
+	id, ok, err := ctx.Cache.XAdd(ctx.Arg(1), ctx.Arg(i), stringArgs(fields), opts)
+	switch {
+	case err != nil:
+		ctx.Reply.WriteError(err.Error())
+	case !ok:
+		ctx.Reply.WriteNull()
+	default:
+		ctx.Reply.WriteBulkString(id.String())
+	}
+}
+
+func cmdXLen(ctx *CommandContext) {
+	n, err := ctx.Cache.XLen(ctx.Arg(1))
+	if err != nil {
+		ctx.Reply.WriteError(err.Error())
+		return
+	}
+	ctx.Reply.WriteInt(int64(n))
+}
+
+// XRANGE key start end [COUNT count], and XREVRANGE key end start.
+func cmdXRange(ctx *CommandContext) {
+	reverse := ctx.Command.Name == "XREVRANGE"
+	startArg, endArg := ctx.Arg(2), ctx.Arg(3)
+	if reverse {
+		startArg, endArg = endArg, startArg
+	}
+
+	count := 0
+	switch {
+	case len(ctx.Args) == 6 && strings.EqualFold(ctx.Arg(4), "COUNT"):
+		n, err := strconv.Atoi(ctx.Arg(5))
+		if err != nil {
+			ctx.Reply.WriteError(errNotInteger)
+			return
+		}
+		if n <= 0 {
+			// COUNT 0 or less answers with nothing, as in Redis.
+			ctx.Reply.WriteArray(0)
+			return
+		}
+		count = n
+	case len(ctx.Args) != 4:
+		ctx.SyntaxError()
+		return
+	}
+
+	start, err := parseRangeID(startArg, false)
+	if err != nil {
+		ctx.Reply.WriteError(err.Error())
+		return
+	}
+	end, err := parseRangeID(endArg, true)
+	if err != nil {
+		ctx.Reply.WriteError(err.Error())
+		return
+	}
+
+	entries, err := ctx.Cache.XRange(ctx.Arg(1), start, end, count, reverse)
+	if err != nil {
+		ctx.Reply.WriteError(err.Error())
+		return
+	}
+	writeStreamEntries(ctx.Reply, entries)
+}
+
+// XTRIM key MAXLEN [=|~] threshold [LIMIT count]
+func cmdXTrim(ctx *CommandContext) {
+	if !strings.EqualFold(ctx.Arg(2), "MAXLEN") {
+		ctx.SyntaxError()
+		return
+	}
+	maxLen, i, ok := parseMaxLen(ctx, 2)
+	if !ok {
+		return
+	}
+	if i != len(ctx.Args)-1 {
+		ctx.SyntaxError()
+		return
+	}
+
+	n, err := ctx.Cache.XTrim(ctx.Arg(1), maxLen)
+	if err != nil {
+		ctx.Reply.WriteError(err.Error())
+		return
+	}
+	ctx.Reply.WriteInt(int64(n))
+}
+
+// streamRead is one key of an XREAD or XREADGROUP reply.
+type streamRead struct {
+	key     string
+	entries []cache.StreamEntry
+}
+
+// writeStreamReads answers with the keys and their entries: a map for
+// RESP3, an array of [key, entries] pairs otherwise.
+func writeStreamReads(ctx *CommandContext, reads []streamRead) {
+	if ctx.Session.Proto() == protoRESP3 {
+		ctx.Reply.WriteMap(len(reads))
+	} else {
+		ctx.Reply.WriteArray(len(reads))
+	}
+	for _, r := range reads {
+		if ctx.Session.Proto() != protoRESP3 {
+			ctx.Reply.WriteArray(2)
+		}
+		ctx.Reply.WriteBulkString(r.key)
+		writeStreamEntries(ctx.Reply, r.entries)
+	}
+}
+
+// blockingRead answers with read, which reports whether it replied. With
+// block set it retries after every write to keys until read replies, the
+// timeout (0 = forever) passes or the connection closes, and answers nil
+// then. TxMu is held during each attempt but never while waiting.
+func blockingRead(ctx *CommandContext, keys []string, block bool, timeout time.Duration, read func() bool) {
+	if ctx.Session.inExec {
+		// EXEC holds TxMu already, and nothing blocks in a transaction.
+		if !read() {
+			ctx.Reply.WriteNull()
+		}
+		return
+	}
+
+	attempt := func() bool {
+		ctx.Cache.TxMu.RLock()
+		defer ctx.Cache.TxMu.RUnlock()
+		return read()
+	}
+	if !block {
+		if !attempt() {
+			ctx.Reply.WriteNull()
+		}
+		return
+	}
+
+	// Register before the first attempt so no write is missed in between.
+	wake, stop := ctx.Cache.WaitKeys(keys)
+	defer stop()
+
+	var expired <-chan time.Time
+	if timeout > 0 {
+		timer := time.NewTimer(timeout)
+		defer timer.Stop()
+		expired = timer.C
+	}
+
+	for !attempt() {
+		select {
+		case <-wake:
+		case <-expired:
+			ctx.Reply.WriteNull()
+			return
+		case <-ctx.Session.closed:
+			ctx.Reply.WriteNull()
+			return
+		}
+	}
+}
+
+// XREAD [COUNT count] [BLOCK ms] STREAMS key [key ...] id [id ...]
+// XREADGROUP GROUP group consumer [COUNT count] [BLOCK ms] [NOACK] STREAMS key [key ...] id [id ...]
+func cmdXRead(ctx *CommandContext) {
+	group := ctx.Command.Name == "XREADGROUP"
+	var groupName, consumer string
+	count, block, noAck := 0, false, false
+	var timeout time.Duration
+
+	i := 1
+	for ; i < len(ctx.Args); i++ {
+		opt := strings.ToUpper(ctx.Arg(i))
+		if opt == "STREAMS" {
+			break
+		}
+		switch {
+		case opt == "COUNT" && i+1 < len(ctx.Args):
+			n, err := strconv.Atoi(ctx.Arg(i + 1))
+			if err != nil {
+				ctx.Reply.WriteError(errNotInteger)
+				return
+			}
+			count = n
+			i++
+		case opt == "BLOCK" && i+1 < len(ctx.Args):
+			ms, err := strconv.ParseInt(ctx.Arg(i+1), 10, 64)
+			if err != nil {
+				ctx.Reply.WriteError("ERR timeout is not an integer or out of range")
+				return
+			}
+			if ms < 0 {
+				ctx.Reply.WriteError("ERR timeout is negative")
+				return
+			}
+			block, timeout = true, time.Duration(ms)*time.Millisecond
+			i++
+		case opt == "GROUP" && group && i+2 < len(ctx.Args):
+			groupName, consumer = ctx.Arg(i+1), ctx.Arg(i+2)
+			i += 2
+		case opt == "NOACK" && group:
+			noAck = true
+		default:
+			ctx.SyntaxError()
+			return
+		}
+	}
+
+	if i >= len(ctx.Args)-1 {
+		ctx.SyntaxError()
+		return
+	}
+	rest := ctx.Args[i+1:]
+	if len(rest)%2 != 0 {
+		ctx.Reply.WriteError("ERR Unbalanced '" + strings.ToLower(ctx.Command.Name) + "' list of streams: for each stream key an ID or '$' must be specified.")
+		return
+	}
+	if group && groupName == "" {
+		ctx.Reply.WriteError("ERR Missing GROUP option for XREADGROUP")
+		return
+	}
+
+	keys := stringArgs(rest[:len(rest)/2])
+	ids := make([]cache.StreamID, len(keys))
+	newOnly := make([]bool, len(keys))
+	for j, arg := range stringArgs(rest[len(rest)/2:]) {
+		var err error
+		switch {
+		case arg == ">" && group:
+			newOnly[j] = true
+		case arg == ">":
+			err = errors.New("ERR The > ID can be specified only when calling XREADGROUP using the GROUP <group> <consumer> option.")
+		case arg == "$" && group:
+			err = errors.New("ERR The $ ID is meaningless in the context of XREADGROUP: you want to read the history of this consumer by specifying a proper ID, or use the > ID to get new messages. The $ ID would just return an empty result set.")
+		case arg == "$":
+			// Resolved once, so only entries added from now on count.
+			ids[j], err = ctx.Cache.XLastID(keys[j])
+		default:
+			ids[j], err = cache.ParseStreamID(arg, 0)
+		}
+		if err != nil {
+			ctx.Reply.WriteError(err.Error())
+			return
+		}
+	}
+
+	read := func() bool {
+		var reads []streamRead
+		for j, key := range keys {
+			var entries []cache.StreamEntry
+			var err error
+			if group {
+				entries, err = ctx.Cache.XReadGroup(key, groupName, consumer, ids[j], newOnly[j], count, noAck)
+			} else {
+				entries, err = ctx.Cache.XRead(key, ids[j], count)
+			}
+			if err != nil {
+				ctx.Reply.WriteError(err.Error())
+				return true
+			}
+			// History reads always answer, even when nothing is pending.
+			if len(entries) > 0 || (group && !newOnly[j]) {
+				reads = append(reads, streamRead{key, entries})
+			}
+		}
+		if len(reads) == 0 {
+			return false
+		}
+		writeStreamReads(ctx, reads)
+		return true
+	}
+
+	blockingRead(ctx, keys, block, timeout, read)
+}
+
+// XGROUP CREATE key group id|$ [MKSTREAM] | SETID key group id|$ |
+// DESTROY key group | CREATECONSUMER key group consumer |
+// DELCONSUMER key group consumer
+func cmdXGroup(ctx *CommandContext) {
+	sub := strings.ToUpper(ctx.Arg(1))
+	arity := map[string]int{"CREATE": 5, "SETID": 5, "DESTROY": 4, "CREATECONSUMER": 5, "DELCONSUMER": 5}
+	want, known := arity[sub]
+	switch {
+	case !known:
+		ctx.Reply.WriteError("ERR unknown subcommand '" + ctx.Arg(1) + "'. Try XGROUP HELP.")
+		return
+	case len(ctx.Args) != want && !(sub == "CREATE" && len(ctx.Args) == 6 && strings.EqualFold(ctx.Arg(5), "MKSTREAM")):
+		ctx.Reply.WriteError("ERR wrong number of arguments for 'xgroup|" + strings.ToLower(sub) + "' command")
+		return
+	}
+
+	key, group := ctx.Arg(2), ctx.Arg(3)
+	var err error
+	switch sub {
+	case "CREATE":
+		if err = ctx.Cache.XGroupCreate(key, group, ctx.Arg(4), len(ctx.Args) == 6); err == nil {
+			ctx.Reply.WriteString("OK")
+		}
+	case "SETID":
+		if err = ctx.Cache.XGroupSetID(key, group, ctx.Arg(4)); err == nil {
+			ctx.Reply.WriteString("OK")
+		}
+	case "DESTROY":
+		var ok bool
+		if ok, err = ctx.Cache.XGroupDestroy(key, group); err == nil {
+			ctx.Reply.WriteInt(boolInt(ok))
+		}
+	case "CREATECONSUMER":
+		var ok bool
+		if ok, err = ctx.Cache.XGroupCreateConsumer(key, group, ctx.Arg(4)); err == nil {
+			ctx.Reply.WriteInt(boolInt(ok))
+		}
+	case "DELCONSUMER":
+		var n int
+		if n, err = ctx.Cache.XGroupDelConsumer(key, group, ctx.Arg(4)); err == nil {
+			ctx.Reply.WriteInt(int64(n))
+		}
+	}
+	if err != nil {
+		ctx.Reply.WriteError(err.Error())
+	}
+}
+
+func boolInt(b bool) int64 {
+	if b {
+		return 1
+	}
+	return 0
+}
+
+// parseStreamIDs parses explicit entry IDs.
+func parseStreamIDs(args [][]byte) ([]cache.StreamID, error) {
+	ids := make([]cache.StreamID, len(args))
+	for i, a := range args {
+		id, err := cache.ParseStreamID(string(a), 0)
+		if err != nil {
+			return nil, err
+		}
+		ids[i] = id
+	}
+	return ids, nil
+}
+
+// XACK key group id [id ...]
+func cmdXAck(ctx *CommandContext) {
+	ids, err := parseStreamIDs(ctx.Args[3:])
+	if err != nil {
+		ctx.Reply.WriteError(err.Error())
+		return
+	}
+	n, err := ctx.Cache.XAck(ctx.Arg(1), ctx.Arg(2), ids...)
+	if err != nil {
+		ctx.Reply.WriteError(err.Error())
+		return
+	}
+	ctx.Reply.WriteInt(int64(n))
+}
+
+// XCLAIM key group consumer min-idle-time id [id ...] [IDLE ms]
+// [TIME unix-ms] [RETRYCOUNT count] [FORCE] [JUSTID]
+func cmdXClaim(ctx *CommandContext) {
+	minIdle, err := strconv.ParseInt(ctx.Arg(4), 10, 64)
+	if err != nil {
+		ctx.Reply.WriteError("ERR Invalid min-idle-time argument for XCLAIM")
+		return
+	}
+
+	// IDs come first; the options follow the first argument that isn't one.
+	i := 5
+	for ; i < len(ctx.Args); i++ {
+		if _, err := cache.ParseStreamID(ctx.Arg(i), 0); err != nil {
+			break
+		}
+	}
+	ids, _ := parseStreamIDs(ctx.Args[5:i])
+
+	var opts cache.XClaimOptions
+	for ; i < len(ctx.Args); i++ {
+		opt := strings.ToUpper(ctx.Arg(i))
+		switch {
+		case opt == "FORCE":
+			opts.Force = true
+		case opt == "JUSTID":
+			opts.JustID = true
+		case (opt == "IDLE" || opt == "TIME" || opt == "RETRYCOUNT") && i+1 < len(ctx.Args):
+			n, err := strconv.ParseInt(ctx.Arg(i+1), 10, 64)
+			if err != nil {
+				ctx.Reply.WriteError("ERR Invalid " + opt + " option argument for XCLAIM")
+				return
+			}
+			switch opt {
+			case "IDLE":
+				opts.Idle = time.Duration(n) * time.Millisecond
+			case "TIME":
+				opts.Time = time.UnixMilli(n)
+			case "RETRYCOUNT":
+				opts.Retry, opts.RetryCount = true, int(n)
+			}
+			i++
+		case opt == "LASTID" && i+1 < len(ctx.Args):
+			// Accepted for compatibility; the group's last ID is not moved.
+			i++
+		default:
+			if len(ids) == 0 {
+				ctx.Reply.WriteError(cache.ErrInvalidStreamID.Error())
+				return
+			}
+			ctx.Reply.WriteError("ERR Unrecognized XCLAIM option '" + ctx.Arg(i) + "'")
+			return
+		}
+	}
+
+	entries, err := ctx.Cache.XClaim(ctx.Arg(1), ctx.Arg(2), ctx.Arg(3), time.Duration(minIdle)*time.Millisecond, ids, opts)
+	if err != nil {
+		ctx.Reply.WriteError(err.Error())
+		return
+	}
+	if opts.JustID {
+		ctx.Reply.WriteArray(len(entries))
+		for _, e := range entries {
+			ctx.Reply.WriteBulkString(e.ID.String())
+		}
+		return
+	}
+	writeStreamEntries(ctx.Reply, entries)
+}
+
+// XPENDING key group [[IDLE min-idle-time] start end count [consumer]]
+func cmdXPending(ctx *CommandContext) {
+	key, group := ctx.Arg(1), ctx.Arg(2)
+	if len(ctx.Args) == 3 {
+		sum, err := ctx.Cache.XPendingSummary(key, group)
+		if err != nil {
+			ctx.Reply.WriteError(err.Error())
+			return
+		}
+		ctx.Reply.WriteArray(4)
+		ctx.Reply.WriteInt(int64(sum.Count))
+		if sum.Count == 0 {
+			ctx.Reply.WriteNull()
+			ctx.Reply.WriteNull()
+			ctx.Reply.WriteNull()
+			return
+		}
+		ctx.Reply.WriteBulkString(sum.Min.String())
+		ctx.Reply.WriteBulkString(sum.Max.String())
+		ctx.Reply.WriteArray(len(sum.Consumers))
+		for _, c := range sum.Consumers {
+			ctx.Reply.WriteArray(2)
+			ctx.Reply.WriteBulkString(c.Consumer)
+			ctx.Reply.WriteBulkString(strconv.Itoa(c.Count))
+		}
+		return
+	}
+
+	args := ctx.Args[3:]
+	var minIdle time.Duration
+	if len(args) >= 2 && strings.EqualFold(string(args[0]), "IDLE") {
+		ms, err := strconv.ParseInt(string(args[1]), 10, 64)
+		if err != nil {
+			ctx.Reply.WriteError(errNotInteger)
+			return
+		}
+		minIdle = time.Duration(ms) * time.Millisecond
+		args = args[2:]
+	}
+	if len(args) != 3 && len(args) != 4 {
+		ctx.SyntaxError()
+		return
+	}
+
+	start, err := parseRangeID(string(args[0]), false)
+	if err != nil {
+		ctx.Reply.WriteError(err.Error())
+		return
+	}
+	end, err := parseRangeID(string(args[1]), true)
+	if err != nil {
+		ctx.Reply.WriteError(err.Error())
+		return
+	}
+	count, err := strconv.Atoi(string(args[2]))
+	if err != nil {
+		ctx.Reply.WriteError(errNotInteger)
+		return
+	}
+	consumer := ""
+	if len(args) == 4 {
+		consumer = string(args[3])
+	}
+
+	pending, err := ctx.Cache.XPending(key, group, start, end, count, consumer, minIdle)
+	if err != nil {
+		ctx.Reply.WriteError(err.Error())
+		return
+	}
+	now := time.Now()
+	ctx.Reply.WriteArray(len(pending))
+	for _, pe := range pending {
+		ctx.Reply.WriteArray(4)
+		ctx.Reply.WriteBulkString(pe.ID.String())
+		ctx.Reply.WriteBulkString(pe.Consumer)
+		ctx.Reply.WriteInt(now.Sub(pe.DeliveredAt).Milliseconds())
+		ctx.Reply.WriteInt(int64(pe.Deliveries))
+	}
+}
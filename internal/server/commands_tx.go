@@ -0,0 +1,82 @@
+package server
+
+// Transaction commands.
+func init() {
+	registerCommands(
+		&Command{Name: "MULTI", Arity: 1, Flags: FlagFast | FlagTransaction, Feature: "transactions", Handler: cmdMulti},
+		&Command{Name: "EXEC", Arity: 1, Flags: FlagTransaction, Feature: "transactions", Handler: cmdExec},
+		&Command{Name: "DISCARD", Arity: 1, Flags: FlagFast | FlagTransaction, Feature: "transactions", Handler: cmdDiscard},
+		&Command{Name: "WATCH", Arity: -2, Flags: FlagFast | FlagTransaction, FirstKey: 1, LastKey: -1, KeyStep: 1, Feature: "transactions", Handler: cmdWatch},
+		&Command{Name: "UNWATCH", Arity: 1, Flags: FlagFast | FlagTransaction, Feature: "transactions", Handler: cmdUnwatch},
+	)
+}
+
+func cmdMulti(ctx *CommandContext) {
+	if ctx.Session.multi {
+		ctx.Reply.WriteError("ERR MULTI calls can not be nested")
+		return
+	}
+	ctx.Session.multi = true
+	ctx.Reply.WriteString("OK")
+}
+
+// EXEC runs the queued commands while holding TxMu exclusively, so no
+// other command observes or interleaves with a partial transaction.
+func cmdExec(ctx *CommandContext) {
+	sess := ctx.Session
+	if !sess.multi {
+		ctx.Reply.WriteError("ERR EXEC without MULTI")
+		return
+	}
+
+	queue, dirty := sess.queue, sess.dirty
+	sess.discard()
+	defer sess.unwatch()
+
+	if dirty {
+		ctx.Reply.WriteError("EXECABORT Transaction discarded because of previous errors.")
+		return
+	}
+
+	ctx.Cache.TxMu.Lock()
+	defer ctx.Cache.TxMu.Unlock()
+
+	if !sess.watchedUnchanged() {
+		ctx.Reply.WriteNull()
+		return
+	}
+
+	sess.inExec = true
+	defer func() { sess.inExec = false }()
+
+	ctx.Reply.WriteArray(len(queue))
+	for _, q := range queue {
+		sess.call(q.cmd, q.args, ctx.Reply)
+	}
+}
+
+func cmdDiscard(ctx *CommandContext) {
+	if !ctx.Session.multi {
+		ctx.Reply.WriteError("ERR DISCARD without MULTI")
+		return
+	}
+	ctx.Session.discard()
+	ctx.Session.unwatch()
+	ctx.Reply.WriteString("OK")
+}
+
+func cmdWatch(ctx *CommandContext) {
+	if ctx.Session.multi {
+		ctx.Reply.WriteError("ERR WATCH inside MULTI is not allowed")
+		return
+	}
+	for _, key := range ctx.Args[1:] {
+		ctx.Session.watch(string(key))
+	}
+	ctx.Reply.WriteString("OK")
+}
+
+func cmdUnwatch(ctx *CommandContext) {
+	ctx.Session.unwatch()
+	ctx.Reply.WriteString("OK")
+}
@@ -0,0 +1,95 @@
+package server
+
+// List, set and hash commands.
+func init() {
+	registerCommands(
+		&Command{Name: "LPUSH", Arity: -3, Flags: FlagWrite | FlagFast, FirstKey: 1, LastKey: 1, KeyStep: 1, Feature: "complex_types", Handler: cmdLPush},
+		&Command{Name: "LPOP", Arity: 2, Flags: FlagWrite | FlagFast, FirstKey: 1, LastKey: 1, KeyStep: 1, Feature: "complex_types", Handler: cmdLPop},
+		&Command{Name: "SADD", Arity: -3, Flags: FlagWrite | FlagFast, FirstKey: 1, LastKey: 1, KeyStep: 1, Feature: "complex_types", Handler: cmdSAdd},
+		&Command{Name: "SREM", Arity: -3, Flags: FlagWrite | FlagFast, FirstKey: 1, LastKey: 1, KeyStep: 1, Feature: "complex_types", Handler: cmdSRem},
+		&Command{Name: "SMEMBERS", Arity: 2, Flags: FlagRead, FirstKey: 1, LastKey: 1, KeyStep: 1, Feature: "complex_types", Handler: cmdSMembers},
+		&Command{Name: "HSET", Arity: -4, Flags: FlagWrite | FlagFast, FirstKey: 1, LastKey: 1, KeyStep: 1, Feature: "complex_types", Handler: cmdHSet},
+		&Command{Name: "HDEL", Arity: -3, Flags: FlagWrite | FlagFast, FirstKey: 1, LastKey: 1, KeyStep: 1, Feature: "complex_types", Handler: cmdHDel},
+		&Command{Name: "HGET", Arity: 3, Flags: FlagRead | FlagFast, FirstKey: 1, LastKey: 1, KeyStep: 1, Feature: "complex_types", Handler: cmdHGet},
+		&Command{Name: "HGETALL", Arity: 2, Flags: FlagRead, FirstKey: 1, LastKey: 1, KeyStep: 1, Feature: "complex_types", Handler: cmdHGetAll},
+	)
+}
+
+// stringArgs copies raw arguments into strings.
+func stringArgs(args [][]byte) []string {
+	out := make([]string, len(args))
+	for i, a := range args {
+		out[i] = string(a)
+	}
+	return out
+}
+
+func cmdLPush(ctx *CommandContext) {
+	n := ctx.Cache.LPush(ctx.Arg(1), stringArgs(ctx.Args[2:])...)
+	ctx.Reply.WriteInt(int64(n))
+}
+
+func cmdLPop(ctx *CommandContext) {
+	if value, ok := ctx.Cache.LPop(ctx.Arg(1)); ok {
+		ctx.Reply.WriteBulkString(value)
+		return
+	}
+	ctx.Reply.WriteNull()
+}
+
+func cmdSAdd(ctx *CommandContext) {
+	n := ctx.Cache.SAdd(ctx.Arg(1), stringArgs(ctx.Args[2:])...)
+	ctx.Reply.WriteInt(int64(n))
+}
+
+func cmdSRem(ctx *CommandContext) {
+	n := ctx.Cache.SRem(ctx.Arg(1), stringArgs(ctx.Args[2:])...)
+	ctx.Reply.WriteInt(int64(n))
+}
+
+func cmdSMembers(ctx *CommandContext) {
+	members := ctx.Cache.SMembers(ctx.Arg(1))
+	ctx.Reply.WriteSet(len(members))
+	for _, m := range members {
+		ctx.Reply.WriteBulkString(m)
+	}
+}
+
+// HSET key field value [field value ...]
+func cmdHSet(ctx *CommandContext) {
+	if len(ctx.Args)%2 != 0 {
+		ctx.Reply.WriteError("ERR wrong number of arguments for 'hset' command")
+		return
+	}
+
+	key := ctx.Arg(1)
+	added := 0
+	for i := 2; i < len(ctx.Args); i += 2 {
+		if ctx.Cache.HSet(key, ctx.Arg(i), ctx.Arg(i+1)) {
+			added++
+		}
+	}
+	ctx.Reply.WriteInt(int64(added))
+}
+
+func cmdHDel(ctx *CommandContext) {
+	n := ctx.Cache.HDel(ctx.Arg(1), stringArgs(ctx.Args[2:])...)
+	ctx.Reply.WriteInt(int64(n))
+}
+
+func cmdHGet(ctx *CommandContext) {
+	if value, ok := ctx.Cache.HGet(ctx.Arg(1), ctx.Arg(2)); ok {
+		ctx.Reply.WriteBulkString(value)
+		return
+	}
+	ctx.Reply.WriteNull()
+}
+
+func cmdHGetAll(ctx *CommandContext) {
+	hash := ctx.Cache.HGetAll(ctx.Arg(1))
+	ctx.Reply.WriteMap(len(hash))
+	for field, value := range hash {
+		ctx.Reply.WriteBulkString(field)
+		ctx.Reply.WriteBulkString(value)
+	}
+}
@@ -0,0 +1,320 @@
+package server
+
+import (
+	"math"
+	"strconv"
+	"strings"
+)
+
+import (
+	cache "boltcache/internal/cache"
+)
+
+// Sorted set commands.
+func init() {
+	registerCommands(
+		&Command{Name: "ZADD", Arity: -4, Flags: FlagWrite | FlagFast, FirstKey: 1, LastKey: 1, KeyStep: 1, Feature: "complex_types", Handler: cmdZAdd},
+		&Command{Name: "ZINCRBY", Arity: 4, Flags: FlagWrite | FlagFast, FirstKey: 1, LastKey: 1, KeyStep: 1, Feature: "complex_types", Handler: cmdZIncrBy},
+		&Command{Name: "ZREM", Arity: -3, Flags: FlagWrite | FlagFast, FirstKey: 1, LastKey: 1, KeyStep: 1, Feature: "complex_types", Handler: cmdZRem},
+		&Command{Name: "ZSCORE", Arity: 3, Flags: FlagRead | FlagFast, FirstKey: 1, LastKey: 1, KeyStep: 1, Feature: "complex_types", Handler: cmdZScore},
+		&Command{Name: "ZCARD", Arity: 2, Flags: FlagRead | FlagFast, FirstKey: 1, LastKey: 1, KeyStep: 1, Feature: "complex_types", Handler: cmdZCard},
+		&Command{Name: "ZRANK", Arity: -3, Flags: FlagRead | FlagFast, FirstKey: 1, LastKey: 1, KeyStep: 1, Feature: "complex_types", Handler: cmdZRank},
+		&Command{Name: "ZREVRANK", Arity: -3, Flags: FlagRead | FlagFast, FirstKey: 1, LastKey: 1, KeyStep: 1, Feature: "complex_types", Handler: cmdZRank},
+		&Command{Name: "ZRANGE", Arity: -4, Flags: FlagRead, FirstKey: 1, LastKey: 1, KeyStep: 1, Feature: "complex_types", Handler: cmdZRange},
+		&Command{Name: "ZREVRANGE", Arity: -4, Flags: FlagRead, FirstKey: 1, LastKey: 1, KeyStep: 1, Feature: "complex_types", Handler: cmdZRange},
+		&Command{Name: "ZRANGEBYSCORE", Arity: -4, Flags: FlagRead, FirstKey: 1, LastKey: 1, KeyStep: 1, Feature: "complex_types", Handler: cmdZRange},
+		&Command{Name: "ZREVRANGEBYSCORE", Arity: -4, Flags: FlagRead, FirstKey: 1, LastKey: 1, KeyStep: 1, Feature: "complex_types", Handler: cmdZRange},
+	)
+}
+
+const errNotFloat = "ERR value is not a valid float"
+
+// parseScore parses a score, accepting inf, +inf and -inf.
+func parseScore(s string) (float64, bool) {
+	switch strings.ToLower(s) {
+	case "inf", "+inf":
+		return math.Inf(1), true
+	case "-inf":
+		return math.Inf(-1), true
+	}
+	f, err := strconv.ParseFloat(s, 64)
+	if err != nil || math.IsNaN(f) {
+		return 0, false
+	}
+	return f, true
+}
+
+// parseScoreBound parses a range end; a "(" prefix makes it exclusive.
+func parseScoreBound(s string) (cache.ScoreBound, bool) {
+	var b cache.ScoreBound
+	if strings.HasPrefix(s, "(") {
+		b.Exclusive = true
+		s = s[1:]
+	}
+	v, ok := parseScore(s)
+	b.Value = v
+	return b, ok
+}
+
+// writeZMembers answers with members, interleaved with their scores when
+// withScores is set. RESP3 clients get [member, score] pairs.
+func writeZMembers(ctx *CommandContext, members []cache.ZMember, withScores bool) {
+	if !withScores {
+		ctx.Reply.WriteArray(len(members))
+		for _, m := range members {
+			ctx.Reply.WriteBulkString(m.Member)
+		}
+		return
+	}
+
+	if ctx.Session.Proto() == protoRESP3 {
+		ctx.Reply.WriteArray(len(members))
+		for _, m := range members {
+			ctx.Reply.WriteArray(2)
+			ctx.Reply.WriteBulkString(m.Member)
+			ctx.Reply.WriteDouble(m.Score)
+		}
+		return
+	}
+
+	ctx.Reply.WriteArray(len(members) * 2)
+	for _, m := range members {
+		ctx.Reply.WriteBulkString(m.Member)
+		ctx.Reply.WriteDouble(m.Score)
+	}
+}
+
+// ZADD key [NX|XX] [GT|LT] [CH] [INCR] score member [score member ...]
+func cmdZAdd(ctx *CommandContext) {
+	var opts cache.ZAddOptions
+	incr := false
+
+	i := 2
+options:
+	for ; i < len(ctx.Args); i++ {
+		switch strings.ToUpper(ctx.Arg(i)) {
+		case "NX":
+			opts.NX = true
+		case "XX":
+			opts.XX = true
+		case "GT":
+			opts.GT = true
+		case "LT":
+			opts.LT = true
+		case "CH":
+			opts.CH = true
+		case "INCR":
+			incr = true
+		default:
+			break options
+		}
+	}
+
+	pairs := ctx.Args[i:]
+	if len(pairs) == 0 || len(pairs)%2 != 0 {
+		ctx.SyntaxError()
+		return
+	}
+	if opts.NX && opts.XX {
+		ctx.Reply.WriteError("ERR XX and NX options at the same time are not compatible")
+		return
+	}
+	if (opts.GT && opts.LT) || (opts.NX && (opts.GT || opts.LT)) {
+		ctx.Reply.WriteError("ERR GT, LT, and/or NX options at the same time are not compatible")
+		return
+	}
+	if incr && len(pairs) != 2 {
+		ctx.Reply.WriteError("ERR INCR option supports a single increment-element pair")
+		return
+	}
+
+	members := make([]cache.ZMember, 0, len(pairs)/2)
+	for j := 0; j < len(pairs); j += 2 {
+		score, ok := parseScore(string(pairs[j]))
+		if !ok {
+			ctx.Reply.WriteError(errNotFloat)
+			return
+		}
+		members = append(members, cache.ZMember{Member: string(pairs[j+1]), Score: score})
+	}
+
+	if incr {
+		score, ok, err := ctx.Cache.ZAddIncr(ctx.Arg(1), opts, members[0].Member, members[0].Score)
+		switch {
+		case err != nil:
+			ctx.Reply.WriteError(err.Error())
+		case !ok:
+			ctx.Reply.WriteNull()
+		default:
+			ctx.Reply.WriteDouble(score)
+		}
+		return
+	}
+
+	n, err := ctx.Cache.ZAdd(ctx.Arg(1), opts, members...)
+	if err != nil {
+		ctx.Reply.WriteError(err.Error())
+		return
+	}
+	ctx.Reply.WriteInt(int64(n))
+}
+
+// ZINCRBY key increment member
+func cmdZIncrBy(ctx *CommandContext) {
+	incr, ok := parseScore(ctx.Arg(2))
+	if !ok {
+		ctx.Reply.WriteError(errNotFloat)
+		return
+	}
+	score, err := ctx.Cache.ZIncrBy(ctx.Arg(1), ctx.Arg(3), incr)
+	if err != nil {
+		ctx.Reply.WriteError(err.Error())
+		return
+	}
+	ctx.Reply.WriteDouble(score)
+}
+
+func cmdZRem(ctx *CommandContext) {
+	n, err := ctx.Cache.ZRem(ctx.Arg(1), stringArgs(ctx.Args[2:])...)
+	if err != nil {
+		ctx.Reply.WriteError(err.Error())
+		return
+	}
+	ctx.Reply.WriteInt(int64(n))
+}
+
+func cmdZScore(ctx *CommandContext) {
+	score, ok, err := ctx.Cache.ZScore(ctx.Arg(1), ctx.Arg(2))
+	switch {
+	case err != nil:
+		ctx.Reply.WriteError(err.Error())
+	case !ok:
+		ctx.Reply.WriteNull()
+	default:
+		ctx.Reply.WriteDouble(score)
+	}
+}
+
+func cmdZCard(ctx *CommandContext) {
+	n, err := ctx.Cache.ZCard(ctx.Arg(1))
+	if err != nil {
+		ctx.Reply.WriteError(err.Error())
+		return
+	}
+	ctx.Reply.WriteInt(int64(n))
+}
+
+// ZRANK key member [WITHSCORE], and ZREVRANK.
+func cmdZRank(ctx *CommandContext) {
+	withScore := false
+	switch {
+	case len(ctx.Args) == 4 && strings.EqualFold(ctx.Arg(3), "WITHSCORE"):
+		withScore = true
+	case len(ctx.Args) != 3:
+		ctx.SyntaxError()
+		return
+	}
+
+	key, member := ctx.Arg(1), ctx.Arg(2)
+	rank, ok, err := ctx.Cache.ZRank(key, member, ctx.Command.Name == "ZREVRANK")
+	if err != nil {
+		ctx.Reply.WriteError(err.Error())
+		return
+	}
+	if !ok {
+		ctx.Reply.WriteNull()
+		return
+	}
+	if !withScore {
+		ctx.Reply.WriteInt(int64(rank))
+		return
+	}
+	score, _, _ := ctx.Cache.ZScore(key, member)
+	ctx.Reply.WriteArray(2)
+	ctx.Reply.WriteInt(int64(rank))
+	ctx.Reply.WriteDouble(score)
+}
+
+// ZRANGE key start stop [BYSCORE] [REV] [LIMIT offset count] [WITHSCORES]
+// and the older ZREVRANGE, ZRANGEBYSCORE and ZREVRANGEBYSCORE forms.
+func cmdZRange(ctx *CommandContext) {
+	byScore, reverse, withScores, limit := false, false, false, false
+	offset, count := 0, -1
+
+	switch ctx.Command.Name {
+	case "ZREVRANGE":
+		reverse = true
+	case "ZRANGEBYSCORE":
+		byScore = true
+	case "ZREVRANGEBYSCORE":
+		byScore, reverse = true, true
+	}
+
+	for i := 4; i < len(ctx.Args); i++ {
+		opt := strings.ToUpper(ctx.Arg(i))
+		switch {
+		case opt == "WITHSCORES":
+			withScores = true
+		case opt == "BYSCORE" && ctx.Command.Name == "ZRANGE":
+			byScore = true
+		case opt == "REV" && ctx.Command.Name == "ZRANGE":
+			reverse = true
+		case opt == "BYLEX" && ctx.Command.Name == "ZRANGE":
+			ctx.Reply.WriteError("ERR BYLEX is not supported")
+			return
+		case opt == "LIMIT" && i+2 < len(ctx.Args):
+			var err1, err2 error
+			offset, err1 = strconv.Atoi(ctx.Arg(i + 1))
+			count, err2 = strconv.Atoi(ctx.Arg(i + 2))
+			if err1 != nil || err2 != nil {
+				ctx.Reply.WriteError("ERR value is not an integer or out of range")
+				return
+			}
+			limit = true
+			i += 2
+		default:
+			ctx.SyntaxError()
+			return
+		}
+	}
+
+	key := ctx.Arg(1)
+	if !byScore {
+		if limit {
+			ctx.Reply.WriteError("ERR syntax error, LIMIT is only supported in combination with either BYSCORE or BYLEX")
+			return
+		}
+		start, err1 := strconv.Atoi(ctx.Arg(2))
+		stop, err2 := strconv.Atoi(ctx.Arg(3))
+		if err1 != nil || err2 != nil {
+			ctx.Reply.WriteError("ERR value is not an integer or out of range")
+			return
+		}
+		members, err := ctx.Cache.ZRange(key, start, stop, reverse)
+		if err != nil {
+			ctx.Reply.WriteError(err.Error())
+			return
+		}
+		writeZMembers(ctx, members, withScores)
+		return
+	}
+
+	// Reverse score ranges are written max first.
+	minArg, maxArg := ctx.Arg(2), ctx.Arg(3)
+	if reverse {
+		minArg, maxArg = maxArg, minArg
+	}
+	min, ok1 := parseScoreBound(minArg)
+	max, ok2 := parseScoreBound(maxArg)
+	if !ok1 || !ok2 {
+		ctx.Reply.WriteError("ERR min or max is not a float")
+		return
+	}
+
+	members, err := ctx.Cache.ZRangeByScore(key, min, max, reverse, offset, count)
+	if err != nil {
+		ctx.Reply.WriteError(err.Error())
+		return
+	}
+	writeZMembers(ctx, members, withScores)
+}
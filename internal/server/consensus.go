@@ -0,0 +1,178 @@
+package server
+
+import (
+	"fmt"
+	"io"
+	"path/filepath"
+	"time"
+)
+
+import (
+	config "boltcache/config"
+	cache "boltcache/internal/cache"
+	raft "boltcache/internal/raft"
+)
+
+// consensusTimeout bounds how long a command on consistent keys waits for
+// the Raft group.
+const consensusTimeout = 5 * time.Second
+
+// startConsensus replicates the keys under the configured prefixes through
+// the Raft group of the configured peers, if any. Each entry of the log is
+// a command, applied on every member through the command table; the reply
+// it gets on the node it was sent to is the client's. It runs before
+// replication starts, which leaves these keys to Raft.
+func startConsensus(c *cache.BoltCache, cfg config.ConsensusConfig, id, addr string) error {
+	if len(cfg.Prefixes) == 0 {
+		return nil
+	}
+	cons := &cache.Consensus{Prefixes: cfg.Prefixes}
+	sm := &stateMachine{cache: c, sess: newSession(c, protoText, nil), covers: cons.Covers}
+	node, err := raft.New(raft.Config{
+		ID:              addr,
+		Peers:           cfg.Peers,
+		Dir:             filepath.Join(cfg.Directory, id),
+		ElectionTimeout: cfg.ElectionTimeout,
+		SnapshotEntries: uint64(cfg.SnapshotEntries),
+	}, sm, raft.NewTCPTransport())
+	if err != nil {
+		return err
+	}
+	cons.Node = node
+	c.Consensus = cons
+	node.Start()
+	return nil
+}
+
+// stateMachine applies the Raft log to the consistent keys of the cache.
+// Snapshots reuse the snapshot format of persistence.
+type stateMachine struct {
+	cache  *cache.BoltCache
+	sess   *Session
+	covers func(key string) bool
+}
+
+func (m *stateMachine) Apply(data []byte) interface{} {
+	reply := &recordedReply{}
+	args, err := splitArgs(data)
+	var cmd *Command
+	if err == nil && len(args) > 0 {
+		cmd = lookupCommand(args[0])
+	}
+	if cmd == nil || !cmd.arityOK(len(args)) {
+		reply.WriteError(fmt.Sprintf("ERR invalid Raft entry %q", data))
+		return reply
+	}
+	m.cache.TxMu.RLock()
+	m.sess.call(cmd, args, reply)
+	m.cache.TxMu.RUnlock()
+	return reply
+}
+
+func (m *stateMachine) Snapshot(w io.Writer) error {
+	return m.cache.WriteSnapshotKeys(w, m.covers)
+}
+
+func (m *stateMachine) Restore(r io.Reader) error {
+	_, err := m.cache.ReplaceKeys(r, m.covers)
+	return err
+}
+
+// consistent reports whether the keys of args are under consensus. It
+// returns an error when only some of them are, or when cmd can't go
+// through the Raft log.
+func (s *Session) consistent(cmd *Command, args [][]byte) (bool, string) {
+	cons := s.cache.Consensus
+	if cons == nil {
+		return false, ""
+	}
+	keys := routingKeys(cmd, args)
+	covered := 0
+	for _, key := range keys {
+		if cons.Covers(string(key)) {
+			covered++
+		}
+	}
+	switch {
+	case covered == 0:
+		return false, ""
+	case covered < len(keys):
+		return false, "CROSSSLOT Keys in request mix consistent and regular keys"
+	case cmd.Flags&FlagBlocking != 0:
+		return false, fmt.Sprintf("ERR '%s' can't be used on consistent keys", cmd.Name)
+	}
+	return true, ""
+}
+
+// executeConsistent runs a command on consistent keys. A write goes
+// through the Raft log and is answered with the reply it got when this
+// node applied it; a read runs once this node caught up with the leader's
+// commit index.
+func (s *Session) executeConsistent(cmd *Command, args [][]byte, reply Reply) {
+	cons := s.cache.Consensus
+	if cmd.Flags&FlagWrite != 0 {
+		result, err := cons.Propose(encodeArgs(args), consensusTimeout)
+		if err != nil {
+			reply.WriteError(err.Error())
+			return
+		}
+		result.(*recordedReply).replay(reply)
+		return
+	}
+	if err := cons.ReadIndex(consensusTimeout); err != nil {
+		reply.WriteError(err.Error())
+		return
+	}
+	s.cache.TxMu.RLock()
+	s.call(cmd, args, reply)
+	s.cache.TxMu.RUnlock()
+}
+
+// encodeArgs encodes a command as a text protocol line.
+func encodeArgs(args [][]byte) []byte {
+	var line []byte
+	for i, a := range args {
+		if i > 0 {
+			line = append(line, ' ')
+		}
+		line = append(line, quoteArg(a)...)
+	}
+	return line
+}
+
+// recordedReply keeps a reply to write it out later, in the protocol of
+// the client waiting for it. Attributes are dropped.
+type recordedReply struct {
+	writes []func(Reply)
+}
+
+func (r *recordedReply) add(w func(Reply)) {
+	r.writes = append(r.writes, w)
+}
+
+func (r *recordedReply) replay(to Reply) {
+	for _, w := range r.writes {
+		w(to)
+	}
+}
+
+func (r *recordedReply) WriteString(s string)  { r.add(func(to Reply) { to.WriteString(s) }) }
+func (r *recordedReply) WriteError(msg string) { r.add(func(to Reply) { to.WriteError(msg) }) }
+func (r *recordedReply) WriteInt(n int64)      { r.add(func(to Reply) { to.WriteInt(n) }) }
+func (r *recordedReply) WriteBulk(b []byte) {
+	b = append([]byte(nil), b...)
+	r.add(func(to Reply) { to.WriteBulk(b) })
+}
+func (r *recordedReply) WriteBulkString(s string) { r.add(func(to Reply) { to.WriteBulkString(s) }) }
+func (r *recordedReply) WriteNull()               { r.add(func(to Reply) { to.WriteNull() }) }
+func (r *recordedReply) WriteArray(n int)         { r.add(func(to Reply) { to.WriteArray(n) }) }
+func (r *recordedReply) WriteMap(n int)           { r.add(func(to Reply) { to.WriteMap(n) }) }
+func (r *recordedReply) WriteSet(n int)           { r.add(func(to Reply) { to.WriteSet(n) }) }
+func (r *recordedReply) WriteDouble(f float64)    { r.add(func(to Reply) { to.WriteDouble(f) }) }
+func (r *recordedReply) WritePush(n int)          { r.add(func(to Reply) { to.WritePush(n) }) }
+func (r *recordedReply) WriteAttribute(n int) bool {
+	return false
+}
+func (r *recordedReply) WriteVerbatim(format, s string) {
+	r.add(func(to Reply) { to.WriteVerbatim(format, s) })
+}
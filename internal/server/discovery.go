@@ -0,0 +1,71 @@
+package server
+
+import (
+	"sort"
+	"strings"
+)
+
+import (
+	config "boltcache/config"
+	cache "boltcache/internal/cache"
+	cluster "boltcache/internal/cluster"
+	discovery "boltcache/internal/discovery"
+	logger "boltcache/logger"
+)
+
+// startDiscovery keeps looking up the nodes of cfg, registering this node
+// id at addr with Consul or etcd. Nodes found that aren't members yet are
+// met. On a master, the replicas found that follow it are added to those
+// sync replication waits for, next to the configured ones.
+func startDiscovery(c *cache.BoltCache, cfg config.DiscoveryConfig, id, addr string) (*discovery.Watcher, error) {
+	d, err := discovery.New(cfg)
+	if err != nil {
+		return nil, err
+	}
+	configured := c.GetReplicas()
+	return discovery.Watch(d, id, addr, cfg.Interval, func(peers []string) {
+		found := make(map[string]bool, len(peers))
+		for _, p := range peers {
+			found[p] = true
+		}
+		nodes := c.Cluster.Nodes()
+		for _, n := range nodes {
+			delete(found, n.Addr)
+		}
+		for p := range found {
+			go func(p string) {
+				if err := c.Cluster.Meet(p); err != nil {
+					logger.Log("Failed to join discovered node %s: %v", p, err)
+				}
+			}(p)
+		}
+
+		if c.ReplicationEnabled() && !c.IsReplica() {
+			updateReplicas(c, configured, peers, nodes)
+		}
+	}), nil
+}
+
+// updateReplicas sets the replicas of c to the configured ones and the
+// healthy members among peers replicating c.
+func updateReplicas(c *cache.BoltCache, configured, peers []string, nodes []cluster.Node) {
+	discovered := make(map[string]bool, len(peers))
+	for _, p := range peers {
+		discovered[p] = true
+	}
+	replicas := append([]string(nil), configured...)
+	for _, r := range configured {
+		delete(discovered, r)
+	}
+	self := c.Cluster.Myself().Addr
+	for _, n := range nodes {
+		if n.Role == cluster.RoleReplica && n.Master == self && !n.Failed && discovered[n.Addr] {
+			replicas = append(replicas, n.Addr)
+		}
+	}
+	sort.Strings(replicas[len(configured):])
+	if old := c.GetReplicas(); strings.Join(old, " ") != strings.Join(replicas, " ") {
+		c.SetReplicas(replicas)
+		logger.Log("Replicas are now %v", replicas)
+	}
+}
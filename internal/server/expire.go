@@ -0,0 +1,84 @@
+package server
+
+import (
+	"fmt"
+	"math"
+	"strconv"
+	"strings"
+	"time"
+)
+
+import (
+	cache "boltcache/internal/cache"
+)
+
+// runExpire implements EXPIRE, PEXPIRE, EXPIREAT and PEXPIREAT.
+// It returns 1 when the timeout was set and 0 when the key does not exist.
+func runExpire(c *cache.BoltCache, command, key, arg string) (int, error) {
+	n, err := strconv.ParseInt(arg, 10, 64)
+	if err != nil {
+		return 0, fmt.Errorf("ERR value is not an integer or out of range")
+	}
+
+	var unit time.Duration
+	relative := false
+	switch strings.ToUpper(command) {
+	case "EXPIRE":
+		unit, relative = time.Second, true
+	case "PEXPIRE":
+		unit, relative = time.Millisecond, true
+	case "EXPIREAT":
+		unit = time.Second
+	case "PEXPIREAT":
+		unit = time.Millisecond
+	default:
+		return 0, fmt.Errorf("ERR unknown command '%s'", command)
+	}
+	if !expireInRange(n, unit, relative) {
+		return 0, fmt.Errorf("ERR invalid expire time in '%s' command", strings.ToLower(command))
+	}
+
+	var ok bool
+	if relative {
+		ok = c.Expire(key, time.Duration(n)*unit)
+	} else {
+		ok = c.ExpireAt(key, time.Unix(0, n*int64(unit)))
+	}
+	if ok {
+		return 1, nil
+	}
+	return 0, nil
+}
+
+// expireInRange reports whether n units from now, or from the Unix epoch
+// when not relative, is a time the expiry index can hold in nanoseconds.
+func expireInRange(n int64, unit time.Duration, relative bool) bool {
+	limit := math.MaxInt64 / int64(unit)
+	if n > limit || n < -limit {
+		return false
+	}
+	return !relative || time.Duration(n)*unit <= time.Duration(math.MaxInt64-time.Now().UnixNano())
+}
+
+// runTTL implements TTL and PTTL with the Redis return codes:
+// -2 when the key does not exist, -1 when it has no expire.
+func runTTL(c *cache.BoltCache, command, key string) int64 {
+	ttl := c.TTL(key)
+	if ttl < 0 {
+		return int64(ttl)
+	}
+
+	if strings.EqualFold(command, "PTTL") {
+		return (ttl + time.Millisecond - 1).Milliseconds()
+	}
+	// Round up like Redis so a key set with EXPIRE 10 reports 10, not 9.
+	return int64((ttl + time.Second - 1) / time.Second)
+}
+
+// runPersist implements PERSIST.
+func runPersist(c *cache.BoltCache, key string) int {
+	if c.Persist(key) {
+		return 1
+	}
+	return 0
+}
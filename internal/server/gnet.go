@@ -20,90 +20,154 @@ type gnetServer struct {
 	cache *cache.BoltCache
 }
 
-var (
-	respOK      = []byte("OK\n")
-	respNIL     = []byte("NIL\n")
-	valuePrefix = []byte("VALUE ")
-	newLine     = []byte("\n")
-)
-
-var batchPool = sync.Pool{
+var textReplyPool = sync.Pool{
 	New: func() interface{} {
-		b := make([]byte, 0, 65536)
-		return &b
+		return &textReply{buf: make([]byte, 0, 65536)}
 	},
 }
 
-
 //go:nosplit
 func b2s(b []byte) string {
 	return unsafe.String(unsafe.SliceData(b), len(b))
 }
 
+// gnetSubscriber delivers pub/sub messages through the event loop.
+type gnetSubscriber struct {
+	conn gnet.Conn
+	sess *Session
+}
+
+func (s *gnetSubscriber) Deliver(channel, message string) error {
+	var msg []byte
+	if proto := s.sess.Proto(); proto == protoText {
+		msg = []byte(fmt.Sprintf("MESSAGE %s %s\n", channel, message))
+	} else {
+		msg = respMessage(proto, channel, message)
+	}
+	return s.conn.AsyncWrite(msg, nil)
+}
+
+// newGnetSession creates the session of a gnet connection.
+func newGnetSession(c gnet.Conn, cache *cache.BoltCache, proto int) *Session {
+	sess := newSession(cache, proto, nil)
+	sess.subscriber = &gnetSubscriber{conn: c, sess: sess}
+	return sess
+}
+
+// runsBlocking reports whether args must go through runBlocking. Inside
+// MULTI the command is only queued, so it can run inline. Writes wait for
+// replicas when replication is synchronous, commands on consistent keys
+// for the Raft group, and exclusive commands for the commands running.
+func runsBlocking(sess *Session, args [][]byte) bool {
+	cmd := lookupCommand(args[0])
+	if cmd == nil || !cmd.arityOK(len(args)) {
+		return false
+	}
+	if consistent, _ := sess.consistent(cmd, args); consistent && !sess.multi {
+		return true
+	}
+	if sess.cache.SyncReplication() && (cmd.Flags&FlagWrite != 0 && !sess.multi || cmd.Name == "EXEC") {
+		return true
+	}
+	return cmd.Flags&(FlagBlocking|FlagExclusive) != 0 && !sess.multi
+}
+
+// runBlocking executes a blocking command off the event loop. Input that
+// arrives meanwhile stays buffered until the reply is written and the
+// connection is woken up again.
+func runBlocking(c gnet.Conn, sess *Session, exec func() []byte) {
+	sess.blocked.Store(true)
+	go func() {
+		out := exec()
+		c.AsyncWrite(out, func(c gnet.Conn, err error) error {
+			sess.blocked.Store(false)
+			if err != nil {
+				return nil
+			}
+			return c.Wake(nil)
+		})
+	}()
+}
+
+func (gs *gnetServer) OnOpen(c gnet.Conn) ([]byte, gnet.Action) {
+	c.SetContext(newGnetSession(c, gs.cache, protoText))
+	return nil, gnet.None
+}
+
+func (gs *gnetServer) OnClose(c gnet.Conn, err error) gnet.Action {
+	if sess, ok := c.Context().(*Session); ok {
+		sess.Close()
+	}
+	return gnet.None
+}
+
 func (gs *gnetServer) OnTraffic(c gnet.Conn) gnet.Action {
-	data, _ := c.Next(-1)
-	if len(data) == 0 {
+	sess := c.Context().(*Session)
+	if sess.blocked.Load() {
 		return gnet.None
 	}
 
-	batchPtr := batchPool.Get().(*[]byte)
-	batch := *batchPtr
-	batch = batch[:0]
+	data, _ := c.Peek(-1)
+	if len(data) == 0 {
+		return gnet.None
+	}
 
-	for len(data) > 0 {
-		idx := bytes.IndexByte(data, '\n')
+	reply := textReplyPool.Get().(*textReply)
+	reply.buf = reply.buf[:0]
+
+	// Only complete lines are consumed; a partial line stays buffered
+	// until the rest of it arrives.
+	consumed := 0
+	tooBig := false
+	for {
+		idx := bytes.IndexByte(data[consumed:], '\n')
+		if idx > maxInlineSize || idx == -1 && len(data)-consumed > maxInlineSize {
+			tooBig = true
+			break
+		}
 		if idx == -1 {
 			break
 		}
-		line := data[:idx]
-		data = data[idx+1:]
+		line := data[consumed : consumed+idx]
+		consumed += idx + 1
 
 		if len(line) > 0 && line[len(line)-1] == '\r' {
 			line = line[:len(line)-1]
 		}
 
-		if len(line) < 4 {
-			continue
-		}
-
-		cmd := line[0] | 0x20
-		if cmd == 's' { // SET
-			rest := line[4:]
-			sp := bytes.IndexByte(rest, ' ')
-			if sp == -1 {
-				continue
-			}
-			key := string(rest[:sp])
-			val := make([]byte, len(rest[sp+1:]))
-			copy(val, rest[sp+1:])
-
-			gs.cache.Set(key, val, 0)
-			batch = append(batch, respOK...)
-		} else if cmd == 'g' { // GET
-			key := b2s(line[4:])
-			val, ok := gs.cache.Get(key)
-			if ok {
-				batch = append(batch, valuePrefix...)
-				switch v := val.(type) {
-				case []byte:
-					batch = append(batch, v...)
-				case string:
-					batch = append(batch, v...)
-				default:
-					batch = append(batch, []byte(fmt.Sprintf("%v", v))...)
-				}
-				batch = append(batch, newLine...)
-			} else {
-				batch = append(batch, respNIL...)
+		args, err := splitArgs(line)
+		if err != nil {
+			reply.WriteError(err.Error())
+		} else if len(args) > 0 {
+			if runsBlocking(sess, args) {
+				args = copyArgs(args)
+				runBlocking(c, sess, func() []byte {
+					r := &textReply{}
+					sess.Execute(args, r)
+					return r.buf
+				})
+				break
 			}
+			sess.Execute(args, reply)
 		}
 	}
+	if consumed > 0 {
+		// Discard(0) would drop the whole buffer.
+		c.Discard(consumed)
+	}
 
-	if len(batch) > 0 {
-		c.Write(batch)
+	if tooBig {
+		// Same limit and reply as the text port; the stream can't be
+		// resynchronized past an oversized line.
+		reply.WriteError(errInlineTooBig.Error())
+	}
+	if len(reply.buf) > 0 {
+		c.Write(reply.buf)
+	}
+	textReplyPool.Put(reply)
+	if tooBig {
+		return gnet.Close
 	}
-	*batchPtr = batch
-	batchPool.Put(batchPtr)
 	return gnet.None
 }
 
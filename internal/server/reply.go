@@ -0,0 +1,383 @@
+package server
+
+import (
+	"fmt"
+	"math"
+	"strconv"
+	"strings"
+)
+
+// Reply is how command handlers answer, independent of the wire protocol.
+// Each front-end supplies an encoder for its protocol.
+type Reply interface {
+	WriteString(s string) // status reply, e.g. OK
+	WriteError(msg string)
+	WriteInt(n int64)
+	WriteBulk(b []byte)
+	WriteBulkString(s string)
+	WriteNull()
+	WriteArray(n int) // followed by n element writes
+
+	// Types added by RESP3. Older protocols encode them with the closest
+	// RESP2 equivalent: maps and sets become flat arrays, doubles and
+	// verbatim strings become bulk strings and pushes become arrays.
+	WriteMap(n int) // followed by n key/value pairs
+	WriteSet(n int)
+	WriteDouble(f float64)
+	WriteVerbatim(format, s string) // format is a 3 letter type, e.g. txt
+	WritePush(n int)
+
+	// WriteAttribute starts an attribute map of n key/value pairs that
+	// annotates the reply that follows. Protocols without attributes
+	// return false and the caller must skip the pairs.
+	WriteAttribute(n int) bool
+}
+
+// respReply encodes replies as RESP2, or RESP3 once the connection has
+// negotiated it with HELLO, into an in-memory buffer that the front-end
+// flushes to the connection.
+type respReply struct {
+	buf   []byte
+	resp3 bool
+}
+
+func (r *respReply) writeHeader(prefix byte, n int) {
+	r.buf = append(r.buf, prefix)
+	r.buf = strconv.AppendInt(r.buf, int64(n), 10)
+	r.buf = append(r.buf, '\r', '\n')
+}
+
+func (r *respReply) WriteString(s string) {
+	r.buf = append(r.buf, '+')
+	r.buf = append(r.buf, s...)
+	r.buf = append(r.buf, '\r', '\n')
+}
+
+func (r *respReply) WriteError(msg string) {
+	r.buf = append(r.buf, '-')
+	r.buf = append(r.buf, msg...)
+	r.buf = append(r.buf, '\r', '\n')
+}
+
+func (r *respReply) WriteInt(n int64) {
+	r.buf = append(r.buf, ':')
+	r.buf = strconv.AppendInt(r.buf, n, 10)
+	r.buf = append(r.buf, '\r', '\n')
+}
+
+func (r *respReply) WriteBulk(b []byte) {
+	r.buf = append(r.buf, '$')
+	r.buf = strconv.AppendInt(r.buf, int64(len(b)), 10)
+	r.buf = append(r.buf, '\r', '\n')
+	r.buf = append(r.buf, b...)
+	r.buf = append(r.buf, '\r', '\n')
+}
+
+func (r *respReply) WriteBulkString(s string) {
+	r.buf = append(r.buf, '$')
+	r.buf = strconv.AppendInt(r.buf, int64(len(s)), 10)
+	r.buf = append(r.buf, '\r', '\n')
+	r.buf = append(r.buf, s...)
+	r.buf = append(r.buf, '\r', '\n')
+}
+
+func (r *respReply) WriteNull() {
+	if r.resp3 {
+		r.buf = append(r.buf, "_\r\n"...)
+		return
+	}
+	r.buf = append(r.buf, "$-1\r\n"...)
+}
+
+func (r *respReply) WriteArray(n int) {
+	r.writeHeader('*', n)
+}
+
+func (r *respReply) WriteMap(n int) {
+	if r.resp3 {
+		r.writeHeader('%', n)
+		return
+	}
+	r.writeHeader('*', n*2)
+}
+
+func (r *respReply) WriteSet(n int) {
+	if r.resp3 {
+		r.writeHeader('~', n)
+		return
+	}
+	r.writeHeader('*', n)
+}
+
+func (r *respReply) WriteDouble(f float64) {
+	if !r.resp3 {
+		r.WriteBulk(appendDouble(nil, f))
+		return
+	}
+	r.buf = append(r.buf, ',')
+	r.buf = appendDouble(r.buf, f)
+	r.buf = append(r.buf, '\r', '\n')
+}
+
+func (r *respReply) WriteVerbatim(format, s string) {
+	if !r.resp3 {
+		r.WriteBulkString(s)
+		return
+	}
+	r.writeHeader('=', len(format)+1+len(s))
+	r.buf = append(r.buf, format...)
+	r.buf = append(r.buf, ':')
+	r.buf = append(r.buf, s...)
+	r.buf = append(r.buf, '\r', '\n')
+}
+
+func (r *respReply) WritePush(n int) {
+	if r.resp3 {
+		r.writeHeader('>', n)
+		return
+	}
+	r.writeHeader('*', n)
+}
+
+func (r *respReply) WriteAttribute(n int) bool {
+	if !r.resp3 {
+		return false
+	}
+	r.writeHeader('|', n)
+	return true
+}
+
+// appendDouble formats f the way Redis does: the shortest representation
+// that round-trips, and inf, -inf or nan for special values.
+func appendDouble(buf []byte, f float64) []byte {
+	switch {
+	case math.IsInf(f, 1):
+		return append(buf, "inf"...)
+	case math.IsInf(f, -1):
+		return append(buf, "-inf"...)
+	case math.IsNaN(f):
+		return append(buf, "nan"...)
+	}
+	return strconv.AppendFloat(buf, f, 'g', -1, 64)
+}
+
+// textReply encodes replies in the line-based text protocol:
+//
+//	OK / PONG        status replies
+//	VALUE <v>        bulk replies
+//	NIL              null replies
+//	INTEGER <n>      integer replies
+//	ARRAY <a> <b>    arrays, nested arrays are flattened onto the same line
+//	ERROR: <msg>     errors
+type textReply struct {
+	buf     []byte
+	pending []int // remaining elements of the open arrays, innermost last
+}
+
+func (r *textReply) inArray() bool {
+	return len(r.pending) > 0
+}
+
+// done is called after every complete value; it closes finished arrays
+// and terminates the line once the top-level reply is complete.
+func (r *textReply) done() {
+	for len(r.pending) > 0 {
+		top := len(r.pending) - 1
+		r.pending[top]--
+		if r.pending[top] > 0 {
+			return
+		}
+		r.pending = r.pending[:top]
+	}
+	r.buf = append(r.buf, '\n')
+}
+
+func (r *textReply) WriteString(s string) {
+	if r.inArray() {
+		r.buf = append(r.buf, ' ')
+	}
+	r.buf = append(r.buf, s...)
+	r.done()
+}
+
+func (r *textReply) WriteError(msg string) {
+	if r.inArray() {
+		r.buf = append(r.buf, " ERROR:"...)
+	} else {
+		r.buf = append(r.buf, "ERROR: "...)
+	}
+	r.buf = append(r.buf, strings.TrimPrefix(msg, "ERR ")...)
+	r.done()
+}
+
+func (r *textReply) WriteInt(n int64) {
+	if r.inArray() {
+		r.buf = append(r.buf, ' ')
+	} else {
+		r.buf = append(r.buf, "INTEGER "...)
+	}
+	r.buf = strconv.AppendInt(r.buf, n, 10)
+	r.done()
+}
+
+func (r *textReply) WriteBulk(b []byte) {
+	r.WriteBulkString(b2s(b))
+}
+
+func (r *textReply) WriteBulkString(s string) {
+	if r.inArray() {
+		r.buf = append(r.buf, ' ')
+	} else {
+		r.buf = append(r.buf, "VALUE "...)
+	}
+	r.buf = appendSingleLine(r.buf, s)
+	r.done()
+}
+
+func (r *textReply) WriteNull() {
+	if r.inArray() {
+		r.buf = append(r.buf, ' ')
+	}
+	r.buf = append(r.buf, "NIL"...)
+	r.done()
+}
+
+func (r *textReply) WriteArray(n int) {
+	if !r.inArray() {
+		r.buf = append(r.buf, "ARRAY"...)
+	}
+	if n <= 0 {
+		r.done()
+		return
+	}
+	r.pending = append(r.pending, n)
+}
+
+func (r *textReply) WriteMap(n int) {
+	r.WriteArray(n * 2)
+}
+
+func (r *textReply) WriteSet(n int) {
+	r.WriteArray(n)
+}
+
+func (r *textReply) WriteDouble(f float64) {
+	r.WriteBulk(appendDouble(nil, f))
+}
+
+func (r *textReply) WriteVerbatim(format, s string) {
+	r.WriteBulkString(s)
+}
+
+func (r *textReply) WritePush(n int) {
+	r.WriteArray(n)
+}
+
+func (r *textReply) WriteAttribute(n int) bool {
+	return false
+}
+
+// appendSingleLine keeps multi-line values (INFO) on one line, since text
+// clients read exactly one line per reply. Section headers are dropped.
+func appendSingleLine(buf []byte, s string) []byte {
+	if !strings.ContainsAny(s, "\r\n") {
+		return append(buf, s...)
+	}
+
+	first := true
+	for _, line := range strings.Split(s, "\n") {
+		line = strings.TrimRight(line, "\r")
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		if !first {
+			buf = append(buf, ' ')
+		}
+		buf = append(buf, line...)
+		first = false
+	}
+	return buf
+}
+
+// jsonReply collects replies as values for encoding/json, for the REST
+// API. Maps become objects and errors become {"error": msg}.
+type jsonReply struct {
+	values []interface{}
+	open   []*jsonAggregate
+}
+
+type jsonAggregate struct {
+	items []interface{}
+	left  int
+	isMap bool
+}
+
+func (a *jsonAggregate) value() interface{} {
+	if !a.isMap {
+		return a.items
+	}
+	m := make(map[string]interface{}, len(a.items)/2)
+	for i := 0; i+1 < len(a.items); i += 2 {
+		m[fmt.Sprint(a.items[i])] = a.items[i+1]
+	}
+	return m
+}
+
+// add appends a complete value to the innermost open aggregate, closing
+// every aggregate it completes.
+func (r *jsonReply) add(v interface{}) {
+	for len(r.open) > 0 {
+		top := r.open[len(r.open)-1]
+		top.items = append(top.items, v)
+		top.left--
+		if top.left > 0 {
+			return
+		}
+		r.open = r.open[:len(r.open)-1]
+		v = top.value()
+	}
+	r.values = append(r.values, v)
+}
+
+func (r *jsonReply) openAggregate(n int, isMap bool) {
+	a := &jsonAggregate{items: []interface{}{}, left: n, isMap: isMap}
+	if isMap {
+		a.left = n * 2
+	}
+	if a.left <= 0 {
+		r.add(a.value())
+		return
+	}
+	r.open = append(r.open, a)
+}
+
+func (r *jsonReply) WriteString(s string)      { r.add(s) }
+func (r *jsonReply) WriteError(msg string)     { r.add(map[string]interface{}{"error": msg}) }
+func (r *jsonReply) WriteInt(n int64)          { r.add(n) }
+func (r *jsonReply) WriteBulk(b []byte)        { r.add(string(b)) }
+func (r *jsonReply) WriteBulkString(s string)  { r.add(s) }
+func (r *jsonReply) WriteNull()                { r.add(nil) }
+func (r *jsonReply) WriteArray(n int)          { r.openAggregate(n, false) }
+func (r *jsonReply) WriteMap(n int)            { r.openAggregate(n, true) }
+func (r *jsonReply) WriteSet(n int)            { r.openAggregate(n, false) }
+func (r *jsonReply) WritePush(n int)           { r.openAggregate(n, false) }
+func (r *jsonReply) WriteAttribute(n int) bool { return false }
+
+func (r *jsonReply) WriteVerbatim(format, s string) { r.add(s) }
+
+func (r *jsonReply) WriteDouble(f float64) {
+	if math.IsInf(f, 0) || math.IsNaN(f) {
+		// JSON has no representation for these.
+		r.add(string(appendDouble(nil, f)))
+		return
+	}
+	r.add(f)
+}
+
+// last returns the most recent complete top-level value.
+func (r *jsonReply) last() interface{} {
+	if len(r.values) == 0 {
+		return nil
+	}
+	return r.values[len(r.values)-1]
+}
@@ -0,0 +1,241 @@
+package server
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+	"time"
+)
+
+import (
+	cluster "boltcache/internal/cluster"
+)
+
+// ReshardOptions describe which slots Reshard moves.
+type ReshardOptions struct {
+	From     string        // ID of the master giving slots away
+	To       string        // ID of the master taking them over
+	Slots    int           // number of slots to move
+	Pipeline int           // keys moved per MIGRATE, default 100
+	Timeout  time.Duration // MIGRATE timeout, default 5s
+}
+
+// reshardNode is a master as reported by CLUSTER SHARDS.
+type reshardNode struct {
+	id    string
+	addr  string
+	slots []int
+}
+
+// Reshard moves opts.Slots slots, lowest first, from one master to another
+// through the cluster the node at addr belongs to. Both nodes keep serving
+// the slot while its keys move: the source answers ASK for keys it no
+// longer has and the target accepts them after ASKING. progress is called
+// after every slot with the number of keys moved.
+func Reshard(addr string, opts ReshardOptions, progress func(slot, keys int)) error {
+	if opts.Pipeline <= 0 {
+		opts.Pipeline = 100
+	}
+	if opts.Timeout <= 0 {
+		opts.Timeout = 5 * time.Second
+	}
+	if opts.From == opts.To {
+		return errors.New("source and target are the same node")
+	}
+
+	seed, err := dialText(addr)
+	if err != nil {
+		return err
+	}
+	reply, err := seed.do("CLUSTER", "SHARDS")
+	seed.Close()
+	if err != nil {
+		return err
+	}
+	masters, err := parseShards(reply)
+	if err != nil {
+		return err
+	}
+	from, to := masters[opts.From], masters[opts.To]
+	if from == nil || to == nil {
+		return fmt.Errorf("both %s and %s must be masters of the cluster", opts.From, opts.To)
+	}
+	if opts.Slots <= 0 || opts.Slots > len(from.slots) {
+		return fmt.Errorf("node %s serves %d slots, can't move %d", from.id, len(from.slots), opts.Slots)
+	}
+
+	src, err := dialText(from.addr)
+	if err != nil {
+		return err
+	}
+	defer src.Close()
+	dst, err := dialText(to.addr)
+	if err != nil {
+		return err
+	}
+	defer dst.Close()
+
+	for _, slot := range from.slots[:opts.Slots] {
+		keys, err := moveSlot(src, dst, from, to, slot, opts)
+		if err != nil {
+			return fmt.Errorf("slot %d: %v", slot, err)
+		}
+		if progress != nil {
+			progress(slot, keys)
+		}
+	}
+	return nil
+}
+
+// moveSlot moves slot and its keys from one master to the other, like
+// redis-cli --cluster reshard, and returns the number of keys moved.
+func moveSlot(src, dst *textClient, from, to *reshardNode, slot int, opts ReshardOptions) (int, error) {
+	s := strconv.Itoa(slot)
+	if _, err := dst.do("CLUSTER", "SETSLOT", s, "IMPORTING", from.id); err != nil {
+		return 0, err
+	}
+	if _, err := src.do("CLUSTER", "SETSLOT", s, "MIGRATING", to.id); err != nil {
+		return 0, err
+	}
+
+	host, port, err := net.SplitHostPort(to.addr)
+	if err != nil {
+		return 0, err
+	}
+	timeout := strconv.FormatInt(opts.Timeout.Milliseconds(), 10)
+	moved, stalled := 0, 0
+	for {
+		before, err := countKeysInSlot(src, s)
+		if err != nil {
+			return moved, err
+		}
+		if before == 0 {
+			break
+		}
+		reply, err := src.do("CLUSTER", "GETKEYSINSLOT", s, strconv.Itoa(opts.Pipeline))
+		if err != nil {
+			return moved, err
+		}
+		keys := strings.Fields(strings.TrimPrefix(reply, "ARRAY"))
+		args := append([]string{"MIGRATE", host, port, "", "0", timeout, "REPLACE", "KEYS"}, keys...)
+		if _, err := src.do(args...); err != nil {
+			return moved, err
+		}
+
+		after, err := countKeysInSlot(src, s)
+		if err != nil {
+			return moved, err
+		}
+		// Keys written while in flight stay behind and move with the next
+		// batch; keys whose names the text protocol can't carry never do.
+		if after >= before {
+			if stalled++; stalled == 3 {
+				return moved, fmt.Errorf("%d keys can't be moved", after)
+			}
+			continue
+		}
+		moved += before - after
+		stalled = 0
+	}
+
+	if _, err := dst.do("CLUSTER", "SETSLOT", s, "NODE", to.id); err != nil {
+		return moved, err
+	}
+	if _, err := src.do("CLUSTER", "SETSLOT", s, "NODE", to.id); err != nil {
+		return moved, err
+	}
+	return moved, nil
+}
+
+func countKeysInSlot(c *textClient, slot string) (int, error) {
+	reply, err := c.do("CLUSTER", "COUNTKEYSINSLOT", slot)
+	if err != nil {
+		return 0, err
+	}
+	return strconv.Atoi(strings.TrimPrefix(reply, "INTEGER "))
+}
+
+// parseShards reads the masters of a text protocol CLUSTER SHARDS reply:
+// per shard "slots" start end ... "nodes" and six key/value pairs per
+// node, the master first.
+func parseShards(reply string) (map[string]*reshardNode, error) {
+	f := strings.Fields(reply)
+	if len(f) == 0 || f[0] != "ARRAY" {
+		return nil, fmt.Errorf("unexpected CLUSTER SHARDS reply %q", reply)
+	}
+	masters := make(map[string]*reshardNode)
+	for i := 1; i < len(f); {
+		if f[i] != "slots" {
+			return nil, fmt.Errorf("unexpected CLUSTER SHARDS reply %q", reply)
+		}
+		var ranges []string
+		for i++; i < len(f) && f[i] != "nodes"; i += 2 {
+			if i+1 == len(f) {
+				return nil, fmt.Errorf("unexpected CLUSTER SHARDS reply %q", reply)
+			}
+			ranges = append(ranges, f[i]+"-"+f[i+1])
+		}
+		i++
+		var master *reshardNode
+		for ; i+12 <= len(f) && f[i] == "id"; i += 12 {
+			node := make(map[string]string, 6)
+			for j := i; j < i+12; j += 2 {
+				node[f[j]] = f[j+1]
+			}
+			if master == nil {
+				master = &reshardNode{id: node["id"], addr: net.JoinHostPort(node["ip"], node["port"])}
+			}
+		}
+		if master == nil {
+			return nil, fmt.Errorf("unexpected CLUSTER SHARDS reply %q", reply)
+		}
+		slots, err := cluster.ParseSlots(strings.Join(ranges, ","))
+		if err != nil {
+			return nil, err
+		}
+		master.slots = slots
+		masters[master.id] = master
+	}
+	return masters, nil
+}
+
+// textClient sends commands to a node over the text protocol.
+type textClient struct {
+	net.Conn
+	r *bufio.Reader
+}
+
+func dialText(addr string) (*textClient, error) {
+	conn, err := net.DialTimeout("tcp", addr, 5*time.Second)
+	if err != nil {
+		return nil, err
+	}
+	return &textClient{Conn: conn, r: bufio.NewReader(conn)}, nil
+}
+
+// do sends args and returns the reply line, or the error it carries.
+func (c *textClient) do(args ...string) (string, error) {
+	line := make([]byte, 0, 64)
+	for i, a := range args {
+		if i > 0 {
+			line = append(line, ' ')
+		}
+		line = append(line, quoteArg([]byte(a))...)
+	}
+	line = append(line, "\r\n"...)
+	if _, err := c.Write(line); err != nil {
+		return "", err
+	}
+	reply, err := c.r.ReadString('\n')
+	if err != nil {
+		return "", err
+	}
+	reply = strings.TrimRight(reply, "\r\n")
+	if msg, ok := strings.CutPrefix(reply, "ERROR: "); ok {
+		return "", errors.New(msg)
+	}
+	return reply, nil
+}
@@ -4,7 +4,7 @@ import (
 	"fmt"
 	"github.com/tidwall/redcon"
 	"log"
-	"strings"
+	"sync"
 )
 
 import (
@@ -12,6 +12,20 @@ import (
 	cache "boltcache/internal/cache"
 )
 
+// redconSubscriber delivers pub/sub messages to a detached connection.
+type redconSubscriber struct {
+	mu   sync.Mutex
+	conn redcon.DetachedConn
+	sess *Session
+}
+
+func (s *redconSubscriber) Deliver(channel, message string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.conn.WriteRaw(respMessage(s.sess.Proto(), channel, message))
+	return s.conn.Flush()
+}
+
 // StartRESPServer starts a Redis-compatible RESP protocol server
 func StartRESPServer(cache *cache.BoltCache, cfg *config.Config) {
 	port := 6382 // RESP server port
@@ -25,151 +39,33 @@ func StartRESPServer(cache *cache.BoltCache, cfg *config.Config) {
 		addr := fmt.Sprintf(":%d", port)
 		err := redcon.ListenAndServe(addr,
 			func(conn redcon.Conn, cmd redcon.Command) {
-				if len(cmd.Args) == 0 {
-					conn.WriteError("ERR empty command")
+				sess := conn.Context().(*Session)
+				if lookupCommand(cmd.Args[0]) == commandTable["SUBSCRIBE"] {
+					// Subscribers receive messages from other goroutines, so
+					// the connection leaves redcon's loop and is served here.
+					dc := conn.Detach()
+					sub := &redconSubscriber{conn: dc, sess: sess}
+					sess.subscriber = sub
+					args := make([][]byte, len(cmd.Args))
+					for i, a := range cmd.Args {
+						args[i] = append([]byte(nil), a...)
+					}
+					go serveDetached(sess, sub, args)
 					return
 				}
 
-				command := strings.ToLower(string(cmd.Args[0]))
-
-				switch command {
-				case "ping":
-					conn.WriteString("PONG")
-
-				case "set":
-					if len(cmd.Args) < 3 {
-						conn.WriteError("ERR wrong number of arguments for 'set' command")
-						return
-					}
-					key := string(cmd.Args[1])
-					value := cmd.Args[2]
-					cache.Set(key, value, 0)
-					conn.WriteString("OK")
-
-				case "get":
-					if len(cmd.Args) < 2 {
-						conn.WriteError("ERR wrong number of arguments for 'get' command")
-						return
-					}
-					key := string(cmd.Args[1])
-					if val, ok := cache.Get(key); ok {
-						switch v := val.(type) {
-						case []byte:
-							conn.WriteBulk(v)
-						case string:
-							conn.WriteBulkString(v)
-						default:
-							conn.WriteBulkString(fmt.Sprintf("%v", v))
-						}
-					} else {
-						conn.WriteNull()
-					}
-
-				case "del":
-					if len(cmd.Args) < 2 {
-						conn.WriteError("ERR wrong number of arguments for 'del' command")
-						return
-					}
-					key := string(cmd.Args[1])
-					cache.Delete(key)
-					conn.WriteInt(1)
-
-				case "exists":
-					if len(cmd.Args) < 2 {
-						conn.WriteError("ERR wrong number of arguments for 'exists' command")
-						return
-					}
-					key := string(cmd.Args[1])
-					if _, ok := cache.Get(key); ok {
-						conn.WriteInt(1)
-					} else {
-						conn.WriteInt(0)
-					}
-
-				case "lpush":
-					if len(cmd.Args) < 3 {
-						conn.WriteError("ERR wrong number of arguments for 'lpush' command")
-						return
-					}
-					key := string(cmd.Args[1])
-					values := make([]string, len(cmd.Args)-2)
-					for i, arg := range cmd.Args[2:] {
-						values[i] = string(arg)
-					}
-					count := cache.LPush(key, values...)
-					conn.WriteInt(count)
-
-				case "lpop":
-					if len(cmd.Args) < 2 {
-						conn.WriteError("ERR wrong number of arguments for 'lpop' command")
-						return
-					}
-					key := string(cmd.Args[1])
-					if val, ok := cache.LPop(key); ok {
-						conn.WriteBulkString(val)
-					} else {
-						conn.WriteNull()
-					}
-
-				case "sadd":
-					if len(cmd.Args) < 3 {
-						conn.WriteError("ERR wrong number of arguments for 'sadd' command")
-						return
-					}
-					key := string(cmd.Args[1])
-					members := make([]string, len(cmd.Args)-2)
-					for i, arg := range cmd.Args[2:] {
-						members[i] = string(arg)
-					}
-					count := cache.SAdd(key, members...)
-					conn.WriteInt(count)
-
-				case "smembers":
-					if len(cmd.Args) < 2 {
-						conn.WriteError("ERR wrong number of arguments for 'smembers' command")
-						return
-					}
-					key := string(cmd.Args[1])
-					members := cache.SMembers(key)
-					conn.WriteArray(len(members))
-					for _, m := range members {
-						conn.WriteBulkString(m)
-					}
-
-				case "hset":
-					if len(cmd.Args) < 4 {
-						conn.WriteError("ERR wrong number of arguments for 'hset' command")
-						return
-					}
-					key := string(cmd.Args[1])
-					field := string(cmd.Args[2])
-					value := string(cmd.Args[3])
-					cache.HSet(key, field, value)
-					conn.WriteInt(1)
-
-				case "hget":
-					if len(cmd.Args) < 3 {
-						conn.WriteError("ERR wrong number of arguments for 'hget' command")
-						return
-					}
-					key := string(cmd.Args[1])
-					field := string(cmd.Args[2])
-					if val, ok := cache.HGet(key, field); ok {
-						conn.WriteBulkString(val)
-					} else {
-						conn.WriteNull()
-					}
-
-				default:
-					conn.WriteError("ERR unknown command '" + command + "'")
-				}
+				reply := &respReply{}
+				sess.Execute(cmd.Args, reply)
+				conn.WriteRaw(reply.buf)
 			},
 			func(conn redcon.Conn) bool {
-				// Accept connection
+				conn.SetContext(newSession(cache, protoRESP2, nil))
 				return true
 			},
 			func(conn redcon.Conn, err error) {
-				// Connection closed
+				if sess, ok := conn.Context().(*Session); ok {
+					sess.Close()
+				}
 			},
 		)
 
@@ -178,3 +74,30 @@ func StartRESPServer(cache *cache.BoltCache, cfg *config.Config) {
 		}
 	}()
 }
+
+// serveDetached runs a subscribed connection, starting with the SUBSCRIBE
+// command that detached it.
+func serveDetached(sess *Session, sub *redconSubscriber, first [][]byte) {
+	defer sub.conn.Close()
+	defer sess.Close()
+
+	args := first
+	for {
+		reply := &respReply{}
+		sess.Execute(args, reply)
+
+		sub.mu.Lock()
+		sub.conn.WriteRaw(reply.buf)
+		err := sub.conn.Flush()
+		sub.mu.Unlock()
+		if err != nil {
+			return
+		}
+
+		cmd, err := sub.conn.ReadCommand()
+		if err != nil {
+			return
+		}
+		args = cmd.Args
+	}
+}
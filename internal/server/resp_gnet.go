@@ -1,11 +1,9 @@
 package server
 
 import (
-	"bytes"
 	"fmt"
 	"log"
 	"sync"
-	"unsafe"
 
 	"github.com/panjf2000/gnet/v2"
 )
@@ -15,150 +13,85 @@ import (
 	cache "boltcache/internal/cache"
 )
 
-// RESP Protocol Parser for gnet
+// RESP server on gnet; commands are parsed by parseCommand
 type respServer struct {
 	gnet.BuiltinEventEngine
 	cache *cache.BoltCache
 }
 
-var (
-	respOKResp   = []byte("+OK\r\n")
-	respNullResp = []byte("$-1\r\n")
-	respPongResp = []byte("+PONG\r\n")
-)
-
-var respBatchPool = sync.Pool{
+var respReplyPool = sync.Pool{
 	New: func() interface{} {
-		b := make([]byte, 0, 65536)
-		return &b
+		return &respReply{buf: make([]byte, 0, 65536)}
 	},
 }
 
-//go:nosplit
-func b2sResp(b []byte) string {
-	return unsafe.String(unsafe.SliceData(b), len(b))
+func (rs *respServer) OnOpen(c gnet.Conn) ([]byte, gnet.Action) {
+	c.SetContext(newGnetSession(c, rs.cache, protoRESP2))
+	return nil, gnet.None
+}
+
+func (rs *respServer) OnClose(c gnet.Conn, err error) gnet.Action {
+	if sess, ok := c.Context().(*Session); ok {
+		sess.Close()
+	}
+	return gnet.None
 }
 
 func (rs *respServer) OnTraffic(c gnet.Conn) gnet.Action {
-	data, _ := c.Next(-1)
-	if len(data) == 0 {
+	sess := c.Context().(*Session)
+	if sess.blocked.Load() {
 		return gnet.None
 	}
 
-	batchPtr := respBatchPool.Get().(*[]byte)
-	batch := *batchPtr
-	batch = batch[:0]
+	data, _ := c.Peek(-1)
+	if len(data) == 0 {
+		return gnet.None
+	}
 
-	for len(data) > 0 {
-		// Parse RESP array (*3\r\n$3\r\nSET\r\n...)
-		if len(data) < 4 || data[0] != '*' {
-			break
+	reply := respReplyPool.Get().(*respReply)
+	reply.buf = reply.buf[:0]
+	defer respReplyPool.Put(reply)
+
+	// Execute every complete command in the buffer; an incomplete trailing
+	// frame stays in gnet's inbound buffer until the next call.
+	var args [][]byte
+	consumed := 0
+	for consumed < len(data) {
+		var n int
+		var err error
+		args, n, err = parseCommand(data[consumed:], args)
+		if err != nil {
+			// The stream can't be resynchronized after a protocol error.
+			reply.WriteError(err.Error())
+			c.Write(reply.buf)
+			return gnet.Close
 		}
-
-		// Find array length
-		idx := bytes.IndexByte(data, '\r')
-		if idx == -1 {
+		if n == 0 {
 			break
 		}
-
-		// Skip *N\r\n
-		data = data[idx+2:]
-
-		// Parse command arguments
-		var args [][]byte
-		for {
-			if len(data) < 4 {
-				break
-			}
-
-			if data[0] != '$' {
-				break
-			}
-
-			// Find bulk string length
-			idx := bytes.IndexByte(data, '\r')
-			if idx == -1 {
-				break
-			}
-
-			// Parse length
-			lenStr := data[1:idx]
-			argLen := 0
-			for _, b := range lenStr {
-				argLen = argLen*10 + int(b-'0')
-			}
-
-			// Skip $N\r\n
-			data = data[idx+2:]
-
-			if len(data) < argLen+2 {
-				break
-			}
-
-			// Extract argument
-			arg := data[:argLen]
-			args = append(args, arg)
-
-			// Skip arg\r\n
-			data = data[argLen+2:]
-
-			// Check if we have all args
-			if len(args) >= 3 {
+		consumed += n
+
+		if len(args) > 0 {
+			if runsBlocking(sess, args) {
+				args = copyArgs(args)
+				runBlocking(c, sess, func() []byte {
+					r := &respReply{}
+					sess.Execute(args, r)
+					return r.buf
+				})
 				break
 			}
+			sess.Execute(args, reply)
 		}
-
-		if len(args) == 0 {
-			continue
-		}
-
-		// Execute command
-		cmd := b2sResp(args[0])
-
-		switch cmd {
-		case "PING", "ping":
-			batch = append(batch, respPongResp...)
-
-		case "SET", "set":
-			if len(args) >= 3 {
-				key := string(args[1])
-				val := make([]byte, len(args[2]))
-				copy(val, args[2])
-				rs.cache.Set(key, val, 0)
-				batch = append(batch, respOKResp...)
-			}
-
-		case "GET", "get":
-			if len(args) >= 2 {
-				key := b2sResp(args[1])
-				if val, ok := rs.cache.Get(key); ok {
-					var valBytes []byte
-					switch v := val.(type) {
-					case []byte:
-						valBytes = v
-					case string:
-						valBytes = []byte(v)
-					default:
-						valBytes = []byte(fmt.Sprintf("%v", v))
-					}
-					// $N\r\nVALUE\r\n
-					batch = append(batch, '$')
-					batch = append(batch, []byte(fmt.Sprintf("%d", len(valBytes)))...)
-					batch = append(batch, '\r', '\n')
-					batch = append(batch, valBytes...)
-					batch = append(batch, '\r', '\n')
-				} else {
-					batch = append(batch, respNullResp...)
-				}
-			}
-		}
+	}
+	if consumed > 0 {
+		// Discard(0) would drop the whole buffer.
+		c.Discard(consumed)
 	}
 
-	if len(batch) > 0 {
-		c.Write(batch)
+	if len(reply.buf) > 0 {
+		c.Write(reply.buf)
 	}
-	*batchPtr = batch
-	respBatchPool.Put(batchPtr)
 	return gnet.None
 }
 
@@ -0,0 +1,156 @@
+package server
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"math"
+)
+
+// Limits match the Redis defaults.
+const (
+	maxInlineSize    = 64 * 1024
+	maxMultibulkLen  = 1024 * 1024
+	maxBulkLen       = 512 * 1024 * 1024
+	maxLengthLineLen = 32
+)
+
+var (
+	errInlineTooBig    = errors.New("ERR Protocol error: too big inline request")
+	errMultibulkTooBig = errors.New("ERR Protocol error: too big mbulk count string")
+	errBulkTooBig      = errors.New("ERR Protocol error: too big bulk count string")
+	errMultibulkLen    = errors.New("ERR Protocol error: invalid multibulk length")
+	errBulkLen         = errors.New("ERR Protocol error: invalid bulk length")
+	errBulkEnd         = errors.New("ERR Protocol error: expected CRLF after bulk string")
+)
+
+// parseCommand reads one command from the start of buf, either a RESP
+// multibulk array or an inline command line. It returns the arguments
+// (appended to args[:0]) and the number of bytes consumed. A consumed
+// count of 0 with a nil error means buf holds an incomplete command and
+// more data is needed; nothing should be discarded in that case.
+//
+// Blank inline lines and empty arrays are consumed and yield no
+// arguments. The returned arguments alias buf.
+func parseCommand(buf []byte, args [][]byte) ([][]byte, int, error) {
+	args = args[:0]
+	if len(buf) == 0 {
+		return args, 0, nil
+	}
+	if buf[0] != '*' {
+		return parseInline(buf, args)
+	}
+
+	count, pos, err := parseLength(buf, 1, maxMultibulkLen, errMultibulkTooBig, errMultibulkLen)
+	if err != nil || pos == 0 {
+		return args, 0, err
+	}
+	if count <= 0 {
+		return args, pos, nil
+	}
+
+	for i := 0; i < count; i++ {
+		if pos >= len(buf) {
+			return args, 0, nil
+		}
+		if buf[pos] != '$' {
+			return args, 0, fmt.Errorf("ERR Protocol error: expected '$', got '%c'", buf[pos])
+		}
+
+		size, next, err := parseLength(buf, pos+1, maxBulkLen, errBulkTooBig, errBulkLen)
+		if err != nil || next == 0 {
+			return args, 0, err
+		}
+		if size < 0 {
+			return args, 0, errBulkLen
+		}
+		if len(buf)-next < size+2 {
+			return args, 0, nil
+		}
+		if buf[next+size] != '\r' || buf[next+size+1] != '\n' {
+			return args, 0, errBulkEnd
+		}
+		args = append(args, buf[next:next+size:next+size])
+		pos = next + size + 2
+	}
+	return args, pos, nil
+}
+
+// parseLength parses the integer line that starts at buf[start] and ends
+// with CRLF. It returns the value and the offset just past the line, or
+// offset 0 if the line is not complete yet.
+func parseLength(buf []byte, start, max int, errTooBig, errInvalid error) (int, int, error) {
+	end := bytes.IndexByte(buf[start:], '\r')
+	if end < 0 {
+		if len(buf)-start > maxLengthLineLen {
+			return 0, 0, errTooBig
+		}
+		return 0, 0, nil
+	}
+	end += start
+	if end+1 >= len(buf) {
+		return 0, 0, nil
+	}
+	if buf[end+1] != '\n' {
+		return 0, 0, errInvalid
+	}
+
+	n, ok := parseInt(buf[start:end])
+	if !ok || n > int64(max) {
+		return 0, 0, errInvalid
+	}
+	return int(n), end + 2, nil
+}
+
+// parseInt is strconv.ParseInt for base 10 without allocating. Values
+// out of the int64 range are rejected.
+func parseInt(b []byte) (int64, bool) {
+	if len(b) == 0 || len(b) > 20 {
+		return 0, false
+	}
+	neg := false
+	if b[0] == '-' {
+		neg = true
+		b = b[1:]
+		if len(b) == 0 {
+			return 0, false
+		}
+	}
+	var n int64
+	for _, ch := range b {
+		if ch < '0' || ch > '9' {
+			return 0, false
+		}
+		d := int64(ch - '0')
+		if n > (math.MaxInt64-d)/10 {
+			return 0, false
+		}
+		n = n*10 + d
+	}
+	if neg {
+		n = -n
+	}
+	return n, true
+}
+
+// parseInline reads a space separated command terminated by LF, the
+// form redis-cli and telnet send when they do not speak RESP.
+func parseInline(buf []byte, args [][]byte) ([][]byte, int, error) {
+	end := bytes.IndexByte(buf, '\n')
+	if end > maxInlineSize || end < 0 && len(buf) > maxInlineSize {
+		return args, 0, errInlineTooBig
+	}
+	if end < 0 {
+		return args, 0, nil
+	}
+
+	line := buf[:end]
+	if len(line) > 0 && line[len(line)-1] == '\r' {
+		line = line[:len(line)-1]
+	}
+	split, err := splitArgs(line)
+	if err != nil {
+		return args, 0, err
+	}
+	return append(args, split...), end + 1, nil
+}
@@ -0,0 +1,109 @@
+package server
+
+import (
+	"strconv"
+	"strings"
+	"testing"
+)
+
+func TestParseCommandPipeline(t *testing.T) {
+	buf := []byte("*3\r\n$3\r\nSET\r\n$1\r\nk\r\n$4\r\na\r\nb\r\n" +
+		"*5\r\n$4\r\nHSET\r\n$1\r\nh\r\n$1\r\nf\r\n$1\r\nv\r\n$0\r\n\r\n" +
+		"PING\r\n" +
+		"\r\n" +
+		"*0\r\n" +
+		"get \"quoted key\"\n")
+
+	want := [][]string{
+		{"SET", "k", "a\r\nb"},
+		{"HSET", "h", "f", "v", ""},
+		{"PING"},
+		nil,
+		nil,
+		{"get", "quoted key"},
+	}
+
+	var args [][]byte
+	for i, w := range want {
+		var n int
+		var err error
+		args, n, err = parseCommand(buf, args)
+		if err != nil || n == 0 {
+			t.Fatalf("command %d: n=%d err=%v", i, n, err)
+		}
+		if len(args) != len(w) {
+			t.Fatalf("command %d: got %q, want %q", i, args, w)
+		}
+		for j := range w {
+			if string(args[j]) != w[j] {
+				t.Fatalf("command %d arg %d: got %q, want %q", i, j, args[j], w[j])
+			}
+		}
+		buf = buf[n:]
+	}
+	if len(buf) != 0 {
+		t.Fatalf("%d bytes left over", len(buf))
+	}
+}
+
+func TestParseCommandIncomplete(t *testing.T) {
+	frame := "*2\r\n$3\r\nGET\r\n$10\r\n0123456789\r\n"
+	for i := 0; i < len(frame); i++ {
+		_, n, err := parseCommand([]byte(frame[:i]), nil)
+		if err != nil || n != 0 {
+			t.Fatalf("prefix %q: n=%d err=%v", frame[:i], n, err)
+		}
+	}
+	if _, n, err := parseCommand([]byte(frame), nil); err != nil || n != len(frame) {
+		t.Fatalf("full frame: n=%d err=%v", n, err)
+	}
+
+	if _, n, err := parseCommand([]byte("PING"), nil); err != nil || n != 0 {
+		t.Fatalf("inline without newline: n=%d err=%v", n, err)
+	}
+}
+
+func TestParseCommandErrors(t *testing.T) {
+	cases := map[string]string{
+		"*x\r\n":                                    "invalid multibulk length",
+		"*2\r\n:1\r\n":                              "expected '$', got ':'",
+		"*1\r\n$-5\r\n":                             "invalid bulk length",
+		"*1\r\n$abc\r\n":                            "invalid bulk length",
+		"*1\r\n$4\r\nPINGxx":                        "expected CRLF after bulk string",
+		"*2\r\n$1\r\na\n$1\r\nb\r\n":                "expected CRLF after bulk string",
+		"*1\r\n$18446744073709551617\r\n":           "invalid bulk length",
+		"*-9223372036854775809\r\n":                 "invalid multibulk length",
+		"*1\r\n$9223372036854775807\r\n":            "invalid bulk length",
+		"*99999999\r\n":                             "invalid multibulk length",
+		"*1\r\n$" + strings.Repeat("9", 40):         "too big bulk count string",
+		strings.Repeat("a", maxInlineSize+1):        "too big inline request",
+		strings.Repeat("a", maxInlineSize+1) + "\n": "too big inline request",
+		"SET \"k v\n":                               "unbalanced quotes",
+	}
+	for input, want := range cases {
+		_, _, err := parseCommand([]byte(input), nil)
+		if err == nil || !strings.Contains(err.Error(), want) || !strings.HasPrefix(err.Error(), "ERR ") {
+			t.Fatalf("%.20q: got %v, want %q", input, err, want)
+		}
+	}
+}
+
+func TestParseInt(t *testing.T) {
+	cases := map[string]bool{
+		"0":                    true,
+		"-42":                  true,
+		"9223372036854775807":  true,
+		"-9223372036854775807": true,
+		"9223372036854775808":  false,
+		"99999999999999999999": false,
+		"":                     false,
+		"-":                    false,
+		"1x":                   false,
+	}
+	for input, ok := range cases {
+		n, got := parseInt([]byte(input))
+		if got != ok || ok && strconv.FormatInt(n, 10) != input {
+			t.Fatalf("%q: got %d, %v", input, n, got)
+		}
+	}
+}
@@ -3,9 +3,11 @@ package server
 import (
 	"encoding/json"
 	"fmt"
+	"math"
 	"net"
 	"net/http"
 	"strconv"
+	"strings"
 	"time"
 
 	"github.com/gorilla/mux"
@@ -67,6 +69,10 @@ func (s *RestServer) setValue(w http.ResponseWriter, r *http.Request) {
 			s.sendError(w, "Invalid TTL format", http.StatusBadRequest)
 			return
 		}
+		if !expireInRange(int64(ttl), time.Nanosecond, true) {
+			s.sendError(w, "Invalid expire time", http.StatusBadRequest)
+			return
+		}
 	}
 
 	s.cache.Set(key, req.Value, ttl)
@@ -92,6 +98,80 @@ func (s *RestServer) deleteValue(w http.ResponseWriter, r *http.Request) {
 	s.sendResponse(w, CacheResponse{Success: true})
 }
 
+// Expiration
+type TTLRequest struct {
+	TTL      string `json:"ttl,omitempty"`
+	ExpireAt int64  `json:"expire_at,omitempty"` // unix seconds
+}
+
+func (s *RestServer) getTTL(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	key := vars["key"]
+
+	ttl := s.cache.TTL(key)
+	if ttl == cache.KeyNotFound {
+		s.sendError(w, "Key not found", http.StatusNotFound)
+		return
+	}
+
+	s.sendResponse(w, CacheResponse{Success: true, Value: map[string]int64{
+		"ttl":  runTTL(s.cache, "TTL", key),
+		"pttl": runTTL(s.cache, "PTTL", key),
+	}})
+}
+
+func (s *RestServer) setTTL(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	key := vars["key"]
+
+	var req TTLRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		s.sendError(w, "Invalid JSON", http.StatusBadRequest)
+		return
+	}
+
+	var ok bool
+	switch {
+	case req.TTL != "":
+		ttl, err := time.ParseDuration(req.TTL)
+		if err != nil {
+			s.sendError(w, "Invalid TTL format", http.StatusBadRequest)
+			return
+		}
+		if !expireInRange(int64(ttl), time.Nanosecond, true) {
+			s.sendError(w, "Invalid expire time", http.StatusBadRequest)
+			return
+		}
+		ok = s.cache.Expire(key, ttl)
+	case req.ExpireAt > 0:
+		if !expireInRange(req.ExpireAt, time.Second, false) {
+			s.sendError(w, "Invalid expire time", http.StatusBadRequest)
+			return
+		}
+		ok = s.cache.ExpireAt(key, time.Unix(req.ExpireAt, 0))
+	default:
+		s.sendError(w, "ttl or expire_at is required", http.StatusBadRequest)
+		return
+	}
+
+	if !ok {
+		s.sendError(w, "Key not found", http.StatusNotFound)
+		return
+	}
+	s.sendResponse(w, CacheResponse{Success: true, Count: 1})
+}
+
+func (s *RestServer) persistKey(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	key := vars["key"]
+
+	if s.cache.TTL(key) == cache.KeyNotFound {
+		s.sendError(w, "Key not found", http.StatusNotFound)
+		return
+	}
+	s.sendResponse(w, CacheResponse{Success: true, Count: runPersist(s.cache, key)})
+}
+
 // List operations
 func (s *RestServer) listPush(w http.ResponseWriter, r *http.Request) {
 	vars := mux.Vars(r)
@@ -169,6 +249,359 @@ func (s *RestServer) hashGet(w http.ResponseWriter, r *http.Request) {
 	}
 }
 
+// Sorted set operations
+
+// ZAddRequest is the body of POST /zset/{key}.
+type ZAddRequest struct {
+	Members []cache.ZMember `json:"members"`
+	NX      bool            `json:"nx,omitempty"`
+	XX      bool            `json:"xx,omitempty"`
+	GT      bool            `json:"gt,omitempty"`
+	LT      bool            `json:"lt,omitempty"`
+	CH      bool            `json:"ch,omitempty"`
+}
+
+func (s *RestServer) zsetAdd(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	key := vars["key"]
+
+	var req ZAddRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil || len(req.Members) == 0 {
+		s.sendError(w, "Invalid JSON", http.StatusBadRequest)
+		return
+	}
+	if (req.NX && (req.XX || req.GT || req.LT)) || (req.GT && req.LT) {
+		s.sendError(w, "Incompatible options", http.StatusBadRequest)
+		return
+	}
+
+	opts := cache.ZAddOptions{NX: req.NX, XX: req.XX, GT: req.GT, LT: req.LT, CH: req.CH}
+	count, err := s.cache.ZAdd(key, opts, req.Members...)
+	if err != nil {
+		s.sendError(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	s.sendResponse(w, CacheResponse{Success: true, Count: count})
+}
+
+// zsetRange serves GET /zset/{key}. By default it returns ranks start..stop
+// (0..-1); min and/or max switch to a score range with offset and count.
+// rev=true reverses the order and withscores=true includes the scores.
+func (s *RestServer) zsetRange(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	key := vars["key"]
+	q := r.URL.Query()
+
+	reverse := q.Get("rev") == "true"
+	withScores := q.Get("withscores") == "true"
+
+	var members []cache.ZMember
+	var err error
+	if q.Has("min") || q.Has("max") {
+		min, max := cache.ScoreBound{Value: math.Inf(-1)}, cache.ScoreBound{Value: math.Inf(1)}
+		var ok1, ok2 = true, true
+		if q.Has("min") {
+			min, ok1 = parseScoreBound(q.Get("min"))
+		}
+		if q.Has("max") {
+			max, ok2 = parseScoreBound(q.Get("max"))
+		}
+		offset, err1 := queryInt(q.Get("offset"), 0)
+		count, err2 := queryInt(q.Get("count"), -1)
+		if !ok1 || !ok2 || err1 != nil || err2 != nil {
+			s.sendError(w, "Invalid range", http.StatusBadRequest)
+			return
+		}
+		members, err = s.cache.ZRangeByScore(key, min, max, reverse, offset, count)
+	} else {
+		start, err1 := queryInt(q.Get("start"), 0)
+		stop, err2 := queryInt(q.Get("stop"), -1)
+		if err1 != nil || err2 != nil {
+			s.sendError(w, "Invalid range", http.StatusBadRequest)
+			return
+		}
+		members, err = s.cache.ZRange(key, start, stop, reverse)
+	}
+	if err != nil {
+		s.sendError(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	if withScores {
+		s.sendResponse(w, CacheResponse{Success: true, Value: members})
+		return
+	}
+	names := make([]string, len(members))
+	for i, m := range members {
+		names[i] = m.Member
+	}
+	s.sendResponse(w, CacheResponse{Success: true, Value: names})
+}
+
+func (s *RestServer) zsetMember(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	key := vars["key"]
+	member := vars["member"]
+
+	score, ok, err := s.cache.ZScore(key, member)
+	if err != nil {
+		s.sendError(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if !ok {
+		s.sendError(w, "Member not found", http.StatusNotFound)
+		return
+	}
+	rank, _, _ := s.cache.ZRank(key, member, false)
+	s.sendResponse(w, CacheResponse{Success: true, Value: map[string]interface{}{
+		"member": member,
+		"score":  score,
+		"rank":   rank,
+	}})
+}
+
+func (s *RestServer) zsetIncr(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	key := vars["key"]
+	member := vars["member"]
+
+	var req struct {
+		Increment float64 `json:"increment"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		s.sendError(w, "Invalid JSON", http.StatusBadRequest)
+		return
+	}
+
+	score, err := s.cache.ZIncrBy(key, member, req.Increment)
+	if err != nil {
+		s.sendError(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	s.sendResponse(w, CacheResponse{Success: true, Value: score})
+}
+
+func (s *RestServer) zsetRemove(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	key := vars["key"]
+	member := vars["member"]
+
+	count, err := s.cache.ZRem(key, member)
+	if err != nil {
+		s.sendError(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if count == 0 {
+		s.sendError(w, "Member not found", http.StatusNotFound)
+		return
+	}
+	s.sendResponse(w, CacheResponse{Success: true, Count: count})
+}
+
+// Geo operations
+
+// GeoAddRequest is the body of POST /geo/{key}.
+type GeoAddRequest struct {
+	Members []cache.GeoMember `json:"members"`
+	NX      bool              `json:"nx,omitempty"`
+	XX      bool              `json:"xx,omitempty"`
+	CH      bool              `json:"ch,omitempty"`
+}
+
+// geoEnabled answers 403 when features.geo_commands is off.
+func (s *RestServer) geoEnabled(w http.ResponseWriter) bool {
+	if !featureEnabled(s.cache, "geo_commands") {
+		s.sendError(w, "Geo commands are disabled (features.geo_commands)", http.StatusForbidden)
+		return false
+	}
+	return true
+}
+
+func (s *RestServer) geoAdd(w http.ResponseWriter, r *http.Request) {
+	if !s.geoEnabled(w) {
+		return
+	}
+	vars := mux.Vars(r)
+	key := vars["key"]
+
+	var req GeoAddRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil || len(req.Members) == 0 {
+		s.sendError(w, "Invalid JSON", http.StatusBadRequest)
+		return
+	}
+	if req.NX && req.XX {
+		s.sendError(w, "Incompatible options", http.StatusBadRequest)
+		return
+	}
+
+	count, err := s.cache.GeoAdd(key, cache.ZAddOptions{NX: req.NX, XX: req.XX, CH: req.CH}, req.Members...)
+	if err != nil {
+		s.sendError(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	s.sendResponse(w, CacheResponse{Success: true, Count: count})
+}
+
+// geoSearch serves GET /geo/{key}. The center is member=name or lon and
+// lat; the area is radius=r or width=w&height=h, in unit (m, km, ft or mi,
+// default m). sort=asc|desc, count=n and any=true work as in GEOSEARCH.
+// Distances in the answer are in unit.
+func (s *RestServer) geoSearch(w http.ResponseWriter, r *http.Request) {
+	if !s.geoEnabled(w) {
+		return
+	}
+	vars := mux.Vars(r)
+	key := vars["key"]
+	q := r.URL.Query()
+
+	unit := 1.0
+	if q.Has("unit") {
+		var ok bool
+		if unit, ok = geoUnit(q.Get("unit")); !ok {
+			s.sendError(w, "Unsupported unit, use m, km, ft or mi", http.StatusBadRequest)
+			return
+		}
+	}
+
+	var query cache.GeoQuery
+	switch {
+	case q.Has("member"):
+		query.Member = q.Get("member")
+	case q.Has("lon") && q.Has("lat"):
+		p, ok := parseGeoPoint(q.Get("lon"), q.Get("lat"))
+		if !ok || !cache.ValidGeoPoint(p) {
+			s.sendError(w, "Invalid lon/lat", http.StatusBadRequest)
+			return
+		}
+		query.Center = p
+	default:
+		s.sendError(w, "Either member or lon and lat is required", http.StatusBadRequest)
+		return
+	}
+
+	number := func(name string) (float64, bool) {
+		v, err := strconv.ParseFloat(q.Get(name), 64)
+		return v * unit, err == nil && v >= 0
+	}
+	switch {
+	case q.Has("radius"):
+		radius, ok := number("radius")
+		if !ok {
+			s.sendError(w, "Invalid radius", http.StatusBadRequest)
+			return
+		}
+		query.Shape.Radius = radius
+	case q.Has("width") && q.Has("height"):
+		width, ok1 := number("width")
+		height, ok2 := number("height")
+		if !ok1 || !ok2 {
+			s.sendError(w, "Invalid width or height", http.StatusBadRequest)
+			return
+		}
+		query.Shape = cache.GeoShape{Box: true, Width: width, Height: height}
+	default:
+		s.sendError(w, "Either radius or width and height is required", http.StatusBadRequest)
+		return
+	}
+
+	switch q.Get("sort") {
+	case "", "none":
+	case "asc":
+		query.Sort = 1
+	case "desc":
+		query.Sort = -1
+	default:
+		s.sendError(w, "sort must be asc or desc", http.StatusBadRequest)
+		return
+	}
+	count, err := queryInt(q.Get("count"), 0)
+	if err != nil || count < 0 {
+		s.sendError(w, "Invalid count", http.StatusBadRequest)
+		return
+	}
+	query.Count, query.Any = count, q.Get("any") == "true" && count > 0
+
+	results, err := s.cache.GeoSearch(key, query)
+	if err != nil {
+		s.sendError(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	for i := range results {
+		results[i].Dist /= unit
+	}
+	s.sendResponse(w, CacheResponse{Success: true, Value: results})
+}
+
+func (s *RestServer) geoMember(w http.ResponseWriter, r *http.Request) {
+	if !s.geoEnabled(w) {
+		return
+	}
+	vars := mux.Vars(r)
+	key := vars["key"]
+	member := vars["member"]
+
+	pos, err := s.cache.GeoPos(key, member)
+	if err != nil {
+		s.sendError(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if pos[0] == nil {
+		s.sendError(w, "Member not found", http.StatusNotFound)
+		return
+	}
+	score, _, _ := s.cache.ZScore(key, member)
+	s.sendResponse(w, CacheResponse{Success: true, Value: map[string]interface{}{
+		"member":    member,
+		"longitude": pos[0].Longitude,
+		"latitude":  pos[0].Latitude,
+		"geohash":   cache.GeoHashString(score),
+	}})
+}
+
+// geoDistance serves GET /geo/{key}/{member}/distance/{other}?unit=km.
+func (s *RestServer) geoDistance(w http.ResponseWriter, r *http.Request) {
+	if !s.geoEnabled(w) {
+		return
+	}
+	vars := mux.Vars(r)
+	key := vars["key"]
+
+	unit := 1.0
+	if u := r.URL.Query().Get("unit"); u != "" {
+		var ok bool
+		if unit, ok = geoUnit(u); !ok {
+			s.sendError(w, "Unsupported unit, use m, km, ft or mi", http.StatusBadRequest)
+			return
+		}
+	}
+
+	dist, ok, err := s.cache.GeoDist(key, vars["member"], vars["other"])
+	if err != nil {
+		s.sendError(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if !ok {
+		s.sendError(w, "Member not found", http.StatusNotFound)
+		return
+	}
+	s.sendResponse(w, CacheResponse{Success: true, Value: dist / unit})
+}
+
+func (s *RestServer) geoRemove(w http.ResponseWriter, r *http.Request) {
+	if !s.geoEnabled(w) {
+		return
+	}
+	s.zsetRemove(w, r)
+}
+
+// queryInt parses an optional integer query parameter.
+func queryInt(value string, def int) (int, error) {
+	if value == "" {
+		return def, nil
+	}
+	return strconv.Atoi(value)
+}
+
 // Pub/Sub via WebSocket
 func (s *RestServer) subscribe(w http.ResponseWriter, r *http.Request) {
 	vars := mux.Vars(r)
@@ -181,8 +614,9 @@ func (s *RestServer) subscribe(w http.ResponseWriter, r *http.Request) {
 	}
 	defer conn.Close()
 
-	// Create a mock net.Conn for compatibility
-	s.cache.Subscribe(channel, &wsConn{conn: conn})
+	sub := cache.NewConnSubscriber(&wsConn{conn: conn})
+	s.cache.Subscribe(channel, sub)
+	defer s.cache.Unsubscribe(channel, sub)
 
 	// Keep connection alive
 	for {
@@ -224,6 +658,68 @@ func (s *RestServer) evalScript(w http.ResponseWriter, r *http.Request) {
 	s.sendResponse(w, CacheResponse{Success: true, Value: result})
 }
 
+// TxRequest is the body of POST /tx. Each command is a list of arguments,
+// e.g. ["SET", "key", "value"]; they run as one MULTI/EXEC block.
+type TxRequest struct {
+	Commands [][]string `json:"commands"`
+}
+
+// Transactions
+func (s *RestServer) transaction(w http.ResponseWriter, r *http.Request) {
+	var req TxRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		s.sendError(w, "Invalid JSON", http.StatusBadRequest)
+		return
+	}
+	if len(req.Commands) == 0 {
+		s.sendError(w, "No commands", http.StatusBadRequest)
+		return
+	}
+
+	sess := newSession(s.cache, protoRESP3, nil)
+	defer sess.Close()
+	reply := &jsonReply{}
+
+	sess.Execute([][]byte{[]byte("MULTI")}, reply)
+	if msg := replyError(reply.last()); msg != "" {
+		s.sendError(w, msg, http.StatusForbidden)
+		return
+	}
+
+	for i, command := range req.Commands {
+		args := make([][]byte, len(command))
+		for j, a := range command {
+			args[j] = []byte(a)
+		}
+		sess.Execute(args, reply)
+		if msg := replyError(reply.last()); msg != "" {
+			s.sendError(w, fmt.Sprintf("command %d: %s", i, msg), http.StatusBadRequest)
+			return
+		}
+	}
+
+	sess.Execute([][]byte{[]byte("EXEC")}, reply)
+	if msg := replyError(reply.last()); msg != "" {
+		s.sendError(w, msg, http.StatusBadRequest)
+		return
+	}
+	if reply.last() == nil {
+		s.sendError(w, "Transaction aborted", http.StatusConflict)
+		return
+	}
+	s.sendResponse(w, CacheResponse{Success: true, Value: reply.last()})
+}
+
+// replyError returns the message of an error reply collected by jsonReply.
+func replyError(v interface{}) string {
+	if m, ok := v.(map[string]interface{}); ok && len(m) == 1 {
+		if msg, ok := m["error"].(string); ok {
+			return msg
+		}
+	}
+	return ""
+}
+
 // Info endpoint
 func (s *RestServer) info(w http.ResponseWriter, r *http.Request) {
 	var count int
@@ -232,16 +728,83 @@ func (s *RestServer) info(w http.ResponseWriter, r *http.Request) {
 		return true
 	})
 
+	stats := s.cache.GetData().EvictionStats()
 	info := map[string]interface{}{
-		"keys":     count,
-		"replicas": len(s.cache.GetReplicas()),
-		"version":  appinfo.Version,
-		"uptime":   time.Now().Format(time.RFC3339),
+		"keys":            count,
+		"replicas":        len(s.cache.GetReplicas()),
+		"role":            s.cache.ReplicationInfo().Role,
+		"repl_offset":     s.cache.ReplicationOffset(),
+		"version":         appinfo.Version,
+		"uptime":          time.Now().Format(time.RFC3339),
+		"used_memory":     stats.UsedMemory,
+		"max_memory":      stats.MaxMemory,
+		"max_keys":        stats.MaxKeys,
+		"eviction_policy": stats.Policy,
+		"evicted_keys":    stats.EvictedKeys,
+		"expired_keys":    s.cache.GetData().ExpiredKeys(),
 	}
 
 	s.sendResponse(w, CacheResponse{Success: true, Value: info})
 }
 
+// Persistence administration
+func (s *RestServer) adminSave(w http.ResponseWriter, r *http.Request) {
+	if background, _ := strconv.ParseBool(r.URL.Query().Get("background")); background {
+		if err := s.cache.BackgroundSave(); err != nil {
+			s.sendSaveError(w, err)
+			return
+		}
+		s.sendResponse(w, CacheResponse{Success: true, Value: "Background saving started"})
+		return
+	}
+
+	if err := s.cache.Save(); err != nil {
+		s.sendSaveError(w, err)
+		return
+	}
+	s.sendResponse(w, CacheResponse{Success: true, Value: map[string]int64{"last_save": s.cache.LastSave().Unix()}})
+}
+
+func (s *RestServer) adminBackups(w http.ResponseWriter, r *http.Request) {
+	backups := s.cache.Backups()
+	s.sendResponse(w, CacheResponse{Success: true, Value: backups, Count: len(backups)})
+}
+
+type RestoreRequest struct {
+	Backup string `json:"backup"`
+}
+
+func (s *RestServer) adminRestore(w http.ResponseWriter, r *http.Request) {
+	var req RestoreRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil || req.Backup == "" {
+		s.sendError(w, "Invalid JSON", http.StatusBadRequest)
+		return
+	}
+
+	// Keep transactions and other commands from interleaving with the swap.
+	s.cache.TxMu.Lock()
+	n, err := s.cache.RestoreBackup(req.Backup)
+	s.cache.TxMu.Unlock()
+	if err != nil {
+		s.sendSaveError(w, err)
+		return
+	}
+	s.sendResponse(w, CacheResponse{Success: true, Value: req.Backup, Count: n})
+}
+
+func (s *RestServer) sendSaveError(w http.ResponseWriter, err error) {
+	code := http.StatusInternalServerError
+	switch err {
+	case cache.ErrSaveInProgress, cache.ErrRestoreInProgress:
+		code = http.StatusConflict
+	case cache.ErrBackupNotFound:
+		code = http.StatusNotFound
+	case cache.ErrNoPersistFile:
+		code = http.StatusBadRequest
+	}
+	s.sendError(w, err.Error(), code)
+}
+
 // Token management
 func (s *RestServer) listTokens(w http.ResponseWriter, r *http.Request) {
 	// Demo token list since auth is disabled
@@ -286,6 +849,88 @@ func (s *RestServer) sendError(w http.ResponseWriter, message string, code int)
 	json.NewEncoder(w).Encode(CacheResponse{Success: false, Error: message})
 }
 
+// replicationMiddleware rejects writes on a replica and, when replication
+// is synchronous, holds write responses until the replicas have the write.
+// /tx runs through the command table, which does both itself.
+func (s *RestServer) replicationMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !restWrite(r) || !s.cache.ReplicationEnabled() || r.URL.Path == "/tx" {
+			next.ServeHTTP(w, r)
+			return
+		}
+		if s.cache.IsReplica() {
+			s.sendError(w, "READONLY You can't write against a read only replica.", http.StatusForbidden)
+			return
+		}
+		if !s.cache.SyncReplication() {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		held := &heldResponse{ResponseWriter: w, code: http.StatusOK}
+		next.ServeHTTP(held, r)
+		if offset := s.cache.ReplicationOffset(); !s.cache.WaitReplicas(offset) {
+			logger.Log("Replicas did not acknowledge offset %d in time", offset)
+		}
+		w.WriteHeader(held.code)
+		w.Write(held.body)
+	})
+}
+
+// txMiddleware runs keyspace requests holding TxMu for reading, like the
+// command table runs commands, so transactions stay atomic against them.
+// The response is buffered so a slow client can't hold up EXEC.
+func (s *RestServer) txMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !restKeyspace(r) {
+			next.ServeHTTP(w, r)
+			return
+		}
+		held := &heldResponse{ResponseWriter: w, code: http.StatusOK}
+		s.cache.TxMu.RLock()
+		next.ServeHTTP(held, r)
+		s.cache.TxMu.RUnlock()
+		w.WriteHeader(held.code)
+		w.Write(held.body)
+	})
+}
+
+// restKeyspace reports whether r reads or writes keys directly. /tx and
+// /admin/restore take TxMu themselves.
+func restKeyspace(r *http.Request) bool {
+	for _, prefix := range []string{"/cache/", "/list/", "/set/", "/hash/", "/zset/", "/geo/"} {
+		if strings.HasPrefix(r.URL.Path, prefix) {
+			return true
+		}
+	}
+	return r.URL.Path == "/eval"
+}
+
+// restWrite reports whether r may modify the dataset.
+func restWrite(r *http.Request) bool {
+	switch {
+	case r.Method != "PUT" && r.Method != "POST" && r.Method != "DELETE":
+		return false
+	case r.URL.Path == "/admin/save", strings.HasPrefix(r.URL.Path, "/publish/"), strings.HasPrefix(r.URL.Path, "/auth/"):
+		return false
+	}
+	return true
+}
+
+// heldResponse buffers a response so it can be sent later.
+type heldResponse struct {
+	http.ResponseWriter
+	code int
+	body []byte
+}
+
+func (h *heldResponse) WriteHeader(code int) { h.code = code }
+
+func (h *heldResponse) Write(p []byte) (int, error) {
+	h.body = append(h.body, p...)
+	return len(p), nil
+}
+
 // WebSocket wrapper for net.Conn compatibility
 type wsConn struct {
 	conn *websocket.Conn
@@ -338,6 +983,9 @@ func (s *RestServer) Start() error {
 	// Auth middleware (disabled)
 	// r.Use(s.authManager.HTTPMiddleware)
 
+	r.Use(s.replicationMiddleware)
+	r.Use(s.txMiddleware)
+
 	// Swagger UI
 	if s.config.Server.SwaggerUI {
 		r.HandleFunc("/openapi.json", swaggerui.OpenAPIHandler).Methods("GET")
@@ -349,6 +997,11 @@ func (s *RestServer) Start() error {
 	r.HandleFunc("/cache/{key}", s.getValue).Methods("GET")
 	r.HandleFunc("/cache/{key}", s.deleteValue).Methods("DELETE")
 
+	// Expiration
+	r.HandleFunc("/cache/{key}/ttl", s.getTTL).Methods("GET")
+	r.HandleFunc("/cache/{key}/ttl", s.setTTL).Methods("PUT")
+	r.HandleFunc("/cache/{key}/ttl", s.persistKey).Methods("DELETE")
+
 	// List operations
 	r.HandleFunc("/list/{key}", s.listPush).Methods("POST")
 	r.HandleFunc("/list/{key}", s.listPop).Methods("DELETE")
@@ -361,6 +1014,20 @@ func (s *RestServer) Start() error {
 	r.HandleFunc("/hash/{key}/{field}", s.hashSet).Methods("PUT")
 	r.HandleFunc("/hash/{key}/{field}", s.hashGet).Methods("GET")
 
+	// Sorted set operations
+	r.HandleFunc("/zset/{key}", s.zsetAdd).Methods("POST")
+	r.HandleFunc("/zset/{key}", s.zsetRange).Methods("GET")
+	r.HandleFunc("/zset/{key}/{member}", s.zsetMember).Methods("GET")
+	r.HandleFunc("/zset/{key}/{member}", s.zsetRemove).Methods("DELETE")
+	r.HandleFunc("/zset/{key}/{member}/incr", s.zsetIncr).Methods("POST")
+
+	// Geo operations
+	r.HandleFunc("/geo/{key}", s.geoAdd).Methods("POST")
+	r.HandleFunc("/geo/{key}", s.geoSearch).Methods("GET")
+	r.HandleFunc("/geo/{key}/{member}", s.geoMember).Methods("GET")
+	r.HandleFunc("/geo/{key}/{member}", s.geoRemove).Methods("DELETE")
+	r.HandleFunc("/geo/{key}/{member}/distance/{other}", s.geoDistance).Methods("GET")
+
 	// Pub/Sub
 	r.HandleFunc("/subscribe/{channel}", s.subscribe).Methods("GET")
 	r.HandleFunc("/publish/{channel}", s.publish).Methods("POST")
@@ -368,11 +1035,19 @@ func (s *RestServer) Start() error {
 	// Script execution
 	r.HandleFunc("/eval", s.evalScript).Methods("POST")
 
+	// Transactions
+	r.HandleFunc("/tx", s.transaction).Methods("POST")
+
 	// Auth management
 	r.HandleFunc("/auth/tokens", s.listTokens).Methods("GET")
 	r.HandleFunc("/auth/tokens", s.createToken).Methods("POST")
 	r.HandleFunc("/auth/tokens/{token}", s.deleteToken).Methods("DELETE")
 
+	// Persistence administration
+	r.HandleFunc("/admin/save", s.adminSave).Methods("POST")
+	r.HandleFunc("/admin/backups", s.adminBackups).Methods("GET")
+	r.HandleFunc("/admin/restore", s.adminRestore).Methods("POST")
+
 	// Info and health check - BEFORE static files
 	r.HandleFunc("/info", s.info).Methods("GET")
 	r.HandleFunc("/ping", s.ping).Methods("GET")
@@ -394,18 +1069,35 @@ func (s *RestServer) Start() error {
 	logger.LogRoute("PUT", "/cache/{key}", "Set value")
 	logger.LogRoute("GET", "/cache/{key}", "Get value")
 	logger.LogRoute("DELETE", "/cache/{key}", "Delete value")
+	logger.LogRoute("GET", "/cache/{key}/ttl", "Get remaining TTL")
+	logger.LogRoute("PUT", "/cache/{key}/ttl", "Set expiration")
+	logger.LogRoute("DELETE", "/cache/{key}/ttl", "Remove expiration")
 	logger.LogRoute("POST", "/list/{key}", "Push to list")
 	logger.LogRoute("DELETE", "/list/{key}", "Pop from list")
 	logger.LogRoute("POST", "/set/{key}", "Add to set")
 	logger.LogRoute("GET", "/set/{key}", "Get set members")
 	logger.LogRoute("PUT", "/hash/{key}/{field}", "Set hash field")
 	logger.LogRoute("GET", "/hash/{key}/{field}", "Get hash field")
+	logger.LogRoute("POST", "/zset/{key}", "Add sorted set members")
+	logger.LogRoute("GET", "/zset/{key}", "Sorted set range")
+	logger.LogRoute("GET", "/zset/{key}/{member}", "Member score and rank")
+	logger.LogRoute("DELETE", "/zset/{key}/{member}", "Remove member")
+	logger.LogRoute("POST", "/zset/{key}/{member}/incr", "Increment member score")
+	logger.LogRoute("POST", "/geo/{key}", "Add geo members")
+	logger.LogRoute("GET", "/geo/{key}", "Search by radius or box")
+	logger.LogRoute("GET", "/geo/{key}/{member}", "Member position")
+	logger.LogRoute("DELETE", "/geo/{key}/{member}", "Remove geo member")
+	logger.LogRoute("GET", "/geo/{key}/{member}/distance/{other}", "Distance between members")
 	logger.LogRoute("GET", "/subscribe/{channel}", "Subscribe (WebSocket)")
 	logger.LogRoute("POST", "/publish/{channel}", "Publish message")
 	logger.LogRoute("POST", "/eval", "Execute script")
+	logger.LogRoute("POST", "/tx", "Run commands atomically")
 	logger.LogRoute("GET", "/auth/tokens", "List tokens")
 	logger.LogRoute("POST", "/auth/tokens", "Create token")
 	logger.LogRoute("DELETE", "/auth/tokens/{token}", "Delete token")
+	logger.LogRoute("POST", "/admin/save", "Save to disk (?background=true for BGSAVE)")
+	logger.LogRoute("GET", "/admin/backups", "List backups")
+	logger.LogRoute("POST", "/admin/restore", "Restore a backup")
 	logger.LogRoute("GET", "/info", "Server info")
 	logger.LogRoute("GET", "/ping", "Health check")
 
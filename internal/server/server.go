@@ -69,6 +69,9 @@ func (s *Server) Start() error {
 		StartGnetServer(s.cache, s.config)     // High-performance gnet on port 6381
 		StartRESPGnetServer(s.cache, s.config) // RESP gnet (multicore) on port 6382
 	case "rest":
+		if s.config.Cluster.Enabled || s.config.Cluster.Replication.Enabled {
+			go s.startTCPServer() // nodes talk over the TCP port
+		}
 		go s.startRESTServer()
 		StartRESPGnetServer(s.cache, s.config) // RESP gnet (multicore) on port 6382
 	case "both":
@@ -137,6 +140,7 @@ func (s *Server) shutdown() {
 		logger.Log("Saving data to disk...")
 		s.cache.ForcePersist()
 	}
+	s.cache.CloseAOF()
 
 	logger.Log("Shutdown complete")
 }
@@ -169,21 +173,69 @@ func NewBoltCacheWithConfig(config *config.Config) *cache.BoltCache {
 		Config:      config,
 	}
 
+	// Enforce max_memory / max_keys with the configured eviction policy
+	_cache.Data.ConfigureEviction(config.Cache)
+
 	// Initialize Lua engine if enabled
 	if config.Features.LuaScripting {
 		_cache.LuaEngine = cache.NewLuaEngine(_cache)
 	}
 
-	// Load from disk if persistence enabled
-	if config.Persistence.Enabled {
-		_cache.LoadFromDisk()
+	// Load from disk if persistence enabled. The append-only file is
+	// newer than the periodic dump, so it wins when both exist.
+	aof := config.Persistence.AOF
+	loaded := false
+	if aof.Enabled {
+		var err error
+		if loaded, err = _cache.LoadAOF(aof.File); err != nil {
+			log.Fatalf("Failed to load append-only file: %v", err)
+		}
+	}
+	if !loaded && config.Persistence.Enabled {
+		if err := _cache.LoadFromDisk(); err != nil {
+			log.Fatalf("Failed to load persistence file: %v", err)
+		}
+	}
+	if aof.Enabled {
+		if err := _cache.StartAOF(aof); err != nil {
+			log.Fatalf("Failed to start append-only file: %v", err)
+		}
 	}
 
 	// Start background tasks
-	go _cache.CleanupExpiredWithConfig()
+	_cache.StartActiveExpiry()
 
 	if config.Persistence.Enabled {
 		go _cache.PersistToDiskWithConfig()
+		_cache.StartSnapshots()
+	}
+
+	if config.Cluster.Enabled {
+		tcp := config.Server.TCP
+		addr := clusterAddr(config.Cluster.Announce, tcp.Host, tcp.Port)
+		if err := startConsensus(_cache, config.Cluster.Consensus, config.Cluster.NodeID, addr); err != nil {
+			log.Fatalf("Failed to start consensus: %v", err)
+		}
+	}
+
+	// A replica replaces what it loaded with the master's data once the
+	// first sync completes.
+	if config.Cluster.Replication.Enabled {
+		if err := _cache.StartReplication(config.Cluster.Replication); err != nil {
+			log.Fatalf("Failed to start replication: %v", err)
+		}
+	}
+
+	// Active-active peers merge with what was loaded above.
+	if aa := config.Cluster.ActiveActive; len(aa.Peers) > 0 {
+		if err := _cache.StartActiveReplication(config.Cluster.NodeID, aa); err != nil {
+			log.Fatalf("Failed to start active-active replication: %v", err)
+		}
+	}
+
+	if config.Cluster.Enabled {
+		tcp := config.Server.TCP
+		startClusterMembership(_cache, config, config.Cluster.NodeID, clusterAddr(config.Cluster.Announce, tcp.Host, tcp.Port), nil)
 	}
 
 	return _cache
@@ -0,0 +1,193 @@
+package server
+
+import (
+	"bufio"
+	"io"
+	"net"
+	"sync"
+	"sync/atomic"
+)
+
+import (
+	cache "boltcache/internal/cache"
+)
+
+// Wire protocols a session can speak.
+const (
+	protoText  = 0
+	protoRESP2 = 2
+	protoRESP3 = 3
+)
+
+// Session is the per-connection state shared by every protocol front-end.
+type Session struct {
+	id    int64
+	cache *cache.BoltCache
+	proto int32 // changed by HELLO, read by publishers; use Proto
+	name  string
+
+	mu         sync.Mutex
+	subscriber cache.Subscriber
+	channels   map[string]struct{}
+
+	// Transaction state, only used by the connection's own goroutine.
+	multi   bool
+	dirty   bool // a command failed to queue, EXEC must abort
+	inExec  bool // EXEC is running the queue and holds TxMu
+	queue   []queuedCommand
+	watched map[string]uint64
+
+	// Cluster redirection state, see route.
+	asking   bool // the previous command was ASKING
+	readonly bool // READONLY: reads of the master's slots are served
+
+	// blocked is set by the gnet front-ends while a blocking command runs
+	// off the event loop; closed wakes it up when the connection goes away.
+	blocked   atomic.Bool
+	closed    chan struct{}
+	closeOnce sync.Once
+
+	// conn is set by the text front-end, which serves raw connections.
+	// A command that takes the connection over, like PSYNC, sets handoff;
+	// it is called once the reply has been written.
+	conn    net.Conn
+	handoff func(conn net.Conn, r *bufio.Reader)
+}
+
+type queuedCommand struct {
+	cmd  *Command
+	args [][]byte
+}
+
+var lastSessionID int64
+
+// newSession creates the state for a new connection. sub delivers pub/sub
+// messages in the connection's wire format.
+func newSession(c *cache.BoltCache, proto int, sub cache.Subscriber) *Session {
+	return &Session{
+		id:         atomic.AddInt64(&lastSessionID, 1),
+		cache:      c,
+		proto:      int32(proto),
+		subscriber: sub,
+		closed:     make(chan struct{}),
+	}
+}
+
+// Proto returns the wire protocol the connection currently speaks.
+func (s *Session) Proto() int {
+	return int(atomic.LoadInt32(&s.proto))
+}
+
+func (s *Session) setProto(proto int) {
+	atomic.StoreInt32(&s.proto, int32(proto))
+}
+
+// Subscribe adds channel to the session and returns the subscription count.
+func (s *Session) Subscribe(channel string) int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.channels == nil {
+		s.channels = make(map[string]struct{})
+	}
+	if _, ok := s.channels[channel]; !ok && s.subscriber != nil {
+		s.channels[channel] = struct{}{}
+		s.cache.Subscribe(channel, s.subscriber)
+	}
+	return len(s.channels)
+}
+
+// Unsubscribe removes channel and returns the remaining subscription count.
+func (s *Session) Unsubscribe(channel string) int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if _, ok := s.channels[channel]; ok {
+		delete(s.channels, channel)
+		s.cache.Unsubscribe(channel, s.subscriber)
+	}
+	return len(s.channels)
+}
+
+// Channels returns the channels the session is subscribed to.
+func (s *Session) Channels() []string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	channels := make([]string, 0, len(s.channels))
+	for ch := range s.channels {
+		channels = append(channels, ch)
+	}
+	return channels
+}
+
+func (s *Session) subscriptions() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return len(s.channels)
+}
+
+// Close releases everything the connection holds.
+func (s *Session) Close() {
+	s.closeOnce.Do(func() { close(s.closed) })
+	for _, ch := range s.Channels() {
+		s.Unsubscribe(ch)
+	}
+	s.discard()
+	s.unwatch()
+}
+
+// discard leaves MULTI and drops the queued commands.
+func (s *Session) discard() {
+	s.multi = false
+	s.dirty = false
+	s.queue = nil
+}
+
+// watch records the current version of key, unless it is already watched.
+func (s *Session) watch(key string) {
+	if s.watched == nil {
+		s.watched = make(map[string]uint64)
+	}
+	if _, ok := s.watched[key]; !ok {
+		s.watched[key] = s.cache.Data.Version(key)
+	}
+}
+
+func (s *Session) unwatch() {
+	s.watched = nil
+}
+
+// watchedUnchanged reports whether none of the watched keys was written
+// since WATCH. The caller must hold cache.TxMu.
+func (s *Session) watchedUnchanged() bool {
+	for key, version := range s.watched {
+		if s.cache.Data.Version(key) != version {
+			return false
+		}
+	}
+	return true
+}
+
+// syncWriter serializes writes from the connection loop and from
+// publishers delivering messages on other goroutines.
+type syncWriter struct {
+	mu sync.Mutex
+	w  io.Writer
+}
+
+func (w *syncWriter) Write(p []byte) (int, error) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	return w.w.Write(p)
+}
+
+// respMessage encodes a pub/sub message as a RESP2 array or a RESP3 push.
+func respMessage(proto int, channel, message string) []byte {
+	r := &respReply{resp3: proto == protoRESP3}
+	r.WritePush(3)
+	r.WriteBulkString("message")
+	r.WriteBulkString(channel)
+	r.WriteBulkString(message)
+	return r.buf
+}
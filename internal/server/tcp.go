@@ -2,18 +2,18 @@ package server
 
 import (
 	"bufio"
-	"fmt"
+	"bytes"
 	"net"
-	"strconv"
-	"strings"
-	"time"
 )
 
 import (
 	_cache "boltcache/internal/cache"
 )
 
-// Optimized handleConnection for standard TCP
+// handleConnection serves the line-based text protocol. Every line is one
+// command, split with redis-cli quoting rules and run through the shared
+// command table. Connections starting with a RESP array are served RESP
+// instead, since cluster redirections point clients at this port.
 func handleConnection(conn net.Conn, cache *_cache.BoltCache) {
 	defer conn.Close()
 
@@ -21,10 +21,32 @@ func handleConnection(conn net.Conn, cache *_cache.BoltCache) {
 		tc.SetNoDelay(true)
 	}
 
-	reader := bufio.NewReaderSize(conn, 65536)
+	// A line must fit the buffer, so it holds the longest inline command
+	// plus its newline.
+	reader := bufio.NewReaderSize(conn, maxInlineSize+1)
+	if first, err := reader.Peek(1); err != nil {
+		return
+	} else if first[0] == '*' {
+		serveRESP(conn, cache, reader)
+		return
+	}
+
+	out := &syncWriter{w: conn}
+	sess := newSession(cache, protoText, _cache.NewConnSubscriber(out))
+	defer sess.Close()
+	sess.conn = conn
+
+	reply := &textReply{}
 
 	for {
 		line, err := reader.ReadSlice('\n')
+		if err == bufio.ErrBufferFull {
+			// The rest of the line can't be told apart from the next
+			// command, so the connection is closed like on the RESP port.
+			reply.WriteError(errInlineTooBig.Error())
+			out.Write(reply.buf)
+			return
+		}
 		if err != nil {
 			return
 		}
@@ -36,126 +58,87 @@ func handleConnection(conn net.Conn, cache *_cache.BoltCache) {
 		if n > 0 && line[n-1] == '\r' {
 			n--
 		}
-		line = line[:n]
 
-		if n < 4 {
-			continue
+		args, err := splitArgs(line[:n])
+		if err != nil {
+			reply.WriteError(err.Error())
+		} else if len(args) > 0 {
+			sess.Execute(args, reply)
 		}
 
-		parts := strings.Fields(string(line))
-		if len(parts) == 0 {
-			continue
+		// Pipelined commands are answered in one write, once no complete
+		// line is left in the buffer.
+		if len(reply.buf) > 0 && (!hasLine(reader) || sess.handoff != nil) {
+			if _, err := out.Write(reply.buf); err != nil {
+				return
+			}
+			reply.buf = reply.buf[:0]
+		}
+		if sess.handoff != nil {
+			sess.handoff(conn, reader)
+			return
 		}
+	}
+}
 
-		cmd := strings.ToUpper(parts[0])
-
-		switch cmd {
-		case "SET":
-			if len(parts) >= 3 {
-				key, value := parts[1], parts[2]
-				var ttl time.Duration
-				if len(parts) >= 4 {
-					if d, err := time.ParseDuration(parts[3]); err == nil {
-						ttl = d
-					}
-				}
-				cache.Set(key, value, ttl)
-				fmt.Fprintln(conn, "OK")
-			} else {
-				fmt.Fprintln(conn, "ERROR: SET key value [ttl]")
-			}
-		case "GET":
-			if len(parts) >= 2 {
-				key := parts[1]
-				if value, ok := cache.Get(key); ok {
-					fmt.Fprintf(conn, "VALUE %v\n", value)
-				} else {
-					fmt.Fprintln(conn, "NIL")
-				}
-			} else {
-				fmt.Fprintln(conn, "ERROR: GET key")
-			}
-		case "DEL":
-			if len(parts) >= 2 {
-				key := parts[1]
-				cache.Delete(key)
-				fmt.Fprintln(conn, "OK")
-			}
-		case "PING":
-			fmt.Fprintln(conn, "PONG")
-		case "LPUSH":
-			if len(parts) >= 3 {
-				count := cache.LPush(parts[1], parts[2:]...)
-				fmt.Fprintf(conn, "INTEGER %d\n", count)
-			}
-		case "LPOP":
-			if len(parts) >= 2 {
-				if val, ok := cache.LPop(parts[1]); ok {
-					fmt.Fprintf(conn, "VALUE %s\n", val)
-				} else {
-					fmt.Fprintln(conn, "NIL")
-				}
-			}
-		case "SADD":
-			if len(parts) >= 3 {
-				count := cache.SAdd(parts[1], parts[2:]...)
-				fmt.Fprintf(conn, "INTEGER %d\n", count)
-			}
-		case "SMEMBERS":
-			if len(parts) >= 2 {
-				members := cache.SMembers(parts[1])
-				fmt.Fprintf(conn, "ARRAY %s\n", strings.Join(members, " "))
-			}
-		case "HSET":
-			if len(parts) >= 4 {
-				cache.HSet(parts[1], parts[2], parts[3])
-				fmt.Fprintln(conn, "OK")
-			}
-		case "HGET":
-			if len(parts) >= 3 {
-				if val, ok := cache.HGet(parts[1], parts[2]); ok {
-					fmt.Fprintf(conn, "VALUE %s\n", val)
-				} else {
-					fmt.Fprintln(conn, "NIL")
-				}
+func hasLine(r *bufio.Reader) bool {
+	buffered, _ := r.Peek(r.Buffered())
+	return bytes.IndexByte(buffered, '\n') >= 0
+}
+
+// serveRESP serves RESP on a connection of the text port.
+func serveRESP(conn net.Conn, cache *_cache.BoltCache, reader *bufio.Reader) {
+	out := &syncWriter{w: conn}
+	sess := newSession(cache, protoRESP2, nil)
+	sess.subscriber = &respConnSubscriber{out: out, sess: sess}
+	defer sess.Close()
+
+	var buf []byte
+	var args [][]byte
+	chunk := make([]byte, 65536)
+	reply := &respReply{}
+	for {
+		for {
+			var n int
+			var err error
+			args, n, err = parseCommand(buf, args)
+			if err != nil {
+				// The stream can't be resynchronized after a protocol error.
+				reply.WriteError(err.Error())
+				out.Write(reply.buf)
+				return
 			}
-		case "SUBSCRIBE":
-			if len(parts) >= 2 {
-				cache.Subscribe(parts[1], conn)
-				fmt.Fprintf(conn, "SUBSCRIBED %s\n", parts[1])
+			if n == 0 {
+				break
 			}
-		case "PUBLISH":
-			if len(parts) >= 3 {
-				count := cache.Publish(parts[1], strings.Join(parts[2:], " "))
-				fmt.Fprintf(conn, "PUBLISHED %d\n", count)
+			if len(args) > 0 {
+				sess.Execute(args, reply)
 			}
-		case "EVAL":
-
-			if cache.LuaEngine == nil {
-				fmt.Fprintln(conn, "ERROR: Lua scripting disabled")
-				continue
+			buf = buf[n:]
+		}
+		if len(reply.buf) > 0 {
+			if _, err := out.Write(reply.buf); err != nil {
+				return
 			}
+			reply.buf = reply.buf[:0]
+		}
 
-			if len(parts) >= 4 && cache.LuaEngine != nil {
-				script := parts[1]
-				numKeys, _ := strconv.Atoi(parts[2])
-				keys := parts[3 : 3+numKeys]
-				args := parts[3+numKeys:]
-				result := cache.LuaEngine.Execute(script, keys, args)
-				fmt.Fprintf(conn, "RESULT %v\n", result)
-			}
-		case "INFO":
-			info := fmt.Sprintf(
-				"BoltCache keys=%d lua=%v pubsub=%v mode=tcp",
-				cache.Data.Len(),
-				cache.LuaEngine != nil,
-				cache.Config.Features.PubSub,
-			)
-
-			fmt.Fprintln(conn, info)
-
-		default:
-			fmt.Fprintln(conn, "ERROR: Unknown command")
+		n, err := reader.Read(chunk)
+		if err != nil {
+			return
 		}
+		buf = append(buf, chunk[:n]...)
 	}
 }
+
+// respConnSubscriber delivers pub/sub messages to a RESP connection of the
+// text port.
+type respConnSubscriber struct {
+	out  *syncWriter
+	sess *Session
+}
+
+func (s *respConnSubscriber) Deliver(channel, message string) error {
+	_, err := s.out.Write(respMessage(s.sess.Proto(), channel, message))
+	return err
+}
@@ -44,6 +44,45 @@ var apiRoutes = []APIRoute{
 		},
 	},
 
+	// Expiration
+	{
+		Method:  "GET",
+		Path:    "/cache/{key}/ttl",
+		Summary: "Get remaining TTL (-1 = no expiry)",
+		Tag:     "Cache",
+		Responses: map[string]interface{}{
+			"200": map[string]interface{}{"description": "OK"},
+			"404": map[string]interface{}{"description": "Not found"},
+		},
+	},
+	{
+		Method:  "PUT",
+		Path:    "/cache/{key}/ttl",
+		Summary: "Set expiration",
+		Tag:     "Cache",
+		RequestBody: map[string]interface{}{
+			"type": "object",
+			"properties": map[string]interface{}{
+				"ttl":       map[string]interface{}{"type": "string"},
+				"expire_at": map[string]interface{}{"type": "integer"},
+			},
+		},
+		Responses: map[string]interface{}{
+			"200": map[string]interface{}{"description": "OK"},
+			"404": map[string]interface{}{"description": "Not found"},
+		},
+	},
+	{
+		Method:  "DELETE",
+		Path:    "/cache/{key}/ttl",
+		Summary: "Remove expiration",
+		Tag:     "Cache",
+		Responses: map[string]interface{}{
+			"200": map[string]interface{}{"description": "OK"},
+			"404": map[string]interface{}{"description": "Not found"},
+		},
+	},
+
 	// List
 	{
 		Method:  "POST",
@@ -136,6 +175,152 @@ var apiRoutes = []APIRoute{
 		},
 	},
 
+	// Sorted set
+	{
+		Method:  "POST",
+		Path:    "/zset/{key}",
+		Summary: "Add members (ZADD)",
+		Tag:     "Sorted Set",
+		RequestBody: map[string]interface{}{
+			"type": "object",
+			"properties": map[string]interface{}{
+				"members": map[string]interface{}{
+					"type": "array",
+					"items": map[string]interface{}{
+						"type": "object",
+						"properties": map[string]interface{}{
+							"member": map[string]interface{}{"type": "string"},
+							"score":  map[string]interface{}{"type": "number"},
+						},
+					},
+				},
+				"nx": map[string]interface{}{"type": "boolean"},
+				"xx": map[string]interface{}{"type": "boolean"},
+				"gt": map[string]interface{}{"type": "boolean"},
+				"lt": map[string]interface{}{"type": "boolean"},
+				"ch": map[string]interface{}{"type": "boolean"},
+			},
+		},
+		Responses: map[string]interface{}{
+			"200": map[string]interface{}{"description": "OK"},
+		},
+	},
+	{
+		Method:  "GET",
+		Path:    "/zset/{key}",
+		Summary: "Range by rank (start, stop) or score (min, max, offset, count); rev, withscores",
+		Tag:     "Sorted Set",
+		Responses: map[string]interface{}{
+			"200": map[string]interface{}{"description": "OK"},
+		},
+	},
+	{
+		Method:  "GET",
+		Path:    "/zset/{key}/{member}",
+		Summary: "Get member score and rank",
+		Tag:     "Sorted Set",
+		Responses: map[string]interface{}{
+			"200": map[string]interface{}{"description": "OK"},
+			"404": map[string]interface{}{"description": "Not found"},
+		},
+	},
+	{
+		Method:  "DELETE",
+		Path:    "/zset/{key}/{member}",
+		Summary: "Remove member (ZREM)",
+		Tag:     "Sorted Set",
+		Responses: map[string]interface{}{
+			"200": map[string]interface{}{"description": "OK"},
+			"404": map[string]interface{}{"description": "Not found"},
+		},
+	},
+	{
+		Method:  "POST",
+		Path:    "/zset/{key}/{member}/incr",
+		Summary: "Increment member score (ZINCRBY)",
+		Tag:     "Sorted Set",
+		RequestBody: map[string]interface{}{
+			"type": "object",
+			"properties": map[string]interface{}{
+				"increment": map[string]interface{}{"type": "number"},
+			},
+		},
+		Responses: map[string]interface{}{
+			"200": map[string]interface{}{"description": "OK"},
+		},
+	},
+
+	// Geo
+	{
+		Method:  "POST",
+		Path:    "/geo/{key}",
+		Summary: "Add members (GEOADD)",
+		Tag:     "Geo",
+		RequestBody: map[string]interface{}{
+			"type": "object",
+			"properties": map[string]interface{}{
+				"members": map[string]interface{}{
+					"type": "array",
+					"items": map[string]interface{}{
+						"type": "object",
+						"properties": map[string]interface{}{
+							"member":    map[string]interface{}{"type": "string"},
+							"longitude": map[string]interface{}{"type": "number"},
+							"latitude":  map[string]interface{}{"type": "number"},
+						},
+					},
+				},
+				"nx": map[string]interface{}{"type": "boolean"},
+				"xx": map[string]interface{}{"type": "boolean"},
+				"ch": map[string]interface{}{"type": "boolean"},
+			},
+		},
+		Responses: map[string]interface{}{
+			"200": map[string]interface{}{"description": "OK"},
+			"403": map[string]interface{}{"description": "Geo commands disabled"},
+		},
+	},
+	{
+		Method:  "GET",
+		Path:    "/geo/{key}",
+		Summary: "Search from member or lon/lat by radius or width/height; unit, sort, count, any",
+		Tag:     "Geo",
+		Responses: map[string]interface{}{
+			"200": map[string]interface{}{"description": "OK"},
+			"403": map[string]interface{}{"description": "Geo commands disabled"},
+		},
+	},
+	{
+		Method:  "GET",
+		Path:    "/geo/{key}/{member}",
+		Summary: "Get member position and geohash (GEOPOS)",
+		Tag:     "Geo",
+		Responses: map[string]interface{}{
+			"200": map[string]interface{}{"description": "OK"},
+			"404": map[string]interface{}{"description": "Not found"},
+		},
+	},
+	{
+		Method:  "DELETE",
+		Path:    "/geo/{key}/{member}",
+		Summary: "Remove member",
+		Tag:     "Geo",
+		Responses: map[string]interface{}{
+			"200": map[string]interface{}{"description": "OK"},
+			"404": map[string]interface{}{"description": "Not found"},
+		},
+	},
+	{
+		Method:  "GET",
+		Path:    "/geo/{key}/{member}/distance/{other}",
+		Summary: "Distance between two members (GEODIST), ?unit=m|km|ft|mi",
+		Tag:     "Geo",
+		Responses: map[string]interface{}{
+			"200": map[string]interface{}{"description": "OK"},
+			"404": map[string]interface{}{"description": "Not found"},
+		},
+	},
+
 	// Pub/Sub
 	{
 		Method:  "GET",
@@ -187,6 +372,67 @@ var apiRoutes = []APIRoute{
 		},
 	},
 
+	// Transactions
+	{
+		Method:  "POST",
+		Path:    "/tx",
+		Summary: "Run commands atomically (MULTI/EXEC)",
+		Tag:     "Transactions",
+		RequestBody: map[string]interface{}{
+			"type": "object",
+			"properties": map[string]interface{}{
+				"commands": map[string]interface{}{
+					"type":  "array",
+					"items": map[string]interface{}{"type": "array", "items": map[string]interface{}{"type": "string"}},
+				},
+			},
+		},
+		Responses: map[string]interface{}{
+			"200": map[string]interface{}{"description": "OK"},
+			"400": map[string]interface{}{"description": "Invalid command"},
+			"403": map[string]interface{}{"description": "Transactions disabled"},
+		},
+	},
+
+	// Admin
+	{
+		Method:  "POST",
+		Path:    "/admin/save",
+		Summary: "Save to disk (SAVE), or start a background save with ?background=true (BGSAVE)",
+		Tag:     "Admin",
+		Responses: map[string]interface{}{
+			"200": map[string]interface{}{"description": "OK"},
+			"409": map[string]interface{}{"description": "Background save already in progress"},
+			"500": map[string]interface{}{"description": "Save failed"},
+		},
+	},
+	{
+		Method:  "GET",
+		Path:    "/admin/backups",
+		Summary: "List backups of the persistence file, newest first",
+		Tag:     "Admin",
+		Responses: map[string]interface{}{
+			"200": map[string]interface{}{"description": "OK"},
+		},
+	},
+	{
+		Method:  "POST",
+		Path:    "/admin/restore",
+		Summary: "Replace the dataset with a backup",
+		Tag:     "Admin",
+		RequestBody: map[string]interface{}{
+			"type": "object",
+			"properties": map[string]interface{}{
+				"backup": map[string]interface{}{"type": "string"},
+			},
+		},
+		Responses: map[string]interface{}{
+			"200": map[string]interface{}{"description": "OK"},
+			"404": map[string]interface{}{"description": "No such backup"},
+			"500": map[string]interface{}{"description": "Backup is damaged"},
+		},
+	},
+
 	// Auth
 	{
 		Method:  "GET",